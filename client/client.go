@@ -0,0 +1,1517 @@
+// Package client calls the browsing and admin JSON API of a Repocraft
+// server. Its types and methods follow the OpenAPI document the server
+// serves at /api/v1/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is safe for concurrent use.
+type Client struct {
+	// BaseURL of the server, e.g. "https://git.example.com".
+	BaseURL string
+	// AdminToken is sent as a bearer token; only the admin methods need it.
+	AdminToken string
+	// UserToken is sent instead when AdminToken is empty, for the methods
+	// managing a user's own SSH keys. It may be a sudo token.
+	UserToken string
+	// Snapshot, if set, is the ID of a snapshot that Refs, Commit, Compare
+	// and Archive read the repository's refs from; see CreateSnapshot.
+	Snapshot string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Error is a non-2xx response of the API.
+type Error struct {
+	StatusCode int
+	// Code identifies the kind of error, e.g. "repo_not_found"; it is
+	// stable where Message is not.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("repocraft api: %d %s", e.StatusCode, e.Message)
+}
+
+type Ref struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	// Peeled is the object an annotated tag points to.
+	Peeled string `json:"peeled,omitempty"`
+}
+
+type Refs struct {
+	Repo string `json:"repo"`
+	// Head is the ref HEAD points to.
+	Head string `json:"head,omitempty"`
+	// Archived repositories refuse pushes.
+	Archived bool `json:"archived,omitempty"`
+	// Wiki is the path of the repository's wiki, if it has one.
+	Wiki string `json:"wiki,omitempty"`
+	Refs []Ref  `json:"refs"`
+}
+
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"when"`
+}
+
+type Commit struct {
+	Hash      string    `json:"hash"`
+	Tree      string    `json:"tree"`
+	Parents   []string  `json:"parents"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// BatchRefsResult is the refs of one repository of a batch; Error is set
+// when the repository could not be read.
+type BatchRefsResult struct {
+	Refs
+	Error string `json:"error,omitempty"`
+}
+
+type RepoStats struct {
+	Repo          string    `json:"repo"`
+	FetchCount    int64     `json:"fetch_count"`
+	PushCount     int64     `json:"push_count"`
+	UniqueClients int       `json:"unique_clients"`
+	LastFetch     time.Time `json:"last_fetch,omitempty"`
+	LastPush      time.Time `json:"last_push,omitempty"`
+	// HourlyActivity counts fetches and pushes by hour of day (UTC).
+	HourlyActivity [24]int64 `json:"hourly_activity"`
+}
+
+type FetchToken struct {
+	Repo    string    `json:"repo"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type ReplicaStatus struct {
+	URL        string `json:"url"`
+	Checksum   string `json:"checksum,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Consistent bool   `json:"consistent"`
+	Repaired   bool   `json:"repaired,omitempty"`
+}
+
+type ChecksumStatus struct {
+	Repo     string          `json:"repo"`
+	Checksum string          `json:"checksum"`
+	Refs     int             `json:"refs"`
+	Replicas []ReplicaStatus `json:"replicas"`
+}
+
+// MergeRequest asks to merge From into the branch Into of Repo.
+type MergeRequest struct {
+	Repo            string `json:"repo"`
+	Into            string `json:"into"`
+	From            string `json:"from"`
+	Message         string `json:"message,omitempty"`
+	Author          string `json:"author,omitempty"` // "Name <email>"
+	FastForwardOnly bool   `json:"fast_forward_only,omitempty"`
+}
+
+type MergeResult struct {
+	Ref         string `json:"ref"`
+	Old         string `json:"old"`
+	New         string `json:"new"`
+	FastForward bool   `json:"fast_forward"`
+}
+
+type PackReport struct {
+	Valid    bool   `json:"valid"`
+	Objects  uint32 `json:"objects,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Error is git's explanation of why the pack was rejected.
+	Error string `json:"error,omitempty"`
+}
+
+type HookSyncReport struct {
+	Repos   int `json:"repos"`
+	Linked  int `json:"linked"`
+	Removed int `json:"removed"`
+	// Skipped counts template scripts shadowed by a repository's own hook.
+	Skipped int `json:"skipped"`
+}
+
+type Session struct {
+	ID       uint64    `json:"id"`
+	Service  string    `json:"service"`
+	Repo     string    `json:"repo"`
+	Identity string    `json:"identity,omitempty"`
+	State    string    `json:"state"`
+	Start    time.Time `json:"start"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// Change is one difference between the repository manifest and the
+// repositories.
+type Change struct {
+	Repo string `json:"repo"`
+	// Action is "create", "update" or "delete".
+	Action string `json:"action"`
+	Field  string `json:"field,omitempty"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// Refs returns all refs of a repository and the target of HEAD.
+func (c *Client) Refs(ctx context.Context, repo string) (Refs, error) {
+	var out Refs
+	err := c.do(ctx, http.MethodGet, "/api/v1/refs", c.pinned(url.Values{"repo": {repo}}), nil, &out)
+	return out, err
+}
+
+// Snapshot is the state of a repository's refs at one moment. Browsing
+// requests passing its ID resolve revisions in it, so reads spanning
+// several requests see one state while pushes land.
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Repo    string    `json:"repo"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Head    string    `json:"head"`
+	Refs    []Ref     `json:"refs"`
+}
+
+// CreateSnapshot pins the refs of a repository for ttl, or an hour if
+// zero. Set Client.Snapshot to its ID, on a copy of the client, to read
+// from it.
+func (c *Client) CreateSnapshot(ctx context.Context, repo string, ttl time.Duration) (Snapshot, error) {
+	req := struct {
+		Repo string `json:"repo"`
+		TTL  string `json:"ttl,omitempty"`
+	}{Repo: repo}
+	if ttl > 0 {
+		req.TTL = ttl.String()
+	}
+	var out Snapshot
+	err := c.do(ctx, http.MethodPost, "/api/v1/snapshots", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// ReleaseSnapshot drops a snapshot before it expires.
+func (c *Client) ReleaseSnapshot(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/snapshots", url.Values{"id": {id}}, nil, nil)
+}
+
+// pinned adds the client's snapshot to the query of a browsing request.
+func (c *Client) pinned(q url.Values) url.Values {
+	if c.Snapshot != "" {
+		q.Set("snapshot", c.Snapshot)
+	}
+	return q
+}
+
+// Comparison tells how far Head is ahead of and behind Base. MergeBase is
+// empty for unrelated histories.
+type Comparison struct {
+	Repo      string `json:"repo"`
+	Base      string `json:"base"`
+	Head      string `json:"head"`
+	MergeBase string `json:"merge_base"`
+	Ahead     int    `json:"ahead"`
+	Behind    int    `json:"behind"`
+}
+
+// Compare compares head with base, which defaults to HEAD.
+func (c *Client) Compare(ctx context.Context, repo, base, head string) (Comparison, error) {
+	q := url.Values{"repo": {repo}, "head": {head}}
+	if base != "" {
+		q.Set("base", base)
+	}
+	var out Comparison
+	err := c.do(ctx, http.MethodGet, "/api/v1/compare", c.pinned(q), nil, &out)
+	return out, err
+}
+
+// Commit returns a single commit; rev defaults to HEAD.
+func (c *Client) Commit(ctx context.Context, repo, rev string) (Commit, error) {
+	q := url.Values{"repo": {repo}}
+	if rev != "" {
+		q.Set("rev", rev)
+	}
+	var out Commit
+	err := c.do(ctx, http.MethodGet, "/api/v1/commit", c.pinned(q), nil, &out)
+	return out, err
+}
+
+// BatchRefs returns the refs under prefixes, by default branches and tags,
+// of many repositories in one request.
+func (c *Client) BatchRefs(ctx context.Context, repos, prefixes []string) ([]BatchRefsResult, error) {
+	req := struct {
+		Repos    []string `json:"repos"`
+		Prefixes []string `json:"prefixes,omitempty"`
+	}{repos, prefixes}
+	var out struct {
+		Results []BatchRefsResult `json:"results"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/refs/batch", nil, jsonBody(req), &out)
+	return out.Results, err
+}
+
+// Stats returns the activity statistics of a repository.
+func (c *Client) Stats(ctx context.Context, repo string) (RepoStats, error) {
+	var out RepoStats
+	err := c.do(ctx, http.MethodGet, "/api/v1/stats", url.Values{"repo": {repo}}, nil, &out)
+	return out, err
+}
+
+// AllStats returns the activity statistics of every repository with
+// recorded activity.
+func (c *Client) AllStats(ctx context.Context) ([]RepoStats, error) {
+	var out struct {
+		Repos []RepoStats `json:"repos"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/stats", nil, nil, &out)
+	return out.Repos, err
+}
+
+// IssueFetchToken issues a read token for repo; a zero ttl means the
+// server's default of one hour.
+func (c *Client) IssueFetchToken(ctx context.Context, repo string, ttl time.Duration) (FetchToken, error) {
+	req := struct {
+		Repo string `json:"repo"`
+		TTL  string `json:"ttl,omitempty"`
+	}{Repo: repo}
+	if ttl > 0 {
+		req.TTL = ttl.String()
+	}
+	var out FetchToken
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/fetch-tokens", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// Namespace lists the children of a namespace.
+type Namespace struct {
+	Path       string   `json:"path"`
+	Namespaces []string `json:"namespaces"`
+	Repos      []string `json:"repos"`
+}
+
+// Namespace returns the namespaces and repositories directly inside the
+// namespace at path, or at the top level if path is empty.
+func (c *Client) Namespace(ctx context.Context, path string) (Namespace, error) {
+	var q url.Values
+	if path != "" {
+		q = url.Values{"path": {path}}
+	}
+	var out Namespace
+	err := c.do(ctx, http.MethodGet, "/api/v1/namespaces", q, nil, &out)
+	return out, err
+}
+
+// CreateRepo creates an empty repository, and the namespaces above it.
+func (c *Client) CreateRepo(ctx context.Context, repo string) error {
+	req := struct {
+		Repo string `json:"repo"`
+	}{repo}
+	return c.do(ctx, http.MethodPost, "/api/v1/admin/repos", nil, jsonBody(req), nil)
+}
+
+// CreateWiki creates the wiki of an existing repository and returns its
+// path.
+func (c *Client) CreateWiki(ctx context.Context, repo string) (string, error) {
+	req := struct {
+		Repo string `json:"repo"`
+	}{repo}
+	var out struct {
+		Repo string `json:"repo"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/repos/wiki", nil, jsonBody(req), &out)
+	return out.Repo, err
+}
+
+// WikiPage is a page of a wiki.
+type WikiPage struct {
+	// Name is the path without its extension, e.g. "guides/Setup".
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	// Content is only set by Client.WikiPage.
+	Content string `json:"content,omitempty"`
+}
+
+// Wiki lists the pages of a repository's wiki.
+type Wiki struct {
+	Repo   string     `json:"repo"`
+	Wiki   string     `json:"wiki"`
+	Commit string     `json:"commit,omitempty"`
+	Pages  []WikiPage `json:"pages"`
+}
+
+// Wiki returns the pages of repo's wiki.
+func (c *Client) Wiki(ctx context.Context, repo string) (Wiki, error) {
+	var out Wiki
+	err := c.do(ctx, http.MethodGet, "/api/v1/wiki", url.Values{"repo": {repo}}, nil, &out)
+	return out, err
+}
+
+// WikiPage returns the page of repo's wiki with the given name, including
+// its source.
+func (c *Client) WikiPage(ctx context.Context, repo, name string) (WikiPage, error) {
+	var out Wiki
+	err := c.do(ctx, http.MethodGet, "/api/v1/wiki", url.Values{"repo": {repo}, "page": {name}}, nil, &out)
+	if err != nil || len(out.Pages) == 0 {
+		return WikiPage{}, err
+	}
+	return out.Pages[0], nil
+}
+
+// ArchiveOptions select what Archive writes. The zero value is a tar of
+// HEAD without submodules.
+type ArchiveOptions struct {
+	Rev string
+	// Format is "tar", "tar.gz" or "zip".
+	Format string
+	// Prefix is prepended to every path, e.g. "project-1.2/".
+	Prefix string
+	// Submodules includes the submodules hosted on the server, recursively.
+	Submodules bool
+}
+
+// Archive writes a source archive of a commit of repo to w.
+func (c *Client) Archive(ctx context.Context, repo string, opts ArchiveOptions, w io.Writer) error {
+	q := url.Values{"repo": {repo}}
+	for k, v := range map[string]string{"rev": opts.Rev, "format": opts.Format, "prefix": opts.Prefix} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if opts.Submodules {
+		q.Set("submodules", "true")
+	}
+	return c.do(ctx, http.MethodGet, "/api/v1/archive", c.pinned(q), nil, w)
+}
+
+// Transfer moves a repository; requests for the old path are redirected.
+func (c *Client) Transfer(ctx context.Context, from, to string) error {
+	req := struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}{from, to}
+	return c.do(ctx, http.MethodPost, "/api/v1/admin/repos/transfer", nil, jsonBody(req), nil)
+}
+
+// SetArchived archives a repository, so it refuses pushes, or unarchives it.
+func (c *Client) SetArchived(ctx context.Context, repo string, archived bool) error {
+	req := struct {
+		Repo     string `json:"repo"`
+		Archived bool   `json:"archived"`
+	}{repo, archived}
+	return c.do(ctx, http.MethodPost, "/api/v1/admin/repos/archive", nil, jsonBody(req), nil)
+}
+
+// Merge merges a branch or commit into a branch, fast-forwarding when it
+// can. Conflicting merges fail with a conflict error.
+func (c *Client) Merge(ctx context.Context, req MergeRequest) (MergeResult, error) {
+	var out MergeResult
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/repos/merge", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// LegalHold is the legal hold of a repository: every ref when All is set,
+// otherwise Refs.
+type LegalHold struct {
+	Repo   string   `json:"repo"`
+	All    bool     `json:"all"`
+	Refs   []string `json:"refs,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// LegalHold returns the legal hold of a repository.
+func (c *Client) LegalHold(ctx context.Context, repo string) (LegalHold, error) {
+	var out LegalHold
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/repos/legal-hold", url.Values{"repo": {repo}}, nil, &out)
+	return out, err
+}
+
+// PlaceLegalHold holds refs of a repository, or all of them if refs is
+// empty, so they can't be updated or deleted.
+func (c *Client) PlaceLegalHold(ctx context.Context, repo string, refs []string, reason string) (LegalHold, error) {
+	return c.setLegalHold(ctx, repo, true, refs, reason)
+}
+
+// ReleaseLegalHold releases refs of a repository, or everything held if
+// refs is empty.
+func (c *Client) ReleaseLegalHold(ctx context.Context, repo string, refs []string) (LegalHold, error) {
+	return c.setLegalHold(ctx, repo, false, refs, "")
+}
+
+func (c *Client) setLegalHold(ctx context.Context, repo string, hold bool, refs []string, reason string) (LegalHold, error) {
+	req := struct {
+		Repo   string   `json:"repo"`
+		Hold   bool     `json:"hold"`
+		Refs   []string `json:"refs,omitempty"`
+		Reason string   `json:"reason,omitempty"`
+	}{repo, hold, refs, reason}
+	var out LegalHold
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/repos/legal-hold", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// RefUpdate is a recorded ref update. Old is all zeros when it created
+// the ref, New when it deleted it.
+type RefUpdate struct {
+	Time   time.Time `json:"time"`
+	Ref    string    `json:"ref"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+	Pusher string    `json:"pusher,omitempty"`
+}
+
+// RefHistory returns the recorded updates of a repository's refs between
+// since and until, oldest first. Empty ref and zero times don't restrict
+// the updates.
+func (c *Client) RefHistory(ctx context.Context, repo, ref string, since, until time.Time) ([]RefUpdate, error) {
+	q := url.Values{"repo": {repo}}
+	if ref != "" {
+		q.Set("ref", ref)
+	}
+	if !since.IsZero() {
+		q.Set("since", since.Format(time.RFC3339))
+	}
+	if !until.IsZero() {
+		q.Set("until", until.Format(time.RFC3339))
+	}
+	var out struct {
+		Updates []RefUpdate `json:"updates"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/repos/ref-history", q, nil, &out)
+	return out.Updates, err
+}
+
+// RefAt returns the commit ref of a repository pointed to at t according
+// to its recorded history, or "" if the ref didn't exist then.
+func (c *Client) RefAt(ctx context.Context, repo, ref string, t time.Time) (string, error) {
+	var out struct {
+		Target string `json:"target"`
+	}
+	q := url.Values{"repo": {repo}, "ref": {ref}, "at": {t.Format(time.RFC3339)}}
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/repos/ref-history", q, nil, &out)
+	return out.Target, err
+}
+
+// RefRestore is the outcome of RestoreRef. Old is empty when the ref was
+// recreated.
+type RefRestore struct {
+	Ref string `json:"ref"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+}
+
+// RestoreRef points a deleted or force-pushed ref back to to, a commit it
+// pointed to according to its recorded history, or if to is empty to the
+// commit before its last update.
+func (c *Client) RestoreRef(ctx context.Context, repo, ref, to, reason string) (RefRestore, error) {
+	req := struct {
+		Repo   string `json:"repo"`
+		Ref    string `json:"ref"`
+		To     string `json:"to,omitempty"`
+		Reason string `json:"reason,omitempty"`
+	}{repo, ref, to, reason}
+	var out RefRestore
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/repos/ref-history/restore", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// Event is something that happened to a repository: a push, a ref update
+// the server made, or a repository created, transferred, archived,
+// unarchived or deleted. Type is "push", "ref_update", "repo_created",
+// "repo_transferred", "repo_archived", "repo_unarchived" or
+// "repo_deleted".
+type Event struct {
+	// ID resumes the stream after the event.
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Repo string    `json:"repo"`
+	// From is where a transferred repository was before.
+	From    string `json:"from,omitempty"`
+	Actor   string `json:"actor,omitempty"`
+	Updates []struct {
+		Ref string `json:"ref"`
+		Old string `json:"old"`
+		New string `json:"new"`
+	} `json:"updates,omitempty"`
+}
+
+// EventOptions narrow down the events Events follows. Repo is a
+// path.Match pattern such as "team/*"; Types are event types.
+type EventOptions struct {
+	Repo  string
+	Types []string
+}
+
+// Events follows the server's event stream after the event with the
+// given ID, calling fn for each event until ctx is cancelled or fn fails.
+// An empty after starts with new events, "0" with the oldest kept. To
+// resume after an error, call it again with the ID of the last event fn
+// handled.
+func (c *Client) Events(ctx context.Context, after string, opts EventOptions, fn func(Event) error) error {
+	q := url.Values{}
+	if after != "" {
+		q.Set("after", after)
+	}
+	if opts.Repo != "" {
+		q.Set("repo", opts.Repo)
+	}
+	if len(opts.Types) > 0 {
+		q.Set("types", strings.Join(opts.Types, ","))
+	}
+	return c.do(ctx, http.MethodGet, "/api/v1/events", q, nil, &streamReader{fn: func(_ string, data []byte) error {
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("decode event: %w", err)
+		}
+		return fn(e)
+	}})
+}
+
+// LogLine is a line the server logged. Severity is "debug", "info" or
+// "error".
+type LogLine struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+// TailOptions narrow down what Tail follows. Repo is a path.Match pattern
+// of the repositories log lines mention and events are of; User is an
+// identity or address log lines mention and events were made by;
+// Severity is the least severe log line followed.
+type TailOptions struct {
+	Repo     string
+	User     string
+	Severity string
+	// NoLogs and NoEvents leave out log lines and events.
+	NoLogs   bool
+	NoEvents bool
+}
+
+// TailEntry is a log line or an event.
+type TailEntry struct {
+	Log   *LogLine
+	Event *Event
+}
+
+// Tail follows what the server logs and its event log from now on,
+// calling fn for each until ctx is cancelled or fn fails. It needs the
+// admin token.
+func (c *Client) Tail(ctx context.Context, opts TailOptions, fn func(TailEntry) error) error {
+	q := url.Values{}
+	for k, v := range map[string]string{"repo": opts.Repo, "user": opts.User, "severity": opts.Severity} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if opts.NoLogs {
+		q.Set("logs", "false")
+	}
+	if opts.NoEvents {
+		q.Set("events", "false")
+	}
+	return c.do(ctx, http.MethodGet, "/api/v1/admin/tail", q, nil, &streamReader{fn: func(name string, data []byte) error {
+		var entry TailEntry
+		var err error
+		if name == "log" {
+			entry.Log = &LogLine{}
+			err = json.Unmarshal(data, entry.Log)
+		} else {
+			entry.Event = &Event{}
+			err = json.Unmarshal(data, entry.Event)
+		}
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", name, err)
+		}
+		return fn(entry)
+	}})
+}
+
+// streamReader parses the server-sent events written to it, passing each
+// event's name and data to fn.
+type streamReader struct {
+	fn   func(name string, data []byte) error
+	buf  []byte
+	name string
+	data []byte
+}
+
+func (r *streamReader) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(bytes.TrimSuffix(r.buf[:i], []byte("\r")))
+		r.buf = r.buf[i+1:]
+		if name, ok := strings.CutPrefix(line, "event:"); ok {
+			r.name = strings.TrimPrefix(name, " ")
+			continue
+		}
+		if data, ok := strings.CutPrefix(line, "data:"); ok {
+			r.data = append(r.data, strings.TrimPrefix(data, " ")...)
+			continue
+		}
+		if line != "" {
+			// Comments and ids; the data repeats the ids.
+			continue
+		}
+		name, data := r.name, r.data
+		r.name, r.data = "", nil
+		if len(data) == 0 {
+			continue
+		}
+		if err := r.fn(name, data); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Webhook is an endpoint notified of pushes to a repository. Secret is
+// never returned.
+type Webhook struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	// Events are "push" and "tag"; every event when empty.
+	Events []string `json:"events,omitempty"`
+	// Refs are patterns of the refs sent, with * also matching slashes.
+	Refs []string `json:"refs,omitempty"`
+	// DefaultBranch only sends updates of the default branch.
+	DefaultBranch bool `json:"default_branch,omitempty"`
+}
+
+// Webhooks returns the webhooks of a repository.
+func (c *Client) Webhooks(ctx context.Context, repo string) ([]Webhook, error) {
+	var out struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/repos/webhooks", url.Values{"repo": {repo}}, nil, &out)
+	return out.Webhooks, err
+}
+
+// SaveWebhook adds hook to a repository, replacing its webhook of the same
+// name, and returns the repository's webhooks.
+func (c *Client) SaveWebhook(ctx context.Context, repo string, hook Webhook) ([]Webhook, error) {
+	req := struct {
+		Repo string `json:"repo"`
+		Webhook
+	}{repo, hook}
+	var out struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/repos/webhooks", nil, jsonBody(req), &out)
+	return out.Webhooks, err
+}
+
+// RemoveWebhook removes the named webhook of a repository.
+func (c *Client) RemoveWebhook(ctx context.Context, repo, name string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/admin/repos/webhooks", url.Values{"repo": {repo}, "name": {name}}, nil, nil)
+}
+
+// ExportRule sets an export attribute on the paths matching Pattern in the
+// archives of a repository.
+type ExportRule struct {
+	Pattern string `json:"pattern"`
+	// Attribute is "export-ignore" or "export-subst", or either prefixed
+	// by "-" to unset it.
+	Attribute string `json:"attribute"`
+}
+
+// ExportRules returns the export rules of a repository.
+func (c *Client) ExportRules(ctx context.Context, repo string) ([]ExportRule, error) {
+	var out struct {
+		Rules []ExportRule `json:"rules"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/repos/export-rules", url.Values{"repo": {repo}}, nil, &out)
+	return out.Rules, err
+}
+
+// SetExportRules replaces the export rules of a repository; no rules
+// removes them.
+func (c *Client) SetExportRules(ctx context.Context, repo string, rules []ExportRule) ([]ExportRule, error) {
+	if rules == nil {
+		rules = []ExportRule{}
+	}
+	req := struct {
+		Repo  string       `json:"repo"`
+		Rules []ExportRule `json:"rules"`
+	}{repo, rules}
+	var out struct {
+		Rules []ExportRule `json:"rules"`
+	}
+	err := c.do(ctx, http.MethodPut, "/api/v1/admin/repos/export-rules", nil, jsonBody(req), &out)
+	return out.Rules, err
+}
+
+// SparseProfile is a named set of directories of a repository to clone
+// with a partial clone filter and a cone-mode sparse checkout.
+type SparseProfile struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Paths       []string `json:"paths"`
+	// Filter is the partial clone filter; blob:none when empty.
+	Filter string `json:"filter,omitempty"`
+	// Commands clone the repository with the profile. They are only
+	// returned by SparseProfiles.
+	Commands []string `json:"commands,omitempty"`
+}
+
+// SparseProfiles returns the sparse profiles of a repository.
+func (c *Client) SparseProfiles(ctx context.Context, repo string) ([]SparseProfile, error) {
+	var out struct {
+		Profiles []SparseProfile `json:"profiles"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/sparse-profiles", url.Values{"repo": {repo}}, nil, &out)
+	return out.Profiles, err
+}
+
+// SaveSparseProfile adds profile to a repository, replacing its profile of
+// the same name, and returns the repository's profiles.
+func (c *Client) SaveSparseProfile(ctx context.Context, repo string, profile SparseProfile) ([]SparseProfile, error) {
+	profile.Commands = nil
+	req := struct {
+		Repo string `json:"repo"`
+		SparseProfile
+	}{repo, profile}
+	var out struct {
+		Profiles []SparseProfile `json:"profiles"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/repos/sparse-profiles", nil, jsonBody(req), &out)
+	return out.Profiles, err
+}
+
+// RemoveSparseProfile removes the named sparse profile of a repository.
+func (c *Client) RemoveSparseProfile(ctx context.Context, repo, name string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/admin/repos/sparse-profiles", url.Values{"repo": {repo}, "name": {name}}, nil, nil)
+}
+
+// Checksum returns the ref checksum of a repository and of its replicas.
+func (c *Client) Checksum(ctx context.Context, repo string) (ChecksumStatus, error) {
+	var out ChecksumStatus
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/repos/checksum", url.Values{"repo": {repo}}, nil, &out)
+	return out, err
+}
+
+// Repair updates diverged replicas of a repository to match the server.
+func (c *Client) Repair(ctx context.Context, repo string) (ChecksumStatus, error) {
+	req := struct {
+		Repo string `json:"repo"`
+	}{repo}
+	var out ChecksumStatus
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/repos/repair", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// StartMaintenance starts maintenance of a repository outside its window;
+// force starts it even while a push is active.
+func (c *Client) StartMaintenance(ctx context.Context, repo string, force bool) error {
+	req := struct {
+		Repo  string `json:"repo"`
+		Force bool   `json:"force"`
+	}{repo, force}
+	return c.do(ctx, http.MethodPost, "/api/v1/admin/repos/maintenance", nil, jsonBody(req), nil)
+}
+
+// Encrypt converts a repository to encryption at rest.
+func (c *Client) Encrypt(ctx context.Context, repo string) error {
+	req := struct {
+		Repo string `json:"repo"`
+	}{repo}
+	return c.do(ctx, http.MethodPost, "/api/v1/admin/repos/encrypt", nil, jsonBody(req), nil)
+}
+
+// ValidatePack checks a pack against a repository without storing it.
+func (c *Client) ValidatePack(ctx context.Context, repo string, pack io.Reader) (PackReport, error) {
+	var out PackReport
+	err := c.doType(ctx, http.MethodPost, "/api/v1/admin/repos/validate-pack", url.Values{"repo": {repo}}, "application/x-git-packed-objects", pack, &out)
+	return out, err
+}
+
+// SyncHooks links the hook template into repo, or into every repository
+// when repo is empty.
+func (c *Client) SyncHooks(ctx context.Context, repo string) (HookSyncReport, error) {
+	var q url.Values
+	if repo != "" {
+		q = url.Values{"repo": {repo}}
+	}
+	var out HookSyncReport
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/hooks/sync", q, nil, &out)
+	return out, err
+}
+
+// Sessions lists the git operations in progress.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var out []Session
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/sessions", nil, nil, &out)
+	return out, err
+}
+
+// Provision converges the repositories to the server's manifest and returns
+// the changes made; with dryRun it only reports them.
+func (c *Client) Provision(ctx context.Context, dryRun bool) ([]Change, error) {
+	var q url.Values
+	if dryRun {
+		q = url.Values{"dry_run": {"true"}}
+	}
+	var out struct {
+		Changes []Change `json:"changes"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/provision", q, nil, &out)
+	return out.Changes, err
+}
+
+// ImportRequest names the repositories to import.
+type ImportRequest struct {
+	// Provider is "github" or "gitlab".
+	Provider  string `json:"provider"`
+	Owner     string `json:"owner"`
+	Token     string `json:"token,omitempty"`
+	BaseURL   string `json:"base_url,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Metadata  bool   `json:"metadata,omitempty"`
+}
+
+// ImportJob is the progress of an import.
+type ImportJob struct {
+	ID        int       `json:"id"`
+	Source    string    `json:"source"`
+	Namespace string    `json:"namespace"`
+	State     string    `json:"state"`
+	Total     int       `json:"total"`
+	Imported  int       `json:"imported"`
+	Updated   int       `json:"updated"`
+	Failed    int       `json:"failed"`
+	Current   string    `json:"current"`
+	Errors    []string  `json:"errors"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// StartImport starts importing repositories in the background.
+func (c *Client) StartImport(ctx context.Context, req ImportRequest) (ImportJob, error) {
+	var out ImportJob
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/imports", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// Imports returns the progress of recent imports.
+func (c *Client) Imports(ctx context.Context) ([]ImportJob, error) {
+	var out []ImportJob
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/imports", nil, nil, &out)
+	return out, err
+}
+
+// Import returns the progress of one import.
+func (c *Client) Import(ctx context.Context, id int) (ImportJob, error) {
+	var out ImportJob
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/imports", url.Values{"id": {strconv.Itoa(id)}}, nil, &out)
+	return out, err
+}
+
+// ExportRequest names the repositories to export and where to.
+type ExportRequest struct {
+	// Target is "github", "gitlab" or "repocraft".
+	Target   string   `json:"target"`
+	Owner    string   `json:"owner,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	BaseURL  string   `json:"base_url,omitempty"`
+	Repos    []string `json:"repos,omitempty"`
+	Prefix   string   `json:"prefix,omitempty"`
+	Metadata bool     `json:"metadata,omitempty"`
+	// Submodules also exports the repositories on the server that the
+	// selected ones use as submodules.
+	Submodules bool `json:"submodules,omitempty"`
+}
+
+// ExportJob is the progress of an export. Metadata is a provisioning
+// manifest when the export was started with Metadata.
+type ExportJob struct {
+	ID       int             `json:"id"`
+	Target   string          `json:"target"`
+	State    string          `json:"state"`
+	Total    int             `json:"total"`
+	Exported int             `json:"exported"`
+	Failed   int             `json:"failed"`
+	Current  string          `json:"current"`
+	Errors   []string        `json:"errors"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// StartExport starts exporting repositories in the background.
+func (c *Client) StartExport(ctx context.Context, req ExportRequest) (ExportJob, error) {
+	var out ExportJob
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/exports", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// Exports returns the progress of recent exports.
+func (c *Client) Exports(ctx context.Context) ([]ExportJob, error) {
+	var out []ExportJob
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/exports", nil, nil, &out)
+	return out, err
+}
+
+// Export returns the progress of one export.
+func (c *Client) Export(ctx context.Context, id int) (ExportJob, error) {
+	var out ExportJob
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/exports", url.Values{"id": {strconv.Itoa(id)}}, nil, &out)
+	return out, err
+}
+
+// PurgeRequest names the files to remove from the history of a
+// repository.
+type PurgeRequest struct {
+	Repo string `json:"repo"`
+	// Paths are files or directories to remove from every commit.
+	Paths []string `json:"paths,omitempty"`
+	// Blobs are IDs of file contents to remove wherever they appear.
+	Blobs  []string `json:"blobs,omitempty"`
+	Reason string   `json:"reason"`
+	// DryRun only reports the refs that would change.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// PurgeRefChange is a ref moved to rewritten history; New is empty for
+// deleted refs.
+type PurgeRefChange struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// PurgeJob is the progress of a purge.
+type PurgeJob struct {
+	ID               int              `json:"id"`
+	Repo             string           `json:"repo"`
+	Paths            []string         `json:"paths"`
+	Blobs            []string         `json:"blobs"`
+	Reason           string           `json:"reason"`
+	DryRun           bool             `json:"dry_run"`
+	State            string           `json:"state"`
+	Step             string           `json:"step"`
+	RewrittenCommits int              `json:"rewritten_commits"`
+	Refs             []PurgeRefChange `json:"refs"`
+	Replicas         []ReplicaStatus  `json:"replicas"`
+	Error            string           `json:"error"`
+	Started          time.Time        `json:"started"`
+	Finished         time.Time        `json:"finished"`
+}
+
+// StartPurge starts removing files from the history of a repository in the
+// background.
+func (c *Client) StartPurge(ctx context.Context, req PurgeRequest) (PurgeJob, error) {
+	var out PurgeJob
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/purges", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// Purges returns the progress of recent purges.
+func (c *Client) Purges(ctx context.Context) ([]PurgeJob, error) {
+	var out []PurgeJob
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/purges", nil, nil, &out)
+	return out, err
+}
+
+// Purge returns the progress of one purge.
+func (c *Client) Purge(ctx context.Context, id int) (PurgeJob, error) {
+	var out PurgeJob
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/purges", url.Values{"id": {strconv.Itoa(id)}}, nil, &out)
+	return out, err
+}
+
+// RuntimeConfig is what a running server reports about itself.
+type RuntimeConfig struct {
+	Started   time.Time `json:"started"`
+	Uptime    string    `json:"uptime"`
+	GoVersion string    `json:"go_version"`
+	// Status is "ok", or "degraded" when a component is failing.
+	Status string `json:"status"`
+	// Settings are the effective settings, with secrets redacted.
+	Settings map[string]string          `json:"settings"`
+	Features map[string]bool            `json:"features"`
+	Health   map[string]ComponentHealth `json:"health"`
+}
+
+// ComponentHealth is the result of one component's health check.
+type ComponentHealth struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// RuntimeConfig returns the server's effective configuration, enabled
+// features and component health.
+func (c *Client) RuntimeConfig(ctx context.Context) (RuntimeConfig, error) {
+	var out RuntimeConfig
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/config", nil, nil, &out)
+	return out, err
+}
+
+// FeatureFlag is the rollout state of a feature. Repos and Identities
+// override Enabled for matching repositories and clients; Percent turns a
+// disabled flag on for that share of clients.
+type FeatureFlag struct {
+	Enabled    bool            `json:"enabled"`
+	Repos      map[string]bool `json:"repos,omitempty"`
+	Identities map[string]bool `json:"identities,omitempty"`
+	Percent    float64         `json:"percent,omitempty"`
+}
+
+// FeatureFlags returns the server's feature flags by name.
+func (c *Client) FeatureFlags(ctx context.Context) (map[string]FeatureFlag, error) {
+	var out map[string]FeatureFlag
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/flags", nil, nil, &out)
+	return out, err
+}
+
+// Capture is a profile or execution trace of the server, recorded in the
+// background. Kind is "cpu", "trace", "heap", "allocs" or "goroutine".
+type Capture struct {
+	ID       int       `json:"id"`
+	Kind     string    `json:"kind"`
+	Duration string    `json:"duration,omitempty"`
+	State    string    `json:"state"`
+	Size     int64     `json:"size,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// StartCapture starts a capture of kind. CPU profiles and traces record
+// for duration, e.g. "30s"; empty means the server's default.
+func (c *Client) StartCapture(ctx context.Context, kind, duration string) (Capture, error) {
+	var out Capture
+	req := map[string]string{"kind": kind}
+	if duration != "" {
+		req["duration"] = duration
+	}
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/diagnostics", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// Captures returns the recent captures.
+func (c *Client) Captures(ctx context.Context) ([]Capture, error) {
+	var out []Capture
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/diagnostics", nil, nil, &out)
+	return out, err
+}
+
+// Capture returns the state of one capture.
+func (c *Client) Capture(ctx context.Context, id int) (Capture, error) {
+	var out Capture
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/diagnostics", url.Values{"id": {strconv.Itoa(id)}}, nil, &out)
+	return out, err
+}
+
+// DownloadCapture writes the file of a finished capture to w.
+func (c *Client) DownloadCapture(ctx context.Context, id int, w io.Writer) error {
+	return c.do(ctx, http.MethodGet, "/api/v1/admin/diagnostics/download", url.Values{"id": {strconv.Itoa(id)}}, nil, w)
+}
+
+// DebugToggle reports whether debug logging of a subsystem is on.
+type DebugToggle struct {
+	Subsystem   string `json:"subsystem"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// DebugToggles returns the subsystems with their debug logging state.
+func (c *Client) DebugToggles(ctx context.Context) ([]DebugToggle, error) {
+	var out []DebugToggle
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/debug", nil, nil, &out)
+	return out, err
+}
+
+// SetDebug turns debug logging of subsystem, or of "all", on or off.
+func (c *Client) SetDebug(ctx context.Context, subsystem string, enabled bool) ([]DebugToggle, error) {
+	var out []DebugToggle
+	req := struct {
+		Subsystem string `json:"subsystem"`
+		Enabled   bool   `json:"enabled"`
+	}{subsystem, enabled}
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/debug", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// FreezeWindow is a period during which pushes to some branches are
+// refused, either recurring on Schedule for Duration or from Start to End.
+// Frozen reports whether pushes are refused now.
+type FreezeWindow struct {
+	Name     string          `json:"name"`
+	Schedule string          `json:"schedule,omitempty"`
+	Duration string          `json:"duration,omitempty"`
+	Timezone string          `json:"timezone,omitempty"`
+	Start    *time.Time      `json:"start,omitempty"`
+	End      *time.Time      `json:"end,omitempty"`
+	Repos    []string        `json:"repos,omitempty"`
+	Refs     []string        `json:"refs,omitempty"`
+	Reason   string          `json:"reason"`
+	Active   bool            `json:"active"`
+	Ends     *time.Time      `json:"ends,omitempty"`
+	Opens    *time.Time      `json:"opens,omitempty"`
+	Override *FreezeOverride `json:"override,omitempty"`
+	Frozen   bool            `json:"frozen"`
+}
+
+// FreezeOverride lifts a freeze window until Until.
+type FreezeOverride struct {
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+// FreezeWindows returns the server's freeze windows.
+func (c *Client) FreezeWindows(ctx context.Context) ([]FreezeWindow, error) {
+	var out []FreezeWindow
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/freezes", nil, nil, &out)
+	return out, err
+}
+
+// OverrideFreeze lifts the named freeze window until until, or until its
+// current occurrence ends if until is zero.
+func (c *Client) OverrideFreeze(ctx context.Context, name string, until time.Time, reason string) (FreezeWindow, error) {
+	req := struct {
+		Name   string     `json:"name"`
+		Until  *time.Time `json:"until,omitempty"`
+		Reason string     `json:"reason"`
+	}{Name: name, Reason: reason}
+	if !until.IsZero() {
+		req.Until = &until
+	}
+	var out FreezeWindow
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/freezes/override", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// RemoveFreezeOverride puts the named freeze window back in force.
+func (c *Client) RemoveFreezeOverride(ctx context.Context, name string) (FreezeWindow, error) {
+	var out FreezeWindow
+	err := c.do(ctx, http.MethodDelete, "/api/v1/admin/freezes/override", url.Values{"name": {name}}, nil, &out)
+	return out, err
+}
+
+// UserToken identifies a user to the user endpoints until it expires.
+type UserToken struct {
+	User    string    `json:"user"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// IssueUserToken issues a token with which user manages their own SSH
+// keys; ttl defaults to one hour when zero.
+func (c *Client) IssueUserToken(ctx context.Context, user string, ttl time.Duration) (UserToken, error) {
+	req := struct {
+		User string `json:"user"`
+		TTL  string `json:"ttl,omitempty"`
+	}{User: user}
+	if ttl > 0 {
+		req.TTL = ttl.String()
+	}
+	var out UserToken
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/user-tokens", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// SudoToken lets automation act as User within Scopes until it expires.
+// Use it as Client.UserToken.
+type SudoToken struct {
+	User    string    `json:"user"`
+	Actor   string    `json:"actor"`
+	Scopes  []string  `json:"scopes"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// IssueSudoToken issues a token with which actor, e.g. "support-bot", acts
+// as user within scopes, "keys:read" and "keys:write"; ttl defaults to one
+// hour when zero. reason is recorded in the audit log.
+func (c *Client) IssueSudoToken(ctx context.Context, user, actor string, scopes []string, reason string, ttl time.Duration) (SudoToken, error) {
+	req := struct {
+		User   string   `json:"user"`
+		Actor  string   `json:"actor"`
+		Scopes []string `json:"scopes"`
+		Reason string   `json:"reason"`
+		TTL    string   `json:"ttl,omitempty"`
+	}{User: user, Actor: actor, Scopes: scopes, Reason: reason}
+	if ttl > 0 {
+		req.TTL = ttl.String()
+	}
+	var out SudoToken
+	err := c.do(ctx, http.MethodPost, "/api/v1/admin/sudo-tokens", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// AuditEntry records something an admin or a sudo token did on behalf of
+// a user.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Actor is "admin" or the actor of a sudo token.
+	Actor  string   `json:"actor"`
+	User   string   `json:"user"`
+	Action string   `json:"action"`
+	Status int      `json:"status,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// AuditLog returns what was done on behalf of user, or of anyone if user
+// is empty, oldest first.
+func (c *Client) AuditLog(ctx context.Context, user string) ([]AuditEntry, error) {
+	var out struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/audit", userQuery(user), nil, &out)
+	return out.Entries, err
+}
+
+// UserKey is an SSH key a user registered.
+type UserKey struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Title       string    `json:"title,omitempty"`
+	Added       time.Time `json:"added"`
+	// Expires and LastUsed are nil for keys without expiry and keys not
+	// used yet.
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// userQuery names the user whose keys an admin manages; with a user token
+// user is empty.
+func userQuery(user string) url.Values {
+	if user == "" {
+		return nil
+	}
+	return url.Values{"user": {user}}
+}
+
+// UserKeys returns the SSH keys of the user of UserToken, or with the
+// admin token those of user.
+func (c *Client) UserKeys(ctx context.Context, user string) ([]UserKey, error) {
+	var out struct {
+		Keys []UserKey `json:"keys"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/user/keys", userQuery(user), nil, &out)
+	return out.Keys, err
+}
+
+// AddUserKey registers a public key in authorized_keys form until
+// expires, or without expiry if it is zero; title defaults to the key's
+// comment. Adding a key again returns the key already registered.
+func (c *Client) AddUserKey(ctx context.Context, user, key, title string, expires time.Time) (UserKey, error) {
+	req := struct {
+		Key     string     `json:"key"`
+		Title   string     `json:"title,omitempty"`
+		Expires *time.Time `json:"expires,omitempty"`
+	}{Key: key, Title: title}
+	if !expires.IsZero() {
+		req.Expires = &expires
+	}
+	var out UserKey
+	err := c.do(ctx, http.MethodPost, "/api/v1/user/keys", userQuery(user), jsonBody(req), &out)
+	return out, err
+}
+
+// RemoveUserKey removes the key with fingerprint, e.g. "SHA256:...".
+func (c *Client) RemoveUserKey(ctx context.Context, user, fingerprint string) error {
+	q := userQuery(user)
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("fingerprint", fingerprint)
+	return c.do(ctx, http.MethodDelete, "/api/v1/user/keys", q, nil, nil)
+}
+
+// DeviceCode is the code of a push refused for lack of credentials.
+type DeviceCode struct {
+	Code string `json:"code"`
+	Repo string `json:"repo"`
+	// Client is the address whose pushes are approved.
+	Client string `json:"client"`
+	// Expires is when the approval ends.
+	Expires time.Time `json:"expires"`
+	User    string    `json:"user"`
+}
+
+// ApproveDeviceCode approves the code of a refused push, so that pushes to
+// its repository from its client are accepted for a while. It needs a user
+// token of the user approving, and no admin token.
+func (c *Client) ApproveDeviceCode(ctx context.Context, code string) (DeviceCode, error) {
+	req := struct {
+		Code string `json:"code"`
+	}{code}
+	var out DeviceCode
+	err := c.do(ctx, http.MethodPost, "/api/v1/user/device-codes", nil, jsonBody(req), &out)
+	return out, err
+}
+
+// StaleUserKey is a key flagged by the stale key report; Reason is
+// "expired", "expiring" or "unused".
+type StaleUserKey struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+	UserKey
+}
+
+// StaleUserKeys returns the registered keys that expired, expire within
+// expiringWithin, or weren't used for unusedFor. Zero durations use the
+// server's defaults of 14 and 90 days.
+func (c *Client) StaleUserKeys(ctx context.Context, unusedFor, expiringWithin time.Duration) ([]StaleUserKey, error) {
+	q := url.Values{}
+	if unusedFor > 0 {
+		q.Set("unused_for", unusedFor.String())
+	}
+	if expiringWithin > 0 {
+		q.Set("expiring_within", expiringWithin.String())
+	}
+	var out struct {
+		Keys []StaleUserKey `json:"keys"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/user-keys/stale", q, nil, &out)
+	return out.Keys, err
+}
+
+// Credential is the recorded use of an SSH key, token or HTTP user. Tokens
+// are identified by the start of their SHA-256. Flags are "unused",
+// "new_source", "many_sources", "many_repos" or "resumed".
+type Credential struct {
+	Kind      string           `json:"kind"`
+	ID        string           `json:"id"`
+	Owner     string           `json:"owner,omitempty"`
+	Actor     string           `json:"actor,omitempty"`
+	FirstUsed time.Time        `json:"first_used"`
+	LastUsed  time.Time        `json:"last_used"`
+	Uses      int64            `json:"uses"`
+	Ops       map[string]int64 `json:"ops"`
+	Repos     []CredentialSeen `json:"repos,omitempty"`
+	Sources   []CredentialSeen `json:"sources,omitempty"`
+	Resumed   *time.Time       `json:"resumed,omitempty"`
+	Flags     []string         `json:"flags,omitempty"`
+}
+
+// CredentialSeen is a repository a credential touched or an address it was
+// used from.
+type CredentialSeen struct {
+	Name  string    `json:"name"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	Uses  int64     `json:"uses"`
+}
+
+// CredentialOptions narrow down the credential usage report. Kind is
+// "ssh_key", "fetch_token", "user_token", "sudo_token" or "http_user";
+// UnusedFor defaults to the server's 90 days.
+type CredentialOptions struct {
+	Kind      string
+	Owner     string
+	UnusedFor time.Duration
+	Flagged   bool
+}
+
+// Credentials reports how credentials were used, most recently used first.
+func (c *Client) Credentials(ctx context.Context, opts CredentialOptions) ([]Credential, error) {
+	q := url.Values{}
+	if opts.Kind != "" {
+		q.Set("kind", opts.Kind)
+	}
+	if opts.Owner != "" {
+		q.Set("owner", opts.Owner)
+	}
+	if opts.UnusedFor > 0 {
+		q.Set("unused_for", opts.UnusedFor.String())
+	}
+	if opts.Flagged {
+		q.Set("flagged", "true")
+	}
+	var out struct {
+		Credentials []Credential `json:"credentials"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/admin/credentials", q, nil, &out)
+	return out.Credentials, err
+}
+
+func jsonBody(v any) io.Reader {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err) // the request types always marshal
+	}
+	return bytes.NewReader(b)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, out any) error {
+	return c.doType(ctx, method, path, query, "application/json", body, out)
+}
+
+func (c *Client) doType(ctx context.Context, method, path string, query url.Values, contentType string, body io.Reader, out any) error {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	} else if c.UserToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.UserToken)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e) != nil || e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &Error{StatusCode: resp.StatusCode, Code: e.Code, Message: e.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if w, ok := out.(io.Writer); ok {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s response: %w", path, err)
+	}
+	return nil
+}
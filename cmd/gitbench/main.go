@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/client"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/bench"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repogen"
+)
+
+// gitbench runs concurrent clones, fetches and pushes against a
+// repository and reports their latencies.
+func main() {
+	cfg := bench.Config{}
+	flag.StringVar(&cfg.URL, "url", "", "repository to load, e.g. http://localhost:8080/bench/load.git")
+	flag.IntVar(&cfg.Clients, "clients", 8, "concurrent clients")
+	flag.DurationVar(&cfg.Duration, "duration", 30*time.Second, "how long to run")
+	flag.IntVar(&cfg.Requests, "requests", 0, "stop after this many operations instead")
+	mix := flag.String("mix", "clone=1,fetch=8,push=1", "weights of the operations")
+	flag.StringVar(&cfg.Protocol, "protocol", "", "protocol version clients ask for (0, 1 or 2)")
+	flag.IntVar(&cfg.Depth, "depth", 0, "make clones shallow with this depth")
+	flag.StringVar(&cfg.Filter, "filter", "", "make clones partial, e.g. blob:none")
+	flag.IntVar(&cfg.Behind, "behind", 10, "commits fetching clients lag behind")
+	flag.IntVar(&cfg.PushSize, "push-size", 4096, "bytes of new content per push")
+	seed := flag.Bool("seed", false, "push a generated repository to -url first")
+	seedCommits := flag.Int("seed-commits", 200, "commits of the generated repository")
+	seedFiles := flag.Int("seed-files", 100, "files of the generated repository")
+	seedBlobSize := flag.Int("seed-max-blob-size", 16<<10, "largest blob of the generated repository")
+	seedBinary := flag.Float64("seed-binary-ratio", 0.1, "fraction of binary files of the generated repository")
+	adminToken := flag.String("admin-token", os.Getenv("REPOCRAFT_ADMIN_TOKEN"), "with -seed, create the repository through the admin API")
+	jsonOut := flag.Bool("json", false, "print the report as JSON")
+	flag.StringVar(&cfg.WorkDir, "workdir", "", "directory for the clients' repositories")
+	flag.Parse()
+
+	if cfg.URL == "" {
+		fmt.Fprintln(os.Stderr, "gitbench: -url is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	if cfg.Mix, err = parseMix(*mix); err != nil {
+		fmt.Fprintf(os.Stderr, "gitbench: -mix: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *seed {
+		cfg.Seed = &repogen.Shape{
+			Commits:     *seedCommits,
+			Files:       *seedFiles,
+			MinBlobSize: 64,
+			MaxBlobSize: *seedBlobSize,
+			BinaryRatio: *seedBinary,
+			Seed:        1,
+		}
+		if *adminToken != "" {
+			if err := createRepo(ctx, cfg.URL, *adminToken); err != nil {
+				fmt.Fprintf(os.Stderr, "gitbench: create repository: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	runner := &bench.Runner{Config: cfg}
+	report, err := runner.Run(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gitbench: %v\n", err)
+		os.Exit(1)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		printReport(report)
+	}
+	if report.Failed() > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseMix parses weights such as "clone=1,fetch=8,push=1".
+func parseMix(s string) (map[bench.Op]int, error) {
+	mix := make(map[bench.Op]int)
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, weight, ok := strings.Cut(part, "=")
+		if !ok {
+			weight = "1"
+		}
+		op := bench.Op(name)
+		known := false
+		for _, o := range bench.Ops {
+			known = known || o == op
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid weight %q", weight)
+		}
+		mix[op] = n
+	}
+	return mix, nil
+}
+
+// createRepo creates the repository at repoURL, a githttpd URL, unless it
+// exists.
+func createRepo(ctx context.Context, repoURL, token string) error {
+	u, err := url.Parse(repoURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("-admin-token needs an http(s) -url")
+	}
+	c := &client.Client{BaseURL: u.Scheme + "://" + u.Host, AdminToken: token}
+	err = c.CreateRepo(ctx, strings.TrimPrefix(u.Path, "/"))
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.Code == "repo_exists" {
+		return nil
+	}
+	return err
+}
+
+func printReport(r bench.Report) {
+	fmt.Printf("%s, %d clients, %s\n\n", r.URL, r.Clients, r.Duration)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcount\terrors\tper second\tp50\tp90\tp99\tmax\t")
+	for _, s := range r.Ops {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%s\t%s\t%s\t%s\t\n", s.Op, s.Count, s.Errors, s.PerSecond, s.P50, s.P90, s.P99, s.Max)
+	}
+	tw.Flush()
+	for _, s := range r.Ops {
+		for _, msg := range s.Messages {
+			fmt.Printf("\n%s error: %s", s.Op, msg)
+		}
+	}
+	if r.Failed() > 0 {
+		fmt.Println()
+	}
+}
@@ -1,28 +1,133 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/access"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/accounting"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/admission"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/api"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/bundles"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/celpolicy"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/commitpolicy"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/cryptopolicy"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/deviceauth"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/discovery"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/exporter"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/faults"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/featureflag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
 	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/httpsmart"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/htpasswd"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/importer"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/introspect"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/listener"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/loadshed"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/locale"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/maintenance"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/malscan"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/metrics"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/purge"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/reclaim"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refhistory"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refpin"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/replication"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/secrets"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/signedurl"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/snapshot"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/telemetry"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/tracing"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/userkeys"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/warmup"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/wasmhook"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/webhook"
 )
 
 const (
-	repoRoot        = "./.repositories"
-	httpListenAddr  = ":8080"
-	uploadPackPath  = ""
-	receivePackPath = ""
+	repoRoot         = "./.repositories"
+	statsPath        = "./.repocraft/stats.json"
+	sshStatsPath     = "./.repocraft/ssh-stats.json"
+	redirectsPath    = "./.repocraft/redirects.json"
+	accountingPath   = "./.repocraft/accounting.jsonl"
+	pushSessionsDir  = "./.repocraft/push-sessions"
+	auditPath        = "./.repocraft/audit.jsonl"
+	reclaimedPath    = "./.repocraft/reclaimed.jsonl"
+	refHistoryDir    = "./.repocraft/ref-history"
+	eventsDir        = "./.repocraft/events"
+	snapshotsDir     = "./.repocraft/snapshots"
+	credentialsDir   = "./.repocraft/credentials"
+	diagnosticsDir   = "./.repocraft/diagnostics"
+	maxConcurrentOps = 32
+	httpListenAddr   = ":8080"
+	uploadPackPath   = ""
+	receivePackPath  = ""
 )
 
+// loadThresholds start load shedding: load per CPU, and percentages of
+// time stalled on memory or waiting for I/O.
+var loadThresholds = loadshed.Thresholds{Load: 2, MemoryPressure: 20, IOWait: 40}
+
+// negotiationLimits turn away pathological fetch requests.
+var negotiationLimits = service.NegotiationLimits{MaxWants: 100000, MaxHaves: 50000, MaxDepth: 100000, MaxDeepenNot: 100}
+
 // githttpd launches a Smart HTTP server on :8080.
 // Repositories are served from ./.repositories by default.
 func main() {
+	// Admins see what this instance runs with at /api/v1/admin/config.
+	info := &introspect.Registry{Started: time.Now()}
+	info.SetEnv("REPOCRAFT_")
+
+	// Admins follow the log at /api/v1/admin/tail.
+	logTail := &diag.LogTail{}
+	log.SetOutput(io.MultiWriter(os.Stderr, logTail))
+	// REPOCRAFT_LOG_FORMAT=json or text logs structured records, one per
+	// line, for log pipelines to parse.
+	logger, err := diag.NewLogger(os.Getenv("REPOCRAFT_LOG_FORMAT"), io.MultiWriter(os.Stderr, logTail))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_LOG_FORMAT: %v\n", err)
+		os.Exit(1)
+	}
+
+	// REPOCRAFT_DEBUG, e.g. "http,git" or "all", turns on debug logging of
+	// subsystems from the start; admins switch it at /api/v1/admin/debug.
+	if err := diag.EnableDebug(os.Getenv("REPOCRAFT_DEBUG")); err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_DEBUG: %v\n", err)
+		os.Exit(1)
+	}
+	// REPOCRAFT_FAULTS, e.g. "drop=0.05,delay=0.1:250ms", injects transport
+	// faults in builds with -tags faultinjection.
+	if err := faults.Configure(os.Getenv("REPOCRAFT_FAULTS")); err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_FAULTS: %v\n", err)
+		os.Exit(1)
+	}
+
 	rootAbs, err := filepath.Abs(repoRoot)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "resolve repo root: %v\n", err)
@@ -34,29 +139,960 @@ func main() {
 		os.Exit(1)
 	}
 
-	handler := &httpsmart.Server{
-		RepoRoot:        rootAbs,
-		UploadPackPath:  uploadPackPath,
-		ReceivePackPath: receivePackPath,
+	// gitsshd keeps its statistics next to ours; warmup and the API see
+	// both.
+	stats := &repostats.Store{Path: statsPath, Peers: []string{sshStatsPath}}
+	if err := stats.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	statsCtx, stopStats := context.WithCancel(context.Background())
+	statsDone := make(chan struct{})
+	go func() {
+		defer close(statsDone)
+		if err := stats.Run(statsCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}()
+	defer func() {
+		stopStats()
+		<-statsDone
+	}()
+
+	redirects := &repoadmin.RedirectStore{Path: redirectsPath}
+	if err := redirects.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	repos := &repo.Cache{}
+	defer repos.Close()
+
+	accountingSink, err := accounting.OpenFileSink(accountingPath, "jsonl")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer accountingSink.Close()
+	recorder := &accounting.Recorder{Sink: accountingSink, Transport: "http"}
+	// Every git invocation is accounted; the server logs it with its
+	// resource usage.
+	onFinish := recorder.Observe
+
+	// REPOCRAFT_CRYPTO_POLICY=fips limits TLS and token signing to FIPS
+	// algorithms; builds with GOEXPERIMENT=boringcrypto always do.
+	cryptoPolicy, err := cryptopolicy.Parse(os.Getenv("REPOCRAFT_CRYPTO_POLICY"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_CRYPTO_POLICY: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Keys and tokens come from REPOCRAFT_SECRETS (e.g. file:/run/secrets,
+	// vault:https://vault:8200 or aws:us-east-1), by default from
+	// REPOCRAFT_* variables. Rotated secrets are picked up every few minutes.
+	secretsSpec := os.Getenv("REPOCRAFT_SECRETS")
+	if secretsSpec == "" {
+		secretsSpec = "env:REPOCRAFT_"
+	}
+	secretProvider, err := secrets.Parse(secretsSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_SECRETS: %v\n", err)
+		os.Exit(1)
+	}
+	secretWatcher := &secrets.Watcher{Provider: secretProvider}
+	secretsCtx, stopSecrets := context.WithCancel(context.Background())
+	defer stopSecrets()
+
+	// Signed fetch tokens are enabled when a signing key is provided.
+	var fetchTokens *signedurl.Signer
+	err = secretWatcher.Watch(secretsCtx, "fetch-token-key", func(key []byte) error {
+		key = bytes.TrimSpace(key)
+		if err := cryptoPolicy.CheckHMACKey(key); err != nil {
+			return err
+		}
+		if fetchTokens == nil {
+			fetchTokens = &signedurl.Signer{Key: key}
+		} else {
+			fetchTokens.Rotate(key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "fetch-token-key: %v\n", err)
+		os.Exit(1)
+	}
+	// A certificate bundle (chain and private key, PEM) switches to HTTPS.
+	var certificate *secrets.Certificate
+	err = secretWatcher.Watch(secretsCtx, "tls-certificate", func(pem []byte) error {
+		if certificate == nil {
+			certificate = &secrets.Certificate{}
+		}
+		return certificate.Set(pem)
+	})
+	if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "tls-certificate: %v\n", err)
+		os.Exit(1)
+	}
+	adminToken, err := secretProvider.Secret(secretsCtx, "admin-token")
+	if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "admin-token: %v\n", err)
+		os.Exit(1)
+	}
+	go secretWatcher.Run(secretsCtx)
+
+	// Pushes are replicated to the comma-separated replica base URLs, if any,
+	// or to the non-primary nodes found by REPOCRAFT_DISCOVERY. Replicas are
+	// also verified in the background and repaired when they diverge.
+	var refTransactions service.ReferenceTransactions
+	var replicator *replication.Replicator
+	var replicaDiscovery discovery.Discoverer
+	if spec := os.Getenv("REPOCRAFT_DISCOVERY"); spec != "" {
+		source, err := discovery.Parse(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_DISCOVERY %q: %v\n", spec, err)
+			os.Exit(1)
+		}
+		replicaDiscovery = &discovery.Cache{Source: source}
+	}
+	if urls := os.Getenv("REPOCRAFT_REPLICAS"); urls != "" || replicaDiscovery != nil {
+		replicator = &replication.Replicator{
+			Discovery: replicaDiscovery,
+			RepoRoot:  rootAbs,
+			Repos:     repos,
+		}
+		if urls != "" {
+			replicator.Replicas = strings.Split(urls, ",")
+		}
+		refTransactions = replicator
+		replCtx, stopRepl := context.WithCancel(context.Background())
+		defer stopRepl()
+		go func() {
+			if err := replicator.Run(replCtx); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}()
+	}
+
+	// Repositories are garbage collected in their quietest hour, never
+	// during a push.
+	locks := &repolock.Manager{}
+	scheduler := &maintenance.Scheduler{RepoRoot: rootAbs, Stats: stats, Locks: locks}
+	maintCtx, stopMaint := context.WithCancel(context.Background())
+	defer stopMaint()
+	go scheduler.Run(maintCtx)
+
+	// Every pushed ref update is kept in the ref history for
+	// REPOCRAFT_REF_HISTORY_RETENTION, 90 days by default.
+	refHistory := &refhistory.Store{Dir: refHistoryDir}
+	if v := os.Getenv("REPOCRAFT_REF_HISTORY_RETENTION"); v != "" {
+		refHistory.Retention, err = time.ParseDuration(v)
+		if err != nil || refHistory.Retention <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_REF_HISTORY_RETENTION %q\n", v)
+			os.Exit(1)
+		}
+	}
+	go refHistory.Run(maintCtx)
+
+	// Pushes and repository changes go to the event log, streamed at
+	// /api/v1/events and kept for REPOCRAFT_EVENTS_RETENTION, 7 days by
+	// default.
+	eventLog := &events.Log{Dir: eventsDir}
+	if v := os.Getenv("REPOCRAFT_EVENTS_RETENTION"); v != "" {
+		eventLog.Retention, err = time.ParseDuration(v)
+		if err != nil || eventLog.Retention <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_EVENTS_RETENTION %q\n", v)
+			os.Exit(1)
+		}
+	}
+	go eventLog.Run(maintCtx)
+
+	// Clients pin the refs of a repository for reads spanning several
+	// requests; pins last an hour unless asked otherwise, a day at most.
+	pins := &refpin.Store{Dir: snapshotsDir}
+	go pins.Run(maintCtx)
+
+	// Uses of fetch tokens, HTTP users and user and sudo tokens go to a
+	// file of this daemon's; reports merge those of gitsshd.
+	host, _ := os.Hostname()
+	credentials := &credusage.Store{Dir: credentialsDir, Name: "githttpd-" + host}
+	if err := credentials.Load(); err != nil {
+		log.Printf("credential usage: %v", err)
+	}
+	go credentials.Run(maintCtx)
+	defer func() {
+		if err := credentials.Flush(time.Now()); err != nil {
+			log.Printf("credential usage: %v", err)
+		}
+	}()
+
+	// Pushes are sent to the webhooks configured in each repository, never
+	// to internal addresses unless allowed.
+	webhooks := &webhook.Dispatcher{Egress: newWebhookEgress(cryptoPolicy)}
+	go webhooks.Run(maintCtx)
+	// REPOCRAFT_COMMIT_POLICY names a JSON file of rules the messages of
+	// commits pushed to selected branches must follow.
+	var commitRules service.PushCheck
+	if file := os.Getenv("REPOCRAFT_COMMIT_POLICY"); file != "" {
+		policy, err := commitpolicy.Load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		commitRules = policy
+	}
+	// REPOCRAFT_MALWARE_POLICY names a JSON file of the scanner new blobs
+	// of pushes are sent to, and whether findings block or flag pushes.
+	var malware service.PushCheck
+	if file := os.Getenv("REPOCRAFT_MALWARE_POLICY"); file != "" {
+		policy, err := malscan.Load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		policy.Events = eventLog
+		malware = policy
+	}
+	// With REPOCRAFT_WASM_POLICIES=true, pushes run the WebAssembly policy
+	// plugins admins upload to repositories, each with at most
+	// REPOCRAFT_WASM_POLICY_MEMORY bytes of memory, 64 MiB by default, for
+	// at most REPOCRAFT_WASM_POLICY_TIMEOUT, 5s by default.
+	var (
+		policies    *wasmhook.Runner
+		policyCheck service.PushCheck
+	)
+	if on, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_WASM_POLICIES")); on {
+		policies = &wasmhook.Runner{Logger: logger}
+		if v := os.Getenv("REPOCRAFT_WASM_POLICY_MEMORY"); v != "" {
+			limit, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || limit < 64<<10 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WASM_POLICY_MEMORY %q\n", v)
+				os.Exit(1)
+			}
+			policies.MemoryLimit = limit
+		}
+		if v := os.Getenv("REPOCRAFT_WASM_POLICY_TIMEOUT"); v != "" {
+			timeout, err := time.ParseDuration(v)
+			if err != nil || timeout <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WASM_POLICY_TIMEOUT %q\n", v)
+				os.Exit(1)
+			}
+			policies.Timeout = timeout
+		}
+		policyCheck = policies
+	}
+	refTransactions = service.JoinTransactions(refTransactions, refHistory, webhooks, eventLog)
+
+	// REPOCRAFT_RECLAIM_EMPTY_AFTER, e.g. "720h", removes repositories
+	// nobody pushed to within that time of their creation, and
+	// REPOCRAFT_RECLAIM_NAMESPACES=true namespaces left without
+	// repositories. REPOCRAFT_RECLAIM_DRY_RUN=true only records what would
+	// go.
+	reclaimNamespaces, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_RECLAIM_NAMESPACES"))
+	reclaimDryRun, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_RECLAIM_DRY_RUN"))
+	var reclaimEmptyAfter time.Duration
+	if v := os.Getenv("REPOCRAFT_RECLAIM_EMPTY_AFTER"); v != "" {
+		reclaimEmptyAfter, err = time.ParseDuration(v)
+		if err != nil || reclaimEmptyAfter <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_RECLAIM_EMPTY_AFTER %q\n", v)
+			os.Exit(1)
+		}
+	}
+	if reclaimEmptyAfter > 0 || reclaimNamespaces {
+		record := reclaim.AppendTo(reclaimedPath)
+		collector := &reclaim.Collector{
+			RepoRoot:   rootAbs,
+			EmptyAfter: reclaimEmptyAfter,
+			Namespaces: reclaimNamespaces,
+			DryRun:     reclaimDryRun,
+			Locks:      locks,
+			OnRemove: func(r reclaim.Removal) {
+				repos.Evict(filepath.Join(rootAbs, filepath.FromSlash(r.Path)))
+				record(r)
+				if !r.DryRun && r.Kind == reclaim.KindEmptyRepo {
+					eventLog.Record(events.Event{Type: events.RepoDeleted, Time: r.Time, Repo: r.Path, Actor: "reclaim"})
+				}
+			},
+		}
+		go collector.Run(maintCtx)
+	}
+
+	// REPOCRAFT_PUSH_SESSION_MAX_LENGTH caps the body of a resumable push,
+	// in bytes (default 2 GiB); -1 lifts the cap.
+	pushSessions := &httpsmart.PushSessions{Dir: pushSessionsDir}
+	if v := os.Getenv("REPOCRAFT_PUSH_SESSION_MAX_LENGTH"); v != "" {
+		if pushSessions.MaxLength, err = strconv.ParseInt(v, 10, 64); err != nil || pushSessions.MaxLength == 0 || pushSessions.MaxLength < -1 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_PUSH_SESSION_MAX_LENGTH: %q\n", v)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_PUSH_SESSION_MAX_SESSIONS caps the resumable pushes open
+	// per repository and per client (default 8), and
+	// REPOCRAFT_PUSH_SESSION_MAX_SPOOLED the bytes they may spool
+	// together (default 16 GiB); -1 lifts the caps.
+	if v := os.Getenv("REPOCRAFT_PUSH_SESSION_MAX_SESSIONS"); v != "" {
+		if pushSessions.MaxSessions, err = strconv.Atoi(v); err != nil || pushSessions.MaxSessions == 0 || pushSessions.MaxSessions < -1 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_PUSH_SESSION_MAX_SESSIONS: %q\n", v)
+			os.Exit(1)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_PUSH_SESSION_MAX_SPOOLED"); v != "" {
+		if pushSessions.MaxSpooled, err = strconv.ParseInt(v, 10, 64); err != nil || pushSessions.MaxSpooled == 0 || pushSessions.MaxSpooled < -1 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_PUSH_SESSION_MAX_SPOOLED: %q\n", v)
+			os.Exit(1)
+		}
+	}
+	go pushSessions.Run(maintCtx)
+
+	// Large repositories get a daily clone bundle that clients can download
+	// with resumable range requests.
+	bundleGen := &bundles.Generator{RepoRoot: rootAbs}
+	go bundleGen.Run(maintCtx)
+
+	// REPOCRAFT_HOOK_TEMPLATE names a directory of hook scripts linked into
+	// every repository; new repositories get them on the next sync.
+	var hookTemplate *repoadmin.HookTemplate
+	if dir := os.Getenv("REPOCRAFT_HOOK_TEMPLATE"); dir != "" {
+		dirAbs, err := filepath.Abs(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "resolve hook template: %v\n", err)
+			os.Exit(1)
+		}
+		hookTemplate = &repoadmin.HookTemplate{Dir: dirAbs, RepoRoot: rootAbs}
+		go hookTemplate.Run(maintCtx)
+	}
+
+	// Private repositories and deploy keys are read from the repositories'
+	// provisioned settings. With REPOCRAFT_PROVISION_MANIFEST set, the
+	// repositories are converged to that manifest at startup and every ten
+	// minutes; REPOCRAFT_PROVISION_PRUNE=true deletes those dropped from it.
+	provisioned := &provision.Index{RepoRoot: rootAbs}
+	go provisioned.Run(maintCtx)
+	var provisioner *provision.Reconciler
+	if manifest := os.Getenv("REPOCRAFT_PROVISION_MANIFEST"); manifest != "" {
+		prune, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_PROVISION_PRUNE"))
+		provisioner = &provision.Reconciler{RepoRoot: rootAbs, Manifest: manifest, Prune: prune, Index: provisioned, Events: eventLog}
+		go provisioner.Run(maintCtx)
+	}
+
+	// Admins import repositories from GitHub and GitLab through the API;
+	// REPOCRAFT_IMPORT_RESYNC, e.g. "1h", re-syncs everything imported since
+	// startup at that interval.
+	imports := &importer.Importer{RepoRoot: rootAbs, Index: provisioned, Events: eventLog}
+	if v := os.Getenv("REPOCRAFT_IMPORT_RESYNC"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_IMPORT_RESYNC: %v\n", err)
+			os.Exit(1)
+		}
+		imports.Interval = interval
+		go imports.Run(maintCtx)
+	}
+
+	// Admins purge files from the history of repositories through the API
+	// when git-filter-repo is installed, or REPOCRAFT_FILTER_REPO names it.
+	var purger *purge.Purger
+	filterRepo := os.Getenv("REPOCRAFT_FILTER_REPO")
+	if filterRepo == "" {
+		filterRepo = "git-filter-repo"
+	}
+	if bin, err := exec.LookPath(filterRepo); err == nil {
+		purger = &purge.Purger{RepoRoot: rootAbs, FilterRepoPath: bin, Locks: locks, Replicator: replicator, Repos: repos}
+	} else if os.Getenv("REPOCRAFT_FILTER_REPO") != "" {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_FILTER_REPO: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Anonymous clones are turned away with Retry-After while the host is
+	// overloaded; pushes are never shed.
+	shedder := &loadshed.Shedder{Thresholds: loadThresholds}
+	go func() {
+		if err := shedder.Run(maintCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}()
+
+	// git runs in a process group of its own, with the pack-objects and
+	// hooks it spawns. The group gets SIGTERM when its request is cancelled,
+	// times out or is still running at shutdown, then SIGKILL after
+	// REPOCRAFT_GIT_KILL_GRACE, e.g. "10s", five seconds by default; with
+	// "0", groups get SIGKILL right away.
+	reaper := &service.Reaper{}
+	if v := os.Getenv("REPOCRAFT_GIT_KILL_GRACE"); v != "" {
+		grace, err := time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_GIT_KILL_GRACE %q\n", v)
+			os.Exit(1)
+		}
+		if grace == 0 {
+			grace = -1
+		}
+		reaper.Grace = grace
 	}
+	defer reaper.Shutdown()
+	// REPOCRAFT_UPLOAD_TIMEOUT and REPOCRAFT_RECEIVE_TIMEOUT, e.g. "2h",
+	// bound how long a fetch or a push may run once it has a slot, and
+	// REPOCRAFT_GIT_MAX_DURATION every git invocation; git still running
+	// then is stopped.
+	uploadTimeout := durationEnv("REPOCRAFT_UPLOAD_TIMEOUT")
+	receiveTimeout := durationEnv("REPOCRAFT_RECEIVE_TIMEOUT")
+	maxGitDuration := durationEnv("REPOCRAFT_GIT_MAX_DURATION")
+	sessions := &service.Sessions{}
+
+	// URL namespaces can be served from other roots, e.g.
+	// REPOCRAFT_REPO_MOUNTS=mirrors=/data/mirrors,users=/data/users.
+	mounts, err := service.ParseRepoMounts(os.Getenv("REPOCRAFT_REPO_MOUNTS"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	// Before serving, the repositories in REPOCRAFT_WARMUP_REPOS and the
+	// REPOCRAFT_WARMUP_TOP busiest ones are warmed up, for at most
+	// REPOCRAFT_WARMUP_TIMEOUT (default one minute).
+	warmer, warmupTimeout := newWarmer(service.RepoResolver{Root: rootAbs, Mounts: mounts}, stats)
+	if warmer != nil {
+		warmer.Cache = repos
+	}
+	// REPOCRAFT_HTTP_REWRITES names a file of "pattern replacement" rules rewriting the
+	// repository paths HTTP clients ask for, e.g. "^svn-migrated/(.+)$ legacy/$1.git".
+	var rewrites service.RewriteRules
+	if file := os.Getenv("REPOCRAFT_HTTP_REWRITES"); file != "" {
+		if rewrites, err = service.LoadRewriteRules(file); err != nil {
+			fmt.Fprintf(os.Stderr, "rewrite rules: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_FEATURE_FLAGS names a JSON file gating bundle-uri, protocol v2
+	// and dry-run pushes per repository and client; edits apply within seconds.
+	var flags *featureflag.Set
+	if file := os.Getenv("REPOCRAFT_FEATURE_FLAGS"); file != "" {
+		flags = &featureflag.Set{Path: file}
+		if err := flags.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_REVIEW_POLICY names a JSON file of protected branches that
+	// only take direct pushes signed by a second person, and their approvers.
+	var review *service.ReviewPolicy
+	if file := os.Getenv("REPOCRAFT_REVIEW_POLICY"); file != "" {
+		if review, err = service.LoadReviewPolicy(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_PATH_SCOPES names a JSON file of identities restricted to
+	// directories of monorepos (experimental).
+	var pathScopes *service.PathScopes
+	if file := os.Getenv("REPOCRAFT_PATH_SCOPES"); file != "" {
+		if pathScopes, err = service.LoadPathScopes(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// With REPOCRAFT_DEVICE_AUTH=true, pushes are refused with a code until
+	// a user approves it with their user token; REPOCRAFT_DEVICE_AUTH_TTL
+	// is how long pushes are then accepted, 15 minutes by default.
+	var deviceAuth *deviceauth.Store
+	if on, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_DEVICE_AUTH")); on {
+		if fetchTokens == nil {
+			fmt.Fprintln(os.Stderr, "REPOCRAFT_DEVICE_AUTH needs the fetch-token-key secret to verify user tokens")
+			os.Exit(1)
+		}
+		deviceAuth = &deviceauth.Store{}
+		if v := os.Getenv("REPOCRAFT_DEVICE_AUTH_TTL"); v != "" {
+			deviceAuth.GrantTTL, err = time.ParseDuration(v)
+			if err != nil || deviceAuth.GrantTTL <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_DEVICE_AUTH_TTL %q\n", v)
+				os.Exit(1)
+			}
+		}
+	}
+	// REPOCRAFT_HTPASSWD names an htpasswd file of bcrypt entries; pushes
+	// then need the credentials of a user in it, and fetches too with
+	// REPOCRAFT_HTPASSWD_READS=true.
+	var auth httpsmart.Authenticator
+	if file := os.Getenv("REPOCRAFT_HTPASSWD"); file != "" {
+		users := &htpasswd.File{Path: file}
+		users.RequireForReads, _ = strconv.ParseBool(os.Getenv("REPOCRAFT_HTPASSWD_READS"))
+		if err := users.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		auth = users.Authenticate
+	}
+	// REPOCRAFT_ACCESS_POLICY names a JSON file of the users who may read
+	// and write each repository, enforced alike by githttpd and gitsshd.
+	var authorizer access.Authorizer
+	if file := os.Getenv("REPOCRAFT_ACCESS_POLICY"); file != "" {
+		policy, err := access.LoadPolicy(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		authorizer = policy
+	}
+	// REPOCRAFT_CEL_RULES names a JSON file of access and push rules
+	// written as CEL expressions, refusing more than the access policy.
+	var celRules service.PushCheck
+	if file := os.Getenv("REPOCRAFT_CEL_RULES"); file != "" {
+		rules, err := celpolicy.Load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		rules.Base, rules.Logger = authorizer, logger
+		authorizer, celRules = rules, rules
+	}
+	if deviceAuth != nil {
+		// Only users who may push to a repository approve pushes to it.
+		deviceAuth.Authorizer = authorizer
+	}
+	// REPOCRAFT_FREEZE_WINDOWS names a JSON file of freeze windows during
+	// which pushes to selected branches are refused.
+	var freezes *freeze.Schedule
+	if file := os.Getenv("REPOCRAFT_FREEZE_WINDOWS"); file != "" {
+		freezes = &freeze.Schedule{Path: file}
+		if err := freezes.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_LOCALES names a JSON file choosing the language of client
+	// messages per repository and identity, with extra message catalogs.
+	var locales *locale.Localizer
+	if file := os.Getenv("REPOCRAFT_LOCALES"); file != "" {
+		if locales, err = locale.Load(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_USER_KEYS names the JSON file of SSH keys users register
+	// through the API, shared with gitsshd. User tokens are signed with the
+	// fetch token key.
+	var userKeys *userkeys.Store
+	if file := os.Getenv("REPOCRAFT_USER_KEYS"); file != "" {
+		userKeys = &userkeys.Store{Path: file, Allow: cryptoPolicy.SSHClientKey}
+		if err := userKeys.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		// REPOCRAFT_USER_KEY_MAX_LIFETIME, e.g. "8760h", makes every key
+		// expire within that time of being added.
+		if v := os.Getenv("REPOCRAFT_USER_KEY_MAX_LIFETIME"); v != "" {
+			lifetime, err := time.ParseDuration(v)
+			if err != nil || lifetime <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_USER_KEY_MAX_LIFETIME: %q\n", v)
+				os.Exit(1)
+			}
+			userKeys.MaxLifetime = lifetime
+		}
+	}
+	// REPOCRAFT_CANONICAL_URL, e.g. "https://git.example.com", redirects clones
+	// arriving under other host names there; repositories can override it with
+	// the canonical_url manifest field.
+	var canonical *url.URL
+	if raw := os.Getenv("REPOCRAFT_CANONICAL_URL"); raw != "" {
+		if canonical, err = service.ParseCanonicalURL(raw); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// With an encryption key (64 hex digits) set, repositories encrypted at
+	// rest can be served; the key wraps their data keys.
+	var encryption *atrest.Store
+	if key, err := secretProvider.Secret(secretsCtx, "encryption-key"); err == nil {
+		kms, err := atrest.ParseLocalKMS(string(key))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "encryption-key: %v\n", err)
+			os.Exit(1)
+		}
+		encryption = &atrest.Store{KMS: kms, StagingDir: os.Getenv("REPOCRAFT_STAGING_DIR")}
+	} else if !errors.Is(err, secrets.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "encryption-key: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Huge repositories listed in REPOCRAFT_DEPTH_LIMITS, e.g.
+	// big/monorepo.git=50, are only served shallow: full clones get depth 50.
+	depthLimits, err := service.ParseDepthLimits(os.Getenv("REPOCRAFT_DEPTH_LIMITS"), true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	// With REPOCRAFT_HTTP_BACKENDS set, requests are forwarded to the backend
+	// base URL owning the repository; REPOCRAFT_HTTP_SELF names this node.
+	var proxy *httpsmart.Proxy
+	if backends := os.Getenv("REPOCRAFT_HTTP_BACKENDS"); backends != "" {
+		proxy = &httpsmart.Proxy{
+			Route: httpsmart.HashRoute(strings.Split(backends, ","), os.Getenv("REPOCRAFT_HTTP_SELF")),
+		}
+	}
+	// Backends take the client address from X-Forwarded-For of these edges.
+	trustedProxies := make(map[string]bool)
+	for _, addr := range strings.Split(os.Getenv("REPOCRAFT_TRUSTED_HTTP_PROXIES"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			trustedProxies[addr] = true
+		}
+	}
+
+	// REPOCRAFT_SHADOW_URL mirrors REPOCRAFT_SHADOW_PERCENT (default 1) of
+	// upload-pack requests to a second backend and logs the comparison.
+	var shadow *httpsmart.Shadow
+	if u := os.Getenv("REPOCRAFT_SHADOW_URL"); u != "" {
+		percent := 1.0
+		if v := os.Getenv("REPOCRAFT_SHADOW_PERCENT"); v != "" {
+			if percent, err = strconv.ParseFloat(v, 64); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_SHADOW_PERCENT: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		shadow = &httpsmart.Shadow{URL: u, Percent: percent}
+	}
+
+	// REPOCRAFT_MAX_INFLATED_BODY caps gzip-compressed fetch and push
+	// bodies once decompressed, in bytes (default 1 GiB).
+	var maxInflatedBody int64
+	if v := os.Getenv("REPOCRAFT_MAX_INFLATED_BODY"); v != "" {
+		if maxInflatedBody, err = strconv.ParseInt(v, 10, 64); err != nil || maxInflatedBody <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_MAX_INFLATED_BODY: %q\n", v)
+			os.Exit(1)
+		}
+	}
+
+	manager := &repoadmin.Manager{
+		RepoRoot:  rootAbs,
+		Redirects: redirects,
+		Stats:     stats,
+		Repos:     repos,
+		Events:    eventLog,
+	}
+	// REPOCRAFT_PERSONAL_REPOS=true lets users Auth identifies create
+	// repositories by pushing to <user>/<name>.git, within
+	// REPOCRAFT_PERSONAL_MAX_REPOS repositories and
+	// REPOCRAFT_PERSONAL_MAX_SIZE bytes per namespace.
+	var personal *repoadmin.PersonalNamespaces
+	if enabled, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_PERSONAL_REPOS")); enabled {
+		personal = &repoadmin.PersonalNamespaces{Manager: manager}
+		if v := os.Getenv("REPOCRAFT_PERSONAL_MAX_REPOS"); v != "" {
+			if personal.MaxRepos, err = strconv.Atoi(v); err != nil || personal.MaxRepos < 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_PERSONAL_MAX_REPOS: %q\n", v)
+				os.Exit(1)
+			}
+		}
+		if v := os.Getenv("REPOCRAFT_PERSONAL_MAX_SIZE"); v != "" {
+			if personal.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil || personal.MaxSize < 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_PERSONAL_MAX_SIZE: %q\n", v)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// REPOCRAFT_METRICS_ADDR, e.g. 127.0.0.1:9100, serves Prometheus
+	// metrics of the git traffic at /metrics on that address.
+	var gitMetrics *metrics.Git
+	if addr := os.Getenv("REPOCRAFT_METRICS_ADDR"); addr != "" {
+		gitMetrics = &metrics.Git{Transport: "http"}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "REPOCRAFT_METRICS_ADDR: %v\n", err)
+			os.Exit(1)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler(gitMetrics))
+		go http.Serve(l, metricsMux)
+	}
+
+	// REPOCRAFT_OTLP_ENDPOINT, e.g. http://collector:4318/v1/traces, sends
+	// spans of requests and git invocations to an OpenTelemetry collector;
+	// REPOCRAFT_TRACE_SAMPLE_RATIO records a share of new traces, all by
+	// default.
+	var tracer *tracing.Tracer
+	if endpoint := os.Getenv("REPOCRAFT_OTLP_ENDPOINT"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_OTLP_ENDPOINT %q\n", endpoint)
+			os.Exit(1)
+		}
+		tracer = &tracing.Tracer{Exporter: &tracing.Exporter{URL: endpoint, ServiceName: "githttpd", Logger: logger}, SampleRatio: 1}
+		if v := os.Getenv("REPOCRAFT_TRACE_SAMPLE_RATIO"); v != "" {
+			ratio, err := strconv.ParseFloat(v, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_TRACE_SAMPLE_RATIO %q\n", v)
+				os.Exit(1)
+			}
+			tracer.SampleRatio = ratio
+		}
+		go tracer.Exporter.Run(maintCtx)
+	}
+
+	// REPOCRAFT_TELEMETRY_ENDPOINT opts in to sending anonymous usage
+	// statistics there once a day: the server's version, roughly how many
+	// repositories it hosts and the protocol versions clients speak. Nothing
+	// is sent without it, and each report sent is logged.
+	var reporter *telemetry.Reporter
+	if endpoint := os.Getenv("REPOCRAFT_TELEMETRY_ENDPOINT"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_TELEMETRY_ENDPOINT %q\n", endpoint)
+			os.Exit(1)
+		}
+		reporter = &telemetry.Reporter{Endpoint: endpoint, Daemon: "githttpd", RepoRoot: rootAbs, Logger: logger}
+		account := onFinish
+		onFinish = func(res service.Result) {
+			account(res)
+			reporter.Observe(res)
+		}
+		go reporter.Run(maintCtx)
+	}
+
+	gitHandler := &httpsmart.Server{
+		RepoRoot:          rootAbs,
+		RepoMounts:        mounts,
+		UploadPackPath:    uploadPackPath,
+		ReceivePackPath:   receivePackPath,
+		Stats:             stats,
+		Auth:              auth,
+		Authorizer:        authorizer,
+		Credentials:       credentials,
+		Metrics:           gitMetrics,
+		Tracer:            tracer,
+		FetchTokens:       fetchTokens,
+		Redirects:         redirects,
+		Personal:          personal,
+		Rewrites:          rewrites,
+		CanonicalURL:      canonical,
+		Provisioned:       provisioned,
+		OnFinish:          onFinish,
+		Logger:            logger,
+		RefTransactions:   refTransactions,
+		PushChecks:        service.JoinPushChecks(celRules, commitRules, malware, policyCheck),
+		Locks:             locks,
+		PushSessions:      pushSessions,
+		PushReplays:       &httpsmart.PushReplays{},
+		CloneBundles:      true,
+		Admission:         &admission.Scheduler{Limit: maxConcurrentOps},
+		Shedder:           shedder,
+		Reaper:            reaper,
+		UploadTimeout:     uploadTimeout,
+		ReceiveTimeout:    receiveTimeout,
+		MaxDuration:       maxGitDuration,
+		Sessions:          sessions,
+		Proxy:             proxy,
+		TrustedProxies:    trustedProxies,
+		Shadow:            shadow,
+		NegotiationLimits: negotiationLimits,
+		MaxInflatedBody:   maxInflatedBody,
+		Encryption:        encryption,
+		Depth:             service.DepthPolicy{PerRepo: depthLimits},
+		DeviceAuth:        deviceAuth,
+		PathScopes:        pathScopes,
+		DryRunPushes:      true,
+		SparseHints:       true,
+		Review:            review,
+		Freeze:            freezes,
+		Flags:             flags,
+		Locales:           locales,
+	}
+	go flags.Run(maintCtx)
+	go freezes.Run(maintCtx)
+	// Browser frontends on the origins in REPOCRAFT_CORS_ORIGINS may call
+	// the API; REPOCRAFT_CORS_METHODS and REPOCRAFT_CORS_HEADERS override
+	// what their preflights may ask for.
+	var cors *api.CORS
+	if origins := splitList(os.Getenv("REPOCRAFT_CORS_ORIGINS")); len(origins) > 0 {
+		cors = &api.CORS{
+			AllowedOrigins: origins,
+			AllowedMethods: splitList(os.Getenv("REPOCRAFT_CORS_METHODS")),
+			AllowedHeaders: splitList(os.Getenv("REPOCRAFT_CORS_HEADERS")),
+		}
+	}
+
+	info.Set("repo_root", rootAbs)
+	info.Set("crypto_policy", cryptoPolicy.String())
+	info.Set("max_concurrent_ops", strconv.Itoa(maxConcurrentOps))
+	for name, enabled := range map[string]bool{
+		"tls":                certificate != nil,
+		"fetch_tokens":       fetchTokens != nil,
+		"replication":        replicator != nil,
+		"provisioning":       provisioner != nil,
+		"import_resync":      imports.Interval > 0,
+		"encryption_at_rest": encryption != nil,
+		"hook_template":      hookTemplate != nil,
+		"repo_mounts":        len(mounts) > 0,
+		"path_rewrites":      len(rewrites) > 0,
+		"canonical_url":      canonical != nil,
+		"edge_proxy":         proxy != nil,
+		"traffic_shadowing":  shadow != nil,
+		"cors":               cors != nil,
+		"clone_bundles":      gitHandler.CloneBundles,
+		"dry_run_pushes":     gitHandler.DryRunPushes,
+		"sparse_hints":       gitHandler.SparseHints,
+		"path_scopes":        pathScopes != nil,
+		"device_auth":        deviceAuth != nil,
+		"htpasswd":           auth != nil,
+		"access_policy":      authorizer != nil,
+		"cel_rules":          celRules != nil,
+		"commit_policy":      commitRules != nil,
+		"malware_scan":       malware != nil,
+		"wasm_policies":      policies != nil,
+		"metrics":            gitMetrics != nil,
+		"tracing":            tracer != nil,
+		"telemetry":          reporter != nil,
+		"personal_repos":     personal != nil,
+		"locales":            locales != nil,
+		"user_keys":          userKeys != nil,
+		"review":             review != nil,
+		"freeze_windows":     freezes != nil,
+		"purges":             purger != nil,
+		"warm_up":            warmer != nil,
+		"fault_injection":    faults.Enabled(),
+	} {
+		info.Feature(name, enabled)
+	}
+	info.Check("repo_root", func(context.Context) error {
+		f, err := os.CreateTemp(rootAbs, ".health-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	})
+	info.Check("git", func(ctx context.Context) error {
+		return exec.CommandContext(ctx, "git", "--version").Run()
+	})
+	info.Check("load", func(context.Context) error {
+		if _, ok := shedder.Allow(loadshed.PriorityLow); !ok {
+			p := shedder.Pressure()
+			return fmt.Errorf("shedding anonymous fetches: load %.2f, memory pressure %.1f%%, iowait %.1f%%", p.Load, p.MemoryPressure, p.IOWait)
+		}
+		return nil
+	})
+	info.Check("feature_flags", func(context.Context) error { return flags.Err() })
+	info.Check("user_keys", func(context.Context) error { return userKeys.Err() })
+	info.Check("freeze_windows", func(context.Context) error { return freezes.Err() })
+	info.Check("secrets", func(ctx context.Context) error {
+		if _, err := secretProvider.Secret(ctx, "admin-token"); err != nil && !errors.Is(err, secrets.ErrNotFound) {
+			return err
+		}
+		return nil
+	})
+
+	// Submodules with URLs relative to their superproject, or under the
+	// canonical URL, are hosted here; archives and exports can include
+	// them.
+	var submoduleBases []*url.URL
+	if canonical != nil {
+		submoduleBases = append(submoduleBases, canonical)
+	}
+
+	apiHandler := &api.Server{
+		RepoRoot:      rootAbs,
+		Stats:         stats,
+		Repos:         repos,
+		AdminToken:    string(bytes.TrimSpace(adminToken)),
+		FetchTokens:   fetchTokens,
+		Replicator:    replicator,
+		Maintenance:   scheduler,
+		Sessions:      sessions,
+		HookTemplate:  hookTemplate,
+		Encryption:    encryption,
+		CORS:          cors,
+		Provisioned:   provisioned,
+		Auth:          auth,
+		Authorizer:    authorizer,
+		Provisioner:   provisioner,
+		Importer:      imports,
+		Exporter:      &exporter.Exporter{RepoRoot: rootAbs, Bases: submoduleBases},
+		Purger:        purger,
+		Introspection: info,
+		Diagnostics:   &diag.Capturer{Dir: diagnosticsDir},
+		Flags:         flags,
+		Freeze:        freezes,
+		UserKeys:      userKeys,
+		UserTokens:    fetchTokens,
+		Audit:         &api.AuditLog{Path: auditPath},
+		RefHistory:    refHistory,
+		Webhooks:      webhooks,
+		Policies:      policies,
+		Archives:      &snapshot.Archiver{Bases: submoduleBases},
+		DeviceAuth:    deviceAuth,
+		Events:        eventLog,
+		Credentials:   credentials,
+		Pins:          pins,
+		Logs:          logTail,
+		Manager:       manager,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", apiHandler)
+	mux.Handle("/", gitHandler)
 
 	server := &http.Server{
-		Addr:         httpListenAddr,
-		Handler:      handler,
+		Handler:      mux,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		// git sends a handful of short headers.
+		MaxHeaderBytes: 64 << 10,
+		ConnContext:    listener.ConnContext,
+	}
+	if certificate != nil {
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certificate.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+		cryptoPolicy.TLSConfig(server.TLSConfig)
 	}
 
-	fmt.Printf("Serving Git Smart HTTP on %s (repos under %s)\n", httpListenAddr, rootAbs)
+	// REPOCRAFT_HTTP_LISTEN binds several addresses, e.g.
+	// 0.0.0.0:8080,[::]:8080,:8443+tls,127.0.0.1:8081+proxied; by default the
+	// server listens on :8080, with TLS when a certificate is configured.
+	listenConfigs := []listener.Config{{Network: "tcp", Addr: httpListenAddr, TLS: certificate != nil}}
+	if spec := os.Getenv("REPOCRAFT_HTTP_LISTEN"); spec != "" {
+		if listenConfigs, err = listener.Parse(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "REPOCRAFT_HTTP_LISTEN: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	listen := make([]string, len(listenConfigs))
+	for i, c := range listenConfigs {
+		listen[i] = c.String()
+	}
+	info.Set("listen", strings.Join(listen, ","))
 
-	errCh := make(chan error, 1)
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errCh <- err
-			return
+	// Known-answer tests and the configured keys are checked on every start;
+	// under a restricted policy a failure stops the server.
+	checkInputs := cryptopolicy.Inputs{}
+	if certificate != nil {
+		checkInputs.TLSCertificate, _ = certificate.GetCertificate(nil)
+	}
+	if fetchTokens != nil {
+		checkInputs.TokenKey = fetchTokens.Key
+	}
+	report := cryptopolicy.SelfCheck(cryptoPolicy, checkInputs)
+	fmt.Print(report)
+	if !report.OK() && cryptoPolicy.Restricted() {
+		fmt.Fprintln(os.Stderr, "crypto self-check failed")
+		os.Exit(1)
+	}
+
+	if warmer != nil {
+		warmUp(warmer, warmupTimeout)
+	}
+
+	errCh := make(chan error, len(listenConfigs))
+	for _, c := range listenConfigs {
+		l, err := c.Listen(server.TLSConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
 		}
-		errCh <- nil
-	}()
+		fmt.Printf("Serving Git Smart HTTP on %s (repos under %s)\n", c, rootAbs)
+		go func() {
+			if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+				errCh <- err
+				return
+			}
+			errCh <- nil
+		}()
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -72,6 +1108,114 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		_ = server.Shutdown(ctx)
-		<-errCh // wait for server goroutine to exit
+		for range listenConfigs {
+			<-errCh // wait for the serving goroutines to exit
+		}
+	}
+}
+
+// newWarmer configures the startup warm-up from the environment; it
+// returns nil if none is asked for.
+func newWarmer(resolver service.RepoResolver, stats *repostats.Store) (*warmup.Warmer, time.Duration) {
+	w := &warmup.Warmer{Resolver: resolver, Repos: splitList(os.Getenv("REPOCRAFT_WARMUP_REPOS")), Stats: stats}
+	if v := os.Getenv("REPOCRAFT_WARMUP_TOP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WARMUP_TOP: %q\n", v)
+			os.Exit(1)
+		}
+		w.Top = n
+	}
+	timeout := time.Minute
+	if v := os.Getenv("REPOCRAFT_WARMUP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WARMUP_TIMEOUT: %q\n", v)
+			os.Exit(1)
+		}
+		timeout = d
+	}
+	if len(w.Repos) == 0 && w.Top == 0 {
+		return nil, 0
+	}
+	return w, timeout
+}
+
+// warmUp runs w for at most timeout and reports how it went.
+func warmUp(w *warmup.Warmer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	n := w.Run(ctx)
+	fmt.Printf("Warmed up %d repositories in %s\n", n, time.Since(start).Round(time.Millisecond))
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+// durationEnv returns the duration in the environment variable name, or
+// zero if it isn't set, and exits if it is invalid.
+func durationEnv(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		fmt.Fprintf(os.Stderr, "invalid %s %q\n", name, v)
+		os.Exit(1)
+	}
+	return d
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// newWebhookEgress configures where webhook deliveries may go from the
+// environment: REPOCRAFT_WEBHOOK_PROXY is an HTTP proxy to send them
+// through, REPOCRAFT_WEBHOOK_ALLOW_CIDRS and REPOCRAFT_WEBHOOK_BLOCK_CIDRS
+// open up internal or close further address ranges,
+// REPOCRAFT_WEBHOOK_HTTPS_ONLY=true refuses plain http and
+// REPOCRAFT_WEBHOOK_CA is a PEM bundle to verify endpoints against.
+func newWebhookEgress(policy cryptopolicy.Policy) *webhook.Egress {
+	fail := func(name, v string) {
+		fmt.Fprintf(os.Stderr, "invalid %s: %q\n", name, v)
+		os.Exit(1)
+	}
+	e := &webhook.Egress{TLS: policy.TLSConfig}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_PROXY"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("REPOCRAFT_WEBHOOK_PROXY", v)
+		}
+		e.Proxy = u
+	}
+	var err error
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_ALLOW_CIDRS"); v != "" {
+		if e.Allow, err = webhook.ParseCIDRs(v); err != nil {
+			fail("REPOCRAFT_WEBHOOK_ALLOW_CIDRS", v)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_BLOCK_CIDRS"); v != "" {
+		if e.Block, err = webhook.ParseCIDRs(v); err != nil {
+			fail("REPOCRAFT_WEBHOOK_BLOCK_CIDRS", v)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_HTTPS_ONLY"); v != "" {
+		if e.HTTPSOnly, err = strconv.ParseBool(v); err != nil {
+			fail("REPOCRAFT_WEBHOOK_HTTPS_ONLY", v)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_CA"); v != "" {
+		if e.RootCAs, err = webhook.LoadRootCAs(v); err != nil {
+			fmt.Fprintf(os.Stderr, "REPOCRAFT_WEBHOOK_CA: %v\n", err)
+			os.Exit(1)
+		}
 	}
+	return e
 }
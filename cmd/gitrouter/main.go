@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/discovery"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/router"
+)
+
+const (
+	routerListenAddr = ":8000"
+	primaryURL       = "http://localhost:8080"
+)
+
+// gitrouter launches a Smart HTTP router on :8000 in front of a githttpd
+// primary on :8080 and the replicas listed in REPOCRAFT_REPLICAS, or the
+// nodes found by REPOCRAFT_DISCOVERY or the SRV records of
+// REPOCRAFT_DISCOVERY_SRV.
+func main() {
+	nodes := []router.Node{{URL: primaryURL, Primary: true}}
+	if urls := os.Getenv("REPOCRAFT_REPLICAS"); urls != "" {
+		for _, u := range strings.Split(urls, ",") {
+			nodes = append(nodes, router.Node{URL: u})
+		}
+	}
+	rt := &router.Router{Nodes: nodes}
+	// With a discovery source, nodes are discovered instead.
+	if spec := os.Getenv("REPOCRAFT_DISCOVERY"); spec != "" {
+		source, err := discovery.Parse(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_DISCOVERY %q: %v\n", spec, err)
+			os.Exit(1)
+		}
+		rt.Discovery = &discovery.Cache{Source: source}
+	} else if name := os.Getenv("REPOCRAFT_DISCOVERY_SRV"); name != "" {
+		rt.Discovery = &discovery.Cache{Source: discovery.DNSSRV{Name: name}}
+	}
+	if err := rt.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	defer stopHealth()
+	go rt.Run(healthCtx)
+
+	// No write timeout: clones of large repositories stream for a long time.
+	server := &http.Server{
+		Addr:        routerListenAddr,
+		Handler:     rt,
+		ReadTimeout: 30 * time.Second,
+	}
+
+	fmt.Printf("Routing Git Smart HTTP on %s\n", routerListenAddr)
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+			return
+		}
+		errCh <- nil
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	case sig := <-sigCh:
+		fmt.Printf("Received signal %s, shutting down...\n", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		<-errCh
+	}
+}
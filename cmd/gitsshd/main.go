@@ -2,13 +2,56 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	xssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/access"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/accounting"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/admission"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/celpolicy"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/commitpolicy"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/cryptopolicy"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/faults"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/featureflag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
 	gitssh "github.com/repocraft-project/repocraft-server-go/internal/infra/git/ssh"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/listener"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/loadshed"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/locale"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/malscan"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/metrics"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refhistory"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/secrets"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/telemetry"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/tracing"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/userkeys"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/warmup"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/wasmhook"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/webhook"
 )
 
 const (
@@ -17,30 +60,597 @@ const (
 	sshDir             = "./.ssh"
 	hostKeyPath        = "./.ssh/hostkey"
 	authorizedKeysPath = "./.ssh/authorized_keys"
+	routerKeyPath      = "./.ssh/router"
+	backendHostsPath   = "./.ssh/backend_known_hosts"
+	statsPath          = "./.repocraft/ssh-stats.json"
+	httpStatsPath      = "./.repocraft/stats.json"
+	redirectsPath      = "./.repocraft/redirects.json"
+	accountingPath     = "./.repocraft/ssh-accounting.jsonl"
+	refHistoryDir      = "./.repocraft/ref-history"
+	eventsDir          = "./.repocraft/events"
+	credentialsDir     = "./.repocraft/credentials"
+	maxConcurrentOps   = 32
+	maxSessionsPerConn = 8
+	connStatsInterval  = 5 * time.Minute
 	uploadPackPath     = ""
 	receivePackPath    = ""
 )
 
+// loadThresholds start load shedding: load per CPU, and percentages of
+// time stalled on memory or waiting for I/O.
+var loadThresholds = loadshed.Thresholds{Load: 2, MemoryPressure: 20, IOWait: 40}
+
+// negotiationLimits turn away pathological fetch requests.
+var negotiationLimits = service.NegotiationLimits{MaxWants: 100000, MaxHaves: 50000, MaxDepth: 100000, MaxDeepenNot: 100}
+
 // gitsshd launches an SSH server demo that only serves git-upload-pack and git-receive-pack.
 func main() {
 	if err := setupDemo(); err != nil {
 		fmt.Fprintf(os.Stderr, "setup error: %v\n", err)
 		os.Exit(1)
 	}
+	// REPOCRAFT_LOG_FORMAT=json or text logs structured records, one per
+	// line, for log pipelines to parse.
+	logger, err := diag.NewLogger(os.Getenv("REPOCRAFT_LOG_FORMAT"), os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_LOG_FORMAT: %v\n", err)
+		os.Exit(1)
+	}
+	// REPOCRAFT_DEBUG, e.g. "ssh,git" or "all", turns on debug logging of
+	// subsystems.
+	if err := diag.EnableDebug(os.Getenv("REPOCRAFT_DEBUG")); err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_DEBUG: %v\n", err)
+		os.Exit(1)
+	}
+	// REPOCRAFT_FAULTS injects transport faults in builds with
+	// -tags faultinjection.
+	if err := faults.Configure(os.Getenv("REPOCRAFT_FAULTS")); err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_FAULTS: %v\n", err)
+		os.Exit(1)
+	}
+
+	// githttpd keeps its statistics next to ours; warmup sees both.
+	stats := &repostats.Store{Path: statsPath, Peers: []string{httpStatsPath}}
+	if err := stats.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	redirects := &repoadmin.RedirectStore{Path: redirectsPath}
+	if err := redirects.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	accountingSink, err := accounting.OpenFileSink(accountingPath, "jsonl")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer accountingSink.Close()
+	recorder := &accounting.Recorder{Sink: accountingSink, Transport: "ssh"}
+	// Every git invocation is accounted; the server logs it with its
+	// resource usage.
+	onFinish := recorder.Observe
+
+	shedder := &loadshed.Shedder{Thresholds: loadThresholds}
+
+	// git runs in a process group of its own, with the pack-objects and
+	// hooks it spawns. The group gets SIGTERM when its request is cancelled,
+	// times out or is still running at shutdown, then SIGKILL after
+	// REPOCRAFT_GIT_KILL_GRACE, e.g. "10s", five seconds by default; with
+	// "0", groups get SIGKILL right away.
+	reaper := &service.Reaper{}
+	if v := os.Getenv("REPOCRAFT_GIT_KILL_GRACE"); v != "" {
+		grace, err := time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_GIT_KILL_GRACE %q\n", v)
+			os.Exit(1)
+		}
+		if grace == 0 {
+			grace = -1
+		}
+		reaper.Grace = grace
+	}
+	defer reaper.Shutdown()
+	// REPOCRAFT_UPLOAD_TIMEOUT and REPOCRAFT_RECEIVE_TIMEOUT, e.g. "2h",
+	// bound how long a fetch or a push may run once it has a slot, and
+	// REPOCRAFT_GIT_MAX_DURATION every git invocation; git still running
+	// then is stopped.
+	uploadTimeout := durationEnv("REPOCRAFT_UPLOAD_TIMEOUT")
+	receiveTimeout := durationEnv("REPOCRAFT_RECEIVE_TIMEOUT")
+	maxGitDuration := durationEnv("REPOCRAFT_GIT_MAX_DURATION")
+
+	// URL namespaces can be served from other roots, e.g.
+	// REPOCRAFT_REPO_MOUNTS=mirrors=/data/mirrors,users=/data/users.
+	mounts, err := service.ParseRepoMounts(os.Getenv("REPOCRAFT_REPO_MOUNTS"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	// Before serving, the repositories in REPOCRAFT_WARMUP_REPOS and the
+	// REPOCRAFT_WARMUP_TOP busiest ones are warmed up, for at most
+	// REPOCRAFT_WARMUP_TIMEOUT (default one minute).
+	warmer, warmupTimeout := newWarmer(service.RepoResolver{Root: repoRoot, Mounts: mounts}, stats)
+	// REPOCRAFT_SSH_REWRITES names a file of "pattern replacement" rules rewriting the
+	// repository paths SSH clients ask for, e.g. "^svn-migrated/(.+)$ legacy/$1.git".
+	var rewrites service.RewriteRules
+	if file := os.Getenv("REPOCRAFT_SSH_REWRITES"); file != "" {
+		if rewrites, err = service.LoadRewriteRules(file); err != nil {
+			fmt.Fprintf(os.Stderr, "rewrite rules: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_FEATURE_FLAGS names a JSON file gating protocol v2 and dry-run
+	// pushes per repository and client; edits apply within seconds.
+	var flags *featureflag.Set
+	if file := os.Getenv("REPOCRAFT_FEATURE_FLAGS"); file != "" {
+		flags = &featureflag.Set{Path: file}
+		if err := flags.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_REVIEW_POLICY names a JSON file of protected branches that
+	// only take direct pushes signed by a second person, and their approvers.
+	var review *service.ReviewPolicy
+	if file := os.Getenv("REPOCRAFT_REVIEW_POLICY"); file != "" {
+		if review, err = service.LoadReviewPolicy(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_COMMIT_POLICY names a JSON file of rules the messages of
+	// commits pushed to selected branches must follow.
+	var commitRules service.PushCheck
+	if file := os.Getenv("REPOCRAFT_COMMIT_POLICY"); file != "" {
+		policy, err := commitpolicy.Load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		commitRules = policy
+	}
+	// REPOCRAFT_PATH_SCOPES names a JSON file of identities restricted to
+	// directories of monorepos (experimental).
+	var pathScopes *service.PathScopes
+	if file := os.Getenv("REPOCRAFT_PATH_SCOPES"); file != "" {
+		if pathScopes, err = service.LoadPathScopes(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_ACCESS_POLICY names a JSON file of the users who may read
+	// and write each repository, enforced alike by githttpd and gitsshd.
+	var authorizer access.Authorizer
+	if file := os.Getenv("REPOCRAFT_ACCESS_POLICY"); file != "" {
+		policy, err := access.LoadPolicy(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		authorizer = policy
+	}
+	// REPOCRAFT_CEL_RULES names a JSON file of access and push rules
+	// written as CEL expressions, refusing more than the access policy.
+	var celRules service.PushCheck
+	if file := os.Getenv("REPOCRAFT_CEL_RULES"); file != "" {
+		rules, err := celpolicy.Load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		rules.Base, rules.Logger = authorizer, logger
+		authorizer, celRules = rules, rules
+	}
+	// REPOCRAFT_FREEZE_WINDOWS names a JSON file of freeze windows during
+	// which pushes to selected branches are refused.
+	var freezes *freeze.Schedule
+	if file := os.Getenv("REPOCRAFT_FREEZE_WINDOWS"); file != "" {
+		freezes = &freeze.Schedule{Path: file}
+		if err := freezes.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_LOCALES names a JSON file choosing the language of client
+	// messages per repository and identity, with extra message catalogs.
+	var locales *locale.Localizer
+	if file := os.Getenv("REPOCRAFT_LOCALES"); file != "" {
+		if locales, err = locale.Load(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_USER_KEYS names the JSON file of SSH keys users register
+	// through githttpd's API; keys added there are admitted within seconds.
+	var userKeys *userkeys.Store
+	if file := os.Getenv("REPOCRAFT_USER_KEYS"); file != "" {
+		userKeys = &userkeys.Store{Path: file}
+		if err := userKeys.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// REPOCRAFT_CRYPTO_POLICY=fips limits SSH to FIPS algorithms and key
+	// types; builds with GOEXPERIMENT=boringcrypto always do.
+	cryptoPolicy, err := cryptopolicy.Parse(os.Getenv("REPOCRAFT_CRYPTO_POLICY"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_CRYPTO_POLICY: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Keys come from REPOCRAFT_SECRETS (e.g. file:/run/secrets,
+	// vault:https://vault:8200 or aws:us-east-1), by default from
+	// REPOCRAFT_* variables. Rotated secrets are picked up every few minutes.
+	secretsSpec := os.Getenv("REPOCRAFT_SECRETS")
+	if secretsSpec == "" {
+		secretsSpec = "env:REPOCRAFT_"
+	}
+	secretProvider, err := secrets.Parse(secretsSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_SECRETS: %v\n", err)
+		os.Exit(1)
+	}
+	secretWatcher := &secrets.Watcher{Provider: secretProvider}
+	// A host key held by the provider replaces the generated demo key.
+	var hostKey *gitssh.HostKey
+	err = secretWatcher.Watch(context.Background(), "ssh-host-key", func(pem []byte) error {
+		if hostKey == nil {
+			hostKey = &gitssh.HostKey{}
+		}
+		return hostKey.Set(pem)
+	})
+	if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "ssh-host-key: %v\n", err)
+		os.Exit(1)
+	}
+
+	// With an encryption key (64 hex digits) set, repositories encrypted at
+	// rest can be served; the key wraps their data keys.
+	var encryption *atrest.Store
+	if key, err := secretProvider.Secret(context.Background(), "encryption-key"); err == nil {
+		kms, err := atrest.ParseLocalKMS(string(key))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "encryption-key: %v\n", err)
+			os.Exit(1)
+		}
+		encryption = &atrest.Store{KMS: kms, StagingDir: os.Getenv("REPOCRAFT_STAGING_DIR")}
+	} else if !errors.Is(err, secrets.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "encryption-key: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Huge repositories listed in REPOCRAFT_DEPTH_LIMITS, e.g.
+	// big/monorepo.git=50, are only served shallow: full clones get depth 50.
+	depthLimits, err := service.ParseDepthLimits(os.Getenv("REPOCRAFT_DEPTH_LIMITS"), true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	// REPOCRAFT_SSH_LISTEN binds several addresses instead of :2222, e.g.
+	// 0.0.0.0:2222,[::]:2222,[::]:22.
+	listenConfigs, err := listener.Parse(os.Getenv("REPOCRAFT_SSH_LISTEN"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "REPOCRAFT_SSH_LISTEN: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Known-answer tests and the host key are checked on every start; under
+	// a restricted policy a failure stops the server.
+	checkInputs := cryptopolicy.Inputs{}
+	if hostKey != nil {
+		checkInputs.SSHHostKey = hostKey.PublicKey()
+	} else if pem, err := os.ReadFile(hostKeyPath); err == nil {
+		if signer, err := xssh.ParsePrivateKey(pem); err == nil {
+			checkInputs.SSHHostKey = signer.PublicKey()
+		}
+	}
+	report := cryptopolicy.SelfCheck(cryptoPolicy, checkInputs)
+	fmt.Print(report)
+	if !report.OK() && cryptoPolicy.Restricted() {
+		fmt.Fprintln(os.Stderr, "crypto self-check failed")
+		os.Exit(1)
+	}
+
+	// With REPOCRAFT_SSH_BACKENDS set, sessions are relayed to the backend
+	// owning the repository; REPOCRAFT_SSH_SELF names this node in the list.
+	var proxy *gitssh.Proxy
+	if backends := os.Getenv("REPOCRAFT_SSH_BACKENDS"); backends != "" {
+		proxy, err = newProxy(strings.Split(backends, ","), os.Getenv("REPOCRAFT_SSH_SELF"), cryptoPolicy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	// Backends accept forwarded client identities from these router keys.
+	trustedProxies := make(map[string]bool)
+	for _, fp := range strings.Split(os.Getenv("REPOCRAFT_TRUSTED_PROXIES"), ",") {
+		if fp = strings.TrimSpace(fp); fp != "" {
+			trustedProxies[fp] = true
+		}
+	}
+
+	// Keys listed in REPOCRAFT_ADMIN_SHELL_KEYS get the admin-shell scope
+	// and may run read-only git commands for debugging.
+	var adminShell *gitssh.AdminShell
+	if keys := os.Getenv("REPOCRAFT_ADMIN_SHELL_KEYS"); keys != "" {
+		adminShell = &gitssh.AdminShell{Identities: make(map[string]bool)}
+		for _, fp := range strings.Split(keys, ",") {
+			if fp = strings.TrimSpace(fp); fp != "" {
+				adminShell.Identities[fp] = true
+			}
+		}
+	}
+
+	// Deploy keys provisioned into a repository's settings (see githttpd's
+	// REPOCRAFT_PROVISION_MANIFEST) may access that repository only.
+	provisioned := &provision.Index{RepoRoot: repoRoot}
+
+	// Pushed ref updates go to the ref history and the event log shared
+	// with githttpd, which also trims them, and to the webhooks of the
+	// repository.
+	refHistory := &refhistory.Store{Dir: refHistoryDir}
+	eventLog := &events.Log{Dir: eventsDir}
+	webhooks := &webhook.Dispatcher{Egress: newWebhookEgress(cryptoPolicy)}
+
+	// REPOCRAFT_MALWARE_POLICY names a JSON file of the scanner new blobs
+	// of pushes are sent to, and whether findings block or flag pushes.
+	var malware service.PushCheck
+	if file := os.Getenv("REPOCRAFT_MALWARE_POLICY"); file != "" {
+		policy, err := malscan.Load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		policy.Events = eventLog
+		malware = policy
+	}
+	// With REPOCRAFT_WASM_POLICIES=true, pushes run the WebAssembly policy
+	// plugins admins upload to repositories, each with at most
+	// REPOCRAFT_WASM_POLICY_MEMORY bytes of memory, 64 MiB by default, for
+	// at most REPOCRAFT_WASM_POLICY_TIMEOUT, 5s by default.
+	var (
+		policies    *wasmhook.Runner
+		policyCheck service.PushCheck
+	)
+	if on, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_WASM_POLICIES")); on {
+		policies = &wasmhook.Runner{}
+		if v := os.Getenv("REPOCRAFT_WASM_POLICY_MEMORY"); v != "" {
+			limit, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || limit < 64<<10 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WASM_POLICY_MEMORY %q\n", v)
+				os.Exit(1)
+			}
+			policies.MemoryLimit = limit
+		}
+		if v := os.Getenv("REPOCRAFT_WASM_POLICY_TIMEOUT"); v != "" {
+			timeout, err := time.ParseDuration(v)
+			if err != nil || timeout <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WASM_POLICY_TIMEOUT %q\n", v)
+				os.Exit(1)
+			}
+			policies.Timeout = timeout
+		}
+		policyCheck = policies
+	}
+
+	// Key uses go to a file of this daemon's in the directory githttpd
+	// reports credential usage from.
+	host, _ := os.Hostname()
+	credentials := &credusage.Store{Dir: credentialsDir, Name: "gitsshd-" + host}
+	if err := credentials.Load(); err != nil {
+		log.Printf("credential usage: %v", err)
+	}
+
+	// REPOCRAFT_PERSONAL_REPOS=true lets key owners create repositories by
+	// pushing to <user>/<name>.git, within REPOCRAFT_PERSONAL_MAX_REPOS
+	// repositories and REPOCRAFT_PERSONAL_MAX_SIZE bytes per namespace.
+	var personal *repoadmin.PersonalNamespaces
+	if enabled, _ := strconv.ParseBool(os.Getenv("REPOCRAFT_PERSONAL_REPOS")); enabled {
+		personal = &repoadmin.PersonalNamespaces{
+			Manager: &repoadmin.Manager{RepoRoot: repoRoot, Redirects: redirects, Stats: stats, Events: eventLog},
+		}
+		if v := os.Getenv("REPOCRAFT_PERSONAL_MAX_REPOS"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_PERSONAL_MAX_REPOS: %q\n", v)
+				os.Exit(1)
+			}
+			personal.MaxRepos = n
+		}
+		if v := os.Getenv("REPOCRAFT_PERSONAL_MAX_SIZE"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_PERSONAL_MAX_SIZE: %q\n", v)
+				os.Exit(1)
+			}
+			personal.MaxSize = n
+		}
+	}
+
+	// REPOCRAFT_METRICS_ADDR, e.g. 127.0.0.1:9100, serves Prometheus
+	// metrics of the git traffic at /metrics on that address.
+	var gitMetrics *metrics.Git
+	if addr := os.Getenv("REPOCRAFT_METRICS_ADDR"); addr != "" {
+		gitMetrics = &metrics.Git{Transport: "ssh"}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "REPOCRAFT_METRICS_ADDR: %v\n", err)
+			os.Exit(1)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler(gitMetrics))
+		go http.Serve(l, metricsMux)
+	}
+
+	// REPOCRAFT_OTLP_ENDPOINT, e.g. http://collector:4318/v1/traces, sends
+	// spans of requests and git invocations to an OpenTelemetry collector;
+	// REPOCRAFT_TRACE_SAMPLE_RATIO records a share of new traces, all by
+	// default.
+	var tracer *tracing.Tracer
+	if endpoint := os.Getenv("REPOCRAFT_OTLP_ENDPOINT"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_OTLP_ENDPOINT %q\n", endpoint)
+			os.Exit(1)
+		}
+		tracer = &tracing.Tracer{Exporter: &tracing.Exporter{URL: endpoint, ServiceName: "gitsshd", Logger: logger}, SampleRatio: 1}
+		if v := os.Getenv("REPOCRAFT_TRACE_SAMPLE_RATIO"); v != "" {
+			ratio, err := strconv.ParseFloat(v, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_TRACE_SAMPLE_RATIO %q\n", v)
+				os.Exit(1)
+			}
+			tracer.SampleRatio = ratio
+		}
+	}
+
+	// REPOCRAFT_TELEMETRY_ENDPOINT opts in to sending anonymous usage
+	// statistics there once a day: the server's version, roughly how many
+	// repositories it hosts and the protocol versions clients speak. Nothing
+	// is sent without it, and each report sent is logged.
+	var reporter *telemetry.Reporter
+	if endpoint := os.Getenv("REPOCRAFT_TELEMETRY_ENDPOINT"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_TELEMETRY_ENDPOINT %q\n", endpoint)
+			os.Exit(1)
+		}
+		reporter = &telemetry.Reporter{Endpoint: endpoint, Daemon: "gitsshd", RepoRoot: repoRoot, Logger: logger}
+		account := onFinish
+		onFinish = func(res service.Result) {
+			account(res)
+			reporter.Observe(res)
+		}
+	}
 
 	server := gitssh.Server{
 		Addr:               listenAddr,
+		Listeners:          listenConfigs,
 		RepoRoot:           repoRoot,
+		RepoMounts:         mounts,
 		HostKeyPath:        hostKeyPath,
+		HostKey:            hostKey,
+		CryptoPolicy:       cryptoPolicy,
 		AuthorizedKeysPath: authorizedKeysPath,
 		UploadPackPath:     uploadPackPath,
 		ReceivePackPath:    receivePackPath,
+		Stats:              stats,
+		Redirects:          redirects,
+		Personal:           personal,
+		Authorizer:         authorizer,
+		Rewrites:           rewrites,
+		Provisioned:        provisioned,
+		OnFinish:           onFinish,
+		Logger:             logger,
+		Admission:          &admission.Scheduler{Limit: maxConcurrentOps},
+		// Pushes take the repository's lock file, which githttpd's
+		// maintenance checks before garbage collecting.
+		Locks:              &repolock.Manager{},
+		Shedder:            shedder,
+		Reaper:             reaper,
+		UploadTimeout:      uploadTimeout,
+		ReceiveTimeout:     receiveTimeout,
+		MaxDuration:        maxGitDuration,
+		Proxy:              proxy,
+		MaxSessionsPerConn: maxSessionsPerConn,
+		TrustedProxies:     trustedProxies,
+		NegotiationLimits:  negotiationLimits,
+		Encryption:         encryption,
+		Depth:              service.DepthPolicy{PerRepo: depthLimits},
+		PathScopes:         pathScopes,
+		DryRunPushes:       true,
+		SparseHints:        true,
+		Review:             review,
+		Freeze:             freezes,
+		Flags:              flags,
+		Locales:            locales,
+		UserKeys:           userKeys,
+		Credentials:        credentials,
+		Metrics:            gitMetrics,
+		Tracer:             tracer,
+		AdminShell:         adminShell,
+		RefTransactions:    service.JoinTransactions(refHistory, webhooks, eventLog),
+		PushChecks:         service.JoinPushChecks(celRules, commitRules, malware, policyCheck),
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	if tracer != nil {
+		go tracer.Exporter.Run(ctx)
+	}
+	if reporter != nil {
+		go reporter.Run(ctx)
+	}
+
+	statsDone := make(chan struct{})
+	go func() {
+		defer close(statsDone)
+		if err := stats.Run(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}()
+	defer func() {
+		stop()
+		<-statsDone
+	}()
+
+	go secretWatcher.Run(ctx)
+	go provisioned.Run(ctx)
+	go flags.Run(ctx)
+	go userKeys.Run(ctx)
+	go freezes.Run(ctx)
+	go webhooks.Run(ctx)
+	go credentials.Run(ctx)
+	defer func() {
+		if err := credentials.Flush(time.Now()); err != nil {
+			log.Printf("credential usage: %v", err)
+		}
+	}()
 
-	fmt.Printf("Serving Git SSH on %s (repos under %s)\n", listenAddr, repoRoot)
+	go func() {
+		if err := shedder.Run(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}()
+
+	// REPOCRAFT_HOOK_TEMPLATE names a directory of hook scripts linked into
+	// every repository; new repositories get them on the next sync.
+	if dir := os.Getenv("REPOCRAFT_HOOK_TEMPLATE"); dir != "" {
+		dirAbs, err := filepath.Abs(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "resolve hook template: %v\n", err)
+			os.Exit(1)
+		}
+		template := &repoadmin.HookTemplate{Dir: dirAbs, RepoRoot: repoRoot}
+		go template.Run(ctx)
+	}
+
+	// Connection reuse is logged periodically.
+	go func() {
+		ticker := time.NewTicker(connStatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				log.Printf("ssh: %s", server.ConnStats())
+			}
+		}
+	}()
+
+	addrs := []string{listenAddr}
+	if len(listenConfigs) > 0 {
+		addrs = addrs[:0]
+		for _, c := range listenConfigs {
+			addrs = append(addrs, c.String())
+		}
+	}
+	if warmer != nil {
+		warmUp(warmer, warmupTimeout)
+	}
+	fmt.Printf("Serving Git SSH on %s (repos under %s)\n", strings.Join(addrs, ", "), repoRoot)
 	fmt.Printf("Add public keys to %s and place bare repos under %s\n", authorizedKeysPath, repoRoot)
 	fmt.Printf("Example: git clone ssh://localhost%s/owner/repo.git\n", listenAddr)
 	if err := server.ListenAndServe(ctx); err != nil {
@@ -66,6 +676,94 @@ func setupDemo() error {
 	return nil
 }
 
+// newProxy authenticates to backends with the router key and checks their
+// host keys against backendHostsPath.
+func newProxy(backends []string, self string, policy cryptopolicy.Policy) (*gitssh.Proxy, error) {
+	if err := ensureKey(routerKeyPath, "repocraft-demo-router"); err != nil {
+		return nil, fmt.Errorf("ensure router key: %w", err)
+	}
+	pem, err := os.ReadFile(routerKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read router key: %w", err)
+	}
+	signer, err := xssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("parse router key: %w", err)
+	}
+	hostKeys, err := knownhosts.New(backendHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("load backend host keys: %w", err)
+	}
+	fmt.Printf("Routing to %s as %s\n", strings.Join(backends, ", "), xssh.FingerprintSHA256(signer.PublicKey()))
+	config := &xssh.ClientConfig{
+		User:              "git",
+		Auth:              []xssh.AuthMethod{xssh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: policy.SSHHostKeyAlgorithms(),
+	}
+	policy.SSHConfig(&config.Config)
+	return &gitssh.Proxy{
+		Route:  gitssh.HashRoute(backends, self),
+		Config: config,
+	}, nil
+}
+
+// newWarmer configures the startup warm-up from the environment; it
+// returns nil if none is asked for.
+func newWarmer(resolver service.RepoResolver, stats *repostats.Store) (*warmup.Warmer, time.Duration) {
+	w := &warmup.Warmer{Resolver: resolver, Stats: stats}
+	for _, name := range strings.Split(os.Getenv("REPOCRAFT_WARMUP_REPOS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			w.Repos = append(w.Repos, name)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_WARMUP_TOP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WARMUP_TOP: %q\n", v)
+			os.Exit(1)
+		}
+		w.Top = n
+	}
+	timeout := time.Minute
+	if v := os.Getenv("REPOCRAFT_WARMUP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid REPOCRAFT_WARMUP_TIMEOUT: %q\n", v)
+			os.Exit(1)
+		}
+		timeout = d
+	}
+	if len(w.Repos) == 0 && w.Top == 0 {
+		return nil, 0
+	}
+	return w, timeout
+}
+
+// warmUp runs w for at most timeout and reports how it went.
+func warmUp(w *warmup.Warmer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	n := w.Run(ctx)
+	fmt.Printf("Warmed up %d repositories in %s\n", n, time.Since(start).Round(time.Millisecond))
+}
+
+// durationEnv returns the duration in the environment variable name, or
+// zero if it isn't set, and exits if it is invalid.
+func durationEnv(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		fmt.Fprintf(os.Stderr, "invalid %s %q\n", name, v)
+		os.Exit(1)
+	}
+	return d
+}
+
 func ensureKey(path, comment string) error {
 	if _, err := os.Stat(path); err == nil {
 		return nil
@@ -82,3 +780,47 @@ func ensureAuthorizedFile(path string) error {
 	}
 	return os.WriteFile(path, []byte{}, 0o600)
 }
+
+// newWebhookEgress configures where webhook deliveries may go from the
+// environment: REPOCRAFT_WEBHOOK_PROXY is an HTTP proxy to send them
+// through, REPOCRAFT_WEBHOOK_ALLOW_CIDRS and REPOCRAFT_WEBHOOK_BLOCK_CIDRS
+// open up internal or close further address ranges,
+// REPOCRAFT_WEBHOOK_HTTPS_ONLY=true refuses plain http and
+// REPOCRAFT_WEBHOOK_CA is a PEM bundle to verify endpoints against.
+func newWebhookEgress(policy cryptopolicy.Policy) *webhook.Egress {
+	fail := func(name, v string) {
+		fmt.Fprintf(os.Stderr, "invalid %s: %q\n", name, v)
+		os.Exit(1)
+	}
+	e := &webhook.Egress{TLS: policy.TLSConfig}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_PROXY"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("REPOCRAFT_WEBHOOK_PROXY", v)
+		}
+		e.Proxy = u
+	}
+	var err error
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_ALLOW_CIDRS"); v != "" {
+		if e.Allow, err = webhook.ParseCIDRs(v); err != nil {
+			fail("REPOCRAFT_WEBHOOK_ALLOW_CIDRS", v)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_BLOCK_CIDRS"); v != "" {
+		if e.Block, err = webhook.ParseCIDRs(v); err != nil {
+			fail("REPOCRAFT_WEBHOOK_BLOCK_CIDRS", v)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_HTTPS_ONLY"); v != "" {
+		if e.HTTPSOnly, err = strconv.ParseBool(v); err != nil {
+			fail("REPOCRAFT_WEBHOOK_HTTPS_ONLY", v)
+		}
+	}
+	if v := os.Getenv("REPOCRAFT_WEBHOOK_CA"); v != "" {
+		if e.RootCAs, err = webhook.LoadRootCAs(v); err != nil {
+			fmt.Fprintf(os.Stderr, "REPOCRAFT_WEBHOOK_CA: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	return e
+}
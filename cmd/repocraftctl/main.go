@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/client"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/layout"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/reclaim"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repogen"
+)
+
+const defaultRepoRoot = "./.repositories"
+
+// repocraftctl runs maintenance operations against a repository root.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var code int
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "fsck-layout":
+		code = fsckLayout(ctx, args)
+	case "generate-repo":
+		code = generateRepo(ctx, args)
+	case "reclaim":
+		code = reclaimRoot(ctx, args)
+	case "restore-ref":
+		code = restoreRef(ctx, args)
+	case "tail":
+		code = tail(ctx, args)
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "repocraftctl: unknown command %q\n", cmd)
+		usage()
+		code = 2
+	}
+	os.Exit(code)
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: repocraftctl <command> [flags]
+
+Commands:
+  fsck-layout    check the repository root's layout and repair what is safe to
+  generate-repo  generate a synthetic repository for tests and benchmarks
+  reclaim        remove repositories never pushed to and empty namespaces
+  restore-ref    restore a deleted or force-pushed branch from the ref history
+  tail           follow githttpd's log and events live
+
+Run repocraftctl <command> -h for the command's flags.
+`)
+}
+
+// fsckLayout reports the layout problems of a repository root, fixing what
+// it safely can unless -dry-run is given. It exits with 1 when problems
+// remain.
+func fsckLayout(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("fsck-layout", flag.ExitOnError)
+	root := fs.String("root", defaultRepoRoot, "repository root")
+	dryRun := fs.Bool("dry-run", false, "only report, fix nothing")
+	staleAfter := fs.Duration("stale-after", 24*time.Hour, "age after which temporary build directories are left over")
+	fs.Parse(args)
+
+	checker := &layout.Checker{RepoRoot: *root, Fix: !*dryRun, StaleAfter: *staleAfter}
+	problems, err := checker.Check(ctx)
+	remaining := 0
+	for _, p := range problems {
+		if p.Fixed {
+			fmt.Printf("fixed    %s\n", p)
+			continue
+		}
+		remaining++
+		fmt.Printf("problem  %s\n", p)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck-layout: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d problems, %d fixed\n", len(problems), len(problems)-remaining)
+	if remaining > 0 {
+		return 1
+	}
+	return 0
+}
+
+// generateRepo writes a synthetic bare repository of the given shape. The
+// same flags always generate the same repository.
+func generateRepo(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("generate-repo", flag.ExitOnError)
+	gen := &repogen.Generator{}
+	dir := fs.String("dir", "", "bare repository to create, e.g. ./.repositories/bench/large.git")
+	fs.StringVar(&gen.Branch, "branch", "main", "default branch")
+	fs.IntVar(&gen.Commits, "commits", 1000, "commits on the default branch")
+	fs.IntVar(&gen.Branches, "branches", 10, "branches besides the default one")
+	fs.IntVar(&gen.BranchCommits, "branch-commits", 5, "commits of each branch")
+	fs.IntVar(&gen.Files, "files", 500, "files of the first commit")
+	fs.IntVar(&gen.MinBlobSize, "min-blob-size", 64, "smallest blob in bytes")
+	fs.IntVar(&gen.MaxBlobSize, "max-blob-size", 64<<10, "largest blob in bytes")
+	fs.Float64Var(&gen.BinaryRatio, "binary-ratio", 0.1, "fraction of binary files")
+	fs.Int64Var(&gen.Seed, "seed", 1, "seed of the generator")
+	fs.Parse(args)
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "generate-repo: -dir is required")
+		fs.Usage()
+		return 2
+	}
+
+	start := time.Now()
+	sum, err := gen.Generate(ctx, *dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate-repo: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s: %d commits, %d branches, %d blobs (%d binary, %d bytes) in %s\n",
+		*dir, sum.Commits, sum.Branches+1, sum.Blobs, sum.BinaryBlobs, sum.BlobBytes, time.Since(start).Round(time.Millisecond))
+	return 0
+}
+
+// reclaimRoot removes repositories that never received a push and
+// namespaces without repositories, or with -dry-run lists them.
+func reclaimRoot(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("reclaim", flag.ExitOnError)
+	c := &reclaim.Collector{}
+	fs.StringVar(&c.RepoRoot, "root", defaultRepoRoot, "repository root")
+	fs.DurationVar(&c.EmptyAfter, "empty-after", 30*24*time.Hour, "age after which repositories without refs are removed; 0 keeps them")
+	fs.BoolVar(&c.Namespaces, "namespaces", true, "remove namespaces without repositories")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "only report, remove nothing")
+	fs.Parse(args)
+
+	removals, err := c.Collect(ctx, time.Now())
+	verb := "removed"
+	if c.DryRun {
+		verb = "would remove"
+	}
+	for _, r := range removals {
+		fmt.Printf("%s %s\n", verb, r)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reclaim: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d %s\n", len(removals), verb)
+	return 0
+}
+
+// restoreRef asks a running githttpd to point a ref back to a commit from
+// its recorded history, or with -list prints that history.
+func restoreRef(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("restore-ref", flag.ExitOnError)
+	server := fs.String("url", "http://localhost:8080", "githttpd base URL")
+	token := fs.String("admin-token", os.Getenv("REPOCRAFT_ADMIN_TOKEN"), "admin token")
+	repo := fs.String("repo", "", "repository, e.g. owner/repo.git")
+	ref := fs.String("ref", "", "ref to restore, e.g. main or refs/heads/main")
+	to := fs.String("to", "", "commit to restore; defaults to the one before the ref's last update")
+	reason := fs.String("reason", "", "why the ref is restored, for the server's log")
+	list := fs.Bool("list", false, "only list the recorded updates of the ref")
+	fs.Parse(args)
+	if *repo == "" || *ref == "" {
+		fmt.Fprintln(os.Stderr, "restore-ref: -repo and -ref are required")
+		fs.Usage()
+		return 2
+	}
+	name := *ref
+	if !strings.HasPrefix(name, "refs/") {
+		name = "refs/heads/" + name
+	}
+
+	c := &client.Client{BaseURL: strings.TrimSuffix(*server, "/"), AdminToken: *token}
+	if *list {
+		updates, err := c.RefHistory(ctx, *repo, name, time.Time{}, time.Time{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restore-ref: %v\n", err)
+			return 1
+		}
+		for _, u := range updates {
+			fmt.Printf("%s  %s -> %s  %s\n", u.Time.Local().Format(time.DateTime), u.Old, u.New, u.Pusher)
+		}
+		return 0
+	}
+	res, err := c.RestoreRef(ctx, *repo, name, *to, *reason)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore-ref: %v\n", err)
+		return 1
+	}
+	switch {
+	case res.Old == res.New:
+		fmt.Printf("%s already points to %s\n", res.Ref, res.New)
+	case res.Old == "":
+		fmt.Printf("recreated %s at %s\n", res.Ref, res.New)
+	default:
+		fmt.Printf("restored %s: %s -> %s\n", res.Ref, res.Old, res.New)
+	}
+	return 0
+}
+
+// tail prints what a running githttpd logs and its events as they happen,
+// until interrupted.
+func tail(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	server := fs.String("url", "http://localhost:8080", "githttpd base URL")
+	token := fs.String("admin-token", os.Getenv("REPOCRAFT_ADMIN_TOKEN"), "admin token")
+	repo := fs.String("repo", "", "only log lines mentioning and events of repositories matching this pattern, e.g. owner/*")
+	user := fs.String("user", "", "only log lines mentioning and events made by this user or address")
+	severity := fs.String("severity", "", "least severe log lines to print: debug, info or error")
+	logs := fs.Bool("logs", true, "print log lines")
+	events := fs.Bool("events", true, "print events")
+	asJSON := fs.Bool("json", false, "print entries as JSON, one per line")
+	fs.Parse(args)
+
+	c := &client.Client{BaseURL: strings.TrimSuffix(*server, "/"), AdminToken: *token}
+	opts := client.TailOptions{Repo: *repo, User: *user, Severity: *severity, NoLogs: !*logs, NoEvents: !*events}
+	enc := json.NewEncoder(os.Stdout)
+	err := c.Tail(ctx, opts, func(entry client.TailEntry) error {
+		switch {
+		case *asJSON && entry.Log != nil:
+			return enc.Encode(entry.Log)
+		case *asJSON:
+			return enc.Encode(entry.Event)
+		case entry.Log != nil:
+			fmt.Printf("%s %-5s %s\n", entry.Log.Time.Local().Format(time.TimeOnly), strings.ToUpper(entry.Log.Severity), entry.Log.Message)
+		default:
+			e := entry.Event
+			line := fmt.Sprintf("%s EVENT %s %s", e.Time.Local().Format(time.TimeOnly), e.Type, e.Repo)
+			if e.From != "" {
+				line += " from " + e.From
+			}
+			if e.Actor != "" {
+				line += " by " + e.Actor
+			}
+			for _, u := range e.Updates {
+				line += fmt.Sprintf(" %s %.12s..%.12s", u.Ref, u.Old, u.New)
+			}
+			fmt.Println(line)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "tail: %v\n", err)
+		return 1
+	}
+	return 0
+}
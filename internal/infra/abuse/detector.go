@@ -0,0 +1,191 @@
+// Package abuse flags anomalous client behaviour such as mass cloning or
+// credential guessing, and can temporarily block offending clients.
+package abuse
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Kind identifies the pattern that triggered an alert.
+type Kind string
+
+const (
+	// KindMassClone: one identity fetched many distinct repositories.
+	KindMassClone Kind = "mass_clone"
+	// KindRepeatedFullClone: one identity fully cloned the same repository many times.
+	KindRepeatedFullClone Kind = "repeated_full_clone"
+	// KindAuthFailures: one source failed authentication many times.
+	KindAuthFailures Kind = "auth_failures"
+)
+
+// Alert describes a detected anomaly.
+type Alert struct {
+	Kind    Kind
+	Subject string // identity or source address
+	Repo    string // set for repository-specific alerts
+	Count   int
+	Window  time.Duration
+	At      time.Time
+	// BlockedUntil is set when the subject was automatically blocked.
+	BlockedUntil time.Time
+}
+
+func (a Alert) String() string {
+	msg := fmt.Sprintf("%s: %s reached %d within %s", a.Kind, a.Subject, a.Count, a.Window)
+	if a.Repo != "" {
+		msg += " on " + a.Repo
+	}
+	if !a.BlockedUntil.IsZero() {
+		msg += fmt.Sprintf(" (blocked until %s)", a.BlockedUntil.Format(time.RFC3339))
+	}
+	return msg
+}
+
+// Rules configures thresholds; a zero threshold disables that check.
+type Rules struct {
+	// Window is the sliding window all thresholds apply to. Defaults to one hour.
+	Window time.Duration
+	// DistinctRepos alerts when an identity fetches more distinct repositories.
+	DistinctRepos int
+	// FullClonesPerRepo alerts when an identity fully clones one repository more often.
+	FullClonesPerRepo int
+	// AuthFailures alerts when a source fails authentication more often.
+	AuthFailures int
+	// BlockFor, when positive, blocks the offending subject for this long.
+	BlockFor time.Duration
+}
+
+// Detector evaluates Rules over observed events. It is safe for concurrent use.
+type Detector struct {
+	Rules Rules
+	// OnAlert receives every alert; alerts are logged when nil.
+	OnAlert func(Alert)
+
+	mu         sync.Mutex
+	repos      map[string]map[string]time.Time // identity -> repo -> last fetch
+	fullClones map[[2]string][]time.Time       // identity, repo -> clone times
+	authFails  map[string][]time.Time          // source -> failure times
+	blocked    map[string]time.Time            // subject -> until
+}
+
+// ObserveFetch records a fetch of repo by identity.
+func (d *Detector) ObserveFetch(identity, repo string, fullClone bool, at time.Time) {
+	if d == nil || identity == "" {
+		return
+	}
+	var alerts []Alert
+	d.mu.Lock()
+	window := d.window()
+
+	if d.Rules.DistinctRepos > 0 {
+		if d.repos == nil {
+			d.repos = make(map[string]map[string]time.Time)
+		}
+		seen := d.repos[identity]
+		if seen == nil {
+			seen = make(map[string]time.Time)
+			d.repos[identity] = seen
+		}
+		for name, last := range seen {
+			if at.Sub(last) > window {
+				delete(seen, name)
+			}
+		}
+		_, known := seen[repo]
+		seen[repo] = at
+		if !known && len(seen) == d.Rules.DistinctRepos+1 {
+			alerts = append(alerts, d.alertLocked(KindMassClone, identity, "", len(seen), at))
+		}
+	}
+
+	if fullClone && d.Rules.FullClonesPerRepo > 0 {
+		if d.fullClones == nil {
+			d.fullClones = make(map[[2]string][]time.Time)
+		}
+		key := [2]string{identity, repo}
+		times := append(prune(d.fullClones[key], at, window), at)
+		d.fullClones[key] = times
+		if len(times) == d.Rules.FullClonesPerRepo+1 {
+			alerts = append(alerts, d.alertLocked(KindRepeatedFullClone, identity, repo, len(times), at))
+		}
+	}
+	d.mu.Unlock()
+	d.emit(alerts)
+}
+
+// ObserveAuthFailure records a failed authentication attempt from source.
+func (d *Detector) ObserveAuthFailure(source string, at time.Time) {
+	if d == nil || source == "" || d.Rules.AuthFailures <= 0 {
+		return
+	}
+	var alerts []Alert
+	d.mu.Lock()
+	if d.authFails == nil {
+		d.authFails = make(map[string][]time.Time)
+	}
+	times := append(prune(d.authFails[source], at, d.window()), at)
+	d.authFails[source] = times
+	if len(times) == d.Rules.AuthFailures+1 {
+		alerts = append(alerts, d.alertLocked(KindAuthFailures, source, "", len(times), at))
+	}
+	d.mu.Unlock()
+	d.emit(alerts)
+}
+
+// Blocked reports whether subject is currently blocked and until when.
+func (d *Detector) Blocked(subject string, at time.Time) (time.Time, bool) {
+	if d == nil || subject == "" {
+		return time.Time{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.blocked[subject]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !at.Before(until) {
+		delete(d.blocked, subject)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func (d *Detector) alertLocked(kind Kind, subject, repo string, count int, at time.Time) Alert {
+	a := Alert{Kind: kind, Subject: subject, Repo: repo, Count: count, Window: d.window(), At: at}
+	if d.Rules.BlockFor > 0 {
+		if d.blocked == nil {
+			d.blocked = make(map[string]time.Time)
+		}
+		a.BlockedUntil = at.Add(d.Rules.BlockFor)
+		d.blocked[subject] = a.BlockedUntil
+	}
+	return a
+}
+
+func (d *Detector) emit(alerts []Alert) {
+	for _, a := range alerts {
+		if d.OnAlert != nil {
+			d.OnAlert(a)
+			continue
+		}
+		log.Printf("abuse alert: %s", a)
+	}
+}
+
+func (d *Detector) window() time.Duration {
+	if d.Rules.Window > 0 {
+		return d.Rules.Window
+	}
+	return time.Hour
+}
+
+func prune(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > window {
+		i++
+	}
+	return times[i:]
+}
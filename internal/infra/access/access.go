@@ -0,0 +1,109 @@
+// Package access decides who may read and write which repositories, the
+// same way whichever transport a client uses.
+package access
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repomatch"
+)
+
+// Authorizer decides access to repositories. user is who the transport
+// authenticated the client as, such as an htpasswd user over HTTP or the
+// owner of a key over SSH, or "" for anonymous clients. repo is a path
+// relative to the repository root, such as "team/app.git".
+type Authorizer interface {
+	CanRead(user, repo string) bool
+	CanWrite(user, repo string) bool
+}
+
+const (
+	// Anyone in a rule stands for every authenticated user.
+	Anyone = "*"
+	// Anonymous in a rule stands for clients without an identity.
+	Anonymous = "anonymous"
+)
+
+// Policy is an Authorizer configured in a JSON file:
+//
+//	{"repos": {
+//	  "*/*": {"read": ["*", "anonymous"], "write": ["*"]},
+//	  "secret/*": {"read": ["alice", "bob"], "write": ["alice"]}
+//	}}
+type Policy struct {
+	// Repos maps path.Match patterns such as "team/*" to the rule of
+	// matching repositories; the longest matching pattern wins.
+	// Repositories no pattern matches are closed to everyone.
+	Repos map[string]Rule `json:"repos"`
+}
+
+// Rule lists the users who may access a repository, by name or as Anyone
+// or Anonymous. Writers may also read.
+type Rule struct {
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+}
+
+// Denied returns the error for user refused access to repo, for reading
+// or for writing.
+func Denied(user, repo string, read bool) error {
+	if read {
+		return errcode.Errorf(errcode.AccessDenied, "%s may not read %s", user, repo)
+	}
+	return errcode.Errorf(errcode.AccessDenied, "%s may not push to %s", user, repo)
+}
+
+// LoadPolicy reads a Policy from a JSON file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read access policy: %w", err)
+	}
+	p := &Policy{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("parse access policy %s: %w", file, err)
+	}
+	for pattern := range p.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("access policy %s: invalid pattern %q", file, pattern)
+		}
+	}
+	return p, nil
+}
+
+// CanRead implements Authorizer.
+func (p *Policy) CanRead(user, repo string) bool {
+	rule := p.rule(repo)
+	return allows(rule.Read, user) || allows(rule.Write, user)
+}
+
+// CanWrite implements Authorizer.
+func (p *Policy) CanWrite(user, repo string) bool {
+	return allows(p.rule(repo).Write, user)
+}
+
+// rule returns the rule of the longest pattern matching repo.
+func (p *Policy) rule(repo string) Rule {
+	rule, _ := repomatch.Best(p.Repos, repo)
+	return rule
+}
+
+// allows reports whether users, as listed in a Rule, include user.
+func allows(users []string, user string) bool {
+	for _, u := range users {
+		switch {
+		case user == "" && u == Anonymous:
+			return true
+		case user != "" && (u == Anyone || u == user):
+			return true
+		}
+	}
+	return false
+}
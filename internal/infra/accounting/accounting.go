@@ -0,0 +1,63 @@
+// Package accounting exports one record per git operation for chargeback
+// and capacity planning.
+package accounting
+
+import (
+	"log"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Record is one accounted operation.
+type Record struct {
+	Time      time.Time     `json:"time"`
+	Identity  string        `json:"identity"`
+	Repo      string        `json:"repo"`
+	Operation string        `json:"operation"` // git-upload-pack, git-receive-pack, ...
+	Transport string        `json:"transport"`
+	BytesIn   int64         `json:"bytes_in"`
+	BytesOut  int64         `json:"bytes_out"`
+	Duration  time.Duration `json:"duration_ns"`
+	UserCPU   time.Duration `json:"user_cpu_ns"`
+	SystemCPU time.Duration `json:"system_cpu_ns"`
+	MaxRSS    int64         `json:"max_rss_bytes"`
+	ExitCode  int           `json:"exit_code"`
+}
+
+// Sink receives accounting records. Implementations must be safe for concurrent use.
+type Sink interface {
+	Write(Record) error
+	Close() error
+}
+
+// Recorder turns service results into records for a Sink.
+type Recorder struct {
+	Sink Sink
+	// Transport is stamped on every record, e.g. "ssh" or "http".
+	Transport string
+}
+
+// Observe records res. It has the signature of ServiceExecutor.OnFinish.
+func (r *Recorder) Observe(res service.Result) {
+	if r == nil || r.Sink == nil {
+		return
+	}
+	rec := Record{
+		Time:      res.Start.UTC(),
+		Identity:  res.Request.Identity,
+		Repo:      res.Request.RepoName,
+		Operation: res.Request.Service.Command(),
+		Transport: r.Transport,
+		BytesIn:   res.BytesIn,
+		BytesOut:  res.BytesOut,
+		Duration:  res.Duration,
+		UserCPU:   res.UserCPU,
+		SystemCPU: res.SystemCPU,
+		MaxRSS:    res.MaxRSS,
+		ExitCode:  res.ExitCode,
+	}
+	if err := r.Sink.Write(rec); err != nil {
+		log.Printf("accounting: %v", err)
+	}
+}
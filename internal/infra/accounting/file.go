@@ -0,0 +1,121 @@
+package accounting
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JSONLSink writes one JSON object per line.
+type JSONLSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewJSONLSink returns a sink writing to w. If w is an io.Closer it is closed by Close.
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{w: w, enc: json.NewEncoder(w)}
+}
+
+// Write implements Sink.
+func (s *JSONLSink) Write(rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(rec)
+}
+
+// Close implements Sink.
+func (s *JSONLSink) Close() error {
+	return closeWriter(s.w)
+}
+
+var csvHeader = []string{
+	"time", "identity", "repo", "operation", "transport",
+	"bytes_in", "bytes_out", "duration_ms", "user_cpu_ms", "system_cpu_ms", "max_rss_bytes", "exit_code",
+}
+
+// CSVSink writes records as CSV rows with durations in milliseconds.
+type CSVSink struct {
+	mu          sync.Mutex
+	w           io.Writer
+	csv         *csv.Writer
+	writeHeader bool
+}
+
+// NewCSVSink returns a sink writing to w. Pass header=false when appending
+// to a file that already has one.
+func NewCSVSink(w io.Writer, header bool) *CSVSink {
+	return &CSVSink{w: w, csv: csv.NewWriter(w), writeHeader: header}
+}
+
+// Write implements Sink.
+func (s *CSVSink) Write(rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeHeader {
+		if err := s.csv.Write(csvHeader); err != nil {
+			return err
+		}
+		s.writeHeader = false
+	}
+	row := []string{
+		rec.Time.Format(time.RFC3339Nano),
+		rec.Identity,
+		rec.Repo,
+		rec.Operation,
+		rec.Transport,
+		strconv.FormatInt(rec.BytesIn, 10),
+		strconv.FormatInt(rec.BytesOut, 10),
+		strconv.FormatInt(rec.Duration.Milliseconds(), 10),
+		strconv.FormatInt(rec.UserCPU.Milliseconds(), 10),
+		strconv.FormatInt(rec.SystemCPU.Milliseconds(), 10),
+		strconv.FormatInt(rec.MaxRSS, 10),
+		strconv.Itoa(rec.ExitCode),
+	}
+	if err := s.csv.Write(row); err != nil {
+		return err
+	}
+	s.csv.Flush()
+	return s.csv.Error()
+}
+
+// Close implements Sink.
+func (s *CSVSink) Close() error {
+	return closeWriter(s.w)
+}
+
+// OpenFileSink opens (appending to) path and returns a CSV or JSONL sink
+// depending on format ("csv" or "jsonl").
+func OpenFileSink(path, format string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open accounting file: %w", err)
+	}
+	switch format {
+	case "jsonl":
+		return NewJSONLSink(f), nil
+	case "csv":
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("open accounting file: %w", err)
+		}
+		return NewCSVSink(f, info.Size() == 0), nil
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unsupported accounting format %q", format)
+	}
+}
+
+func closeWriter(w io.Writer) error {
+	if c, ok := w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
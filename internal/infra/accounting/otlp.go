@@ -0,0 +1,178 @@
+package accounting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPSink exports records as OpenTelemetry log records over OTLP/HTTP
+// (JSON encoding) to Endpoint, e.g. "http://collector:4318". Records are
+// batched and sent every FlushInterval or once BatchSize records queued.
+type OTLPSink struct {
+	Endpoint      string
+	Client        *http.Client
+	ServiceName   string        // resource service.name; defaults to "repocraft"
+	BatchSize     int           // defaults to 100
+	FlushInterval time.Duration // defaults to 5s
+	Headers       map[string]string
+
+	once    sync.Once
+	mu      sync.Mutex
+	pending []Record
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Write implements Sink.
+func (s *OTLPSink) Write(rec Record) error {
+	s.once.Do(s.start)
+	s.mu.Lock()
+	s.pending = append(s.pending, rec)
+	full := len(s.pending) >= s.batchSize()
+	s.mu.Unlock()
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+// Close flushes queued records and stops the background exporter.
+func (s *OTLPSink) Close() error {
+	s.once.Do(s.start)
+	close(s.stop)
+	<-s.done
+	return s.flush()
+}
+
+func (s *OTLPSink) start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	interval := s.FlushInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					log.Printf("accounting: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (s *OTLPSink) batchSize() int {
+	if s.BatchSize > 0 {
+		return s.BatchSize
+	}
+	return 100
+}
+
+func (s *OTLPSink) flush() error {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(s.payload(batch))
+	if err != nil {
+		return fmt.Errorf("encode otlp logs: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.Endpoint, "/")+"/v1/logs", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("export otlp logs: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("export otlp logs: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("export otlp logs: collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 is a string in OTLP/JSON
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func strValue(v string) otlpValue {
+	return otlpValue{StringValue: &v}
+}
+
+func strAttr(k, v string) otlpAttr {
+	return otlpAttr{Key: k, Value: strValue(v)}
+}
+
+func intAttr(k string, v int64) otlpAttr {
+	s := strconv.FormatInt(v, 10)
+	return otlpAttr{Key: k, Value: otlpValue{IntValue: &s}}
+}
+
+func (s *OTLPSink) payload(batch []Record) map[string]any {
+	name := s.ServiceName
+	if name == "" {
+		name = "repocraft"
+	}
+	records := make([]map[string]any, 0, len(batch))
+	for _, rec := range batch {
+		records = append(records, map[string]any{
+			"timeUnixNano": strconv.FormatInt(rec.Time.UnixNano(), 10),
+			"body":         strValue(rec.Operation),
+			"attributes": []otlpAttr{
+				strAttr("repocraft.identity", rec.Identity),
+				strAttr("repocraft.repo", rec.Repo),
+				strAttr("repocraft.operation", rec.Operation),
+				strAttr("repocraft.transport", rec.Transport),
+				intAttr("repocraft.bytes_in", rec.BytesIn),
+				intAttr("repocraft.bytes_out", rec.BytesOut),
+				intAttr("repocraft.duration_ms", rec.Duration.Milliseconds()),
+				intAttr("repocraft.user_cpu_ms", rec.UserCPU.Milliseconds()),
+				intAttr("repocraft.system_cpu_ms", rec.SystemCPU.Milliseconds()),
+				intAttr("repocraft.max_rss_bytes", rec.MaxRSS),
+				intAttr("repocraft.exit_code", int64(rec.ExitCode)),
+			},
+		})
+	}
+	return map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttr{strAttr("service.name", name)}},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]string{"name": "repocraft/accounting"},
+				"logRecords": records,
+			}},
+		}},
+	}
+}
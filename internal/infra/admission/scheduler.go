@@ -0,0 +1,149 @@
+// Package admission limits how many git operations run at once and hands
+// free slots out fairly between tenants.
+package admission
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// Scheduler admits at most Limit operations at a time. Operations waiting
+// for a slot are ordered by weighted fair queuing over their keys (usually
+// the client identity): a key with many queued operations gets its share of
+// slots, interleaved with other keys, instead of everything it queued first.
+// A nil Scheduler or a zero Limit admits everything immediately.
+type Scheduler struct {
+	Limit int
+	// Weights gives keys a larger share of slots; unlisted keys weigh 1.
+	Weights map[string]int
+
+	mu      sync.Mutex
+	running int
+	virtual float64            // tag of the most recently admitted operation
+	last    map[string]float64 // key -> tag of its latest queued operation
+	waiting waitQueue
+	seq     uint64
+}
+
+type waiter struct {
+	key     string
+	tag     float64
+	seq     uint64
+	ready   chan struct{}
+	index   int
+	granted bool
+}
+
+// Acquire blocks until the operation of key may run or ctx is done. The
+// returned release must be called once the operation finished.
+func (s *Scheduler) Acquire(ctx context.Context, key string) (release func(), err error) {
+	if s == nil || s.Limit <= 0 {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	if s.running < s.Limit && s.waiting.Len() == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.releaser(), nil
+	}
+	w := &waiter{key: key, ready: make(chan struct{}), seq: s.seq}
+	s.seq++
+	start := s.virtual
+	if last, ok := s.last[key]; ok && last > start {
+		start = last
+	}
+	w.tag = start + 1/float64(s.weight(key))
+	if s.last == nil {
+		s.last = make(map[string]float64)
+	}
+	s.last[key] = w.tag
+	heap.Push(&s.waiting, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaser(), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if w.granted {
+			// Admitted while giving up; pass the slot on.
+			s.mu.Unlock()
+			s.releaser()()
+			return nil, ctx.Err()
+		}
+		heap.Remove(&s.waiting, w.index)
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns the number of running and queued operations.
+func (s *Scheduler) Stats() (running, queued int) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running, s.waiting.Len()
+}
+
+func (s *Scheduler) weight(key string) int {
+	if w := s.Weights[key]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (s *Scheduler) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.waiting.Len() == 0 {
+				s.running--
+				if s.running == 0 {
+					// Idle: forget history so tags stay small.
+					s.virtual, s.last = 0, nil
+				}
+				return
+			}
+			// Hand the slot directly to the next waiter.
+			w := heap.Pop(&s.waiting).(*waiter)
+			w.granted = true
+			s.virtual = w.tag
+			if s.last[w.key] == w.tag {
+				delete(s.last, w.key)
+			}
+			close(w.ready)
+		})
+	}
+}
+
+// waitQueue is a min-heap of waiters by tag, then arrival.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].tag != q[j].tag {
+		return q[i].tag < q[j].tag
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,886 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/exporter"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/importer"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/maintenance"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/purge"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refhistory"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/replication"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+)
+
+const maxAdminBodyBytes = 1 << 20
+
+// maxValidatePackBytes bounds packs sent to the validate-pack endpoint.
+const maxValidatePackBytes = 2 << 30
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="repocraft-admin"`)
+		writeError(w, http.StatusUnauthorized, "admin token required")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, pprofPrefix) {
+		s.handlePprof(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/admin/fetch-tokens":
+		s.handleIssueFetchToken(w, r)
+	case "/api/v1/admin/user-tokens":
+		s.handleIssueUserToken(w, r)
+	case "/api/v1/admin/sudo-tokens":
+		s.handleIssueSudoToken(w, r)
+	case "/api/v1/admin/audit":
+		s.handleAudit(w, r)
+	case "/api/v1/admin/user-keys/stale":
+		s.handleStaleUserKeys(w, r)
+	case "/api/v1/admin/credentials":
+		s.handleCredentials(w, r)
+	case "/api/v1/admin/repos":
+		s.handleCreateRepo(w, r)
+	case "/api/v1/admin/repos/wiki":
+		s.handleCreateWiki(w, r)
+	case "/api/v1/admin/repos/transfer":
+		s.handleTransfer(w, r)
+	case "/api/v1/admin/repos/archive":
+		s.handleArchive(w, r)
+	case "/api/v1/admin/repos/merge":
+		s.handleMerge(w, r)
+	case "/api/v1/admin/repos/legal-hold":
+		s.handleLegalHold(w, r)
+	case "/api/v1/admin/repos/ref-history":
+		s.handleRefHistory(w, r)
+	case "/api/v1/admin/repos/ref-history/restore":
+		s.handleRestoreRef(w, r)
+	case "/api/v1/admin/repos/webhooks":
+		s.handleWebhooks(w, r)
+	case "/api/v1/admin/repos/sparse-profiles":
+		s.handleAdminSparseProfiles(w, r)
+	case "/api/v1/admin/repos/policies":
+		s.handlePolicies(w, r)
+	case "/api/v1/admin/repos/export-rules":
+		s.handleExportRules(w, r)
+	case "/api/v1/admin/repos/checksum":
+		s.handleChecksum(w, r)
+	case "/api/v1/admin/repos/repair":
+		s.handleRepair(w, r)
+	case "/api/v1/admin/repos/maintenance":
+		s.handleMaintenance(w, r)
+	case "/api/v1/admin/repos/encrypt":
+		s.handleEncrypt(w, r)
+	case "/api/v1/admin/repos/validate-pack":
+		s.handleValidatePack(w, r)
+	case "/api/v1/admin/hooks/sync":
+		s.handleHookSync(w, r)
+	case "/api/v1/admin/sessions":
+		s.handleSessions(w, r)
+	case "/api/v1/admin/provision":
+		s.handleProvision(w, r)
+	case "/api/v1/admin/imports":
+		s.handleImports(w, r)
+	case "/api/v1/admin/exports":
+		s.handleExports(w, r)
+	case "/api/v1/admin/purges":
+		s.handlePurges(w, r)
+	case "/api/v1/admin/config":
+		s.handleConfig(w, r)
+	case "/api/v1/admin/diagnostics":
+		s.handleDiagnostics(w, r)
+	case "/api/v1/admin/diagnostics/download":
+		s.handleDiagnosticsDownload(w, r)
+	case "/api/v1/admin/debug":
+		s.handleDebug(w, r)
+	case "/api/v1/admin/tail":
+		s.handleTail(w, r)
+	case "/api/v1/admin/flags":
+		s.handleFlags(w, r)
+	case "/api/v1/admin/freezes":
+		s.handleFreezes(w, r)
+	case "/api/v1/admin/freezes/override":
+		s.handleFreezeOverride(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) isAdmin(r *http.Request) bool {
+	if s.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) == 1
+}
+
+func decodeAdminBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxAdminBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+type fetchTokenRequest struct {
+	Repo string `json:"repo"`
+	TTL  string `json:"ttl"` // Go duration, e.g. "30m"; defaults to one hour
+}
+
+type fetchTokenResponse struct {
+	Repo    string    `json:"repo"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (s *Server) handleIssueFetchToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.FetchTokens == nil {
+		writeError(w, http.StatusNotFound, "fetch tokens are not enabled")
+		return
+	}
+
+	var req fetchTokenRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ttl := time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		ttl = d
+	}
+	if _, err := s.openRepo(req.Repo); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	repoPath := strings.Trim(req.Repo, "/")
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := s.FetchTokens.Sign(repoPath, expires)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, fetchTokenResponse{Repo: repoPath, Token: token, Expires: expires})
+}
+
+type transferRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type createRepoRequest struct {
+	Repo string `json:"repo"`
+	// Wiki creates the repository's wiki as well.
+	Wiki bool `json:"wiki,omitempty"`
+}
+
+// handleCreateRepo creates an empty repository, and the namespaces above it
+// as needed.
+func (s *Server) handleCreateRepo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Manager == nil {
+		writeError(w, http.StatusNotFound, "repository management is not enabled")
+		return
+	}
+	var req createRepoRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := s.Manager.Create(req.Repo)
+	if err == nil && req.Wiki {
+		err = s.Manager.CreateWiki(req.Repo)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, repoadmin.ErrRepoExists):
+			writeCodedError(w, err)
+		case errors.Is(err, repoadmin.ErrInvalidPath):
+			writeCodedError(w, err)
+		default:
+			log.Printf("api create %s: %v", req.Repo, err)
+			writeError(w, http.StatusInternalServerError, "create failed")
+		}
+		return
+	}
+	writeJSON(w, http.StatusCreated, createRepoRequest{Repo: strings.Trim(req.Repo, "/"), Wiki: req.Wiki})
+}
+
+type wikiRequest struct {
+	Repo string `json:"repo"`
+}
+
+// handleCreateWiki creates the wiki of an existing repository.
+func (s *Server) handleCreateWiki(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Manager == nil {
+		writeError(w, http.StatusNotFound, "repository management is not enabled")
+		return
+	}
+	var req wikiRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.Manager.CreateWiki(req.Repo); err != nil {
+		switch {
+		case errors.Is(err, repoadmin.ErrRepoNotFound):
+			writeCodedError(w, err)
+		case errors.Is(err, repoadmin.ErrRepoExists):
+			writeCodedError(w, err)
+		case errors.Is(err, repoadmin.ErrInvalidPath):
+			writeCodedError(w, err)
+		default:
+			log.Printf("api create wiki %s: %v", req.Repo, err)
+			writeError(w, http.StatusInternalServerError, "create failed")
+		}
+		return
+	}
+	writeJSON(w, http.StatusCreated, wikiRequest{Repo: service.WikiPath(req.Repo)})
+}
+
+func (s *Server) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Manager == nil {
+		writeError(w, http.StatusNotFound, "repository management is not enabled")
+		return
+	}
+	var req transferRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.Manager.Transfer(req.From, req.To); err != nil {
+		switch {
+		case errors.Is(err, repoadmin.ErrRepoNotFound):
+			writeCodedError(w, err)
+		case errors.Is(err, repoadmin.ErrRepoExists):
+			writeCodedError(w, err)
+		case errors.Is(err, repoadmin.ErrInvalidPath):
+			writeCodedError(w, err)
+		default:
+			log.Printf("api transfer %s -> %s: %v", req.From, req.To, err)
+			writeError(w, http.StatusInternalServerError, "transfer failed")
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"from": strings.Trim(req.From, "/"),
+		"to":   strings.Trim(req.To, "/"),
+	})
+}
+
+type archiveRequest struct {
+	Repo     string `json:"repo"`
+	Archived bool   `json:"archived"`
+}
+
+// handleArchive archives a repository, making it refuse pushes, or
+// unarchives it.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Manager == nil {
+		writeError(w, http.StatusNotFound, "repository management is not enabled")
+		return
+	}
+	var req archiveRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.Manager.SetArchived(req.Repo, req.Archived); err != nil {
+		switch {
+		case errors.Is(err, repoadmin.ErrRepoNotFound):
+			writeCodedError(w, err)
+		case errors.Is(err, repoadmin.ErrInvalidPath):
+			writeCodedError(w, err)
+		default:
+			log.Printf("api archive %s: %v", req.Repo, err)
+			writeError(w, http.StatusInternalServerError, "archive failed")
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, archiveRequest{Repo: strings.Trim(req.Repo, "/"), Archived: req.Archived})
+}
+
+type legalHoldRequest struct {
+	Repo string `json:"repo"`
+	// Hold places the hold, or releases it when false.
+	Hold bool `json:"hold"`
+	// Refs are the refs to hold or release; the whole repository, or
+	// everything held, when empty.
+	Refs   []string `json:"refs,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+type legalHoldResponse struct {
+	Repo string `json:"repo"`
+	service.LegalHold
+}
+
+// handleLegalHold shows, places and releases the legal hold of a
+// repository. Held refs, or every ref of a held repository, can't be
+// updated or deleted, and maintenance doesn't prune their objects.
+func (s *Server) handleLegalHold(w http.ResponseWriter, r *http.Request) {
+	if s.Manager == nil {
+		writeError(w, http.StatusNotFound, "repository management is not enabled")
+		return
+	}
+	var (
+		hold service.LegalHold
+		repo string
+		err  error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		repo = r.URL.Query().Get("repo")
+		hold, err = s.Manager.LegalHold(repo)
+	case http.MethodPost:
+		var req legalHoldRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		repo = req.Repo
+		if req.Hold {
+			hold, err = s.Manager.PlaceLegalHold(req.Repo, req.Refs, req.Reason)
+		} else {
+			hold, err = s.Manager.ReleaseLegalHold(req.Repo, req.Refs)
+		}
+		if err == nil {
+			what := "the repository"
+			if len(req.Refs) > 0 {
+				what = strings.Join(req.Refs, ", ")
+			}
+			if req.Hold {
+				log.Printf("legal hold: placed on %s of %s (%s)", what, req.Repo, hold.Reason)
+			} else {
+				log.Printf("legal hold: released %s of %s", what, req.Repo)
+			}
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err != nil {
+		if errcode.CodeOf(err) == errcode.Internal {
+			log.Printf("api legal hold %s: %v", repo, err)
+			writeError(w, http.StatusInternalServerError, "legal hold failed")
+			return
+		}
+		writeCodedError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, legalHoldResponse{Repo: strings.Trim(repo, "/"), LegalHold: hold})
+}
+
+type mergeRequest struct {
+	Repo string `json:"repo"`
+	repoadmin.MergeRequest
+}
+
+// handleMerge merges a branch or commit into a branch on behalf of a
+// review system; protected branches accept such merges without a signed
+// push.
+func (s *Server) handleMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Manager == nil {
+		writeError(w, http.StatusNotFound, "repository management is not enabled")
+		return
+	}
+	var req mergeRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res, err := s.Manager.Merge(r.Context(), req.Repo, req.MergeRequest)
+	if err != nil {
+		if errcode.CodeOf(err) == errcode.Internal {
+			log.Printf("api merge %s: %v", req.Repo, err)
+			writeError(w, http.StatusInternalServerError, "merge failed")
+			return
+		}
+		writeCodedError(w, err)
+		return
+	}
+	log.Printf("merged %s into %s of %s: %s..%s", req.From, res.Ref, req.Repo, res.Old, res.New)
+	s.recordRefUpdate(req.Repo, refhistory.Update{Ref: res.Ref, Old: res.Old, New: res.New, Pusher: adminActor})
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleChecksum reports the ref checksum of a repository and, with
+// replication enabled, of each replica.
+func (s *Server) handleChecksum(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := r.URL.Query().Get("repo")
+	full, err := s.resolveRepoPath(name)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if _, err := s.openRepo(name); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	replicator := s.Replicator
+	if replicator == nil {
+		replicator = &replication.Replicator{Repos: s.repoCache()}
+	}
+	st, err := replicator.Verify(r.Context(), full, name, false)
+	if err != nil {
+		log.Printf("api checksum %s: %v", name, err)
+		writeError(w, http.StatusInternalServerError, "checksum failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+type repairRequest struct {
+	Repo string `json:"repo"`
+}
+
+// handleRepair updates diverged replicas of a repository to match this node.
+func (s *Server) handleRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Replicator == nil {
+		writeError(w, http.StatusNotFound, "replication is not enabled")
+		return
+	}
+	var req repairRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	full, err := s.resolveRepoPath(req.Repo)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if _, err := s.openRepo(req.Repo); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	st, err := s.Replicator.Verify(r.Context(), full, req.Repo, true)
+	if err != nil {
+		log.Printf("api repair %s: %v", req.Repo, err)
+		writeError(w, http.StatusInternalServerError, "repair failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+type maintenanceRequest struct {
+	Repo string `json:"repo"`
+	// Force starts maintenance even while a push is active.
+	Force bool `json:"force"`
+}
+
+// handleMaintenance starts maintenance of a repository outside its window.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Maintenance == nil {
+		writeError(w, http.StatusNotFound, "maintenance is not enabled")
+		return
+	}
+	var req maintenanceRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	full, err := s.resolveRepoPath(req.Repo)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if _, err := s.openRepo(req.Repo); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	if err := s.Maintenance.Trigger(full, req.Force); err != nil {
+		if errors.Is(err, maintenance.ErrBusy) || errors.Is(err, maintenance.ErrEncrypted) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"repo": strings.Trim(req.Repo, "/"), "status": "started"})
+}
+
+type encryptRequest struct {
+	Repo string `json:"repo"`
+}
+
+// handleEncrypt converts a repository to encryption at rest.
+func (s *Server) handleEncrypt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Encryption == nil {
+		writeError(w, http.StatusNotFound, "encryption at rest is not enabled")
+		return
+	}
+	var req encryptRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	full, err := s.resolveRepoPath(req.Repo)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if _, err := s.openRepo(req.Repo); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if err := s.Encryption.Encrypt(r.Context(), full); err != nil {
+		log.Printf("api encrypt %s: %v", req.Repo, err)
+		writeError(w, http.StatusInternalServerError, "encryption failed")
+		return
+	}
+	s.repoCache().Evict(full)
+	writeJSON(w, http.StatusOK, map[string]string{"repo": strings.Trim(req.Repo, "/"), "status": "encrypted"})
+}
+
+// handleValidatePack checks the pack in the request body against a
+// repository without storing it, e.g. for bots to pre-flight a push.
+func (s *Server) handleValidatePack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := r.URL.Query().Get("repo")
+	full, err := s.resolveRepoPath(name)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if _, err := s.openRepo(name); err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxValidatePackBytes)
+	report, err := repoadmin.ValidatePack(r.Context(), full, body)
+	if err != nil {
+		log.Printf("api validate-pack %s: %v", name, err)
+		writeError(w, http.StatusInternalServerError, "pack validation failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleHookSync applies the hook template to the repository named by the
+// repo query parameter, or to all repositories without it.
+func (s *Server) handleHookSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.HookTemplate == nil {
+		writeError(w, http.StatusNotFound, "hook template is not configured")
+		return
+	}
+	var report repoadmin.HookSyncReport
+	var err error
+	if name := r.URL.Query().Get("repo"); name != "" {
+		full, rerr := s.resolveRepoPath(name)
+		if rerr != nil {
+			writeRepoError(w, rerr)
+			return
+		}
+		if _, rerr := s.openRepo(name); rerr != nil {
+			writeRepoError(w, rerr)
+			return
+		}
+		report, err = s.HookTemplate.Apply(full)
+	} else {
+		report, err = s.HookTemplate.Sync(r.Context())
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleSessions lists the git operations in progress with the bytes
+// transferred so far.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sessions := s.Sessions.List()
+	if sessions == nil {
+		sessions = []service.Session{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// handleConfig reports the effective configuration, enabled features and
+// component health of the running server.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Introspection.Report(r.Context()))
+}
+
+// handleFlags lists the feature flags with their rollout state, defaults
+// included.
+func (s *Server) handleFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Flags.Flags())
+}
+
+type provisionResponse struct {
+	DryRun  bool               `json:"dry_run"`
+	Changes []provision.Change `json:"changes"`
+}
+
+// handleProvision converges the repositories to the manifest, or with
+// dry_run=true only reports the changes it would make.
+func (s *Server) handleProvision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Provisioner == nil {
+		writeError(w, http.StatusNotFound, "provisioning is not enabled")
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	var changes []provision.Change
+	var err error
+	if dryRun {
+		changes, err = s.Provisioner.Plan(r.Context())
+	} else {
+		changes, err = s.Provisioner.Apply(r.Context())
+	}
+	if err != nil {
+		log.Printf("api provision: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if changes == nil {
+		changes = []provision.Change{}
+	}
+	writeJSON(w, http.StatusOK, provisionResponse{DryRun: dryRun, Changes: changes})
+}
+
+type importRequest struct {
+	// Provider is "github" or "gitlab".
+	Provider string `json:"provider"`
+	// Owner is the GitHub organization or GitLab group.
+	Owner string `json:"owner"`
+	Token string `json:"token"`
+	// BaseURL selects a self-hosted instance.
+	BaseURL   string `json:"base_url"`
+	Namespace string `json:"namespace"`
+	Metadata  bool   `json:"metadata"`
+}
+
+// handleImports starts an import with POST and reports the progress of
+// recent imports, or of the one named by the id parameter, with GET.
+func (s *Server) handleImports(w http.ResponseWriter, r *http.Request) {
+	if s.Importer == nil {
+		writeError(w, http.StatusNotFound, "imports are not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if v := r.URL.Query().Get("id"); v != "" {
+			id, _ := strconv.Atoi(v)
+			job, ok := s.Importer.Job(id)
+			if !ok {
+				writeError(w, http.StatusNotFound, "import not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Importer.Jobs())
+	case http.MethodPost:
+		var req importRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		src, err := importer.ParseSource(req.Provider, req.Owner, req.Token, req.BaseURL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		job, err := s.Importer.Start(src, importer.Options{Namespace: req.Namespace, Metadata: req.Metadata})
+		switch {
+		case errors.Is(err, importer.ErrRunning):
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeJSON(w, http.StatusAccepted, job)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type exportRequest struct {
+	// Target is "github", "gitlab" or "repocraft".
+	Target string `json:"target"`
+	// Owner is the GitHub organization or GitLab group.
+	Owner string `json:"owner"`
+	Token string `json:"token"`
+	// BaseURL selects a self-hosted instance, or the Repocraft server.
+	BaseURL  string   `json:"base_url"`
+	Repos    []string `json:"repos"`
+	Prefix   string   `json:"prefix"`
+	Metadata bool     `json:"metadata"`
+	// Submodules adds the repositories hosted here that the selected ones
+	// use as submodules.
+	Submodules bool `json:"submodules"`
+}
+
+// handleExports starts an export with POST and reports the progress of
+// recent exports, or of the one named by the id parameter, with GET.
+func (s *Server) handleExports(w http.ResponseWriter, r *http.Request) {
+	if s.Exporter == nil {
+		writeError(w, http.StatusNotFound, "exports are not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if v := r.URL.Query().Get("id"); v != "" {
+			id, _ := strconv.Atoi(v)
+			job, ok := s.Exporter.Job(id)
+			if !ok {
+				writeError(w, http.StatusNotFound, "export not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Exporter.Jobs())
+	case http.MethodPost:
+		var req exportRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		target, err := exporter.ParseTarget(req.Target, req.Owner, req.Token, req.BaseURL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		job, err := s.Exporter.Start(target, exporter.Options{Repos: req.Repos, Prefix: req.Prefix, Metadata: req.Metadata, Submodules: req.Submodules})
+		switch {
+		case errors.Is(err, exporter.ErrRunning):
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeJSON(w, http.StatusAccepted, job)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handlePurges starts a purge with POST and reports the progress of recent
+// purges, or of the one named by the id parameter, with GET.
+func (s *Server) handlePurges(w http.ResponseWriter, r *http.Request) {
+	if s.Purger == nil {
+		writeError(w, http.StatusNotFound, "purges are not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if v := r.URL.Query().Get("id"); v != "" {
+			id, _ := strconv.Atoi(v)
+			job, ok := s.Purger.Job(id)
+			if !ok {
+				writeError(w, http.StatusNotFound, "purge not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Purger.Jobs())
+	case http.MethodPost:
+		var req purge.Request
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		job, err := s.Purger.Start(req)
+		if err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultMaxBatchRepos = 500
+	maxBatchBodyBytes    = 1 << 20
+)
+
+type batchRefsRequest struct {
+	Repos []string `json:"repos"`
+	// Prefixes restricts the returned refs; defaults to branches and tags.
+	Prefixes []string `json:"prefixes"`
+}
+
+type batchRefsResult struct {
+	refsResponse
+	Error string `json:"error,omitempty"`
+}
+
+type batchRefsResponse struct {
+	Results []batchRefsResult `json:"results"`
+}
+
+// handleRefsBatch returns ref tips for many repositories in one round trip.
+// Per-repository failures are reported inline so one missing repository does
+// not fail the whole batch.
+func (s *Server) handleRefsBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req batchRefsRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBatchBodyBytes))
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if len(req.Repos) == 0 {
+		writeError(w, http.StatusBadRequest, "no repositories requested")
+		return
+	}
+	if max := s.maxBatchRepos(); len(req.Repos) > max {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("too many repositories (max %d)", max))
+		return
+	}
+	prefixes := req.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{"refs/heads/", "refs/tags/"}
+	}
+
+	resp := batchRefsResponse{Results: make([]batchRefsResult, 0, len(req.Repos))}
+	for _, repoPath := range req.Repos {
+		result := batchRefsResult{refsResponse: refsResponse{Repo: repoPath}}
+		rp, err := s.openVisibleRepo(r, repoPath)
+		if err != nil {
+			result.Error = err.Error()
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+		refs, err := readRefs(rp, repoPath)
+		if err != nil {
+			result.Error = "failed to read refs"
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+		result.refsResponse = filterRefs(refs, prefixes)
+		resp.Results = append(resp.Results, result)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) maxBatchRepos() int {
+	if s.MaxBatchRepos > 0 {
+		return s.MaxBatchRepos
+	}
+	return defaultMaxBatchRepos
+}
+
+func filterRefs(resp refsResponse, prefixes []string) refsResponse {
+	kept := resp.Refs[:0]
+	for _, ref := range resp.Refs {
+		for _, p := range prefixes {
+			if strings.HasPrefix(ref.Name, p) {
+				kept = append(kept, ref)
+				break
+			}
+		}
+	}
+	resp.Refs = kept
+	return resp
+}
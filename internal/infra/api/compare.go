@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+)
+
+type compareResponse struct {
+	Repo string `json:"repo"`
+	Base string `json:"base"`
+	Head string `json:"head"`
+	// MergeBase is empty for unrelated histories.
+	MergeBase string `json:"merge_base,omitempty"`
+	Ahead     int    `json:"ahead"`
+	Behind    int    `json:"behind"`
+}
+
+// handleCompare reports how far head is ahead of and behind base, which
+// defaults to HEAD, and their merge base. Repositories without a
+// commit-graph get one first, so later comparisons stay fast on long
+// histories.
+func (s *Server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	repoPath := q.Get("repo")
+	baseRev, headRev := q.Get("base"), q.Get("head")
+	if baseRev == "" {
+		baseRev = "HEAD"
+	}
+	if headRev == "" {
+		writeError(w, http.StatusBadRequest, "missing head")
+		return
+	}
+	rp, err := s.openRepoContents(r, repoPath)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	pin, err := s.requestPin(r, s.repoName(rp))
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+	base, err := resolveRevision(rp, pin, baseRev)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "revision not found")
+		return
+	}
+	head, err := resolveRevision(rp, pin, headRev)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "revision not found")
+		return
+	}
+
+	if !rp.HasCommitGraph() {
+		if err := repoadmin.EnsureCommitGraph(r.Context(), rp.Path()); err != nil {
+			log.Printf("api compare %s: %v", repoPath, err)
+		}
+	}
+	cmp, err := rp.Compare(base, head)
+	if err != nil {
+		if errors.Is(err, repo.ErrObjectNotFound) {
+			writeError(w, http.StatusNotFound, "commit not found")
+			return
+		}
+		log.Printf("api compare %s %s...%s: %v", repoPath, baseRev, headRev, err)
+		writeError(w, http.StatusInternalServerError, "failed to compare commits")
+		return
+	}
+	resp := compareResponse{Repo: repoPath, Base: base.String(), Head: head.String(), Ahead: cmp.Ahead, Behind: cmp.Behind}
+	if !cmp.MergeBase.IsZero() {
+		resp.MergeBase = cmp.MergeBase.String()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets browser frontends hosted on other origins call the API.
+// Requests from origins not listed get no CORS headers, so browsers keep
+// their responses from the calling page.
+type CORS struct {
+	// AllowedOrigins lists origins such as "https://git.example.com"; "*"
+	// allows any origin.
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET and POST.
+	AllowedMethods []string
+	// AllowedHeaders defaults to Authorization and Content-Type.
+	AllowedHeaders []string
+	// MaxAge is how long browsers may cache a preflight; defaults to ten
+	// minutes.
+	MaxAge time.Duration
+}
+
+// exposedHeaders are response headers frontends may read.
+const exposedHeaders = "Retry-After, WWW-Authenticate"
+
+// handle adds the CORS headers for r and reports whether r was a preflight
+// request, which is then fully answered.
+func (c *CORS) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if c == nil || origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if !c.allowsOrigin(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if !preflight {
+		h.Set("Access-Control-Expose-Headers", exposedHeaders)
+		return false
+	}
+
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost}
+	}
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Authorization", "Content-Type"}
+	}
+	maxAge := c.MaxAge
+	if maxAge <= 0 {
+		maxAge = 10 * time.Minute
+	}
+	if !containsFold(methods, r.Header.Get("Access-Control-Request-Method")) {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if name = strings.TrimSpace(name); name != "" && !containsFold(headers, name) {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	h.Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (c *CORS) allowsOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// setSecurityHeaders marks API responses as data that browsers must not
+// render, frame or cache.
+func setSecurityHeaders(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("Cross-Origin-Opener-Policy", "same-origin")
+	if r.TLS != nil {
+		h.Set("Strict-Transport-Security", "max-age=31536000")
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/v1/admin/") {
+		h.Set("Cache-Control", "no-store")
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+)
+
+type credentialsResponse struct {
+	UnusedFor   string                 `json:"unused_for"`
+	Credentials []credusage.Credential `json:"credentials"`
+}
+
+// handleCredentials reports how SSH keys, tokens and HTTP users were used,
+// with flags for forgotten credentials and suspicious use. The kind and
+// owner parameters narrow the report down, flagged=true leaves out
+// credentials without flags, and unused_for is how long keys go unused
+// before they are flagged.
+func (s *Server) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Credentials == nil {
+		writeError(w, http.StatusNotFound, "credential usage is not recorded")
+		return
+	}
+	q := r.URL.Query()
+	opts := credusage.ReportOptions{Kind: q.Get("kind"), Owner: q.Get("owner"), UnusedFor: defaultUnusedFor}
+	if v := q.Get("unused_for"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid unused_for")
+			return
+		}
+		opts.UnusedFor = d
+	}
+	if v := q.Get("flagged"); v != "" {
+		flagged, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid flagged")
+			return
+		}
+		opts.Flagged = flagged
+	}
+	creds, err := s.Credentials.Report(time.Now(), opts)
+	if err != nil {
+		log.Printf("api credentials: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to read credential usage")
+		return
+	}
+	if creds == nil {
+		creds = []credusage.Credential{}
+	}
+	writeJSON(w, http.StatusOK, credentialsResponse{UnusedFor: opts.UnusedFor.String(), Credentials: creds})
+}
+
+// recordToken records a use of a user or sudo token by r.
+func (s *Server) recordToken(r *http.Request, kind, token, user, actor string) {
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+	s.Credentials.Record(credusage.Use{
+		Kind:   kind,
+		ID:     credusage.TokenID(token),
+		Owner:  user,
+		Actor:  actor,
+		Op:     r.Method + " " + r.URL.Path,
+		Source: source,
+	}, time.Now())
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/deviceauth"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// devicePage asks for a device code and the user token approving it, and
+// shows the outcome. The page has no scripts or styles, which the
+// Content-Security-Policy of API responses wouldn't allow.
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Approve a push</title></head>
+<body>
+<h1>Approve a push</h1>
+{{if .Approved}}<p>The push to <b>{{.Approved.Repo}}</b> from {{.Approved.Client}} is approved for {{.Approved.User}} until {{.Approved.Expires.Format "15:04 MST"}}. Push again to the URL it showed.</p>
+{{else}}{{if .Error}}<p><b>{{.Error}}</b></p>
+{{end}}<p>Only approve a code shown by a push you started yourself.</p>
+<form method="post">
+<p><label>Code <input name="code" value="{{.Code}}" autocomplete="off" required></label></p>
+<p><label>User token <input name="token" type="password" autocomplete="off" required></label></p>
+<p><button type="submit">Approve</button></p>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type devicePageData struct {
+	Code     string
+	Error    string
+	Approved *deviceauth.Code
+}
+
+// handleDevicePage serves the page where users approve the code of a
+// refused push with their user token.
+func (s *Server) handleDevicePage(w http.ResponseWriter, r *http.Request) {
+	if s.DeviceAuth == nil || s.UserTokens == nil {
+		writeError(w, http.StatusNotFound, "device approval is not enabled")
+		return
+	}
+	data := devicePageData{Code: r.URL.Query().Get("code")}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+		data.Code = r.PostFormValue("code")
+		code, err := s.approveDevice(r, r.PostFormValue("token"), data.Code)
+		if err != nil {
+			status = errcode.As(err).HTTPStatus()
+			data.Error = errcode.Text(err)
+		} else {
+			data.Approved = &code
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = devicePage.Execute(w, data)
+}
+
+type deviceCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// handleDeviceCodes approves the code of a refused push for the user of
+// a user token. Admins and sudo tokens can't approve codes for users.
+func (s *Server) handleDeviceCodes(w http.ResponseWriter, r *http.Request) {
+	if s.DeviceAuth == nil || s.UserTokens == nil {
+		writeError(w, http.StatusNotFound, "device approval is not enabled")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req deviceCodeRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	code, err := s.approveDevice(r, token, req.Code)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="repocraft-user"`)
+		writeCodedError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, code)
+}
+
+// approveDevice approves code for the user token identifies.
+func (s *Server) approveDevice(r *http.Request, token, code string) (deviceauth.Code, error) {
+	user, err := s.UserTokens.VerifyUser(token, time.Now())
+	if err != nil {
+		return deviceauth.Code{}, errcode.Errorf(errcode.Unauthenticated, "invalid user token: %w", err)
+	}
+	s.recordToken(r, credusage.KindUserToken, token, user, "")
+	approved, err := s.DeviceAuth.Approve(code, user, time.Now())
+	if err != nil {
+		return deviceauth.Code{}, err
+	}
+	log.Printf("user %s approved pushes to %s from %s", user, approved.Repo, approved.Client)
+	return approved, nil
+}
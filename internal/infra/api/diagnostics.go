@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+)
+
+const pprofPrefix = "/api/v1/admin/pprof/"
+
+type captureRequest struct {
+	Kind string `json:"kind"`
+	// Duration is a Go duration, e.g. "30s", for CPU profiles and traces.
+	Duration string `json:"duration,omitempty"`
+}
+
+type debugRequest struct {
+	Subsystem string `json:"subsystem"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// handlePprof serves the net/http/pprof handlers under the admin prefix.
+// Their CPU profiles and traces stream over the request, so long ones are
+// better captured with handleDiagnostics.
+func (s *Server) handlePprof(w http.ResponseWriter, r *http.Request) {
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, "diagnostics are not enabled")
+		return
+	}
+	switch name := strings.TrimPrefix(r.URL.Path, pprofPrefix); name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
+
+// handleDiagnostics lists the captured profiles and traces, or starts a
+// new capture in the background.
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, "diagnostics are not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if v := r.URL.Query().Get("id"); v != "" {
+			id, _ := strconv.Atoi(v)
+			c, ok := s.Diagnostics.Capture(id)
+			if !ok {
+				writeError(w, http.StatusNotFound, "capture not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, c)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Diagnostics.Captures())
+	case http.MethodPost:
+		var req captureRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid duration")
+				return
+			}
+		}
+		c, err := s.Diagnostics.Start(req.Kind, d)
+		if err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, c)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleDiagnosticsDownload sends the file of a finished capture, for
+// go tool pprof or go tool trace.
+func (s *Server) handleDiagnosticsDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Diagnostics == nil {
+		writeError(w, http.StatusNotFound, "diagnostics are not enabled")
+		return
+	}
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	f, c, err := s.Diagnostics.Open(id)
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.Filename()))
+	w.Header().Set("Content-Length", strconv.FormatInt(c.Size, 10))
+	_, _ = io.Copy(w, f)
+}
+
+// handleDebug lists the subsystems' debug logging toggles, or switches one.
+func (s *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, diag.Toggles())
+	case http.MethodPost:
+		var req debugRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := diag.SetDebug(req.Subsystem, req.Enabled); err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, diag.Toggles())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+)
+
+const (
+	// eventsPoll is how often the event stream looks for new events.
+	eventsPoll = time.Second
+	// eventsKeepalive is how often an idle event stream sends a comment,
+	// so proxies don't close it.
+	eventsKeepalive = 15 * time.Second
+)
+
+// handleEvents streams the event log as server-sent events. Each event's
+// id resumes the stream after it, through the after parameter or the
+// Last-Event-ID header that EventSource clients send on reconnecting;
+// without either, the stream starts with new events. The repo parameter,
+// a path.Match pattern, and types, a comma-separated list, narrow it down.
+// Events of private repositories are only sent to admins.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Events == nil {
+		writeError(w, http.StatusNotFound, "the event log is not enabled")
+		return
+	}
+	q := r.URL.Query()
+	pattern := strings.Trim(q.Get("repo"), "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid repo pattern")
+		return
+	}
+	types := make(map[string]bool)
+	for _, t := range strings.Split(q.Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	after := q.Get("after")
+	if after == "" {
+		after = r.Header.Get("Last-Event-ID")
+	}
+	cursor, err := s.Events.Cursor(after, time.Now())
+	if err != nil {
+		if errcode.CodeOf(err) == errcode.Internal {
+			log.Printf("api events: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to read the event log")
+			return
+		}
+		writeCodedError(w, err)
+		return
+	}
+
+	st, ok := startStream(w, ": repocraft events\n\n")
+	if !ok {
+		return
+	}
+
+	poll := time.NewTicker(eventsPoll)
+	defer poll.Stop()
+	idle := time.Now()
+	for {
+		list, err := cursor.Next(time.Now())
+		if err != nil {
+			log.Printf("api events: %v", err)
+			return
+		}
+		var buf []byte
+		skipped := false
+		for _, e := range list {
+			skipped = !s.wantEvent(r, e, pattern, types)
+			if skipped {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("api events: %v", err)
+				continue
+			}
+			buf = fmt.Appendf(buf, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		}
+		if skipped {
+			// Skipped events still move a resuming client past them.
+			buf = fmt.Appendf(buf, "id: %s\n\n", list[len(list)-1].ID)
+		}
+		if len(buf) == 0 && time.Since(idle) >= eventsKeepalive {
+			buf = []byte(": keepalive\n\n")
+		}
+		if len(buf) > 0 {
+			if !st.send(buf) {
+				return
+			}
+			idle = time.Now()
+		}
+		if len(list) > 0 {
+			// There may be more to read right away.
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// wantEvent reports whether e is sent to the client of r asking for
+// events of repositories matching pattern and, unless empty, of types. A
+// transfer matches by either path, so followers see repositories leave.
+func (s *Server) wantEvent(r *http.Request, e events.Event, pattern string, types map[string]bool) bool {
+	if len(types) > 0 && !types[e.Type] {
+		return false
+	}
+	if pattern != "" && !matchRepo(pattern, e.Repo) && (e.From == "" || !matchRepo(pattern, e.From)) {
+		return false
+	}
+	return !s.hidden(r, e.Repo) && (e.From == "" || !s.hidden(r, e.From))
+}
+
+// matchRepo reports whether pattern matches repo, with or without ".git".
+func matchRepo(pattern, repo string) bool {
+	ok, _ := path.Match(pattern, repo)
+	bare, _ := path.Match(pattern, strings.TrimSuffix(repo, ".git"))
+	return ok || bare
+}
+
+// stream is a response of server-sent events.
+type stream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// startStream sends the headers of a stream of server-sent events and
+// first, a comment telling the client the stream is open.
+func startStream(w http.ResponseWriter, first string) (*stream, bool) {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	// Proxies that buffer responses would hold events back.
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	st := &stream{w: w, rc: http.NewResponseController(w)}
+	return st, st.send([]byte(first))
+}
+
+// send writes buf past the server's write timeout, which is meant for git
+// requests, not streams that stay open.
+func (st *stream) send(buf []byte) bool {
+	st.rc.SetWriteDeadline(time.Now().Add(eventsKeepalive + 30*time.Second))
+	if _, err := st.w.Write(buf); err != nil {
+		return false
+	}
+	return st.rc.Flush() == nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+)
+
+type exportRulesRequest struct {
+	Repo  string                 `json:"repo"`
+	Rules []repoadmin.ExportRule `json:"rules"`
+}
+
+type exportRulesResponse struct {
+	Repo  string                 `json:"repo"`
+	Rules []repoadmin.ExportRule `json:"rules"`
+}
+
+// handleExportRules shows and replaces the export rules of a repository,
+// which decide what its archives leave out and expand.
+func (s *Server) handleExportRules(w http.ResponseWriter, r *http.Request) {
+	if s.Manager == nil {
+		writeError(w, http.StatusNotFound, "repository management is not enabled")
+		return
+	}
+	var (
+		rules []repoadmin.ExportRule
+		repo  string
+		err   error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		repo = r.URL.Query().Get("repo")
+		rules, err = s.Manager.ExportRules(repo)
+	case http.MethodPut:
+		var req exportRulesRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		repo = req.Repo
+		rules, err = s.Manager.SetExportRules(req.Repo, req.Rules)
+		if err == nil {
+			log.Printf("export rules: %s has %d rules", req.Repo, len(rules))
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err != nil {
+		if errcode.CodeOf(err) == errcode.Internal {
+			log.Printf("api export rules %s: %v", repo, err)
+			writeError(w, http.StatusInternalServerError, "export rules failed")
+			return
+		}
+		writeCodedError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, exportRulesResponse{Repo: strings.Trim(repo, "/"), Rules: rules})
+}
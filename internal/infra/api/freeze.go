@@ -0,0 +1,76 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
+)
+
+type freezeOverrideRequest struct {
+	Name string `json:"name"`
+	// Until defaults to the end of the window's current occurrence.
+	Until  *time.Time `json:"until,omitempty"`
+	Reason string     `json:"reason"`
+}
+
+// handleFreezes lists the freeze windows with their state.
+func (s *Server) handleFreezes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Freeze == nil {
+		writeError(w, http.StatusNotFound, "freeze windows are not enabled")
+		return
+	}
+	statuses := s.Freeze.Status(time.Now())
+	if statuses == nil {
+		statuses = []freeze.Status{}
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleFreezeOverride lifts a freeze window in an emergency, or removes
+// the override so the window is in force again.
+func (s *Server) handleFreezeOverride(w http.ResponseWriter, r *http.Request) {
+	if s.Freeze == nil {
+		writeError(w, http.StatusNotFound, "freeze windows are not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var req freezeOverrideRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var until time.Time
+		if req.Until != nil {
+			until = *req.Until
+		}
+		st, err := s.Freeze.SetOverride(req.Name, until, req.Reason, time.Now())
+		if err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		log.Printf("freeze window %s overridden until %s: %s", req.Name, st.Override.Until.Format(time.RFC3339), req.Reason)
+		writeJSON(w, http.StatusOK, st)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeError(w, http.StatusBadRequest, "missing name")
+			return
+		}
+		st, err := s.Freeze.ClearOverride(name, time.Now())
+		if err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		log.Printf("freeze window %s override removed", name)
+		writeJSON(w, http.StatusOK, st)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+type namespaceResponse struct {
+	Path string `json:"path"`
+	// Namespaces and Repos are the direct children, with full paths.
+	Namespaces []string `json:"namespaces"`
+	Repos      []string `json:"repos"`
+}
+
+// handleNamespace lists the namespaces and repositories directly inside the
+// namespace given by the path parameter, or at the top level without it.
+// Private repositories and namespaces are left out without the admin token.
+func (s *Server) handleNamespace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ns := strings.Trim(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	dir := filepath.Clean(s.RepoRoot)
+	if ns != "" {
+		full, err := s.resolveRepoPath(ns)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		dir = full
+	}
+	if hiddenPath(ns) || service.IsRepository(dir) || (ns != "" && s.hidden(r, ns)) {
+		writeError(w, http.StatusNotFound, "namespace not found")
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, "namespace not found")
+			return
+		}
+		log.Printf("api namespace %s: %v", ns, err)
+		writeError(w, http.StatusInternalServerError, "failed to list namespace")
+		return
+	}
+
+	resp := namespaceResponse{Path: ns, Namespaces: []string{}, Repos: []string{}}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		child := path.Join(ns, e.Name())
+		if s.hidden(r, child) {
+			continue
+		}
+		if service.IsRepository(filepath.Join(dir, e.Name())) {
+			resp.Repos = append(resp.Repos, child)
+		} else {
+			resp.Namespaces = append(resp.Namespaces, child)
+		}
+	}
+	sort.Strings(resp.Namespaces)
+	sort.Strings(resp.Repos)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func hiddenPath(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refpin"
+)
+
+type snapshotRequest struct {
+	Repo string `json:"repo"`
+	TTL  string `json:"ttl,omitempty"` // Go duration, e.g. "30m"; defaults to one hour
+}
+
+// errSnapshotRepo is returned for snapshots used with another repository
+// than the one they pin.
+var errSnapshotRepo = errcode.New(errcode.InvalidRequest, "the snapshot is of another repository")
+
+// handleSnapshots pins the refs of a repository, so that browsing requests
+// passing the snapshot's ID see them as they were, returns a snapshot, or
+// releases one before it expires.
+func (s *Server) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if s.Pins == nil {
+		writeError(w, http.StatusNotFound, "snapshots are not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		pin, err := s.Pins.Get(r.URL.Query().Get("id"), time.Now())
+		if err == nil && s.hidden(r, pin.Repo) {
+			err = refpin.ErrNotFound
+		}
+		if err != nil {
+			writeSnapshotError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, pin)
+	case http.MethodPost:
+		var req snapshotRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid ttl")
+				return
+			}
+			ttl = d
+		}
+		rp, err := s.openVisibleRepo(r, req.Repo)
+		if err != nil {
+			writeRepoError(w, err)
+			return
+		}
+		refs, err := rp.Refs()
+		if err != nil {
+			log.Printf("api snapshot %s: %v", req.Repo, err)
+			writeError(w, http.StatusInternalServerError, "failed to read refs")
+			return
+		}
+		pinned := make([]refpin.Ref, 0, len(refs))
+		for _, ref := range refs {
+			p := refpin.Ref{Name: ref.Name, Target: ref.Target.String()}
+			if !ref.Peeled.IsZero() {
+				p.Peeled = ref.Peeled.String()
+			}
+			pinned = append(pinned, p)
+		}
+		head, _ := rp.SymbolicTarget("HEAD")
+		pin, err := s.Pins.Create(s.repoName(rp), head, pinned, ttl, time.Now())
+		if err != nil {
+			writeSnapshotError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, pin)
+	case http.MethodDelete:
+		if err := s.Pins.Release(r.URL.Query().Get("id")); err != nil {
+			writeSnapshotError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// requestPin returns the snapshot a browsing request of the named
+// repository passes in the snapshot parameter, or nil if it passes none.
+func (s *Server) requestPin(r *http.Request, name string) (*refpin.Pin, error) {
+	id := r.URL.Query().Get("snapshot")
+	if id == "" {
+		return nil, nil
+	}
+	if s.Pins == nil {
+		return nil, errcode.New(errcode.NotFound, "snapshots are not enabled")
+	}
+	pin, err := s.Pins.Get(id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if pin.Repo != name {
+		return nil, errSnapshotRepo
+	}
+	return pin, nil
+}
+
+// resolveRevision resolves rev in rp, as pinned by pin if it isn't nil.
+func resolveRevision(rp *repo.Repository, pin *refpin.Pin, rev string) (repo.Hash, error) {
+	if pin == nil {
+		return rp.ResolveRevision(rev)
+	}
+	target, ok := pin.Resolve(rev, isObjectName)
+	if !ok {
+		return repo.ZeroHash, repo.ErrRefNotFound
+	}
+	return repo.ParseHash(target)
+}
+
+func isObjectName(rev string) bool {
+	_, err := repo.ParseHash(rev)
+	return err == nil
+}
+
+// repoName returns the name of rp relative to the repository root.
+func (s *Server) repoName(rp *repo.Repository) string {
+	root, _ := filepath.Abs(s.RepoRoot)
+	dir, _ := filepath.Abs(rp.Path())
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return rp.Path()
+	}
+	return filepath.ToSlash(rel)
+}
+
+func writeSnapshotError(w http.ResponseWriter, err error) {
+	if errcode.CodeOf(err) == errcode.Internal {
+		log.Printf("api snapshot: %v", err)
+		writeError(w, http.StatusInternalServerError, "snapshot failed")
+		return
+	}
+	writeCodedError(w, err)
+}
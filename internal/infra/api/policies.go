@@ -0,0 +1,69 @@
+package api
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/wasmhook"
+)
+
+type policiesResponse struct {
+	Repo     string            `json:"repo"`
+	Policies []wasmhook.Plugin `json:"policies"`
+}
+
+// handlePolicies lists, uploads and removes the WebAssembly policy plugins
+// of a repository. Uploads are the module itself, named by the hook and
+// name parameters.
+func (s *Server) handlePolicies(w http.ResponseWriter, r *http.Request) {
+	if s.Policies == nil {
+		writeError(w, http.StatusNotFound, "policy plugins are not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	name, err := s.servedRepo(q.Get("repo"))
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	dir, err := s.resolveRepoPath(name)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		module, rerr := io.ReadAll(io.LimitReader(r.Body, wasmhook.MaxModuleSize+1))
+		if rerr != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if len(module) > wasmhook.MaxModuleSize {
+			writeCodedError(w, errcode.Errorf(errcode.TooLarge, "plugins are limited to %d MiB", wasmhook.MaxModuleSize>>20))
+			return
+		}
+		err = s.Policies.Save(r.Context(), dir, q.Get("hook"), q.Get("name"), module)
+	case http.MethodDelete:
+		err = wasmhook.Remove(dir, q.Get("hook"), q.Get("name"))
+	}
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	plugins, err := wasmhook.List(dir)
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	if plugins == nil {
+		plugins = []wasmhook.Plugin{}
+	}
+	writeJSON(w, http.StatusOK, policiesResponse{Repo: name, Policies: plugins})
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refhistory"
+)
+
+type refHistoryResponse struct {
+	Repo    string              `json:"repo"`
+	Updates []refhistory.Update `json:"updates"`
+}
+
+type refAtResponse struct {
+	Repo string    `json:"repo"`
+	Ref  string    `json:"ref"`
+	At   time.Time `json:"at"`
+	// Target is empty if the ref didn't exist at the time.
+	Target string `json:"target,omitempty"`
+}
+
+// handleRefHistory lists the recorded updates of a repository's refs, or,
+// with the at parameter, tells what a ref pointed to at that time.
+func (s *Server) handleRefHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.RefHistory == nil {
+		writeError(w, http.StatusNotFound, "the ref history is not enabled")
+		return
+	}
+	q := r.URL.Query()
+	repo, err := s.servedRepo(q.Get("repo"))
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	now := time.Now()
+	if v := q.Get("at"); v != "" {
+		ref := q.Get("ref")
+		if ref == "" {
+			writeError(w, http.StatusBadRequest, "missing ref")
+			return
+		}
+		at, err := parseHistoryTime(v, now)
+		if err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		oid, ok, err := s.RefHistory.At(repo, ref, at)
+		if err != nil {
+			log.Printf("api ref history: %s: %v", repo, err)
+			writeError(w, http.StatusInternalServerError, "failed to read the ref history")
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "no recorded history of "+ref)
+			return
+		}
+		resp := refAtResponse{Repo: repo, Ref: ref, At: at.UTC()}
+		if oid != refhistory.ZeroOID {
+			resp.Target = oid
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	query := refhistory.Query{Ref: q.Get("ref")}
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if v := q.Get(name); v != "" {
+			if *t, err = parseHistoryTime(v, now); err != nil {
+				writeCodedError(w, err)
+				return
+			}
+		}
+	}
+	updates, err := s.RefHistory.Updates(repo, query)
+	if err != nil {
+		log.Printf("api ref history: %s: %v", repo, err)
+		writeError(w, http.StatusInternalServerError, "failed to read the ref history")
+		return
+	}
+	if updates == nil {
+		updates = []refhistory.Update{}
+	}
+	writeJSON(w, http.StatusOK, refHistoryResponse{Repo: repo, Updates: updates})
+}
+
+type restoreRefRequest struct {
+	Repo string `json:"repo"`
+	// Ref is the ref to restore, e.g. "main" or "refs/heads/main".
+	Ref string `json:"ref"`
+	// To is a commit the ref pointed to according to its history; defaults
+	// to the one before its last update.
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleRestoreRef points a deleted or force-pushed ref back to a commit it
+// pointed to before, as recorded in the ref history. Refs under legal hold
+// or frozen can't be restored.
+func (s *Server) handleRestoreRef(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.RefHistory == nil || s.Manager == nil {
+		writeError(w, http.StatusNotFound, "the ref history is not enabled")
+		return
+	}
+	var req restoreRefRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	repo, err := s.servedRepo(req.Repo)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	ref := req.Ref
+	if ref == "" {
+		writeError(w, http.StatusBadRequest, "missing ref")
+		return
+	}
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/heads/" + ref
+	}
+	updates, err := s.RefHistory.Updates(repo, refhistory.Query{Ref: ref})
+	if err != nil {
+		log.Printf("api ref history: %s: %v", repo, err)
+		writeError(w, http.StatusInternalServerError, "failed to read the ref history")
+		return
+	}
+	if len(updates) == 0 {
+		writeError(w, http.StatusNotFound, "no recorded history of "+ref)
+		return
+	}
+	to := req.To
+	if to == "" {
+		if to = updates[len(updates)-1].Old; to == refhistory.ZeroOID {
+			writeError(w, http.StatusBadRequest, ref+" didn't exist before its last update; name the commit to restore")
+			return
+		}
+	}
+	recorded := false
+	for _, u := range updates {
+		recorded = recorded || u.Old == to || u.New == to
+	}
+	if !recorded || to == refhistory.ZeroOID {
+		writeError(w, http.StatusBadRequest, ref+" never pointed to "+to+" in its recorded history")
+		return
+	}
+	for _, f := range s.Freeze.Frozen(repo, time.Now()) {
+		if f.Covers(ref) {
+			writeCodedError(w, errcode.Errorf(errcode.PushFrozen, "%s until %s: %s", f.Name, f.Until.Format(time.RFC1123), f.Reason))
+			return
+		}
+	}
+	res, err := s.Manager.RestoreRef(r.Context(), repo, ref, to)
+	if err != nil {
+		if errcode.CodeOf(err) == errcode.Internal {
+			log.Printf("api restore ref %s: %v", repo, err)
+			writeError(w, http.StatusInternalServerError, "restore failed")
+			return
+		}
+		writeCodedError(w, err)
+		return
+	}
+	if res.Old != res.New {
+		old := res.Old
+		if old == "" {
+			old = refhistory.ZeroOID
+		}
+		log.Printf("restored %s of %s: %s..%s: %s", ref, repo, old, res.New, req.Reason)
+		s.recordRefUpdate(repo, refhistory.Update{Ref: ref, Old: old, New: res.New, Pusher: adminActor})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// servedRepo returns the name of the repository at raw that git requests
+// for it are served with, under which its ref history is kept. Like the
+// git transports, it falls back to raw with ".git" appended.
+func (s *Server) servedRepo(raw string) (string, error) {
+	_, name, err := (service.RepoResolver{Root: s.RepoRoot}).Resolve(raw)
+	if err != nil {
+		return "", errcode.Errorf(errcode.InvalidRequest, "invalid repository path: %w", err)
+	}
+	if _, err := s.openRepo(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// recordRefUpdate adds a ref update the server made itself to the ref
+// history of repo and to the event log.
+func (s *Server) recordRefUpdate(repo string, u refhistory.Update) {
+	if s.RefHistory == nil && s.Events == nil {
+		return
+	}
+	name, err := s.servedRepo(repo)
+	if err == nil {
+		u.Time = time.Now().UTC()
+		s.Events.Record(events.Event{Type: events.RefUpdate, Time: u.Time, Repo: name, Actor: u.Pusher,
+			Updates: []events.Update{{Ref: u.Ref, Old: u.Old, New: u.New}}})
+		if s.RefHistory != nil {
+			err = s.RefHistory.Record(name, u)
+		}
+	}
+	if err != nil {
+		log.Printf("api ref history: %s: %v", repo, err)
+	}
+}
+
+// parseHistoryTime parses an RFC 3339 time, or a Go duration such as "24h"
+// meaning that long before now.
+func parseHistoryTime(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, errcode.Errorf(errcode.InvalidRequest, "invalid time %q: want RFC 3339 or a duration before now", v)
+}
@@ -0,0 +1,532 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/access"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/deviceauth"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/exporter"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/featureflag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/httpsmart"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/importer"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/introspect"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/maintenance"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/purge"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refhistory"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/refpin"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/replication"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/signedurl"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/snapshot"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/userkeys"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/wasmhook"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/webhook"
+)
+
+// Server exposes read-only JSON endpoints over the repositories under RepoRoot.
+// Refs and objects are read in-process through repo.Cache instead of forking git.
+// It handles:
+//   - GET /api/v1/refs?repo=<path>             (all refs and HEAD)
+//   - GET /api/v1/commit?repo=<path>&rev=<rev> (a single commit)
+//   - GET /api/v1/compare?repo=<path>&head=<rev> (ahead/behind and merge base)
+//   - POST /api/v1/refs/batch                 (branch/tag tips of many repos)
+//   - GET /api/v1/stats[?repo=<path>]         (activity statistics)
+//   - GET /api/v1/openapi.json                (OpenAPI document of the API)
+//   - GET/POST/DELETE /api/v1/user/keys       (the caller's own SSH keys)
+//   - GET/POST /api/v1/device                 (approve a refused push)
+//
+// Endpoints under /api/v1/admin/ require AdminToken as a bearer token, and
+// those under /api/v1/user/ a user token or a sudo token.
+type Server struct {
+	RepoRoot string
+	// MaxBatchRepos caps the number of repositories in one batch request.
+	// Defaults to 500 when zero.
+	MaxBatchRepos int
+	// Stats optionally exposes recorded per-repository activity.
+	Stats *repostats.Store
+	// AdminToken guards the admin endpoints; they are disabled when empty.
+	AdminToken string
+	// FetchTokens issues signed, expiring read tokens.
+	FetchTokens *signedurl.Signer
+	// Manager performs administrative layout changes such as transfers.
+	Manager *repoadmin.Manager
+	// Replicator, if set, includes replicas in checksums and enables repair.
+	Replicator *replication.Replicator
+	// Maintenance, if set, lets admins start repository maintenance on demand.
+	Maintenance *maintenance.Scheduler
+	// Encryption, if set, lets admins encrypt repositories at rest.
+	Encryption *atrest.Store
+	// HookTemplate, if set, lets admins link template hooks into repositories.
+	HookTemplate *repoadmin.HookTemplate
+	// Sessions, if set, lists the git operations in progress.
+	Sessions *service.Sessions
+	// Repos optionally shares open repositories with other components.
+	Repos *repo.Cache
+	// CORS, if set, lets browser frontends on other origins call the API.
+	CORS *CORS
+	// Provisioned, if set, hides private repositories from requests
+	// without the admin token.
+	Provisioned *provision.Index
+	// Auth, if set, identifies the clients of the read endpoints as it
+	// does git clients.
+	Auth httpsmart.Authenticator
+	// Authorizer, if set, hides the repositories the client Auth
+	// identified, or an anonymous one, may not fetch from, as the git
+	// transports refuse them. Requests with the admin token see them all.
+	Authorizer access.Authorizer
+	// Provisioner, if set, lets admins plan and apply the repository
+	// manifest on demand.
+	Provisioner *provision.Reconciler
+	// Importer, if set, lets admins import repositories from GitHub and
+	// GitLab.
+	Importer *importer.Importer
+	// Exporter, if set, lets admins push repositories to GitHub, GitLab or
+	// another Repocraft server.
+	Exporter *exporter.Exporter
+	// Purger, if set, lets admins remove files from the history of
+	// repositories.
+	Purger *purge.Purger
+	// Introspection, if set, reports the server's configuration and health
+	// to admins.
+	Introspection *introspect.Registry
+	// Diagnostics, if set, lets admins profile and trace the running server.
+	Diagnostics *diag.Capturer
+	// Flags, if set, are shown to admins with their rollout state.
+	Flags *featureflag.Set
+	// Freeze, if set, lets admins see freeze windows and override them.
+	Freeze *freeze.Schedule
+	// UserKeys, if set, lets users register their own SSH keys.
+	UserKeys *userkeys.Store
+	// UserTokens issues and verifies the tokens users manage their keys
+	// with, and the sudo tokens automation acts on their behalf with.
+	UserTokens *signedurl.Signer
+	// Audit, if set, keeps a record of every request an admin or a sudo
+	// token makes as a user; otherwise they are only logged.
+	Audit *AuditLog
+	// RefHistory, if set, lets admins look up where refs pointed in the
+	// past.
+	RefHistory *refhistory.Store
+	// Webhooks, if set, lets admins configure the webhooks of
+	// repositories.
+	Webhooks *webhook.Dispatcher
+	// Policies, if set, lets admins upload WebAssembly policy plugins to
+	// repositories.
+	Policies *wasmhook.Runner
+	// Archives, if set, serves source archives of commits.
+	Archives *snapshot.Archiver
+	// DeviceAuth, if set, lets users approve the codes of pushes refused
+	// for lack of credentials.
+	DeviceAuth *deviceauth.Store
+	// Pins, if set, lets clients pin the refs of a repository for reads
+	// spanning several requests.
+	Pins *refpin.Store
+	// Logs, if set, lets admins follow what the server logs.
+	Logs *diag.LogTail
+	// Events, if set, streams the event log to indexers and mirrors.
+	Events *events.Log
+	// Credentials, if set, records the use of user and sudo tokens and
+	// reports the use of all credentials to admins.
+	Credentials *credusage.Store
+
+	once  sync.Once
+	repos *repo.Cache
+}
+
+type refJSON struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	Peeled string `json:"peeled,omitempty"`
+}
+
+type refsResponse struct {
+	Repo string `json:"repo"`
+	Head string `json:"head,omitempty"`
+	// Archived repositories refuse pushes.
+	Archived bool `json:"archived,omitempty"`
+	// Wiki is the path of the repository's wiki, if it has one.
+	Wiki string    `json:"wiki,omitempty"`
+	Refs []refJSON `json:"refs"`
+}
+
+type signatureJSON struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"when"`
+}
+
+type commitResponse struct {
+	Hash      string        `json:"hash"`
+	Tree      string        `json:"tree"`
+	Parents   []string      `json:"parents"`
+	Author    signatureJSON `json:"author"`
+	Committer signatureJSON `json:"committer"`
+	Message   string        `json:"message"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	setSecurityHeaders(w, r)
+	// Preflights carry no credentials, so they are answered before the
+	// admin token is checked.
+	if s.CORS.handle(w, r) {
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/v1/admin/") {
+		s.serveAdmin(w, r)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), clientKey{}, &client{}))
+
+	switch r.URL.Path {
+	case "/api/v1/refs":
+		s.handleRefs(w, r)
+	case "/api/v1/commit":
+		s.handleCommit(w, r)
+	case "/api/v1/compare":
+		s.handleCompare(w, r)
+	case "/api/v1/refs/batch":
+		s.handleRefsBatch(w, r)
+	case "/api/v1/stats":
+		s.handleStats(w, r)
+	case "/api/v1/namespaces":
+		s.handleNamespace(w, r)
+	case "/api/v1/wiki":
+		s.handleWiki(w, r)
+	case "/api/v1/archive":
+		s.handleSnapshot(w, r)
+	case "/api/v1/sparse-profiles":
+		s.handleSparseProfiles(w, r)
+	case "/api/v1/snapshots":
+		s.handleSnapshots(w, r)
+	case "/api/v1/events":
+		s.handleEvents(w, r)
+	case "/api/v1/openapi.json":
+		s.handleOpenAPI(w, r)
+	case "/api/v1/device":
+		s.handleDevicePage(w, r)
+	case "/api/v1/user/keys":
+		s.handleUserKeys(w, r)
+	case "/api/v1/user/device-codes":
+		s.handleDeviceCodes(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) handleRefs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	repoPath := r.URL.Query().Get("repo")
+	rp, err := s.openVisibleRepo(r, repoPath)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	pin, err := s.requestPin(r, s.repoName(rp))
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+	resp, err := readRefs(rp, repoPath)
+	if err != nil {
+		log.Printf("api refs %s: %v", repoPath, err)
+		writeError(w, http.StatusInternalServerError, "failed to read refs")
+		return
+	}
+	if pin != nil {
+		resp.Head, resp.Refs = pin.Head, make([]refJSON, 0, len(pin.Refs))
+		for _, ref := range pin.Refs {
+			resp.Refs = append(resp.Refs, refJSON(ref))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	repoPath := r.URL.Query().Get("repo")
+	rev := r.URL.Query().Get("rev")
+	if rev == "" {
+		rev = "HEAD"
+	}
+	rp, err := s.openRepoContents(r, repoPath)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+
+	pin, err := s.requestPin(r, s.repoName(rp))
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+	h, err := resolveRevision(rp, pin, rev)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "revision not found")
+		return
+	}
+	c, err := rp.Commit(h)
+	if err != nil {
+		if errors.Is(err, repo.ErrObjectNotFound) {
+			writeError(w, http.StatusNotFound, "commit not found")
+			return
+		}
+		log.Printf("api commit %s %s: %v", repoPath, rev, err)
+		writeError(w, http.StatusInternalServerError, "failed to read commit")
+		return
+	}
+
+	resp := commitResponse{
+		Hash:      c.Hash.String(),
+		Tree:      c.Tree.String(),
+		Parents:   make([]string, 0, len(c.Parents)),
+		Author:    signatureJSON(c.Author),
+		Committer: signatureJSON(c.Committer),
+		Message:   c.Message,
+	}
+	for _, p := range c.Parents {
+		resp.Parents = append(resp.Parents, p.String())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Stats == nil {
+		writeError(w, http.StatusNotFound, "statistics are not enabled")
+		return
+	}
+	if repoPath := r.URL.Query().Get("repo"); repoPath != "" {
+		st, ok := s.Stats.Get(strings.Trim(repoPath, "/"))
+		if !ok || s.hidden(r, st.Repo) {
+			writeError(w, http.StatusNotFound, "no activity recorded")
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+		return
+	}
+	all := make([]repostats.RepoStats, 0)
+	for _, st := range s.Stats.All() {
+		if !s.hidden(r, st.Repo) {
+			all = append(all, st)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"repos": all})
+}
+
+func readRefs(rp *repo.Repository, repoPath string) (refsResponse, error) {
+	refs, err := rp.Refs()
+	if err != nil {
+		return refsResponse{}, err
+	}
+	resp := refsResponse{Repo: repoPath, Archived: service.Archived(rp.Path()), Refs: make([]refJSON, 0, len(refs))}
+	if head, err := rp.SymbolicTarget("HEAD"); err == nil {
+		resp.Head = head
+	}
+	if _, ok := service.WikiOf(repoPath); !ok && service.IsRepository(strings.TrimSuffix(rp.Path(), ".git")+service.WikiSuffix) {
+		resp.Wiki = service.WikiPath(repoPath)
+	}
+	for _, ref := range refs {
+		out := refJSON{Name: ref.Name, Target: ref.Target.String()}
+		if !ref.Peeled.IsZero() {
+			out.Peeled = ref.Peeled.String()
+		}
+		resp.Refs = append(resp.Refs, out)
+	}
+	return resp, nil
+}
+
+var errRepoNotFound = errcode.New(errcode.RepoNotFound, "repository not found")
+
+// errEncrypted is returned for reads of the contents of repositories
+// encrypted at rest.
+var errEncrypted = errcode.New(errcode.Conflict, "the repository is encrypted at rest; its contents can only be fetched with git")
+
+func (s *Server) openRepo(repoPath string) (*repo.Repository, error) {
+	full, err := s.resolveRepoPath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(full); err != nil {
+		return nil, errRepoNotFound
+	}
+	rp, err := s.repoCache().Open(full)
+	if err != nil {
+		return nil, errRepoNotFound
+	}
+	return rp, nil
+}
+
+// openVisibleRepo opens a repository for the browsing endpoints, which
+// don't reveal private repositories without the admin token, nor those the
+// client may not fetch from. Like the git transports, it falls back to
+// repoPath with ".git" appended.
+func (s *Server) openVisibleRepo(r *http.Request, repoPath string) (*repo.Repository, error) {
+	if _, name, err := (service.RepoResolver{Root: s.RepoRoot}).Resolve(repoPath); err == nil {
+		repoPath = name
+	}
+	if err := s.checkRead(r, repoPath); err != nil {
+		return nil, err
+	}
+	return s.openRepo(repoPath)
+}
+
+// openRepoContents is openVisibleRepo for the endpoints reading objects. It
+// refuses repositories encrypted at rest, whose objects only git sees
+// decrypted.
+func (s *Server) openRepoContents(r *http.Request, repoPath string) (*repo.Repository, error) {
+	rp, err := s.openVisibleRepo(r, repoPath)
+	if err != nil {
+		return nil, err
+	}
+	if atrest.IsEncrypted(rp.Path()) {
+		return nil, errEncrypted
+	}
+	return rp, nil
+}
+
+func (s *Server) hidden(r *http.Request, repoPath string) bool {
+	return s.checkRead(r, repoPath) != nil
+}
+
+// checkRead returns an error unless the client of r may read repoPath:
+// errRepoNotFound for private repositories and those Authorizer refuses
+// to the client, and an errcode.Unauthenticated error when credentials
+// are missing or wrong.
+func (s *Server) checkRead(r *http.Request, repoPath string) error {
+	if s.isAdmin(r) {
+		return nil
+	}
+	if s.Provisioned.Private(path.Clean("/" + repoPath)) {
+		return errRepoNotFound
+	}
+	name := strings.Trim(repoPath, "/")
+	user, err := s.user(r, name)
+	if err != nil {
+		return err
+	}
+	return s.readable(user, name)
+}
+
+// readable returns an error unless Authorizer lets user, Auth's identity
+// of the client or "" for anonymous ones, read the repository name.
+func (s *Server) readable(user, name string) error {
+	if s.Authorizer != nil && !s.Authorizer.CanRead(user, name) {
+		if user == "" {
+			return errcode.New(errcode.Unauthenticated, "authentication required")
+		}
+		return errRepoNotFound
+	}
+	return nil
+}
+
+type clientKey struct{}
+
+// client is the identity Auth returned for a request, kept on its
+// context so listings checking hundreds of repositories authenticate,
+// which may mean checking a password hash, once.
+type client struct {
+	once sync.Once
+	user string
+	err  error
+}
+
+// user returns the identity Auth gives the client of r, authenticating it
+// for name the first time in a request.
+func (s *Server) user(r *http.Request, name string) (string, error) {
+	if s.Auth == nil {
+		return "", nil
+	}
+	c, ok := r.Context().Value(clientKey{}).(*client)
+	if !ok {
+		return s.Auth(r, name, service.ServiceUploadPack)
+	}
+	c.once.Do(func() {
+		c.user, c.err = s.Auth(r, name, service.ServiceUploadPack)
+	})
+	return c.user, c.err
+}
+
+func (s *Server) repoCache() *repo.Cache {
+	s.once.Do(func() {
+		s.repos = s.Repos
+		if s.repos == nil {
+			s.repos = &repo.Cache{}
+		}
+	})
+	return s.repos
+}
+
+func (s *Server) resolveRepoPath(raw string) (string, error) {
+	cleaned := filepath.ToSlash(filepath.Clean("/" + strings.TrimSpace(raw)))
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	if cleaned == "" || cleaned == "." {
+		return "", errcode.New(errcode.InvalidRequest, "missing repository path")
+	}
+	full := filepath.Join(s.RepoRoot, filepath.FromSlash(cleaned))
+	rootClean := filepath.Clean(s.RepoRoot)
+	if !strings.HasPrefix(full, rootClean+string(os.PathSeparator)) {
+		return "", errcode.New(errcode.InvalidRequest, "invalid repository path")
+	}
+	return full, nil
+}
+
+func writeRepoError(w http.ResponseWriter, err error) {
+	if errcode.CodeOf(err) == errcode.Internal {
+		err = errcode.Errorf(errcode.InvalidRequest, "%w", err)
+	}
+	writeCodedError(w, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with status and an error response whose code follows
+// from the status.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg, Code: errcode.ForStatus(status)})
+}
+
+// writeCodedError answers with the status and code of err.
+func writeCodedError(w http.ResponseWriter, err error) {
+	e := errcode.As(err)
+	writeJSON(w, e.HTTPStatus(), errorResponse{Error: err.Error(), Code: e.Code})
+}
+
+type errorResponse struct {
+	Error string       `json:"error"`
+	Code  errcode.Code `json:"code"`
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/snapshot"
+)
+
+// handleSnapshot serves a source archive of a commit, with the submodules
+// hosted here if asked for. With the snapshot parameter, the commit is
+// resolved in the pinned refs. Like the other browsing endpoints, it only
+// reveals private repositories, including those of submodules, to admins,
+// and others only to clients allowed to fetch them.
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Archives == nil {
+		writeError(w, http.StatusNotFound, "archives are not enabled")
+		return
+	}
+	q := r.URL.Query()
+	resolve := func(raw string) (string, string, error) {
+		full, name, err := (service.RepoResolver{Root: s.RepoRoot}).Resolve(raw)
+		if err != nil || !service.IsRepository(full) {
+			return "", "", errRepoNotFound
+		}
+		if err := s.checkRead(r, name); err != nil {
+			return "", "", err
+		}
+		if atrest.IsEncrypted(full) {
+			return "", "", errEncrypted
+		}
+		return full, name, nil
+	}
+	dir, name, err := resolve(q.Get("repo"))
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	req := snapshot.Request{
+		Repo:       name,
+		Dir:        dir,
+		Rev:        q.Get("rev"),
+		Format:     q.Get("format"),
+		Prefix:     q.Get("prefix"),
+		Submodules: q.Get("submodules") == "true",
+		Resolve: func(name string) (string, error) {
+			dir, _, err := resolve(name)
+			return dir, err
+		},
+	}
+	pin, err := s.requestPin(r, name)
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+	if pin != nil {
+		rev := req.Rev
+		if rev == "" {
+			rev = "HEAD"
+		}
+		var ok bool
+		if req.Rev, ok = pin.Resolve(rev, isObjectName); !ok {
+			writeError(w, http.StatusNotFound, "revision not found")
+			return
+		}
+	}
+	plan, err := s.Archives.Plan(r.Context(), req)
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	format := req.Format
+	if format == "" {
+		format = "tar"
+	}
+	file := strings.TrimSuffix(path.Base(name), ".git") + "." + format
+	w.Header().Set("Content-Type", snapshot.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file))
+	if err := plan.Write(r.Context(), w); err != nil && r.Context().Err() == nil {
+		// The status is sent; the client sees a truncated archive.
+		log.Printf("api archive %s: %v", name, err)
+	}
+}
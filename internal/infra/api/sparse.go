@@ -0,0 +1,125 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/sparse"
+)
+
+type sparseProfileJSON struct {
+	sparse.Profile
+	// Commands clone the repository with the profile.
+	Commands []string `json:"commands"`
+}
+
+type sparseProfilesResponse struct {
+	Repo     string              `json:"repo"`
+	CloneURL string              `json:"clone_url"`
+	Profiles []sparseProfileJSON `json:"profiles"`
+}
+
+// handleSparseProfiles describes the sparse profiles of a repository, or
+// the one named by the profile parameter, with the commands to clone them.
+// Private repositories are only described to admins.
+func (s *Server) handleSparseProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	full, name, err := (service.RepoResolver{Root: s.RepoRoot}).Resolve(r.URL.Query().Get("repo"))
+	if err != nil || s.hidden(r, name) || !service.IsRepository(full) {
+		writeRepoError(w, errRepoNotFound)
+		return
+	}
+	if atrest.IsEncrypted(full) {
+		writeCodedError(w, errEncrypted)
+		return
+	}
+	profiles, err := sparse.Read(r.Context(), full)
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	u := url.URL{Scheme: "http", Host: r.Host, Path: "/" + name}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	dir := strings.TrimSuffix(path.Base(name), ".git")
+	resp := sparseProfilesResponse{Repo: name, CloneURL: u.String(), Profiles: []sparseProfileJSON{}}
+	only := r.URL.Query().Get("profile")
+	for _, p := range profiles {
+		if only == "" || p.Name == only {
+			resp.Profiles = append(resp.Profiles, sparseProfileJSON{Profile: p, Commands: p.Commands(resp.CloneURL, dir)})
+		}
+	}
+	if only != "" && len(resp.Profiles) == 0 {
+		writeCodedError(w, sparse.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type sparseProfileRequest struct {
+	Repo string `json:"repo"`
+	sparse.Profile
+}
+
+type sparseProfilesAdminResponse struct {
+	Repo     string           `json:"repo"`
+	Profiles []sparse.Profile `json:"profiles"`
+}
+
+// handleAdminSparseProfiles adds or replaces, and removes the sparse
+// profiles of a repository.
+func (s *Server) handleAdminSparseProfiles(w http.ResponseWriter, r *http.Request) {
+	var (
+		repo string
+		req  sparseProfileRequest
+	)
+	switch r.Method {
+	case http.MethodDelete:
+		repo = r.URL.Query().Get("repo")
+	case http.MethodPost:
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		repo = req.Repo
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name, err := s.servedRepo(repo)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	dir, err := s.resolveRepoPath(name)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		err = sparse.Save(r.Context(), dir, req.Profile)
+	} else {
+		err = sparse.Remove(r.Context(), dir, r.URL.Query().Get("name"))
+	}
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	profiles, err := sparse.Read(r.Context(), dir)
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	if profiles == nil {
+		profiles = []sparse.Profile{}
+	}
+	writeJSON(w, http.StatusOK, sparseProfilesAdminResponse{Repo: name, Profiles: profiles})
+}
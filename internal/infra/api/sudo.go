@@ -0,0 +1,273 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/signedurl"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/userkeys"
+)
+
+// Scopes a sudo token can grant.
+const (
+	scopeKeysRead  = "keys:read"
+	scopeKeysWrite = "keys:write"
+)
+
+var sudoScopes = []string{scopeKeysRead, scopeKeysWrite}
+
+// adminActor is the actor recorded for requests made with the admin token.
+const adminActor = "admin"
+
+// caller is the user a request to the user endpoints acts as.
+type caller struct {
+	User string
+	// Actor is who acts as User: the admin, or the holder of a sudo
+	// token. It is empty when users act for themselves.
+	Actor string
+	// Reason is why the admin acts as User, if given.
+	Reason string
+	// Scopes limit what a sudo token may do; nil allows everything.
+	Scopes []string
+}
+
+func (c caller) allows(scope string) bool {
+	return c.Scopes == nil || slices.Contains(c.Scopes, scope)
+}
+
+// AuditEntry records something done on behalf of a user.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Actor is "admin" or the actor of a sudo token.
+	Actor string `json:"actor"`
+	User  string `json:"user"`
+	// Action is the request, e.g. "DELETE /api/v1/user/keys", or "issue
+	// sudo token".
+	Action string   `json:"action"`
+	Status int      `json:"status,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// AuditLog keeps AuditEntries in a file, one JSON object per line. A nil
+// AuditLog only logs them.
+type AuditLog struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Record appends e to the log.
+func (l *AuditLog) Record(e AuditEntry) {
+	log.Printf("audit: %s as %s: %s (%d) %q", e.Actor, e.User, e.Action, e.Status, e.Reason)
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0o755); err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+	f.Close()
+}
+
+// Entries returns the recorded entries about user, or all of them if user
+// is empty, oldest first.
+func (l *AuditLog) Entries(user string) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if user == "" || e.User == user {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
+
+type sudoTokenRequest struct {
+	User string `json:"user"`
+	// Actor names who will hold the token, e.g. "support-bot".
+	Actor  string   `json:"actor"`
+	Scopes []string `json:"scopes"`
+	Reason string   `json:"reason"`
+	TTL    string   `json:"ttl"` // Go duration, e.g. "30m"; defaults to one hour
+}
+
+type sudoTokenResponse struct {
+	User    string    `json:"user"`
+	Actor   string    `json:"actor"`
+	Scopes  []string  `json:"scopes"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleIssueSudoToken issues a token with which automation acts as a user
+// within some scopes.
+func (s *Server) handleIssueSudoToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.UserTokens == nil || s.UserKeys == nil {
+		writeError(w, http.StatusNotFound, "user tokens are not enabled")
+		return
+	}
+	var req sudoTokenRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := userkeys.CheckUser(req.User); err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	if req.Actor == "" || req.Actor == adminActor || strings.ContainsAny(req.Actor, "\n\r") {
+		writeError(w, http.StatusBadRequest, "missing or invalid actor")
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		writeError(w, http.StatusBadRequest, "missing reason")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(w, http.StatusBadRequest, "missing scopes")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(sudoScopes, scope) {
+			writeError(w, http.StatusBadRequest, "unknown scope "+scope+"; known are "+strings.Join(sudoScopes, ", "))
+			return
+		}
+	}
+	ttl := time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		ttl = d
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := s.UserTokens.SignSudo(signedurl.Sudo{User: req.User, Actor: req.Actor, Scopes: req.Scopes}, expires)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.Audit.Record(AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  adminActor,
+		User:   req.User,
+		Action: "issue sudo token to " + req.Actor,
+		Scopes: req.Scopes,
+		Reason: req.Reason,
+	})
+	writeJSON(w, http.StatusOK, sudoTokenResponse{User: req.User, Actor: req.Actor, Scopes: req.Scopes, Token: token, Expires: expires})
+}
+
+type auditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// handleAudit lists what admins and sudo tokens did on behalf of users.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.Audit == nil {
+		writeError(w, http.StatusNotFound, "the audit log is not enabled")
+		return
+	}
+	entries, err := s.Audit.Entries(r.URL.Query().Get("user"))
+	if err != nil {
+		log.Printf("api audit: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to read the audit log")
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	writeJSON(w, http.StatusOK, auditResponse{Entries: entries})
+}
+
+// requestUser returns who a request acts as: the user of its user token,
+// the user a sudo token lets it act as, or the one named by the user
+// parameter of an admin request.
+func (s *Server) requestUser(r *http.Request) (caller, error) {
+	if s.isAdmin(r) {
+		user := r.URL.Query().Get("user")
+		if err := userkeys.CheckUser(user); err != nil {
+			return caller{}, err
+		}
+		return caller{User: user, Actor: adminActor, Reason: r.URL.Query().Get("reason")}, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.UserTokens == nil {
+		return caller{}, errcode.New(errcode.Unauthenticated, "user token required")
+	}
+	if signedurl.IsSudo(token) {
+		sudo, err := s.UserTokens.VerifySudo(token, time.Now())
+		if err != nil {
+			return caller{}, errcode.Errorf(errcode.Unauthenticated, "invalid sudo token: %w", err)
+		}
+		s.recordToken(r, credusage.KindSudoToken, token, sudo.User, sudo.Actor)
+		return caller{User: sudo.User, Actor: sudo.Actor, Scopes: sudo.Scopes}, nil
+	}
+	user, err := s.UserTokens.VerifyUser(token, time.Now())
+	if err != nil {
+		return caller{}, errcode.Errorf(errcode.Unauthenticated, "invalid user token: %w", err)
+	}
+	s.recordToken(r, credusage.KindUserToken, token, user, "")
+	return caller{User: user}, nil
+}
+
+// statusRecorder remembers the status of a response for the audit log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
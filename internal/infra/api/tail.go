@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+)
+
+// tailFilter selects the log lines and events a tail follows.
+type tailFilter struct {
+	repo     string // path.Match pattern
+	user     string
+	severity string // least severe log line
+}
+
+// handleTail streams what the server logs and the event log, as
+// server-sent events named "log" for log lines and by type for events, so
+// admins can follow an incident without access to the host. The repo,
+// user and severity parameters narrow it down; logs=false or events=false
+// leaves either out.
+func (s *Server) handleTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	f := tailFilter{repo: strings.Trim(q.Get("repo"), "/"), user: q.Get("user"), severity: q.Get("severity")}
+	if _, err := path.Match(f.repo, ""); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid repo pattern")
+		return
+	}
+	if f.severity != "" && !diag.ValidSeverity(f.severity) {
+		writeError(w, http.StatusBadRequest, "invalid severity, want debug, info or error")
+		return
+	}
+	withLogs, withEvents := s.Logs != nil, s.Events != nil
+	for name, with := range map[string]*bool{"logs": &withLogs, "events": &withEvents} {
+		if v := q.Get(name); v != "" {
+			on, err := strconv.ParseBool(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+			*with = *with && on
+		}
+	}
+	if !withLogs && !withEvents {
+		writeError(w, http.StatusNotFound, "nothing to tail")
+		return
+	}
+
+	var lines <-chan diag.LogLine
+	if withLogs {
+		var cancel func()
+		lines, cancel = s.Logs.Subscribe()
+		defer cancel()
+	}
+	var cursor *events.Cursor
+	if withEvents {
+		var err error
+		if cursor, err = s.Events.Cursor("", time.Now()); err != nil {
+			log.Printf("api tail: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to read the event log")
+			return
+		}
+	}
+	st, ok := startStream(w, ": repocraft tail\n\n")
+	if !ok {
+		return
+	}
+
+	poll := time.NewTicker(eventsPoll)
+	defer poll.Stop()
+	idle := time.Now()
+	for {
+		var buf []byte
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-lines:
+			if f.wantLog(line) {
+				data, _ := json.Marshal(line)
+				buf = fmt.Appendf(buf, "event: log\ndata: %s\n\n", data)
+			}
+		case <-poll.C:
+			if cursor == nil {
+				break
+			}
+			list, err := cursor.Next(time.Now())
+			if err != nil {
+				log.Printf("api tail: %v", err)
+				return
+			}
+			for _, e := range list {
+				if f.wantEvent(e) {
+					data, _ := json.Marshal(e)
+					buf = fmt.Appendf(buf, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+				}
+			}
+		}
+		if len(buf) == 0 && time.Since(idle) >= eventsKeepalive {
+			buf = []byte(": keepalive\n\n")
+		}
+		if len(buf) > 0 {
+			if !st.send(buf) {
+				return
+			}
+			idle = time.Now()
+		}
+	}
+}
+
+// wantLog reports whether line passes the filter: it must be as severe as
+// asked for and mention a matching repository and the user.
+func (f tailFilter) wantLog(line diag.LogLine) bool {
+	if f.severity != "" && !diag.SeverityAtLeast(line.Severity, f.severity) {
+		return false
+	}
+	if f.user != "" && !strings.Contains(line.Message, f.user) {
+		return false
+	}
+	if f.repo == "" {
+		return true
+	}
+	for _, word := range strings.Fields(line.Message) {
+		if matchRepo(f.repo, strings.Trim(word, ":,;()[]\"'")) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantEvent reports whether e passes the filter; severities only apply to
+// log lines.
+func (f tailFilter) wantEvent(e events.Event) bool {
+	if f.user != "" && e.Actor != f.user {
+		return false
+	}
+	return f.repo == "" || matchRepo(f.repo, e.Repo) || e.From != "" && matchRepo(f.repo, e.From)
+}
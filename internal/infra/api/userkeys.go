@@ -0,0 +1,208 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/userkeys"
+)
+
+type userTokenRequest struct {
+	User string `json:"user"`
+	TTL  string `json:"ttl"` // Go duration, e.g. "30m"; defaults to one hour
+}
+
+type userTokenResponse struct {
+	User    string    `json:"user"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type addUserKeyRequest struct {
+	// Key is the public key in authorized_keys form, e.g. the contents of
+	// ~/.ssh/id_ed25519.pub.
+	Key string `json:"key"`
+	// Title defaults to the key's comment.
+	Title string `json:"title,omitempty"`
+	// Expires, if set, is when the key stops being admitted.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type userKeysResponse struct {
+	User string         `json:"user"`
+	Keys []userkeys.Key `json:"keys"`
+}
+
+// handleIssueUserToken issues a token with which a user manages their own
+// SSH keys.
+func (s *Server) handleIssueUserToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.UserTokens == nil || s.UserKeys == nil {
+		writeError(w, http.StatusNotFound, "user tokens are not enabled")
+		return
+	}
+	var req userTokenRequest
+	if err := decodeAdminBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := userkeys.CheckUser(req.User); err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	ttl := time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		ttl = d
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := s.UserTokens.SignUser(req.User, expires)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, userTokenResponse{User: req.User, Token: token, Expires: expires})
+}
+
+// handleUserKeys lists, adds and removes the SSH keys of the user a user
+// token identifies. Admins name the user with the user parameter instead,
+// and sudo tokens carry it; both are audited.
+func (s *Server) handleUserKeys(w http.ResponseWriter, r *http.Request) {
+	if s.UserKeys == nil {
+		writeError(w, http.StatusNotFound, "user keys are not enabled")
+		return
+	}
+	c, err := s.requestUser(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="repocraft-user"`)
+		writeCodedError(w, err)
+		return
+	}
+	user := c.User
+	if c.Actor != "" {
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		defer func() {
+			s.Audit.Record(AuditEntry{Time: time.Now().UTC(), Actor: c.Actor, User: user, Action: r.Method + " " + r.URL.Path, Status: rec.status, Reason: c.Reason})
+		}()
+	}
+	scope := scopeKeysWrite
+	if r.Method == http.MethodGet {
+		scope = scopeKeysRead
+	}
+	if !c.allows(scope) {
+		writeCodedError(w, errcode.Errorf(errcode.AccessDenied, "sudo token lacks the %s scope", scope))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := s.UserKeys.List(user)
+		if err != nil {
+			log.Printf("api user keys %s: %v", user, err)
+			writeError(w, http.StatusInternalServerError, "failed to list keys")
+			return
+		}
+		if keys == nil {
+			keys = []userkeys.Key{}
+		}
+		writeJSON(w, http.StatusOK, userKeysResponse{User: user, Keys: keys})
+	case http.MethodPost:
+		var req addUserKeyRequest
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var expires time.Time
+		if req.Expires != nil {
+			expires = *req.Expires
+		}
+		key, added, err := s.UserKeys.Add(user, req.Key, req.Title, expires)
+		if err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		status := http.StatusOK
+		if added {
+			status = http.StatusCreated
+			log.Printf("user %s added SSH key %s", user, key.Fingerprint)
+		}
+		writeJSON(w, status, key)
+	case http.MethodDelete:
+		fingerprint := r.URL.Query().Get("fingerprint")
+		if fingerprint == "" {
+			writeError(w, http.StatusBadRequest, "missing fingerprint")
+			return
+		}
+		if err := s.UserKeys.Remove(user, fingerprint); err != nil {
+			writeCodedError(w, err)
+			return
+		}
+		log.Printf("user %s removed SSH key %s", user, fingerprint)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// Defaults of the stale key report.
+const (
+	defaultUnusedFor      = 90 * 24 * time.Hour
+	defaultExpiringWithin = 14 * 24 * time.Hour
+)
+
+type staleKeysResponse struct {
+	UnusedFor      string              `json:"unused_for"`
+	ExpiringWithin string              `json:"expiring_within"`
+	Keys           []userkeys.StaleKey `json:"keys"`
+}
+
+// handleStaleUserKeys reports the registered keys that expired, expire
+// soon, or haven't been used for a long time.
+func (s *Server) handleStaleUserKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.UserKeys == nil {
+		writeError(w, http.StatusNotFound, "user keys are not enabled")
+		return
+	}
+	durationParam := func(name string, def time.Duration) (time.Duration, bool) {
+		raw := r.URL.Query().Get(name)
+		if raw == "" {
+			return def, true
+		}
+		d, err := time.ParseDuration(raw)
+		return d, err == nil && d >= 0
+	}
+	unusedFor, ok := durationParam("unused_for", defaultUnusedFor)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid unused_for")
+		return
+	}
+	expiringWithin, ok := durationParam("expiring_within", defaultExpiringWithin)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid expiring_within")
+		return
+	}
+	keys, err := s.UserKeys.Stale(time.Now(), unusedFor, expiringWithin)
+	if err != nil {
+		log.Printf("api stale user keys: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list keys")
+		return
+	}
+	if keys == nil {
+		keys = []userkeys.StaleKey{}
+	}
+	writeJSON(w, http.StatusOK, staleKeysResponse{UnusedFor: unusedFor.String(), ExpiringWithin: expiringWithin.String(), Keys: keys})
+}
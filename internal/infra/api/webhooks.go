@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/webhook"
+)
+
+type webhookRequest struct {
+	Repo string `json:"repo"`
+	webhook.Hook
+}
+
+type webhooksResponse struct {
+	Repo     string         `json:"repo"`
+	Webhooks []webhook.Hook `json:"webhooks"`
+}
+
+// handleWebhooks lists, adds or replaces, and removes the webhooks of a
+// repository. Secrets aren't shown.
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		writeError(w, http.StatusNotFound, "webhooks are not enabled")
+		return
+	}
+	var (
+		repo string
+		req  webhookRequest
+	)
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		repo = r.URL.Query().Get("repo")
+	case http.MethodPost:
+		if err := decodeAdminBody(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		repo = req.Repo
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name, err := s.servedRepo(repo)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	dir, err := s.resolveRepoPath(name)
+	if err != nil {
+		writeRepoError(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		err = webhook.Save(r.Context(), dir, req.Hook)
+	case http.MethodDelete:
+		err = webhook.Remove(r.Context(), dir, r.URL.Query().Get("name"))
+	}
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	hooks, err := webhook.Read(r.Context(), dir)
+	if err != nil {
+		writeCodedError(w, err)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	writeJSON(w, http.StatusOK, webhooksResponse{Repo: name, Webhooks: hooks})
+}
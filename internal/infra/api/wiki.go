@@ -0,0 +1,136 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// wikiFormats maps page file extensions to markup formats.
+var wikiFormats = map[string]string{
+	".md":        "markdown",
+	".markdown":  "markdown",
+	".adoc":      "asciidoc",
+	".asciidoc":  "asciidoc",
+	".org":       "org",
+	".rst":       "rst",
+	".textile":   "textile",
+	".mediawiki": "mediawiki",
+	".txt":       "text",
+}
+
+// maxWikiDepth bounds the directories searched for pages.
+const maxWikiDepth = 8
+
+type wikiPage struct {
+	// Name is the path without its extension, e.g. "Home" or "guides/Setup".
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	// Content is only set when a single page is requested.
+	Content string `json:"content,omitempty"`
+
+	blob repo.Hash
+}
+
+type wikiResponse struct {
+	Repo   string     `json:"repo"`
+	Wiki   string     `json:"wiki"`
+	Commit string     `json:"commit,omitempty"`
+	Pages  []wikiPage `json:"pages"`
+}
+
+// handleWiki lists the pages of a repository's wiki at its HEAD, or with the
+// page parameter returns that page's source for the client to render.
+func (s *Server) handleWiki(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	project := r.URL.Query().Get("repo")
+	if _, name, err := (service.RepoResolver{Root: s.RepoRoot}).Resolve(project); err == nil {
+		project = name
+	}
+	if _, ok := service.WikiOf(project); ok {
+		writeError(w, http.StatusBadRequest, "repo names a wiki; pass its project")
+		return
+	}
+	wiki := service.WikiPath(project)
+	rp, err := s.openRepoContents(r, wiki)
+	if err != nil {
+		if errors.Is(err, errRepoNotFound) {
+			writeError(w, http.StatusNotFound, "wiki not found")
+			return
+		}
+		writeRepoError(w, err)
+		return
+	}
+
+	resp := wikiResponse{Repo: project, Wiki: wiki, Pages: []wikiPage{}}
+	h, err := rp.ResolveRevision("HEAD")
+	if err == nil {
+		var c *repo.Commit
+		if c, err = rp.Commit(h); err == nil {
+			resp.Commit = c.Hash.String()
+			err = collectPages(rp, c.Tree, "", 0, &resp.Pages)
+		}
+		if err != nil {
+			log.Printf("api wiki %s: %v", wiki, err)
+			writeError(w, http.StatusInternalServerError, "failed to read wiki")
+			return
+		}
+	}
+	sort.Slice(resp.Pages, func(i, j int) bool { return resp.Pages[i].Name < resp.Pages[j].Name })
+
+	name := r.URL.Query().Get("page")
+	if name == "" {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	for _, p := range resp.Pages {
+		if p.Name != name {
+			continue
+		}
+		obj, err := rp.Object(p.blob)
+		if err != nil {
+			log.Printf("api wiki %s %s: %v", wiki, p.Path, err)
+			writeError(w, http.StatusInternalServerError, "failed to read page")
+			return
+		}
+		p.Content = string(obj.Data)
+		resp.Pages = []wikiPage{p}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	writeError(w, http.StatusNotFound, "page not found")
+}
+
+// collectPages appends the pages in tree, below dir, to pages.
+func collectPages(rp *repo.Repository, tree repo.Hash, dir string, depth int, pages *[]wikiPage) error {
+	entries, err := rp.Tree(tree)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(dir, e.Name)
+		if e.IsTree() {
+			if depth < maxWikiDepth && !strings.HasPrefix(e.Name, ".") {
+				if err := collectPages(rp, e.Hash, p, depth+1, pages); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		ext := path.Ext(e.Name)
+		if format, ok := wikiFormats[strings.ToLower(ext)]; ok && strings.HasPrefix(e.Mode, "100") {
+			*pages = append(*pages, wikiPage{Name: strings.TrimSuffix(p, ext), Path: p, Format: format, blob: e.Hash})
+		}
+	}
+	return nil
+}
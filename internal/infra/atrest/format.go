@@ -0,0 +1,149 @@
+package atrest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted files start with fileMagic and a random nonce prefix, followed
+// by the content in chunks of chunkSize sealed with AES-GCM. Each chunk's
+// nonce is the prefix and its index; the last chunk is marked in the
+// additional data, so truncation at a chunk boundary is detected.
+const (
+	fileMagic   = "RCENC1\n"
+	prefixSize  = 8
+	chunkSize   = 64 << 10
+	gcmOverhead = 16
+)
+
+var errCorrupt = errors.New("encrypted file is corrupt")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, prefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], index)
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptFile writes src encrypted to dst, through a temporary file so dst
+// never holds a partial file.
+func encryptFile(aead cipher.AEAD, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeAtomic(dst, 0o444, func(out io.Writer) error {
+		prefix := make([]byte, prefixSize)
+		if _, err := rand.Read(prefix); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, fileMagic); err != nil {
+			return err
+		}
+		if _, err := out.Write(prefix); err != nil {
+			return err
+		}
+		// Read one byte ahead to know which chunk is the last.
+		buf := make([]byte, chunkSize+1)
+		n, err := io.ReadFull(in, buf)
+		for index := uint32(0); ; index++ {
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return err
+			}
+			last := n <= chunkSize
+			chunk := buf[:min(n, chunkSize)]
+			sealed := aead.Seal(nil, chunkNonce(prefix, index), chunk, chunkAD(last))
+			if _, err := out.Write(sealed); err != nil {
+				return err
+			}
+			if last {
+				return nil
+			}
+			buf[0] = buf[chunkSize]
+			n, err = io.ReadFull(in, buf[1:])
+			n++
+		}
+	})
+}
+
+// decryptFile writes the plaintext of the encrypted file src to dst.
+func decryptFile(aead cipher.AEAD, src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeAtomic(dst, perm, func(out io.Writer) error {
+		header := make([]byte, len(fileMagic)+prefixSize)
+		if _, err := io.ReadFull(in, header); err != nil || string(header[:len(fileMagic)]) != fileMagic {
+			return errCorrupt
+		}
+		prefix := header[len(fileMagic):]
+		buf := make([]byte, chunkSize+gcmOverhead+1)
+		n, err := io.ReadFull(in, buf)
+		for index := uint32(0); ; index++ {
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return err
+			}
+			last := n <= chunkSize+gcmOverhead
+			sealed := buf[:min(n, chunkSize+gcmOverhead)]
+			chunk, err := aead.Open(nil, chunkNonce(prefix, index), sealed, chunkAD(last))
+			if err != nil {
+				return fmt.Errorf("%w: %s", errCorrupt, src)
+			}
+			if _, err := out.Write(chunk); err != nil {
+				return err
+			}
+			if last {
+				return nil
+			}
+			buf[0] = buf[chunkSize+gcmOverhead]
+			n, err = io.ReadFull(in, buf[1:])
+			n++
+		}
+	})
+}
+
+func writeAtomic(dst string, perm os.FileMode, write func(io.Writer) error) error {
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
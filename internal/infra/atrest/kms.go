@@ -0,0 +1,76 @@
+package atrest
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KMS wraps the per-repository data keys with a key it holds, so that only
+// wrapped keys are stored next to the data.
+type KMS interface {
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// LocalKMS wraps data keys with AES-GCM under a master key held in
+// memory, for hosts without an external key service.
+type LocalKMS struct {
+	// Key is the 32-byte master key.
+	Key []byte
+}
+
+// WrapKey implements KMS.
+func (k *LocalKMS) WrapKey(_ context.Context, key []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey implements KMS.
+func (k *LocalKMS) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap key: %w", err)
+	}
+	return key, nil
+}
+
+func (k *LocalKMS) aead() (cipher.AEAD, error) {
+	if len(k.Key) != 32 {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseLocalKMS returns a LocalKMS for a master key given as 64 hex digits.
+func ParseLocalKMS(hexKey string) (*LocalKMS, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("master key must be 64 hex digits")
+	}
+	return &LocalKMS{Key: key}, nil
+}
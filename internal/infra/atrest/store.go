@@ -0,0 +1,256 @@
+// Package atrest keeps the objects of repositories encrypted on disk. The
+// objects are decrypted into a staging area only while git processes use
+// the repository.
+package atrest
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// encryptedDir holds the encrypted object files of a repository, laid
+	// out like its objects directory, which is left empty.
+	encryptedDir = "objects.enc"
+	// keyFile in encryptedDir holds the repository's data key, wrapped by
+	// the KMS.
+	keyFile = "KEY"
+)
+
+// IsEncrypted reports whether the repository at repoPath keeps its objects
+// encrypted.
+func IsEncrypted(repoPath string) bool {
+	_, err := os.Stat(filepath.Join(repoPath, encryptedDir, keyFile))
+	return err == nil
+}
+
+// Store encrypts repositories and stages their objects for git. Each
+// repository has its own random data key, stored wrapped by KMS.
+//
+// A staged copy is shared by the git processes using a repository at the
+// same time and removed when the last one finishes. StagingDir should be on
+// memory-backed storage (e.g. tmpfs) so plaintext never reaches a disk.
+type Store struct {
+	KMS KMS
+	// StagingDir holds the decrypted objects; defaults to the system's
+	// temporary directory.
+	StagingDir string
+
+	mu     sync.Mutex
+	staged map[string]*Staged
+}
+
+// Staged is the decrypted object directory of a repository.
+type Staged struct {
+	store    *Store
+	repoPath string
+	dir      string
+	aead     cipher.AEAD
+
+	mu    sync.Mutex // serializes syncs and commits
+	users int        // guarded by store.mu
+}
+
+// Encrypt converts the plain repository at repoPath: every object file is
+// encrypted into objects.enc and removed from objects. The repository must
+// not be in use while it is converted.
+func (s *Store) Encrypt(ctx context.Context, repoPath string) error {
+	if IsEncrypted(repoPath) {
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	wrapped, err := s.KMS.WrapKey(ctx, key)
+	if err != nil {
+		return fmt.Errorf("wrap data key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	objects := filepath.Join(repoPath, "objects")
+	enc := filepath.Join(repoPath, encryptedDir)
+	if err := os.MkdirAll(enc, 0o755); err != nil {
+		return err
+	}
+	var files []string
+	err = filepath.WalkDir(objects, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(objects, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(enc, rel), 0o755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		files = append(files, rel)
+		return encryptFile(aead, path, filepath.Join(enc, rel))
+	})
+	if err != nil {
+		os.RemoveAll(enc)
+		return fmt.Errorf("encrypt %s: %w", repoPath, err)
+	}
+	// The key file marks the conversion as complete.
+	if err := writeAtomic(filepath.Join(enc, keyFile), 0o400, func(w io.Writer) error {
+		_, err := w.Write(wrapped)
+		return err
+	}); err != nil {
+		os.RemoveAll(enc)
+		return err
+	}
+	for _, rel := range files {
+		if err := os.Remove(filepath.Join(objects, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stage returns the decrypted objects of the repository at repoPath, or
+// nil if the repository is not encrypted. The caller must Release it.
+func (s *Store) Stage(ctx context.Context, repoPath string) (*Staged, error) {
+	if s == nil || !IsEncrypted(repoPath) {
+		return nil, nil
+	}
+	s.mu.Lock()
+	st, ok := s.staged[repoPath]
+	if !ok {
+		if s.staged == nil {
+			s.staged = make(map[string]*Staged)
+		}
+		st = &Staged{store: s, repoPath: repoPath}
+		s.staged[repoPath] = st
+	}
+	st.users++
+	s.mu.Unlock()
+
+	// Objects encrypted since the copy was made, e.g. by another server
+	// process, are added on every Stage.
+	if err := st.sync(ctx); err != nil {
+		st.Release()
+		return nil, fmt.Errorf("stage %s: %w", repoPath, err)
+	}
+	return st, nil
+}
+
+// Dir is the object directory to hand to git as GIT_OBJECT_DIRECTORY.
+func (st *Staged) Dir() string {
+	return st.dir
+}
+
+// sync decrypts the object files missing from the staged copy.
+func (st *Staged) sync(ctx context.Context) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.aead == nil {
+		wrapped, err := os.ReadFile(filepath.Join(st.repoPath, encryptedDir, keyFile))
+		if err != nil {
+			return err
+		}
+		key, err := st.store.KMS.UnwrapKey(ctx, wrapped)
+		if err != nil {
+			return err
+		}
+		if st.aead, err = newAEAD(key); err != nil {
+			return err
+		}
+	}
+	if st.dir == "" {
+		dir, err := os.MkdirTemp(st.store.StagingDir, "repocraft-objects-")
+		if err != nil {
+			return err
+		}
+		st.dir = dir
+	}
+
+	enc := filepath.Join(st.repoPath, encryptedDir)
+	return filepath.WalkDir(enc, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(enc, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(st.dir, rel)
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0o755)
+		}
+		if rel == keyFile || strings.HasSuffix(rel, ".tmp") {
+			return nil
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			return nil
+		}
+		return decryptFile(st.aead, path, dst, 0o444)
+	})
+}
+
+// Commit encrypts the object files git added to the staged copy, e.g. by
+// a push, into the repository.
+func (st *Staged) Commit() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	enc := filepath.Join(st.repoPath, encryptedDir)
+	return filepath.WalkDir(st.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(st.dir, path)
+		if err != nil {
+			return err
+		}
+		// Skip quarantines and temporary files of git processes still running.
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), "incoming-") || strings.HasPrefix(d.Name(), "tmp_") {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(enc, rel), 0o755)
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), "tmp_") || strings.HasSuffix(d.Name(), ".lock") {
+			return nil
+		}
+		dst := filepath.Join(enc, rel)
+		if _, err := os.Lstat(dst); err == nil {
+			return nil
+		}
+		return encryptFile(st.aead, path, dst)
+	})
+}
+
+// Release ends one use of the staged copy and removes it after the last.
+func (st *Staged) Release() {
+	s := st.store
+	s.mu.Lock()
+	st.users--
+	last := st.users == 0
+	if last {
+		delete(s.staged, st.repoPath)
+	}
+	s.mu.Unlock()
+	if last && st.dir != "" {
+		if err := os.RemoveAll(st.dir); err != nil {
+			log.Printf("atrest: remove staged objects of %s: %v", st.repoPath, err)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+// Package bench generates git load against a server and measures it. The
+// operations are run by the git client, so negotiation, packing and
+// transfer are exactly what real clients cause; latencies are measured
+// around each git process.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repogen"
+)
+
+// Op is a kind of operation.
+type Op string
+
+const (
+	// OpClone clones the repository into an empty directory.
+	OpClone Op = "clone"
+	// OpFetch fetches the default branch into a clone lagging Behind
+	// commits behind.
+	OpFetch Op = "fetch"
+	// OpPush pushes a new commit to a branch of the client's own.
+	OpPush Op = "push"
+)
+
+// Ops lists the operations in report order.
+var Ops = []Op{OpClone, OpFetch, OpPush}
+
+// maxErrors bounds the error messages kept per operation.
+const maxErrors = 5
+
+// Config describes a load test.
+type Config struct {
+	// URL is the repository to load, e.g.
+	// "http://localhost:8080/bench/load.git" or an ssh:// URL.
+	URL string
+	// Clients is the number of concurrent clients; defaults to 1.
+	Clients int
+	// Duration bounds the run; Requests, if positive, ends it after that
+	// many operations instead.
+	Duration time.Duration
+	Requests int
+	// Mix weighs the operations, e.g. 1 clone for 8 fetches and 1 push.
+	Mix map[Op]int
+	// Protocol is the protocol version clients ask for, e.g. "2"; git's
+	// default when empty.
+	Protocol string
+	// Depth makes clones shallow, and Filter partial, e.g. "blob:none".
+	Depth  int
+	Filter string
+	// Behind is how many commits fetching clients lag, which sets how much
+	// they negotiate and download. With zero, fetches find nothing new.
+	Behind int
+	// PushSize is the size of the new file in each pushed commit.
+	PushSize int
+	// Seed, if set, is generated and pushed to URL before the run;
+	// otherwise URL must have a default branch with at least Behind
+	// commits.
+	Seed *repogen.Shape
+	// WorkDir holds the clients' repositories; defaults to the system's
+	// temporary directory.
+	WorkDir string
+	GitPath string
+}
+
+// Report is the outcome of a run.
+type Report struct {
+	URL      string    `json:"url"`
+	Clients  int       `json:"clients"`
+	Duration string    `json:"duration"`
+	Ops      []OpStats `json:"ops"`
+}
+
+// OpStats summarizes the operations of one kind. Latencies are of
+// successful operations.
+type OpStats struct {
+	Op        Op      `json:"op"`
+	Count     int     `json:"count"`
+	Errors    int     `json:"errors"`
+	PerSecond float64 `json:"per_second"`
+	P50       string  `json:"p50,omitempty"`
+	P90       string  `json:"p90,omitempty"`
+	P99       string  `json:"p99,omitempty"`
+	Max       string  `json:"max,omitempty"`
+	// Messages are the first distinct errors.
+	Messages []string `json:"messages,omitempty"`
+}
+
+// Failed counts the failed operations.
+func (r Report) Failed() int {
+	n := 0
+	for _, s := range r.Ops {
+		n += s.Errors
+	}
+	return n
+}
+
+// Runner runs a load test.
+type Runner struct {
+	Config
+
+	dir    string
+	seed   string
+	behind string
+	branch string
+	issued atomic.Int64
+	pushed sync.Map
+}
+
+// Run prepares the clients, runs the operations until the duration or
+// request count is reached or ctx ends, and reports their latencies.
+// Branches pushed during the run are deleted afterwards.
+func (r *Runner) Run(ctx context.Context) (Report, error) {
+	if r.URL == "" {
+		return Report{}, errors.New("missing repository URL")
+	}
+	ops, weights := r.weights()
+	if len(ops) == 0 {
+		return Report{}, errors.New("no operations in the mix")
+	}
+	clients := r.Clients
+	if clients <= 0 {
+		clients = 1
+	}
+	dir, err := os.MkdirTemp(r.WorkDir, "gitbench-")
+	if err != nil {
+		return Report{}, err
+	}
+	r.dir = dir
+	defer os.RemoveAll(dir)
+
+	if err := r.prepare(ctx); err != nil {
+		return Report{}, err
+	}
+	defer r.deletePushed()
+
+	runCtx := ctx
+	if r.Duration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, r.Duration)
+		defer cancel()
+	}
+	results := make([][]result, clients)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = r.client(runCtx, i, ops, weights)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var all []result
+	for _, rs := range results {
+		all = append(all, rs...)
+	}
+	return summarize(r.URL, clients, elapsed, all), nil
+}
+
+// weights returns the operations with a positive weight and their
+// cumulative weights.
+func (r *Runner) weights() ([]Op, []int) {
+	var ops []Op
+	var cumulative []int
+	total := 0
+	for _, op := range Ops {
+		if w := r.Mix[op]; w > 0 {
+			total += w
+			ops = append(ops, op)
+			cumulative = append(cumulative, total)
+		}
+	}
+	return ops, cumulative
+}
+
+// prepare seeds the repository if asked to and builds the local
+// repositories the clients start from. None of it is measured.
+func (r *Runner) prepare(ctx context.Context) error {
+	r.seed = filepath.Join(r.dir, "seed.git")
+	if r.Seed != nil {
+		// The seed goes to the branch HEAD names, so clones check it out.
+		out, err := r.git(ctx, "", "ls-remote", "--symref", r.URL, "HEAD")
+		if err != nil {
+			return err
+		}
+		r.branch = "main"
+		if ref, ok := strings.CutPrefix(out, "ref: refs/heads/"); ok {
+			r.branch, _, _ = strings.Cut(ref, "\t")
+		}
+		gen := &repogen.Generator{Shape: *r.Seed, Branch: r.branch, GitPath: r.gitPath()}
+		if _, err := gen.Generate(ctx, r.seed); err != nil {
+			return fmt.Errorf("generate seed: %w", err)
+		}
+		if _, err := r.git(ctx, r.seed, "push", "--quiet", r.URL, "refs/heads/"+r.branch); err != nil {
+			return fmt.Errorf("push seed: %w", err)
+		}
+	} else {
+		if _, err := r.git(ctx, "", "clone", "--bare", "--quiet", r.URL, r.seed); err != nil {
+			return fmt.Errorf("clone %s: %w", r.URL, err)
+		}
+		branch, err := r.defaultBranch(ctx)
+		if err != nil {
+			return err
+		}
+		r.branch = branch
+	}
+
+	if r.Mix[OpFetch] <= 0 {
+		return nil
+	}
+	// A clone of the branch as it was Behind commits ago holds none of
+	// the newer objects, so every fetch downloads them.
+	rev := fmt.Sprintf("refs/heads/%s~%d", r.branch, r.Behind)
+	oid, err := r.git(ctx, r.seed, "rev-parse", "--verify", rev+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("%s has fewer than %d commits: %w", r.branch, r.Behind+1, err)
+	}
+	if _, err := r.git(ctx, r.seed, "update-ref", "refs/heads/gitbench-behind", oid); err != nil {
+		return err
+	}
+	r.behind = filepath.Join(r.dir, "behind.git")
+	_, err = r.git(ctx, "", "clone", "--bare", "--quiet", "--no-local", "--single-branch", "--branch", "gitbench-behind", r.seed, r.behind)
+	if err != nil {
+		return err
+	}
+	if _, err := r.git(ctx, r.behind, "update-ref", "refs/heads/"+r.branch, oid); err != nil {
+		return err
+	}
+	return nil
+}
+
+// defaultBranch returns the branch HEAD of the cloned repository names or,
+// if that doesn't exist, main, master or else the first branch.
+func (r *Runner) defaultBranch(ctx context.Context) (string, error) {
+	out, err := r.git(ctx, r.seed, "for-each-ref", "--format=%(refname:short)", "refs/heads/")
+	if err != nil {
+		return "", err
+	}
+	branches := strings.Fields(out)
+	if len(branches) == 0 {
+		return "", fmt.Errorf("%s has no branches; run with -seed", r.URL)
+	}
+	head, _ := r.git(ctx, r.seed, "symbolic-ref", "--short", "HEAD")
+	for _, want := range []string{head, "main", "master"} {
+		if contains(branches, want) {
+			return want, nil
+		}
+	}
+	return branches[0], nil
+}
+
+type result struct {
+	op  Op
+	d   time.Duration
+	err error
+}
+
+// client runs operations until ctx ends or the requests are used up.
+func (r *Runner) client(ctx context.Context, id int, ops []Op, weights []int) []result {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	var results []result
+	for n := 0; ctx.Err() == nil; n++ {
+		if r.Requests > 0 && r.issued.Add(1) > int64(r.Requests) {
+			break
+		}
+		pick := rng.Intn(weights[len(weights)-1])
+		op := ops[sort.SearchInts(weights, pick+1)]
+		d, err := r.run(ctx, op, id, n, rng)
+		if ctx.Err() != nil && err != nil {
+			// Cut short by the end of the run.
+			break
+		}
+		results = append(results, result{op: op, d: d, err: err})
+	}
+	return results
+}
+
+// run performs one operation and returns how long the measured part took.
+func (r *Runner) run(ctx context.Context, op Op, id, n int, rng *rand.Rand) (time.Duration, error) {
+	dir := filepath.Join(r.dir, fmt.Sprintf("c%d-%d.git", id, n))
+	defer os.RemoveAll(dir)
+	switch op {
+	case OpClone:
+		args := []string{"clone", "--bare", "--quiet"}
+		if r.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(r.Depth))
+		}
+		if r.Filter != "" {
+			args = append(args, "--filter", r.Filter)
+		}
+		start := time.Now()
+		_, err := r.git(ctx, "", append(args, r.URL, dir)...)
+		return time.Since(start), err
+	case OpFetch:
+		if _, err := r.git(ctx, "", "clone", "--bare", "--quiet", "--local", r.behind, dir); err != nil {
+			return 0, fmt.Errorf("prepare fetch: %w", err)
+		}
+		refspec := fmt.Sprintf("+refs/heads/%s:refs/heads/%s", r.branch, r.branch)
+		start := time.Now()
+		_, err := r.git(ctx, dir, "fetch", "--quiet", r.URL, refspec)
+		return time.Since(start), err
+	case OpPush:
+		return r.push(ctx, id, rng)
+	}
+	return 0, fmt.Errorf("unknown operation %q", op)
+}
+
+// push commits a file of PushSize random bytes on the client's branch,
+// gitbench/c<id>, and pushes it.
+func (r *Runner) push(ctx context.Context, id int, rng *rand.Rand) (time.Duration, error) {
+	repo := filepath.Join(r.dir, fmt.Sprintf("c%d-push.git", id))
+	branch := fmt.Sprintf("refs/heads/gitbench/c%d", id)
+	if _, err := os.Stat(repo); err != nil {
+		if _, err := r.git(ctx, "", "clone", "--bare", "--quiet", "--local", r.seed, repo); err != nil {
+			return 0, fmt.Errorf("prepare push: %w", err)
+		}
+		if _, err := r.git(ctx, repo, "update-ref", branch, "refs/heads/"+r.branch); err != nil {
+			return 0, fmt.Errorf("prepare push: %w", err)
+		}
+	}
+	content := make([]byte, r.PushSize)
+	rng.Read(content)
+	blob, err := r.gitInput(ctx, repo, content, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return 0, err
+	}
+	tree, err := r.gitInput(ctx, repo, []byte(fmt.Sprintf("100644 blob %s\tgitbench-c%d\n", blob, id)), "mktree")
+	if err != nil {
+		return 0, err
+	}
+	commit, err := r.git(ctx, repo, "commit-tree", tree, "-p", branch, "-m", "gitbench")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.git(ctx, repo, "update-ref", branch, commit); err != nil {
+		return 0, err
+	}
+	r.pushed.Store(branch, true)
+	start := time.Now()
+	_, err = r.git(ctx, repo, "push", "--quiet", "--force", r.URL, branch)
+	return time.Since(start), err
+}
+
+// deletePushed removes the clients' branches from the server.
+func (r *Runner) deletePushed() {
+	var refs []string
+	r.pushed.Range(func(k, _ any) bool {
+		refs = append(refs, ":"+k.(string))
+		return true
+	})
+	if len(refs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := r.git(ctx, r.seed, append([]string{"push", "--quiet", r.URL}, refs...)...); err != nil {
+		fmt.Fprintf(os.Stderr, "gitbench: delete pushed branches: %v\n", err)
+	}
+}
+
+func summarize(url string, clients int, elapsed time.Duration, results []result) Report {
+	rep := Report{URL: url, Clients: clients, Duration: elapsed.Round(time.Millisecond).String()}
+	for _, op := range Ops {
+		st := OpStats{Op: op}
+		var latencies []time.Duration
+		for _, res := range results {
+			if res.op != op {
+				continue
+			}
+			st.Count++
+			if res.err != nil {
+				st.Errors++
+				if msg := res.err.Error(); len(st.Messages) < maxErrors && !contains(st.Messages, msg) {
+					st.Messages = append(st.Messages, msg)
+				}
+				continue
+			}
+			latencies = append(latencies, res.d)
+		}
+		if st.Count == 0 {
+			continue
+		}
+		st.PerSecond = float64(len(latencies)) / elapsed.Seconds()
+		if len(latencies) > 0 {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			st.P50 = percentile(latencies, 50)
+			st.P90 = percentile(latencies, 90)
+			st.P99 = percentile(latencies, 99)
+			st.Max = latencies[len(latencies)-1].Round(time.Millisecond).String()
+		}
+		rep.Ops = append(rep.Ops, st)
+	}
+	return rep
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p int) string {
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1].Round(time.Millisecond).String()
+}
+
+func (r *Runner) git(ctx context.Context, dir string, args ...string) (string, error) {
+	return r.gitInput(ctx, dir, nil, args...)
+}
+
+func (r *Runner) gitInput(ctx context.Context, dir string, stdin []byte, args ...string) (string, error) {
+	full := []string{"-c", "advice.detachedHead=false"}
+	if r.Protocol != "" {
+		full = append(full, "-c", "protocol.version="+r.Protocol)
+	}
+	if dir != "" {
+		full = append(full, "-C", dir)
+	}
+	cmd := exec.CommandContext(ctx, r.gitPath(), append(full, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=gitbench", "GIT_AUTHOR_EMAIL=gitbench@example.com",
+		"GIT_COMMITTER_NAME=gitbench", "GIT_COMMITTER_EMAIL=gitbench@example.com")
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (r *Runner) gitPath() string {
+	if r.GitPath != "" {
+		return r.GitPath
+	}
+	return "git"
+}
@@ -0,0 +1,206 @@
+// Package bundles pre-generates clone bundles so large initial clones can
+// be served as static, resumable downloads.
+package bundles
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// fileName is the bundle's location inside the repository directory, so it
+// moves along with transfers.
+const fileName = "repocraft/clone.bundle"
+
+// Generator keeps a bundle of the branches and tags of every large
+// repository under RepoRoot, regenerating it once it is older than Every.
+// Refs hidden from upload-pack, by the repository's uploadpack.hideRefs
+// and transfer.hideRefs or by RefAdvertisement, are left out, since anyone
+// who may fetch downloads the bundle.
+type Generator struct {
+	RepoRoot string
+	// RefAdvertisement is the policy upload-pack is run with.
+	RefAdvertisement service.RefAdvertisementPolicy
+	// MinSize is the size of the objects directory from which repositories
+	// get a bundle; defaults to 100 MiB.
+	MinSize int64
+	// Every is the bundle refresh interval; defaults to 24 hours.
+	Every   time.Duration
+	GitPath string
+}
+
+// Path returns where the bundle of repoPath is stored.
+func Path(repoPath string) string {
+	return filepath.Join(repoPath, filepath.FromSlash(fileName))
+}
+
+// Lookup returns the bundle of repoPath if one was generated.
+func Lookup(repoPath string) (string, os.FileInfo, bool) {
+	path := Path(repoPath)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", nil, false
+	}
+	return path, info, true
+}
+
+// Generate writes a fresh bundle of the advertised refs of repoPath. A
+// repository without any gets none.
+func (g *Generator) Generate(ctx context.Context, repoPath string) error {
+	path := Path(repoPath)
+	bin := g.GitPath
+	if bin == "" {
+		bin = "git"
+	}
+	refs, err := g.refs(ctx, bin, repoPath)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	cmd := exec.CommandContext(ctx, bin, "-C", repoPath, "bundle", "create", "--quiet", tmp, "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(refs, "\n") + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("git bundle create: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	// Readers holding the old file keep a consistent copy.
+	return os.Rename(tmp, path)
+}
+
+// refs returns the branches and tags of repoPath upload-pack advertises,
+// and HEAD if it points to one of them.
+func (g *Generator) refs(ctx context.Context, bin, repoPath string) ([]string, error) {
+	var hide []string
+	for _, key := range []string{"transfer.hideRefs", "uploadpack.hideRefs"} {
+		// Exits 1 when the key isn't set.
+		out, _ := exec.CommandContext(ctx, bin, "-C", repoPath, "config", "--get-all", key).Output()
+		hide = append(hide, strings.Fields(string(out))...)
+	}
+	name := repoPath
+	if rel, err := filepath.Rel(g.RepoRoot, repoPath); err == nil {
+		name = filepath.ToSlash(rel)
+	}
+	hide = append(hide, g.RefAdvertisement.For(name).HideRefs...)
+
+	out, err := exec.CommandContext(ctx, bin, "-C", repoPath, "for-each-ref", "--format=%(refname)", "refs/heads/", "refs/tags/").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git for-each-ref: %w", err)
+	}
+	var refs []string
+	advertised := make(map[string]bool)
+	for _, ref := range strings.Fields(string(out)) {
+		if !hidden(ref, hide) {
+			refs = append(refs, ref)
+			advertised[ref] = true
+		}
+	}
+	head, _ := exec.CommandContext(ctx, bin, "-C", repoPath, "symbolic-ref", "-q", "HEAD").Output()
+	if advertised[strings.TrimSpace(string(head))] {
+		refs = append(refs, "HEAD")
+	}
+	return refs, nil
+}
+
+// hidden reports whether hideRefs entries hide ref, as git matches them:
+// an entry hides the ref it names and those below it, "!" reveals them
+// again, and the last matching entry decides.
+func hidden(ref string, hide []string) bool {
+	for i := len(hide) - 1; i >= 0; i-- {
+		entry := hide[i]
+		neg := strings.HasPrefix(entry, "!")
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "!"), "^")
+		entry = strings.TrimRight(entry, "/")
+		if rest, ok := strings.CutPrefix(ref, entry); ok && (rest == "" || rest[0] == '/') {
+			return !neg
+		}
+	}
+	return false
+}
+
+// Run refreshes stale bundles hourly until ctx is cancelled.
+func (g *Generator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := g.refresh(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("bundles: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *Generator) refresh(ctx context.Context, now time.Time) error {
+	every := g.Every
+	if every <= 0 {
+		every = 24 * time.Hour
+	}
+	minSize := g.MinSize
+	if minSize <= 0 {
+		minSize = 100 << 20
+	}
+	root := filepath.Clean(g.RepoRoot)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !service.IsRepository(path) {
+			return nil
+		}
+		if _, info, ok := Lookup(path); ok && now.Sub(info.ModTime()) < every {
+			return filepath.SkipDir
+		}
+		if dirSize(filepath.Join(path, "objects")) < minSize {
+			return filepath.SkipDir
+		}
+		start := time.Now()
+		if err := g.Generate(ctx, path); err != nil {
+			log.Printf("bundles: %s: %v", path, err)
+		} else {
+			log.Printf("bundles: %s generated in %s", path, time.Since(start).Round(time.Millisecond))
+		}
+		return filepath.SkipDir
+	})
+}
+
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,309 @@
+// Package celpolicy has access and push rules written as CEL expressions
+// (https://github.com/google/cel-spec), for rules the JSON policies can't
+// state, such as who may push to which branch:
+//
+//	ref == 'refs/heads/main' && !identity.groups.contains('release')
+package celpolicy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/access"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// When rules apply.
+const (
+	// Read rules apply to fetches and clones.
+	Read = "read"
+	// Write rules apply to pushes as a whole, before they are received.
+	Write = "write"
+	// Push rules apply to each ref a push updates, once it is received.
+	Push = "push"
+)
+
+// maxDenials bounds the refused ref updates listed in the error.
+const maxDenials = 20
+
+// Rules is an access.Authorizer and a service.PushCheck refusing what any
+// of its rules denies, read from a JSON file:
+//
+//	{"groups": {"release": ["alice", "bob"]},
+//	 "rules": [
+//	  {"name": "release-main", "on": "push",
+//	   "deny": "ref == 'refs/heads/main' && !identity.groups.contains('release')",
+//	   "message": "only release managers push to main"},
+//	  {"name": "no-anonymous-secrets", "on": "read",
+//	   "deny": "repo.startsWith('secret/') && identity.anonymous"}
+//	]}
+//
+// Every rule sees identity, a map of the user's name, the groups they are
+// in and whether they are anonymous; repo, such as "team/app.git"; and now,
+// a timestamp. Push rules also see ref, old and new, the ref and its object
+// IDs; action, one of "create", "update" or "delete"; and force, true for
+// updates that aren't fast-forwards. Rules that fail to evaluate deny.
+type Rules struct {
+	// Groups maps group names to the users in them.
+	Groups map[string][]string `json:"groups,omitempty"`
+	Rules  []Rule              `json:"rules"`
+
+	// Base, if set, decides access first; rules only refuse more.
+	Base access.Authorizer `json:"-"`
+	// Logger receives the denials; slog.Default() if nil.
+	Logger *slog.Logger `json:"-"`
+
+	groupsOf map[string][]string
+}
+
+// Rule denies what its expression is true for.
+type Rule struct {
+	// Name identifies the rule in logs.
+	Name string `json:"name"`
+	// On is Read, Write or Push.
+	On string `json:"on"`
+	// Deny is a CEL expression of type bool.
+	Deny string `json:"deny"`
+	// Message is shown to clients refused by a push rule.
+	Message string `json:"message,omitempty"`
+
+	program cel.Program
+}
+
+// Load reads rules from a JSON file.
+func Load(file string) (*Rules, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CEL rules: %w", err)
+	}
+	r := &Rules{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(r); err != nil {
+		return nil, fmt.Errorf("parse CEL rules %s: %w", file, err)
+	}
+	if err := r.Init(); err != nil {
+		return nil, fmt.Errorf("CEL rules %s: %w", file, err)
+	}
+	return r, nil
+}
+
+// Init checks and compiles the rules.
+func (r *Rules) Init() error {
+	r.groupsOf = make(map[string][]string)
+	for group, users := range r.Groups {
+		for _, u := range users {
+			r.groupsOf[u] = append(r.groupsOf[u], group)
+		}
+	}
+	for _, groups := range r.groupsOf {
+		sort.Strings(groups)
+	}
+	accessEnv, err := newEnv(false)
+	if err != nil {
+		return err
+	}
+	pushEnv, err := newEnv(true)
+	if err != nil {
+		return err
+	}
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		env := accessEnv
+		switch rule.On {
+		case Read, Write:
+		case Push:
+			env = pushEnv
+		default:
+			return fmt.Errorf("rule %s: invalid on %q, want read, write or push", rule.Name, rule.On)
+		}
+		ast, issues := env.Compile(rule.Deny)
+		if issues.Err() != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, issues.Err())
+		}
+		// Fields of identity are dyn; what isn't a bool then denies.
+		if t := ast.OutputType(); !t.IsExactType(cel.BoolType) && !t.IsExactType(cel.DynType) {
+			return fmt.Errorf("rule %s: deny is of type %s, want bool", rule.Name, ast.OutputType())
+		}
+		if rule.program, err = env.Program(ast); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// newEnv returns the environment of access rules, or of push rules.
+func newEnv(push bool) (*cel.Env, error) {
+	opts := []cel.EnvOption{
+		cel.Variable("identity", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("repo", cel.StringType),
+		cel.Variable("now", cel.TimestampType),
+		// Lists get contains as strings have it, for the groups of
+		// identity.
+		cel.Function("contains", cel.MemberOverload("list_contains",
+			[]*cel.Type{cel.ListType(cel.DynType), cel.DynType}, cel.BoolType,
+			cel.BinaryBinding(func(list, v ref.Val) ref.Val {
+				if c, ok := list.(traits.Container); ok {
+					return c.Contains(v)
+				}
+				return types.NewErr("no such overload")
+			}))),
+	}
+	if push {
+		opts = append(opts,
+			cel.Variable("ref", cel.StringType),
+			cel.Variable("old", cel.StringType),
+			cel.Variable("new", cel.StringType),
+			cel.Variable("action", cel.StringType),
+			cel.Variable("force", cel.BoolType),
+		)
+	}
+	return cel.NewEnv(opts...)
+}
+
+// vars returns the variables every rule sees.
+func (r *Rules) vars(user, repo string) map[string]any {
+	groups := r.groupsOf[user]
+	if user == "" || groups == nil {
+		groups = []string{}
+	}
+	return map[string]any{
+		"identity": map[string]any{"name": user, "groups": groups, "anonymous": user == ""},
+		"repo":     strings.Trim(repo, "/"),
+		"now":      time.Now(),
+	}
+}
+
+// denies returns the first rule on on that denies vars, or nil.
+func (r *Rules) denies(on string, vars map[string]any) *Rule {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.On != on {
+			continue
+		}
+		out, _, err := rule.program.Eval(vars)
+		if err != nil {
+			r.logger().Warn("CEL rule failed, denying", "rule", rule.Name, "error", err)
+			return rule
+		}
+		if deny, ok := out.Value().(bool); !ok || deny {
+			return rule
+		}
+	}
+	return nil
+}
+
+// CanRead implements access.Authorizer.
+func (r *Rules) CanRead(user, repo string) bool {
+	return r.can(Read, user, repo)
+}
+
+// CanWrite implements access.Authorizer.
+func (r *Rules) CanWrite(user, repo string) bool {
+	return r.can(Write, user, repo)
+}
+
+func (r *Rules) can(on, user, repo string) bool {
+	if r.Base != nil {
+		if on == Read && !r.Base.CanRead(user, repo) || on == Write && !r.Base.CanWrite(user, repo) {
+			return false
+		}
+	}
+	if rule := r.denies(on, r.vars(user, repo)); rule != nil {
+		r.logger().Info("CEL rule denied access", "rule", rule.Name, "on", on, "user", user, "repo", repo)
+		return false
+	}
+	return true
+}
+
+// CheckPush runs the push rules on each ref update and declines the push
+// if any of them denies one, listing the refused refs.
+func (r *Rules) CheckPush(ctx context.Context, req service.ServiceRequest, env []string, updates []service.PushCommand) error {
+	if !r.has(Push) {
+		return nil
+	}
+	var denials []string
+	for _, u := range updates {
+		vars := r.vars(req.User, req.RepoName)
+		vars["ref"], vars["old"], vars["new"] = u.Ref, u.Old, u.New
+		vars["action"], vars["force"] = "update", false
+		switch {
+		case u.IsCreate():
+			vars["action"] = "create"
+		case u.IsDelete():
+			vars["action"] = "delete"
+		default:
+			force, err := isForce(ctx, req.RepoPath, env, u)
+			if err != nil {
+				return err
+			}
+			vars["force"] = force
+		}
+		rule := r.denies(Push, vars)
+		if rule == nil {
+			continue
+		}
+		r.logger().Info("CEL rule refused a ref update", "rule", rule.Name, "repo", req.RepoName, "ref", u.Ref, "user", req.User)
+		msg := rule.Message
+		if msg == "" {
+			msg = "refused by rule " + rule.Name
+		}
+		denials = append(denials, u.Ref+": "+msg)
+	}
+	if len(denials) == 0 {
+		return nil
+	}
+	if len(denials) > maxDenials {
+		denials = append(denials[:maxDenials:maxDenials], fmt.Sprintf("and %d more", len(denials)-maxDenials))
+	}
+	return errcode.Errorf(errcode.AccessDenied, "the rules of this server refuse this push:\n%s", strings.Join(denials, "\n"))
+}
+
+func (r *Rules) logger() *slog.Logger {
+	if r.Logger == nil {
+		return slog.Default()
+	}
+	return r.Logger
+}
+
+// has reports whether any rule applies on on.
+func (r *Rules) has(on string) bool {
+	for _, rule := range r.Rules {
+		if rule.On == on {
+			return true
+		}
+	}
+	return false
+}
+
+// isForce reports whether u isn't a fast-forward. env gives access to the
+// pushed objects.
+func isForce(ctx context.Context, repoPath string, env []string, u service.PushCommand) (bool, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "merge-base", "--is-ancestor", u.Old, u.New)
+	cmd.Env = append(os.Environ(), env...)
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("git merge-base: %w", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,249 @@
+// Package commitpolicy refuses pushes of commits whose messages break the
+// rules of the branch they are pushed to: a pattern to match, an issue to
+// reference, a maximum subject length or a Developer Certificate of Origin
+// sign-off.
+package commitpolicy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repomatch"
+)
+
+const (
+	// maxCommits bounds the commits checked per ref update.
+	maxCommits = 10000
+	// maxViolations bounds the violations listed in the error.
+	maxViolations = 20
+)
+
+// Policy is a service.PushCheck checking the message of every commit a push
+// adds to a branch, read from a JSON file:
+//
+//	{"repos": {"team/*": [
+//	  {"refs": ["refs/heads/main", "refs/heads/release/*"],
+//	   "pattern": "^(feat|fix|docs|chore)(\\(.+\\))?: ",
+//	   "issue": "[A-Z]+-[0-9]+", "max_subject": 72, "signed_off": true}
+//	]}}
+//
+// Every commit a push adds to a branch is checked, even if another branch
+// already has it, so rules can't be bypassed by pushing elsewhere first.
+// Only new branches take the commits other refs have as they are. Merge
+// commits, whose messages git writes, aren't checked.
+type Policy struct {
+	// Repos maps path.Match patterns such as "team/*" to the rules of
+	// matching repositories; the longest matching pattern wins.
+	Repos map[string][]Rule `json:"repos"`
+}
+
+// Rule constrains the commit messages pushed to some refs.
+type Rule struct {
+	// Refs are path.Match patterns of the refs the rule applies to; all
+	// branches when empty.
+	Refs []string `json:"refs,omitempty"`
+	// Pattern is a regular expression the message must match.
+	Pattern string `json:"pattern,omitempty"`
+	// Issue is a regular expression of an issue reference, such as
+	// "#[0-9]+", the message must contain.
+	Issue string `json:"issue,omitempty"`
+	// MaxSubject is the longest subject line allowed, in characters.
+	MaxSubject int `json:"max_subject,omitempty"`
+	// SignedOff requires a "Signed-off-by:" trailer naming the author.
+	SignedOff bool `json:"signed_off,omitempty"`
+
+	pattern, issue *regexp.Regexp
+}
+
+// Load reads a policy from a JSON file.
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read commit policy: %w", err)
+	}
+	p := &Policy{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("parse commit policy %s: %w", file, err)
+	}
+	if err := p.Init(); err != nil {
+		return nil, fmt.Errorf("commit policy %s: %w", file, err)
+	}
+	return p, nil
+}
+
+// Init checks the policy and compiles its expressions.
+func (p *Policy) Init() error {
+	for pattern, rules := range p.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+		for i := range rules {
+			r := &rules[i]
+			for _, ref := range r.Refs {
+				if _, err := path.Match(ref, ""); err != nil || !strings.HasPrefix(ref, "refs/") {
+					return fmt.Errorf("%s: invalid ref pattern %q", pattern, ref)
+				}
+			}
+			var err error
+			if r.Pattern != "" {
+				if r.pattern, err = regexp.Compile(r.Pattern); err != nil {
+					return fmt.Errorf("%s: pattern: %w", pattern, err)
+				}
+			}
+			if r.Issue != "" {
+				if r.issue, err = regexp.Compile(r.Issue); err != nil {
+					return fmt.Errorf("%s: issue: %w", pattern, err)
+				}
+			}
+			if r.MaxSubject < 0 {
+				return fmt.Errorf("%s: invalid max_subject %d", pattern, r.MaxSubject)
+			}
+		}
+	}
+	return nil
+}
+
+// For returns the rules of repo.
+func (p *Policy) For(repo string) []Rule {
+	if p == nil {
+		return nil
+	}
+	rules, _ := repomatch.Best(p.Repos, repo)
+	return rules
+}
+
+// appliesTo reports whether the rule covers ref.
+func (r *Rule) appliesTo(ref string) bool {
+	if len(r.Refs) == 0 {
+		return strings.HasPrefix(ref, "refs/heads/")
+	}
+	for _, pattern := range r.Refs {
+		if ok, _ := path.Match(pattern, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Commit is what the rules look at in a commit.
+type Commit struct {
+	ID      string
+	Author  string // "Name <email>"
+	Message string
+}
+
+// Check returns what is wrong with the message of c, if anything.
+func (r *Rule) Check(c Commit) []string {
+	var problems []string
+	subject, _, _ := strings.Cut(strings.TrimLeft(c.Message, "\n"), "\n")
+	if r.pattern != nil && !r.pattern.MatchString(c.Message) {
+		problems = append(problems, fmt.Sprintf("message doesn't match %s", r.Pattern))
+	}
+	if r.issue != nil && !r.issue.MatchString(c.Message) {
+		problems = append(problems, fmt.Sprintf("no issue reference matching %s", r.Issue))
+	}
+	if n := utf8.RuneCountInString(subject); r.MaxSubject > 0 && n > r.MaxSubject {
+		problems = append(problems, fmt.Sprintf("subject is %d characters, at most %d allowed", n, r.MaxSubject))
+	}
+	if r.SignedOff && !signedOff(c.Message, c.Author) {
+		problems = append(problems, fmt.Sprintf("missing Signed-off-by: %s", c.Author))
+	}
+	return problems
+}
+
+// signedOff reports whether message carries the sign-off of author.
+func signedOff(message, author string) bool {
+	for _, line := range strings.Split(message, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "Signed-off-by:"); ok && strings.EqualFold(strings.TrimSpace(v), author) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPush checks the commits each update adds to a ref rules apply to
+// and declines the push if any breaks them, listing every violation.
+func (p *Policy) CheckPush(ctx context.Context, req service.ServiceRequest, env []string, updates []service.PushCommand) error {
+	rules := p.For(req.RepoName)
+	if len(rules) == 0 {
+		return nil
+	}
+	var violations []string
+	total := 0
+	for _, u := range updates {
+		if u.IsDelete() {
+			continue
+		}
+		var applied []*Rule
+		for i := range rules {
+			if rules[i].appliesTo(u.Ref) {
+				applied = append(applied, &rules[i])
+			}
+		}
+		if len(applied) == 0 {
+			continue
+		}
+		commits, err := newCommits(ctx, req.RepoPath, env, u)
+		if err != nil {
+			return fmt.Errorf("check commit messages: %w", err)
+		}
+		for _, c := range commits {
+			var problems []string
+			for _, r := range applied {
+				problems = append(problems, r.Check(c)...)
+			}
+			for _, problem := range problems {
+				if total++; total <= maxViolations {
+					violations = append(violations, fmt.Sprintf("%s %.12s: %s", u.Ref, c.ID, problem))
+				}
+			}
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	if total > maxViolations {
+		violations = append(violations, fmt.Sprintf("and %d more", total-maxViolations))
+	}
+	return errcode.Errorf(errcode.AccessDenied, "commit messages break the rules of this repository:\n%s", strings.Join(violations, "\n"))
+}
+
+// newCommits returns the commits u adds to its ref, or, for a new ref, the
+// commits no ref has yet, merges left out, newest first. env gives access
+// to the pushed objects.
+func newCommits(ctx context.Context, repoPath string, env []string, u service.PushCommand) ([]Commit, error) {
+	args := []string{"-C", repoPath, "log", "-z", "--no-merges", fmt.Sprintf("--max-count=%d", maxCommits), "--format=%H%n%an <%ae>%n%B", u.New}
+	if u.IsCreate() {
+		args = append(args, "--not", "--all")
+	} else {
+		args = append(args, "^"+u.Old)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git log: %w", err)
+	}
+	var commits []Commit
+	for _, entry := range strings.Split(string(out), "\x00") {
+		id, rest, ok := strings.Cut(entry, "\n")
+		if !ok {
+			continue
+		}
+		author, message, _ := strings.Cut(rest, "\n")
+		commits = append(commits, Commit{ID: id, Author: author, Message: message})
+	}
+	return commits, nil
+}
@@ -0,0 +1,487 @@
+// Package credusage tracks how credentials are used: SSH keys, fetch
+// tokens, user and sudo tokens, and HTTP users. For each credential it
+// counts operations and records the repositories touched and the addresses
+// it was used from. Reports flag patterns worth a look, so security teams
+// can find forgotten credentials and investigate suspicious use.
+//
+// Each daemon keeps its counts in memory and saves them every minute to a
+// file of its own in a directory the daemons share; reports merge the
+// files of all daemons.
+package credusage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of credentials.
+const (
+	KindSSHKey     = "ssh_key"
+	KindFetchToken = "fetch_token"
+	KindUserToken  = "user_token"
+	KindSudoToken  = "sudo_token"
+	KindHTTPUser   = "http_user"
+)
+
+// Flags reports set on credentials.
+const (
+	// FlagUnused is a key or HTTP user not used for the report's unusedFor.
+	FlagUnused = "unused"
+	// FlagNewSource is a credential used for a week or more that was used
+	// from a new address in the last day.
+	FlagNewSource = "new_source"
+	// FlagManySources is a credential used from many addresses in the last
+	// day.
+	FlagManySources = "many_sources"
+	// FlagManyRepos is a credential that touched many repositories in the
+	// last day.
+	FlagManyRepos = "many_repos"
+	// FlagResumed is a credential used again in the last week after months
+	// without use.
+	FlagResumed = "resumed"
+)
+
+// Thresholds of the flags.
+const (
+	recent         = 24 * time.Hour
+	establishedFor = 7 * 24 * time.Hour
+	manySources    = 5
+	manyRepos      = 20
+	dormantAfter   = 90 * 24 * time.Hour
+	resumedWithin  = 7 * 24 * time.Hour
+)
+
+const (
+	// maxSeen caps the repositories and addresses kept per credential; the
+	// least recently seen are dropped.
+	maxSeen = 50
+	// maxOps caps the operations counted per credential.
+	maxOps = 50
+	// maxCredentials caps the credentials tracked per daemon; the least
+	// recently used are dropped.
+	maxCredentials = 50000
+	// tokenRetention is how long tokens, which expire within a day, are
+	// kept after their last use.
+	tokenRetention = 30 * 24 * time.Hour
+)
+
+// Use is one use of a credential.
+type Use struct {
+	Kind string
+	// ID identifies the credential: a key fingerprint, a user name or,
+	// for tokens, TokenID.
+	ID string
+	// Owner is the user the credential belongs to, if known.
+	Owner string
+	// Actor is who holds a sudo token on the owner's behalf.
+	Actor string
+	// Op is what it was used for, e.g. "fetch", "push" or "api".
+	Op     string
+	Repo   string
+	Source string // client address
+}
+
+// Credential is the recorded use of a credential.
+type Credential struct {
+	Kind      string           `json:"kind"`
+	ID        string           `json:"id"`
+	Owner     string           `json:"owner,omitempty"`
+	Actor     string           `json:"actor,omitempty"`
+	FirstUsed time.Time        `json:"first_used"`
+	LastUsed  time.Time        `json:"last_used"`
+	Uses      int64            `json:"uses"`
+	Ops       map[string]int64 `json:"ops"`
+	Repos     []Seen           `json:"repos,omitempty"`
+	Sources   []Seen           `json:"sources,omitempty"`
+	// Resumed is when the credential was last used again after months
+	// without use.
+	Resumed *time.Time `json:"resumed,omitempty"`
+	// Flags are set by Report.
+	Flags []string `json:"flags,omitempty"`
+}
+
+// Seen is a repository a credential touched or an address it was used
+// from.
+type Seen struct {
+	Name  string    `json:"name"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	Uses  int64     `json:"uses"`
+}
+
+// TokenID identifies a token without keeping it: the start of its SHA-256.
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+type file struct {
+	Credentials []*Credential `json:"credentials"`
+}
+
+// Store records the uses of credentials by one daemon. A nil Store records
+// nothing. It is safe for concurrent use.
+type Store struct {
+	// Dir holds the files of all daemons.
+	Dir string
+	// Name is this daemon's file in Dir without ".json"; it must differ
+	// between daemons sharing Dir, e.g. "gitsshd-host1".
+	Name string
+	// Interval between saves; one minute when zero.
+	Interval time.Duration
+
+	mu    sync.Mutex
+	creds map[string]*Credential // by kind and ID
+	dirty bool
+}
+
+// Load reads what this daemon saved before, so its counts carry on. A
+// missing file is not an error.
+func (s *Store) Load() error {
+	f, err := readFile(s.path())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds = make(map[string]*Credential, len(f.Credentials))
+	for _, c := range f.Credentials {
+		s.creds[key(c.Kind, c.ID)] = c
+	}
+	return nil
+}
+
+// Record records a use of a credential at now.
+func (s *Store) Record(u Use, now time.Time) {
+	if s == nil || u.ID == "" {
+		return
+	}
+	now = now.UTC().Truncate(time.Second)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.creds == nil {
+		s.creds = make(map[string]*Credential)
+	}
+	k := key(u.Kind, u.ID)
+	c, ok := s.creds[k]
+	if !ok {
+		if len(s.creds) >= maxCredentials {
+			s.dropOldestLocked()
+		}
+		c = &Credential{Kind: u.Kind, ID: u.ID, FirstUsed: now, Ops: make(map[string]int64)}
+		s.creds[k] = c
+	}
+	if !c.LastUsed.IsZero() && now.Sub(c.LastUsed) >= dormantAfter {
+		resumed := now
+		c.Resumed = &resumed
+	}
+	if u.Owner != "" {
+		c.Owner = u.Owner
+	}
+	if u.Actor != "" {
+		c.Actor = u.Actor
+	}
+	c.LastUsed = now
+	c.Uses++
+	if _, ok := c.Ops[u.Op]; ok || len(c.Ops) < maxOps {
+		c.Ops[u.Op]++
+	}
+	if u.Repo != "" {
+		c.Repos = see(c.Repos, Seen{Name: u.Repo, First: now, Last: now, Uses: 1})
+	}
+	if u.Source != "" {
+		c.Sources = see(c.Sources, Seen{Name: u.Source, First: now, Last: now, Uses: 1})
+	}
+	s.dirty = true
+}
+
+// Run saves the recorded uses every Interval until ctx is cancelled.
+func (s *Store) Run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Flush(time.Now()); err != nil {
+			log.Printf("credential usage: %v", err)
+		}
+	}
+}
+
+// Flush saves the recorded uses if there are new ones, dropping tokens
+// unused for a month.
+func (s *Store) Flush(now time.Time) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	f := file{Credentials: make([]*Credential, 0, len(s.creds))}
+	for k, c := range s.creds {
+		if isToken(c.Kind) && now.Sub(c.LastUsed) > tokenRetention {
+			delete(s.creds, k)
+			continue
+		}
+		f.Credentials = append(f.Credentials, c)
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("save credential usage: %w", err)
+	}
+	tmp := s.path() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("save credential usage: %w", err)
+	}
+	if err := os.Rename(tmp, s.path()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("save credential usage: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// ReportOptions narrow down a report.
+type ReportOptions struct {
+	Kind  string
+	Owner string
+	// UnusedFor is how long keys and HTTP users go unused before they are
+	// flagged; 90 days when zero.
+	UnusedFor time.Duration
+	// Flagged only reports credentials with flags.
+	Flagged bool
+}
+
+// Report merges the uses recorded by every daemon sharing Dir, sets the
+// flags of each credential and returns them, most recently used first.
+func (s *Store) Report(now time.Time, opts ReportOptions) ([]Credential, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	merged := make(map[string]*Credential)
+	add := func(c *Credential) {
+		k := key(c.Kind, c.ID)
+		if m, ok := merged[k]; ok {
+			merge(m, c)
+			return
+		}
+		cp := *c
+		cp.Ops = make(map[string]int64, len(c.Ops))
+		for op, n := range c.Ops {
+			cp.Ops[op] = n
+		}
+		cp.Repos = append([]Seen(nil), c.Repos...)
+		cp.Sources = append([]Seen(nil), c.Sources...)
+		merged[k] = &cp
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || name == s.Name {
+			continue
+		}
+		f, err := readFile(filepath.Join(s.Dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range f.Credentials {
+			add(c)
+		}
+	}
+	s.mu.Lock()
+	for _, c := range s.creds {
+		add(c)
+	}
+	s.mu.Unlock()
+
+	unusedFor := opts.UnusedFor
+	if unusedFor <= 0 {
+		unusedFor = dormantAfter
+	}
+	var out []Credential
+	for _, c := range merged {
+		if opts.Kind != "" && c.Kind != opts.Kind || opts.Owner != "" && c.Owner != opts.Owner {
+			continue
+		}
+		c.Flags = flags(c, now, unusedFor)
+		if opts.Flagged && len(c.Flags) == 0 {
+			continue
+		}
+		sortSeen(c.Repos)
+		sortSeen(c.Sources)
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].LastUsed.Equal(out[j].LastUsed) {
+			return out[i].LastUsed.After(out[j].LastUsed)
+		}
+		return key(out[i].Kind, out[i].ID) < key(out[j].Kind, out[j].ID)
+	})
+	return out, nil
+}
+
+// flags returns the flags of c at now.
+func flags(c *Credential, now time.Time, unusedFor time.Duration) []string {
+	var flags []string
+	if !isToken(c.Kind) && now.Sub(c.LastUsed) >= unusedFor {
+		flags = append(flags, FlagUnused)
+	}
+	var newSource bool
+	var sources, repos int
+	for _, src := range c.Sources {
+		if now.Sub(src.Last) < recent {
+			sources++
+			newSource = newSource || now.Sub(src.First) < recent
+		}
+	}
+	for _, repo := range c.Repos {
+		if now.Sub(repo.Last) < recent {
+			repos++
+		}
+	}
+	if newSource && now.Sub(c.FirstUsed) >= establishedFor {
+		flags = append(flags, FlagNewSource)
+	}
+	if sources >= manySources {
+		flags = append(flags, FlagManySources)
+	}
+	if repos >= manyRepos {
+		flags = append(flags, FlagManyRepos)
+	}
+	if c.Resumed != nil && now.Sub(*c.Resumed) < resumedWithin {
+		flags = append(flags, FlagResumed)
+	}
+	return flags
+}
+
+// merge adds what another daemon recorded for the same credential to c.
+func merge(c, other *Credential) {
+	if other.FirstUsed.Before(c.FirstUsed) {
+		c.FirstUsed = other.FirstUsed
+	}
+	if other.LastUsed.After(c.LastUsed) {
+		c.LastUsed = other.LastUsed
+		if other.Owner != "" {
+			c.Owner = other.Owner
+		}
+		if other.Actor != "" {
+			c.Actor = other.Actor
+		}
+	}
+	c.Uses += other.Uses
+	for op, n := range other.Ops {
+		c.Ops[op] += n
+	}
+	for _, seen := range other.Repos {
+		c.Repos = see(c.Repos, seen)
+	}
+	for _, seen := range other.Sources {
+		c.Sources = see(c.Sources, seen)
+	}
+	if other.Resumed != nil && (c.Resumed == nil || other.Resumed.After(*c.Resumed)) {
+		c.Resumed = other.Resumed
+	}
+}
+
+// see adds seen to list, dropping the least recently seen entry when the
+// list is full.
+func see(list []Seen, seen Seen) []Seen {
+	for i := range list {
+		if list[i].Name != seen.Name {
+			continue
+		}
+		if seen.First.Before(list[i].First) {
+			list[i].First = seen.First
+		}
+		if seen.Last.After(list[i].Last) {
+			list[i].Last = seen.Last
+		}
+		list[i].Uses += seen.Uses
+		return list
+	}
+	if len(list) >= maxSeen {
+		oldest := 0
+		for i := range list {
+			if list[i].Last.Before(list[oldest].Last) {
+				oldest = i
+			}
+		}
+		list = append(list[:oldest], list[oldest+1:]...)
+	}
+	return append(list, seen)
+}
+
+// sortSeen sorts list most recently seen first.
+func sortSeen(list []Seen) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Last.After(list[j].Last) })
+}
+
+// dropOldestLocked forgets the least recently used credential; s.mu must
+// be held.
+func (s *Store) dropOldestLocked() {
+	var oldest string
+	for k, c := range s.creds {
+		if oldest == "" || c.LastUsed.Before(s.creds[oldest].LastUsed) {
+			oldest = k
+		}
+	}
+	delete(s.creds, oldest)
+}
+
+func (s *Store) path() string {
+	return filepath.Join(s.Dir, s.Name+".json")
+}
+
+func readFile(path string) (file, error) {
+	var f file
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return f, fmt.Errorf("read credential usage: %w", err)
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("parse credential usage %s: %w", path, err)
+	}
+	for _, c := range f.Credentials {
+		if c.Ops == nil {
+			c.Ops = make(map[string]int64)
+		}
+	}
+	return f, nil
+}
+
+func isToken(kind string) bool {
+	return kind == KindFetchToken || kind == KindUserToken || kind == KindSudoToken
+}
+
+func key(kind, id string) string {
+	return kind + " " + id
+}
@@ -0,0 +1,14 @@
+//go:build boringcrypto
+
+package cryptopolicy
+
+import (
+	"crypto/boring"
+
+	// Restricts crypto/tls to FIPS-approved settings process-wide.
+	_ "crypto/tls/fipsonly"
+)
+
+func boringEnabled() bool {
+	return boring.Enabled()
+}
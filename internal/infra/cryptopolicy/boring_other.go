@@ -0,0 +1,7 @@
+//go:build !boringcrypto
+
+package cryptopolicy
+
+func boringEnabled() bool {
+	return false
+}
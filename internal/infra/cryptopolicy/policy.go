@@ -0,0 +1,177 @@
+// Package cryptopolicy restricts the algorithms the servers negotiate over
+// SSH and TLS, and the keys they sign tokens with, to a FIPS 140-compatible
+// set. Binaries built with GOEXPERIMENT=boringcrypto use the BoringCrypto
+// module and always apply the FIPS policy.
+package cryptopolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// Policy selects the permitted algorithms.
+type Policy string
+
+const (
+	// Default leaves the libraries' defaults in place.
+	Default Policy = ""
+	// FIPS permits only FIPS-approved algorithms.
+	FIPS Policy = "fips"
+)
+
+// minHMACKeyBytes is the shortest HMAC key with 112 bits of security
+// (NIST SP 800-131A).
+const minHMACKeyBytes = 14
+
+var (
+	sshKeyExchanges = []string{
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+	}
+	sshCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+	sshMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+	}
+	// sshKeyAlgorithms are the permitted host key and client key signature
+	// algorithms; Ed25519 and SHA-1 RSA signatures are excluded.
+	sshKeyAlgorithms = []string{
+		xssh.KeyAlgoECDSA256, xssh.KeyAlgoECDSA384, xssh.KeyAlgoECDSA521,
+		xssh.KeyAlgoRSASHA256, xssh.KeyAlgoRSASHA512,
+	}
+	tlsCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	tlsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+)
+
+// Parse returns the policy named by s: "" or "default", or "fips".
+func Parse(s string) (Policy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "default":
+		return Default, nil
+	case "fips":
+		return FIPS, nil
+	default:
+		return Default, fmt.Errorf("unknown crypto policy %q", s)
+	}
+}
+
+// BoringCrypto reports whether the binary uses the BoringCrypto module.
+func BoringCrypto() bool {
+	return boringEnabled()
+}
+
+// Restricted reports whether algorithms are limited to the FIPS set, either
+// because p is FIPS or because the binary uses BoringCrypto.
+func (p Policy) Restricted() bool {
+	return p == FIPS || boringEnabled()
+}
+
+// SSHConfig limits the key exchanges, ciphers and MACs of c.
+func (p Policy) SSHConfig(c *xssh.Config) {
+	if !p.Restricted() {
+		return
+	}
+	c.KeyExchanges = append([]string(nil), sshKeyExchanges...)
+	c.Ciphers = append([]string(nil), sshCiphers...)
+	c.MACs = append([]string(nil), sshMACs...)
+}
+
+// SSHServerConfig limits c as SSHConfig does, and the signature algorithms
+// clients may authenticate with, so RSA keys must sign with SHA-2.
+func (p Policy) SSHServerConfig(c *xssh.ServerConfig) {
+	p.SSHConfig(&c.Config)
+	if !p.Restricted() {
+		return
+	}
+	c.PublicKeyAuthAlgorithms = append([]string(nil), sshKeyAlgorithms...)
+}
+
+// SSHHostKeyAlgorithms returns the host key algorithms a client accepts,
+// or nil for the defaults.
+func (p Policy) SSHHostKeyAlgorithms() []string {
+	if !p.Restricted() {
+		return nil
+	}
+	return append([]string(nil), sshKeyAlgorithms...)
+}
+
+// SSHHostKey limits the signature algorithms offered with the host key. It
+// fails for key types with no permitted algorithm, such as Ed25519.
+func (p Policy) SSHHostKey(signer xssh.Signer) (xssh.Signer, error) {
+	if !p.Restricted() {
+		return signer, nil
+	}
+	algSigner, ok := signer.(xssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("host key type %s is not permitted by the %s policy", signer.PublicKey().Type(), FIPS)
+	}
+	var algorithms []string
+	for _, alg := range sshKeyAlgorithms {
+		if keyFormat(alg) == signer.PublicKey().Type() {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("host key type %s is not permitted by the %s policy", signer.PublicKey().Type(), FIPS)
+	}
+	return xssh.NewSignerWithAlgorithms(algSigner, algorithms)
+}
+
+// SSHClientKey reports whether clients may authenticate with key. RSA keys
+// are admitted by type; SSHServerConfig keeps them from signing with SHA-1.
+func (p Policy) SSHClientKey(key xssh.PublicKey) bool {
+	if !p.Restricted() {
+		return true
+	}
+	for _, alg := range sshKeyAlgorithms {
+		if keyFormat(alg) == key.Type() {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig limits c to TLS 1.2 and later with ECDHE and AES-GCM.
+func (p Policy) TLSConfig(c *tls.Config) {
+	if !p.Restricted() {
+		return
+	}
+	c.MinVersion = tls.VersionTLS12
+	c.CipherSuites = append([]uint16(nil), tlsCipherSuites...)
+	c.CurvePreferences = append([]tls.CurveID(nil), tlsCurves...)
+}
+
+// CheckHMACKey returns an error if key is too short to sign tokens under p.
+func (p Policy) CheckHMACKey(key []byte) error {
+	if p.Restricted() && len(key) < minHMACKeyBytes {
+		return fmt.Errorf("token signing key has %d bits, the %s policy needs at least %d", len(key)*8, FIPS, minHMACKeyBytes*8)
+	}
+	return nil
+}
+
+func (p Policy) String() string {
+	if p.Restricted() {
+		return string(FIPS)
+	}
+	return "default"
+}
+
+// keyFormat returns the key type signing with the given algorithm.
+func keyFormat(alg string) string {
+	switch alg {
+	case xssh.KeyAlgoRSASHA256, xssh.KeyAlgoRSASHA512:
+		return xssh.KeyAlgoRSA
+	}
+	return alg
+}
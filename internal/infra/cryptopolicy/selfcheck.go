@@ -0,0 +1,199 @@
+package cryptopolicy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// Inputs are the keys checked against the policy; nil fields are skipped.
+type Inputs struct {
+	SSHHostKey     xssh.PublicKey
+	TLSCertificate *tls.Certificate
+	TokenKey       []byte
+}
+
+// Check is one line of a self-check report.
+type Check struct {
+	Name string `json:"name"`
+	// Status is "ok", "warn" or "fail".
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the result of SelfCheck.
+type Report struct {
+	Policy       string  `json:"policy"`
+	BoringCrypto bool    `json:"boringcrypto"`
+	Checks       []Check `json:"checks"`
+}
+
+// OK reports whether no check failed.
+func (r Report) OK() bool {
+	for _, c := range r.Checks {
+		if c.Status == "fail" {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "crypto self-check: policy %s, BoringCrypto %t\n", r.Policy, r.BoringCrypto)
+	for _, c := range r.Checks {
+		fmt.Fprintf(&b, "  %-4s  %s", c.Status, c.Name)
+		if c.Detail != "" {
+			fmt.Fprintf(&b, ": %s", c.Detail)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// SelfCheck runs known-answer tests of the algorithms the servers rely on
+// and checks the configured keys against p. Daemons should print the
+// report at startup and refuse to start when it is not OK under a
+// restricted policy.
+func SelfCheck(p Policy, in Inputs) Report {
+	r := Report{Policy: p.String(), BoringCrypto: boringEnabled()}
+	add := func(name string, err error) {
+		c := Check{Name: name, Status: "ok"}
+		if err != nil {
+			c.Status, c.Detail = "fail", err.Error()
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	add("SHA-256 known answer", knownAnswer(sha256Sum([]byte("abc")),
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"))
+	add("HMAC-SHA-256 known answer", knownAnswer(hmacSum([]byte("Jefe"), []byte("what do ya want for nothing?")),
+		"5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"))
+	add("AES-GCM known answer", aesGCMKnownAnswer())
+	add("ECDSA P-256 pairwise consistency", ecdsaPairwise())
+
+	if !p.Restricted() {
+		return r
+	}
+	if !r.BoringCrypto {
+		r.Checks = append(r.Checks, Check{
+			Name:   "FIPS module",
+			Status: "warn",
+			Detail: "algorithms are restricted, but Go's crypto is not a validated module; build with GOEXPERIMENT=boringcrypto",
+		})
+	}
+	if in.SSHHostKey != nil {
+		var err error
+		if !p.SSHClientKey(in.SSHHostKey) {
+			err = fmt.Errorf("%s keys are not permitted", in.SSHHostKey.Type())
+		}
+		add("SSH host key", err)
+		r.Checks = append(r.Checks, Check{
+			Name:   "SSH client keys",
+			Status: "warn",
+			Detail: "Ed25519 keys are refused; RSA keys are admitted whatever signature hash the client uses",
+		})
+	}
+	if in.TLSCertificate != nil {
+		add("TLS certificate key", checkCertificate(in.TLSCertificate))
+	}
+	if in.TokenKey != nil {
+		add("token signing key", p.CheckHMACKey(in.TokenKey))
+	}
+	return r
+}
+
+func checkCertificate(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA key has %d bits, at least 2048 are needed", key.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() && key.Curve != elliptic.P384() {
+			return fmt.Errorf("ECDSA curve %s is not permitted", key.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("%T keys are not permitted", key)
+	}
+	return nil
+}
+
+func knownAnswer(got []byte, want string) error {
+	if hex.EncodeToString(got) != want {
+		return fmt.Errorf("got %x", got)
+	}
+	return nil
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func hmacSum(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// aesGCMKnownAnswer checks test case 2 of the GCM specification: a zero
+// key, nonce and block.
+func aesGCMKnownAnswer() error {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nil, make([]byte, aead.NonceSize()), make([]byte, 16), nil)
+	if err := knownAnswer(sealed, "0388dace60b6a392f328c2b971b2fe78ab6e47d42cec13bdf53a67b21257bddf"); err != nil {
+		return err
+	}
+	sealed[0] ^= 1
+	if _, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed, nil); err == nil {
+		return fmt.Errorf("tampered ciphertext was accepted")
+	}
+	return nil
+}
+
+func ecdsaPairwise() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	digest := sha256Sum([]byte("repocraft self-check"))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest, sig) {
+		return fmt.Errorf("signature does not verify")
+	}
+	if ecdsa.VerifyASN1(&key.PublicKey, bytes.Repeat([]byte{0}, len(digest)), sig) {
+		return fmt.Errorf("signature verifies for another digest")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Package deviceauth lets pushes over HTTP without credentials be approved
+// in a browser, device-code style: the refused push shows a short code and
+// a secret, a user approves the code with their user token, and pushes to
+// the same repository that present the secret go through for a while, as
+// that user.
+package deviceauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/access"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// codeAlphabet leaves out vowels, so codes don't spell words, and
+// characters that are easily confused.
+const codeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// maxPending caps the codes waiting for approval, so clients can't fill
+// memory by asking for codes.
+const maxPending = 10000
+
+var (
+	// ErrUnknownCode is returned for codes that don't exist or expired.
+	ErrUnknownCode = errcode.New(errcode.NotFound, "unknown or expired code")
+	// ErrTooManyCodes is returned when too many codes wait for approval.
+	ErrTooManyCodes = errcode.New(errcode.Overloaded, "too many pending device codes, try again later")
+)
+
+// Code is a request to push to a repository from a client.
+type Code struct {
+	Code string `json:"code"`
+	Repo string `json:"repo"`
+	// Client is the address of the push the code was issued to; it is
+	// only shown to the approving user.
+	Client string `json:"client"`
+	// Secret is only given to the client whose push was refused, which
+	// presents it to push once the code is approved.
+	Secret string `json:"-"`
+	// Expires is when the code can no longer be approved, or when pushes
+	// stop being accepted once it is.
+	Expires time.Time `json:"expires"`
+	// User approved the code; empty while pending.
+	User string `json:"user,omitempty"`
+}
+
+// Store keeps codes in memory.
+type Store struct {
+	// CodeTTL is how long a code can be approved; 10 minutes when zero.
+	CodeTTL time.Duration
+	// GrantTTL is how long pushes are accepted once a code is approved;
+	// 15 minutes when zero.
+	GrantTTL time.Duration
+	// Authorizer, if set, decides who may approve pushes to a repository:
+	// only users it lets push there. Without it, any user may.
+	Authorizer access.Authorizer
+
+	mu      sync.Mutex
+	byCode  map[string]*Code
+	byGrant map[string]*Code // by secret
+}
+
+// Start issues a code for a push to repo from client.
+func (s *Store) Start(repo, client string, now time.Time) (Code, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	if len(s.byGrant) >= maxPending {
+		return Code{}, ErrTooManyCodes
+	}
+	code, err := newCode()
+	if err != nil {
+		return Code{}, err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return Code{}, err
+	}
+	c := &Code{Code: code, Repo: repo, Client: client, Secret: secret, Expires: now.Add(ttl(s.CodeTTL, 10*time.Minute))}
+	if s.byCode == nil {
+		s.byCode = make(map[string]*Code)
+		s.byGrant = make(map[string]*Code)
+	}
+	s.byCode[code] = c
+	s.byGrant[secret] = c
+	return *c, nil
+}
+
+// Approve approves code for user and returns it. Users Authorizer doesn't
+// let push to the code's repository are refused.
+func (s *Store) Approve(code, user string, now time.Time) (Code, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	c, ok := s.byCode[Normalize(code)]
+	if !ok || c.User != "" {
+		return Code{}, ErrUnknownCode
+	}
+	if s.Authorizer != nil && !s.Authorizer.CanWrite(user, c.Repo) {
+		return Code{}, access.Denied(user, c.Repo, false)
+	}
+	delete(s.byCode, c.Code)
+	c.User = user
+	c.Expires = now.Add(ttl(s.GrantTTL, 15*time.Minute))
+	return *c, nil
+}
+
+// Approved returns the user who approved the code issued with secret, if
+// it was issued for repo, one did and the approval hasn't expired.
+func (s *Store) Approved(repo, secret string, now time.Time) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.byGrant[secret]
+	if !ok || c.User == "" || c.Repo != repo || !now.Before(c.Expires) {
+		return "", false
+	}
+	return c.User, true
+}
+
+// prune drops expired codes and approvals.
+func (s *Store) prune(now time.Time) {
+	for k, c := range s.byGrant {
+		if !now.Before(c.Expires) {
+			delete(s.byGrant, k)
+			delete(s.byCode, c.Code)
+		}
+	}
+}
+
+// newSecret returns 128 random bits, URL-safe so it can go in a remote
+// URL.
+func newSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Normalize returns code as issued, e.g. "BCDF-GHJK" for "bcdfghjk".
+func Normalize(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func newCode() (string, error) {
+	code := make([]byte, 0, 8)
+	b := make([]byte, 16)
+	for len(code) < cap(code) {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			// Bytes past the last multiple of the alphabet's size would
+			// favour its first letters.
+			if int(c) < 256/len(codeAlphabet)*len(codeAlphabet) && len(code) < cap(code) {
+				code = append(code, codeAlphabet[int(c)%len(codeAlphabet)])
+			}
+		}
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+func ttl(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
@@ -0,0 +1,239 @@
+package diag
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// Capture kinds. CPU profiles and traces record for a duration; the others
+// are snapshots.
+const (
+	KindCPU       = "cpu"
+	KindTrace     = "trace"
+	KindHeap      = "heap"
+	KindAllocs    = "allocs"
+	KindGoroutine = "goroutine"
+)
+
+// Capture states.
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+const (
+	// DefaultDuration is how long CPU profiles and traces record unless
+	// asked otherwise.
+	DefaultDuration = 30 * time.Second
+	// MaxDuration bounds the recording time.
+	MaxDuration = 10 * time.Minute
+	// maxCaptures is the number of captures kept; older files are removed.
+	maxCaptures = 20
+)
+
+// Capture is one profile or trace.
+type Capture struct {
+	ID   int    `json:"id"`
+	Kind string `json:"kind"`
+	// Duration is the recording time of CPU profiles and traces.
+	Duration string    `json:"duration,omitempty"`
+	State    string    `json:"state"`
+	Size     int64     `json:"size,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	file string
+}
+
+// Filename names the capture's file, e.g. "3-cpu.pprof" or "4-trace.trace".
+func (c Capture) Filename() string {
+	ext := "pprof"
+	if c.Kind == KindTrace {
+		ext = "trace"
+	}
+	return fmt.Sprintf("%d-%s.%s", c.ID, c.Kind, ext)
+}
+
+// Capturer records profiles and traces into files under Dir in the
+// background, so long recordings don't depend on a connection staying open
+// through proxies and their timeouts. Only one CPU profile and one trace
+// can record at a time.
+type Capturer struct {
+	Dir string
+
+	mu       sync.Mutex
+	captures []*Capture
+	nextID   int
+	running  map[string]bool
+}
+
+// Start begins a capture of kind; d is the recording time of CPU profiles
+// and traces, DefaultDuration if zero.
+func (c *Capturer) Start(kind string, d time.Duration) (Capture, error) {
+	switch kind {
+	case KindCPU, KindTrace:
+		if d == 0 {
+			d = DefaultDuration
+		}
+		if d < 0 || d > MaxDuration {
+			return Capture{}, errcode.Errorf(errcode.InvalidRequest, "duration must be positive and at most %s", MaxDuration)
+		}
+	case KindHeap, KindAllocs, KindGoroutine:
+		d = 0
+	default:
+		return Capture{}, errcode.Errorf(errcode.InvalidRequest, "unknown capture kind %q", kind)
+	}
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return Capture{}, fmt.Errorf("create diagnostics dir: %w", err)
+	}
+
+	c.mu.Lock()
+	if c.running[kind] {
+		c.mu.Unlock()
+		return Capture{}, errcode.Errorf(errcode.Conflict, "a %s capture is already running", kind)
+	}
+	if c.running == nil {
+		c.running = make(map[string]bool)
+		// Captures of earlier runs can't be listed anymore.
+		stale, _ := filepath.Glob(filepath.Join(c.Dir, "*.*"))
+		for _, f := range stale {
+			_ = os.Remove(f)
+		}
+	}
+	c.nextID++
+	cp := &Capture{ID: c.nextID, Kind: kind, State: StateRunning, Started: time.Now()}
+	if d > 0 {
+		cp.Duration = d.String()
+	}
+	cp.file = filepath.Join(c.Dir, cp.Filename())
+	c.running[kind] = true
+	c.captures = append(c.captures, cp)
+	if len(c.captures) > maxCaptures {
+		for _, old := range c.captures[:len(c.captures)-maxCaptures] {
+			_ = os.Remove(old.file)
+		}
+		c.captures = c.captures[len(c.captures)-maxCaptures:]
+	}
+	c.mu.Unlock()
+
+	// Starting synchronously reports a profile or trace already running,
+	// e.g. one requested through pprof, to the caller.
+	stop, err := begin(kind, cp.file)
+	if err != nil {
+		c.finish(cp, err)
+		return Capture{}, errcode.Errorf(errcode.Conflict, "%s capture: %w", kind, err)
+	}
+	if d == 0 {
+		c.finish(cp, stop())
+	} else {
+		go func() {
+			time.Sleep(d)
+			c.finish(cp, stop())
+		}()
+	}
+	snapshot, _ := c.Capture(cp.ID)
+	return snapshot, nil
+}
+
+// Captures lists the captures, oldest first.
+func (c *Capturer) Captures() []Capture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]Capture, 0, len(c.captures))
+	for _, cp := range c.captures {
+		out = append(out, *cp)
+	}
+	return out
+}
+
+// Capture returns the capture with id.
+func (c *Capturer) Capture(id int) (Capture, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cp := range c.captures {
+		if cp.ID == id {
+			return *cp, true
+		}
+	}
+	return Capture{}, false
+}
+
+// Open opens the file of a finished capture.
+func (c *Capturer) Open(id int) (*os.File, Capture, error) {
+	cp, ok := c.Capture(id)
+	if !ok {
+		return nil, Capture{}, errcode.Errorf(errcode.NotFound, "capture %d not found", id)
+	}
+	if cp.State != StateDone {
+		return nil, cp, errcode.Errorf(errcode.Conflict, "capture %d is %s", id, cp.State)
+	}
+	f, err := os.Open(cp.file)
+	if err != nil {
+		return nil, cp, err
+	}
+	return f, cp, nil
+}
+
+func (c *Capturer) finish(cp *Capture, err error) {
+	var size int64
+	if st, statErr := os.Stat(cp.file); statErr == nil {
+		size = st.Size()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running, cp.Kind)
+	cp.Finished = time.Now()
+	cp.Size = size
+	if err != nil {
+		cp.State = StateFailed
+		cp.Error = err.Error()
+		_ = os.Remove(cp.file)
+		log.Printf("diagnostics: %s capture %d: %v", cp.Kind, cp.ID, err)
+		return
+	}
+	cp.State = StateDone
+	log.Printf("diagnostics: %s capture %d done (%d bytes)", cp.Kind, cp.ID, size)
+}
+
+// begin starts recording kind into file and returns the function ending
+// it. Snapshots are written right away.
+func begin(kind, file string) (func() error, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	closeErr := func(err error) error {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	switch kind {
+	case KindCPU:
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return nil, closeErr(err)
+		}
+		return func() error { pprof.StopCPUProfile(); return closeErr(nil) }, nil
+	case KindTrace:
+		if err := trace.Start(f); err != nil {
+			return nil, closeErr(err)
+		}
+		return func() error { trace.Stop(); return closeErr(nil) }, nil
+	case KindHeap:
+		// Like pprof's gc=1, so the profile shows live memory.
+		runtime.GC()
+	}
+	err = pprof.Lookup(kind).WriteTo(f, 0)
+	return func() error { return closeErr(err) }, nil
+}
@@ -0,0 +1,113 @@
+// Package diag helps diagnose a running daemon: it captures CPU and heap
+// profiles and execution traces on demand, and switches debug logging on
+// and off per subsystem.
+package diag
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// Toggle switches the debug logging of one subsystem. Subsystems register
+// their toggle in a package variable and log through it; logging is off
+// until an admin turns it on.
+type Toggle struct {
+	name string
+	doc  string
+	on   atomic.Bool
+}
+
+// ToggleState describes a toggle for admins.
+type ToggleState struct {
+	Subsystem   string `json:"subsystem"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+var toggles struct {
+	mu     sync.Mutex
+	byName map[string]*Toggle
+}
+
+// Register returns the toggle of subsystem name, creating it on first use.
+func Register(name, doc string) *Toggle {
+	toggles.mu.Lock()
+	defer toggles.mu.Unlock()
+	if t, ok := toggles.byName[name]; ok {
+		return t
+	}
+	if toggles.byName == nil {
+		toggles.byName = make(map[string]*Toggle)
+	}
+	t := &Toggle{name: name, doc: doc}
+	toggles.byName[name] = t
+	return t
+}
+
+// Enabled reports whether debug logging is on.
+func (t *Toggle) Enabled() bool {
+	return t != nil && t.on.Load()
+}
+
+// Printf logs a debug message if the toggle is on.
+func (t *Toggle) Printf(format string, args ...any) {
+	if t.Enabled() {
+		log.Printf("debug %s: %s", t.name, fmt.Sprintf(format, args...))
+	}
+}
+
+// Toggles lists the registered toggles by subsystem.
+func Toggles() []ToggleState {
+	toggles.mu.Lock()
+	out := make([]ToggleState, 0, len(toggles.byName))
+	for _, t := range toggles.byName {
+		out = append(out, ToggleState{Subsystem: t.name, Description: t.doc, Enabled: t.Enabled()})
+	}
+	toggles.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Subsystem < out[j].Subsystem })
+	return out
+}
+
+// SetDebug turns debug logging of subsystem on or off; "all" names every
+// subsystem.
+func SetDebug(subsystem string, on bool) error {
+	toggles.mu.Lock()
+	defer toggles.mu.Unlock()
+	if subsystem == "all" {
+		for _, t := range toggles.byName {
+			t.on.Store(on)
+		}
+		return nil
+	}
+	t, ok := toggles.byName[subsystem]
+	if !ok {
+		return errcode.Errorf(errcode.NotFound, "unknown subsystem %q", subsystem)
+	}
+	t.on.Store(on)
+	if on {
+		log.Printf("debug logging of %s enabled", subsystem)
+	} else {
+		log.Printf("debug logging of %s disabled", subsystem)
+	}
+	return nil
+}
+
+// EnableDebug turns on debug logging of a comma-separated list of
+// subsystems, e.g. "http,git" or "all".
+func EnableDebug(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := SetDebug(name, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
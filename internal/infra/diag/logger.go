@@ -0,0 +1,29 @@
+package diag
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// NewLogger returns a logger writing to w in format: "text" for key=value
+// lines or "json" for a JSON object per line. It is made the default, so
+// what is still logged through the log package comes out the same way.
+// An empty format keeps the default logger, which writes through the log
+// package.
+func NewLogger(format string, w io.Writer) (*slog.Logger, error) {
+	var h slog.Handler
+	switch format {
+	case "":
+		return slog.Default(), nil
+	case "text":
+		h = slog.NewTextHandler(w, nil)
+	case "json":
+		h = slog.NewJSONHandler(w, nil)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+	logger := slog.New(h)
+	slog.SetDefault(logger)
+	return logger, nil
+}
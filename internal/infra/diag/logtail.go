@@ -0,0 +1,151 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log severities, least severe first.
+const (
+	SeverityDebug = "debug"
+	SeverityInfo  = "info"
+	SeverityError = "error"
+)
+
+// LogLine is a line the daemon logged.
+type LogLine struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+// LogTail passes what the daemon logs on to subscribers, so admins can
+// follow it without access to the host. It is an io.Writer for
+// log.SetOutput, next to the daemon's own output.
+type LogTail struct {
+	mu      sync.Mutex
+	subs    map[chan LogLine]struct{}
+	partial []byte
+}
+
+// Write splits p into lines and sends them to the subscribers. Lines are
+// dropped for subscribers that don't keep up, so logging never blocks.
+func (t *LogTail) Write(p []byte) (int, error) {
+	now := time.Now().UTC()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.subs) == 0 {
+		t.partial = nil
+		return len(p), nil
+	}
+	buf := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := parseLogLine(string(buf[:i]), now)
+		buf = buf[i+1:]
+		for ch := range t.subs {
+			select {
+			case ch <- line:
+			default:
+			}
+		}
+	}
+	t.partial = append([]byte(nil), buf...)
+	return len(p), nil
+}
+
+// Subscribe returns the lines logged from now on, until cancel is called.
+func (t *LogTail) Subscribe() (<-chan LogLine, func()) {
+	ch := make(chan LogLine, 256)
+	t.mu.Lock()
+	if t.subs == nil {
+		t.subs = make(map[chan LogLine]struct{})
+	}
+	t.subs[ch] = struct{}{}
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.subs, ch)
+		t.mu.Unlock()
+	}
+}
+
+// parseLogLine strips the date and time the log package prefixes lines
+// with and tells the severity from the message: debug logging goes
+// through a Toggle, and failures say so. Lines of the text and JSON
+// handlers of NewLogger are kept whole and carry their level.
+func parseLogLine(text string, now time.Time) LogLine {
+	line := LogLine{Time: now, Severity: SeverityInfo, Message: text}
+	if level, msg, ok := structured(text); ok {
+		switch {
+		case level == "DEBUG" || strings.HasPrefix(strings.ToLower(msg), "debug "):
+			line.Severity = SeverityDebug
+		case level == "ERROR":
+			line.Severity = SeverityError
+		}
+		return line
+	}
+	if len(text) >= 20 {
+		if _, err := time.Parse("2006/01/02 15:04:05", text[:19]); err == nil {
+			line.Message = text[20:]
+		}
+	}
+	lower := strings.ToLower(line.Message)
+	switch {
+	case strings.HasPrefix(lower, "debug "):
+		line.Severity = SeverityDebug
+	case strings.Contains(lower, "error") || strings.Contains(lower, "failed") || strings.Contains(lower, "panic"):
+		line.Severity = SeverityError
+	}
+	return line
+}
+
+// structured returns the level and message of a line of slog's JSON or
+// text handler.
+func structured(text string) (level, msg string, ok bool) {
+	if strings.HasPrefix(text, "{") {
+		var rec struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}
+		if json.Unmarshal([]byte(text), &rec) != nil || rec.Level == "" {
+			return "", "", false
+		}
+		return rec.Level, rec.Msg, true
+	}
+	if !strings.HasPrefix(text, "time=") {
+		return "", "", false
+	}
+	_, rest, ok := strings.Cut(text, " level=")
+	if !ok {
+		return "", "", false
+	}
+	level, rest, _ = strings.Cut(rest, " ")
+	if rest, ok = strings.CutPrefix(rest, "msg="); ok {
+		if quoted, err := strconv.QuotedPrefix(rest); err == nil {
+			msg, _ = strconv.Unquote(quoted)
+		} else {
+			msg, _, _ = strings.Cut(rest, " ")
+		}
+	}
+	return level, msg, true
+}
+
+// SeverityAtLeast reports whether severity is min or more severe; an empty
+// min admits everything.
+func SeverityAtLeast(severity, min string) bool {
+	rank := map[string]int{SeverityDebug: 0, SeverityInfo: 1, SeverityError: 2}
+	return rank[severity] >= rank[min]
+}
+
+// ValidSeverity reports whether s names a severity.
+func ValidSeverity(s string) bool {
+	return s == SeverityDebug || s == SeverityInfo || s == SeverityError
+}
@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consul discovers the passing instances of a service registered in Consul.
+// The instance tagged with PrimaryTag is the primary.
+type Consul struct {
+	// Address of the Consul HTTP API; defaults to "http://127.0.0.1:8500".
+	Address string
+	Service string
+	// PrimaryTag defaults to "primary".
+	PrimaryTag string
+	// Token is sent as X-Consul-Token when set.
+	Token string
+	// Scheme of the node URLs; defaults to "http".
+	Scheme string
+	Client *http.Client
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+	}
+}
+
+// Discover implements Discoverer.
+func (c Consul) Discover(ctx context.Context) ([]Node, error) {
+	addr := c.Address
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	u := strings.TrimRight(addr, "/") + "/v1/health/service/" + url.PathEscape(c.Service) + "?passing=true"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("consul: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("consul: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	primaryTag := c.PrimaryTag
+	if primaryTag == "" {
+		primaryTag = "primary"
+	}
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	nodes := make([]Node, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		n := Node{URL: scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port))}
+		for _, tag := range e.Service.Tags {
+			if tag == primaryTag {
+				n.Primary = true
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
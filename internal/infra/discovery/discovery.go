@@ -0,0 +1,110 @@
+// Package discovery finds the storage nodes that serve repositories, so the
+// router and replication can follow changes without restarts.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node is a storage node found by discovery.
+type Node struct {
+	URL     string
+	Primary bool
+}
+
+// Discoverer returns the current set of storage nodes.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]Node, error)
+}
+
+// Static always returns the same nodes.
+type Static []Node
+
+// Discover implements Discoverer.
+func (s Static) Discover(context.Context) ([]Node, error) {
+	return append([]Node(nil), s...), nil
+}
+
+// Cache reuses the result of a Discoverer for TTL and keeps serving the last
+// good result while the source fails. It is safe for concurrent use.
+type Cache struct {
+	Source Discoverer
+	// TTL defaults to thirty seconds.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	at    time.Time
+	nodes []Node
+}
+
+// Discover implements Discoverer.
+func (c *Cache) Discover(ctx context.Context) ([]Node, error) {
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes != nil && time.Since(c.at) < ttl {
+		return c.nodes, nil
+	}
+	nodes, err := c.Source.Discover(ctx)
+	if err != nil {
+		if c.nodes != nil {
+			return c.nodes, nil
+		}
+		return nil, err
+	}
+	if len(nodes) == 0 && c.nodes != nil {
+		// An empty answer is more likely a broken source than a fleet
+		// without nodes.
+		return c.nodes, nil
+	}
+	c.at, c.nodes = time.Now(), nodes
+	return nodes, nil
+}
+
+// ErrNoNodes is returned by sources that found no nodes.
+var ErrNoNodes = errors.New("no storage nodes discovered")
+
+// Parse returns the source described by spec:
+//
+//	srv:_git._tcp.storage.example.com  DNS SRV records
+//	consul:storage                     a Consul service, the agent at
+//	                                   CONSUL_HTTP_ADDR with CONSUL_HTTP_TOKEN
+//	kubernetes:storage:storage-0       the Endpoints of a Service in the
+//	                                   pod's namespace and the primary's pod
+func Parse(spec string) (Discoverer, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	switch kind {
+	case "srv":
+		if arg == "" {
+			return nil, errors.New("srv discovery needs a record name")
+		}
+		return DNSSRV{Name: arg}, nil
+	case "consul":
+		if arg == "" {
+			return nil, errors.New("consul discovery needs a service name")
+		}
+		addr := os.Getenv("CONSUL_HTTP_ADDR")
+		if addr != "" && !strings.Contains(addr, "://") {
+			// Consul's own tools take a bare host and port.
+			addr = "http://" + addr
+		}
+		return Consul{Address: addr, Service: arg, Token: os.Getenv("CONSUL_HTTP_TOKEN")}, nil
+	case "kubernetes":
+		service, primary, _ := strings.Cut(arg, ":")
+		if service == "" || primary == "" {
+			return nil, errors.New("kubernetes discovery needs a service and the primary's pod")
+		}
+		return KubernetesEndpoints{Service: service, Primary: primary}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery source %q", kind)
+	}
+}
@@ -0,0 +1,55 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// DNSSRV discovers nodes from SRV records such as
+// "_git._tcp.storage.example.com". Records with the lowest priority value
+// name the primary; the first of them by weight is chosen when there are
+// several.
+type DNSSRV struct {
+	Name string
+	// Scheme of the node URLs; defaults to "http".
+	Scheme string
+	// Resolver defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// Discover implements Discoverer.
+func (d DNSSRV) Discover(ctx context.Context) ([]Node, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", d.Name, err)
+	}
+	if len(records) == 0 {
+		return nil, ErrNoNodes
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		return records[i].Weight > records[j].Weight
+	})
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	nodes := make([]Node, 0, len(records))
+	for i, rec := range records {
+		host := strings.TrimSuffix(rec.Target, ".")
+		nodes = append(nodes, Node{
+			URL:     fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, fmt.Sprint(rec.Port))),
+			Primary: i == 0,
+		})
+	}
+	return nodes, nil
+}
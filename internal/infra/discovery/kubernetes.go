@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesEndpoints discovers the ready addresses of a Service from its
+// Endpoints object using the in-cluster service account. The address whose
+// pod (or hostname) is named Primary is the primary, e.g. "storage-0" of a
+// StatefulSet.
+type KubernetesEndpoints struct {
+	Service string
+	// Namespace defaults to the pod's own namespace.
+	Namespace string
+	Primary   string
+	// Port selects a named port of the Endpoints; defaults to the first.
+	Port string
+	// Scheme of the node URLs; defaults to "http".
+	Scheme string
+}
+
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP        string
+			Hostname  string
+			TargetRef *struct {
+				Name string
+			}
+		}
+		Ports []struct {
+			Name string
+			Port int
+		}
+	}
+}
+
+// Discover implements Discoverer.
+func (k KubernetesEndpoints) Discover(ctx context.Context) ([]Node, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes: not running in a cluster")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	ns := k.Namespace
+	if ns == "" {
+		data, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: %w", err)
+		}
+		ns = strings.TrimSpace(string(data))
+	}
+	client, err := inClusterClient()
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("https://%s/api/v1/namespaces/%s/endpoints/%s", net.JoinHostPort(host, port), ns, k.Service)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubernetes: endpoints %s/%s: %s", ns, k.Service, resp.Status)
+	}
+	var ep endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+
+	scheme := k.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	var nodes []Node
+	for _, subset := range ep.Subsets {
+		portNum := 0
+		for _, p := range subset.Ports {
+			if k.Port == "" || p.Name == k.Port {
+				portNum = p.Port
+				break
+			}
+		}
+		if portNum == 0 {
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			name := addr.Hostname
+			if addr.TargetRef != nil {
+				name = addr.TargetRef.Name
+			}
+			nodes = append(nodes, Node{
+				URL:     scheme + "://" + net.JoinHostPort(addr.IP, strconv.Itoa(portNum)),
+				Primary: k.Primary != "" && name == k.Primary,
+			})
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	return nodes, nil
+}
+
+func inClusterClient() (*http.Client, error) {
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes: invalid service account CA")
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}, nil
+}
@@ -0,0 +1,184 @@
+// Package errcode is the error model shared by the git transports and the
+// API. Errors a client can act on carry a Code, a short identifier such as
+// "repo_not_found" that stays stable while messages change. Clients see it
+// in front of the message, as in "repo_not_found: repository not found":
+// in ERR pkt-lines and SSH error messages, in the body and the
+// Repocraft-Error header of Smart HTTP responses, and as "code" in API
+// error responses.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Header is the HTTP response header carrying the code of a failed request.
+const Header = "Repocraft-Error"
+
+// Code identifies a kind of error.
+type Code string
+
+// Codes.
+const (
+	// InvalidRequest is a request the server can't make sense of.
+	InvalidRequest Code = "invalid_request"
+	// MethodNotAllowed is an HTTP method the endpoint doesn't serve.
+	MethodNotAllowed Code = "method_not_allowed"
+	// Unauthenticated is a request without valid credentials.
+	Unauthenticated Code = "unauthenticated"
+	// AccessDenied is a request the client's credentials don't allow.
+	AccessDenied Code = "access_denied"
+	// RepoNotFound is a repository that doesn't exist or isn't visible.
+	RepoNotFound Code = "repo_not_found"
+	// NotFound is anything else that doesn't exist.
+	NotFound Code = "not_found"
+	// RepoArchived is a push to an archived, read-only repository.
+	RepoArchived Code = "repo_archived"
+	// PushFrozen is a push to a branch during a freeze window.
+	PushFrozen Code = "push_frozen"
+	// LegalHold is a change to a ref or repository under legal hold.
+	LegalHold Code = "legal_hold"
+	// RepoExists is a repository that is in the way of a create or move.
+	RepoExists Code = "repo_exists"
+	// WrongHost is a repository served under another URL.
+	WrongHost Code = "wrong_host"
+	// Conflict is a request clashing with the state of the server, e.g. a
+	// resumed push continuing at the wrong offset.
+	Conflict Code = "conflict"
+	// TooLarge is a request bigger than the server accepts.
+	TooLarge Code = "too_large"
+	// LimitExceeded is a request asking for more work than allowed, e.g.
+	// too many wants or too deep a history.
+	LimitExceeded Code = "limit_exceeded"
+	// QuotaExceeded is a request that would take an identity or namespace
+	// over its quota.
+	QuotaExceeded Code = "quota_exceeded"
+	// RateLimited is a client sending too many requests.
+	RateLimited Code = "rate_limited"
+	// Overloaded is a server shedding load; retrying later helps.
+	Overloaded Code = "overloaded"
+	// Unavailable is a storage node that can't be reached.
+	Unavailable Code = "backend_unavailable"
+	// Internal is everything else.
+	Internal Code = "internal"
+)
+
+// statuses maps codes to HTTP statuses.
+var statuses = map[Code]int{
+	InvalidRequest:   http.StatusBadRequest,
+	MethodNotAllowed: http.StatusMethodNotAllowed,
+	Unauthenticated:  http.StatusUnauthorized,
+	AccessDenied:     http.StatusForbidden,
+	RepoNotFound:     http.StatusNotFound,
+	NotFound:         http.StatusNotFound,
+	RepoArchived:     http.StatusForbidden,
+	PushFrozen:       http.StatusForbidden,
+	LegalHold:        http.StatusForbidden,
+	RepoExists:       http.StatusConflict,
+	WrongHost:        http.StatusMisdirectedRequest,
+	Conflict:         http.StatusConflict,
+	TooLarge:         http.StatusRequestEntityTooLarge,
+	LimitExceeded:    http.StatusUnprocessableEntity,
+	QuotaExceeded:    http.StatusForbidden,
+	RateLimited:      http.StatusTooManyRequests,
+	Overloaded:       http.StatusServiceUnavailable,
+	Unavailable:      http.StatusBadGateway,
+	Internal:         http.StatusInternalServerError,
+}
+
+// codesByStatus picks the code ForStatus returns for statuses several codes
+// share.
+var codesByStatus = map[int]Code{
+	http.StatusNotFound:  NotFound,
+	http.StatusConflict:  Conflict,
+	http.StatusForbidden: AccessDenied,
+}
+
+// HTTPStatus returns the HTTP status for c.
+func (c Code) HTTPStatus() int {
+	if status, ok := statuses[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// ForStatus returns the code for an HTTP status, for errors that only know
+// their status.
+func ForStatus(status int) Code {
+	if c, ok := codesByStatus[status]; ok {
+		return c
+	}
+	for c, s := range statuses {
+		if s == status {
+			return c
+		}
+	}
+	if status >= 400 && status < 500 {
+		return InvalidRequest
+	}
+	return Internal
+}
+
+// Error is an error with a code.
+type Error struct {
+	Code    Code
+	Message string
+	// Status, if set, is a more specific HTTP status than the code's.
+	Status int
+	// RetryAfter, if set, tells the client when trying again may succeed.
+	RetryAfter time.Duration
+	// Err is the underlying error, if any.
+	Err error
+}
+
+// New returns an error with code and message.
+func New(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// Errorf returns an error with code and a formatted message. Like
+// fmt.Errorf, it wraps the operand of a %w verb.
+func Errorf(code Code, format string, args ...any) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Code: code, Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// HTTPStatus returns the HTTP status for the error.
+func (e *Error) HTTPStatus() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	return e.Code.HTTPStatus()
+}
+
+// As returns the first *Error in err's chain, or one with code Internal
+// wrapping err.
+func As(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: Internal, Message: err.Error(), Err: err}
+}
+
+// CodeOf returns the code of err: that of the first *Error in its chain,
+// Internal if there is none, or "" for a nil err.
+func CodeOf(err error) Code {
+	if err == nil {
+		return ""
+	}
+	return As(err).Code
+}
+
+// Text returns the client-visible form of err, its code followed by the
+// message, e.g. "repo_not_found: repository not found". The message is the
+// whole of err, so context added by wrapping is kept.
+func Text(err error) string {
+	return fmt.Sprintf("%s: %s", CodeOf(err), err.Error())
+}
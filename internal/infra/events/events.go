@@ -0,0 +1,350 @@
+// Package events keeps a log of what happens to repositories, pushes and
+// the ref updates the server makes itself as well as repositories being
+// created, moved, archived and deleted, for indexers and mirrors to follow
+// instead of polling.
+//
+// The log is a file per day of JSON lines, appended to by every server
+// process sharing the directory. An event's position, the day and the
+// offset just past its line, is the token that resumes reading after it.
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Event types.
+const (
+	// Push is a push that updated refs.
+	Push = "push"
+	// RefUpdate is a ref the server updated itself, e.g. a merge or a
+	// restore through the API.
+	RefUpdate = "ref_update"
+	// RepoCreated is a repository created, provisioned or imported.
+	RepoCreated = "repo_created"
+	// RepoTransferred is a repository moved to Repo from From.
+	RepoTransferred = "repo_transferred"
+	// RepoArchived and RepoUnarchived are a repository made read-only and
+	// writable again.
+	RepoArchived   = "repo_archived"
+	RepoUnarchived = "repo_unarchived"
+	// RepoDeleted is a repository removed by provisioning or reclaimed.
+	RepoDeleted = "repo_deleted"
+	// MalwareFlagged is a push let through although the malware scanner
+	// found something in it, listed in Findings.
+	MalwareFlagged = "malware_flagged"
+)
+
+// Event is something that happened to a repository.
+type Event struct {
+	// ID is the token resuming after the event; it is set when reading.
+	ID   string    `json:"id,omitempty"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Repo string    `json:"repo"`
+	// From is where a transferred repository was before.
+	From string `json:"from,omitempty"`
+	// Actor pushed or made the change: an identity, "admin" or the
+	// component that did it, e.g. "provision".
+	Actor   string   `json:"actor,omitempty"`
+	Updates []Update `json:"updates,omitempty"`
+	// Findings are what the malware scanner found in a flagged push.
+	Findings []string `json:"findings,omitempty"`
+}
+
+// Update is a ref update of a Push or RefUpdate event. Old is the zero
+// object ID when the ref was created, New when it was deleted.
+type Update struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// ErrExpired is returned for tokens of events dropped from the log.
+var ErrExpired = errcode.New(errcode.NotFound, "events after this token are no longer kept, start over with after=0")
+
+// errInvalidToken is returned for tokens the log didn't hand out.
+var errInvalidToken = errcode.New(errcode.InvalidRequest, "invalid event token")
+
+// dayLayout names the file of each day.
+const dayLayout = "20060102"
+
+// maxRead caps what Cursor.Next reads at once.
+const maxRead = 1 << 20
+
+// Log keeps events in files under Dir. A nil Log drops them. It is safe
+// for concurrent use.
+type Log struct {
+	Dir string
+	// Retention is how long events are kept; defaults to 7 days.
+	Retention time.Duration
+
+	mu sync.Mutex
+}
+
+// Append adds events to the log, stamping those without a time.
+func (l *Log) Append(events ...Event) error {
+	if l == nil || len(events) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	var buf []byte
+	for _, e := range events {
+		e.ID = ""
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(l.Dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.file(now.Format(dayLayout)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	// A single write keeps lines whole when other processes append to
+	// the same file.
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Record appends events, logging failures instead of returning them, for
+// callers whose work is done either way.
+func (l *Log) Record(events ...Event) {
+	if err := l.Append(events...); err != nil {
+		log.Printf("events: %v", err)
+	}
+}
+
+// Prepare accepts every update and appends a Push event once git commits
+// them.
+func (l *Log) Prepare(ctx context.Context, req service.ServiceRequest, updates []service.PushCommand) (service.PreparedTransaction, error) {
+	e := Event{Type: Push, Repo: req.RepoName, Actor: req.Identity}
+	for _, u := range updates {
+		e.Updates = append(e.Updates, Update{Ref: u.Ref, Old: u.Old, New: u.New})
+	}
+	return &transaction{log: l, event: e}, nil
+}
+
+type transaction struct {
+	log   *Log
+	event Event
+}
+
+func (t *transaction) Commit(ctx context.Context) error {
+	return t.log.Append(t.event)
+}
+
+func (t *transaction) Abort(ctx context.Context) error { return nil }
+
+// Cursor reads the log from a position on.
+type Cursor struct {
+	log *Log
+	day string
+	off int64
+}
+
+// Cursor returns a cursor after the event token names. An empty token
+// starts at the end of the log, so only new events are read, and "0" at
+// its oldest event.
+func (l *Log) Cursor(token string, now time.Time) (*Cursor, error) {
+	days, err := l.days()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case "":
+		day := now.UTC().Format(dayLayout)
+		if len(days) > 0 && days[len(days)-1] > day {
+			day = days[len(days)-1]
+		}
+		c := &Cursor{log: l, day: day}
+		if fi, err := os.Stat(l.file(day)); err == nil {
+			c.off = fi.Size()
+		}
+		return c, nil
+	case "0":
+		if len(days) == 0 {
+			return &Cursor{log: l, day: now.UTC().Format(dayLayout)}, nil
+		}
+		return &Cursor{log: l, day: days[0]}, nil
+	}
+	day, off, ok := strings.Cut(token, "-")
+	n, err := strconv.ParseInt(off, 10, 64)
+	if _, perr := time.Parse(dayLayout, day); !ok || perr != nil || err != nil || n < 0 {
+		return nil, errInvalidToken
+	}
+	fi, err := os.Stat(l.file(day))
+	switch {
+	case os.IsNotExist(err):
+		if len(days) == 0 || day < days[0] {
+			return nil, ErrExpired
+		}
+		return nil, errInvalidToken
+	case err != nil:
+		return nil, err
+	case n > fi.Size():
+		return nil, errInvalidToken
+	}
+	return &Cursor{log: l, day: day, off: n}, nil
+}
+
+// Next returns the events appended after the cursor's position so far,
+// oldest first, and moves past them. It returns none when there are no
+// new events yet.
+func (c *Cursor) Next(now time.Time) ([]Event, error) {
+	for {
+		events, err := c.read()
+		if err != nil || len(events) > 0 {
+			return events, err
+		}
+		// A day's file is complete once every process has moved on to
+		// the next; allow a minute for writes that straddled midnight.
+		next, err := c.nextDay()
+		if err != nil || next == "" {
+			return nil, err
+		}
+		end, _ := time.Parse(dayLayout, c.day)
+		if now.Before(end.Add(24*time.Hour + time.Minute)) {
+			return nil, nil
+		}
+		c.day, c.off = next, 0
+	}
+}
+
+// read reads the whole lines past the cursor in its day's file.
+func (c *Cursor) read() ([]Event, error) {
+	f, err := os.Open(c.log.file(c.day))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, maxRead)
+	n, err := f.ReadAt(buf, c.off)
+	if err != nil && n == 0 && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	buf = buf[:n]
+	end := bytes.LastIndexByte(buf, '\n')
+	if end < 0 {
+		return nil, nil
+	}
+	var events []Event
+	for _, line := range bytes.SplitAfter(buf[:end+1], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		c.off += int64(len(line))
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Printf("events: %s at %d: %v", c.day, c.off, err)
+			continue
+		}
+		e.ID = fmt.Sprintf("%s-%d", c.day, c.off)
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// nextDay returns the first day after the cursor's with a file, if any.
+func (c *Cursor) nextDay() (string, error) {
+	days, err := c.log.days()
+	if err != nil {
+		return "", err
+	}
+	i := sort.SearchStrings(days, c.day+"\xff")
+	if i == len(days) {
+		return "", nil
+	}
+	return days[i], nil
+}
+
+// Run drops old events on start and then daily until ctx is cancelled.
+func (l *Log) Run(ctx context.Context) error {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := l.Trim(time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("events: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Trim removes the files of days entirely older than the retention.
+func (l *Log) Trim(now time.Time) error {
+	retention := l.Retention
+	if retention <= 0 {
+		retention = 7 * 24 * time.Hour
+	}
+	cutoff := now.UTC().Add(-retention).Format(dayLayout)
+	days, err := l.days()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if day >= cutoff {
+			break
+		}
+		if err := os.Remove(l.file(day)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// days returns the days with a file, oldest first.
+func (l *Log) days() ([]string, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, e := range entries {
+		day, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if _, err := time.Parse(dayLayout, day); ok && err == nil && !e.IsDir() {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (l *Log) file(day string) string {
+	return filepath.Join(l.Dir, day+".jsonl")
+}
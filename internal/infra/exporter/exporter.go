@@ -0,0 +1,327 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/jobs"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/snapshot"
+)
+
+// ErrRunning is returned when an export to the same target is already
+// running.
+var ErrRunning = errors.New("export already running")
+
+// Job states.
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// Options select what is exported.
+type Options struct {
+	// Repos are the paths to export. If empty, every repository under
+	// Prefix is exported, or every repository if Prefix is empty too.
+	Repos  []string
+	Prefix string
+	// Metadata creates repositories on GitHub and GitLab with their
+	// description and visibility, and records every repository's settings
+	// in the job as a provisioning manifest. Without it, repositories are
+	// created private.
+	Metadata bool
+	// Submodules adds the repositories hosted here that the branches and
+	// tags of the selected ones use as submodules, recursively, so the
+	// target gets a complete source tree.
+	Submodules bool
+}
+
+// Job is the progress of one export run.
+type Job struct {
+	ID       int       `json:"id"`
+	Target   string    `json:"target"`
+	State    string    `json:"state"`
+	Total    int       `json:"total"`
+	Exported int       `json:"exported"`
+	Failed   int       `json:"failed"`
+	Current  string    `json:"current,omitempty"`
+	Errors   []string  `json:"errors,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	// Metadata is the manifest of the exported repositories, for the
+	// receiving Repocraft server's REPOCRAFT_PROVISION_MANIFEST.
+	Metadata *provision.Manifest `json:"metadata,omitempty"`
+}
+
+// maxJobErrors bounds the errors kept per job; Failed keeps counting.
+const maxJobErrors = 50
+
+// Exporter runs export jobs from RepoRoot.
+type Exporter struct {
+	RepoRoot string
+	GitPath  string
+	// Bases are the URLs this server is reached at; submodules with
+	// absolute URLs under them are hosted here.
+	Bases []*url.URL
+
+	jobs jobs.Registry[Job]
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// Start exports to target in the background and returns the new job.
+func (ex *Exporter) Start(target Target, opts Options) (Job, error) {
+	repos, err := ex.selectRepos(opts)
+	if err != nil {
+		return Job{}, err
+	}
+	if opts.Submodules {
+		repos = ex.addSubmodules(context.Background(), repos)
+	}
+	if len(repos) == 0 {
+		return Job{}, fmt.Errorf("no repositories selected")
+	}
+	key := target.Name()
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.running[key] {
+		return Job{}, ErrRunning
+	}
+	if ex.running == nil {
+		ex.running = make(map[string]bool)
+	}
+	ex.running[key] = true
+	job := ex.jobs.Add(func(id int) *Job {
+		return &Job{ID: id, Target: key, State: StateRunning, Total: len(repos), Started: time.Now()}
+	})
+	snapshot := job.snapshot()
+
+	go func() {
+		ex.run(context.Background(), job, target, repos, opts)
+		ex.mu.Lock()
+		delete(ex.running, key)
+		ex.mu.Unlock()
+	}()
+	return snapshot, nil
+}
+
+// Jobs returns the recent jobs, oldest first.
+func (ex *Exporter) Jobs() []Job {
+	return ex.jobs.All((*Job).snapshot)
+}
+
+// Job returns the job with the given ID.
+func (ex *Exporter) Job(id int) (Job, bool) {
+	return ex.jobs.Get(id, (*Job).snapshot)
+}
+
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Errors = append([]string(nil), j.Errors...)
+	if j.Metadata != nil {
+		m := provision.Manifest{Repos: append([]provision.Repo(nil), j.Metadata.Repos...)}
+		c.Metadata = &m
+	}
+	return c
+}
+
+func (ex *Exporter) run(ctx context.Context, job *Job, target Target, repos []string, opts Options) {
+	if opts.Metadata {
+		ex.jobs.Update(job, func(j *Job) { j.Metadata = &provision.Manifest{} })
+	}
+	for _, rel := range repos {
+		ex.jobs.Update(job, func(j *Job) { j.Current = rel })
+		st, err := ex.export(ctx, target, rel, opts)
+		ex.jobs.Update(job, func(j *Job) {
+			if err != nil {
+				j.Failed++
+				if len(j.Errors) < maxJobErrors {
+					j.Errors = append(j.Errors, fmt.Sprintf("%s: %v", rel, err))
+				}
+				return
+			}
+			j.Exported++
+			if j.Metadata != nil {
+				j.Metadata.Repos = append(j.Metadata.Repos, st)
+			}
+		})
+		if err != nil {
+			log.Printf("export %d: %s: %v", job.ID, rel, err)
+		}
+	}
+
+	var done Job
+	ex.jobs.Finish(job, func(j *Job) {
+		j.State, j.Current, j.Finished = StateDone, "", time.Now()
+		if j.Exported == 0 {
+			j.State = StateFailed
+		}
+		done = *j
+	})
+	log.Printf("export %d: %s %s: %d exported, %d failed", done.ID, done.Target, done.State, done.Exported, done.Failed)
+}
+
+// export pushes the branches and tags of rel to target and returns the
+// repository's settings.
+func (ex *Exporter) export(ctx context.Context, target Target, rel string, opts Options) (provision.Repo, error) {
+	st, err := provision.Describe(ctx, ex.RepoRoot, rel)
+	if err != nil {
+		return st, err
+	}
+	repo := Repo{Path: rel, Private: true}
+	if opts.Metadata {
+		repo.Description, repo.Private = st.Description, st.Visibility == provision.Private
+	}
+	pushURL, err := target.Prepare(ctx, repo)
+	if err != nil {
+		return st, err
+	}
+	dir := filepath.Join(ex.RepoRoot, filepath.FromSlash(rel))
+	err = ex.gitRun(ctx, target, dir, "push", "--quiet", "--prune", pushURL, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	return st, err
+}
+
+// gitRun runs git with the target's credentials passed through the
+// environment, where they don't show up in process listings or get saved.
+func (ex *Exporter) gitRun(ctx context.Context, target Target, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, ex.git(), append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=http:https:ssh")
+	if header := target.AuthHeader(); header != "" {
+		cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0="+header)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git push: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// selectRepos resolves opts to repository paths relative to RepoRoot.
+func (ex *Exporter) selectRepos(opts Options) ([]string, error) {
+	if len(opts.Repos) > 0 {
+		repos := make([]string, 0, len(opts.Repos))
+		for _, raw := range opts.Repos {
+			rel := path.Clean(strings.Trim(raw, "/"))
+			if !strings.HasSuffix(rel, ".git") {
+				rel += ".git"
+			}
+			dir := filepath.Join(ex.RepoRoot, filepath.FromSlash(rel))
+			if !filepath.IsLocal(rel) || hasHiddenPart(rel) || !service.IsRepository(dir) {
+				return nil, fmt.Errorf("repository %q not found", raw)
+			}
+			repos = append(repos, rel)
+		}
+		return repos, nil
+	}
+
+	prefix := strings.Trim(opts.Prefix, "/")
+	if prefix != "" && (!filepath.IsLocal(prefix) || hasHiddenPart(prefix)) {
+		return nil, fmt.Errorf("invalid prefix %q", opts.Prefix)
+	}
+	root := filepath.Clean(ex.RepoRoot)
+	start := filepath.Join(root, filepath.FromSlash(prefix))
+	var repos []string
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() || p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !service.IsRepository(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		repos = append(repos, filepath.ToSlash(rel))
+		return filepath.SkipDir
+	})
+	return repos, err
+}
+
+// addSubmodules appends to repos the repositories hosted here that their
+// branch and tag tips pin as submodules, and theirs in turn.
+func (ex *Exporter) addSubmodules(ctx context.Context, repos []string) []string {
+	seen := make(map[string]bool)
+	for _, rel := range repos {
+		seen[rel] = true
+	}
+	for i := 0; i < len(repos); i++ {
+		dir := filepath.Join(ex.RepoRoot, filepath.FromSlash(repos[i]))
+		// Tags are peeled to what they point to.
+		out, err := exec.CommandContext(ctx, ex.git(), "--git-dir="+dir, "for-each-ref", "--format=%(if)%(*objectname)%(then)%(*objectname)%(else)%(objectname)%(end)", "refs/heads/", "refs/tags/").Output()
+		if err != nil {
+			continue
+		}
+		tips := make(map[string]bool)
+		for _, tip := range strings.Fields(string(out)) {
+			if tips[tip] {
+				continue
+			}
+			tips[tip] = true
+			subs, err := snapshot.Submodules(ctx, ex.git(), dir, repos[i], tip, ex.Bases)
+			if err != nil {
+				continue
+			}
+			for _, sub := range subs {
+				if rel, ok := ex.hosted(sub.Repo); ok && !seen[rel] {
+					seen[rel] = true
+					repos = append(repos, rel)
+				}
+			}
+		}
+	}
+	return repos
+}
+
+// hosted returns the path of the repository name under RepoRoot, falling
+// back to name with ".git" appended like the transports.
+func (ex *Exporter) hosted(name string) (string, bool) {
+	if name == "" || !filepath.IsLocal(name) || hasHiddenPart(name) {
+		return "", false
+	}
+	for _, rel := range []string{name, name + ".git"} {
+		if service.IsRepository(filepath.Join(ex.RepoRoot, filepath.FromSlash(rel))) {
+			return rel, true
+		}
+	}
+	return "", false
+}
+
+func (ex *Exporter) git() string {
+	if ex.GitPath != "" {
+		return ex.GitPath
+	}
+	return "git"
+}
+
+func hasHiddenPart(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+// Package exporter pushes repositories from the repository root to another
+// host: a GitHub organization, a GitLab group or another Repocraft server.
+// It complements the importer for planned migrations and for seeding a
+// disaster-recovery copy. Exports run as background jobs; running one again
+// pushes only what changed.
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Repo is a repository to export.
+type Repo struct {
+	// Path relative to the repository root, e.g. "team/app.git".
+	Path        string
+	Description string
+	Private     bool
+}
+
+// Target receives exported repositories.
+type Target interface {
+	// Name identifies the target in job status, e.g. "github:acme".
+	Name() string
+	// Prepare creates the repository on the target if it doesn't exist and
+	// returns the URL to push to.
+	Prepare(ctx context.Context, repo Repo) (string, error)
+	// AuthHeader is sent with pushes, so the token never appears in a URL.
+	AuthHeader() string
+}
+
+// errNotFound is returned by doJSON for a 404 response.
+var errNotFound = errors.New("not found")
+
+// GitHub creates repositories in an organization. Nested paths are
+// flattened, so "team/app.git" becomes "team-app".
+type GitHub struct {
+	Org   string
+	Token string
+	// BaseURL of the REST API; defaults to "https://api.github.com". Set it
+	// to "https://<host>/api/v3" for GitHub Enterprise Server.
+	BaseURL string
+	Client  *http.Client
+}
+
+type githubRepo struct {
+	CloneURL string `json:"clone_url"`
+}
+
+// Name implements Target.
+func (g GitHub) Name() string { return "github:" + g.Org }
+
+// AuthHeader implements Target.
+func (g GitHub) AuthHeader() string { return basicAuth("x-access-token", g.Token) }
+
+// Prepare implements Target.
+func (g GitHub) Prepare(ctx context.Context, repo Repo) (string, error) {
+	base := strings.TrimSuffix(g.BaseURL, "/")
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	header := http.Header{
+		"Accept":        {"application/vnd.github+json"},
+		"Authorization": {"Bearer " + g.Token},
+	}
+	name := flatName(repo.Path)
+	var out githubRepo
+	err := doJSON(ctx, g.Client, http.MethodGet, fmt.Sprintf("%s/repos/%s/%s", base, url.PathEscape(g.Org), url.PathEscape(name)), header, nil, &out)
+	if errors.Is(err, errNotFound) {
+		body := map[string]any{"name": name, "description": repo.Description, "private": repo.Private}
+		err = doJSON(ctx, g.Client, http.MethodPost, fmt.Sprintf("%s/orgs/%s/repos", base, url.PathEscape(g.Org)), header, body, &out)
+	}
+	if err != nil {
+		return "", fmt.Errorf("github: %s/%s: %w", g.Org, name, err)
+	}
+	return out.CloneURL, nil
+}
+
+// GitLab creates projects in a group. Nested paths are flattened, so
+// "team/app.git" becomes "team-app".
+type GitLab struct {
+	// Group is the full path of the group, e.g. "acme/platform".
+	Group string
+	Token string
+	// BaseURL of the instance; defaults to "https://gitlab.com".
+	BaseURL string
+	Client  *http.Client
+}
+
+type gitlabProject struct {
+	HTTPURLToRepo string `json:"http_url_to_repo"`
+}
+
+// Name implements Target.
+func (g GitLab) Name() string { return "gitlab:" + g.Group }
+
+// AuthHeader implements Target.
+func (g GitLab) AuthHeader() string { return basicAuth("oauth2", g.Token) }
+
+// Prepare implements Target.
+func (g GitLab) Prepare(ctx context.Context, repo Repo) (string, error) {
+	base := strings.TrimSuffix(g.BaseURL, "/")
+	if base == "" {
+		base = "https://gitlab.com"
+	}
+	group := strings.Trim(g.Group, "/")
+	header := http.Header{"PRIVATE-TOKEN": {g.Token}}
+	name := flatName(repo.Path)
+	var out gitlabProject
+	err := doJSON(ctx, g.Client, http.MethodGet, base+"/api/v4/projects/"+url.PathEscape(group+"/"+name), header, nil, &out)
+	if errors.Is(err, errNotFound) {
+		var ns struct {
+			ID int `json:"id"`
+		}
+		if err := doJSON(ctx, g.Client, http.MethodGet, base+"/api/v4/groups/"+url.PathEscape(group), header, nil, &ns); err != nil {
+			return "", fmt.Errorf("gitlab: group %s: %w", group, err)
+		}
+		visibility := "public"
+		if repo.Private {
+			visibility = "private"
+		}
+		body := map[string]any{"name": name, "path": name, "namespace_id": ns.ID, "description": repo.Description, "visibility": visibility}
+		err = doJSON(ctx, g.Client, http.MethodPost, base+"/api/v4/projects", header, body, &out)
+	}
+	if err != nil {
+		return "", fmt.Errorf("gitlab: %s/%s: %w", group, name, err)
+	}
+	return out.HTTPURLToRepo, nil
+}
+
+// Repocraft pushes to another Repocraft server under the same paths. The
+// repositories must already exist there, e.g. provisioned from the
+// manifest an export with metadata produces.
+type Repocraft struct {
+	// BaseURL is the server's smart HTTP or SSH URL, e.g.
+	// "https://git.example.com" or "ssh://git@git.example.com:2222".
+	// Private repositories only accept pushes over SSH.
+	BaseURL string
+}
+
+// Name implements Target.
+func (r Repocraft) Name() string { return "repocraft:" + r.BaseURL }
+
+// AuthHeader implements Target.
+func (r Repocraft) AuthHeader() string { return "" }
+
+// Prepare implements Target.
+func (r Repocraft) Prepare(ctx context.Context, repo Repo) (string, error) {
+	return strings.TrimSuffix(r.BaseURL, "/") + "/" + repo.Path, nil
+}
+
+// flatName turns a repository path into a single path segment.
+func flatName(rel string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(rel, ".git"), "/", "-")
+}
+
+func doJSON(ctx context.Context, client *http.Client, method, u string, header http.Header, in, out any) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode/100 != 2:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func basicAuth(user, password string) string {
+	if password == "" {
+		return ""
+	}
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// ParseTarget returns the target named by kind, "github", "gitlab" or
+// "repocraft". owner is the organization or group and is ignored for
+// Repocraft, which needs baseURL instead.
+func ParseTarget(kind, owner, token, baseURL string) (Target, error) {
+	switch strings.ToLower(kind) {
+	case "github", "gitlab":
+		if owner == "" {
+			return nil, fmt.Errorf("missing organization or group")
+		}
+		if token == "" {
+			return nil, fmt.Errorf("missing token")
+		}
+		if strings.ToLower(kind) == "github" {
+			return GitHub{Org: owner, Token: token, BaseURL: baseURL}, nil
+		}
+		return GitLab{Group: owner, Token: token, BaseURL: baseURL}, nil
+	case "repocraft":
+		if baseURL == "" {
+			return nil, fmt.Errorf("missing base URL")
+		}
+		return Repocraft{BaseURL: baseURL}, nil
+	default:
+		return nil, fmt.Errorf("unknown target %q", kind)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build faultinjection
+
+package faults
+
+const built = true
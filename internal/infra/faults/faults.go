@@ -0,0 +1,219 @@
+// Package faults injects transport faults into git's output, so resilience
+// features such as resumable fetches and client retries can be exercised
+// automatically. Faults are only available in builds with the
+// faultinjection tag; other builds refuse to configure them, so the hooks
+// pass output through untouched.
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault kinds.
+const (
+	// Drop cuts the connection at the fault's byte, without the end a
+	// client expects.
+	Drop = "drop"
+	// Corrupt flips the bits of the fault's byte.
+	Corrupt = "corrupt"
+	// Kill kills the git process once its output reaches the fault's byte.
+	Kill = "kill"
+	// Delay sleeps before every write of the stream.
+	Delay = "delay"
+)
+
+// ErrDropped is returned by a stream's writes once it was dropped.
+// Transports close the connection on it instead of ending the response.
+var ErrDropped = errors.New("connection dropped by fault injection")
+
+// Config sets the chance of each fault per git process.
+type Config struct {
+	Drop    float64
+	Corrupt float64
+	Kill    float64
+	Delay   float64
+	// DelayBy is how long delayed writes sleep; defaults to 100ms.
+	DelayBy time.Duration
+	// Offset bounds the byte a drop, corruption or kill happens at, drawn
+	// from [0, Offset); defaults to 64 KiB. Shorter output escapes them.
+	Offset int64
+	// Seed makes the faults drawn reproducible.
+	Seed int64
+}
+
+// Parse reads a spec such as
+// "drop=0.05,corrupt=0.01,kill=0.02,delay=0.1:250ms,offset=1048576,seed=7".
+func Parse(spec string) (Config, error) {
+	cfg := Config{DelayBy: 100 * time.Millisecond, Offset: 64 << 10}
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		var err error
+		switch name {
+		case Drop:
+			cfg.Drop, err = chance(value)
+		case Corrupt:
+			cfg.Corrupt, err = chance(value)
+		case Kill:
+			cfg.Kill, err = chance(value)
+		case Delay:
+			p, d, ok := strings.Cut(value, ":")
+			if cfg.Delay, err = chance(p); err == nil && ok {
+				if cfg.DelayBy, err = time.ParseDuration(d); err == nil && cfg.DelayBy <= 0 {
+					err = errors.New("delay must be positive")
+				}
+			}
+		case "offset":
+			if cfg.Offset, err = strconv.ParseInt(value, 10, 64); err == nil && cfg.Offset <= 0 {
+				err = errors.New("offset must be positive")
+			}
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return Config{}, fmt.Errorf("unknown fault %q", name)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if cfg.Drop+cfg.Corrupt+cfg.Kill > 1 {
+		return Config{}, errors.New("drop, corrupt and kill chances add up to more than 1")
+	}
+	return cfg, nil
+}
+
+func chance(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("chance %q must be between 0 and 1", s)
+	}
+	return p, nil
+}
+
+var (
+	mu     sync.Mutex
+	active *Config
+	rng    *rand.Rand
+)
+
+// Configure turns on the faults of spec, or turns them off if spec is
+// empty. Builds without the faultinjection tag only accept an empty spec.
+func Configure(spec string) error {
+	if spec == "" {
+		mu.Lock()
+		active = nil
+		mu.Unlock()
+		return nil
+	}
+	if !built {
+		return errors.New("fault injection needs a build with -tags faultinjection")
+	}
+	cfg, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	active, rng = &cfg, rand.New(rand.NewSource(cfg.Seed))
+	mu.Unlock()
+	log.Printf("faults: injecting %s", spec)
+	return nil
+}
+
+// Enabled reports whether faults are configured.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return active != nil
+}
+
+// Stream draws the faults of one git process's output to w. kill stops the
+// process. Without faults, w is returned as is.
+func Stream(w io.Writer, name string, kill func()) io.Writer {
+	mu.Lock()
+	defer mu.Unlock()
+	if active == nil {
+		return w
+	}
+	s := &stream{w: w, name: name, kill: kill}
+	switch p := rng.Float64(); {
+	case p < active.Drop:
+		s.kind = Drop
+	case p < active.Drop+active.Corrupt:
+		s.kind = Corrupt
+	case p < active.Drop+active.Corrupt+active.Kill:
+		s.kind = Kill
+	}
+	if s.kind != "" {
+		s.at = rng.Int63n(active.Offset)
+	}
+	if rng.Float64() < active.Delay {
+		s.delay = active.DelayBy
+	}
+	if s.kind == "" && s.delay == 0 {
+		return w
+	}
+	return s
+}
+
+// stream applies one fault, at byte at, and delays.
+type stream struct {
+	w     io.Writer
+	name  string
+	kind  string
+	at    int64
+	delay time.Duration
+	kill  func()
+	n     int64
+	fired bool
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	if s.delay > 0 {
+		time.Sleep(s.delay)
+	}
+	if s.kind == "" || s.fired || s.n+int64(len(p)) <= s.at {
+		n, err := s.w.Write(p)
+		s.n += int64(n)
+		return n, err
+	}
+	s.fired = true
+	i := s.at - s.n
+	log.Printf("faults: %s of %s at byte %d", s.kind, s.name, s.at)
+	switch s.kind {
+	case Drop:
+		n, err := s.w.Write(p[:i])
+		s.n += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, ErrDropped
+	case Corrupt:
+		q := append([]byte(nil), p...)
+		q[i] ^= 0xff
+		n, err := s.w.Write(q)
+		s.n += int64(n)
+		return n, err
+	default:
+		s.kill()
+		n, err := s.w.Write(p)
+		s.n += int64(n)
+		return n, err
+	}
+}
+
+// Dropped reports whether w, returned by Stream, was dropped. Process
+// errors hide ErrDropped, so callers check once the process is done.
+func Dropped(w io.Writer) bool {
+	s, ok := w.(*stream)
+	return ok && s.kind == Drop && s.fired
+}
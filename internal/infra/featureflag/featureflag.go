@@ -0,0 +1,220 @@
+// Package featureflag gates risky features so they can be turned on for a
+// part of the traffic first and switched off again without a restart.
+// Flags are read from a JSON file that is re-read whenever it changes:
+//
+//	{"flags": {
+//	  "bundle-uri": {"enabled": false, "percent": 10,
+//	    "repos": {"team/*": true, "team/huge.git": false},
+//	    "identities": {"SHA256:abc...": true}}
+//	}}
+//
+// A flag the file doesn't mention keeps its default from Defaults.
+package featureflag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repomatch"
+)
+
+// Flag names.
+const (
+	// BundleURI offers clone bundles to protocol v2 clients through the
+	// bundle-uri command.
+	BundleURI = "bundle-uri"
+	// ProtocolV2 honours requests for protocol version 2. Where it is off,
+	// clients asking for version 2 are served version 0.
+	ProtocolV2 = "protocol-v2"
+	// DryRunPushes honours the dry-run push option.
+	DryRunPushes = "dry-run-pushes"
+	// SparseHints tells full clones of repositories with sparse profiles
+	// about them.
+	SparseHints = "sparse-hints"
+)
+
+// Defaults are the states of the known flags when the file doesn't
+// mention them. Every flag starts out enabled, so features behave as
+// configured until a flag narrows them.
+var Defaults = map[string]bool{
+	BundleURI:    true,
+	ProtocolV2:   true,
+	DryRunPushes: true,
+	SparseHints:  true,
+}
+
+// Flag is the rollout state of one feature. For a request, the first of
+// these that applies decides: an entry in Identities, the longest pattern
+// in Repos matching the repository, Enabled, and finally Percent.
+type Flag struct {
+	Enabled bool `json:"enabled"`
+	// Repos maps path.Match patterns such as "team/*" or exact paths such
+	// as "team/app.git" to the flag's state for matching repositories.
+	Repos map[string]bool `json:"repos,omitempty"`
+	// Identities maps SSH key fingerprints or client addresses to the
+	// flag's state for their requests.
+	Identities map[string]bool `json:"identities,omitempty"`
+	// Percent turns a disabled flag on for that share of identities. Each
+	// identity stays on the same side as long as Percent doesn't shrink.
+	Percent float64 `json:"percent,omitempty"`
+}
+
+type file struct {
+	Flags map[string]Flag `json:"flags"`
+}
+
+// Set holds the current flags. A nil Set, or one without Path, reports
+// every flag at its default.
+type Set struct {
+	// Path of the JSON flag file.
+	Path string
+	// Interval between checks of the file for changes; defaults to five
+	// seconds.
+	Interval time.Duration
+
+	mu      sync.RWMutex
+	flags   map[string]Flag
+	modTime time.Time
+	err     error
+}
+
+// Load reads the flag file. On error the previous flags stay in effect.
+func (s *Set) Load() error {
+	fi, err := os.Stat(s.Path)
+	if err == nil {
+		var flags map[string]Flag
+		if flags, err = parse(s.Path); err == nil {
+			s.mu.Lock()
+			s.flags, s.modTime = flags, fi.ModTime()
+			s.mu.Unlock()
+		}
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	return err
+}
+
+func parse(name string) (map[string]Flag, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read feature flags: %w", err)
+	}
+	var f file
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("parse feature flags %s: %w", name, err)
+	}
+	for flagName, flag := range f.Flags {
+		if _, ok := Defaults[flagName]; !ok {
+			return nil, fmt.Errorf("feature flags %s: unknown flag %q", name, flagName)
+		}
+		if flag.Percent < 0 || flag.Percent > 100 {
+			return nil, fmt.Errorf("feature flags %s: %s: percent must be between 0 and 100", name, flagName)
+		}
+		for pattern := range flag.Repos {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("feature flags %s: %s: invalid pattern %q", name, flagName, pattern)
+			}
+		}
+	}
+	return f.Flags, nil
+}
+
+// Run re-reads the file every Interval when it changed, until ctx is
+// cancelled.
+func (s *Set) Run(ctx context.Context) {
+	if s == nil || s.Path == "" {
+		return
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(s.Path)
+		s.mu.RLock()
+		changed := err != nil || !fi.ModTime().Equal(s.modTime)
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := s.Load(); err != nil {
+			log.Printf("%v; keeping the previous flags", err)
+			continue
+		}
+		log.Printf("feature flags: reloaded %s", s.Path)
+	}
+}
+
+// Err returns the error of the last load, if it failed.
+func (s *Set) Err() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// Enabled reports whether the named flag is on for a request by identity
+// for repo, a path such as "team/app.git".
+func (s *Set) Enabled(name, repo, identity string) bool {
+	if s == nil {
+		return Defaults[name]
+	}
+	s.mu.RLock()
+	f, ok := s.flags[name]
+	s.mu.RUnlock()
+	if !ok {
+		return Defaults[name]
+	}
+	if on, ok := f.Identities[identity]; ok && identity != "" {
+		return on
+	}
+	if on, ok := repomatch.Best(f.Repos, repo); ok {
+		return on
+	}
+	if f.Enabled {
+		return true
+	}
+	if f.Percent <= 0 || identity == "" {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "\x00" + identity))
+	return float64(h.Sum32()%10000) < f.Percent*100
+}
+
+// Flags returns the state of every known flag, defaults included.
+func (s *Set) Flags() map[string]Flag {
+	flags := make(map[string]Flag, len(Defaults))
+	for name, on := range Defaults {
+		flags[name] = Flag{Enabled: on}
+	}
+	if s == nil {
+		return flags
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for name, f := range s.flags {
+		flags[name] = f
+	}
+	return flags
+}
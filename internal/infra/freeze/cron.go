@@ -0,0 +1,145 @@
+package freeze
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron is a parsed cron expression, "minute hour day-of-month month
+// day-of-week", with each field a set of allowed values.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, a day matches either restricted day field when both are.
+	anyDay bool
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron parses a five-field cron expression. Fields are "*", numbers,
+// ranges such as "1-5" and steps such as "*/15", separated by commas. Day
+// of week 0 and 7 are both Sunday.
+func parseCron(expr string) (*cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: want minute, hour, day of month, month and day of week", expr)
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronRanges[i][0], cronRanges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	c := &cron{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4]}
+	if c.dow&(1<<7) != 0 {
+		c.dow = c.dow&^(1<<7) | 1
+	}
+	c.anyDay = !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if span != "*" {
+			first, last, isRange := strings.Cut(span, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(first)
+			hi, err2 = lo, nil
+			if isRange {
+				hi, err2 = strconv.Atoi(last)
+			} else if stepped {
+				hi = max
+			}
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid field %q", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cron) matchDay(t time.Time) bool {
+	if c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.anyDay {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// prev returns the latest minute at or before t the expression matches,
+// unless it is before limit. Times are matched in t's location.
+func (c *cron) prev(t, limit time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	for !t.Before(limit) {
+		y, m, d := t.Date()
+		var earlier time.Time
+		switch {
+		case !c.matchDay(t):
+			earlier = time.Date(y, m, d, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case c.hour&(1<<t.Hour()) == 0:
+			earlier = time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+		case c.minute&(1<<t.Minute()) == 0:
+			earlier = t.Add(-time.Minute)
+		default:
+			return t, true
+		}
+		// Around daylight saving changes, wall clock times can be
+		// ambiguous; keep moving.
+		if !earlier.Before(t) {
+			earlier = t.Add(-time.Minute)
+		}
+		t = earlier
+	}
+	return time.Time{}, false
+}
+
+// next returns the earliest minute at or after t the expression matches,
+// if it is before limit.
+func (c *cron) next(t, limit time.Time) (time.Time, bool) {
+	if r := t.Truncate(time.Minute); !r.Equal(t) {
+		t = r.Add(time.Minute)
+	}
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		var later time.Time
+		switch {
+		case !c.matchDay(t):
+			later = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			later = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			later = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+		if !later.After(t) {
+			later = t.Add(time.Minute)
+		}
+		t = later
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,510 @@
+// Package freeze refuses pushes to selected branches during freeze windows,
+// such as deployment freezes over weekends or holidays. Windows are read
+// from a JSON file that is re-read whenever it changes:
+//
+//	{"windows": {
+//	  "weekend": {"schedule": "0 18 * * 5", "duration": "60h", "timezone": "Europe/Berlin",
+//	    "repos": ["team/*"], "refs": ["refs/heads/main"], "reason": "weekend deploy freeze"},
+//	  "holidays": {"start": "2026-12-22T00:00:00Z", "end": "2027-01-04T00:00:00Z",
+//	    "reason": "year-end freeze"}
+//	}}
+//
+// In an emergency, admins lift a window with an override until a given
+// time. Overrides are kept in a second file next to the first, written by
+// the HTTP daemon and re-read by the others, see OverridesPath.
+package freeze
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+const (
+	// maxDuration bounds recurring windows, so finding the current one
+	// stays cheap.
+	maxDuration = 31 * 24 * time.Hour
+	// lookahead bounds the search for the next start of a recurring window.
+	lookahead = 366 * 24 * time.Hour
+)
+
+// ErrWindowNotFound is returned for overrides of windows that don't exist.
+var ErrWindowNotFound = errcode.New(errcode.NotFound, "freeze window not found")
+
+// Window is a period, one-off or recurring, during which pushes to some
+// branches are refused.
+type Window struct {
+	// Schedule is a cron expression, "minute hour day-of-month month
+	// day-of-week", of when a recurring window starts, e.g. "0 18 * * 5"
+	// for Fridays at 18:00.
+	Schedule string `json:"schedule,omitempty"`
+	// Duration of a recurring window, e.g. "60h"; at most 31 days.
+	Duration string `json:"duration,omitempty"`
+	// Timezone the schedule is in, e.g. "Europe/Berlin"; defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+	// Start and End bound a one-off window instead of a schedule.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+	// Repos are path.Match patterns such as "team/*" of the repositories
+	// frozen; every repository when empty.
+	Repos []string `json:"repos,omitempty"`
+	// Refs are patterns such as "refs/heads/release/*" of the refs frozen,
+	// with * also matching slashes; every branch when empty.
+	Refs []string `json:"refs,omitempty"`
+	// Reason is shown to clients whose push is refused.
+	Reason string `json:"reason"`
+
+	cron     *cron
+	duration time.Duration
+	loc      *time.Location
+}
+
+// current returns the start and end of the occurrence of w in effect at
+// now, if any.
+func (w *Window) current(now time.Time) (time.Time, time.Time, bool) {
+	if w.cron == nil {
+		if now.Before(*w.Start) || !now.Before(*w.End) {
+			return time.Time{}, time.Time{}, false
+		}
+		return *w.Start, *w.End, true
+	}
+	start, ok := w.cron.prev(now.In(w.loc), now.Add(-w.duration))
+	if !ok || !start.Add(w.duration).After(now) {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, start.Add(w.duration), true
+}
+
+// upcoming returns the next start of w after now, if there is one within
+// a year.
+func (w *Window) upcoming(now time.Time) (time.Time, bool) {
+	if w.cron == nil {
+		return *w.Start, now.Before(*w.Start)
+	}
+	return w.cron.next(now.Add(time.Minute).In(w.loc), now.Add(lookahead))
+}
+
+func (w *Window) appliesTo(repo string) bool {
+	if len(w.Repos) == 0 {
+		return true
+	}
+	repo = strings.Trim(repo, "/")
+	for _, pattern := range w.Repos {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Window) refs() []string {
+	if len(w.Refs) == 0 {
+		return []string{"refs/heads/*"}
+	}
+	return w.Refs
+}
+
+// Override lifts a window until a given time.
+type Override struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+	// Created is when the override was made.
+	Created time.Time `json:"created"`
+}
+
+type file struct {
+	Windows map[string]*Window `json:"windows"`
+}
+
+type overridesFile struct {
+	Overrides map[string]Override `json:"overrides"`
+}
+
+var windowName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Schedule holds the freeze windows and their overrides. A nil Schedule,
+// or one without Path, freezes nothing.
+type Schedule struct {
+	// Path of the JSON window file.
+	Path string
+	// OverridesPath is the JSON file of overrides; defaults to Path with
+	// "-overrides" before the extension, e.g. "freeze-overrides.json".
+	OverridesPath string
+	// Interval between checks of the files for changes; defaults to five
+	// seconds.
+	Interval time.Duration
+
+	mu                sync.RWMutex
+	windows           map[string]*Window
+	overrides         map[string]Override
+	modTime, ovrMTime time.Time
+	err               error
+}
+
+// Load reads the window and override files. A missing override file is
+// not an error. On error the previous windows stay in effect.
+func (s *Schedule) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = s.loadLocked()
+	return s.err
+}
+
+func (s *Schedule) loadLocked() error {
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return fmt.Errorf("read freeze windows: %w", err)
+	}
+	windows, err := parse(s.Path)
+	if err != nil {
+		return err
+	}
+	overrides, ovrMTime, err := s.readOverrides()
+	if err != nil {
+		return err
+	}
+	s.windows, s.overrides = windows, overrides
+	s.modTime, s.ovrMTime = fi.ModTime(), ovrMTime
+	return nil
+}
+
+func parse(name string) (map[string]*Window, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read freeze windows: %w", err)
+	}
+	var f file
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("parse freeze windows %s: %w", name, err)
+	}
+	for key, w := range f.Windows {
+		if err := w.init(key); err != nil {
+			return nil, fmt.Errorf("freeze windows %s: %s: %w", name, key, err)
+		}
+	}
+	return f.Windows, nil
+}
+
+func (w *Window) init(name string) error {
+	if !windowName.MatchString(name) {
+		return errors.New("invalid name")
+	}
+	if w == nil {
+		return errors.New("empty window")
+	}
+	switch {
+	case w.Schedule != "" && (w.Start != nil || w.End != nil):
+		return errors.New("either schedule or start and end")
+	case w.Schedule != "":
+		c, err := parseCron(w.Schedule)
+		if err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(w.Duration)
+		if err != nil || d <= 0 || d > maxDuration {
+			return fmt.Errorf("invalid duration %q", w.Duration)
+		}
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return err
+		}
+		w.cron, w.duration, w.loc = c, d, loc
+	case w.Start != nil && w.End != nil:
+		if !w.Start.Before(*w.End) {
+			return errors.New("start is not before end")
+		}
+		if w.Duration != "" || w.Timezone != "" {
+			return errors.New("duration and timezone need a schedule")
+		}
+	default:
+		return errors.New("missing schedule, or start and end")
+	}
+	for _, pattern := range w.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	for _, ref := range w.Refs {
+		if !strings.HasPrefix(ref, "refs/") || strings.ContainsAny(ref, " \t\n") {
+			return fmt.Errorf("invalid ref pattern %q", ref)
+		}
+	}
+	if strings.ContainsAny(w.Reason, "\r\n") {
+		return errors.New("reason spans lines")
+	}
+	return nil
+}
+
+func (s *Schedule) overridesPath() string {
+	if s.OverridesPath != "" {
+		return s.OverridesPath
+	}
+	ext := filepath.Ext(s.Path)
+	return strings.TrimSuffix(s.Path, ext) + "-overrides" + ext
+}
+
+func (s *Schedule) readOverrides() (map[string]Override, time.Time, error) {
+	name := s.overridesPath()
+	fi, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]Override{}, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("read freeze overrides: %w", err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("read freeze overrides: %w", err)
+	}
+	var f overridesFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, time.Time{}, fmt.Errorf("parse freeze overrides %s: %w", name, err)
+	}
+	if f.Overrides == nil {
+		f.Overrides = map[string]Override{}
+	}
+	return f.Overrides, fi.ModTime(), nil
+}
+
+// Run re-reads the files every Interval when they changed, until ctx is
+// cancelled.
+func (s *Schedule) Run(ctx context.Context) {
+	if s == nil || s.Path == "" {
+		return
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(s.Path)
+		ofi, oerr := os.Stat(s.overridesPath())
+		s.mu.RLock()
+		changed := err != nil || !fi.ModTime().Equal(s.modTime) ||
+			(oerr == nil && !ofi.ModTime().Equal(s.ovrMTime)) ||
+			(oerr != nil && !s.ovrMTime.IsZero())
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := s.Load(); err != nil {
+			log.Printf("%v; keeping the previous freeze windows", err)
+			continue
+		}
+		log.Printf("freeze windows: reloaded %s", s.Path)
+	}
+}
+
+// Err returns the error of the last load, if it failed.
+func (s *Schedule) Err() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// Freeze is a window in effect for a repository.
+type Freeze struct {
+	Name   string
+	Reason string
+	// Refs are the patterns of the refs frozen.
+	Refs []string
+	// Until is when the window ends, in the window's time zone.
+	Until time.Time
+}
+
+// Covers reports whether ref is frozen. As in the hook refusing pushes,
+// * in the patterns also matches slashes.
+func (f Freeze) Covers(ref string) bool {
+	// path.Match treats only slashes specially, so without them * matches
+	// anything.
+	unslash := func(s string) string { return strings.ReplaceAll(s, "/", "\x00") }
+	for _, pattern := range f.Refs {
+		if ok, _ := path.Match(unslash(pattern), unslash(ref)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Frozen returns the windows in effect for repo, a path such as
+// "team/app.git", at now, leaving out overridden ones.
+func (s *Schedule) Frozen(repo string, now time.Time) []Freeze {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var freezes []Freeze
+	for name, w := range s.windows {
+		if !w.appliesTo(repo) {
+			continue
+		}
+		if o, ok := s.overrides[name]; ok && now.Before(o.Until) {
+			continue
+		}
+		if _, end, ok := w.current(now); ok {
+			freezes = append(freezes, Freeze{Name: name, Reason: w.Reason, Refs: w.refs(), Until: end})
+		}
+	}
+	sort.Slice(freezes, func(i, j int) bool { return freezes[i].Name < freezes[j].Name })
+	return freezes
+}
+
+// Status is a window as admins see it.
+type Status struct {
+	Name string `json:"name"`
+	*Window
+	// Active is whether the window is open; Ends is when it closes.
+	Active bool       `json:"active"`
+	Ends   *time.Time `json:"ends,omitempty"`
+	// Opens is the next start of the window.
+	Opens *time.Time `json:"opens,omitempty"`
+	// Override, if set, lifts the window until its Until.
+	Override *Override `json:"override,omitempty"`
+	// Frozen is whether pushes are refused now: the window is active and
+	// not overridden.
+	Frozen bool `json:"frozen"`
+}
+
+// Status returns every window's state at now, by name.
+func (s *Schedule) Status(now time.Time) []Status {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := make([]Status, 0, len(s.windows))
+	for name := range s.windows {
+		statuses = append(statuses, s.statusLocked(name, now))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (s *Schedule) statusLocked(name string, now time.Time) Status {
+	w := s.windows[name]
+	st := Status{Name: name, Window: w}
+	if _, end, ok := w.current(now); ok {
+		st.Active, st.Ends = true, &end
+	}
+	if opens, ok := w.upcoming(now); ok {
+		st.Opens = &opens
+	}
+	if o, ok := s.overrides[name]; ok && now.Before(o.Until) {
+		st.Override = &o
+	}
+	st.Frozen = st.Active && st.Override == nil
+	return st
+}
+
+// SetOverride lifts the named window until until, or until the end of its
+// current occurrence if until is zero, and saves the override.
+func (s *Schedule) SetOverride(name string, until time.Time, reason string, now time.Time) (Status, error) {
+	if s == nil {
+		return Status{}, ErrWindowNotFound
+	}
+	if strings.TrimSpace(reason) == "" || strings.ContainsAny(reason, "\r\n") {
+		return Status{}, errcode.New(errcode.InvalidRequest, "an override needs a one-line reason")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.windows[name]
+	if !ok {
+		return Status{}, ErrWindowNotFound
+	}
+	if until.IsZero() {
+		_, end, active := w.current(now)
+		if !active {
+			return Status{}, errcode.New(errcode.InvalidRequest, "window is not active; give the time the override lasts until")
+		}
+		until = end
+	}
+	if !until.After(now) {
+		return Status{}, errcode.New(errcode.InvalidRequest, "until is in the past")
+	}
+	overrides := s.activeOverridesLocked(now)
+	overrides[name] = Override{Until: until.UTC().Truncate(time.Second), Reason: reason, Created: now.UTC().Truncate(time.Second)}
+	if err := s.saveLocked(overrides); err != nil {
+		return Status{}, err
+	}
+	return s.statusLocked(name, now), nil
+}
+
+// ClearOverride removes the override of the named window, so it is in
+// force again.
+func (s *Schedule) ClearOverride(name string, now time.Time) (Status, error) {
+	if s == nil {
+		return Status{}, ErrWindowNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.windows[name]; !ok {
+		return Status{}, ErrWindowNotFound
+	}
+	overrides := s.activeOverridesLocked(now)
+	delete(overrides, name)
+	if err := s.saveLocked(overrides); err != nil {
+		return Status{}, err
+	}
+	return s.statusLocked(name, now), nil
+}
+
+// activeOverridesLocked returns a copy of the overrides that haven't run
+// out, of windows that still exist.
+func (s *Schedule) activeOverridesLocked(now time.Time) map[string]Override {
+	overrides := make(map[string]Override, len(s.overrides)+1)
+	for name, o := range s.overrides {
+		if _, ok := s.windows[name]; ok && now.Before(o.Until) {
+			overrides[name] = o
+		}
+	}
+	return overrides
+}
+
+// saveLocked writes overrides to the override file and makes them current.
+func (s *Schedule) saveLocked(overrides map[string]Override) error {
+	name := s.overridesPath()
+	data, err := json.MarshalIndent(overridesFile{Overrides: overrides}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("save freeze overrides: %w", err)
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("save freeze overrides: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("save freeze overrides: %w", err)
+	}
+	s.overrides = overrides
+	if fi, err := os.Stat(name); err == nil {
+		s.ovrMTime = fi.ModTime()
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package httpsmart
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Authenticator identifies the client of a request for repo, a repository
+// path without the leading slash, using svc. It returns the client's
+// identity, or "" to serve the request anonymously, identified by its
+// address. An errcode.Unauthenticated error asks git for credentials; other
+// errors refuse the request with their code.
+type Authenticator func(r *http.Request, repo string, svc service.Service) (string, error)
+
+type identityKey struct{}
+
+// authenticate runs Auth, if set, and returns r carrying the identity it
+// returned. Pushes presenting the secret of a device code are identified
+// as the user who approved it instead. It writes the error response and
+// returns false when the request must not proceed.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, repoPath string, svc service.Service) (*http.Request, bool) {
+	if secret, ok := deviceCredentials(r); ok && svc == service.ServiceReceivePack {
+		return s.authenticateDevice(w, r, repoPath, secret)
+	}
+	if s.Auth == nil {
+		return r, true
+	}
+	id, err := s.Auth(r, strings.TrimPrefix(repoPath, "/"), svc)
+	if err != nil {
+		switch errcode.CodeOf(err) {
+		case errcode.Internal:
+			s.logger().Error("authenticate", "repo", strings.TrimPrefix(repoPath, "/"), "remote_addr", r.RemoteAddr, "error", err)
+		case errcode.Unauthenticated:
+			// Requests without credentials are only git's first attempt.
+			if r.Header.Get("Authorization") != "" {
+				s.Abuse.ObserveAuthFailure(remoteHost(r), time.Now())
+				s.Metrics.AuthFailure("bad_credentials")
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="repocraft"`)
+		case errcode.AccessDenied:
+			s.Metrics.AuthFailure("denied")
+		}
+		writeError(w, r, err)
+		return r, false
+	}
+	if id == "" {
+		return r, true
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id)), true
+}
+
+// identity returns the identity Auth gave the client of r, or its address.
+func identity(r *http.Request) string {
+	if id, ok := r.Context().Value(identityKey{}).(string); ok {
+		return id
+	}
+	return remoteHost(r)
+}
+
+// identified reports whether Auth identified the client of r.
+func identified(r *http.Request) bool {
+	_, ok := r.Context().Value(identityKey{}).(string)
+	return ok
+}
+
+// user returns who Auth identified the client of r as, or "".
+func user(r *http.Request) string {
+	id, _ := r.Context().Value(identityKey{}).(string)
+	return id
+}
+
+// recordCredentials records the use of the credentials r carries for svc.
+// Fetch tokens only count for reads, the only requests they are checked
+// for.
+func (s *Server) recordCredentials(r *http.Request, repoPath string, svc service.Service) {
+	if s.Credentials == nil {
+		return
+	}
+	op := "fetch"
+	switch svc {
+	case service.ServiceReceivePack:
+		op = "push"
+	case service.ServiceUploadArchive:
+		op = "archive"
+	}
+	use := credusage.Use{Op: op, Repo: strings.TrimPrefix(repoPath, "/"), Source: remoteHost(r)}
+	now := time.Now()
+	if id, ok := r.Context().Value(identityKey{}).(string); ok {
+		use.Kind, use.ID, use.Owner = credusage.KindHTTPUser, id, id
+		s.Credentials.Record(use, now)
+	}
+	if token := fetchToken(r); token != "" && s.FetchTokens != nil && svc.IsRead() {
+		use.Kind, use.ID, use.Owner = credusage.KindFetchToken, credusage.TokenID(token), ""
+		s.Credentials.Record(use, now)
+	}
+}
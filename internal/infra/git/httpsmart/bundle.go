@@ -0,0 +1,140 @@
+package httpsmart
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/bundles"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// bundleSuffix is the URL of a repository's clone bundle, relative to the
+// repository URL.
+const bundleSuffix = "/clone.bundle"
+
+var errNoBundle = errcode.New(errcode.NotFound, "repository has no clone bundle")
+
+// handleBundle serves the pre-generated clone bundle of a repository.
+// http.ServeContent answers Range and If-Range requests, so interrupted
+// downloads can resume.
+func (s *Server) handleBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	repoPath, err := s.repoPathFromURL(strings.TrimSuffix(r.URL.Path, bundleSuffix))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if target, ok := s.movedTo(repoPath); ok {
+		u := *r.URL
+		u.Path = target + bundleSuffix
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	r, ok := s.authenticate(w, r, repoPath, service.ServiceUploadPack)
+	if !ok {
+		return
+	}
+	if !s.checkAccess(w, r, repoPath, service.ServiceUploadPack) {
+		return
+	}
+	// Bundles hold whole trees.
+	if s.PathScopes.Restricts(strings.TrimPrefix(repoPath, "/"), identity(r)) {
+		writeError(w, r, service.ErrPathScope)
+		return
+	}
+	repoFull, err := s.repoDir(repoPath)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	path, info, ok := bundles.Lookup(repoFull)
+	if !ok {
+		writeError(w, r, errNoBundle)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, r, errNoBundle)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	http.ServeContent(w, r, "clone.bundle", info.ModTime(), f)
+}
+
+// hasBundle reports whether repoPath has a clone bundle to advertise.
+func (s *Server) hasBundle(repoPath string) bool {
+	if !s.CloneBundles {
+		return false
+	}
+	repoFull, err := s.repoDir(repoPath)
+	if err != nil {
+		return false
+	}
+	_, _, ok := bundles.Lookup(repoFull)
+	return ok
+}
+
+// interceptBundleURI answers the protocol v2 bundle-uri command, which the
+// git versions this server supports don't implement in upload-pack. It
+// returns the request body to pass on when the request is another command.
+func (s *Server) interceptBundleURI(w http.ResponseWriter, r *http.Request, repoPath string, body io.Reader) (io.Reader, bool) {
+	br := bufio.NewReader(body)
+	const command = "command=bundle-uri\n"
+	head, err := br.Peek(4 + len(command))
+	if err != nil || string(head[4:]) != command {
+		return br, false
+	}
+	if n, err := strconv.ParseUint(string(head[:4]), 16, 16); err != nil || int(n) != len(head) {
+		return br, false
+	}
+	// The command takes no arguments; drain the request up to its flush.
+	pr := pktline.NewReader(br)
+	for {
+		pkt, err := pr.ReadPacket()
+		if err != nil || pkt.Type == pktline.Flush {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	pw := pktline.NewWriter(w)
+	lines := []string{"bundle.version=1", "bundle.mode=all"}
+	if s.hasBundle(repoPath) {
+		lines = append(lines, "bundle.clone.uri="+bundleURL(r, repoPath))
+	}
+	for _, line := range lines {
+		if err := pw.WriteString(line + "\n"); err != nil {
+			return nil, true
+		}
+	}
+	pw.Flush()
+	return nil, true
+}
+
+// bundleURL returns the absolute clone bundle URL, carrying over a fetch
+// token presented by the client.
+func bundleURL(r *http.Request, repoPath string) string {
+	u := url.URL{Scheme: "http", Host: r.Host, Path: repoPath + bundleSuffix}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if token := fetchToken(r); token != "" {
+		u.RawQuery = url.Values{"token": {token}}.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,73 @@
+package httpsmart
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// canonicalURL returns the base URL the repository at repoPath is served
+// at, or nil if it may be served under any name.
+func (s *Server) canonicalURL(repoPath string) *url.URL {
+	if raw := s.Provisioned.CanonicalURL(repoPath); raw != "" {
+		u, err := service.ParseCanonicalURL(raw)
+		if err == nil {
+			return u
+		}
+		s.logger().Error("invalid canonical URL", "repo", strings.TrimPrefix(repoPath, "/"), "error", err)
+	}
+	return s.CanonicalURL
+}
+
+// checkCanonical advertises the canonical clone URL of repoPath in a Link
+// header and makes sure the request arrived under it. Ref advertisements
+// requested under another scheme or host are redirected, which git follows
+// for the rest of the operation; anything else is refused with the URL to
+// use. It returns false when the response has been written.
+func (s *Server) checkCanonical(w http.ResponseWriter, r *http.Request, repoPath string) bool {
+	base := s.canonicalURL(repoPath)
+	if base == nil {
+		return true
+	}
+	clone := *base
+	clone.Path = base.Path + repoPath
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"canonical\"", clone.String()))
+	if requestScheme(r) == base.Scheme && sameHost(r.Host, base.Host, base.Scheme) {
+		return true
+	}
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/info/refs") {
+		target := clone
+		target.Path += "/info/refs"
+		target.RawQuery = r.URL.RawQuery
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return false
+	}
+	writeError(w, r, errcode.Errorf(errcode.WrongHost, "this repository is served at %s; update the remote with: git remote set-url origin %s", clone.String(), clone.String()))
+	return false
+}
+
+// requestScheme returns the scheme the client used, as reported by a
+// trusted proxy (see clientAddr) or else by the connection.
+func requestScheme(r *http.Request) string {
+	switch {
+	case r.URL.Scheme != "":
+		return r.URL.Scheme
+	case r.TLS != nil:
+		return "https"
+	default:
+		return "http"
+	}
+}
+
+// sameHost compares two hosts, ignoring case and the scheme's default port.
+func sameHost(a, b, scheme string) bool {
+	port := ":80"
+	if scheme == "https" {
+		port = ":443"
+	}
+	return strings.EqualFold(strings.TrimSuffix(a, port), strings.TrimSuffix(b, port))
+}
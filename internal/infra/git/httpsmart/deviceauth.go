@@ -0,0 +1,92 @@
+package httpsmart
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// devicePath is the page where users approve device codes.
+const devicePath = "/api/v1/device"
+
+// deviceSecretPrefix starts the URLs that carry the secret of a device
+// code, as in /-/device/<secret>/owner/repo.git. git only sends Basic auth
+// after a 401, which would make it prompt anonymous pushers for
+// credentials, so the secret goes in the path.
+const deviceSecretPrefix = "/-/device/"
+
+type deviceSecretKey struct{}
+
+// stripDeviceSecret removes the device code secret from the path of r,
+// if DeviceAuth is set and the path carries one, and returns r carrying
+// the secret for authenticate.
+func (s *Server) stripDeviceSecret(r *http.Request) *http.Request {
+	if s.DeviceAuth == nil {
+		return r
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, deviceSecretPrefix)
+	if !ok {
+		return r
+	}
+	secret, rest, ok := strings.Cut(rest, "/")
+	if !ok || secret == "" {
+		return r
+	}
+	r = r.WithContext(context.WithValue(r.Context(), deviceSecretKey{}, secret))
+	r.URL.Path = "/" + rest
+	r.URL.RawPath = ""
+	return r
+}
+
+// deviceCredentials reports whether r presented the secret of a device
+// code, and returns the secret.
+func deviceCredentials(r *http.Request) (string, bool) {
+	secret, ok := r.Context().Value(deviceSecretKey{}).(string)
+	return secret, ok
+}
+
+// authenticateDevice identifies a push presenting the secret of a device
+// code as the user who approved the code. It writes the error response and
+// returns false when the code isn't approved.
+func (s *Server) authenticateDevice(w http.ResponseWriter, r *http.Request, repoPath, secret string) (*http.Request, bool) {
+	repo := strings.TrimPrefix(repoPath, "/")
+	now := time.Now()
+	user, ok := s.DeviceAuth.Approved(repo, secret, now)
+	if !ok {
+		s.Abuse.ObserveAuthFailure(remoteHost(r), now)
+		s.Metrics.AuthFailure("bad_credentials")
+		writeError(w, r, errcode.Errorf(errcode.AccessDenied, "the device code of this push to %s is unknown, not approved yet or expired", repo))
+		return r, false
+	}
+	if r.Method == http.MethodPost {
+		s.logger().Info("push approved by device code", "repo", repo, "remote_addr", remoteHost(r), "user", user)
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, user)), true
+}
+
+// startDeviceAuth refuses an anonymous push with a code to approve and the
+// URL to push to once it is, which git shows to the user. The URL carries
+// the code's secret, so only this client can use the approval.
+func (s *Server) startDeviceAuth(w http.ResponseWriter, r *http.Request, repoPath string) {
+	repo := strings.TrimPrefix(repoPath, "/")
+	code, err := s.DeviceAuth.Start(repo, remoteHost(r), time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	base := url.URL{Scheme: requestScheme(r), Host: r.Host}
+	if canonical := s.canonicalURL(repoPath); canonical != nil {
+		base = url.URL{Scheme: canonical.Scheme, Host: canonical.Host, Path: strings.TrimSuffix(canonical.Path, "/")}
+	}
+	approve := base
+	approve.Path += devicePath
+	approve.RawQuery = url.Values{"code": {code.Code}}.Encode()
+	push := base
+	push.Path += deviceSecretPrefix + code.Secret + repoPath
+	writeError(w, r, errcode.Errorf(errcode.AccessDenied, "to push to %s, open %s and approve the code %s, then push to %s within %d minutes",
+		repo, approve.String(), code.Code, push.String(), int(time.Until(code.Expires).Round(time.Minute)/time.Minute)))
+}
@@ -0,0 +1,68 @@
+package httpsmart
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// defaultMaxInflatedBody caps compressed request bodies once decompressed
+// when Server.MaxInflatedBody is zero.
+const defaultMaxInflatedBody = 1 << 30
+
+var errUnsupportedEncoding = &errcode.Error{Code: errcode.InvalidRequest, Message: "unsupported Content-Encoding, want gzip", Status: http.StatusUnsupportedMediaType}
+
+// decodeBody returns body, as sent by the client of r, decompressed:
+// git compresses large fetch negotiations with gzip. Decompressed bodies
+// larger than the server's limit fail with errcode.TooLarge, so a small
+// request can't inflate into gigabytes piped to git.
+func (s *Server) decodeBody(r *http.Request, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, errcode.Errorf(errcode.InvalidRequest, "invalid gzip body: %v", err)
+	}
+	max := s.MaxInflatedBody
+	if max <= 0 {
+		max = defaultMaxInflatedBody
+	}
+	return &inflatedBody{r: zr, left: max, max: max}, nil
+}
+
+// inflatedBody reads a decompressed body, failing once it exceeds max
+// bytes. git only sees its stdin end early, so err keeps the reason to
+// tell the client.
+type inflatedBody struct {
+	r         io.Reader
+	left, max int64
+	err       error
+}
+
+func (b *inflatedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.r.Read(p)
+	b.left -= int64(n)
+	switch {
+	case b.left < 0:
+		b.err = errcode.Errorf(errcode.TooLarge, "request body larger than %d bytes decompressed", b.max)
+		return 0, b.err
+	case err != nil && err != io.EOF:
+		b.err = errcode.Errorf(errcode.InvalidRequest, "invalid gzip body: %v", err)
+		err = b.err
+	}
+	return n, err
+}
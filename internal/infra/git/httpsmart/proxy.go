@@ -0,0 +1,183 @@
+package httpsmart
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/listener"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/shard"
+)
+
+// maxReplayBody is the largest request body kept in memory so that the
+// request can be sent again when a backend redirects it. Larger bodies,
+// i.e. most pushes, are streamed and the redirect is passed to the client.
+const maxReplayBody = 1 << 20
+
+// maxProxyRedirects bounds how many 307/308 hops a request may take.
+const maxProxyRedirects = 5
+
+var errBackendUnavailable = errcode.New(errcode.Unavailable, "repository backend unavailable")
+
+// Proxy makes the server a stateless edge in front of a sharded fleet:
+// requests for repositories owned by another node are forwarded to it with
+// streaming in both directions. Temporary and permanent redirects (307 and
+// 308) between backends are followed; other redirects, such as those for
+// moved repositories, are passed to the client.
+type Proxy struct {
+	// Route returns the base URL of the node owning repo, or "" to serve it
+	// locally.
+	Route func(repo string) string
+	// Transport defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+
+	once  sync.Once
+	proxy *httputil.ReverseProxy
+}
+
+// HashRoute assigns every repository to one of the base URLs in nodes with
+// shard.Owner. Repositories assigned to self are served locally.
+func HashRoute(nodes []string, self string) func(repo string) string {
+	return func(repo string) string {
+		i := shard.Owner(nodes, repo)
+		if i < 0 || nodes[i] == self {
+			return ""
+		}
+		return nodes[i]
+	}
+}
+
+func (p *Proxy) route(repo string) string {
+	if p == nil || p.Route == nil || repo == "" {
+		return ""
+	}
+	return p.Route(repo)
+}
+
+// forward sends r to the node at base and streams the response back.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, base string) {
+	target, err := url.Parse(base)
+	if err != nil {
+		slog.Error("proxy: invalid backend", "backend", base, "error", err)
+		writeError(w, r, errBackendUnavailable)
+		return
+	}
+	p.once.Do(p.init)
+
+	out := r.Clone(r.Context())
+	out.URL.Scheme = target.Scheme
+	out.URL.Host = target.Host
+	out.URL.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	out.Host = target.Host
+	if r.Body != nil && r.Body != http.NoBody {
+		head, err := io.ReadAll(io.LimitReader(r.Body, maxReplayBody+1))
+		if err != nil {
+			writeError(w, r, errcode.New(errcode.InvalidRequest, "read request body"))
+			return
+		}
+		if len(head) <= maxReplayBody {
+			out.Body = io.NopCloser(bytes.NewReader(head))
+			out.ContentLength = int64(len(head))
+			out.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(head)), nil
+			}
+		} else {
+			out.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		}
+	}
+	p.proxy.ServeHTTP(w, out)
+}
+
+func (p *Proxy) init() {
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	p.proxy = &httputil.ReverseProxy{
+		// The request is already addressed to the backend.
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+		},
+		Transport:     &redirectFollower{next: transport},
+		FlushInterval: -1, // stream progress and packs as they are produced
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Error("proxy request failed", "backend", r.URL.Host, "path", r.URL.Path, "error", err)
+			writeError(w, r, errBackendUnavailable)
+		},
+	}
+}
+
+// redirectFollower repeats requests answered with 307 or 308 at the new
+// location, as long as their body can be replayed.
+type redirectFollower struct {
+	next http.RoundTripper
+}
+
+func (t *redirectFollower) RoundTrip(req *http.Request) (*http.Response, error) {
+	for hop := 0; ; hop++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || hop == maxProxyRedirects {
+			return resp, err
+		}
+		if resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusPermanentRedirect {
+			return resp, nil
+		}
+		hasBody := req.Body != nil && req.Body != http.NoBody
+		if hasBody && req.GetBody == nil {
+			return resp, nil
+		}
+		loc, err := resp.Location()
+		if err != nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		next := req.Clone(req.Context())
+		next.URL = loc
+		next.Host = loc.Host
+		if hasBody {
+			if next.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = next
+	}
+}
+
+// clientAddr returns r with RemoteAddr set to the client named in
+// X-Forwarded-For when r comes from one of trusted, such as an edge Proxy,
+// or arrives on a proxied listener. The scheme and host the client used are
+// taken from X-Forwarded-Proto and X-Forwarded-Host too, for checkCanonical.
+func clientAddr(r *http.Request, trusted map[string]bool) *http.Request {
+	if !trusted[remoteHost(r)] && !listener.Proxied(r.Context()) {
+		return r
+	}
+	proto, host := r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host")
+	xff := r.Header.Get("X-Forwarded-For")
+	// The last entry was added by the trusted proxy itself.
+	client := strings.TrimSpace(xff[strings.LastIndex(xff, ",")+1:])
+	if net.ParseIP(client) == nil && proto == "" && host == "" {
+		return r
+	}
+	r2 := r.Clone(r.Context())
+	if net.ParseIP(client) != nil {
+		r2.RemoteAddr = net.JoinHostPort(client, "0")
+	}
+	if proto == "http" || proto == "https" {
+		r2.URL.Scheme = proto
+	}
+	if host != "" {
+		r2.Host = strings.TrimSpace(host[strings.LastIndex(host, ",")+1:])
+	}
+	return r2
+}
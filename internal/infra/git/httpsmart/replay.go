@@ -0,0 +1,215 @@
+package httpsmart
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// PushReplays recognizes a receive-pack request delivered twice, as
+// proxies do when they retry a POST whose response got lost, and answers
+// the copy with the original's response. Running it again would report the
+// refs as stale, since they already point where the push wanted them.
+//
+// Deliveries are the same push when they come from the same identity and
+// their bodies, the command list and the pack, are byte for byte the same.
+// A copy arriving while the original still runs waits for it. Copies are
+// only answered with the original's response while every ref still points
+// where the push left it; a tag deleted and created again since, for
+// example, makes the copy run for real. Pushes that failed are forgotten,
+// so their retries run again. It is safe for concurrent use.
+type PushReplays struct {
+	// Dir holds request bodies while they are hashed and pushed; defaults
+	// to the system's temporary directory.
+	Dir string
+	// Window is how long a push's response is kept; defaults to 10 minutes.
+	Window time.Duration
+	// MaxResponse caps the response kept per push; pushes with longer ones
+	// aren't replayed. Defaults to 64 KiB.
+	MaxResponse int
+
+	mu     sync.Mutex
+	pushes map[string]*replayedPush
+}
+
+type replayedPush struct {
+	done     chan struct{}
+	commands []service.PushCommand
+	response []byte
+	ok       bool
+	at       time.Time
+}
+
+// PushDelivery is one delivery of a push, returned by Deliver.
+type PushDelivery struct {
+	body     *os.File
+	replays  *PushReplays
+	key      string
+	push     *replayedPush
+	response bytes.Buffer
+	// Original is false when Response is the answer to an earlier delivery.
+	Original bool
+}
+
+// Deliver spools and hashes the request body of a push by identity to
+// repo. If the same push was answered within the window and applied
+// reports its commands are still in effect, the delivery is a replay of
+// it; otherwise it is the original, whose body is read from the delivery
+// and whose response is written to it, and which Finish must be called on.
+func (p *PushReplays) Deliver(ctx context.Context, repo, identity string, body io.Reader, applied func([]service.PushCommand) bool) (*PushDelivery, error) {
+	f, err := os.CreateTemp(p.Dir, "push-*.body")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	d := &PushDelivery{body: f}
+	commands := service.NewPushCommandReader(body)
+	if _, err := io.Copy(io.MultiWriter(f, h), commands); err != nil {
+		d.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		d.Close()
+		return nil, err
+	}
+	d.replays = p
+	d.key = strings.Trim(repo, "/") + "\x00" + identity + "\x00" + hex.EncodeToString(h.Sum(nil))
+
+	for {
+		p.mu.Lock()
+		p.expire(time.Now())
+		push, seen := p.pushes[d.key]
+		if !seen {
+			if p.pushes == nil {
+				p.pushes = make(map[string]*replayedPush)
+			}
+			d.push = &replayedPush{done: make(chan struct{}), commands: commands.Commands()}
+			d.Original = true
+			p.pushes[d.key] = d.push
+			p.mu.Unlock()
+			return d, nil
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-push.done:
+		case <-ctx.Done():
+			d.Close()
+			return nil, ctx.Err()
+		}
+		if push.ok && applied(push.commands) {
+			d.push = push
+			return d, nil
+		}
+		if push.ok {
+			// The refs moved since; push for real.
+			p.mu.Lock()
+			if p.pushes[d.key] == push {
+				delete(p.pushes, d.key)
+			}
+			p.mu.Unlock()
+		}
+		// The original failed and was forgotten; try for real.
+	}
+}
+
+// refsApplied reports whether every ref of commands points at its new
+// object in the repository at dir, or is missing if it was deleted.
+func refsApplied(ctx context.Context, dir string, commands []service.PushCommand) bool {
+	if len(commands) == 0 {
+		return false
+	}
+	args := []string{"-C", dir, "for-each-ref", "--format=%(objectname) %(refname)"}
+	for _, cmd := range commands {
+		args = append(args, cmd.Ref)
+	}
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return false
+	}
+	current := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if oid, ref, ok := strings.Cut(line, " "); ok {
+			current[ref] = oid
+		}
+	}
+	for _, cmd := range commands {
+		oid, ok := current[cmd.Ref]
+		if cmd.IsDelete() && ok || !cmd.IsDelete() && oid != cmd.New {
+			return false
+		}
+	}
+	return true
+}
+
+// expire forgets responses older than the window. p.mu must be held.
+func (p *PushReplays) expire(now time.Time) {
+	window := p.Window
+	if window <= 0 {
+		window = 10 * time.Minute
+	}
+	for key, push := range p.pushes {
+		select {
+		case <-push.done:
+			if push.ok && now.Sub(push.at) > window {
+				delete(p.pushes, key)
+			}
+		default:
+		}
+	}
+}
+
+func (p *PushReplays) maxResponse() int {
+	if p.MaxResponse > 0 {
+		return p.MaxResponse
+	}
+	return 64 << 10
+}
+
+// Read reads the request body.
+func (d *PushDelivery) Read(b []byte) (int, error) { return d.body.Read(b) }
+
+// Write records the response, up to MaxResponse bytes.
+func (d *PushDelivery) Write(b []byte) (int, error) {
+	if d.response.Len() <= d.replays.maxResponse() {
+		d.response.Write(b)
+	}
+	return len(b), nil
+}
+
+// Response returns the response of the original delivery to replay.
+func (d *PushDelivery) Response() []byte { return d.push.response }
+
+// Finish keeps the response of a successful original delivery for replays
+// and releases copies waiting for it.
+func (d *PushDelivery) Finish(ok bool) {
+	if !d.Original {
+		return
+	}
+	ok = ok && d.response.Len() <= d.replays.maxResponse()
+	d.replays.mu.Lock()
+	d.push.ok, d.push.at = ok, time.Now()
+	if ok {
+		d.push.response = d.response.Bytes()
+	} else {
+		delete(d.replays.pushes, d.key)
+	}
+	d.replays.mu.Unlock()
+	close(d.push.done)
+}
+
+// Close removes the spooled body.
+func (d *PushDelivery) Close() error {
+	err := d.body.Close()
+	os.Remove(d.body.Name())
+	return err
+}
@@ -0,0 +1,384 @@
+package httpsmart
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// Resumable pushes are an extension of the receive-pack POST. A client that
+// sends Repocraft-Push-Session (its own random ID) and Repocraft-Push-Length
+// (the full request body size) may deliver the body in several requests,
+// each starting at Repocraft-Push-Offset. A HEAD request with the session
+// header reports the offset to resume from. receive-pack runs once the whole
+// body has arrived.
+const (
+	pushSessionHeader = "Repocraft-Push-Session"
+	pushLengthHeader  = "Repocraft-Push-Length"
+	pushOffsetHeader  = "Repocraft-Push-Offset"
+)
+
+var (
+	// ErrOffsetMismatch is returned when a client resumes from an offset other
+	// than the number of bytes already received.
+	ErrOffsetMismatch = errcode.New(errcode.Conflict, "push session offset mismatch")
+	// ErrSessionBusy is returned while another request appends to the session.
+	ErrSessionBusy = errcode.New(errcode.Conflict, "push session is busy")
+	// ErrSessionTooLarge is returned for bodies beyond MaxLength.
+	ErrSessionTooLarge = errcode.New(errcode.TooLarge, "push session too large")
+	// ErrTooManySessions is returned for new sessions beyond MaxSessions.
+	ErrTooManySessions = errcode.New(errcode.LimitExceeded, "too many push sessions")
+	// ErrSpoolFull is returned for new sessions that would take the
+	// spooled bodies beyond MaxSpooled.
+	ErrSpoolFull = errcode.New(errcode.Overloaded, "no room for another push session, try again later")
+)
+
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// DefaultMaxSessionLength caps the body size of push sessions when
+// PushSessions doesn't say.
+const DefaultMaxSessionLength = 2 << 30
+
+// Defaults of PushSessions.MaxSessions and MaxSpooled.
+const (
+	DefaultMaxSessions = 8
+	DefaultMaxSpooled  = 16 << 30
+)
+
+// PushSessions spools the request bodies of resumable pushes in Dir until
+// they are complete. It is safe for concurrent use.
+type PushSessions struct {
+	Dir string
+	// TTL removes sessions that received no data for this long; defaults to 24 hours.
+	TTL time.Duration
+	// MaxLength caps the body size of a session; DefaultMaxSessionLength
+	// if zero, no limit if negative.
+	MaxLength int64
+	// MaxSessions caps the sessions open per repository and per client;
+	// DefaultMaxSessions if zero, no limit if negative.
+	MaxSessions int
+	// MaxSpooled caps the bytes all sessions may spool in Dir, counted by
+	// their full lengths when they start; DefaultMaxSpooled if zero, no
+	// limit if negative.
+	MaxSpooled int64
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+type pushSessionMeta struct {
+	Repo   string `json:"repo"`
+	Client string `json:"client,omitempty"`
+	Length int64  `json:"length"`
+}
+
+func (p *PushSessions) key(repo, id string) string {
+	sum := sha256.Sum256([]byte(strings.Trim(repo, "/") + "\x00" + id))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (p *PushSessions) paths(key string) (data, meta string) {
+	return filepath.Join(p.Dir, key+".body"), filepath.Join(p.Dir, key+".json")
+}
+
+// Offset returns how much of the session's body was received and its full length.
+func (p *PushSessions) Offset(repo, id string) (offset, length int64, ok bool) {
+	data, meta := p.paths(p.key(repo, id))
+	raw, err := os.ReadFile(meta)
+	if err != nil {
+		return 0, 0, false
+	}
+	var m pushSessionMeta
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return 0, 0, false
+	}
+	info, err := os.Stat(data)
+	if err != nil {
+		return 0, m.Length, true
+	}
+	return info.Size(), m.Length, true
+}
+
+// Append writes body to the session at offset and returns the new offset,
+// starting the session for client if it is new. Bytes received before a
+// read error are kept so the client can resume.
+func (p *PushSessions) Append(repo, client, id string, length, offset int64, body io.Reader) (int64, error) {
+	if limit := p.maxLength(); limit > 0 && length > limit {
+		return 0, ErrSessionTooLarge
+	}
+	key := p.key(repo, id)
+	p.mu.Lock()
+	if p.busy[key] {
+		p.mu.Unlock()
+		return 0, ErrSessionBusy
+	}
+	if p.busy == nil {
+		p.busy = make(map[string]bool)
+	}
+	p.busy[key] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.busy, key)
+		p.mu.Unlock()
+	}()
+
+	if err := os.MkdirAll(p.Dir, 0o700); err != nil {
+		return 0, err
+	}
+	current, known, ok := p.Offset(repo, id)
+	if !ok {
+		if err := p.start(key, pushSessionMeta{Repo: strings.Trim(repo, "/"), Client: client, Length: length}); err != nil {
+			return 0, err
+		}
+	} else if known != length {
+		return current, fmt.Errorf("%w: session length is %d", ErrOffsetMismatch, known)
+	}
+	if offset != current {
+		return current, ErrOffsetMismatch
+	}
+
+	data, _ := p.paths(key)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !ok {
+		// A new session starts empty, whatever an expired one left.
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(data, flags, 0o600)
+	if err != nil {
+		return current, err
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(body, length-current))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return current + n, copyErr
+}
+
+// start records a new session unless the client or the repository has
+// MaxSessions open already, or its length doesn't fit in MaxSpooled.
+func (p *PushSessions) start(key string, m pushSessionMeta) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		return err
+	}
+	var repoSessions, clientSessions int
+	spooled := m.Length
+	for _, e := range entries {
+		other, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || other == key {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(p.Dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var o pushSessionMeta
+		if err := json.Unmarshal(raw, &o); err != nil {
+			continue
+		}
+		if o.Repo == m.Repo {
+			repoSessions++
+		}
+		if m.Client != "" && o.Client == m.Client {
+			clientSessions++
+		}
+		spooled += o.Length
+	}
+	if limit := p.maxSessions(); limit > 0 && (repoSessions >= limit || clientSessions >= limit) {
+		return ErrTooManySessions
+	}
+	if limit := p.maxSpooled(); limit > 0 && spooled > limit {
+		return ErrSpoolFull
+	}
+	raw, _ := json.Marshal(m)
+	return os.WriteFile(filepath.Join(p.Dir, key+".json"), raw, 0o600)
+}
+
+func (p *PushSessions) maxSessions() int {
+	if p.MaxSessions == 0 {
+		return DefaultMaxSessions
+	}
+	return p.MaxSessions
+}
+
+func (p *PushSessions) maxSpooled() int64 {
+	if p.MaxSpooled == 0 {
+		return DefaultMaxSpooled
+	}
+	return p.MaxSpooled
+}
+
+func (p *PushSessions) maxLength() int64 {
+	if p.MaxLength == 0 {
+		return DefaultMaxSessionLength
+	}
+	return p.MaxLength
+}
+
+// Open returns the complete body of the session for reading.
+func (p *PushSessions) Open(repo, id string) (*os.File, error) {
+	data, _ := p.paths(p.key(repo, id))
+	return os.Open(data)
+}
+
+// Remove deletes the session.
+func (p *PushSessions) Remove(repo, id string) {
+	data, meta := p.paths(p.key(repo, id))
+	os.Remove(data)
+	os.Remove(meta)
+}
+
+// Run removes abandoned sessions periodically until ctx is cancelled.
+func (p *PushSessions) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		p.collect(time.Now())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *PushSessions) collect(now time.Time) {
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("push sessions", "error", err)
+		}
+		return
+	}
+	// A session's metadata is written once and its body on every append,
+	// so it was last active when the newer of the two was modified. Both
+	// go together, or a resumed session could append to a stale body.
+	active := make(map[string]time.Time)
+	for _, e := range entries {
+		key, ok := strings.CutSuffix(e.Name(), ".body")
+		if !ok {
+			if key, ok = strings.CutSuffix(e.Name(), ".json"); !ok {
+				continue
+			}
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(active[key]) {
+			active[key] = info.ModTime()
+		}
+	}
+	for key, last := range active {
+		if now.Sub(last) < ttl {
+			continue
+		}
+		p.mu.Lock()
+		busy := p.busy[key]
+		p.mu.Unlock()
+		if !busy {
+			data, meta := p.paths(key)
+			os.Remove(meta)
+			os.Remove(data)
+		}
+	}
+}
+
+// resumablePushBody handles a request of a resumable push. It returns the
+// complete request body once every byte has arrived; otherwise it has
+// written the response and returns nil.
+func (s *Server) resumablePushBody(w http.ResponseWriter, r *http.Request, repoPath string) io.ReadCloser {
+	id := r.Header.Get(pushSessionHeader)
+	if !sessionIDPattern.MatchString(id) {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "invalid push session id"))
+		return nil
+	}
+	if _, err := s.repoDir(repoPath); err != nil {
+		writeError(w, r, err)
+		return nil
+	}
+
+	if r.Method == http.MethodHead {
+		offset, length, ok := s.PushSessions.Offset(repoPath, id)
+		if !ok {
+			writeError(w, r, errcode.New(errcode.NotFound, "unknown push session"))
+			return nil
+		}
+		w.Header().Set(pushOffsetHeader, strconv.FormatInt(offset, 10))
+		w.Header().Set(pushLengthHeader, strconv.FormatInt(length, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get(pushLengthHeader), 10, 64)
+	if err != nil || length <= 0 {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "missing or invalid "+pushLengthHeader))
+		return nil
+	}
+	offset := int64(0)
+	if v := r.Header.Get(pushOffsetHeader); v != "" {
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil || offset < 0 {
+			writeError(w, r, errcode.New(errcode.InvalidRequest, "invalid "+pushOffsetHeader))
+			return nil
+		}
+	}
+
+	received, err := s.PushSessions.Append(repoPath, identity(r), id, length, offset, r.Body)
+	w.Header().Set(pushOffsetHeader, strconv.FormatInt(received, 10))
+	switch {
+	case errors.Is(err, ErrOffsetMismatch), errors.Is(err, ErrSessionBusy), errors.Is(err, ErrSessionTooLarge),
+		errors.Is(err, ErrTooManySessions), errors.Is(err, ErrSpoolFull):
+		writeError(w, r, err)
+		return nil
+	case err != nil:
+		// Usually the client went away; what arrived is kept for resuming.
+		s.logger().Warn("push session interrupted", "repo", strings.TrimPrefix(repoPath, "/"), "received", received, "length", length, "error", err)
+		writeError(w, r, errcode.New(errcode.Internal, "push session interrupted"))
+		return nil
+	case received < length:
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+
+	f, err := s.PushSessions.Open(repoPath, id)
+	if err != nil {
+		writeError(w, r, err)
+		return nil
+	}
+	return &sessionBody{File: f, remove: func() { s.PushSessions.Remove(repoPath, id) }}
+}
+
+// sessionBody removes its push session once receive-pack consumed it; a
+// failed push has to start over.
+type sessionBody struct {
+	*os.File
+	remove func()
+}
+
+func (b *sessionBody) Close() error {
+	err := b.File.Close()
+	b.remove()
+	return err
+}
@@ -5,28 +5,219 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/abuse"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/access"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/admission"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/deviceauth"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/faults"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/featureflag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
 	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/loadshed"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/locale"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/metrics"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/signedurl"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/tracing"
 )
 
+var debugHTTP = diag.Register("http", "Smart HTTP requests as they are routed")
+
 // Server implements a minimal Git Smart HTTP server backed by git-upload-pack and git-receive-pack.
 // It handles:
 //   - GET  /<repo>/info/refs?service=git-upload-pack|git-receive-pack (advertise refs)
 //   - POST /<repo>/git-upload-pack
 //   - POST /<repo>/git-receive-pack
+//   - POST /<repo>/git-upload-archive (git archive --remote)
+//   - GET  /<repo>/clone.bundle (when CloneBundles is set)
 type Server struct {
-	RepoRoot        string
+	RepoRoot string
+	// RepoMounts serve URL namespaces from other roots, e.g. mirrors from
+	// slower storage.
+	RepoMounts      []service.RepoMount
 	UploadPackPath  string
 	ReceivePackPath string
+	// RefAdvertisement tunes the refs upload-pack advertises, per repository.
+	RefAdvertisement service.RefAdvertisementPolicy
+	// Stats optionally records per-repository fetch/push activity.
+	Stats *repostats.Store
+	// Abuse optionally flags anomalous clone patterns and rejects blocked clients.
+	Abuse *abuse.Detector
+	// Messages are shown to clients over side-band before and after transfers.
+	Messages service.MessagePolicy
+	// PushAnnotations adds links to the output of successful pushes.
+	PushAnnotations service.PushAnnotations
+	// Capabilities rewrites the capabilities advertised to clients.
+	Capabilities service.CapabilityPolicies
+	// RefTransactions, if set, votes on every ref update of a push.
+	RefTransactions service.ReferenceTransactions
+	// PushChecks, if set, inspect pushes before any ref changes, e.g.
+	// commitpolicy.Policy.
+	PushChecks service.PushCheck
+	// NegotiationLimits reject fetches asking for too many wants, haves or
+	// too deep a history before git works on them.
+	NegotiationLimits service.NegotiationLimits
+	// Depth caps the history that can be fetched from huge repositories.
+	Depth service.DepthPolicy
+	// Encryption, if set, serves repositories encrypted at rest.
+	Encryption *atrest.Store
+	// DeviceAuth, if set, refuses anonymous pushes until a user approves
+	// them in a browser; see startDeviceAuth.
+	DeviceAuth *deviceauth.Store
+	// PathScopes, if set, restricts client addresses to directories of
+	// repositories.
+	PathScopes *service.PathScopes
+	// DryRunPushes checks pushes made with `git push -o dry-run` without
+	// applying them.
+	DryRunPushes bool
+	// SparseHints tells full clones of repositories with sparse profiles
+	// how to clone only part of them.
+	SparseHints bool
+	// Review, if set, requires a second person's approval, in a signed
+	// push, for direct pushes to protected branches.
+	Review *service.ReviewPolicy
+	// Freeze, if set, refuses pushes to branches during freeze windows.
+	Freeze *freeze.Schedule
+	// Locks, if set, tracks active pushes for maintenance scheduling.
+	Locks *repolock.Manager
+	// Admission, if set, bounds concurrent git processes with fair queuing.
+	Admission *admission.Scheduler
+	// Reaper, if set, stops git process groups gracefully and lets the
+	// daemon clean up the remaining ones at shutdown.
+	Reaper *service.Reaper
+	// UploadTimeout, ReceiveTimeout and MaxDuration bound how long git
+	// may run; see service.ServiceExecutor.
+	UploadTimeout  time.Duration
+	ReceiveTimeout time.Duration
+	MaxDuration    time.Duration
+	// Sessions, if set, lists active operations with live transfer progress.
+	Sessions *service.Sessions
+	// OnFinish, if set, receives a summary of every git invocation,
+	// e.g. accounting.Recorder.Observe.
+	OnFinish func(service.Result)
+	// Metrics, if set, counts requests, transfers and refused clients.
+	Metrics *metrics.Git
+	// Logger receives finished git invocations and what goes wrong
+	// serving requests; slog.Default() if nil.
+	Logger *slog.Logger
+	// Tracer, if set, records a span per request, continuing the trace of
+	// its traceparent header, with a child span per git invocation.
+	Tracer *tracing.Tracer
+	// Credentials, if set, records the use of fetch tokens and of the
+	// identities Auth returns.
+	Credentials *credusage.Store
+	// Authorizer, if set, decides who may fetch from and push to each
+	// repository, by the identity Auth returned.
+	Authorizer access.Authorizer
+	// Auth, if set, identifies clients before anything else checks their
+	// access, e.g. against an htpasswd file or a token store; see
+	// Authenticator.
+	Auth Authenticator
+	// FetchTokens verifies signed, expiring read tokens passed as the
+	// "token" query parameter or as the Basic auth password.
+	FetchTokens *signedurl.Signer
+	// RequireFetchToken rejects fetches that don't carry a valid token.
+	RequireFetchToken bool
+	// Provisioned, if set, serves private repositories only to fetches
+	// with a valid token, and takes pushes to them only from clients
+	// Authorizer lets write; see provision.Index.
+	Provisioned *provision.Index
+	// Redirects sends requests for moved repositories to their new path.
+	Redirects *repoadmin.RedirectStore
+	// Personal, if set, lets users Auth identified create repositories in
+	// their own namespace by pushing to them.
+	Personal *repoadmin.PersonalNamespaces
+	// MaxInflatedBody caps gzip-compressed request bodies once
+	// decompressed; 1 GiB when zero.
+	MaxInflatedBody int64
+	// Rewrites map requested repository paths to other paths before
+	// anything else looks at them, e.g. to serve legacy URLs.
+	Rewrites service.RewriteRules
+	// PushSessions, if set, accepts resumable pushes; see resumable.go.
+	PushSessions *PushSessions
+	// PushReplays, if set, answers pushes delivered twice with the response
+	// to the first delivery; see replay.go.
+	PushReplays *PushReplays
+	// CloneBundles serves bundles made by bundles.Generator at
+	// /<repo>/clone.bundle and offers them to protocol v2 clients through
+	// the bundle-uri command.
+	CloneBundles bool
+	// Shedder, if set, turns away anonymous fetches and mirror syncs while
+	// the host is overloaded; pushes are always admitted.
+	Shedder *loadshed.Shedder
+	// Proxy, if set, forwards requests for repositories owned by other nodes.
+	Proxy *Proxy
+	// Shadow, if set, mirrors a sample of upload-pack requests to a second
+	// backend for comparison.
+	Shadow *Shadow
+	// CanonicalURL, if set, is the base URL repositories are served at,
+	// e.g. "https://git.example.com". Clones and pushes addressed to another
+	// host or scheme are redirected there or refused, so remotes don't end
+	// up split across several DNS names. Repositories can override it; see
+	// provision.Repo.CanonicalURL.
+	CanonicalURL *url.URL
+	// Flags, if set, gate bundle-uri, protocol v2 and dry-run pushes per
+	// repository and client; see featureflag.Set.
+	Flags *featureflag.Set
+	// Locales, if set, translate errors and messages for clients; see
+	// locale.Localizer. Clients ask for a language with Accept-Language.
+	Locales *locale.Localizer
+	// TrustedProxies lists the addresses of edge proxies whose
+	// X-Forwarded-For names the client. Clients of proxied listeners (see
+	// listener.ConnContext) are trusted as well.
+	TrustedProxies map[string]bool
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = clientAddr(r, s.TrustedProxies)
+	r = s.stripDeviceSecret(r)
+	if s.Tracer != nil {
+		var finish func()
+		w, r, finish = s.trace(w, r)
+		defer finish()
+	}
+	printer := s.Locales.For(proxiedRepo(r.URL.Path), remoteHost(r), r.Header.Get("Accept-Language"))
+	r = r.WithContext(locale.NewContext(r.Context(), printer))
+	if until, blocked := s.Abuse.Blocked(remoteHost(r), time.Now()); blocked {
+		writeError(w, r, &errcode.Error{Code: errcode.RateLimited, Message: "too many requests", RetryAfter: time.Until(until)})
+		return
+	}
+
+	if err := checkRequest(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	r.URL.Path = s.rewritePath(r.URL.Path)
+	debugHTTP.Printf("%s %s from %s", r.Method, r.URL.RequestURI(), remoteHost(r))
+
+	w, shadowed := s.Shadow.sample(w, r)
+	defer shadowed()
+
+	if base := s.Proxy.route(proxiedRepo(r.URL.Path)); base != "" {
+		debugHTTP.Printf("forwarding %s to %s", r.URL.Path, base)
+		s.Proxy.forward(w, r, base)
+		return
+	}
+
 	switch {
 	case strings.HasSuffix(r.URL.Path, "/info/refs"):
 		s.handleInfoRefs(w, r)
@@ -34,27 +225,84 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleServiceRPC(w, r, service.ServiceUploadPack)
 	case strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
 		s.handleServiceRPC(w, r, service.ServiceReceivePack)
+	case strings.HasSuffix(r.URL.Path, "/git-upload-archive"):
+		s.handleServiceRPC(w, r, service.ServiceUploadArchive)
+	case s.CloneBundles && strings.HasSuffix(r.URL.Path, bundleSuffix):
+		s.handleBundle(w, r)
 	default:
 		http.NotFound(w, r)
 	}
 }
 
+// proxiedRepo returns the repository a request is for, without the leading
+// slash, or "" for unknown endpoints.
+func proxiedRepo(urlPath string) string {
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack", "/git-upload-archive", bundleSuffix} {
+		if repo, ok := strings.CutSuffix(urlPath, suffix); ok {
+			return strings.TrimPrefix(pathClean(repo), "/")
+		}
+	}
+	return ""
+}
+
+// rewritePath applies Rewrites to the repository part of urlPath.
+func (s *Server) rewritePath(urlPath string) string {
+	if len(s.Rewrites) == 0 {
+		return urlPath
+	}
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack", "/git-upload-archive", bundleSuffix} {
+		if repo, ok := strings.CutSuffix(urlPath, suffix); ok {
+			if to, ok := s.Rewrites.Rewrite(repo); ok {
+				return "/" + to + suffix
+			}
+			break
+		}
+	}
+	return urlPath
+}
+
 func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
 	serviceName := r.URL.Query().Get("service")
 	svc, err := parseServiceParam(serviceName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
 	repoPath, err := s.repoPathFromURL(strings.TrimSuffix(r.URL.Path, "/info/refs"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+	// Git follows redirects on the initial request and uses the new base URL
+	// for the rest of the operation.
+	if target, ok := s.movedTo(repoPath); ok {
+		u := *r.URL
+		u.Path = target + "/info/refs"
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	if !s.checkCanonical(w, r, repoPath) {
+		return
+	}
+	r, ok := s.authenticate(w, r, repoPath, svc)
+	if !ok {
+		return
+	}
+
+	if !s.checkAccess(w, r, repoPath, svc) {
+		return
+	}
+	if _, err := s.repoDir(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !s.admitLoad(w, r, svc) {
 		return
 	}
 
@@ -62,96 +310,522 @@ func (s *Server) handleInfoRefs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Cache-Control", "no-cache")
 
-	// Write service header pkt-line then flush.
-	headerLine := fmt.Sprintf("# service=%s\n", svc.Command())
-	if _, err := fmt.Fprintf(w, "%04x%s", len(headerLine)+4, headerLine); err != nil {
-		return
+	req := service.ServiceRequest{
+		Service:         svc,
+		ProtocolVersion: s.protocol(r, repoPath),
+		Identity:        identity(r),
+		RemoteAddr:      r.RemoteAddr,
+		StatelessRPC:    true,
+		AdvertiseRefs:   true,
 	}
-	if _, err := io.WriteString(w, "0000"); err != nil {
-		return
-	}
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+
+	sr := newStreamedResponse(w)
+	// Write service header pkt-line then flush. Protocol v2 responses start
+	// directly with the capability advertisement, as git-http-backend does.
+	if !req.IsProtocolV2() {
+		headerLine := fmt.Sprintf("# service=%s\n", svc.Command())
+		if _, err := fmt.Fprintf(sr, "%04x%s", len(headerLine)+4, headerLine); err != nil {
+			return
+		}
+		if _, err := io.WriteString(sr, "0000"); err != nil {
+			return
+		}
+		sr.Flush()
 	}
 
-	if err := s.runStatelessRPC(r.Context(), w, svc, repoPath, true, nil); err != nil {
-		log.Printf("info/refs %s: %v", repoPath, err)
+	if err := s.runStatelessRPC(r.Context(), sr, req, repoPath, nil); err != nil {
+		s.logger().Error("info/refs failed", "repo", strings.TrimPrefix(repoPath, "/"), "remote_addr", r.RemoteAddr, "error", err)
+		if errors.Is(err, faults.ErrDropped) {
+			panic(http.ErrAbortHandler)
+		}
+		sr.fail(r, err)
+		return
+	}
+	// Every fetch starts with exactly one upload-pack advertisement, while
+	// the number of POSTs varies with negotiation rounds.
+	if svc == service.ServiceUploadPack {
+		s.Stats.Record(strings.TrimPrefix(repoPath, "/"), repostats.OperationFetch, identity(r), time.Now())
+		s.recordCredentials(r, repoPath, svc)
 	}
 }
 
 func (s *Server) handleServiceRPC(w http.ResponseWriter, r *http.Request, svc service.Service) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	resumable := svc == service.ServiceReceivePack && s.PushSessions != nil && r.Header.Get(pushSessionHeader) != ""
+	if r.Method != http.MethodPost && !(resumable && r.Method == http.MethodHead) {
+		writeError(w, r, errMethodNotAllowed)
 		return
 	}
 
 	repoPath, err := s.repoPathFromURL(strings.TrimSuffix(r.URL.Path, "/"+svc.Command()))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+	if target, ok := s.movedTo(repoPath); ok {
+		repoPath = target
+	}
+	if !s.checkCanonical(w, r, repoPath) {
+		return
+	}
+	r, ok := s.authenticate(w, r, repoPath, svc)
+	if !ok {
+		return
+	}
+	if !s.checkAccess(w, r, repoPath, svc) {
+		return
+	}
+	if _, err := s.repoDir(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !s.admitLoad(w, r, svc) {
 		return
 	}
 
+	var body io.Reader = r.Body
+	if resumable {
+		spooled := s.resumablePushBody(w, r, repoPath)
+		if spooled == nil {
+			return
+		}
+		defer spooled.Close()
+		body = spooled
+	}
+	if body, err = s.decodeBody(r, body); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	inflated, _ := body.(*inflatedBody)
+
 	var contentType string
 	switch svc {
 	case service.ServiceUploadPack:
 		contentType = "application/x-git-upload-pack-result"
 	case service.ServiceReceivePack:
 		contentType = "application/x-git-receive-pack-result"
+	case service.ServiceUploadArchive:
+		contentType = "application/x-git-upload-archive-result"
 	default:
-		http.Error(w, "unsupported service", http.StatusBadRequest)
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "unsupported service"))
 		return
 	}
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Cache-Control", "no-cache")
 
-	if err := s.runStatelessRPC(r.Context(), w, svc, repoPath, false, r.Body); err != nil {
-		log.Printf("%s %s: %v", svc.Command(), repoPath, err)
+	req := service.ServiceRequest{
+		Service:         svc,
+		ProtocolVersion: s.protocol(r, repoPath),
+		Identity:        identity(r),
+		User:            user(r),
+		RemoteAddr:      r.RemoteAddr,
+		StatelessRPC:    true,
+	}
+	if svc == service.ServiceUploadPack && s.CloneBundles && req.IsProtocolV2() && s.Flags.Enabled(featureflag.BundleURI, strings.TrimPrefix(repoPath, "/"), req.Identity) && !s.PathScopes.Restricts(strings.TrimPrefix(repoPath, "/"), req.Identity) {
+		var handled bool
+		if body, handled = s.interceptBundleURI(w, r, repoPath, body); handled {
+			return
+		}
+	}
+	var negotiation *service.NegotiationCounter
+	if svc == service.ServiceUploadPack {
+		negotiation = service.NewNegotiationCounter(body)
+		body = negotiation
+	}
+
+	sr := newStreamedResponse(w)
+	var out io.Writer = sr
+	var delivery *PushDelivery
+	if svc == service.ServiceReceivePack && s.PushReplays != nil {
+		applied := func(commands []service.PushCommand) bool {
+			dir, err := s.repoDir(repoPath)
+			return err == nil && refsApplied(r.Context(), dir, commands)
+		}
+		if delivery, err = s.PushReplays.Deliver(r.Context(), repoPath, identity(r), body, applied); err != nil {
+			s.logger().Error("deliver push", "service", svc.Command(), "repo", req.RepoName, "remote_addr", r.RemoteAddr, "error", err)
+			sr.fail(r, err)
+			return
+		}
+		defer delivery.Close()
+		if !delivery.Original {
+			s.logger().Info("replaying the response to a duplicate push", "service", svc.Command(), "repo", req.RepoName, "remote_addr", r.RemoteAddr)
+			_, _ = sr.Write(delivery.Response())
+			return
+		}
+		body, out = delivery, io.MultiWriter(delivery, sr)
+	}
+
+	err = s.runStatelessRPC(r.Context(), out, req, repoPath, body)
+	if err != nil && inflated != nil && inflated.err != nil {
+		err = inflated.err
+	}
+	if delivery != nil {
+		delivery.Finish(err == nil)
+	}
+	if err != nil {
+		s.logger().Error("git request failed", "service", svc.Command(), "repo", req.RepoName, "remote_addr", r.RemoteAddr, "error", err)
+		if errors.Is(err, faults.ErrDropped) {
+			// Cut the connection rather than end the response.
+			panic(http.ErrAbortHandler)
+		}
+		sr.fail(r, err)
+		return
+	}
+	// Requests without wants are ref listings or negotiation-only rounds.
+	if negotiation != nil && negotiation.Wants > 0 {
+		s.Abuse.ObserveFetch(s.fetcher(r), strings.TrimPrefix(repoPath, "/"), negotiation.FullClone(), time.Now())
+	}
+	if svc == service.ServiceReceivePack {
+		s.Stats.Record(strings.TrimPrefix(repoPath, "/"), repostats.OperationPush, identity(r), time.Now())
+	}
+	if svc != service.ServiceUploadPack {
+		s.recordCredentials(r, repoPath, svc)
 	}
 }
 
-func (s *Server) runStatelessRPC(ctx context.Context, stdout io.Writer, svc service.Service, repoPath string, advertise bool, stdin io.Reader) error {
-	if !svc.IsSupported() {
-		return fmt.Errorf("unsupported service: %s", svc)
+func (s *Server) runStatelessRPC(ctx context.Context, stdout io.Writer, req service.ServiceRequest, repoPath string, stdin io.Reader) error {
+	if !req.Service.IsSupported() {
+		return fmt.Errorf("unsupported service: %s", req.Service)
 	}
 
-	repoFull := filepath.Join(s.RepoRoot, filepath.FromSlash(strings.TrimPrefix(repoPath, "/")))
-	if err := ensureWithinRoot(s.RepoRoot, repoFull); err != nil {
+	repoFull, err := s.repoDir(repoPath)
+	if err != nil {
 		return err
 	}
-	if _, err := os.Stat(repoFull); err != nil {
-		return fmt.Errorf("repo not found: %w", err)
+	req.RepoPath = repoFull
+	req.RepoName = strings.TrimPrefix(repoPath, "/")
+	defer s.Metrics.Begin(req.Service)()
+
+	capabilities := s.Capabilities
+	if req.Service == service.ServiceUploadPack && req.AdvertiseRefs && req.IsProtocolV2() && s.hasBundle(repoPath) && s.Flags.Enabled(featureflag.BundleURI, req.RepoName, req.Identity) && !s.PathScopes.Restricts(req.RepoName, req.Identity) {
+		caps := capabilities.UploadPack
+		caps.Add = append(append([]string(nil), caps.Add...), "bundle-uri")
+		capabilities.UploadPack = caps
 	}
 
-	args := []string{"--stateless-rpc"}
-	if advertise {
-		args = append(args, "--advertise-refs")
+	exec := service.ServiceExecutor{
+		UploadPackPath:    s.UploadPackPath,
+		ReceivePackPath:   s.ReceivePackPath,
+		RefAdvertisement:  s.RefAdvertisement,
+		Messages:          s.Messages,
+		PushAnnotations:   s.PushAnnotations,
+		Capabilities:      capabilities,
+		RefTransactions:   s.RefTransactions,
+		PushChecks:        s.PushChecks,
+		Locks:             s.Locks,
+		PathScopes:        s.PathScopes,
+		DryRunPushes:      s.DryRunPushes && s.Flags.Enabled(featureflag.DryRunPushes, req.RepoName, req.Identity),
+		SparseHints:       s.SparseHints && s.Flags.Enabled(featureflag.SparseHints, req.RepoName, req.Identity),
+		Review:            s.Review,
+		Freeze:            s.Freeze,
+		NegotiationLimits: s.NegotiationLimits,
+		Depth:             s.Depth,
+		Encryption:        s.Encryption,
+		Admission:         s.Admission,
+		Reaper:            s.Reaper,
+		UploadTimeout:     s.UploadTimeout,
+		ReceiveTimeout:    s.ReceiveTimeout,
+		MaxDuration:       s.MaxDuration,
+		Sessions:          s.Sessions,
+		OnFinish:          s.finish,
+		Logger:            s.Logger,
+		Tracer:            s.Tracer,
+		Locales:           s.Locales,
 	}
-	args = append(args, repoFull)
+	req.Locale = locale.FromContext(ctx).Locale
+	return exec.Serve(ctx, req, stdin, stdout, os.Stderr)
+}
 
-	binary := svc.Command()
-	if svc == service.ServiceUploadPack && s.UploadPackPath != "" {
-		binary = s.UploadPackPath
+// repoDir returns the directory of the existing repository at repoPath.
+func (s *Server) repoDir(repoPath string) (string, error) {
+	repoFull, _, err := s.resolver().Resolve(repoPath)
+	if err != nil {
+		return "", err
 	}
-	if svc == service.ServiceReceivePack && s.ReceivePackPath != "" {
-		binary = s.ReceivePackPath
+	if _, err := os.Stat(repoFull); err != nil {
+		return "", &errcode.Error{Code: errcode.RepoNotFound, Message: "repository not found: " + strings.TrimPrefix(repoPath, "/"), Err: err}
 	}
+	return repoFull, nil
+}
 
-	cmd := exec.CommandContext(ctx, binary, args...)
-	cmd.Stdin = stdin
-	cmd.Stdout = stdout
-	cmd.Stderr = os.Stderr
+func (s *Server) resolver() service.RepoResolver {
+	return service.RepoResolver{Root: s.RepoRoot, Mounts: s.RepoMounts}
+}
 
-	return cmd.Run()
+// movedTo returns the new path of a repository that was transferred away from
+// repoPath, unless a repository exists at repoPath again.
+func (s *Server) movedTo(repoPath string) (string, bool) {
+	if s.Redirects == nil {
+		return "", false
+	}
+	full, _, err := s.resolver().Resolve(repoPath)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(full); err == nil {
+		return "", false
+	}
+	target, ok := s.Redirects.Lookup(strings.TrimPrefix(repoPath, "/"))
+	if !ok {
+		return "", false
+	}
+	return "/" + target, true
 }
 
+// repoPathFromURL returns the repository path named by the URL prefix, with
+// ".git" appended if the resolver would, so access checks, tokens and
+// statistics all see the repository under one name.
 func (s *Server) repoPathFromURL(prefix string) (string, error) {
 	cleaned := pathClean(prefix)
 	if cleaned == "" || cleaned == "/" {
-		return "", errors.New("invalid repository path")
+		return "", errcode.New(errcode.InvalidRequest, "invalid repository path")
+	}
+	if _, name, err := s.resolver().Resolve(cleaned); err == nil {
+		cleaned = "/" + name
 	}
 	return cleaned, nil
 }
 
+// checkAccess checks requests with authorize, except fetches carrying a
+// fetch token, which grants access to its repository by itself. It checks
+// fetches and archives with checkFetchToken and refuses pushes to private
+// repositories, which fetch tokens don't cover. With DeviceAuth, anonymous
+// pushes get a code to approve instead; approved ones are identified as
+// the approving user by authenticate. Pushes that pass go through
+// preparePush. It writes the error response and returns false when the
+// request must not proceed.
+func (s *Server) checkAccess(w http.ResponseWriter, r *http.Request, repoPath string, svc service.Service) bool {
+	if svc.IsRead() {
+		// ServeHTTP checked the address; a fetcher known by more is
+		// checked here, once it is known.
+		if subject := s.fetcher(r); subject != remoteHost(r) {
+			if until, blocked := s.Abuse.Blocked(subject, time.Now()); blocked {
+				writeError(w, r, &errcode.Error{Code: errcode.RateLimited, Message: "too many requests", RetryAfter: time.Until(until)})
+				return false
+			}
+		}
+		if (s.FetchTokens == nil || fetchToken(r) == "") && !s.authorize(w, r, repoPath, svc) {
+			return false
+		}
+		return s.checkFetchToken(w, r, repoPath)
+	}
+	if s.DeviceAuth != nil && !identified(r) {
+		s.startDeviceAuth(w, r, repoPath)
+		return false
+	}
+	if !s.authorize(w, r, repoPath, svc) {
+		return false
+	}
+	// Private repositories take pushes from clients Authorizer let write
+	// to them; without it, only over SSH, where keys identify users.
+	if s.Provisioned.Private(repoPath) && (s.Authorizer == nil || !identified(r)) {
+		writeError(w, r, errcode.New(errcode.AccessDenied, "private repositories accept pushes over SSH only"))
+		return false
+	}
+	return s.preparePush(w, r, repoPath)
+}
+
+// authorize asks Authorizer whether the client Auth identified, or an
+// anonymous one, may use svc on repoPath. Anonymous clients refused are
+// asked for credentials. It writes the error response and returns false
+// when the request must not proceed.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, repoPath string, svc service.Service) bool {
+	if s.Authorizer == nil {
+		return true
+	}
+	user, repo := "", strings.TrimPrefix(repoPath, "/")
+	if identified(r) {
+		user = identity(r)
+	}
+	if svc.IsRead() && s.Authorizer.CanRead(user, repo) || !svc.IsRead() && s.Authorizer.CanWrite(user, repo) {
+		return true
+	}
+	if user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="repocraft"`)
+		writeError(w, r, errcode.New(errcode.Unauthenticated, "authentication required"))
+		return false
+	}
+	s.Metrics.AuthFailure("denied")
+	writeError(w, r, access.Denied(user, repo, svc.IsRead()))
+	return false
+}
+
+// logger returns Logger or the default logger.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+// finish logs a finished git invocation and reports it to Metrics and
+// OnFinish.
+func (s *Server) finish(res service.Result) {
+	res.Log(s.logger())
+	s.Metrics.Observe(res)
+	if s.OnFinish != nil {
+		s.OnFinish(res)
+	}
+}
+
+// preparePush lets Personal create the repository a push by a client Auth
+// identified is for and hold the push to its namespace's quotas. It writes
+// the error response and returns false when the request must not proceed.
+func (s *Server) preparePush(w http.ResponseWriter, r *http.Request, repoPath string) bool {
+	if s.Personal == nil || !identified(r) {
+		return true
+	}
+	created, err := s.Personal.PreparePush(identity(r), strings.TrimPrefix(repoPath, "/"))
+	if err != nil {
+		if errcode.CodeOf(err) == errcode.Internal {
+			s.logger().Error("prepare push", "repo", strings.TrimPrefix(repoPath, "/"), "identity", identity(r), "error", err)
+		}
+		writeError(w, r, err)
+		return false
+	}
+	if created {
+		s.logger().Info("created repository on push", "repo", strings.TrimPrefix(repoPath, "/"), "identity", identity(r))
+	}
+	return true
+}
+
+// checkFetchToken validates a signed fetch token if one is presented, or if
+// RequireFetchToken is set or the repository is private. It writes a 401
+// response and returns false when the request must not proceed.
+func (s *Server) checkFetchToken(w http.ResponseWriter, r *http.Request, repoPath string) bool {
+	required := s.RequireFetchToken || s.Provisioned.Private(repoPath)
+	if s.FetchTokens == nil {
+		switch {
+		case s.RequireFetchToken:
+			writeError(w, r, errcode.New(errcode.Internal, "fetch tokens are not configured"))
+			return false
+		case required:
+			writeError(w, r, errcode.New(errcode.AccessDenied, "repository is private"))
+			return false
+		}
+		return true
+	}
+	token := fetchToken(r)
+	if token == "" && !required {
+		return true
+	}
+	if err := s.FetchTokens.Verify(token, strings.TrimPrefix(repoPath, "/"), time.Now()); err != nil {
+		s.Metrics.AuthFailure("invalid_token")
+		w.Header().Set("WWW-Authenticate", `Basic realm="repocraft"`)
+		writeError(w, r, errcode.Errorf(errcode.Unauthenticated, "%w", err))
+		return false
+	}
+	return true
+}
+
+// admitLoad asks Shedder whether the request may start. Clients Auth
+// identified and fetches carrying a token checked by checkFetchToken count
+// as authenticated. It writes a 503
+// response with Retry-After and returns false when the request is shed.
+func (s *Server) admitLoad(w http.ResponseWriter, r *http.Request, svc service.Service) bool {
+	if s.Shedder == nil {
+		return true
+	}
+	authenticated := identified(r) || s.FetchTokens != nil && fetchToken(r) != ""
+	priority := s.Shedder.Classify(svc == service.ServiceReceivePack, authenticated, remoteHost(r))
+	retryAfter, ok := s.Shedder.Allow(priority)
+	if ok {
+		return true
+	}
+	writeError(w, r, &errcode.Error{Code: errcode.Overloaded, Message: "server is overloaded, try again later", RetryAfter: retryAfter})
+	return false
+}
+
+// fetcher returns who Abuse counts the fetches of r against: the identity
+// Auth gave the client, else the token checkFetchToken verifies, else its
+// address, so clients sharing an address don't add up.
+func (s *Server) fetcher(r *http.Request) string {
+	if identified(r) {
+		return identity(r)
+	}
+	if token := fetchToken(r); token != "" && s.FetchTokens != nil {
+		return credusage.TokenID(token)
+	}
+	return remoteHost(r)
+}
+
+// fetchToken returns the token from the "token" query parameter or the
+// Basic auth password, unless Auth identified the client with it.
+func fetchToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if _, password, ok := r.BasicAuth(); ok && !identified(r) {
+		return password
+	}
+	return ""
+}
+
+var errMethodNotAllowed = errcode.New(errcode.MethodNotAllowed, "method not allowed")
+
+// writeError answers with the HTTP status of err, its code in the
+// Repocraft-Error header and errcode.Text(err), translated for the client,
+// as a plain text body, which git shows to the user.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	err = locale.FromContext(r.Context()).Error(err)
+	e := errcode.As(err)
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	w.Header().Set(errcode.Header, string(e.Code))
+	http.Error(w, errcode.Text(err), e.HTTPStatus())
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Limits on the parts of a request read before git is started.
+const (
+	maxHeaderFields = 100
+	maxQueryLength  = 1024
+	maxQueryParams  = 8
+)
+
+// checkRequest rejects requests with more header fields or a longer query
+// than any git client sends, and malformed Git-Protocol headers.
+func checkRequest(r *http.Request) error {
+	if len(r.Header) > maxHeaderFields {
+		return &errcode.Error{Code: errcode.TooLarge, Message: fmt.Sprintf("more than %d header fields", maxHeaderFields), Status: http.StatusRequestHeaderFieldsTooLarge}
+	}
+	if len(r.URL.RawQuery) > maxQueryLength {
+		return &errcode.Error{Code: errcode.TooLarge, Message: fmt.Sprintf("query longer than %d bytes", maxQueryLength), Status: http.StatusRequestURITooLong}
+	}
+	if strings.Count(r.URL.RawQuery, "&") >= maxQueryParams {
+		return errcode.Errorf(errcode.InvalidRequest, "more than %d query parameters", maxQueryParams)
+	}
+	if len(r.Header.Values("Git-Protocol")) > 1 {
+		return errcode.New(errcode.InvalidRequest, "repeated Git-Protocol header")
+	}
+	if err := service.ValidProtocolParams(r.Header.Get("Git-Protocol")); err != nil {
+		return errcode.Errorf(errcode.InvalidRequest, "%w", err)
+	}
+	return nil
+}
+
+// gitProtocolHeader returns the Git-Protocol header, checked by checkRequest.
+func gitProtocolHeader(r *http.Request) string {
+	return r.Header.Get("Git-Protocol")
+}
+
+// protocol returns the Git-Protocol parameters to serve repoPath with,
+// without version 2 where the protocol-v2 flag is off.
+func (s *Server) protocol(r *http.Request, repoPath string) string {
+	params := gitProtocolHeader(r)
+	if !s.Flags.Enabled(featureflag.ProtocolV2, strings.TrimPrefix(repoPath, "/"), remoteHost(r)) {
+		params = service.WithoutProtocolV2(params)
+	}
+	return params
+}
+
 func parseServiceParam(raw string) (service.Service, error) {
 	switch raw {
 	case "git-upload-pack":
@@ -159,22 +833,10 @@ func parseServiceParam(raw string) (service.Service, error) {
 	case "git-receive-pack":
 		return service.ServiceReceivePack, nil
 	default:
-		return "", fmt.Errorf("unsupported service %q", raw)
+		return "", errcode.Errorf(errcode.InvalidRequest, "unsupported service %q", raw)
 	}
 }
 
-func ensureWithinRoot(root, full string) error {
-	rootClean := filepath.Clean(root)
-	fullClean := filepath.Clean(full)
-	if rootClean == fullClean {
-		return nil
-	}
-	if !strings.HasPrefix(fullClean, rootClean+string(os.PathSeparator)) {
-		return errors.New("invalid path traversal")
-	}
-	return nil
-}
-
 func pathClean(p string) string {
 	p = strings.TrimPrefix(p, "/")
 	p = strings.TrimSuffix(p, "/")
@@ -0,0 +1,237 @@
+package httpsmart
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// shadowHeader marks requests sent by Shadow, so the shadow backend can tell
+// them apart from client traffic.
+const shadowHeader = "Repocraft-Shadow"
+
+// Shadow sends a sample of upload-pack requests to a second backend, e.g.
+// one on a new storage layout, and compares its answers and latency with
+// the ones given to the client. The client only ever sees the primary
+// response, and shadow requests never delay it.
+type Shadow struct {
+	// URL is the base URL of the shadow backend.
+	URL string
+	// Percent of upload-pack requests to mirror, from 0 to 100.
+	Percent float64
+	// MaxInFlight bounds concurrent shadow requests; samples beyond it are
+	// dropped. Defaults to 16.
+	MaxInFlight int
+	// Timeout bounds each shadow request; defaults to one minute.
+	Timeout time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// OnCompare receives every comparison; defaults to logging it.
+	OnCompare func(ShadowResult)
+
+	inFlight atomic.Int64
+}
+
+// ShadowResponse describes one side of a mirrored request.
+type ShadowResponse struct {
+	Status   int
+	Bytes    int64
+	SHA256   string
+	Duration time.Duration
+}
+
+// ShadowResult compares the primary and shadow responses to one request.
+// Packs may legitimately differ byte for byte between implementations, so
+// a mismatch on a POST is a hint rather than proof of a bug.
+type ShadowResult struct {
+	Method  string
+	Path    string
+	Primary ShadowResponse
+	Shadow  ShadowResponse
+	Err     error // the shadow request failed
+}
+
+// Match reports whether both sides returned the same status and bytes.
+func (r ShadowResult) Match() bool {
+	return r.Err == nil && r.Primary.Status == r.Shadow.Status && r.Primary.SHA256 == r.Shadow.SHA256
+}
+
+// String formats the result as a single log line.
+func (r ShadowResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s %s primary=%d/%dB/%s shadow error: %v", r.Method, r.Path,
+			r.Primary.Status, r.Primary.Bytes, r.Primary.Duration.Round(time.Millisecond), r.Err)
+	}
+	return fmt.Sprintf("%s %s match=%t primary=%d/%dB/%s shadow=%d/%dB/%s", r.Method, r.Path, r.Match(),
+		r.Primary.Status, r.Primary.Bytes, r.Primary.Duration.Round(time.Millisecond),
+		r.Shadow.Status, r.Shadow.Bytes, r.Shadow.Duration.Round(time.Millisecond))
+}
+
+// sample decides whether to mirror r. If so, it returns a response writer
+// that records the primary response and a function to call once the
+// primary response is complete.
+func (s *Shadow) sample(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if s == nil || s.URL == "" || !isUploadPackRequest(r) || rand.Float64()*100 >= s.Percent {
+		return w, func() {}
+	}
+	limit := int64(s.MaxInFlight)
+	if limit <= 0 {
+		limit = 16
+	}
+	if s.inFlight.Add(1) > limit {
+		s.inFlight.Add(-1)
+		return w, func() {}
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		head, err := io.ReadAll(io.LimitReader(r.Body, maxReplayBody+1))
+		if err != nil || len(head) > maxReplayBody {
+			// Too large to replay; serve it unmirrored.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+			s.inFlight.Add(-1)
+			return w, func() {}
+		}
+		body = head
+		r.Body = io.NopCloser(bytes.NewReader(head))
+	}
+
+	shadowDone := make(chan ShadowResult, 1)
+	go func() {
+		shadowDone <- s.send(r, body)
+	}()
+	rec := &responseRecorder{ResponseWriter: w, hash: sha256.New()}
+	start := time.Now()
+	return rec, func() {
+		primary := rec.response(time.Since(start))
+		go func() {
+			defer s.inFlight.Add(-1)
+			res := <-shadowDone
+			res.Primary = primary
+			if s.OnCompare != nil {
+				s.OnCompare(res)
+			} else {
+				slog.Info("shadow compared", "method", res.Method, "path", res.Path, "match", res.Match(),
+					"primary_status", res.Primary.Status, "primary_bytes", res.Primary.Bytes, "primary_duration", res.Primary.Duration,
+					"shadow_status", res.Shadow.Status, "shadow_bytes", res.Shadow.Bytes, "shadow_duration", res.Shadow.Duration, "error", res.Err)
+			}
+		}()
+	}
+}
+
+// send replays the request to the shadow backend and digests its answer.
+func (s *Shadow) send(r *http.Request, body []byte) ShadowResult {
+	res := ShadowResult{Method: r.Method, Path: r.URL.Path}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	u := strings.TrimSuffix(s.URL, "/") + r.URL.Path
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, u, bytes.NewReader(body))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	for _, h := range []string{"Content-Type", "Content-Encoding", "Accept", "Git-Protocol", "User-Agent", "Authorization"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set(shadowHeader, "1")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.Shadow = ShadowResponse{
+		Status:   resp.StatusCode,
+		Bytes:    n,
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+		Duration: time.Since(start),
+	}
+	return res
+}
+
+func isUploadPackRequest(r *http.Request) bool {
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/info/refs"):
+		return r.URL.Query().Get("service") == "git-upload-pack"
+	case r.Method == http.MethodPost:
+		return strings.HasSuffix(r.URL.Path, "/git-upload-pack")
+	}
+	return false
+}
+
+// responseRecorder digests a response on its way to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+	hash   hash.Hash
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if rr.status == 0 {
+		rr.status = code
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.hash.Write(p)
+	rr.n += int64(len(p))
+	return rr.ResponseWriter.Write(p)
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rr *responseRecorder) response(d time.Duration) ShadowResponse {
+	status := rr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return ShadowResponse{
+		Status:   status,
+		Bytes:    rr.n,
+		SHA256:   hex.EncodeToString(rr.hash.Sum(nil)),
+		Duration: d,
+	}
+}
@@ -0,0 +1,78 @@
+package httpsmart
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/tracing"
+)
+
+// trace starts the span of r, named after its method and endpoint, and
+// returns the writer recording the response status and r carrying the
+// span. Requests forwarded by Proxy continue the trace. finish ends the
+// span once the response is written.
+func (s *Server) trace(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	ctx, span := s.Tracer.Start(tracing.Extract(r.Context(), r.Header), r.Method+" "+endpoint(r.URL.Path), tracing.Server,
+		"http.request.method", r.Method,
+		"url.path", r.URL.Path,
+		"client.address", remoteHost(r),
+		"user_agent.original", r.UserAgent())
+	if repo := proxiedRepo(r.URL.Path); repo != "" {
+		span.SetAttributes("repo", repo)
+	}
+	span.Inject(r.Header)
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, r.WithContext(ctx), func() {
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes("http.response.status_code", status)
+		var err error
+		if status >= 500 {
+			err = fmt.Errorf("%d %s", status, http.StatusText(status))
+		}
+		span.End(err)
+	}
+}
+
+// endpoint returns the git endpoint urlPath is for, such as "info/refs".
+func endpoint(urlPath string) string {
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack", "/git-upload-archive", bundleSuffix} {
+		if strings.HasSuffix(urlPath, suffix) {
+			return strings.TrimPrefix(suffix, "/")
+		}
+	}
+	return "other"
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
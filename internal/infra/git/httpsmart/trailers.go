@@ -0,0 +1,60 @@
+package httpsmart
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/locale"
+)
+
+// errorMessageTrailer carries the message of a streamed response that
+// failed, next to its code in the errcode.Header trailer.
+const errorMessageTrailer = "Repocraft-Error-Message"
+
+// streamedResponse is a response git streams its output into. Once output
+// has begun the status can no longer change, so a failure is reported at
+// the end instead: as an ERR pkt-line for git, and in trailers for clients
+// and proxies that only look at HTTP. A response ending without the
+// trailers succeeded, or was cut off.
+type streamedResponse struct {
+	http.ResponseWriter
+	written bool
+}
+
+// newStreamedResponse announces the error trailers, as proxies may drop
+// trailers they weren't told about, and returns w wrapped.
+func newStreamedResponse(w http.ResponseWriter) *streamedResponse {
+	w.Header().Set("Trailer", errcode.Header+", "+errorMessageTrailer)
+	return &streamedResponse{ResponseWriter: w}
+}
+
+func (sr *streamedResponse) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		sr.written = true
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *streamedResponse) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// fail reports err, which ended the response. Before any output it is an
+// ordinary error response with the status for err.
+func (sr *streamedResponse) fail(r *http.Request, err error) {
+	if !sr.written {
+		sr.Header().Del("Trailer")
+		writeError(sr.ResponseWriter, r, err)
+		return
+	}
+	err = locale.FromContext(r.Context()).Error(err)
+	if !service.Reported(err) {
+		_ = service.WriteErr(sr.ResponseWriter, err)
+	}
+	sr.Header().Set(errcode.Header, string(errcode.CodeOf(err)))
+	sr.Header().Set(errorMessageTrailer, strings.Join(strings.Fields(err.Error()), " "))
+}
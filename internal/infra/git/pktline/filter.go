@@ -0,0 +1,91 @@
+package pktline
+
+import (
+	"io"
+	"strconv"
+)
+
+// FilterFunc receives every packet written through a FilterWriter and
+// decides what to emit in its place by writing to w. The payload is only
+// valid during the call. Returning ErrPassthrough stops filtering: the
+// packet and all remaining bytes are copied unchanged.
+type FilterFunc func(p Packet, w *Writer) error
+
+// ErrPassthrough may be returned by a FilterFunc to disable further filtering.
+var ErrPassthrough = passthroughError{}
+
+type passthroughError struct{}
+
+func (passthroughError) Error() string { return "pktline: passthrough" }
+
+// FilterWriter is an io.Writer that reframes a pkt-line stream, handing each
+// packet to a FilterFunc. Bytes that are not pkt-line framed (such as a raw
+// pack sent without side-band) switch the writer to passthrough mode.
+type FilterWriter struct {
+	dst io.Writer
+	w   *Writer
+	fn  FilterFunc
+	buf []byte
+	raw bool
+}
+
+// NewFilterWriter returns a FilterWriter writing filtered packets to dst.
+func NewFilterWriter(dst io.Writer, fn FilterFunc) *FilterWriter {
+	return &FilterWriter{dst: dst, w: NewWriter(dst), fn: fn}
+}
+
+// Write implements io.Writer.
+func (f *FilterWriter) Write(p []byte) (int, error) {
+	if f.raw {
+		return f.dst.Write(p)
+	}
+	f.buf = append(f.buf, p...)
+	for len(f.buf) >= 4 {
+		n, err := strconv.ParseUint(string(f.buf[:4]), 16, 16)
+		if err != nil || n == 3 {
+			return len(p), f.passthrough()
+		}
+
+		var pkt Packet
+		var size int
+		switch n {
+		case 0:
+			pkt, size = Packet{Type: Flush}, 4
+		case 1:
+			pkt, size = Packet{Type: Delim}, 4
+		case 2:
+			pkt, size = Packet{Type: ResponseEnd}, 4
+		default:
+			size = int(n)
+			if len(f.buf) < size {
+				return len(p), nil
+			}
+			pkt = Packet{Type: Data, Payload: f.buf[4:size]}
+		}
+
+		if err := f.fn(pkt, f.w); err != nil {
+			if err == ErrPassthrough {
+				return len(p), f.passthrough()
+			}
+			return 0, err
+		}
+		f.buf = f.buf[size:]
+	}
+	return len(p), nil
+}
+
+// Close flushes any bytes still buffered as an incomplete packet.
+func (f *FilterWriter) Close() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	return f.passthrough()
+}
+
+func (f *FilterWriter) passthrough() error {
+	f.raw = true
+	buf := f.buf
+	f.buf = nil
+	_, err := f.dst.Write(buf)
+	return err
+}
@@ -0,0 +1,125 @@
+// Package pktline reads and writes the pkt-line framing used by the Git wire protocol.
+package pktline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MaxPayload is the largest payload a single pkt-line may carry.
+const MaxPayload = 65516
+
+// Type distinguishes data packets from the special zero-length packets.
+type Type int
+
+const (
+	Data        Type = iota
+	Flush            // 0000
+	Delim            // 0001, protocol v2 section delimiter
+	ResponseEnd      // 0002, protocol v2 stateless response end
+)
+
+// ErrInvalidLength is returned for malformed length prefixes.
+var ErrInvalidLength = errors.New("pktline: invalid length")
+
+// Packet is one decoded pkt-line. Payload is only set for Data packets.
+type Packet struct {
+	Type    Type
+	Payload []byte
+}
+
+// Encode returns the framed representation of p.
+func (p Packet) Encode() []byte {
+	switch p.Type {
+	case Flush:
+		return []byte("0000")
+	case Delim:
+		return []byte("0001")
+	case ResponseEnd:
+		return []byte("0002")
+	default:
+		return append([]byte(fmt.Sprintf("%04x", len(p.Payload)+4)), p.Payload...)
+	}
+}
+
+// Reader decodes pkt-lines from an underlying stream.
+type Reader struct {
+	r   io.Reader
+	hdr [4]byte
+	// MaxPayload optionally lowers the accepted payload size.
+	MaxPayload int
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadPacket reads the next packet. It returns io.EOF only at a clean packet boundary.
+func (r *Reader) ReadPacket() (Packet, error) {
+	if _, err := io.ReadFull(r.r, r.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Packet{}, ErrInvalidLength
+		}
+		return Packet{}, err
+	}
+	n, err := strconv.ParseUint(string(r.hdr[:]), 16, 16)
+	if err != nil {
+		return Packet{}, ErrInvalidLength
+	}
+	switch n {
+	case 0:
+		return Packet{Type: Flush}, nil
+	case 1:
+		return Packet{Type: Delim}, nil
+	case 2:
+		return Packet{Type: ResponseEnd}, nil
+	case 3:
+		return Packet{}, ErrInvalidLength
+	}
+
+	size := int(n) - 4
+	max := MaxPayload
+	if r.MaxPayload > 0 && r.MaxPayload < max {
+		max = r.MaxPayload
+	}
+	if size > max {
+		return Packet{}, fmt.Errorf("pktline: payload of %d bytes exceeds limit of %d", size, max)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return Packet{}, fmt.Errorf("pktline: truncated payload: %w", err)
+	}
+	return Packet{Type: Data, Payload: payload}, nil
+}
+
+// Writer encodes pkt-lines onto an underlying stream.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WritePacket writes p.
+func (w *Writer) WritePacket(p Packet) error {
+	if p.Type == Data && len(p.Payload) > MaxPayload {
+		return fmt.Errorf("pktline: payload of %d bytes exceeds limit", len(p.Payload))
+	}
+	_, err := w.w.Write(p.Encode())
+	return err
+}
+
+// WriteString writes s as a single data packet.
+func (w *Writer) WriteString(s string) error {
+	return w.WritePacket(Packet{Type: Data, Payload: []byte(s)})
+}
+
+// Flush writes a flush packet.
+func (w *Writer) Flush() error {
+	return w.WritePacket(Packet{Type: Flush})
+}
@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Cache shares open Repository handles between requests so pack mappings and
+// object caches survive across calls. The zero value is ready to use.
+type Cache struct {
+	mu    sync.Mutex
+	repos map[string]*Repository
+}
+
+// Open returns the cached handle for gitDir, opening it on first use.
+func (c *Cache) Open(gitDir string) (*Repository, error) {
+	key := filepath.Clean(gitDir)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.repos[key]; ok {
+		return r, nil
+	}
+	r, err := Open(key)
+	if err != nil {
+		return nil, err
+	}
+	if c.repos == nil {
+		c.repos = make(map[string]*Repository)
+	}
+	c.repos[key] = r
+	return r, nil
+}
+
+// Evict closes and forgets the handle for gitDir, e.g. after the repository
+// was deleted or moved.
+func (c *Cache) Evict(gitDir string) {
+	key := filepath.Clean(gitDir)
+	c.mu.Lock()
+	r, ok := c.repos[key]
+	delete(c.repos, key)
+	c.mu.Unlock()
+	if ok {
+		_ = r.Close()
+	}
+}
+
+// Close releases every cached repository.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	repos := c.repos
+	c.repos = nil
+	c.mu.Unlock()
+	for _, r := range repos {
+		_ = r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature is an author or committer line.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// Commit is a parsed commit object.
+type Commit struct {
+	Hash      Hash
+	Tree      Hash
+	Parents   []Hash
+	Author    Signature
+	Committer Signature
+	Message   string
+}
+
+// Commit reads and parses the commit h, peeling annotated tags.
+func (r *Repository) Commit(h Hash) (*Commit, error) {
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		obj, err := r.Object(h)
+		if err != nil {
+			return nil, err
+		}
+		switch obj.Type {
+		case ObjectCommit:
+			return parseCommit(h, obj.Data)
+		case ObjectTag:
+			target, err := tagTarget(obj.Data)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %w", h, err)
+			}
+			h = target
+		default:
+			return nil, fmt.Errorf("object %s is a %s, not a commit", h, obj.Type)
+		}
+	}
+	return nil, fmt.Errorf("tag chain too deep at %s", h)
+}
+
+func tagTarget(data []byte) (Hash, error) {
+	line, _, _ := bytes.Cut(data, []byte{'\n'})
+	hex, ok := strings.CutPrefix(string(line), "object ")
+	if !ok {
+		return ZeroHash, fmt.Errorf("missing object header")
+	}
+	return ParseHash(hex)
+}
+
+func parseCommit(h Hash, data []byte) (*Commit, error) {
+	c := &Commit{Hash: h}
+	header, message, _ := bytes.Cut(data, []byte("\n\n"))
+	c.Message = string(message)
+
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			tree, err := ParseHash(value)
+			if err != nil {
+				return nil, fmt.Errorf("commit %s: %w", h, err)
+			}
+			c.Tree = tree
+		case "parent":
+			parent, err := ParseHash(value)
+			if err != nil {
+				return nil, fmt.Errorf("commit %s: %w", h, err)
+			}
+			c.Parents = append(c.Parents, parent)
+		case "author":
+			c.Author = parseSignature(value)
+		case "committer":
+			c.Committer = parseSignature(value)
+		}
+	}
+	if c.Tree.IsZero() {
+		return nil, fmt.Errorf("commit %s: missing tree", h)
+	}
+	return c, nil
+}
+
+// parseSignature parses "Name <email> 1700000000 +0100".
+func parseSignature(s string) Signature {
+	var sig Signature
+	open := strings.IndexByte(s, '<')
+	closing := strings.LastIndexByte(s, '>')
+	if open < 0 || closing < open {
+		sig.Name = s
+		return sig
+	}
+	sig.Name = strings.TrimSpace(s[:open])
+	sig.Email = s[open+1 : closing]
+
+	fields := strings.Fields(s[closing+1:])
+	if len(fields) == 0 {
+		return sig
+	}
+	secs, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return sig
+	}
+	loc := time.UTC
+	if len(fields) > 1 && len(fields[1]) == 5 {
+		hours, errH := strconv.Atoi(fields[1][1:3])
+		mins, errM := strconv.Atoi(fields[1][3:5])
+		if errH == nil && errM == nil {
+			offset := hours*3600 + mins*60
+			if fields[1][0] == '-' {
+				offset = -offset
+			}
+			loc = time.FixedZone(fields[1], offset)
+		}
+	}
+	sig.When = time.Unix(secs, 0).In(loc)
+	return sig
+}
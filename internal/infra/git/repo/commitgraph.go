@@ -0,0 +1,303 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var graphMagic = []byte("CGPH")
+
+const (
+	graphParentNone  = 0x70000000
+	graphParentEdges = 0x80000000
+	graphDataWidth   = 36
+)
+
+// commitGraph is a memory-mapped commit-graph: objects/info/commit-graph,
+// or the layers listed in objects/info/commit-graphs/commit-graph-chain.
+// Commits are numbered across layers, base layer first.
+type commitGraph struct {
+	layers []*graphLayer
+	count  int
+
+	// users and retired are guarded by Repository.mu, as for packFile.
+	users   int
+	retired bool
+}
+
+// graphLayer is one commit-graph file. Its parent positions count the
+// commits of the layers below it first.
+type graphLayer struct {
+	data    []byte
+	release func() error
+	base    int
+	count   int
+	fanout  []byte
+	oids    []byte
+	cdat    []byte
+	edges   []byte
+}
+
+// HasCommitGraph reports whether the repository has a commit-graph, which
+// makes comparing commits fast.
+func (r *Repository) HasCommitGraph() bool {
+	g, err := r.loadCommitGraph()
+	r.releaseCommitGraph(g)
+	return err == nil && g != nil
+}
+
+// loadCommitGraph (re)maps the commit-graph when its file or chain
+// changes. The caller must hand the graph to releaseCommitGraph once it is
+// done reading it. Like packs, replaced graphs stay mapped until the reads
+// still using them are done.
+func (r *Repository) loadCommitGraph() (*commitGraph, error) {
+	info := filepath.Join(r.gitDir, "objects", "info")
+	file := filepath.Join(info, "commit-graph")
+	chain := filepath.Join(info, "commit-graphs", "commit-graph-chain")
+	st, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		file = ""
+		st, err = os.Stat(chain)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.graph != nil && r.graphStamp == stampOf(st) {
+		r.graph.users++
+		return r.graph, nil
+	}
+	var files []string
+	if file != "" {
+		files = []string{file}
+	} else if files, err = readGraphChain(chain); err != nil {
+		return nil, err
+	}
+	g := &commitGraph{}
+	for _, f := range files {
+		layer, err := openGraphLayer(f, g.count)
+		if err != nil {
+			g.close()
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		g.layers = append(g.layers, layer)
+		g.count += layer.count
+	}
+	if r.graph != nil {
+		_ = r.graph.retire()
+	}
+	r.graph, r.graphStamp = g, stampOf(st)
+	g.users++
+	return g, nil
+}
+
+// releaseCommitGraph ends the read of g, returned by loadCommitGraph,
+// unmapping it if it was replaced meanwhile. g may be nil.
+func (r *Repository) releaseCommitGraph(g *commitGraph) {
+	if g == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g.users--
+	if g.retired && g.users == 0 {
+		_ = g.close()
+	}
+}
+
+// readGraphChain returns the files of a split commit-graph, base first.
+func readGraphChain(chain string) ([]string, error) {
+	f, err := os.Open(chain)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var files []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		name := strings.TrimSpace(sc.Text())
+		if _, err := ParseHash(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", chain, err)
+		}
+		files = append(files, filepath.Join(filepath.Dir(chain), "graph-"+name+".graph"))
+	}
+	return files, sc.Err()
+}
+
+func openGraphLayer(path string, base int) (*graphLayer, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &graphLayer{data: data, release: release, base: base}
+	if err := l.parse(); err != nil {
+		_ = release()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *graphLayer) parse() error {
+	const header = 8
+	d := l.data
+	if len(d) < header || !bytes.Equal(d[:4], graphMagic) {
+		return errors.New("not a commit-graph")
+	}
+	if d[4] != 1 || d[5] != 1 {
+		return fmt.Errorf("unsupported commit-graph version %d with hash version %d", d[4], d[5])
+	}
+	chunks := int(d[6])
+	table := d[header:]
+	if len(table) < (chunks+1)*12 {
+		return errors.New("truncated commit-graph")
+	}
+	for i := 0; i < chunks; i++ {
+		entry := table[i*12:]
+		start := binary.BigEndian.Uint64(entry[4:])
+		end := binary.BigEndian.Uint64(entry[16:])
+		if start > end || end > uint64(len(d)) {
+			return errors.New("invalid commit-graph chunk")
+		}
+		chunk := d[start:end]
+		switch string(entry[:4]) {
+		case "OIDF":
+			l.fanout = chunk
+		case "OIDL":
+			l.oids = chunk
+		case "CDAT":
+			l.cdat = chunk
+		case "EDGE":
+			l.edges = chunk
+		}
+	}
+	if len(l.fanout) != 256*4 {
+		return errors.New("missing commit-graph fanout")
+	}
+	l.count = int(binary.BigEndian.Uint32(l.fanout[255*4:]))
+	if len(l.oids) < l.count*20 || len(l.cdat) < l.count*graphDataWidth {
+		return errors.New("truncated commit-graph")
+	}
+	return nil
+}
+
+func (g *commitGraph) close() error {
+	var errs []error
+	for _, l := range g.layers {
+		errs = append(errs, l.release())
+	}
+	return errors.Join(errs...)
+}
+
+// retire unmaps g, or marks it to be unmapped after the reads in progress.
+func (g *commitGraph) retire() error {
+	g.retired = true
+	if g.users > 0 {
+		return nil
+	}
+	return g.close()
+}
+
+// find returns the position of commit h in the graph.
+func (g *commitGraph) find(h Hash) (int, bool) {
+	for _, l := range g.layers {
+		lo := 0
+		if h[0] > 0 {
+			lo = int(binary.BigEndian.Uint32(l.fanout[(int(h[0])-1)*4:]))
+		}
+		hi := int(binary.BigEndian.Uint32(l.fanout[int(h[0])*4:]))
+		i := lo + sort.Search(hi-lo, func(i int) bool {
+			return bytes.Compare(l.oids[(lo+i)*20:(lo+i+1)*20], h[:]) >= 0
+		})
+		if i < hi && bytes.Equal(l.oids[i*20:(i+1)*20], h[:]) {
+			return l.base + i, true
+		}
+	}
+	return 0, false
+}
+
+// layer returns the layer holding pos and the index of pos in it.
+func (g *commitGraph) layer(pos int) (*graphLayer, int) {
+	for _, l := range g.layers {
+		if pos < l.base+l.count {
+			return l, pos - l.base
+		}
+	}
+	return nil, 0
+}
+
+func (g *commitGraph) hash(pos int) Hash {
+	var h Hash
+	if l, i := g.layer(pos); l != nil {
+		copy(h[:], l.oids[i*20:])
+	}
+	return h
+}
+
+// generation returns the topological level of the commit at pos: one more
+// than the highest level of its parents. It is zero for graphs written
+// without generation numbers.
+func (g *commitGraph) generation(pos int) uint32 {
+	l, i := g.layer(pos)
+	if l == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(l.cdat[i*graphDataWidth+28:]) >> 2
+}
+
+// parents returns the parents of the commit at pos.
+func (g *commitGraph) parents(pos int) ([]Hash, error) {
+	l, i := g.layer(pos)
+	if l == nil {
+		return nil, fmt.Errorf("commit-graph position %d out of range", pos)
+	}
+	row := l.cdat[i*graphDataWidth:]
+	var parents []Hash
+	add := func(p uint32) error {
+		if int(p) >= g.count {
+			return fmt.Errorf("commit-graph parent %d out of range", p)
+		}
+		parents = append(parents, g.hash(int(p)))
+		return nil
+	}
+	p1 := binary.BigEndian.Uint32(row[20:])
+	p2 := binary.BigEndian.Uint32(row[24:])
+	if p1 == graphParentNone {
+		return nil, nil
+	}
+	if err := add(p1); err != nil {
+		return nil, err
+	}
+	switch {
+	case p2 == graphParentNone:
+	case p2&graphParentEdges == 0:
+		if err := add(p2); err != nil {
+			return nil, err
+		}
+	default:
+		for e := int(p2 &^ graphParentEdges); ; e++ {
+			if (e+1)*4 > len(l.edges) {
+				return nil, errors.New("truncated commit-graph edges")
+			}
+			v := binary.BigEndian.Uint32(l.edges[e*4:])
+			if err := add(v &^ graphParentEdges); err != nil {
+				return nil, err
+			}
+			if v&graphParentEdges != 0 {
+				break
+			}
+		}
+	}
+	return parents, nil
+}
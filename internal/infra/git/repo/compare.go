@@ -0,0 +1,212 @@
+package repo
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// Comparison relates two commits by their history.
+type Comparison struct {
+	// Ahead counts the commits reachable from head but not from base, and
+	// Behind those reachable from base but not from head.
+	Ahead, Behind int
+	// MergeBase is a best common ancestor; zero if the histories are
+	// unrelated.
+	MergeBase Hash
+}
+
+const (
+	fromHead uint8 = 1 << iota
+	fromBase
+	fromBoth = fromHead | fromBase
+)
+
+type walkCommit struct {
+	hash   Hash
+	gen    uint32
+	flags  uint8
+	queued bool
+}
+
+// Compare counts the commits base and head don't share and finds their
+// merge base. Commits are visited by decreasing generation number, so the
+// walk ends as soon as only shared history is left. Generation numbers come
+// from the commit-graph; commits missing from it, e.g. pushed since it was
+// written, get theirs computed from their parents.
+func (r *Repository) Compare(base, head Hash) (Comparison, error) {
+	graph, err := r.loadCommitGraph()
+	if err != nil {
+		return Comparison{}, err
+	}
+	defer r.releaseCommitGraph(graph)
+	w := &walk{r: r, graph: graph, commits: make(map[Hash]*walkCommit), gens: make(map[Hash]uint32)}
+	for _, start := range []struct {
+		h    Hash
+		flag uint8
+	}{{head, fromHead}, {base, fromBase}} {
+		c, err := r.Commit(start.h)
+		if err != nil {
+			return Comparison{}, err
+		}
+		if err := w.mark(c.Hash, start.flag); err != nil {
+			return Comparison{}, err
+		}
+	}
+
+	var cmp Comparison
+	for w.pending > 0 {
+		c := heap.Pop(&w.queue).(*walkCommit)
+		c.queued = false
+		switch c.flags {
+		case fromHead:
+			cmp.Ahead++
+			w.pending--
+		case fromBase:
+			cmp.Behind++
+			w.pending--
+		case fromBoth:
+			if cmp.MergeBase.IsZero() {
+				cmp.MergeBase = c.hash
+			}
+		}
+		parents, err := w.parents(c.hash)
+		if err != nil {
+			return Comparison{}, err
+		}
+		for _, p := range parents {
+			if err := w.mark(p, c.flags); err != nil {
+				return Comparison{}, err
+			}
+		}
+	}
+	// Everything left is shared; the newest of it is a best common
+	// ancestor.
+	if cmp.MergeBase.IsZero() && w.queue.Len() > 0 {
+		cmp.MergeBase = w.queue[0].hash
+	}
+	return cmp, nil
+}
+
+// walk is the state of Compare. pending counts the queued commits not yet
+// known to be shared.
+type walk struct {
+	r       *Repository
+	graph   *commitGraph
+	commits map[Hash]*walkCommit
+	// gens holds the generation numbers computed for commits outside the
+	// commit-graph.
+	gens    map[Hash]uint32
+	queue   walkQueue
+	pending int
+}
+
+// mark adds flags to commit h, queueing it if needed.
+func (w *walk) mark(h Hash, flags uint8) error {
+	c, ok := w.commits[h]
+	if !ok {
+		gen, err := w.generation(h)
+		if err != nil {
+			return err
+		}
+		c = &walkCommit{hash: h, gen: gen}
+		w.commits[h] = c
+	}
+	if c.flags|flags == c.flags {
+		return nil
+	}
+	was := c.flags
+	c.flags |= flags
+	switch {
+	case !c.queued:
+		c.queued = true
+		heap.Push(&w.queue, c)
+		if c.flags != fromBoth {
+			w.pending++
+		}
+	case was != fromBoth && c.flags == fromBoth:
+		w.pending--
+	}
+	return nil
+}
+
+func (w *walk) parents(h Hash) ([]Hash, error) {
+	if w.graph != nil {
+		if pos, ok := w.graph.find(h); ok {
+			return w.graph.parents(pos)
+		}
+	}
+	c, err := w.r.Commit(h)
+	if err != nil {
+		return nil, err
+	}
+	return c.Parents, nil
+}
+
+// generation returns the generation number of commit h, from the
+// commit-graph or else computed from the parents' without recursion, as
+// the history outside the graph can be long.
+func (w *walk) generation(h Hash) (uint32, error) {
+	known := func(h Hash) (uint32, bool) {
+		if gen, ok := w.gens[h]; ok {
+			return gen, true
+		}
+		if w.graph != nil {
+			if pos, ok := w.graph.find(h); ok {
+				if gen := w.graph.generation(pos); gen > 0 {
+					return gen, true
+				}
+			}
+		}
+		return 0, false
+	}
+	if gen, ok := known(h); ok {
+		return gen, nil
+	}
+	stack := []Hash{h}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if _, ok := known(top); ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		c, err := w.r.Commit(top)
+		if err != nil {
+			return 0, err
+		}
+		gen, ready := uint32(1), true
+		for _, p := range c.Parents {
+			pg, ok := known(p)
+			if !ok {
+				stack = append(stack, p)
+				ready = false
+			} else if pg+1 > gen {
+				gen = pg + 1
+			}
+		}
+		if ready {
+			w.gens[top] = gen
+			stack = stack[:len(stack)-1]
+		}
+	}
+	gen, _ := known(h)
+	return gen, nil
+}
+
+// walkQueue orders commits by decreasing generation number.
+type walkQueue []*walkCommit
+
+func (q walkQueue) Len() int { return len(q) }
+func (q walkQueue) Less(i, j int) bool {
+	if q[i].gen != q[j].gen {
+		return q[i].gen > q[j].gen
+	}
+	return bytes.Compare(q[i].hash[:], q[j].hash[:]) < 0
+}
+func (q walkQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *walkQueue) Push(x any)   { *q = append(*q, x.(*walkCommit)) }
+func (q *walkQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
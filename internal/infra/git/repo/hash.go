@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Hash is a SHA-1 object name.
+type Hash [20]byte
+
+// ZeroHash is the all-zero object name git uses for "no object".
+var ZeroHash Hash
+
+// ParseHash decodes a 40 character hex object name.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if len(s) != 40 {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	return h, nil
+}
+
+// String returns the hex form of the hash.
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// IsZero reports whether h is the zero hash.
+func (h Hash) IsZero() bool {
+	return h == ZeroHash
+}
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ObjectType is the git object kind.
+type ObjectType int
+
+const (
+	ObjectCommit ObjectType = 1
+	ObjectTree   ObjectType = 2
+	ObjectBlob   ObjectType = 3
+	ObjectTag    ObjectType = 4
+)
+
+// ErrObjectNotFound is returned when an object is neither loose nor packed.
+var ErrObjectNotFound = errors.New("object not found")
+
+func (t ObjectType) valid() bool {
+	return t >= ObjectCommit && t <= ObjectTag
+}
+
+// String returns the name git uses for the type.
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
+	default:
+		return "unknown"
+	}
+}
+
+func parseObjectType(s string) (ObjectType, error) {
+	switch s {
+	case "commit":
+		return ObjectCommit, nil
+	case "tree":
+		return ObjectTree, nil
+	case "blob":
+		return ObjectBlob, nil
+	case "tag":
+		return ObjectTag, nil
+	default:
+		return 0, fmt.Errorf("unknown object type %q", s)
+	}
+}
+
+// Object is a decompressed git object.
+type Object struct {
+	Type ObjectType
+	Data []byte
+}
+
+func readLooseObject(gitDir string, h Hash) (*Object, error) {
+	hex := h.String()
+	f, err := os.Open(filepath.Join(gitDir, "objects", hex[:2], hex[2:]))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("loose object %s: %w", hex, err)
+	}
+	defer zr.Close()
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("loose object %s: %w", hex, err)
+	}
+
+	header, data, found := bytes.Cut(raw, []byte{0})
+	if !found {
+		return nil, fmt.Errorf("loose object %s: missing header", hex)
+	}
+	typeName, sizeStr, found := bytes.Cut(header, []byte{' '})
+	if !found {
+		return nil, fmt.Errorf("loose object %s: malformed header", hex)
+	}
+	typ, err := parseObjectType(string(typeName))
+	if err != nil {
+		return nil, fmt.Errorf("loose object %s: %w", hex, err)
+	}
+	size, err := strconv.Atoi(string(sizeStr))
+	if err != nil || size != len(data) {
+		return nil, fmt.Errorf("loose object %s: size mismatch", hex)
+	}
+	return &Object{Type: typ, Data: data}, nil
+}
@@ -0,0 +1,330 @@
+package repo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	packObjOfsDelta = 6
+	packObjRefDelta = 7
+)
+
+// maxDeltaDepth caps delta chains, the deepest git packs with
+// (pack.depth 4095), so crafted packs can't recurse forever.
+const maxDeltaDepth = 4095
+
+// maxInflateRatio is the most deflate can compress data by; a declared
+// size beyond it can't be inflated from what is left of the pack.
+const maxInflateRatio = 1032
+
+var idxMagic = []byte{0xff, 't', 'O', 'c'}
+
+// packFile is a memory-mapped pack together with its version 2 index.
+type packFile struct {
+	name       string
+	idx        []byte
+	pack       []byte
+	count      int
+	fanout     []byte
+	names      []byte
+	offsets    []byte
+	largeOffs  []byte
+	releaseIdx func() error
+	releasePk  func() error
+
+	// users counts the reads in progress and retired is set once the pack
+	// is gone from the repository, both guarded by Repository.mu. Retired
+	// packs are unmapped when the last read finishes.
+	users   int
+	retired bool
+}
+
+func openPack(idxPath, packPath string) (*packFile, error) {
+	idx, releaseIdx, err := mapFile(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	pack, releasePk, err := mapFile(packPath)
+	if err != nil {
+		_ = releaseIdx()
+		return nil, err
+	}
+
+	p := &packFile{name: packPath, idx: idx, pack: pack, releaseIdx: releaseIdx, releasePk: releasePk}
+	if err := p.parseIndex(); err != nil {
+		_ = p.close()
+		return nil, fmt.Errorf("%s: %w", idxPath, err)
+	}
+	if len(pack) < 12 || string(pack[:4]) != "PACK" {
+		_ = p.close()
+		return nil, fmt.Errorf("%s: invalid pack header", packPath)
+	}
+	return p, nil
+}
+
+func (p *packFile) parseIndex() error {
+	const header = 8
+	const fanoutLen = 256 * 4
+	if len(p.idx) < header+fanoutLen || !bytes.Equal(p.idx[:4], idxMagic) {
+		return errors.New("unsupported pack index (only version 2 is supported)")
+	}
+	if v := binary.BigEndian.Uint32(p.idx[4:8]); v != 2 {
+		return fmt.Errorf("unsupported pack index version %d", v)
+	}
+	p.fanout = p.idx[header : header+fanoutLen]
+	p.count = int(binary.BigEndian.Uint32(p.fanout[255*4:]))
+
+	namesStart := header + fanoutLen
+	crcStart := namesStart + p.count*20
+	offStart := crcStart + p.count*4
+	largeStart := offStart + p.count*4
+	if len(p.idx) < largeStart+40 {
+		return errors.New("truncated pack index")
+	}
+	p.names = p.idx[namesStart:crcStart]
+	p.offsets = p.idx[offStart:largeStart]
+	p.largeOffs = p.idx[largeStart : len(p.idx)-40]
+	return nil
+}
+
+func (p *packFile) close() error {
+	var errs []error
+	if p.releaseIdx != nil {
+		errs = append(errs, p.releaseIdx())
+	}
+	if p.releasePk != nil {
+		errs = append(errs, p.releasePk())
+	}
+	return errors.Join(errs...)
+}
+
+// retire unmaps p, or marks it to be unmapped after the reads in progress.
+func (p *packFile) retire() error {
+	p.retired = true
+	if p.users > 0 {
+		return nil
+	}
+	return p.close()
+}
+
+// find returns the pack offset of h, if present.
+func (p *packFile) find(h Hash) (int64, bool) {
+	lo := 0
+	if h[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(p.fanout[(int(h[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(p.fanout[int(h[0])*4:]))
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.names[(lo+i)*20:(lo+i+1)*20], h[:]) >= 0
+	})
+	if i >= hi || !bytes.Equal(p.names[i*20:(i+1)*20], h[:]) {
+		return 0, false
+	}
+	return p.offsetAt(i), true
+}
+
+func (p *packFile) offsetAt(i int) int64 {
+	off := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if off&0x80000000 == 0 {
+		return int64(off)
+	}
+	large := int(off & 0x7fffffff)
+	return int64(binary.BigEndian.Uint64(p.largeOffs[large*8:]))
+}
+
+// readAt decodes the object at offset, depth deltas down a chain, resolving
+// deltas. Bases stored by reference are looked up through resolve, one
+// level deeper.
+func (p *packFile) readAt(offset int64, depth int, resolve func(Hash, int) (*Object, error)) (*Object, error) {
+	if offset < 12 || offset >= int64(len(p.pack)) {
+		return nil, fmt.Errorf("pack offset %d out of range", offset)
+	}
+	if depth > maxDeltaDepth {
+		return nil, fmt.Errorf("delta chain at pack offset %d deeper than %d", offset, maxDeltaDepth)
+	}
+	pos := int(offset)
+	c := p.pack[pos]
+	pos++
+	typ := int(c>>4) & 7
+	size := int64(c & 0x0f)
+	shift := uint(4)
+	for c&0x80 != 0 {
+		if pos >= len(p.pack) {
+			return nil, errors.New("truncated pack entry header")
+		}
+		c = p.pack[pos]
+		pos++
+		size |= int64(c&0x7f) << shift
+		shift += 7
+	}
+
+	switch typ {
+	case packObjOfsDelta:
+		if pos >= len(p.pack) {
+			return nil, errors.New("truncated ofs-delta")
+		}
+		c = p.pack[pos]
+		pos++
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if pos >= len(p.pack) {
+				return nil, errors.New("truncated ofs-delta")
+			}
+			c = p.pack[pos]
+			pos++
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		if rel <= 0 {
+			// A delta can't be its own base, nor come before it.
+			return nil, fmt.Errorf("invalid ofs-delta base at pack offset %d", offset)
+		}
+		base, err := p.readAt(offset-rel, depth+1, resolve)
+		if err != nil {
+			return nil, err
+		}
+		delta, err := inflate(p.pack[pos:], size)
+		if err != nil {
+			return nil, err
+		}
+		data, err := applyDelta(base.Data, delta)
+		if err != nil {
+			return nil, err
+		}
+		return &Object{Type: base.Type, Data: data}, nil
+	case packObjRefDelta:
+		if pos+20 > len(p.pack) {
+			return nil, errors.New("truncated ref-delta")
+		}
+		var baseHash Hash
+		copy(baseHash[:], p.pack[pos:pos+20])
+		pos += 20
+		base, err := resolve(baseHash, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		delta, err := inflate(p.pack[pos:], size)
+		if err != nil {
+			return nil, err
+		}
+		data, err := applyDelta(base.Data, delta)
+		if err != nil {
+			return nil, err
+		}
+		return &Object{Type: base.Type, Data: data}, nil
+	default:
+		objType := ObjectType(typ)
+		if !objType.valid() {
+			return nil, fmt.Errorf("unknown pack object type %d", typ)
+		}
+		data, err := inflate(p.pack[pos:], size)
+		if err != nil {
+			return nil, err
+		}
+		return &Object{Type: objType, Data: data}, nil
+	}
+}
+
+func inflate(compressed []byte, size int64) ([]byte, error) {
+	if size < 0 || size > int64(len(compressed))*maxInflateRatio {
+		return nil, fmt.Errorf("inflate: object size %d out of range", size)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out := make([]byte, size)
+	if _, err := io.ReadFull(zr, out); err != nil {
+		return nil, fmt.Errorf("inflate: %w", err)
+	}
+	return out, nil
+}
+
+func applyDelta(base, delta []byte) ([]byte, error) {
+	pos := 0
+	readSize := func() (int, error) {
+		size, shift := 0, uint(0)
+		for {
+			if pos >= len(delta) {
+				return 0, errors.New("truncated delta header")
+			}
+			c := delta[pos]
+			pos++
+			size |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				return size, nil
+			}
+		}
+	}
+	srcSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != len(base) {
+		return nil, errors.New("delta base size mismatch")
+	}
+	dstSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every opcode takes at least a byte and copies at most the base or
+	// 127 inserted bytes.
+	if dstSize > len(delta)*max(len(base), 0x7f) {
+		return nil, errors.New("delta result size out of range")
+	}
+	out := make([]byte, 0, dstSize)
+	for pos < len(delta) {
+		op := delta[pos]
+		pos++
+		switch {
+		case op&0x80 != 0:
+			var off, n int
+			for i := uint(0); i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if pos >= len(delta) {
+						return nil, errors.New("truncated delta copy")
+					}
+					off |= int(delta[pos]) << (8 * i)
+					pos++
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if op&(1<<(4+i)) != 0 {
+					if pos >= len(delta) {
+						return nil, errors.New("truncated delta copy")
+					}
+					n |= int(delta[pos]) << (8 * i)
+					pos++
+				}
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if off+n > len(base) {
+				return nil, errors.New("delta copy out of range")
+			}
+			out = append(out, base[off:off+n]...)
+		case op != 0:
+			n := int(op)
+			if pos+n > len(delta) {
+				return nil, errors.New("truncated delta insert")
+			}
+			out = append(out, delta[pos:pos+n]...)
+			pos += n
+		default:
+			return nil, errors.New("invalid delta opcode")
+		}
+	}
+	if len(out) != dstSize {
+		return nil, errors.New("delta result size mismatch")
+	}
+	return out, nil
+}
@@ -0,0 +1,221 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrRefNotFound is returned when a ref cannot be resolved.
+var ErrRefNotFound = errors.New("ref not found")
+
+const maxSymrefDepth = 5
+
+// Ref is a resolved reference. Peeled is set for annotated tags when known.
+type Ref struct {
+	Name   string
+	Target Hash
+	Peeled Hash
+}
+
+type packedRefs struct {
+	stamp fileStamp
+	refs  map[string]Ref
+}
+
+type fileStamp struct {
+	size  int64
+	mtime int64
+}
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{size: info.Size(), mtime: info.ModTime().UnixNano()}
+}
+
+// loadPackedRefs parses packed-refs, reusing the cached copy while the file is unchanged.
+func (r *Repository) loadPackedRefs() (map[string]Ref, error) {
+	path := filepath.Join(r.gitDir, "packed-refs")
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	r.mu.Lock()
+	cached := r.packed
+	r.mu.Unlock()
+	if cached != nil && cached.stamp == stampOf(info) {
+		return cached.refs, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]Ref)
+	var last string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "" || line[0] == '#':
+			continue
+		case line[0] == '^':
+			peeled, err := ParseHash(line[1:])
+			if err != nil || last == "" {
+				return nil, fmt.Errorf("packed-refs: malformed peel line")
+			}
+			ref := refs[last]
+			ref.Peeled = peeled
+			refs[last] = ref
+		default:
+			hex, name, found := strings.Cut(line, " ")
+			if !found {
+				return nil, fmt.Errorf("packed-refs: malformed line %q", line)
+			}
+			h, err := ParseHash(hex)
+			if err != nil {
+				return nil, fmt.Errorf("packed-refs: %w", err)
+			}
+			refs[name] = Ref{Name: name, Target: h}
+			last = name
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.packed = &packedRefs{stamp: stampOf(info), refs: refs}
+	r.mu.Unlock()
+	return refs, nil
+}
+
+// Refs returns all refs under refs/, loose refs taking precedence over packed ones.
+// The result is sorted by name.
+func (r *Repository) Refs() ([]Ref, error) {
+	packed, err := r.loadPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]Ref, len(packed))
+	for name, ref := range packed {
+		merged[name] = ref
+	}
+
+	refsDir := filepath.Join(r.gitDir, "refs")
+	err = filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(r.gitDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		ref, err := r.resolve(name, 0)
+		if err != nil {
+			// Skip refs that are being written or point to missing targets.
+			return nil
+		}
+		if prev, ok := merged[name]; ok && prev.Target == ref.Target {
+			ref.Peeled = prev.Peeled
+		}
+		merged[name] = ref
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]Ref, 0, len(merged))
+	for _, ref := range merged {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs, nil
+}
+
+// ResolveRef resolves a full ref name (or HEAD), following symbolic refs.
+func (r *Repository) ResolveRef(name string) (Ref, error) {
+	return r.resolve(name, 0)
+}
+
+// SymbolicTarget returns the ref name HEAD (or another symref) points to.
+func (r *Repository) SymbolicTarget(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(r.gitDir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(data))
+	target, ok := strings.CutPrefix(line, "ref: ")
+	if !ok {
+		return "", fmt.Errorf("%s is not a symbolic ref", name)
+	}
+	return target, nil
+}
+
+func (r *Repository) resolve(name string, depth int) (Ref, error) {
+	if depth > maxSymrefDepth {
+		return Ref{}, fmt.Errorf("symbolic ref loop at %s", name)
+	}
+	if !validRefName(name) {
+		return Ref{}, fmt.Errorf("invalid ref name %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.gitDir, filepath.FromSlash(name)))
+	if err == nil {
+		line := strings.TrimSpace(string(data))
+		if target, ok := strings.CutPrefix(line, "ref: "); ok {
+			ref, err := r.resolve(target, depth+1)
+			if err != nil {
+				return Ref{}, err
+			}
+			ref.Name = name
+			return ref, nil
+		}
+		h, err := ParseHash(line)
+		if err != nil {
+			return Ref{}, fmt.Errorf("ref %s: %w", name, err)
+		}
+		return Ref{Name: name, Target: h}, nil
+	}
+	// Missing loose files (or a path component that is a file) fall back to packed-refs.
+	packed, err := r.loadPackedRefs()
+	if err != nil {
+		return Ref{}, err
+	}
+	if ref, ok := packed[name]; ok {
+		return ref, nil
+	}
+	return Ref{}, ErrRefNotFound
+}
+
+func validRefName(name string) bool {
+	if name == "HEAD" {
+		return true
+	}
+	if !strings.HasPrefix(name, "refs/") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	return !strings.ContainsAny(name, "\\\x00 ~^:?*[")
+}
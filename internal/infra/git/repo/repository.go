@@ -0,0 +1,236 @@
+package repo
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultObjectCacheSize = 4096
+
+// Repository reads refs and objects of a bare repository directly from disk,
+// without spawning git. Pack files are memory-mapped and parsed objects are
+// kept in a bounded LRU cache. A Repository is safe for concurrent use.
+type Repository struct {
+	gitDir string
+
+	mu         sync.Mutex
+	packed     *packedRefs
+	packs      []*packFile
+	packsStamp fileStamp
+	cacheSize  int
+	cache      map[Hash]*list.Element
+	lru        *list.List
+
+	// graph is the commit-graph, if the repository has one.
+	graph      *commitGraph
+	graphStamp fileStamp
+}
+
+type cacheEntry struct {
+	hash Hash
+	obj  *Object
+}
+
+// Open opens the bare repository at gitDir.
+func Open(gitDir string) (*Repository, error) {
+	info, err := os.Stat(filepath.Join(gitDir, "objects"))
+	if err != nil {
+		return nil, fmt.Errorf("open repository: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("open repository: %s is not a git directory", gitDir)
+	}
+	return &Repository{
+		gitDir:    gitDir,
+		cacheSize: defaultObjectCacheSize,
+		cache:     make(map[Hash]*list.Element),
+		lru:       list.New(),
+	}, nil
+}
+
+// Path returns the repository directory.
+func (r *Repository) Path() string {
+	return r.gitDir
+}
+
+// Close unmaps all pack and commit-graph files. Those still being read are
+// unmapped when the reads finish.
+func (r *Repository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, p := range r.packs {
+		errs = append(errs, p.retire())
+	}
+	r.packs = nil
+	if r.graph != nil {
+		errs = append(errs, r.graph.retire())
+	}
+	r.graph = nil
+	return errors.Join(errs...)
+}
+
+// Object returns the object named h, looking in the cache, loose objects and packs.
+func (r *Repository) Object(h Hash) (*Object, error) {
+	return r.object(h, 0)
+}
+
+// object returns the object named h, as the base of a delta depth deltas
+// down a chain.
+func (r *Repository) object(h Hash, depth int) (*Object, error) {
+	if obj, ok := r.cached(h); ok {
+		return obj, nil
+	}
+
+	obj, err := readLooseObject(r.gitDir, h)
+	if errors.Is(err, ErrObjectNotFound) {
+		obj, err = r.packedObject(h, depth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.remember(h, obj)
+	return obj, nil
+}
+
+func (r *Repository) packedObject(h Hash, depth int) (*Object, error) {
+	packs, err := r.loadPacks()
+	if err != nil {
+		return nil, err
+	}
+	defer r.releasePacks(packs)
+	for _, p := range packs {
+		if off, ok := p.find(h); ok {
+			return p.readAt(off, depth, r.object)
+		}
+	}
+	return nil, ErrObjectNotFound
+}
+
+// loadPacks (re)maps the pack directory when its modification time changes
+// and returns the packs, which the caller must hand to releasePacks once it
+// is done reading them. Packs that disappeared stay mapped until the reads
+// still using them are done.
+func (r *Repository) loadPacks() ([]*packFile, error) {
+	dir := filepath.Join(r.gitDir, "objects", "pack")
+	info, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.packs != nil && r.packsStamp == stampOf(info) {
+		return acquirePacks(r.packs), nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*packFile, len(r.packs))
+	for _, p := range r.packs {
+		existing[p.name] = p
+	}
+	var packs []*packFile
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".idx") {
+			continue
+		}
+		packPath := filepath.Join(dir, strings.TrimSuffix(name, ".idx")+".pack")
+		if p, ok := existing[packPath]; ok {
+			packs = append(packs, p)
+			delete(existing, packPath)
+			continue
+		}
+		p, err := openPack(filepath.Join(dir, name), packPath)
+		if err != nil {
+			// A pack may be mid-rename during repack; it will be picked up next time.
+			continue
+		}
+		packs = append(packs, p)
+	}
+	for _, old := range existing {
+		_ = old.retire()
+	}
+	r.packs = packs
+	r.packsStamp = stampOf(info)
+	return acquirePacks(packs), nil
+}
+
+// acquirePacks counts a read of each of packs. r.mu must be held.
+func acquirePacks(packs []*packFile) []*packFile {
+	for _, p := range packs {
+		p.users++
+	}
+	return packs
+}
+
+// releasePacks ends the read of packs returned by loadPacks, unmapping
+// those retired meanwhile.
+func (r *Repository) releasePacks(packs []*packFile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range packs {
+		p.users--
+		if p.retired && p.users == 0 {
+			_ = p.close()
+		}
+	}
+}
+
+func (r *Repository) cached(h Hash) (*Object, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	el, ok := r.cache[h]
+	if !ok {
+		return nil, false
+	}
+	r.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).obj, true
+}
+
+func (r *Repository) remember(h Hash, obj *Object) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache[h]; ok {
+		return
+	}
+	r.cache[h] = r.lru.PushFront(&cacheEntry{hash: h, obj: obj})
+	for r.lru.Len() > r.cacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*cacheEntry).hash)
+	}
+}
+
+// ResolveRevision resolves a full object name, a full ref name, or a short
+// branch/tag name (in that order) to a hash.
+func (r *Repository) ResolveRevision(rev string) (Hash, error) {
+	if h, err := ParseHash(rev); err == nil {
+		return h, nil
+	}
+	candidates := []string{rev}
+	if !strings.HasPrefix(rev, "refs/") && rev != "HEAD" {
+		candidates = []string{"refs/heads/" + rev, "refs/tags/" + rev}
+	}
+	for _, name := range candidates {
+		ref, err := r.ResolveRef(name)
+		if err == nil {
+			return ref.Target, nil
+		}
+		if !errors.Is(err, ErrRefNotFound) {
+			return ZeroHash, err
+		}
+	}
+	return ZeroHash, fmt.Errorf("%w: %s", ErrRefNotFound, rev)
+}
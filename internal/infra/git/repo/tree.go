@@ -0,0 +1,44 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// TreeEntry is one entry of a tree object.
+type TreeEntry struct {
+	// Mode is git's octal file mode, e.g. "100644" or "40000".
+	Mode string
+	Name string
+	Hash Hash
+}
+
+// IsTree reports whether the entry is a subdirectory.
+func (e TreeEntry) IsTree() bool {
+	return e.Mode == "40000"
+}
+
+// Tree reads the tree h.
+func (r *Repository) Tree(h Hash) ([]TreeEntry, error) {
+	obj, err := r.Object(h)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Type != ObjectTree {
+		return nil, fmt.Errorf("object %s is a %s, not a tree", h, obj.Type)
+	}
+	var entries []TreeEntry
+	data := obj.Data
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+1+len(Hash{}) {
+			return nil, fmt.Errorf("tree %s: malformed entry", h)
+		}
+		e := TreeEntry{Mode: string(data[:sp]), Name: string(data[sp+1 : nul])}
+		copy(e.Hash[:], data[nul+1:])
+		entries = append(entries, e)
+		data = data[nul+1+len(Hash{}):]
+	}
+	return entries, nil
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"bytes"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// ErrWorktreeAttributes is returned for archive requests asking git to take
+// attributes from the working tree. Served repositories have none, so
+// git would ignore the .gitattributes of the archived tree and include the
+// files it marks export-ignore.
+var ErrWorktreeAttributes = errcode.New(errcode.InvalidRequest, "--worktree-attributes is not supported by this server")
+
+// archiveFilter checks the arguments of an upload-archive request, which
+// are sent up to the first flush.
+func archiveFilter(out, pkt, payload []byte) ([]byte, error) {
+	if payload == nil {
+		return out, errPassRest
+	}
+	if string(bytes.TrimSuffix(payload, []byte("\n"))) == "argument --worktree-attributes" {
+		return out, ErrWorktreeAttributes
+	}
+	return append(out, pkt...), nil
+}
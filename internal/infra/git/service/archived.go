@@ -0,0 +1,40 @@
+package service
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// ArchivedKey is the repository config key marking a repository archived.
+// Archived repositories refuse every push; fetches are unaffected.
+const ArchivedKey = "repocraft.archived"
+
+// archivedScript is installed as the pre-receive hook of archived
+// repositories, so clients see why their push was declined, in their
+// language.
+const archivedScript = `#!/bin/sh
+printf '%s\n' "$` + archivedMessageEnv + `" >&2
+exit 1
+`
+
+const archivedMessageEnv = "REPOCRAFT_ARCHIVED_MESSAGE"
+
+var errArchived = errcode.New(errcode.RepoArchived, "This repository is archived and read-only; pushes are not accepted.")
+
+// Archived reports whether the repository at repoPath is archived. Wikis
+// are archived along with their project.
+func Archived(repoPath string) bool {
+	dir := filepath.Clean(repoPath)
+	if project, ok := strings.CutSuffix(dir, WikiSuffix); ok && (archived(project+".git") || archived(project)) {
+		return true
+	}
+	return archived(dir)
+}
+
+func archived(repoPath string) bool {
+	out, err := exec.Command("git", "config", "--file", filepath.Join(repoPath, "config"), "--type=bool", "--get", ArchivedKey).Output()
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
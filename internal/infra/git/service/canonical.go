@@ -0,0 +1,25 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CanonicalKey is the repository config key holding the base URL a
+// repository is served at over HTTP, overriding the server's own.
+const CanonicalKey = "repocraft.canonicalURL"
+
+// ParseCanonicalURL checks a canonical base URL such as
+// "https://git.example.com" or "https://example.com/git" and returns it
+// without a trailing slash.
+func ParseCanonicalURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(strings.TrimSpace(raw), "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid canonical URL %q: %w", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid canonical URL %q: want http(s)://host[:port][/prefix]", raw)
+	}
+	return u, nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+)
+
+// CapabilityPolicy rewrites the capabilities git advertises to clients.
+// Stripping a capability only stops well-behaved clients from using it;
+// enforcement still belongs in hooks or access checks.
+type CapabilityPolicy struct {
+	// Strip removes capabilities by name, e.g. "delete-refs" or "push-options".
+	Strip []string
+	// Add appends capabilities, e.g. "no-thin" or "session-id=abc".
+	Add []string
+	// Agent replaces the agent=... capability value, e.g. "repocraft/1.0".
+	Agent string
+}
+
+// IsZero reports whether the policy leaves advertisements untouched.
+func (p CapabilityPolicy) IsZero() bool {
+	return len(p.Strip) == 0 && len(p.Add) == 0 && p.Agent == ""
+}
+
+// CapabilityPolicies holds a CapabilityPolicy per service.
+type CapabilityPolicies struct {
+	UploadPack  CapabilityPolicy
+	ReceivePack CapabilityPolicy
+}
+
+// For returns the policy for svc.
+func (p CapabilityPolicies) For(svc Service) CapabilityPolicy {
+	switch svc {
+	case ServiceReceivePack:
+		return p.ReceivePack
+	case ServiceUploadPack:
+		return p.UploadPack
+	}
+	return CapabilityPolicy{}
+}
+
+func (p CapabilityPolicy) strips(name string) bool {
+	for _, s := range p.Strip {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteList rewrites a space separated v0 capability list.
+func (p CapabilityPolicy) rewriteList(caps string) string {
+	var out []string
+	for _, c := range strings.Fields(caps) {
+		name, _, _ := strings.Cut(c, "=")
+		if p.strips(name) {
+			continue
+		}
+		if name == "agent" && p.Agent != "" {
+			c = "agent=" + p.Agent
+		}
+		out = append(out, c)
+	}
+	return strings.Join(append(out, p.Add...), " ")
+}
+
+// capabilityFilter rewrites the capability advertisement at the start of a
+// response: the NUL-separated list on the first ref line for protocol v0/v1,
+// or the capability lines before the first flush for protocol v2. Everything
+// after the advertisement is passed through.
+func capabilityFilter(p CapabilityPolicy, v2 bool) pktline.FilterFunc {
+	done := false
+	return func(pkt pktline.Packet, w *pktline.Writer) error {
+		if done {
+			return pktline.ErrPassthrough
+		}
+		if pkt.Type == pktline.Flush {
+			if v2 {
+				for _, c := range p.Add {
+					if err := w.WriteString(c + "\n"); err != nil {
+						return err
+					}
+				}
+			}
+			return pktline.ErrPassthrough
+		}
+		if pkt.Type != pktline.Data {
+			return pktline.ErrPassthrough
+		}
+
+		line := bytes.TrimSuffix(pkt.Payload, []byte("\n"))
+		if v2 {
+			name, _, _ := strings.Cut(string(line), "=")
+			switch {
+			case strings.HasPrefix(name, "version "):
+				// The "version 2" line opens the advertisement and is
+				// never a capability to strip.
+			case p.strips(name):
+				return nil
+			case name == "agent" && p.Agent != "":
+				return w.WriteString("agent=" + p.Agent + "\n")
+			}
+			return w.WritePacket(pkt)
+		}
+
+		refPart, caps, found := bytes.Cut(line, []byte{0})
+		if !found {
+			// "version 1" precedes the first ref line.
+			return w.WritePacket(pkt)
+		}
+		done = true
+		return w.WriteString(string(refPart) + "\x00" + p.rewriteList(string(caps)) + "\n")
+	}
+}
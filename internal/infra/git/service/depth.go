@@ -0,0 +1,208 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+)
+
+// ErrDepthLimit is returned when a fetch asks for more history than the
+// repository's DepthLimit allows.
+var ErrDepthLimit = errcode.New(errcode.LimitExceeded, "depth limit exceeded")
+
+// DepthLimit caps the history clients may fetch from a repository, to keep
+// full clones of huge repositories off the storage nodes.
+type DepthLimit struct {
+	// Max is the largest depth a fetch may ask for. Full clones and deeper
+	// fetches are refused with a hint to use --depth; zero means no limit.
+	Max int
+	// Convert serves such fetches at depth Max instead of refusing them.
+	// Protocol v0 clients only accept this when they asked for a depth
+	// themselves, so their full clones are still refused, as is
+	// fetch --unshallow.
+	Convert bool
+}
+
+// DepthPolicy selects the DepthLimit of each repository.
+type DepthPolicy struct {
+	Default DepthLimit
+	// PerRepo overrides Default for the given repositories, keyed by the
+	// repository path relative to the root (e.g. "owner/repo.git").
+	PerRepo map[string]DepthLimit
+}
+
+// For returns the limit for repo.
+func (p DepthPolicy) For(repo string) DepthLimit {
+	if l, ok := p.PerRepo[strings.Trim(repo, "/")]; ok {
+		return l
+	}
+	return p.Default
+}
+
+// depthFilter enforces a DepthLimit on an upload-pack request. It holds
+// back the part of the request carrying wants and deepen lines until it is
+// complete, then passes it on, rewritten or refused.
+type depthFilter struct {
+	limit DepthLimit
+	repo  string
+	v2    bool
+
+	held     [][]byte // encoded packets held back
+	holding  bool
+	awaitEnd bool // v0: wants without deepen seen, waiting to tell a clone from a fetch
+	done     bool // v0: the first section was let through
+}
+
+func newDepthFilter(limit DepthLimit, req ServiceRequest) *depthFilter {
+	return &depthFilter{limit: limit, repo: req.RepoName, v2: req.IsProtocolV2()}
+}
+
+func (d *depthFilter) packet(out, pkt, payload []byte) ([]byte, error) {
+	line := string(bytes.TrimSuffix(payload, []byte("\n")))
+	if d.v2 {
+		return d.packetV2(out, pkt, line)
+	}
+	return d.packetV0(out, pkt, line)
+}
+
+// packetV0 holds the first section, the wants and deepen lines up to a
+// flush. Without deepen, a clone is told apart from a fetch by the next
+// line: clones send done, fetches their haves.
+func (d *depthFilter) packetV0(out, pkt []byte, line string) ([]byte, error) {
+	if d.done {
+		return append(out, pkt...), nil
+	}
+	if d.awaitEnd {
+		if line == "done" {
+			return out, d.fullCloneError()
+		}
+		d.done = true
+		return append(d.release(out), pkt...), nil
+	}
+	d.held = append(d.held, pkt)
+	if string(pkt) != "0000" {
+		return out, nil
+	}
+	wants, fetch, depth, deepenAt := d.scanHeld()
+	switch {
+	case !wants || (fetch && deepenAt < 0):
+		d.done = true
+	case deepenAt < 0:
+		d.awaitEnd = true
+		return out, nil
+	case depth > d.limit.Max:
+		if !d.limit.Convert || depth == unshallowDepth {
+			return out, d.depthError(depth)
+		}
+		d.held[deepenAt] = deepenPacket(d.limit.Max)
+		d.done = true
+	default:
+		d.done = true
+	}
+	return d.release(out), nil
+}
+
+// packetV2 holds each fetch command up to its flush.
+func (d *depthFilter) packetV2(out, pkt []byte, line string) ([]byte, error) {
+	if !d.holding {
+		if line != "command=fetch" {
+			return append(out, pkt...), nil
+		}
+		d.holding = true
+	}
+	d.held = append(d.held, pkt)
+	if string(pkt) != "0000" {
+		return out, nil
+	}
+	d.holding = false
+	wants, fetch, depth, deepenAt := d.scanHeld()
+	switch {
+	case !wants:
+	case deepenAt < 0 && !fetch:
+		if !d.limit.Convert {
+			return out, d.fullCloneError()
+		}
+		// Ask for depth Max just before the closing flush.
+		flush := d.held[len(d.held)-1]
+		d.held = append(d.held[:len(d.held)-1], deepenPacket(d.limit.Max), flush)
+	case deepenAt >= 0 && depth > d.limit.Max:
+		if !d.limit.Convert || depth == unshallowDepth {
+			return out, d.depthError(depth)
+		}
+		d.held[deepenAt] = deepenPacket(d.limit.Max)
+	}
+	return d.release(out), nil
+}
+
+// scanHeld reports whether the held packets want anything, whether they
+// build on history the client has (haves, shallow, deepen-since or
+// deepen-not), and the deepen line, if any.
+func (d *depthFilter) scanHeld() (wants, fetch bool, depth, deepenAt int) {
+	deepenAt = -1
+	for i, pkt := range d.held {
+		if len(pkt) <= 4 {
+			continue
+		}
+		line := string(bytes.TrimSuffix(pkt[4:], []byte("\n")))
+		switch {
+		case strings.HasPrefix(line, "want ") || strings.HasPrefix(line, "want-ref "):
+			wants = true
+		case strings.HasPrefix(line, "have "), strings.HasPrefix(line, "shallow "),
+			strings.HasPrefix(line, "deepen-since "), strings.HasPrefix(line, "deepen-not "):
+			fetch = true
+		case strings.HasPrefix(line, "deepen "):
+			if n, err := strconv.Atoi(line[len("deepen "):]); err == nil {
+				depth, deepenAt = n, i
+			}
+		}
+	}
+	return wants, fetch, depth, deepenAt
+}
+
+func (d *depthFilter) release(out []byte) []byte {
+	for _, pkt := range d.held {
+		out = append(out, pkt...)
+	}
+	d.held = nil
+	return out
+}
+
+func (d *depthFilter) fullCloneError() error {
+	return fmt.Errorf("%w: %s is too large to clone in full, clone with --depth=%d", ErrDepthLimit, d.repo, d.limit.Max)
+}
+
+func (d *depthFilter) depthError(depth int) error {
+	if depth == unshallowDepth {
+		return fmt.Errorf("%w: %s cannot be unshallowed, fetch with --depth=%d", ErrDepthLimit, d.repo, d.limit.Max)
+	}
+	return fmt.Errorf("%w: %s allows a depth of at most %d", ErrDepthLimit, d.repo, d.limit.Max)
+}
+
+func deepenPacket(depth int) []byte {
+	return pktline.Packet{Type: pktline.Data, Payload: []byte(fmt.Sprintf("deepen %d\n", depth))}.Encode()
+}
+
+// ParseDepthLimits parses a comma-separated list of repo=depth pairs, e.g.
+// "big/monorepo.git=50,big/assets.git=1", into PerRepo limits that convert
+// deeper fetches if convert is set and refuse them otherwise.
+func ParseDepthLimits(s string, convert bool) (map[string]DepthLimit, error) {
+	limits := make(map[string]DepthLimit)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		repo, depth, ok := strings.Cut(pair, "=")
+		repo = strings.Trim(repo, "/")
+		n, err := strconv.Atoi(depth)
+		if !ok || repo == "" || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid depth limit %q, want repo=depth", pair)
+		}
+		limits[repo] = DepthLimit{Max: n, Convert: convert}
+	}
+	return limits, nil
+}
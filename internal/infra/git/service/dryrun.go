@@ -0,0 +1,41 @@
+package service
+
+// dryRunScript is installed as the pre-receive hook when dry-run pushes are
+// enabled. After the repository's own pre-receive hook, a push with the
+// push option "dry-run" runs the repository's update hook for every ref,
+// as receive-pack would next, and is then declined, so no ref changes.
+const dryRunScript = `#!/bin/sh
+updates=$(cat)
+own="$REPOCRAFT_REPO_HOOKS/pre-receive"
+if [ -x "$own" ]; then
+	printf '%s\n' "$updates" | "$own" "$@" || exit 1
+fi
+dry=
+i=0
+while [ "$i" -lt "${GIT_PUSH_OPTION_COUNT:-0}" ]; do
+	eval "opt=\$GIT_PUSH_OPTION_$i"
+	[ "$opt" = dry-run ] && dry=1
+	i=$((i + 1))
+done
+[ -n "$dry" ] || exit 0
+update="$REPOCRAFT_REPO_HOOKS/update"
+printf '%s\n' "$updates" | {
+	n=0
+	while read -r old new ref; do
+		[ -n "$ref" ] || continue
+		if [ -x "$update" ]; then
+			"$update" "$ref" "$old" "$new" || exit 1
+		fi
+		n=$((n + 1))
+	done
+	printf "$` + dryRunMessageEnv + `\n" "$n" >&2
+}
+exit 1
+`
+
+// dryRunMessage is the catalog key and printf format of the message
+// declining a dry run.
+const (
+	dryRunMessage    = "dry run: %d ref update(s) passed all checks, nothing was applied"
+	dryRunMessageEnv = "REPOCRAFT_DRY_RUN_MESSAGE"
+)
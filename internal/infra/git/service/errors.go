@@ -0,0 +1,36 @@
+package service
+
+import (
+	"errors"
+	"io"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+)
+
+// WriteErr sends err to a git client as an ERR pkt-line, which git shows as
+// "remote error: <code>: <message>" before giving up. It must come before
+// or instead of git's own output.
+func WriteErr(w io.Writer, err error) error {
+	return pktline.NewWriter(w).WriteString("ERR " + errcode.Text(err) + "\n")
+}
+
+// ErrTimeout is returned for invocations stopped for running longer than
+// the executor allows.
+var ErrTimeout = errcode.New(errcode.LimitExceeded, "the operation took too long and was stopped")
+
+// reportedError is an error Serve already sent to the client with WriteErr.
+type reportedError struct{ error }
+
+func (e reportedError) Unwrap() error { return e.error }
+
+// Reported reports whether err was already sent to the client as an ERR
+// pkt-line, so transports don't send it again.
+func Reported(err error) bool {
+	var r reportedError
+	return errors.As(err, &r)
+}
+
+// errEncryptPushed refuses pushes to encrypted repositories whose objects
+// could not be encrypted.
+var errEncryptPushed = errcode.New(errcode.Internal, "the pushed objects could not be stored")
@@ -2,12 +2,34 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/admission"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/faults"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/locale"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/tracing"
 )
 
+var debugGit = diag.Register("git", "Git processes started for clients, with their arguments")
+
+// streamWaitDelay bounds how long Serve waits for the client streams after
+// git exited or was killed.
+const streamWaitDelay = 5 * time.Second
+
 // ServiceExecutor executes git service binaries (upload-pack/receive-pack).
 type ServiceExecutor struct {
 	// UploadPackPath and ReceivePackPath optionally override the binary names.
@@ -18,10 +40,89 @@ type ServiceExecutor struct {
 	BaseEnv []string
 	// WorkDir optionally sets the working directory for spawned commands.
 	WorkDir string
+	// RefAdvertisement tunes the refs upload-pack advertises, per repository.
+	RefAdvertisement RefAdvertisementPolicy
+	// Messages are shown to clients over side-band before and after transfers.
+	Messages MessagePolicy
+	// Locales, if set, translate messages and errors into the request's
+	// Locale.
+	Locales *locale.Localizer
+	// PushAnnotations adds links to the output of successful pushes.
+	PushAnnotations PushAnnotations
+	// Capabilities rewrites the capabilities advertised by each service.
+	Capabilities CapabilityPolicies
+	// RefTransactions, if set, votes on every ref update receive-pack applies.
+	RefTransactions ReferenceTransactions
+	// PushChecks, if set, inspect pushes before any ref changes.
+	PushChecks PushCheck
+	// DryRunPushes honours the "dry-run" push option: such pushes are
+	// received and checked by the repository's pre-receive and update
+	// hooks, then declined before any ref changes.
+	DryRunPushes bool
+	// Review, if set, requires a second person's approval for direct
+	// pushes to protected branches.
+	Review *ReviewPolicy
+	// Freeze, if set, refuses pushes to branches during freeze windows.
+	Freeze *freeze.Schedule
+	// NegotiationLimits bound the wants, haves and deepen requests of
+	// upload-pack requests.
+	NegotiationLimits NegotiationLimits
+	// Depth caps the history fetches may ask for, per repository.
+	Depth DepthPolicy
+	// Encryption, if set, decrypts the objects of repositories encrypted at
+	// rest for the duration of each invocation, and encrypts those pushes
+	// add before their refs are updated.
+	Encryption *atrest.Store
+	// Locks, if set, marks pushes as active so maintenance waits for them.
+	Locks *repolock.Manager
+	// Admission, if set, bounds concurrent invocations and queues the rest
+	// fairly by client identity.
+	Admission *admission.Scheduler
+	// Sessions, if set, lists this invocation with live byte counts while
+	// it is queued or running.
+	Sessions *Sessions
+	// PathScopes, if set, restricts identities to directories of
+	// repositories.
+	PathScopes *PathScopes
+	// SparseHints tells clients cloning a repository with sparse profiles
+	// in full about the profiles.
+	SparseHints bool
+	// Reaper, if set, tracks git process groups and stops them gracefully.
+	Reaper *Reaper
+	// UploadTimeout bounds how long upload-pack and upload-archive may run
+	// once they have a slot, ReceiveTimeout receive-pack, and MaxDuration
+	// every invocation; the shortest applies. Zero means no limit beyond
+	// the caller's context. git is stopped when its time is up and Serve
+	// returns ErrTimeout, so a hung transfer can't hold a slot forever.
+	UploadTimeout  time.Duration
+	ReceiveTimeout time.Duration
+	MaxDuration    time.Duration
+	// OnFinish, if set, receives a summary of every invocation.
+	OnFinish func(Result)
+	// Logger receives what goes wrong around invocations; slog.Default()
+	// if nil.
+	Logger *slog.Logger
+	// Tracer, if set, records a span per invocation, a child of the span
+	// in the context Serve is called with.
+	Tracer *tracing.Tracer
+}
+
+func (e ServiceExecutor) logger() *slog.Logger {
+	if e.Logger == nil {
+		return slog.Default()
+	}
+	return e.Logger
 }
 
 // Serve runs the git service for the given request, streaming I/O.
 func (e ServiceExecutor) Serve(ctx context.Context, req ServiceRequest, stdin io.Reader, stdout, stderr io.Writer) error {
+	ctx, span := e.Tracer.Start(ctx, req.Service.Command(), tracing.Internal, "repo", req.RepoName, "identity", req.Identity)
+	err := e.serve(ctx, req, stdin, stdout, stderr)
+	span.End(err)
+	return err
+}
+
+func (e ServiceExecutor) serve(ctx context.Context, req ServiceRequest, stdin io.Reader, stdout, stderr io.Writer) error {
 	if err := req.Validate(); err != nil {
 		return err
 	}
@@ -31,17 +132,350 @@ func (e ServiceExecutor) Serve(ctx context.Context, req ServiceRequest, stdin io
 		return err
 	}
 
-	cmd := exec.CommandContext(ctx, binary, req.RepoPath)
+	printer := e.Locales.Printer(req.Locale, req.RepoName, req.Identity)
+
+	// Count bytes as seen by the client, outside of any stream rewriting.
+	var in *countingReader
+	if stdin != nil {
+		in = &countingReader{r: stdin}
+		stdin = in
+	}
+	out := &countingWriter{w: stdout}
+	stdout = out
+	var filters []*requestFilter
+	if req.Service != ServiceAdminCommand && !req.AdvertiseRefs && stdin != nil {
+		framing := newFramingFilter(stdin, req.Service)
+		// Stateless clients send the whole request up front, so malformed
+		// ones are refused before taking a slot or starting git.
+		if req.StatelessRPC {
+			if err := framing.fill(); err == ErrMalformedRequest {
+				_ = WriteErr(out, printer.Error(err))
+				return reportedError{err}
+			}
+		}
+		filters = append(filters, framing)
+		stdin = framing
+	}
+	scope, scopeDirs, scoped := e.PathScopes.For(req.RepoName, req.Identity)
+	if scoped && req.Service == ServiceUploadPack && !req.AdvertiseRefs && stdin != nil {
+		f := newScopeFilter(ctx, req, scope, scopeDirs)
+		filters = append(filters, &requestFilter{r: stdin, packet: f.packet, held: f.release})
+		stdin = filters[len(filters)-1]
+	}
+	if scoped && req.Service == ServiceUploadArchive && !req.AdvertiseRefs && stdin != nil {
+		filters = append(filters, &requestFilter{r: stdin, packet: scopedArchiveFilter(req.RepoName, scopeDirs)})
+		stdin = filters[len(filters)-1]
+	}
+	if req.Service == ServiceUploadPack && !req.AdvertiseRefs && stdin != nil {
+		if !e.NegotiationLimits.IsZero() {
+			l := newNegotiationLimiter(e.NegotiationLimits)
+			filters = append(filters, &requestFilter{r: stdin, packet: l.packet})
+			stdin = filters[len(filters)-1]
+		}
+		if limit := e.Depth.For(req.RepoName); limit.Max > 0 {
+			d := newDepthFilter(limit, req)
+			filters = append(filters, &requestFilter{r: stdin, packet: d.packet, held: d.release})
+			stdin = filters[len(filters)-1]
+		}
+	}
+	var hint func() string
+	if e.SparseHints && req.Service == ServiceUploadPack && !req.AdvertiseRefs && stdin != nil {
+		if profiles := sparseHint(ctx, req); profiles != "" {
+			o := &cloneObserver{}
+			filters = append(filters, &requestFilter{r: stdin, packet: o.packet})
+			stdin = filters[len(filters)-1]
+			hint = func() string {
+				if !o.fullClone() {
+					return ""
+				}
+				return printer.Text(sparseHintMessage, profiles)
+			}
+		}
+	}
+	if req.Service == ServiceUploadArchive && !req.AdvertiseRefs && stdin != nil {
+		filters = append(filters, &requestFilter{r: stdin, packet: archiveFilter})
+		stdin = filters[len(filters)-1]
+	}
+	session := e.Sessions.begin(req, in, out)
+	defer e.Sessions.end(session)
+
+	queuedAt := time.Now()
+	key := req.Identity
+	if key == "" {
+		key = req.RepoName
+	}
+	release, err := e.Admission.Acquire(ctx, key)
+	if err != nil {
+		return fmt.Errorf("waiting for a free slot: %w", err)
+	}
+	defer release()
+	queued := time.Since(queuedAt)
+	e.Sessions.running(session)
+	if limit := e.timeout(req.Service); limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, limit, ErrTimeout)
+		defer cancel()
+	}
+
+	var args []string
+	// upload-archive answers a single request anyway and has no such flag.
+	if req.StatelessRPC && req.Service != ServiceUploadArchive {
+		args = append(args, "--stateless-rpc")
+	}
+	if req.AdvertiseRefs {
+		args = append(args, "--advertise-refs")
+	}
+	if req.Service == ServiceAdminCommand {
+		args = append([]string{"--git-dir=" + req.RepoPath}, req.Args...)
+	} else {
+		args = append(args, req.RepoPath)
+	}
+
+	var config [][2]string
+	if req.Service == ServiceUploadPack {
+		advert := e.RefAdvertisement.For(req.RepoName)
+		config = append(config, advert.gitConfig()...)
+		if len(advert.LsRefsPrefixes) > 0 && req.IsProtocolV2() && stdin != nil {
+			pr, pw := io.Pipe()
+			defer pr.Close()
+			go func(src io.Reader) {
+				pw.CloseWithError(filterLsRefs(pw, src, advert.LsRefsPrefixes))
+			}(stdin)
+			stdin = pr
+		}
+	}
+
+	if req.Service == ServiceReceivePack && !req.AdvertiseRefs {
+		defer e.Locks.BeginPush(req.RepoPath)()
+	}
+
+	var env []string
+	scripts := make(map[string]string)
+	if e.DryRunPushes && req.Service == ServiceReceivePack {
+		config = append(config, [2]string{"receive.advertisePushOptions", "true"})
+		scripts["pre-receive"] = dryRunScript
+		env = append(env, dryRunMessageEnv+"="+printer.Text(dryRunMessage, ""))
+	}
+	review, reviewed := e.Review.For(req.RepoName)
+	reviewed = reviewed && req.Service == ServiceReceivePack
+	if reviewed && !req.AdvertiseRefs {
+		chainHook(scripts, "pre-receive", reviewScript)
+		env = append(env, e.Review.env(review, req.Identity, errcode.Text(printer.Error(errReviewRequired)))...)
+	} else if reviewed {
+		// The advertisement offers push certificates with a nonce.
+		config = append(config, e.Review.config("")...)
+	}
+	if e.PushChecks != nil && req.Service == ServiceReceivePack && !req.AdvertiseRefs {
+		hook, err := startPushCheckHook(ctx, e.PushChecks, req)
+		if err != nil {
+			return fmt.Errorf("push check hook: %w", err)
+		}
+		defer hook.close()
+		chainHook(scripts, "pre-receive", pushCheckScript)
+		env = append(env, pushCheckDirEnv+"="+hook.dir)
+	}
+	if req.Service == ServiceReceivePack && !req.AdvertiseRefs {
+		if freezes := e.Freeze.Frozen(req.RepoName, time.Now()); len(freezes) > 0 {
+			chainHook(scripts, "pre-receive", freezeScript)
+			env = append(env, freezeEnv(freezes, printer))
+		}
+	}
+	if req.Service == ServiceReceivePack && !req.AdvertiseRefs && Archived(req.RepoPath) {
+		scripts["pre-receive"] = archivedScript
+		env = append(env, archivedMessageEnv+"="+errcode.Text(printer.Error(errArchived)))
+	}
+	var hold LegalHold
+	if req.Service == ServiceReceivePack && !req.AdvertiseRefs {
+		if hold = ReadLegalHold(req.RepoPath); !hold.IsZero() {
+			chainHook(scripts, "pre-receive", legalHoldScript)
+			env = append(env, hold.env(errcode.Text(printer.Error(ErrLegalHold)))...)
+			// Neither may gc after the push prune what the hold keeps.
+			config = append(config, LegalHoldGitConfig()...)
+		}
+	}
+	staged, err := e.Encryption.Stage(ctx, req.RepoPath)
+	if err != nil {
+		return err
+	}
+	txns := e.RefTransactions
+	if staged != nil {
+		defer staged.Release()
+		env = append(env, "GIT_OBJECT_DIRECTORY="+staged.Dir())
+		// gc would only repack the staged copy.
+		config = append(config, [2]string{"receive.autogc", "false"})
+		// Pushed objects are encrypted before any ref points to them, and
+		// the push fails if they can't be.
+		txns = JoinTransactions(encryptPushed{staged: staged, logger: e.logger()}, txns)
+	}
+	if txns != nil && req.Service == ServiceReceivePack && !req.AdvertiseRefs {
+		hook, err := startRefTxnHook(ctx, txns, req, e.logger())
+		if err != nil {
+			return fmt.Errorf("reference transaction hook: %w", err)
+		}
+		defer hook.close()
+		scripts["reference-transaction"] = refTxnScript
+		env = append(env, hook.env())
+	}
+	if len(scripts) > 0 && !req.AdvertiseRefs {
+		overlay, err := newHookOverlay(req.RepoPath, scripts)
+		if err != nil {
+			return fmt.Errorf("hooks: %w", err)
+		}
+		defer overlay.close()
+		config = append(config, overlay.config())
+		env = append(env, overlay.env(req.RepoPath))
+		if reviewed {
+			if err := os.WriteFile(filepath.Join(overlay.dir, allowedSignersFile), e.Review.allowedSigners, 0o600); err != nil {
+				return fmt.Errorf("hooks: %w", err)
+			}
+			config = append(config, e.Review.config(overlay.dir)...)
+		}
+		if !hold.IsZero() {
+			audit := filepath.Join(overlay.dir, legalHoldAuditFile)
+			env = append(env, legalHoldAuditEnv+"="+audit)
+			defer auditLegalHold(audit, req, e.logger())
+		}
+	}
+
+	// Stateless requests other than the advertisement carry no capabilities.
+	caps := e.Capabilities.For(req.Service)
+	if scoped && req.Service == ServiceUploadPack {
+		// object-info reports on any object, and bundles hold whole trees.
+		caps.Strip = append(append([]string(nil), caps.Strip...), "object-info", "bundle-uri")
+	}
+	if !caps.IsZero() && (req.AdvertiseRefs || !req.StatelessRPC) {
+		fw := pktline.NewFilterWriter(stdout, capabilityFilter(caps, req.IsProtocolV2()))
+		defer fw.Close()
+		stdout = fw
+	}
+
+	msgs := e.Messages.For(req.RepoName)
+	msgs.Before, msgs.After = printer.Text(msgs.Before, ""), printer.Text(msgs.After, "")
+	annotate := req.Service == ServiceReceivePack && !e.PushAnnotations.IsZero() && stdin != nil
+	// Archives aren't multiplexed until after an ACK, so they carry no
+	// messages.
+	if (!msgs.IsZero() || annotate || hint != nil) && !req.AdvertiseRefs && req.Service != ServiceUploadArchive {
+		var cmds *PushCommandReader
+		status := &reportStatus{}
+		if annotate {
+			cmds = NewPushCommandReader(stdin)
+			stdin = cmds
+		}
+		after := func() string {
+			if cmds == nil {
+				return msgs.After
+			}
+			links := e.PushAnnotations.render(req.RepoName, defaultBranchOf(req.RepoPath), updatedRefs(cmds.Commands(), status))
+			return joinMessages(links, msgs.After)
+		}
+		before := func() string {
+			if hint == nil {
+				return msgs.Before
+			}
+			return joinMessages(msgs.Before, hint())
+		}
+		fw := pktline.NewFilterWriter(stdout, sidebandInjector(
+			before,
+			after,
+			status.write,
+		))
+		defer fw.Close()
+		stdout = fw
+	}
+
+	cmd := exec.CommandContext(ctx, binary, args...)
 	cmd.Stdin = stdin
-	cmd.Stdout = stdout
+	// Only called once git runs, after Reaper.run set up Cancel.
+	cmd.Stdout = faults.Stream(stdout, req.RepoName, func() { _ = cmd.Cancel() })
 	cmd.Stderr = stderr
 	cmd.Dir = e.WorkDir
 	cmd.Env = append(os.Environ(), e.BaseEnv...)
 	if req.ProtocolVersion != "" {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_PROTOCOL=%s", req.ProtocolVersion))
 	}
+	cmd.Env = append(cmd.Env, gitConfigEnv(config)...)
+	cmd.Env = append(cmd.Env, env...)
+	for _, f := range filters {
+		// Only called once git runs, after Reaper.run set up Cancel.
+		f.stop = func() { _ = cmd.Cancel() }
+	}
+
+	if debugGit.Enabled() {
+		line := binary + " " + strings.Join(args, " ")
+		if req.ProtocolVersion != "" {
+			line += " GIT_PROTOCOL=" + req.ProtocolVersion
+		}
+		for _, kv := range config {
+			line += " -c " + kv[0] + "=" + kv[1]
+		}
+		debugGit.Printf("%s: %s", req.RepoName, line)
+	}
+	start := time.Now()
+	err = e.Reaper.run(cmd)
+	if errors.Is(err, exec.ErrWaitDelay) && ctx.Err() == nil && cmd.ProcessState.Success() {
+		// git finished; only the client's stdin was still open.
+		err = nil
+	}
+	if faults.Dropped(cmd.Stdout) {
+		err = faults.ErrDropped
+	}
+	if err != nil && errors.Is(context.Cause(ctx), ErrTimeout) {
+		err = ErrTimeout
+		if cmd.Process == nil && out.n.Load() == 0 {
+			// git didn't get to read the request or answer it, so the
+			// client still expects pkt-lines and can be told why.
+			_ = WriteErr(out, printer.Error(err))
+			err = reportedError{err}
+		}
+	}
+	for _, f := range filters {
+		if f.err != nil {
+			// git was stopped before serving the request; tell the client why.
+			_ = WriteErr(out, printer.Error(f.err))
+			err = reportedError{f.err}
+			break
+		}
+	}
+	if span := tracing.FromContext(ctx); e.OnFinish != nil || span != nil {
+		res := Result{
+			Request:  req,
+			Start:    start,
+			Duration: time.Since(start),
+			Queued:   queued,
+			BytesOut: out.n.Load(),
+			ExitCode: exitCode(cmd, err),
+			Err:      err,
+		}
+		if in != nil {
+			res.BytesIn = in.n.Load()
+		}
+		if cmd.ProcessState != nil {
+			res.UserCPU = cmd.ProcessState.UserTime()
+			res.SystemCPU = cmd.ProcessState.SystemTime()
+			res.MaxRSS = maxRSS(cmd.ProcessState)
+		}
+		span.SetAttributes("exit_code", res.ExitCode, "bytes_in", res.BytesIn, "bytes_out", res.BytesOut, "queued", res.Queued)
+		if e.OnFinish != nil {
+			e.OnFinish(res)
+		}
+	}
+	return err
+}
 
-	return cmd.Run()
+// timeout returns the time limit of invocations of service, or zero for
+// none.
+func (e ServiceExecutor) timeout(service Service) time.Duration {
+	var limit time.Duration
+	switch service {
+	case ServiceUploadPack, ServiceUploadArchive:
+		limit = e.UploadTimeout
+	case ServiceReceivePack:
+		limit = e.ReceiveTimeout
+	}
+	if e.MaxDuration > 0 && (limit <= 0 || e.MaxDuration < limit) {
+		limit = e.MaxDuration
+	}
+	return limit
 }
 
 func (e ServiceExecutor) resolveBinary(service Service) (string, error) {
@@ -56,7 +490,27 @@ func (e ServiceExecutor) resolveBinary(service Service) (string, error) {
 			return e.ReceivePackPath, nil
 		}
 		return ServiceReceivePack.Command(), nil
+	case ServiceUploadArchive:
+		return ServiceUploadArchive.Command(), nil
+	case ServiceAdminCommand:
+		return ServiceAdminCommand.Command(), nil
 	default:
 		return "", fmt.Errorf("unsupported service: %s", service)
 	}
 }
+
+// gitConfigEnv passes configuration to git through GIT_CONFIG_COUNT/KEY/VALUE
+// (git >= 2.31), since the service binaries don't accept -c.
+func gitConfigEnv(config [][2]string) []string {
+	if len(config) == 0 {
+		return nil
+	}
+	env := []string{fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(config))}
+	for i, kv := range config {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, kv[0]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, kv[1]),
+		)
+	}
+	return env
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package service
+
+import "errors"
+
+func mkfifo(path string) error {
+	return errors.New("reference transactions are not supported on this platform")
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// ErrMalformedRequest is returned for client requests that are not
+// pkt-line framed where the protocol requires it.
+var ErrMalformedRequest = errcode.New(errcode.InvalidRequest, "malformed pkt-line request")
+
+const (
+	// maxProtocolParams bounds the Git-Protocol header and GIT_PROTOCOL
+	// variable; real clients send "version=2".
+	maxProtocolParams = 256
+	// maxSSHCommand bounds the command of an SSH exec request.
+	maxSSHCommand = 4096
+)
+
+// ValidProtocolParams checks a Git-Protocol header or GIT_PROTOCOL value
+// before it is passed to git: colon-separated parameters made of letters,
+// digits and "=._-".
+func ValidProtocolParams(v string) error {
+	if len(v) > maxProtocolParams {
+		return fmt.Errorf("protocol parameters longer than %d bytes", maxProtocolParams)
+	}
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("=:._-", c)) {
+			return fmt.Errorf("invalid character %q in protocol parameters", c)
+		}
+	}
+	return nil
+}
+
+// newFramingFilter checks that requests to upload-pack are pkt-line framed
+// throughout, and those to receive-pack up to the end of the command list;
+// the pack that follows is raw.
+func newFramingFilter(r io.Reader, svc Service) *requestFilter {
+	return &requestFilter{
+		r:      r,
+		strict: true,
+		packet: func(out, pkt, payload []byte) ([]byte, error) {
+			if svc == ServiceReceivePack && payload == nil {
+				return out, errPassRest
+			}
+			return append(out, pkt...), nil
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/locale"
+)
+
+const freezesEnv = "REPOCRAFT_FREEZES"
+
+// freezeScript is installed as the pre-receive hook while freeze windows
+// are in effect for a repository. $REPOCRAFT_FREEZES holds a line per
+// frozen ref pattern, followed by the message refusing pushes to it; a
+// push updating any matching ref is declined. It then runs the next
+// pre-receive hook.
+const freezeScript = `#!/bin/sh
+updates=$(cat)
+while read -r old new ref; do
+	[ -n "$ref" ] || continue
+	while read -r pattern message; do
+		case "$ref" in
+		$pattern)
+			printf '%s\n(%s is frozen)\n' "$message" "$ref" >&2
+			exit 1
+			;;
+		esac
+	done <<FREEZES
+$` + freezesEnv + `
+FREEZES
+done <<EOF
+$updates
+EOF
+next="$0.next"
+[ -x "$next" ] || next="$REPOCRAFT_REPO_HOOKS/pre-receive"
+if [ -x "$next" ]; then
+	printf '%s\n' "$updates" | "$next" "$@" || exit 1
+fi
+`
+
+// freezeEnv passes the frozen ref patterns of freezes to freezeScript, with
+// the messages refusing pushes translated by printer.
+func freezeEnv(freezes []freeze.Freeze, printer locale.Printer) string {
+	var b strings.Builder
+	for _, f := range freezes {
+		err := errcode.Errorf(errcode.PushFrozen, "%s until %s: %s", f.Name, f.Until.Format(time.RFC1123), f.Reason)
+		msg := strings.ReplaceAll(errcode.Text(printer.Error(err)), "\n", " ")
+		for _, ref := range f.Refs {
+			fmt.Fprintf(&b, "%s %s\n", ref, msg)
+		}
+	}
+	return freezesEnv + "=" + b.String()
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// hookOverlay is a temporary core.hooksPath for one git process. It links
+// to the repository's own hooks and replaces some of them with scripts of
+// the server, which find the replaced hook under $REPOCRAFT_REPO_HOOKS and
+// are expected to run it first.
+type hookOverlay struct {
+	dir string
+}
+
+func newHookOverlay(repoPath string, scripts map[string]string) (*hookOverlay, error) {
+	dir, err := os.MkdirTemp("", "repocraft-hooks-")
+	if err != nil {
+		return nil, err
+	}
+	o := &hookOverlay{dir: dir}
+	if err := o.setup(repoPath, scripts); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *hookOverlay) setup(repoPath string, scripts map[string]string) error {
+	own := filepath.Join(repoPath, "hooks")
+	entries, err := os.ReadDir(own)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := scripts[entry.Name()]; ok {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(own, entry.Name()), filepath.Join(o.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(o.dir, name), []byte(script), 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chainHook installs script as the named hook in scripts, in front of the
+// server's script it replaces, if any. Scripts run the one they replaced
+// as "$0.next", or the repository's own hook at the end of the chain.
+func chainHook(scripts map[string]string, name, script string) {
+	if next, ok := scripts[name]; ok {
+		chainHook(scripts, name+".next", next)
+	}
+	scripts[name] = script
+}
+
+// config and env point git and the scripts at the overlay.
+func (o *hookOverlay) config() [2]string {
+	return [2]string{"core.hooksPath", o.dir}
+}
+
+func (o *hookOverlay) env(repoPath string) string {
+	return "REPOCRAFT_REPO_HOOKS=" + filepath.Join(repoPath, "hooks")
+}
+
+func (o *hookOverlay) close() {
+	os.RemoveAll(o.dir)
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// Repository config keys of legal holds. A repository under legal hold
+// refuses every ref change; otherwise the refs named by LegalHoldRefKey, one
+// value each, can't be updated or deleted.
+const (
+	LegalHoldKey       = "repocraft.legalHold"
+	LegalHoldRefKey    = "repocraft.legalHoldRef"
+	LegalHoldReasonKey = "repocraft.legalHoldReason"
+)
+
+// LegalHold is the legal hold of a repository.
+type LegalHold struct {
+	// All holds every ref of the repository.
+	All bool `json:"all"`
+	// Refs are the held refs, e.g. "refs/heads/main".
+	Refs   []string `json:"refs,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// IsZero reports whether nothing is held.
+func (h LegalHold) IsZero() bool {
+	return !h.All && len(h.Refs) == 0
+}
+
+// Covers reports whether ref is held.
+func (h LegalHold) Covers(ref string) bool {
+	if h.All {
+		return true
+	}
+	for _, r := range h.Refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadLegalHold returns the legal hold of the repository at repoPath.
+func ReadLegalHold(repoPath string) LegalHold {
+	var h LegalHold
+	out, err := exec.Command("git", "config", "--file", filepath.Join(repoPath, "config"), "--get-regexp", `^repocraft\.legalhold`).Output()
+	if err != nil {
+		return h
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case strings.ToLower(LegalHoldKey):
+			h.All = value == "true"
+		case strings.ToLower(LegalHoldRefKey):
+			h.Refs = append(h.Refs, value)
+		case strings.ToLower(LegalHoldReasonKey):
+			h.Reason = value
+		}
+	}
+	return h
+}
+
+// LegalHoldGitConfig keeps gc from pruning objects and expiring reflogs
+// of repositories under legal hold.
+func LegalHoldGitConfig() [][2]string {
+	return [][2]string{
+		{"gc.pruneExpire", "never"},
+		{"gc.reflogExpire", "never"},
+		{"gc.reflogExpireUnreachable", "never"},
+	}
+}
+
+// ErrLegalHold is returned for changes to refs under legal hold.
+var ErrLegalHold = errcode.New(errcode.LegalHold, "refs under legal hold can't be updated or deleted")
+
+const (
+	legalHoldAllEnv     = "REPOCRAFT_LEGAL_HOLD_ALL"
+	legalHoldRefsEnv    = "REPOCRAFT_LEGAL_HOLD_REFS"
+	legalHoldMessageEnv = "REPOCRAFT_LEGAL_HOLD_MESSAGE"
+	legalHoldAuditEnv   = "REPOCRAFT_LEGAL_HOLD_AUDIT"
+	legalHoldAuditFile  = "legal-hold-audit"
+)
+
+// legalHoldScript is installed as the pre-receive hook of repositories
+// with a legal hold. It declines pushes changing held refs, recording each
+// refused update in $REPOCRAFT_LEGAL_HOLD_AUDIT for the server to log, and
+// otherwise runs the next pre-receive hook. Ref names can't contain glob
+// characters or spaces, so $REPOCRAFT_LEGAL_HOLD_REFS splits safely.
+const legalHoldScript = `#!/bin/sh
+updates=$(cat)
+denied=
+while read -r old new ref; do
+	[ -n "$ref" ] || continue
+	held=$` + legalHoldAllEnv + `
+	for r in $` + legalHoldRefsEnv + `; do
+		[ "$r" = "$ref" ] && held=1
+	done
+	if [ -n "$held" ]; then
+		printf '%s %s %s\n' "$old" "$new" "$ref" >>"$` + legalHoldAuditEnv + `"
+		denied="$ref"
+	fi
+done <<EOF
+$updates
+EOF
+if [ -n "$denied" ]; then
+	printf '%s\n(%s is under legal hold)\n' "$` + legalHoldMessageEnv + `" "$denied" >&2
+	exit 1
+fi
+next="$0.next"
+[ -x "$next" ] || next="$REPOCRAFT_REPO_HOOKS/pre-receive"
+if [ -x "$next" ]; then
+	printf '%s\n' "$updates" | "$next" "$@" || exit 1
+fi
+`
+
+// env passes the hold to legalHoldScript.
+func (h LegalHold) env(message string) []string {
+	all := ""
+	if h.All {
+		all = "1"
+	}
+	return []string{
+		legalHoldAllEnv + "=" + all,
+		legalHoldRefsEnv + "=" + strings.Join(h.Refs, " "),
+		legalHoldMessageEnv + "=" + message,
+	}
+}
+
+// auditLegalHold logs the updates of held refs legalHoldScript refused, as
+// recorded in file.
+func auditLegalHold(file string, req ServiceRequest, logger *slog.Logger) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		cmd, ok := parsePushCommand(sc.Bytes())
+		if !ok {
+			continue
+		}
+		action := "update"
+		switch {
+		case cmd.Old == zeroOID:
+			action = "creation"
+		case cmd.IsDelete():
+			action = "deletion"
+		}
+		logger.Warn("legal hold refused ref update", "action", action, "ref", cmd.Ref, "repo", req.RepoName, "identity", req.Identity, "old", cmd.Old, "new", cmd.New)
+	}
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+)
+
+const (
+	sidebandProgress = 2
+	// maxSidebandMessage keeps messages within the 1000 byte limit of the
+	// original side-band capability.
+	maxSidebandMessage = 990
+)
+
+// Messages are shown to clients around a fetch or push, e.g. maintenance notices.
+type Messages struct {
+	Before string // shown before the transfer starts
+	After  string // shown once the transfer completed
+}
+
+// IsZero reports whether no message is configured.
+func (m Messages) IsZero() bool {
+	return m.Before == "" && m.After == ""
+}
+
+// MessagePolicy resolves the messages shown for a repository. Global and
+// per-repository messages are both shown, global ones first.
+type MessagePolicy struct {
+	Global Messages
+	// PerRepo is keyed by the repository path relative to the root.
+	PerRepo map[string]Messages
+}
+
+// For returns the combined messages for repo.
+func (p MessagePolicy) For(repo string) Messages {
+	m := p.Global
+	r, ok := p.PerRepo[strings.Trim(repo, "/")]
+	if !ok {
+		return m
+	}
+	return Messages{Before: joinMessages(m.Before, r.Before), After: joinMessages(m.After, r.After)}
+}
+
+func joinMessages(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	default:
+		return strings.TrimRight(a, "\n") + "\n" + b
+	}
+}
+
+// sidebandInjector returns a filter that writes before as side-band progress
+// messages ahead of the first side-band packet git emits, and after ahead of
+// the flush terminating the side-band stream. Data on channel 1 is passed to
+// onData when set. Responses without side-band are left untouched.
+func sidebandInjector(before, after func() string, onData func([]byte)) pktline.FilterFunc {
+	inSideband, sentBefore := false, false
+	return func(p pktline.Packet, w *pktline.Writer) error {
+		if p.Type == pktline.Data && len(p.Payload) > 0 && p.Payload[0] >= 1 && p.Payload[0] <= 3 {
+			if p.Payload[0] == 1 && onData != nil {
+				onData(p.Payload[1:])
+			}
+			if !sentBefore {
+				sentBefore = true
+				if err := writeSidebandMessage(w, before()); err != nil {
+					return err
+				}
+			}
+			inSideband = true
+		}
+		if p.Type == pktline.Flush && inSideband {
+			inSideband = false
+			if err := writeSidebandMessage(w, after()); err != nil {
+				return err
+			}
+		}
+		return w.WritePacket(p)
+	}
+}
+
+// writeSidebandMessage writes msg line by line on side-band channel 2.
+func writeSidebandMessage(w *pktline.Writer, msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		if len(line) > maxSidebandMessage {
+			line = line[:maxSidebandMessage]
+		}
+		payload := append([]byte{sidebandProgress}, line...)
+		payload = append(payload, '\n')
+		if err := w.WritePacket(pktline.Packet{Type: pktline.Data, Payload: payload}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
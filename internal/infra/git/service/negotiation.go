@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// NegotiationCounter wraps an upload-pack request stream and counts the
+// negotiation lines passing through it without altering the bytes.
+// It understands both protocol v0 and v2 request framing.
+type NegotiationCounter struct {
+	r   io.Reader
+	buf []byte
+	bad bool
+
+	Wants   int
+	Haves   int
+	Deepens int
+	Filters int
+}
+
+// NewNegotiationCounter returns a counter reading from r.
+func NewNegotiationCounter(r io.Reader) *NegotiationCounter {
+	return &NegotiationCounter{r: r}
+}
+
+// Read implements io.Reader.
+func (c *NegotiationCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 && !c.bad {
+		c.buf = append(c.buf, p[:n]...)
+		c.scan()
+	}
+	return n, err
+}
+
+// FullClone reports whether the request asked for objects without
+// offering any haves or shallow/filter limits, i.e. a full clone.
+func (c *NegotiationCounter) FullClone() bool {
+	return c.Wants > 0 && c.Haves == 0 && c.Deepens == 0 && c.Filters == 0
+}
+
+func (c *NegotiationCounter) scan() {
+	for len(c.buf) >= 4 {
+		size, err := strconv.ParseUint(string(c.buf[:4]), 16, 16)
+		if err != nil {
+			// Not pkt-line framed; stop interpreting but keep passing bytes.
+			c.bad = true
+			c.buf = nil
+			return
+		}
+		if size < 4 {
+			c.buf = c.buf[4:]
+			continue
+		}
+		if len(c.buf) < int(size) {
+			return
+		}
+		c.count(c.buf[4:size])
+		c.buf = c.buf[size:]
+	}
+}
+
+func (c *NegotiationCounter) count(line []byte) {
+	switch {
+	case bytes.HasPrefix(line, []byte("want ")):
+		c.Wants++
+	case bytes.HasPrefix(line, []byte("have ")):
+		c.Haves++
+	case bytes.HasPrefix(line, []byte("deepen")):
+		c.Deepens++
+	case bytes.HasPrefix(line, []byte("filter ")):
+		c.Filters++
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// ErrNegotiationLimit is returned when an upload-pack request exceeds
+// NegotiationLimits.
+var ErrNegotiationLimit = errcode.New(errcode.LimitExceeded, "negotiation limit exceeded")
+
+// unshallowDepth is the depth git sends for fetch --unshallow.
+const unshallowDepth = 0x7fffffff
+
+// NegotiationLimits bound the work a single upload-pack request can ask
+// for. Requests are checked before git reads them; one exceeding a limit
+// is answered with an ERR packet and never reaches git. Over SSH a session
+// is one request, over Smart HTTP each POST is. Zero fields are unlimited.
+type NegotiationLimits struct {
+	MaxWants int // want and want-ref lines
+	MaxHaves int
+	// MaxDepth bounds deepen; fetch --unshallow is always allowed.
+	MaxDepth     int
+	MaxDeepenNot int
+	// MaxDeepenSinceAge bounds how far back deepen-since may reach.
+	MaxDeepenSinceAge time.Duration
+}
+
+// IsZero reports whether no limit is set.
+func (l NegotiationLimits) IsZero() bool {
+	return l == NegotiationLimits{}
+}
+
+// negotiationLimiter counts the lines of an upload-pack request against
+// NegotiationLimits.
+type negotiationLimiter struct {
+	limits NegotiationLimits
+	now    time.Time
+
+	wants, haves, deepenNots int
+}
+
+func newNegotiationLimiter(limits NegotiationLimits) *negotiationLimiter {
+	return &negotiationLimiter{limits: limits, now: time.Now()}
+}
+
+func (l *negotiationLimiter) packet(out, pkt, payload []byte) ([]byte, error) {
+	if err := l.check(bytes.TrimSuffix(payload, []byte("\n"))); err != nil {
+		return out, err
+	}
+	return append(out, pkt...), nil
+}
+
+func (l *negotiationLimiter) check(line []byte) error {
+	lim := l.limits
+	switch {
+	case bytes.HasPrefix(line, []byte("want ")), bytes.HasPrefix(line, []byte("want-ref ")):
+		if l.wants++; lim.MaxWants > 0 && l.wants > lim.MaxWants {
+			return fmt.Errorf("%w: more than %d wants", ErrNegotiationLimit, lim.MaxWants)
+		}
+	case bytes.HasPrefix(line, []byte("have ")):
+		if l.haves++; lim.MaxHaves > 0 && l.haves > lim.MaxHaves {
+			return fmt.Errorf("%w: more than %d haves", ErrNegotiationLimit, lim.MaxHaves)
+		}
+	case bytes.HasPrefix(line, []byte("deepen-not ")):
+		if l.deepenNots++; lim.MaxDeepenNot > 0 && l.deepenNots > lim.MaxDeepenNot {
+			return fmt.Errorf("%w: more than %d deepen-not", ErrNegotiationLimit, lim.MaxDeepenNot)
+		}
+	case bytes.HasPrefix(line, []byte("deepen-since ")):
+		ts, err := strconv.ParseInt(string(line[len("deepen-since "):]), 10, 64)
+		if err == nil && lim.MaxDeepenSinceAge > 0 && l.now.Sub(time.Unix(ts, 0)) > lim.MaxDeepenSinceAge {
+			return fmt.Errorf("%w: deepen-since older than %s", ErrNegotiationLimit, lim.MaxDeepenSinceAge)
+		}
+	case bytes.HasPrefix(line, []byte("deepen ")):
+		depth, err := strconv.Atoi(string(line[len("deepen "):]))
+		if err == nil && lim.MaxDepth > 0 && depth > lim.MaxDepth && depth != unshallowDepth {
+			return fmt.Errorf("%w: deepen %d exceeds %d", ErrNegotiationLimit, depth, lim.MaxDepth)
+		}
+	}
+	return nil
+}
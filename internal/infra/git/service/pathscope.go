@@ -0,0 +1,236 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repomatch"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/sparse"
+)
+
+// ErrPathScope is returned for requests of identities restricted to some
+// paths of a repository that could read beyond them.
+var ErrPathScope = errcode.New(errcode.AccessDenied, "access limited to part of the repository")
+
+// PathScopes restricts identities to directories of monorepos. It is
+// coarse: restricted identities may list refs and fetch with an approved
+// partial clone filter, which keeps whole trees from being sent, but
+// objects they name by id are still served.
+type PathScopes struct {
+	// Repos maps path.Match patterns such as "big/*" to the scope of
+	// matching repositories; the longest matching pattern wins.
+	Repos map[string]PathScope `json:"repos"`
+}
+
+// PathScope lists the identities restricted in a repository.
+type PathScope struct {
+	// Identities maps identities to the directories they may read,
+	// relative to the root: SSH key fingerprints, and over HTTP user names
+	// of authenticated clients and addresses of the others.
+	Identities map[string][]string `json:"identities"`
+	// Filters are the partial clone filters restricted identities may
+	// fetch with. When empty, those of the sparse profiles within their
+	// directories are approved, or blob:none if there are none.
+	Filters []string `json:"filters,omitempty"`
+}
+
+// LoadPathScopes reads path scopes from a JSON file.
+func LoadPathScopes(file string) (*PathScopes, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read path scopes: %w", err)
+	}
+	p := &PathScopes{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("parse path scopes %s: %w", file, err)
+	}
+	for pattern, scope := range p.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("path scopes %s: invalid pattern %q", file, pattern)
+		}
+		for identity, dirs := range scope.Identities {
+			if len(dirs) == 0 {
+				return nil, fmt.Errorf("path scopes %s: %s: no paths for %s", file, pattern, identity)
+			}
+			for _, dir := range dirs {
+				if !sparse.ValidPath(dir) {
+					return nil, fmt.Errorf("path scopes %s: %s: invalid path %q", file, pattern, dir)
+				}
+			}
+		}
+		for _, filter := range scope.Filters {
+			if !sparse.ValidFilter(filter) {
+				return nil, fmt.Errorf("path scopes %s: %s: invalid filter %q", file, pattern, filter)
+			}
+		}
+	}
+	return p, nil
+}
+
+// For returns the scope of repo and the directories identity may read
+// there, if it is restricted.
+func (p *PathScopes) For(repo, identity string) (PathScope, []string, bool) {
+	if p == nil || identity == "" {
+		return PathScope{}, nil, false
+	}
+	scope, _ := repomatch.Best(p.Repos, repo)
+	dirs, ok := scope.Identities[identity]
+	return scope, dirs, ok
+}
+
+// Restricts reports whether identity is restricted to some paths of repo.
+func (p *PathScopes) Restricts(repo, identity string) bool {
+	_, _, ok := p.For(repo, identity)
+	return ok
+}
+
+// within reports whether name is one of dirs or below one.
+func within(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeFilter enforces a PathScope on an upload-pack request: fetches
+// must carry an approved filter and, over protocol v2, ls-refs and fetch
+// are the only commands.
+type scopeFilter struct {
+	repo     string
+	dirs     []string
+	filters  []string
+	profiles []string
+	v2       bool
+
+	held    [][]byte
+	holding bool
+}
+
+func newScopeFilter(ctx context.Context, req ServiceRequest, scope PathScope, dirs []string) *scopeFilter {
+	f := &scopeFilter{repo: req.RepoName, dirs: dirs, filters: scope.Filters, v2: req.IsProtocolV2()}
+	profiles, _ := sparse.Read(ctx, req.RepoPath)
+	for _, p := range profiles {
+		fits := true
+		for _, dir := range p.Paths {
+			fits = fits && within(dir, dirs)
+		}
+		if !fits {
+			continue
+		}
+		f.profiles = append(f.profiles, p.Name)
+		if len(scope.Filters) == 0 {
+			f.filters = append(f.filters, p.FilterOrDefault())
+		}
+	}
+	if len(f.filters) == 0 {
+		f.filters = []string{sparse.DefaultFilter}
+	}
+	return f
+}
+
+// packet holds each fetch request up to its flush: the first section
+// over protocol v0, each fetch command over v2.
+func (f *scopeFilter) packet(out, pkt, payload []byte) ([]byte, error) {
+	line := string(bytes.TrimSuffix(payload, []byte("\n")))
+	if f.v2 && !f.holding {
+		switch {
+		case line == "command=fetch":
+			f.holding = true
+		case strings.HasPrefix(line, "command=") && line != "command=ls-refs":
+			return out, fmt.Errorf("%w: %s can't be used on %s", ErrPathScope, strings.TrimPrefix(line, "command="), f.repo)
+		default:
+			return append(out, pkt...), nil
+		}
+	}
+	f.held = append(f.held, pkt)
+	if string(pkt) != "0000" {
+		return out, nil
+	}
+	f.holding = false
+	if err := f.check(); err != nil {
+		return out, err
+	}
+	if !f.v2 {
+		// errPassRest passes the flush on.
+		f.held = f.held[:len(f.held)-1]
+		return f.release(out), errPassRest
+	}
+	return f.release(out), nil
+}
+
+// check refuses held wants without an approved filter.
+func (f *scopeFilter) check() error {
+	var wants bool
+	for _, pkt := range f.held {
+		if len(pkt) <= 4 {
+			continue
+		}
+		line := string(bytes.TrimSuffix(pkt[4:], []byte("\n")))
+		switch {
+		case strings.HasPrefix(line, "want ") || strings.HasPrefix(line, "want-ref "):
+			wants = true
+		case strings.HasPrefix(line, "filter "):
+			for _, approved := range f.filters {
+				if strings.TrimPrefix(line, "filter ") == approved {
+					return nil
+				}
+			}
+		}
+	}
+	if !wants {
+		return nil
+	}
+	return f.error()
+}
+
+func (f *scopeFilter) error() error {
+	hint := "a sparse checkout of them"
+	if len(f.profiles) > 0 {
+		hint = fmt.Sprintf("one of the sparse profiles %s (see %s%s)", strings.Join(f.profiles, ", "), sparseProfilesPath, f.repo)
+	}
+	return fmt.Errorf("%w: your access to %s is limited to %s, clone with --filter=%s --sparse and %s", ErrPathScope, f.repo, strings.Join(f.dirs, ", "), f.filters[0], hint)
+}
+
+func (f *scopeFilter) release(out []byte) []byte {
+	for _, pkt := range f.held {
+		out = append(out, pkt...)
+	}
+	f.held = nil
+	return out
+}
+
+// scopedArchiveFilter refuses upload-archive requests of restricted
+// identities unless every path they archive is within their directories.
+// Arguments up to the tree-ish are options; those after it, paths.
+func scopedArchiveFilter(repo string, dirs []string) func(out, pkt, payload []byte) ([]byte, error) {
+	var treeish, paths bool
+	return func(out, pkt, payload []byte) ([]byte, error) {
+		if payload == nil {
+			if !paths {
+				return out, fmt.Errorf("%w: your access to %s is limited to %s, archive those paths", ErrPathScope, repo, strings.Join(dirs, ", "))
+			}
+			return out, errPassRest
+		}
+		arg, ok := strings.CutPrefix(string(bytes.TrimSuffix(payload, []byte("\n"))), "argument ")
+		switch {
+		case !ok || (!treeish && strings.HasPrefix(arg, "-")):
+		case !treeish:
+			treeish = true
+		case !within(path.Clean(arg), dirs) || !sparse.ValidPath(path.Clean(arg)):
+			return out, fmt.Errorf("%w: your access to %s is limited to %s", ErrPathScope, repo, strings.Join(dirs, ", "))
+		default:
+			paths = true
+		}
+		return append(out, pkt...), nil
+	}
+}
@@ -0,0 +1,11 @@
+//go:build linux
+
+package service
+
+import "syscall"
+
+// setParentDeathSignal kills git if the daemon dies without cleaning up,
+// e.g. after a crash.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGKILL
+}
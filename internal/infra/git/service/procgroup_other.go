@@ -0,0 +1,28 @@
+//go:build !unix
+
+package service
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Process groups are not available; only the git process itself is
+// signalled.
+func setProcessGroup(*exec.Cmd) {}
+
+func terminateGroup(pid int) error {
+	return killGroup(pid)
+}
+
+func killGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+func groupAlive(int) bool {
+	return false
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package service
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group, which its
+// children such as pack-objects join.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	setParentDeathSignal(cmd.SysProcAttr)
+}
+
+func terminateGroup(pgid int) error {
+	return syscall.Kill(-pgid, syscall.SIGTERM)
+}
+
+func killGroup(pgid int) error {
+	return syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+// groupAlive reports whether any process of the group still exists.
+func groupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
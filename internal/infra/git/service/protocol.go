@@ -7,6 +7,12 @@ type Service string
 const (
 	ServiceUploadPack  Service = "git-upload-pack"
 	ServiceReceivePack Service = "git-receive-pack"
+	// ServiceUploadArchive sends an archive of a tree, for
+	// git archive --remote.
+	ServiceUploadArchive Service = "git-upload-archive"
+	// ServiceAdminCommand runs the git subcommand in ServiceRequest.Args,
+	// for trusted admins debugging a repository. It is not a wire service.
+	ServiceAdminCommand Service = "git"
 )
 
 // Command returns the executable name associated with the service.
@@ -16,5 +22,11 @@ func (s Service) Command() string {
 
 // IsSupported reports whether the service is recognized.
 func (s Service) IsSupported() bool {
-	return s == ServiceUploadPack || s == ServiceReceivePack
+	return s == ServiceUploadPack || s == ServiceReceivePack || s == ServiceUploadArchive
+}
+
+// IsRead reports whether the service only reads the repository, so access
+// checks treat it like a fetch.
+func (s Service) IsRead() bool {
+	return s == ServiceUploadPack || s == ServiceUploadArchive
 }
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const zeroOID = "0000000000000000000000000000000000000000"
+
+// PushLink is a templated line shown after a successful push of a branch.
+// Text and URL may contain the placeholders {repo} (repository path without
+// the .git suffix), {branch} (short branch name) and {ref} (full ref name);
+// placeholders in URL are query-escaped.
+type PushLink struct {
+	Text string // e.g. "Create a merge request for {branch}:"
+	URL  string // e.g. "https://example.com/{repo}/-/merge_requests/new?branch={branch}"
+	// ExceptDefaultBranch skips the link for pushes to the default branch.
+	ExceptDefaultBranch bool
+}
+
+// PushAnnotations renders PushLinks for every branch a push created or updated.
+type PushAnnotations struct {
+	Links []PushLink
+}
+
+// IsZero reports whether no links are configured.
+func (a PushAnnotations) IsZero() bool {
+	return len(a.Links) == 0
+}
+
+func (a PushAnnotations) render(repo, defaultBranch string, refs []string) string {
+	repo = strings.TrimSuffix(strings.Trim(repo, "/"), ".git")
+	var b strings.Builder
+	for _, ref := range refs {
+		branch, ok := strings.CutPrefix(ref, "refs/heads/")
+		if !ok {
+			continue
+		}
+		for _, link := range a.Links {
+			if link.ExceptDefaultBranch && ref == defaultBranch {
+				continue
+			}
+			text := strings.NewReplacer("{repo}", repo, "{branch}", branch, "{ref}", ref).Replace(link.Text)
+			u := strings.NewReplacer(
+				"{repo}", repo,
+				"{branch}", url.QueryEscape(branch),
+				"{ref}", url.QueryEscape(ref),
+			).Replace(link.URL)
+			if text != "" {
+				b.WriteString(text + "\n")
+			}
+			if u != "" {
+				b.WriteString("  " + u + "\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+// defaultBranchOf returns the ref HEAD points to in the bare repository.
+func defaultBranchOf(repoPath string) string {
+	data, err := os.ReadFile(filepath.Join(repoPath, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	ref, _ := strings.CutPrefix(strings.TrimSpace(string(data)), "ref: ")
+	return ref
+}
+
+// PushCommand is one ref update requested by a receive-pack client.
+type PushCommand struct {
+	Old, New, Ref string
+}
+
+// IsDelete reports whether the command deletes the ref.
+func (c PushCommand) IsDelete() bool {
+	return c.New == zeroOID
+}
+
+// IsCreate reports whether the command creates the ref.
+func (c PushCommand) IsCreate() bool {
+	return c.Old == zeroOID
+}
+
+// PushCommandReader passes a receive-pack request stream through unchanged
+// while recording the ref update commands that precede the pack data.
+type PushCommandReader struct {
+	r    io.Reader
+	buf  []byte
+	done bool
+
+	mu       sync.Mutex
+	commands []PushCommand
+}
+
+// NewPushCommandReader returns a PushCommandReader reading from r.
+func NewPushCommandReader(r io.Reader) *PushCommandReader {
+	return &PushCommandReader{r: r}
+}
+
+// Read implements io.Reader.
+func (c *PushCommandReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 && !c.done {
+		c.buf = append(c.buf, p[:n]...)
+		c.scan()
+	}
+	return n, err
+}
+
+func (c *PushCommandReader) scan() {
+	for !c.done && len(c.buf) >= 4 {
+		size, err := strconv.ParseUint(string(c.buf[:4]), 16, 16)
+		if err != nil || size == 0 || size < 4 {
+			// The command list ends at the first flush; pack data follows.
+			c.done = true
+			c.buf = nil
+			return
+		}
+		if len(c.buf) < int(size) {
+			return
+		}
+		if cmd, ok := parsePushCommand(c.buf[4:size]); ok {
+			c.mu.Lock()
+			c.commands = append(c.commands, cmd)
+			c.mu.Unlock()
+		}
+		c.buf = c.buf[size:]
+	}
+}
+
+// Commands returns the commands read so far.
+func (c *PushCommandReader) Commands() []PushCommand {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]PushCommand(nil), c.commands...)
+}
+
+func parsePushCommand(line []byte) (PushCommand, bool) {
+	line, _, _ = bytes.Cut(line, []byte{0})
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || len(fields[0]) != 40 || len(fields[1]) != 40 {
+		return PushCommand{}, false
+	}
+	return PushCommand{Old: fields[0], New: fields[1], Ref: fields[2]}, true
+}
+
+// reportStatus collects "ok <ref>" lines from report-status data carried on
+// side-band channel 1.
+type reportStatus struct {
+	buf []byte
+	ok  map[string]bool
+}
+
+func (r *reportStatus) write(data []byte) {
+	r.buf = append(r.buf, data...)
+	for len(r.buf) >= 4 {
+		size, err := strconv.ParseUint(string(r.buf[:4]), 16, 16)
+		if err != nil {
+			r.buf = nil
+			return
+		}
+		if size < 4 {
+			r.buf = r.buf[4:]
+			continue
+		}
+		if len(r.buf) < int(size) {
+			return
+		}
+		line := strings.TrimSuffix(string(r.buf[4:size]), "\n")
+		if ref, ok := strings.CutPrefix(line, "ok "); ok {
+			if r.ok == nil {
+				r.ok = make(map[string]bool)
+			}
+			r.ok[ref] = true
+		}
+		r.buf = r.buf[size:]
+	}
+}
+
+// updatedRefs returns the refs the push created or updated successfully.
+func updatedRefs(cmds []PushCommand, status *reportStatus) []string {
+	var refs []string
+	for _, cmd := range cmds {
+		if !cmd.IsDelete() && status.ok[cmd.Ref] {
+			refs = append(refs, cmd.Ref)
+		}
+	}
+	return refs
+}
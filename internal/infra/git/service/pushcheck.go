@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PushCheck inspects pushes before git applies them, e.g. the commits
+// they add. env holds the variables through which git reads the pushed
+// objects, still in quarantine; git commands the check runs on the
+// repository need it. Returning an error declines the push, with the
+// error's message, line by line, shown to the client.
+type PushCheck interface {
+	CheckPush(ctx context.Context, req ServiceRequest, env []string, updates []PushCommand) error
+}
+
+const pushCheckDirEnv = "REPOCRAFT_CHECK_DIR"
+
+// pushCheckScript is installed as the pre-receive hook when a PushCheck is
+// set. It hands the quarantine variables and the updates to the server
+// through a pair of FIFOs, prints the reason if the server declines, and
+// otherwise runs the next pre-receive hook.
+const pushCheckScript = `#!/bin/sh
+updates=$(cat)
+{
+	printf '%s\n' "GIT_OBJECT_DIRECTORY=$GIT_OBJECT_DIRECTORY" "GIT_ALTERNATE_OBJECT_DIRECTORIES=$GIT_ALTERNATE_OBJECT_DIRECTORIES" "GIT_QUARANTINE_PATH=$GIT_QUARANTINE_PATH"
+	[ -z "$updates" ] || printf '%s\n' "$updates"
+	echo
+} >"$` + pushCheckDirEnv + `/request" || exit 1
+read -r status <"$` + pushCheckDirEnv + `/response" || exit 1
+if [ "$status" != ok ]; then
+	printf '%b\n' "$status" >&2
+	exit 1
+fi
+next="$0.next"
+[ -x "$next" ] || next="$REPOCRAFT_REPO_HOOKS/pre-receive"
+if [ -x "$next" ]; then
+	printf '%s\n' "$updates" | "$next" "$@" || exit 1
+fi
+`
+
+// startPushCheckHook serves pushCheckScript for one receive-pack process
+// over the same kind of FIFO pair as the reference-transaction hook.
+func startPushCheckHook(ctx context.Context, check PushCheck, req ServiceRequest) (*refTxnHook, error) {
+	dir, err := os.MkdirTemp("", "repocraft-check-")
+	if err != nil {
+		return nil, err
+	}
+	h := &refTxnHook{dir: dir, done: make(chan struct{})}
+	if err := h.setup(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go func() {
+		defer close(h.done)
+		ctx := context.WithoutCancel(ctx)
+		r := bufio.NewReader(h.request)
+		for {
+			env, updates, err := readPushCheckRequest(r)
+			if err != nil {
+				return
+			}
+			status := "ok"
+			if err := check.CheckPush(ctx, req, env, updates); err != nil {
+				// The script prints it with %b, restoring its line breaks.
+				status = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(err.Error())
+			}
+			if _, err := fmt.Fprintln(h.response, status); err != nil {
+				return
+			}
+		}
+	}()
+	return h, nil
+}
+
+// readPushCheckRequest reads the three quarantine variables followed by
+// "<old> <new> <ref>" lines up to an empty line. Variables git didn't set
+// are left out.
+func readPushCheckRequest(r *bufio.Reader) ([]string, []PushCommand, error) {
+	var env []string
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		if name, value, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "="); value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	var updates []PushCommand
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return env, updates, nil
+		}
+		if cmd, ok := parsePushCommand([]byte(line)); ok && cmd.Old != cmd.New {
+			updates = append(updates, cmd)
+		}
+	}
+}
+
+// JoinPushChecks returns a PushCheck running each of checks in turn,
+// skipping nil ones, and declining the push at the first error.
+func JoinPushChecks(checks ...PushCheck) PushCheck {
+	var joined joinedPushChecks
+	for _, c := range checks {
+		if c != nil {
+			joined = append(joined, c)
+		}
+	}
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
+
+type joinedPushChecks []PushCheck
+
+func (j joinedPushChecks) CheckPush(ctx context.Context, req ServiceRequest, env []string, updates []PushCommand) error {
+	for _, c := range j {
+		if err := c.CheckPush(ctx, req, env, updates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
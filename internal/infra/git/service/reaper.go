@@ -0,0 +1,138 @@
+package service
+
+import (
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Reaper tracks the process groups of running git commands so that no git
+// or pack-objects process outlives its operation or the daemon. Groups are
+// asked to stop with SIGTERM and killed with SIGKILL after Grace. A nil
+// Reaper tracks nothing and kills right away.
+type Reaper struct {
+	// Grace is the time between SIGTERM and SIGKILL; defaults to five
+	// seconds if zero. Groups are killed right away if it is negative.
+	Grace time.Duration
+
+	mu     sync.Mutex
+	groups map[int]struct{}
+}
+
+// Shutdown stops every tracked group and waits up to Grace for them to
+// exit before killing the rest. Call it once the servers stopped accepting
+// requests.
+func (r *Reaper) Shutdown() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	groups := make([]int, 0, len(r.groups))
+	for pgid := range r.groups {
+		groups = append(groups, pgid)
+	}
+	r.mu.Unlock()
+	if len(groups) == 0 {
+		return
+	}
+	slog.Info("reaper: stopping git process groups", "groups", len(groups))
+	if r.grace() == 0 {
+		for _, pgid := range groups {
+			_ = killGroup(pgid)
+		}
+		return
+	}
+	for _, pgid := range groups {
+		_ = terminateGroup(pgid)
+	}
+	deadline := time.Now().Add(r.grace())
+	for time.Now().Before(deadline) {
+		alive := groups[:0]
+		for _, pgid := range groups {
+			if groupAlive(pgid) {
+				alive = append(alive, pgid)
+			}
+		}
+		if groups = alive; len(groups) == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, pgid := range groups {
+		_ = killGroup(pgid)
+	}
+}
+
+// run starts cmd in its own process group and waits for it. The group is
+// stopped when cmd's context is done, and processes left in it after cmd
+// exited are stopped as well.
+func (r *Reaper) run(cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return r.stop(cmd.Process.Pid)
+	}
+	// Reading from a client that went away can block forever; don't let
+	// that hold the slot once git is gone.
+	cmd.WaitDelay = streamWaitDelay + r.grace()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pgid := cmd.Process.Pid
+	r.track(pgid)
+	defer r.finish(pgid)
+	return cmd.Wait()
+}
+
+// stop terminates the group and kills it after the grace period, without
+// waiting.
+func (r *Reaper) stop(pgid int) error {
+	grace := r.grace()
+	if grace == 0 {
+		return killGroup(pgid)
+	}
+	if err := terminateGroup(pgid); err != nil {
+		return err
+	}
+	time.AfterFunc(grace, func() {
+		if groupAlive(pgid) {
+			_ = killGroup(pgid)
+		}
+	})
+	return nil
+}
+
+func (r *Reaper) track(pgid int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.groups == nil {
+		r.groups = make(map[int]struct{})
+	}
+	r.groups[pgid] = struct{}{}
+}
+
+func (r *Reaper) finish(pgid int) {
+	if groupAlive(pgid) {
+		slog.Info("reaper: stopping leftover processes", "pgid", pgid)
+		_ = r.stop(pgid)
+	}
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.groups, pgid)
+}
+
+func (r *Reaper) grace() time.Duration {
+	switch {
+	case r == nil || r.Grace < 0:
+		return 0
+	case r.Grace > 0:
+		return r.Grace
+	}
+	return 5 * time.Second
+}
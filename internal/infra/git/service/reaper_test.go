@@ -0,0 +1,166 @@
+//go:build unix
+
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/admission"
+)
+
+// fakeUploadPack stands in for upload-pack: it records its process group,
+// starts a child that outlives it, as pack-objects would, and streams
+// output until it is stopped. With REPOCRAFT_TEST_IGNORE_TERM set, the
+// child ignores SIGTERM and only SIGKILL stops it.
+const fakeUploadPack = `#!/bin/sh
+echo $$ >"$REPOCRAFT_TEST_PGID"
+if [ -n "$REPOCRAFT_TEST_IGNORE_TERM" ]; then
+	(trap '' TERM; sleep 60) >/dev/null 2>&1 &
+else
+	sleep 60 >/dev/null 2>&1 &
+fi
+while :; do
+	printf 0004
+	sleep 0.05
+done
+`
+
+// dropWriter is the client's end of the connection: it signals the first
+// bytes it gets and, once dropped, fails like a closed connection.
+type dropWriter struct {
+	mu      sync.Mutex
+	started chan struct{}
+	once    sync.Once
+	dropped bool
+}
+
+func (w *dropWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dropped {
+		return 0, errors.New("connection reset by peer")
+	}
+	return len(p), nil
+}
+
+func (w *dropWriter) drop() {
+	w.mu.Lock()
+	w.dropped = true
+	w.mu.Unlock()
+}
+
+func TestServeStopsProcessGroupOnConnectionDrop(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	tests := []struct {
+		name       string
+		reaper     *Reaper
+		ignoreTerm bool
+		// cancel drops the connection by cancelling the request's context,
+		// as transports do when the client goes away; otherwise writes to
+		// the client start failing.
+		cancel bool
+	}{
+		{name: "cancelled", cancel: true},
+		{name: "cancelled without grace", reaper: &Reaper{Grace: -1}, ignoreTerm: true, cancel: true},
+		{name: "cancelled with grace", reaper: &Reaper{Grace: 200 * time.Millisecond}, ignoreTerm: true, cancel: true},
+		{name: "write fails", reaper: &Reaper{Grace: 200 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			repoPath := filepath.Join(dir, "repo.git")
+			if out, err := exec.Command("git", "init", "--quiet", "--bare", repoPath).CombinedOutput(); err != nil {
+				t.Fatalf("git init: %v: %s", err, out)
+			}
+			script := filepath.Join(dir, "upload-pack")
+			if err := os.WriteFile(script, []byte(fakeUploadPack), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			pgidFile := filepath.Join(dir, "pgid")
+			env := []string{"REPOCRAFT_TEST_PGID=" + pgidFile}
+			if tt.ignoreTerm {
+				env = append(env, "REPOCRAFT_TEST_IGNORE_TERM=1")
+			}
+			slots := &admission.Scheduler{Limit: 1}
+			e := ServiceExecutor{
+				UploadPackPath: script,
+				BaseEnv:        env,
+				Admission:      slots,
+				Reaper:         tt.reaper,
+			}
+			req := ServiceRequest{Service: ServiceUploadPack, RepoPath: repoPath, RepoName: "repo.git", Identity: "client"}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := &dropWriter{started: make(chan struct{})}
+			done := make(chan error, 1)
+			go func() {
+				done <- e.Serve(ctx, req, nil, client, &strings.Builder{})
+			}()
+
+			select {
+			case <-client.started:
+			case err := <-done:
+				t.Fatalf("Serve returned before the transfer started: %v", err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("transfer didn't start")
+			}
+			data, err := os.ReadFile(pgidFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pgid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = killGroup(pgid) })
+			if !groupAlive(pgid) {
+				t.Fatal("process group not running during the transfer")
+			}
+
+			if tt.cancel {
+				cancel()
+			} else {
+				client.drop()
+			}
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("Serve succeeded after the connection dropped")
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Serve didn't return after the connection dropped")
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for groupAlive(pgid) && time.Now().Before(deadline) {
+				time.Sleep(20 * time.Millisecond)
+			}
+			if groupAlive(pgid) {
+				t.Error("processes of the group still running after the connection dropped")
+			}
+			if running, queued := slots.Stats(); running != 0 || queued != 0 {
+				t.Errorf("admission after the drop: %d running, %d queued, want none", running, queued)
+			}
+			acquireCtx, stop := context.WithTimeout(context.Background(), time.Second)
+			defer stop()
+			release, err := slots.Acquire(acquireCtx, "other")
+			if err != nil {
+				t.Fatalf("slot not released: %v", err)
+			}
+			release()
+		})
+	}
+}
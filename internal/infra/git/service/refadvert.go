@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+)
+
+// RefAdvertisement tunes which refs upload-pack advertises to clients.
+type RefAdvertisement struct {
+	// HideRefs are passed to upload-pack as uploadpack.hideRefs entries
+	// (e.g. "refs/pull/", "refs/changes/"), hiding them from both protocol
+	// versions while keeping them fetchable by object name if allowed.
+	HideRefs []string
+	// LsRefsPrefixes are injected as ref-prefix arguments into protocol v2
+	// ls-refs commands that carry none, so bare ls-refs calls don't list
+	// every ref of very large repositories.
+	LsRefsPrefixes []string
+}
+
+// IsZero reports whether no tuning is configured.
+func (a RefAdvertisement) IsZero() bool {
+	return len(a.HideRefs) == 0 && len(a.LsRefsPrefixes) == 0
+}
+
+// RefAdvertisementPolicy resolves RefAdvertisement settings per repository.
+type RefAdvertisementPolicy struct {
+	Default RefAdvertisement
+	// PerRepo overrides Default entirely for the given repositories, keyed by
+	// the repository path relative to the root (e.g. "owner/repo.git").
+	PerRepo map[string]RefAdvertisement
+}
+
+// For returns the settings for repo.
+func (p RefAdvertisementPolicy) For(repo string) RefAdvertisement {
+	if a, ok := p.PerRepo[strings.Trim(repo, "/")]; ok {
+		return a
+	}
+	return p.Default
+}
+
+func (a RefAdvertisement) gitConfig() [][2]string {
+	var cfg [][2]string
+	for _, ref := range a.HideRefs {
+		cfg = append(cfg, [2]string{"uploadpack.hideRefs", ref})
+	}
+	return cfg
+}
+
+// filterLsRefs copies a protocol v2 request stream from src to dst, adding
+// the default ref prefixes to ls-refs commands without ref-prefix arguments.
+func filterLsRefs(dst io.Writer, src io.Reader, prefixes []string) error {
+	r := pktline.NewReader(src)
+	w := pktline.NewWriter(dst)
+
+	inLsRefs, sawDelim, sawPrefix := false, false, false
+	for {
+		pkt, err := r.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch pkt.Type {
+		case pktline.Data:
+			line := bytes.TrimSuffix(pkt.Payload, []byte("\n"))
+			if bytes.HasPrefix(line, []byte("command=")) {
+				inLsRefs = string(line) == "command=ls-refs"
+				sawDelim, sawPrefix = false, false
+			} else if inLsRefs && sawDelim && bytes.HasPrefix(line, []byte("ref-prefix ")) {
+				sawPrefix = true
+			}
+		case pktline.Delim:
+			sawDelim = true
+		case pktline.Flush:
+			if inLsRefs && !sawPrefix {
+				if !sawDelim {
+					if err := w.WritePacket(pktline.Packet{Type: pktline.Delim}); err != nil {
+						return err
+					}
+				}
+				for _, prefix := range prefixes {
+					if err := w.WriteString("ref-prefix " + prefix + "\n"); err != nil {
+						return err
+					}
+				}
+			}
+			inLsRefs = false
+		}
+
+		if err := w.WritePacket(pkt); err != nil {
+			return err
+		}
+	}
+}
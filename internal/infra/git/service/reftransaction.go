@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+)
+
+// ReferenceTransactions takes part in the ref updates receive-pack applies.
+// Prepare is called once git has locked the refs but before they change;
+// returning an error rejects the update. The returned transaction is then
+// committed or aborted to match the outcome of git's own transaction.
+type ReferenceTransactions interface {
+	Prepare(ctx context.Context, req ServiceRequest, updates []PushCommand) (PreparedTransaction, error)
+}
+
+// PreparedTransaction is a ref update that was accepted by Prepare.
+type PreparedTransaction interface {
+	Commit(ctx context.Context) error
+	Abort(ctx context.Context) error
+}
+
+// JoinTransactions returns ReferenceTransactions taking part through each
+// of handlers in turn, skipping nil ones. An update is rejected if any of
+// them rejects it, and those that already accepted it abort.
+func JoinTransactions(handlers ...ReferenceTransactions) ReferenceTransactions {
+	var joined joinedTransactions
+	for _, h := range handlers {
+		if h != nil {
+			joined = append(joined, h)
+		}
+	}
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
+
+type joinedTransactions []ReferenceTransactions
+
+func (j joinedTransactions) Prepare(ctx context.Context, req ServiceRequest, updates []PushCommand) (PreparedTransaction, error) {
+	var prepared joinedTransaction
+	for _, h := range j {
+		tx, err := h.Prepare(ctx, req, updates)
+		if err != nil {
+			prepared.Abort(ctx)
+			return nil, err
+		}
+		prepared = append(prepared, tx)
+	}
+	return prepared, nil
+}
+
+type joinedTransaction []PreparedTransaction
+
+func (t joinedTransaction) Commit(ctx context.Context) error {
+	var errs []error
+	for _, tx := range t {
+		errs = append(errs, tx.Commit(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (t joinedTransaction) Abort(ctx context.Context) error {
+	var errs []error
+	for _, tx := range t {
+		errs = append(errs, tx.Abort(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// refTxnScript is installed as the reference-transaction hook. It runs the
+// repository's own hook first, then hands the phase and updates to the server
+// through a pair of FIFOs and fails if the server declines.
+const refTxnScript = `#!/bin/sh
+updates=$(cat)
+own="$REPOCRAFT_REPO_HOOKS/reference-transaction"
+if [ -x "$own" ]; then
+	printf '%s\n' "$updates" | "$own" "$1" || exit 1
+fi
+{ printf '%s\n' "$1"; [ -z "$updates" ] || printf '%s\n' "$updates"; echo; } >"$REPOCRAFT_TXN_DIR/request" || exit 1
+read -r status <"$REPOCRAFT_TXN_DIR/response" || exit 1
+if [ "$status" != ok ]; then
+	echo "$status" >&2
+	exit 1
+fi
+`
+
+// refTxnHook serves reference-transaction hook invocations for one
+// receive-pack process. refTxnScript, installed through a hookOverlay,
+// talks to it through a pair of FIFOs.
+type refTxnHook struct {
+	dir      string
+	request  *os.File
+	response *os.File
+	done     chan struct{}
+	logger   *slog.Logger
+}
+
+func startRefTxnHook(ctx context.Context, handler ReferenceTransactions, req ServiceRequest, logger *slog.Logger) (*refTxnHook, error) {
+	dir, err := os.MkdirTemp("", "repocraft-txn-")
+	if err != nil {
+		return nil, err
+	}
+	h := &refTxnHook{dir: dir, done: make(chan struct{}), logger: logger}
+	if err := h.setup(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go h.serve(context.WithoutCancel(ctx), handler, req)
+	return h, nil
+}
+
+func (h *refTxnHook) setup() error {
+	for _, name := range []string{"request", "response"} {
+		if err := mkfifo(filepath.Join(h.dir, name)); err != nil {
+			return err
+		}
+	}
+	// Opening read-write keeps the FIFOs from blocking or reaching EOF
+	// between hook invocations.
+	var err error
+	if h.request, err = os.OpenFile(filepath.Join(h.dir, "request"), os.O_RDWR, 0); err != nil {
+		return err
+	}
+	if h.response, err = os.OpenFile(filepath.Join(h.dir, "response"), os.O_RDWR, 0); err != nil {
+		h.request.Close()
+		return err
+	}
+	return nil
+}
+
+func (h *refTxnHook) env() string {
+	return "REPOCRAFT_TXN_DIR=" + h.dir
+}
+
+func (h *refTxnHook) serve(ctx context.Context, handler ReferenceTransactions, req ServiceRequest) {
+	defer close(h.done)
+	var pending PreparedTransaction
+	defer func() {
+		// receive-pack exited between prepare and commit.
+		if pending != nil {
+			if err := pending.Abort(ctx); err != nil {
+				h.logger.Error("abort reference transaction", "repo", req.RepoName, "error", err)
+			}
+		}
+	}()
+
+	r := bufio.NewReader(h.request)
+	for {
+		phase, updates, err := readRefTxnRequest(r)
+		if err != nil {
+			return
+		}
+		status := "ok"
+		switch phase {
+		case "prepared":
+			if len(updates) == 0 {
+				break
+			}
+			tx, err := handler.Prepare(ctx, req, updates)
+			if err != nil {
+				status = strings.ReplaceAll(err.Error(), "\n", " ")
+				break
+			}
+			pending = tx
+		case "committed":
+			if pending != nil {
+				if err := pending.Commit(ctx); err != nil {
+					h.logger.Error("commit reference transaction", "repo", req.RepoName, "error", err)
+				}
+				pending = nil
+			}
+		case "aborted":
+			// git also reports aborted transactions that were never
+			// prepared, such as an unused packed-refs transaction.
+			if pending != nil {
+				if err := pending.Abort(ctx); err != nil {
+					h.logger.Error("abort reference transaction", "repo", req.RepoName, "error", err)
+				}
+				pending = nil
+			}
+		}
+		if _, err := fmt.Fprintln(h.response, status); err != nil {
+			return
+		}
+	}
+}
+
+// readRefTxnRequest reads a phase line followed by "<old> <new> <ref>" lines
+// up to an empty line. Updates that change nothing are dropped, as are
+// symbolic refs such as HEAD, which git reports next to the ref they point to.
+func readRefTxnRequest(r *bufio.Reader) (string, []PushCommand, error) {
+	phase, err := r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	var updates []PushCommand
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.TrimSpace(phase), updates, nil
+		}
+		if cmd, ok := parsePushCommand([]byte(line)); ok && cmd.Old != cmd.New && strings.HasPrefix(cmd.Ref, "refs/") {
+			updates = append(updates, cmd)
+		}
+	}
+}
+
+func (h *refTxnHook) close() {
+	h.request.Close()
+	h.response.Close()
+	<-h.done
+	os.RemoveAll(h.dir)
+}
+
+// encryptPushed encrypts the objects a push added to the staged copy of an
+// encrypted repository once git prepared the ref updates, so that refs
+// never point to objects only the staged copy holds.
+type encryptPushed struct {
+	staged *atrest.Staged
+	logger *slog.Logger
+}
+
+func (t encryptPushed) Prepare(ctx context.Context, req ServiceRequest, updates []PushCommand) (PreparedTransaction, error) {
+	if err := t.staged.Commit(); err != nil {
+		t.logger.Error("encrypt pushed objects", "repo", req.RepoName, "error", err)
+		return nil, errEncryptPushed
+	}
+	return encryptedPush{}, nil
+}
+
+// encryptedPush has nothing to undo: objects no ref points to are left
+// for gc.
+type encryptedPush struct{}
+
+func (encryptedPush) Commit(context.Context) error { return nil }
+func (encryptedPush) Abort(context.Context) error  { return nil }
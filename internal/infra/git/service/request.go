@@ -1,21 +1,60 @@
 package service
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
-// ServiceRequest describes an incoming SSH git service request.
+// ServiceRequest describes an incoming git service request.
 type ServiceRequest struct {
 	Service         Service
 	RepoPath        string
+	RepoName        string // path relative to the repository root, e.g. "owner/repo.git"
+	Identity        string // authenticated identity or client address, for accounting
+	User            string // user the transport authenticated, "" if none; see access.Authorizer
+	RemoteAddr      string // address of the client, for logs
 	ProtocolVersion string // e.g. "version=2" when Git wants protocol v2
+	StatelessRPC    bool   // run with --stateless-rpc (Smart HTTP)
+	AdvertiseRefs   bool   // run with --advertise-refs (Smart HTTP info/refs)
+	Locale          string // locale of client-facing messages; see locale.Localizer
+	// Args are the subcommand and arguments of ServiceAdminCommand, e.g.
+	// ["for-each-ref", "refs/heads/"].
+	Args []string
+}
+
+// IsProtocolV2 reports whether the client asked for protocol version 2.
+func (r ServiceRequest) IsProtocolV2() bool {
+	for _, param := range strings.Split(r.ProtocolVersion, ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// WithoutProtocolV2 returns Git-Protocol parameters without "version=2",
+// so the service answers with protocol version 0.
+func WithoutProtocolV2(params string) string {
+	var kept []string
+	for _, param := range strings.Split(params, ":") {
+		if param != "version=2" && param != "" {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, ":")
 }
 
 // Validate performs a basic sanity check on the request.
 func (r ServiceRequest) Validate() error {
-	if !r.Service.IsSupported() {
+	if r.Service == ServiceAdminCommand {
+		if len(r.Args) == 0 {
+			return fmt.Errorf("missing git command")
+		}
+	} else if !r.Service.IsSupported() {
 		return fmt.Errorf("unsupported service: %s", r.Service)
 	}
 	if r.RepoPath == "" {
 		return fmt.Errorf("missing repository path")
 	}
-	return nil
+	return ValidProtocolParams(r.ProtocolVersion)
 }
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+)
+
+// requestFilter passes a client request through to git one complete
+// pkt-line at a time. packet decides what each packet becomes: it appends
+// the bytes to pass on to out, which may be nothing while it holds packets
+// back, or refuses the request with an error. On refusal, stop is called
+// before the read fails: upload-pack takes a request ending early as
+// complete and would go on to serve it.
+type requestFilter struct {
+	r io.Reader
+	// packet gets the encoded packet and its payload (nil for flush,
+	// delim and response-end packets). Returning errPassRest passes the
+	// packet and everything after it on unchecked.
+	packet func(out, pkt, payload []byte) ([]byte, error)
+	// held appends packets still held back when the request ends.
+	held func(out []byte) []byte
+	stop func()
+	// strict refuses input that is not pkt-line framed with
+	// ErrMalformedRequest instead of passing it through.
+	strict bool
+
+	chunk []byte
+	in    []byte // read but not yet seen by packet
+	out   []byte // ready to be read by git
+	bad   bool   // not pkt-line framed; passed through unchecked
+	err   error  // refusal
+	rerr  error  // from reading the client
+}
+
+// errPassRest is returned by packet functions to stop filtering.
+var errPassRest = errors.New("pass the rest through")
+
+// Read implements io.Reader.
+func (f *requestFilter) Read(p []byte) (int, error) {
+	if err := f.fill(); err != nil {
+		if f.err != nil && f.stop != nil {
+			f.stop()
+			f.stop = nil
+		}
+		return 0, err
+	}
+	n := copy(p, f.out)
+	f.out = f.out[n:]
+	return n, nil
+}
+
+// fill reads from the client until bytes are ready for git. It returns an
+// error only when none are: the refusal, or the client's read error.
+func (f *requestFilter) fill() error {
+	for len(f.out) == 0 && f.err == nil && f.rerr == nil {
+		if f.chunk == nil {
+			f.chunk = make([]byte, 32<<10)
+		}
+		n, err := f.r.Read(f.chunk)
+		f.in = append(f.in, f.chunk[:n]...)
+		f.scan()
+		if err != nil {
+			if err == io.EOF && f.err == nil {
+				if f.strict && len(f.in) > 0 {
+					f.err = ErrMalformedRequest
+					break
+				}
+				// git reports whatever is left as a truncated request.
+				if f.held != nil {
+					f.out = f.held(f.out)
+				}
+				f.out = append(f.out, f.in...)
+				f.in = nil
+			}
+			f.rerr = err
+		}
+	}
+	if len(f.out) > 0 {
+		return nil
+	}
+	if f.err != nil {
+		return f.err
+	}
+	return f.rerr
+}
+
+func (f *requestFilter) scan() {
+	for !f.bad && f.err == nil && len(f.in) >= 4 {
+		size, err := strconv.ParseUint(string(f.in[:4]), 16, 16)
+		if err != nil || size == 3 || size > pktline.MaxPayload+4 {
+			if f.strict {
+				f.err = ErrMalformedRequest
+				return
+			}
+			f.bad = true
+			break
+		}
+		var payload []byte
+		if size < 4 {
+			size = 4
+		} else if len(f.in) < int(size) {
+			return
+		} else {
+			payload = f.in[4:size]
+		}
+		f.out, f.err = f.packet(f.out, f.in[:size:size], payload)
+		if f.err == errPassRest {
+			f.out, f.err = append(f.out, f.in[:size]...), nil
+			f.in = f.in[size:]
+			f.bad = true
+			break
+		}
+		if f.err != nil {
+			return
+		}
+		f.in = f.in[size:]
+	}
+	if f.bad {
+		if f.held != nil {
+			f.out = f.held(f.out)
+		}
+		f.out = append(f.out, f.in...)
+		f.in = nil
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RepoMount serves the repositories under the URL namespace Prefix from
+// Root, e.g. "mirrors" from /data/mirrors.
+type RepoMount struct {
+	Prefix string
+	Root   string
+}
+
+// RepoResolver maps repository paths as they appear in URLs to directories.
+// A path under a mount's prefix lives in that mount's root, without the
+// prefix; the longest matching prefix wins. Every other path lives in Root.
+//
+// Namespaces nest to any depth, e.g. "group/subgroup/project.git". A
+// directory holding a bare repository is a repository and every other
+// directory a namespace. A path naming no repository resolves to the one
+// with ".git" appended if that exists, so "group/project" and
+// "group/project.git" reach the same repository.
+type RepoResolver struct {
+	Root   string
+	Mounts []RepoMount
+}
+
+// Resolve returns the directory of the repository at name, a slash
+// separated path such as "mirrors/linux.git", together with the cleaned
+// name.
+func (r RepoResolver) Resolve(name string) (full, cleaned string, err error) {
+	cleaned = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "" {
+		return "", "", errors.New("empty path")
+	}
+	root, rel := r.Root, cleaned
+	matched := 0
+	for _, m := range r.Mounts {
+		prefix := strings.Trim(m.Prefix, "/")
+		if prefix == "" || len(prefix) <= matched {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(cleaned, prefix+"/"); ok {
+			root, rel, matched = m.Root, rest, len(prefix)
+		}
+	}
+	if root == "" {
+		return "", "", errors.New("no repository root for path")
+	}
+	full = filepath.Join(root, filepath.FromSlash(rel))
+	if err := ensureWithinRoot(root, full); err != nil {
+		return "", "", err
+	}
+	if !strings.HasSuffix(cleaned, ".git") && !IsRepository(full) && IsRepository(full+".git") {
+		full, cleaned = full+".git", cleaned+".git"
+	}
+	return full, cleaned, nil
+}
+
+// IsRepository reports whether dir holds a bare repository.
+func IsRepository(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func ensureWithinRoot(root, full string) error {
+	rootClean := filepath.Clean(root)
+	fullClean := filepath.Clean(full)
+	if rootClean == fullClean {
+		return nil
+	}
+	if !strings.HasPrefix(fullClean, rootClean+string(os.PathSeparator)) {
+		return errors.New("path traversal detected")
+	}
+	return nil
+}
+
+// ParseRepoMounts parses a comma-separated list of prefix=root pairs, e.g.
+// "mirrors=/data/mirrors,users=/data/users".
+func ParseRepoMounts(s string) ([]RepoMount, error) {
+	var mounts []RepoMount
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, root, ok := strings.Cut(pair, "=")
+		prefix = strings.Trim(prefix, "/")
+		if !ok || prefix == "" || root == "" {
+			return nil, fmt.Errorf("invalid repository mount %q, want prefix=root", pair)
+		}
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("repository mount %q: %w", pair, err)
+		}
+		mounts = append(mounts, RepoMount{Prefix: prefix, Root: abs})
+	}
+	return mounts, nil
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Result summarizes a finished service invocation.
+type Result struct {
+	Request   ServiceRequest
+	Start     time.Time
+	Duration  time.Duration
+	Queued    time.Duration // time spent waiting for an admission slot
+	BytesIn   int64         // bytes read from the client
+	BytesOut  int64         // bytes written to the client
+	UserCPU   time.Duration
+	SystemCPU time.Duration
+	MaxRSS    int64 // peak resident set size of the git process in bytes
+	ExitCode  int   // -1 if the process did not start or was killed by a signal
+	Err       error
+}
+
+// String formats the result as a single log line.
+func (r Result) String() string {
+	s := fmt.Sprintf("%s %s identity=%s exit=%d wall=%s user=%s sys=%s maxrss=%dKiB in=%dB out=%dB",
+		r.Request.Service, r.Request.RepoName, r.Request.Identity, r.ExitCode,
+		r.Duration.Round(time.Millisecond), r.UserCPU.Round(time.Millisecond), r.SystemCPU.Round(time.Millisecond),
+		r.MaxRSS/1024, r.BytesIn, r.BytesOut)
+	if len(r.Request.Args) > 0 {
+		s += fmt.Sprintf(" args=%q", strings.Join(r.Request.Args, " "))
+	}
+	if r.Queued >= time.Millisecond {
+		s += fmt.Sprintf(" queued=%s", r.Queued.Round(time.Millisecond))
+	}
+	if r.Err != nil {
+		s += fmt.Sprintf(" err=%q", r.Err.Error())
+	}
+	return s
+}
+
+// Attrs returns the result as structured log fields.
+func (r Result) Attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("service", r.Request.Service.Command()),
+		slog.String("repo", r.Request.RepoName),
+		slog.String("identity", r.Request.Identity),
+		slog.String("remote_addr", r.Request.RemoteAddr),
+		slog.Int("exit_code", r.ExitCode),
+		slog.Duration("duration", r.Duration),
+		slog.Duration("user_cpu", r.UserCPU),
+		slog.Duration("sys_cpu", r.SystemCPU),
+		slog.Int64("max_rss", r.MaxRSS),
+		slog.Int64("bytes_in", r.BytesIn),
+		slog.Int64("bytes_out", r.BytesOut),
+	}
+	if len(r.Request.Args) > 0 {
+		attrs = append(attrs, slog.String("args", strings.Join(r.Request.Args, " ")))
+	}
+	if r.Queued >= time.Millisecond {
+		attrs = append(attrs, slog.Duration("queued", r.Queued))
+	}
+	if r.Err != nil {
+		attrs = append(attrs, slog.String("error", r.Err.Error()))
+	}
+	return attrs
+}
+
+// Log logs the result to logger, as an error if the invocation failed.
+func (r Result) Log(logger *slog.Logger) {
+	level := slog.LevelInfo
+	if r.Err != nil {
+		level = slog.LevelError
+	}
+	logger.LogAttrs(context.Background(), level, "git finished", r.Attrs()...)
+}
+
+func exitCode(cmd *exec.Cmd, err error) int {
+	if cmd.ProcessState != nil {
+		return cmd.ProcessState.ExitCode()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	xssh "golang.org/x/crypto/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repomatch"
+)
+
+// ReviewPolicy enforces two-person review of direct pushes to protected
+// branches. Such a push must be signed (git push --signed) with the SSH key
+// of an approver other than the key that authenticated the push, e.g. a
+// reviewer's key on a hardware token while a bot pushes. Merges through the
+// admin API don't go through receive-pack and aren't affected, so a review
+// system holding the admin token can merge what it approved. It is read
+// from a JSON file:
+//
+//	{"approvers": {"bob": "ssh-ed25519 AAAA... bob@laptop"},
+//	 "repos": {"team/*": {"refs": ["refs/heads/main", "refs/heads/release/*"]}}}
+//
+// git verifies the push certificates against the approvers' keys.
+type ReviewPolicy struct {
+	// Approvers maps names to the public SSH keys, in authorized_keys form,
+	// their approvals are signed with.
+	Approvers map[string]string `json:"approvers"`
+	// Repos maps path.Match patterns such as "team/*" to the rule of
+	// matching repositories; the longest matching pattern wins.
+	Repos map[string]ReviewRule `json:"repos"`
+	// NonceSeed keys the nonces that keep push certificates from being
+	// replayed. Servers sharing repositories need the same seed; a random
+	// one is used when empty.
+	NonceSeed string `json:"nonce_seed,omitempty"`
+
+	allowedSigners []byte
+}
+
+// ReviewRule protects refs of the repositories it applies to.
+type ReviewRule struct {
+	// Refs are path.Match patterns of protected refs, e.g.
+	// "refs/heads/main" or "refs/heads/release/*".
+	Refs []string `json:"refs"`
+	// Approvers names who may approve pushes; every approver when empty.
+	Approvers []string `json:"approvers,omitempty"`
+}
+
+// errReviewRequired is shown when a push to a protected ref lacks approval.
+var errReviewRequired = errcode.New(errcode.AccessDenied, "pushes to protected branches need a second person's approval: push with --signed using an approver's key, or merge through the merge API")
+
+const (
+	reviewMessageEnv   = "REPOCRAFT_REVIEW_MESSAGE"
+	reviewRefsEnv      = "REPOCRAFT_PROTECTED_REFS"
+	reviewApproversEnv = "REPOCRAFT_APPROVERS"
+	reviewPusherEnv    = "REPOCRAFT_PUSHER"
+	allowedSignersFile = "allowed_signers"
+)
+
+// reviewScript is installed as the pre-receive hook of repositories with
+// protected refs. Updates to protected refs need a push certificate git
+// verified, with a valid nonce, signed by an approver whose key isn't the
+// pusher's. It then runs the next pre-receive hook.
+const reviewScript = `#!/bin/sh
+updates=$(cat)
+deny() {
+	printf '%s\n' "$` + reviewMessageEnv + `" >&2
+	[ -n "$1" ] && printf '%s\n' "$1" >&2
+	exit 1
+}
+protected=
+set -f
+while read -r old new ref; do
+	for pattern in $` + reviewRefsEnv + `; do
+		case "$ref" in
+		$pattern) protected="$ref" ;;
+		esac
+	done
+done <<EOF
+$updates
+EOF
+set +f
+if [ -n "$protected" ]; then
+	[ "$GIT_PUSH_CERT_STATUS" = G ] || deny "($protected: no valid push certificate)"
+	case "$GIT_PUSH_CERT_NONCE_STATUS" in
+	OK | SLOP) ;;
+	*) deny "($protected: push certificate nonce $GIT_PUSH_CERT_NONCE_STATUS)" ;;
+	esac
+	approved=
+	for name in $` + reviewApproversEnv + `; do
+		[ "$name" = "$GIT_PUSH_CERT_SIGNER" ] && approved=1
+	done
+	[ -n "$approved" ] || deny "($protected: ${GIT_PUSH_CERT_SIGNER:-$GIT_PUSH_CERT_KEY} is not an approver)"
+	[ "$GIT_PUSH_CERT_KEY" != "$` + reviewPusherEnv + `" ] || deny "($protected: approved with the pushing key)"
+	echo "$protected approved by $GIT_PUSH_CERT_SIGNER" >&2
+fi
+next="$0.next"
+[ -x "$next" ] || next="$REPOCRAFT_REPO_HOOKS/pre-receive"
+if [ -x "$next" ]; then
+	printf '%s\n' "$updates" | "$next" "$@" || exit 1
+fi
+`
+
+var approverName = regexp.MustCompile(`^[A-Za-z0-9._@+-]+$`)
+
+// LoadReviewPolicy reads a review policy from a JSON file.
+func LoadReviewPolicy(file string) (*ReviewPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read review policy: %w", err)
+	}
+	p := &ReviewPolicy{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("parse review policy %s: %w", file, err)
+	}
+	if err := p.Init(); err != nil {
+		return nil, fmt.Errorf("review policy %s: %w", file, err)
+	}
+	return p, nil
+}
+
+// Init checks the policy and prepares the approvers' keys for git.
+func (p *ReviewPolicy) Init() error {
+	names := make([]string, 0, len(p.Approvers))
+	for name := range p.Approvers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var signers bytes.Buffer
+	for _, name := range names {
+		if !approverName.MatchString(name) {
+			return fmt.Errorf("invalid approver name %q", name)
+		}
+		key, _, _, _, err := xssh.ParseAuthorizedKey([]byte(p.Approvers[name]))
+		if err != nil {
+			return fmt.Errorf("approver %s: %w", name, err)
+		}
+		fmt.Fprintf(&signers, "%s %s", name, xssh.MarshalAuthorizedKey(key))
+	}
+	for pattern, rule := range p.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+		if len(rule.Refs) == 0 {
+			return fmt.Errorf("%s: no protected refs", pattern)
+		}
+		for _, ref := range rule.Refs {
+			if _, err := path.Match(ref, ""); err != nil || !strings.HasPrefix(ref, "refs/") || strings.ContainsAny(ref, " \t\n") {
+				return fmt.Errorf("%s: invalid ref pattern %q", pattern, ref)
+			}
+		}
+		for _, name := range rule.Approvers {
+			if _, ok := p.Approvers[name]; !ok {
+				return fmt.Errorf("%s: unknown approver %q", pattern, name)
+			}
+		}
+	}
+	if p.NonceSeed == "" {
+		seed := make([]byte, 32)
+		if _, err := rand.Read(seed); err != nil {
+			return err
+		}
+		p.NonceSeed = hex.EncodeToString(seed)
+	}
+	p.allowedSigners = signers.Bytes()
+	return nil
+}
+
+// For returns the rule for repo, if it has protected refs.
+func (p *ReviewPolicy) For(repo string) (ReviewRule, bool) {
+	if p == nil {
+		return ReviewRule{}, false
+	}
+	return repomatch.Best(p.Repos, repo)
+}
+
+// config makes receive-pack offer push certificates and verify them
+// against the approvers' keys, written to dir.
+func (p *ReviewPolicy) config(dir string) [][2]string {
+	config := [][2]string{
+		{"receive.certNonceSeed", p.NonceSeed},
+		// Smart HTTP pushes arrive a moment after the advertisement that
+		// handed out the nonce.
+		{"receive.certNonceSlop", "300"},
+	}
+	if dir != "" {
+		config = append(config,
+			[2]string{"gpg.format", "ssh"},
+			[2]string{"gpg.ssh.allowedSignersFile", filepath.Join(dir, allowedSignersFile)},
+		)
+	}
+	return config
+}
+
+// env passes rule and the pusher's identity to reviewScript.
+func (p *ReviewPolicy) env(rule ReviewRule, identity, message string) []string {
+	approvers := rule.Approvers
+	if len(approvers) == 0 {
+		for name := range p.Approvers {
+			approvers = append(approvers, name)
+		}
+		sort.Strings(approvers)
+	}
+	return []string{
+		reviewMessageEnv + "=" + message,
+		reviewRefsEnv + "=" + strings.Join(rule.Refs, " "),
+		reviewApproversEnv + "=" + strings.Join(approvers, " "),
+		reviewPusherEnv + "=" + identity,
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule maps repository paths matching Pattern to Replacement, which
+// may refer to submatches as $1 or ${name}, e.g. "^svn-migrated/(.+)$" to
+// "legacy/$1.git".
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// RewriteRules rewrite requested repository paths before they are resolved.
+// Rules are tried in order and the first match applies.
+type RewriteRules []RewriteRule
+
+// Rewrite returns the rewritten form of name, a repository path without a
+// leading slash, and whether a rule matched.
+func (rs RewriteRules) Rewrite(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, r := range rs {
+		m := r.Pattern.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+		out := r.Pattern.ExpandString(nil, r.Replacement, name, m)
+		return strings.TrimPrefix(path.Clean("/"+string(out)), "/"), true
+	}
+	return name, false
+}
+
+// LoadRewriteRules reads rules from file, one "pattern replacement" pair
+// per line. Blank lines and lines starting with # are ignored.
+func LoadRewriteRules(file string) (RewriteRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules RewriteRules
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a pattern and a replacement", file, n)
+		}
+		re, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		rules = append(rules, RewriteRule{Pattern: re, Replacement: fields[1]})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package service
+
+import "os"
+
+// maxRSS is not available on this platform.
+func maxRSS(*os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a snapshot of an active invocation. Byte counts are live, as
+// seen by the client, and grow while the transfer runs.
+type Session struct {
+	ID       uint64    `json:"id"`
+	Service  Service   `json:"service"`
+	Repo     string    `json:"repo"`
+	Identity string    `json:"identity,omitempty"`
+	State    string    `json:"state"` // "queued" or "running"
+	Start    time.Time `json:"start"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// Sessions lists the invocations in progress. A nil Sessions tracks nothing.
+type Sessions struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*activeSession
+}
+
+type activeSession struct {
+	Session
+	in  *countingReader
+	out *countingWriter
+}
+
+// List returns the active sessions, oldest first.
+func (s *Sessions) List() []Session {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	out := make([]Session, 0, len(s.active))
+	for _, a := range s.active {
+		sess := a.Session
+		if a.in != nil {
+			sess.BytesIn = a.in.n.Load()
+		}
+		sess.BytesOut = a.out.n.Load()
+		out = append(out, sess)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// begin registers a queued invocation and returns it for updates.
+func (s *Sessions) begin(req ServiceRequest, in *countingReader, out *countingWriter) *activeSession {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		s.active = make(map[uint64]*activeSession)
+	}
+	s.nextID++
+	a := &activeSession{
+		Session: Session{
+			ID:       s.nextID,
+			Service:  req.Service,
+			Repo:     req.RepoName,
+			Identity: req.Identity,
+			State:    "queued",
+			Start:    time.Now(),
+		},
+		in:  in,
+		out: out,
+	}
+	s.active[a.ID] = a
+	return a
+}
+
+// running marks a as admitted.
+func (s *Sessions) running(a *activeSession) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a.State = "running"
+	a.Start = time.Now()
+}
+
+func (s *Sessions) end(a *activeSession) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, a.ID)
+}
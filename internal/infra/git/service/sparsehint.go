@@ -0,0 +1,53 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/sparse"
+)
+
+// sparseHintMessage is the catalog key of the hint telling clients that
+// clone a whole repository about its sparse profiles; Message lists them.
+const sparseHintMessage = "This repository has sparse profiles for partial clones: {{.Message}}"
+
+// sparseProfilesPath is where the read API describes the profiles of a
+// repository, with the commands to clone them.
+const sparseProfilesPath = "/api/v1/sparse-profiles?repo="
+
+// sparseHint returns the hint for a clone of the repository at req, or ""
+// if it has no sparse profiles.
+func sparseHint(ctx context.Context, req ServiceRequest) string {
+	profiles, err := sparse.Read(ctx, req.RepoPath)
+	if err != nil || len(profiles) == 0 {
+		return ""
+	}
+	names := make([]string, len(profiles))
+	for i, p := range profiles {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ") + "\nSee " + sparseProfilesPath + req.RepoName
+}
+
+// cloneObserver watches an upload-pack request for what tells a full
+// clone from a fetch or a partial clone: haves and filters.
+type cloneObserver struct {
+	haves, filtered bool
+}
+
+func (o *cloneObserver) packet(out, pkt, payload []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(payload, []byte("have ")):
+		o.haves = true
+	case bytes.HasPrefix(payload, []byte("filter ")):
+		o.filtered = true
+	}
+	return append(out, pkt...), nil
+}
+
+// fullClone reports whether the request so far is a clone without a
+// filter.
+func (o *cloneObserver) fullClone() bool {
+	return !o.haves && !o.filtered
+}
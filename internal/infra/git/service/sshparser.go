@@ -15,6 +15,9 @@ func ParseSSHCommand(command string) (ServiceRequest, error) {
 	if raw == "" {
 		return ServiceRequest{}, fmt.Errorf("empty command")
 	}
+	if len(raw) > maxSSHCommand {
+		return ServiceRequest{}, fmt.Errorf("command longer than %d bytes", maxSSHCommand)
+	}
 
 	parts := strings.Fields(raw)
 	if len(parts) < 2 {
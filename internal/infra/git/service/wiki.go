@@ -0,0 +1,23 @@
+package service
+
+import "strings"
+
+// WikiSuffix ends the path of a project's wiki repository: the wiki of
+// "group/project.git" is "group/project.wiki.git".
+const WikiSuffix = ".wiki.git"
+
+// WikiPath returns the path of the wiki of the repository at repo.
+func WikiPath(repo string) string {
+	return strings.TrimSuffix(strings.Trim(repo, "/"), ".git") + WikiSuffix
+}
+
+// WikiOf reports whether name is a wiki repository and returns the path of
+// its project without ".git"; the project is that path with ".git"
+// appended or, for repositories named without the suffix, the path itself.
+func WikiOf(name string) (string, bool) {
+	base, ok := strings.CutSuffix(strings.Trim(name, "/"), WikiSuffix)
+	if !ok || base == "" || strings.HasSuffix(base, "/") {
+		return "", false
+	}
+	return base, true
+}
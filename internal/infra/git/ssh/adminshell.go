@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	gossh "github.com/gliderlabs/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// DefaultAdminCommands are the read-only git commands AdminShell allows
+// when Commands is empty.
+var DefaultAdminCommands = map[string]bool{
+	"cat-file":      true,
+	"count-objects": true,
+	"for-each-ref":  true,
+	"ls-tree":       true,
+	"rev-list":      true,
+	"rev-parse":     true,
+	"show-ref":      true,
+}
+
+// AdminShell lets identities with the admin-shell scope run additional git
+// commands against a repository for debugging:
+//
+//	ssh -p 2222 host git -C owner/repo.git for-each-ref refs/heads/
+//
+// Commands run through the service executor like any other session, so
+// they are admitted, logged and accounted the same way. Arguments are split
+// on whitespace without shell quoting, and options writing files (--output)
+// are refused.
+type AdminShell struct {
+	// Identities are the key fingerprints granted the admin-shell scope.
+	Identities map[string]bool
+	// Commands lists the allowed git subcommands. Only read-only commands
+	// should be listed; defaults to DefaultAdminCommands.
+	Commands map[string]bool
+}
+
+// isAdminCommand reports whether raw is a plain git command rather than
+// one of the git-* services.
+func isAdminCommand(raw string) bool {
+	fields := strings.Fields(raw)
+	return len(fields) > 0 && fields[0] == "git"
+}
+
+// parse splits `git -C <repo> <command> [args...]` and checks it against
+// the allowlist.
+func (a *AdminShell) parse(raw string) (repo string, args []string, err error) {
+	fields := strings.Fields(raw)
+	if len(fields) < 4 || fields[0] != "git" || fields[1] != "-C" {
+		return "", nil, fmt.Errorf("usage: git -C <repo> <command> [args...]")
+	}
+	repo, args = fields[2], fields[3:]
+	commands := a.Commands
+	if len(commands) == 0 {
+		commands = DefaultAdminCommands
+	}
+	if !commands[args[0]] {
+		return "", nil, fmt.Errorf("git %s is not allowed", args[0])
+	}
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "--output") {
+			return "", nil, fmt.Errorf("%s is not allowed", arg)
+		}
+	}
+	return repo, args, nil
+}
+
+// serveAdminCommand runs a git command of an AdminShell identity.
+func (s *Server) serveAdminCommand(ctx context.Context, sess gossh.Session, fingerprint, rawCmd string) {
+	if s.AdminShell == nil || !s.AdminShell.Identities[fingerprint] {
+		failCommand(sess, errcode.New(errcode.AccessDenied, "git commands require the admin-shell scope"))
+		return
+	}
+	raw, args, err := s.AdminShell.parse(rawCmd)
+	if err != nil {
+		failCommand(sess, errcode.Errorf(errcode.InvalidRequest, "%w", err))
+		return
+	}
+	repoFull, name, err := s.resolveRepoPath(raw)
+	if err != nil {
+		failCommand(sess, errcode.Errorf(errcode.InvalidRequest, "invalid repo path: %w", err))
+		return
+	}
+	if addr := s.Proxy.route(name); addr != "" {
+		code, err := s.Proxy.relay(ctx, addr, sess, rawCmd, fingerprint)
+		if err != nil {
+			s.logger().Error("ssh proxy failed", "repo", name, "backend", addr, "remote_addr", sess.RemoteAddr().String(), "error", err)
+			failCommand(sess, errcode.New(errcode.Unavailable, "repository backend unavailable"))
+			return
+		}
+		_ = sess.Exit(code)
+		return
+	}
+	if _, err := os.Stat(repoFull); err != nil {
+		failCommand(sess, errcode.Errorf(errcode.RepoNotFound, "repository not found: %s", name))
+		return
+	}
+
+	s.logger().Info("ssh admin shell", "key", fingerprint, "args", strings.Join(args, " "), "repo", name, "remote_addr", sess.RemoteAddr().String())
+	exec := service.ServiceExecutor{
+		BaseEnv:     s.BaseEnv,
+		Admission:   s.Admission,
+		Reaper:      s.Reaper,
+		MaxDuration: s.MaxDuration,
+		Sessions:    s.Sessions,
+		OnFinish:    s.finish,
+		Logger:      s.Logger,
+		Tracer:      s.Tracer,
+	}
+	req := service.ServiceRequest{
+		Service:    service.ServiceAdminCommand,
+		RepoPath:   repoFull,
+		RepoName:   name,
+		Identity:   fingerprint,
+		RemoteAddr: sess.RemoteAddr().String(),
+		Args:       args,
+	}
+	if err := exec.Serve(ctx, req, sess, sess, sess.Stderr()); err != nil {
+		failCommand(sess, fmt.Errorf("git %s failed: %w", args[0], err))
+		return
+	}
+	_ = sess.Exit(0)
+}
+
+// failCommand ends a session that doesn't speak the git protocol with err
+// and its code on stderr.
+func failCommand(sess gossh.Session, err error) {
+	fmt.Fprintf(sess.Stderr(), "%s\n", errcode.Text(err))
+	_ = sess.Exit(1)
+}
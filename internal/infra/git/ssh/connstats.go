@@ -0,0 +1,211 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	gossh "github.com/gliderlabs/ssh"
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// ConnStats describes how clients use SSH connections. Automation often
+// opens many exec channels over one connection, which shows up as reused
+// channels.
+//
+// Wire bytes are what crossed the network, payload bytes what sessions
+// carried inside their channels. The SSH library never negotiates
+// compression, so pack data, which is compressed already, isn't compressed
+// twice; wire bytes exceed payload bytes by the framing, padding and MACs.
+type ConnStats struct {
+	OpenConnections int64  `json:"open_connections"`
+	Connections     uint64 `json:"connections"`
+	OpenChannels    int64  `json:"open_channels"`
+	Channels        uint64 `json:"channels"`
+	// ReusedChannels counts channels opened on a connection that already
+	// had one before.
+	ReusedChannels uint64 `json:"reused_channels"`
+	// RejectedChannels counts channels refused by MaxSessionsPerConn.
+	RejectedChannels uint64 `json:"rejected_channels"`
+	// PeakChannelsPerConn is the most channels seen open at once on a
+	// single connection.
+	PeakChannelsPerConn int64 `json:"peak_channels_per_conn"`
+
+	WireBytesIn     uint64 `json:"wire_bytes_in"`
+	WireBytesOut    uint64 `json:"wire_bytes_out"`
+	PayloadBytesIn  uint64 `json:"payload_bytes_in"`
+	PayloadBytesOut uint64 `json:"payload_bytes_out"`
+}
+
+// Overhead is the share of the bytes sent that wasn't payload, in percent,
+// or zero before anything was sent.
+func (c ConnStats) Overhead() float64 {
+	if c.WireBytesOut == 0 || c.PayloadBytesOut > c.WireBytesOut {
+		return 0
+	}
+	return 100 * float64(c.WireBytesOut-c.PayloadBytesOut) / float64(c.WireBytesOut)
+}
+
+// String formats the statistics as a single log line.
+func (c ConnStats) String() string {
+	return fmt.Sprintf("connections=%d/%d channels=%d/%d reused=%d rejected=%d peak_per_conn=%d wire=%dB/%dB payload=%dB/%dB overhead=%.1f%%",
+		c.OpenConnections, c.Connections, c.OpenChannels, c.Channels,
+		c.ReusedChannels, c.RejectedChannels, c.PeakChannelsPerConn,
+		c.WireBytesIn, c.WireBytesOut, c.PayloadBytesIn, c.PayloadBytesOut, c.Overhead())
+}
+
+type connMetrics struct {
+	openConns    atomic.Int64
+	conns        atomic.Uint64
+	openChannels atomic.Int64
+	channels     atomic.Uint64
+	reused       atomic.Uint64
+	rejected     atomic.Uint64
+	peak         atomic.Int64
+	wireIn       atomic.Uint64
+	wireOut      atomic.Uint64
+	payloadIn    atomic.Uint64
+	payloadOut   atomic.Uint64
+}
+
+// connStateKey stores a *connState in the connection's context.
+type connStateKey struct{}
+
+// connState counts the channels of one connection.
+type connState struct {
+	open  atomic.Int64
+	total atomic.Int64
+}
+
+// ConnStats returns connection and channel counters since the server
+// started.
+func (s *Server) ConnStats() ConnStats {
+	m := &s.connMetrics
+	return ConnStats{
+		OpenConnections:     m.openConns.Load(),
+		Connections:         m.conns.Load(),
+		OpenChannels:        m.openChannels.Load(),
+		Channels:            m.channels.Load(),
+		ReusedChannels:      m.reused.Load(),
+		RejectedChannels:    m.rejected.Load(),
+		PeakChannelsPerConn: m.peak.Load(),
+		WireBytesIn:         m.wireIn.Load(),
+		WireBytesOut:        m.wireOut.Load(),
+		PayloadBytesIn:      m.payloadIn.Load(),
+		PayloadBytesOut:     m.payloadOut.Load(),
+	}
+}
+
+// trackConn is a gossh.ConnCallback that counts the connection until it
+// is closed.
+func (s *Server) trackConn(ctx gossh.Context, conn net.Conn) net.Conn {
+	ctx.SetValue(connStateKey{}, &connState{})
+	s.connMetrics.conns.Add(1)
+	s.connMetrics.openConns.Add(1)
+	return &trackedConn{Conn: conn, m: &s.connMetrics, closed: func() { s.connMetrics.openConns.Add(-1) }}
+}
+
+// sessionChannel is the "session" channel handler. It enforces
+// MaxSessionsPerConn before handing the channel to gliderlabs.
+func (s *Server) sessionChannel(srv *gossh.Server, conn *xssh.ServerConn, newChan xssh.NewChannel, ctx gossh.Context) {
+	st, _ := ctx.Value(connStateKey{}).(*connState)
+	if st == nil {
+		st = &connState{}
+	}
+	open := st.open.Add(1)
+	defer st.open.Add(-1)
+	if s.MaxSessionsPerConn > 0 && open > int64(s.MaxSessionsPerConn) {
+		s.connMetrics.rejected.Add(1)
+		_ = newChan.Reject(xssh.ResourceShortage,
+			fmt.Sprintf("too many sessions on this connection (limit %d)", s.MaxSessionsPerConn))
+		return
+	}
+
+	m := &s.connMetrics
+	m.channels.Add(1)
+	if st.total.Add(1) > 1 {
+		m.reused.Add(1)
+	}
+	for {
+		peak := m.peak.Load()
+		if open <= peak || m.peak.CompareAndSwap(peak, open) {
+			break
+		}
+	}
+	m.openChannels.Add(1)
+	defer m.openChannels.Add(-1)
+
+	gossh.DefaultSessionHandler(srv, conn, &countedNewChannel{NewChannel: newChan, m: m}, ctx)
+}
+
+type trackedConn struct {
+	net.Conn
+	m      *connMetrics
+	once   sync.Once
+	closed func()
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.m.wireIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.m.wireOut.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// countedNewChannel counts the payload of the channel once accepted.
+type countedNewChannel struct {
+	xssh.NewChannel
+	m *connMetrics
+}
+
+func (c *countedNewChannel) Accept() (xssh.Channel, <-chan *xssh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countedChannel{Channel: ch, m: c.m}, reqs, nil
+}
+
+type countedChannel struct {
+	xssh.Channel
+	m *connMetrics
+}
+
+func (c *countedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.m.payloadIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.m.payloadOut.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedChannel) Stderr() io.ReadWriter {
+	return &countedStderr{ReadWriter: c.Channel.Stderr(), m: c.m}
+}
+
+type countedStderr struct {
+	io.ReadWriter
+	m *connMetrics
+}
+
+func (c *countedStderr) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.m.payloadOut.Add(uint64(n))
+	return n, err
+}
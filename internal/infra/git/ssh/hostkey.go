@@ -0,0 +1,60 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// HostKey is a host key that can be replaced while the server runs, e.g.
+// when it is rotated in a secrets manager. New connections are offered the
+// new key; established ones are not affected.
+type HostKey struct {
+	mu     sync.RWMutex
+	signer xssh.AlgorithmSigner
+}
+
+// Set replaces the key with the PEM-encoded private key. The key type must
+// not change once the server is running.
+func (k *HostKey) Set(pem []byte) error {
+	signer, err := xssh.ParsePrivateKey(pem)
+	if err != nil {
+		return fmt.Errorf("parse host key: %w", err)
+	}
+	algSigner, ok := signer.(xssh.AlgorithmSigner)
+	if !ok {
+		return errors.New("unsupported host key type")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.signer != nil && k.signer.PublicKey().Type() != signer.PublicKey().Type() {
+		return fmt.Errorf("host key type changed from %s to %s", k.signer.PublicKey().Type(), signer.PublicKey().Type())
+	}
+	k.signer = algSigner
+	return nil
+}
+
+func (k *HostKey) current() xssh.AlgorithmSigner {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.signer
+}
+
+// PublicKey implements xssh.Signer.
+func (k *HostKey) PublicKey() xssh.PublicKey {
+	return k.current().PublicKey()
+}
+
+// Sign implements xssh.Signer.
+func (k *HostKey) Sign(rand io.Reader, data []byte) (*xssh.Signature, error) {
+	return k.current().Sign(rand, data)
+}
+
+// SignWithAlgorithm implements xssh.AlgorithmSigner, so RSA host keys can
+// sign with SHA-2.
+func (k *HostKey) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*xssh.Signature, error) {
+	return k.current().SignWithAlgorithm(rand, data, algorithm)
+}
@@ -0,0 +1,193 @@
+package ssh
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	gossh "github.com/gliderlabs/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// isInfoCommand reports whether raw is one of the informational commands
+// that help users debug their access:
+//
+//	ssh -p 2222 git@host whoami         # identity and key of the connection
+//	ssh -p 2222 git@host info [pattern] # repositories the key may use
+//
+// Patterns are path.Match patterns such as "team/*".
+func isInfoCommand(raw string) bool {
+	fields := strings.Fields(raw)
+	return len(fields) > 0 && (fields[0] == "whoami" || fields[0] == "info")
+}
+
+// serveInfoCommand answers whoami and info.
+func (s *Server) serveInfoCommand(sess gossh.Session, fingerprint, raw string) {
+	fields := strings.Fields(raw)
+	var err error
+	switch fields[0] {
+	case "whoami":
+		err = s.whoami(sess, fingerprint)
+	case "info":
+		for _, pattern := range fields[1:] {
+			if _, err := path.Match(pattern, ""); err != nil {
+				fmt.Fprintf(sess.Stderr(), "invalid pattern %q\n", pattern)
+				_ = sess.Exit(1)
+				return
+			}
+		}
+		err = s.info(sess, fingerprint, fields[1:])
+	}
+	if err != nil {
+		fmt.Fprintf(sess.Stderr(), "%s: %v\n", fields[0], err)
+		_ = sess.Exit(1)
+		return
+	}
+	_ = sess.Exit(0)
+}
+
+// identityName returns what to call the holder of the key: its comment in
+// authorized_keys, the user who registered it, the titles of a deploy key,
+// or the fingerprint.
+func (s *Server) identityName(fingerprint string, deployKey bool) string {
+	if name := s.keyNames[fingerprint]; name != "" && !deployKey {
+		return name
+	}
+	if user, ok := s.UserKeys.Lookup(fingerprint); ok && !deployKey {
+		return "user " + user
+	}
+	if deployKey {
+		var titles []string
+		seen := make(map[string]bool)
+		for _, g := range s.Provisioned.DeployKeyGrants(fingerprint) {
+			if g.Title != "" && !seen[g.Title] {
+				seen[g.Title] = true
+				titles = append(titles, g.Title)
+			}
+		}
+		if len(titles) > 0 {
+			return "deploy key " + strings.Join(titles, ", ")
+		}
+	}
+	return fingerprint
+}
+
+func (s *Server) whoami(sess gossh.Session, fingerprint string) error {
+	deployKey, _ := sess.Context().Value(deployKeyOnlyKey{}).(bool)
+	tw := tabwriter.NewWriter(sess, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "identity:\t%s\n", s.identityName(fingerprint, deployKey))
+	fmt.Fprintf(tw, "fingerprint:\t%s\n", fingerprint)
+	if key := sess.PublicKey(); key != nil {
+		if keyFingerprint(key) == fingerprint {
+			fmt.Fprintf(tw, "key type:\t%s\n", key.Type())
+		} else {
+			fmt.Fprintf(tw, "forwarded by:\t%s\n", keyFingerprint(key))
+		}
+	}
+	kind := "authorized key"
+	if deployKey {
+		kind = "deploy key"
+	} else if _, ok := s.UserKeys.Lookup(fingerprint); ok {
+		kind = "user key"
+	}
+	fmt.Fprintf(tw, "access:\t%s\n", kind)
+	if s.AdminShell != nil && s.AdminShell.Identities[fingerprint] {
+		fmt.Fprintf(tw, "scopes:\tadmin-shell\n")
+	}
+	fmt.Fprintf(tw, "address:\t%s\n", remoteHost(sess.RemoteAddr()))
+	return tw.Flush()
+}
+
+// info lists the repositories the key may fetch (R) and push to (W),
+// like gitolite's info command. Deploy keys see the repositories they are
+// valid for and their wikis; other keys see every repository, read-only
+// where it is archived.
+func (s *Server) info(sess gossh.Session, fingerprint string, patterns []string) error {
+	deployKey, _ := sess.Context().Value(deployKeyOnlyKey{}).(bool)
+	access := make(map[string]string)
+	if deployKey {
+		for _, g := range s.Provisioned.DeployKeyGrants(fingerprint) {
+			perm := "R W"
+			if g.ReadOnly {
+				perm = "R"
+			}
+			access[g.Repo] = perm
+			if wiki := service.WikiPath(g.Repo); s.exists(wiki) {
+				access[wiki] = perm
+			}
+		}
+	} else {
+		roots := []service.RepoMount{{Root: s.RepoRoot}}
+		roots = append(roots, s.RepoMounts...)
+		for _, m := range roots {
+			if err := listRepos(m.Root, strings.Trim(m.Prefix, "/"), access); err != nil {
+				return err
+			}
+		}
+	}
+
+	repos := make([]string, 0, len(access))
+	for repo := range access {
+		if matchAny(patterns, repo) {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	fmt.Fprintf(sess, "hello %s, this is repocraft\n\n", s.identityName(fingerprint, deployKey))
+	for _, repo := range repos {
+		perm := access[repo]
+		if full, _, err := s.resolveRepoPath(repo); err == nil && service.Archived(full) {
+			perm = "R"
+		}
+		fmt.Fprintf(sess, " %-3s\t%s\n", perm, repo)
+	}
+	return nil
+}
+
+func (s *Server) exists(repo string) bool {
+	full, _, err := s.resolveRepoPath(repo)
+	return err == nil && service.IsRepository(full)
+}
+
+// listRepos adds the repositories under root, named with prefix, to access
+// with full access.
+func listRepos(root, prefix string, access map[string]string) error {
+	root = filepath.Clean(root)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !service.IsRepository(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		access[path.Join(prefix, filepath.ToSlash(rel))] = "R W"
+		return filepath.SkipDir
+	})
+}
+
+func matchAny(patterns []string, repo string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	gossh "github.com/gliderlabs/ssh"
+	xssh "golang.org/x/crypto/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/shard"
+)
+
+// forwardedIdentityEnv carries the client's key fingerprint from a router to
+// the backend, which honours it for keys listed in Server.TrustedProxies.
+const forwardedIdentityEnv = "REPOCRAFT_FORWARDED_IDENTITY"
+
+// Proxy makes the server a router in front of a sharded fleet: sessions for
+// repositories owned by another node are relayed to it over a new SSH
+// connection. The router authenticates with its own key; the client's agent
+// is never forwarded.
+type Proxy struct {
+	// Route returns the address (host:port) of the node owning repo, or ""
+	// to serve it locally.
+	Route func(repo string) string
+	// Config authenticates the router to the backends and verifies their
+	// host keys.
+	Config *xssh.ClientConfig
+	// DialTimeout defaults to ten seconds.
+	DialTimeout time.Duration
+}
+
+// HashRoute assigns every repository to one of nodes with shard.Owner.
+// Repositories assigned to self are served locally.
+func HashRoute(nodes []string, self string) func(repo string) string {
+	return func(repo string) string {
+		i := shard.Owner(nodes, repo)
+		if i < 0 || nodes[i] == self {
+			return ""
+		}
+		return nodes[i]
+	}
+}
+
+func (p *Proxy) route(repo string) string {
+	if p == nil || p.Route == nil {
+		return ""
+	}
+	return p.Route(repo)
+}
+
+// relay runs rawCmd on the node at addr with the client session attached
+// and returns the remote exit status.
+func (p *Proxy) relay(ctx context.Context, addr string, sess gossh.Session, rawCmd, identity string) (int, error) {
+	timeout := p.DialTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return -1, fmt.Errorf("dial backend: %w", err)
+	}
+	c, chans, reqs, err := xssh.NewClientConn(conn, addr, p.Config)
+	if err != nil {
+		conn.Close()
+		return -1, fmt.Errorf("backend handshake: %w", err)
+	}
+	client := xssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	// Drop the backend as soon as the client goes away.
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	remote, err := client.NewSession()
+	if err != nil {
+		return -1, fmt.Errorf("backend session: %w", err)
+	}
+	defer remote.Close()
+	if v := envValue(sess.Environ(), "GIT_PROTOCOL"); v != "" {
+		if err := remote.Setenv("GIT_PROTOCOL", v); err != nil {
+			return -1, fmt.Errorf("backend session: %w", err)
+		}
+	}
+	if err := remote.Setenv(forwardedIdentityEnv, identity); err != nil {
+		return -1, fmt.Errorf("backend session: %w", err)
+	}
+
+	// Session.Wait would also wait for stdin to be drained, which never
+	// happens if the client keeps it open; copy it separately instead.
+	stdin, err := remote.StdinPipe()
+	if err != nil {
+		return -1, fmt.Errorf("backend session: %w", err)
+	}
+	go func() {
+		_, _ = io.Copy(stdin, sess)
+		stdin.Close()
+	}()
+	remote.Stdout = sess
+	remote.Stderr = sess.Stderr()
+
+	err = remote.Run(rawCmd)
+	var exitErr *xssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return -1, fmt.Errorf("backend session: %w", err)
+	}
+	return 0, nil
+}
@@ -5,6 +5,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,20 +17,166 @@ import (
 	gossh "github.com/gliderlabs/ssh"
 	xssh "golang.org/x/crypto/ssh"
 
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/abuse"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/access"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/admission"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/credusage"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/cryptopolicy"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/faults"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/featureflag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/freeze"
 	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/listener"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/loadshed"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/locale"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/metrics"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repoadmin"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/tracing"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/userkeys"
 )
 
+var debugSSH = diag.Register("ssh", "SSH session commands and environments")
+
 // Server exposes a minimal SSH endpoint that only accepts git-upload-pack and git-receive-pack.
 // Public key authentication is enforced via an authorized_keys file.
 type Server struct {
-	Addr               string
-	RepoRoot           string
-	HostKeyPath        string
+	Addr string
+	// Listeners, if set, are bound instead of Addr, e.g. separate IPv4 and
+	// IPv6 addresses. TLS and proxied listeners are not supported.
+	Listeners []listener.Config
+	RepoRoot  string
+	// RepoMounts serve URL namespaces from other roots, e.g. mirrors from
+	// slower storage.
+	RepoMounts  []service.RepoMount
+	HostKeyPath string
+	// HostKey, if set, is used instead of the key at HostKeyPath and can be
+	// rotated while the server runs.
+	HostKey            *HostKey
 	AuthorizedKeysPath string
-	UploadPackPath     string
-	ReceivePackPath    string
-	BaseEnv            []string
-	GracefulTimeout    time.Duration
+	// CryptoPolicy restricts key exchange, ciphers, MACs and host and client
+	// key types, e.g. to the FIPS set.
+	CryptoPolicy    cryptopolicy.Policy
+	UploadPackPath  string
+	ReceivePackPath string
+	BaseEnv         []string
+	GracefulTimeout time.Duration
+	// RefAdvertisement tunes the refs upload-pack advertises, per repository.
+	RefAdvertisement service.RefAdvertisementPolicy
+	// Stats optionally records per-repository fetch/push activity.
+	Stats *repostats.Store
+	// Abuse optionally flags anomalous clone patterns and rejects blocked clients.
+	Abuse *abuse.Detector
+	// Banner is sent to clients during the SSH handshake, before authentication.
+	Banner string
+	// Messages are shown to clients over side-band before and after transfers.
+	Messages service.MessagePolicy
+	// PushAnnotations adds links to the output of successful pushes.
+	PushAnnotations service.PushAnnotations
+	// Capabilities rewrites the capabilities advertised to clients.
+	Capabilities service.CapabilityPolicies
+	// RefTransactions, if set, votes on every ref update of a push.
+	RefTransactions service.ReferenceTransactions
+	// PushChecks, if set, inspect pushes before any ref changes, e.g.
+	// commitpolicy.Policy.
+	PushChecks service.PushCheck
+	// NegotiationLimits reject fetches asking for too many wants, haves or
+	// too deep a history before git works on them.
+	NegotiationLimits service.NegotiationLimits
+	// Depth caps the history that can be fetched from huge repositories.
+	Depth service.DepthPolicy
+	// Encryption, if set, serves repositories encrypted at rest.
+	Encryption *atrest.Store
+	// PathScopes, if set, restricts keys to directories of repositories.
+	PathScopes *service.PathScopes
+	// DryRunPushes checks pushes made with `git push -o dry-run` without
+	// applying them.
+	DryRunPushes bool
+	// SparseHints tells full clones of repositories with sparse profiles
+	// how to clone only part of them.
+	SparseHints bool
+	// Review, if set, requires a second person's approval, in a signed
+	// push, for direct pushes to protected branches.
+	Review *service.ReviewPolicy
+	// Freeze, if set, refuses pushes to branches during freeze windows.
+	Freeze *freeze.Schedule
+	// Flags, if set, gate protocol v2 and dry-run pushes per repository and
+	// key; see featureflag.Set.
+	Flags *featureflag.Set
+	// Locks, if set, tracks active pushes for maintenance scheduling.
+	Locks *repolock.Manager
+	// Admission, if set, bounds concurrent git processes with fair queuing.
+	Admission *admission.Scheduler
+	// Reaper, if set, stops git process groups gracefully and lets the
+	// daemon clean up the remaining ones at shutdown.
+	Reaper *service.Reaper
+	// UploadTimeout, ReceiveTimeout and MaxDuration bound how long git
+	// may run; see service.ServiceExecutor.
+	UploadTimeout  time.Duration
+	ReceiveTimeout time.Duration
+	MaxDuration    time.Duration
+	// Sessions, if set, lists active operations with live transfer progress.
+	Sessions *service.Sessions
+	// Shedder, if set, turns away fetches while the host is overloaded.
+	// Keys are authenticated, so only fetches by Shedder.Mirrors are shed
+	// before severe overload; pushes are always admitted.
+	Shedder *loadshed.Shedder
+	// OnFinish, if set, receives a summary of every git invocation,
+	// e.g. accounting.Recorder.Observe.
+	OnFinish func(service.Result)
+	// Redirects serves moved repositories from their new path.
+	Redirects *repoadmin.RedirectStore
+	// Rewrites map requested repository paths to other paths before they
+	// are resolved, e.g. to serve legacy URLs.
+	Rewrites service.RewriteRules
+	// Provisioned, if set, also admits the deploy keys of its repositories,
+	// each to its own repository only.
+	Provisioned *provision.Index
+	// Proxy, if set, relays sessions for repositories owned by other nodes.
+	Proxy *Proxy
+	// MaxSessionsPerConn limits the channels open at once on a single
+	// connection; zero means no limit.
+	MaxSessionsPerConn int
+	// TrustedProxies lists the key fingerprints of routers whose forwarded
+	// client identity is used in place of their own.
+	TrustedProxies map[string]bool
+	// AdminShell, if set, lets trusted identities run read-only git
+	// commands such as for-each-ref.
+	AdminShell *AdminShell
+	// Locales, if set, translate errors and messages for clients; see
+	// locale.Localizer. Clients ask for a language by passing LANG.
+	Locales *locale.Localizer
+	// UserKeys, if set, also admits the keys users registered through the
+	// API until they expire, with the same access as keys in
+	// authorized_keys. Their use is recorded for stale key reports.
+	UserKeys *userkeys.Store
+	// Credentials, if set, records the use of keys.
+	Credentials *credusage.Store
+	// Metrics, if set, counts sessions, transfers and refused keys.
+	Metrics *metrics.Git
+	// Logger receives finished git invocations and what goes wrong
+	// serving sessions; slog.Default() if nil.
+	Logger *slog.Logger
+	// Tracer, if set, records a span per session with a child span per
+	// git invocation.
+	Tracer *tracing.Tracer
+	// Authorizer, if set, decides who may fetch from and push to each
+	// repository, by the owner of the key; see keyOwner. Keys no one owns
+	// are anonymous.
+	Authorizer access.Authorizer
+	// Personal, if set, lets key owners create repositories in their own
+	// namespace by pushing to them; see keyOwner.
+	Personal *repoadmin.PersonalNamespaces
+
+	connMetrics connMetrics
+	// keyNames are the comments of authorized keys by fingerprint, set
+	// before the server accepts connections.
+	keyNames map[string]string
 }
 
 // ListenAndServe starts the SSH server and blocks until the context is cancelled or the server stops.
@@ -35,7 +184,7 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 	if s.RepoRoot == "" {
 		return errors.New("missing repository root")
 	}
-	if s.HostKeyPath == "" {
+	if s.HostKeyPath == "" && s.HostKey == nil {
 		return errors.New("missing SSH host key path")
 	}
 	if s.AuthorizedKeysPath == "" {
@@ -50,28 +199,59 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 		return fmt.Errorf("ensure repo root: %w", err)
 	}
 
-	authorized, err := loadAuthorizedKeys(s.AuthorizedKeysPath)
+	authorized, names, err := loadAuthorizedKeys(s.AuthorizedKeysPath)
 	if err != nil {
 		return fmt.Errorf("load authorized keys: %w", err)
 	}
+	s.keyNames = names
 
 	server := &gossh.Server{
 		Addr:             s.Addr,
 		Handler:          s.handleSession,
-		PublicKeyHandler: authorizeKey(authorized),
+		PublicKeyHandler: s.authorizeKey(authorized),
+		ConnCallback:     s.trackConn,
+		ChannelHandlers: map[string]gossh.ChannelHandler{
+			"session": s.sessionChannel,
+		},
+	}
+	hostKey, err := s.hostSigner()
+	if err != nil {
+		return err
+	}
+	server.AddHostKey(hostKey)
+	banner := strings.TrimRight(s.Banner, "\n") + "\n"
+	server.ServerConfigCallback = func(ctx gossh.Context) *xssh.ServerConfig {
+		config := &xssh.ServerConfig{}
+		if s.Banner != "" {
+			config.BannerCallback = func(xssh.ConnMetadata) string { return banner }
+		}
+		s.CryptoPolicy.SSHServerConfig(config)
+		return config
 	}
-	server.SetOption(gossh.HostKeyFile(s.HostKeyPath))
 
 	active := &sessionCounter{}
 	server.Handler = wrapSessionCount(server.Handler, active)
 
-	errCh := make(chan error, 1)
+	listeners, err := s.listen()
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, max(len(listeners), 1))
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errCh <- server.ListenAndServe()
-	}()
+	if len(listeners) == 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- server.ListenAndServe()
+		}()
+	}
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			errCh <- server.Serve(l)
+		}(l)
+	}
 
 	select {
 	case <-ctx.Done():
@@ -83,118 +263,446 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 		wg.Wait()
 		return nil
 	case err := <-errCh:
+		_ = server.Close() // stop the remaining listeners
 		wg.Wait()
 		return err
 	}
 }
 
+// listen binds Listeners; it returns none when Addr is used.
+func (s *Server) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, c := range s.Listeners {
+		var l net.Listener
+		var err error
+		if c.TLS || c.Proxied {
+			err = fmt.Errorf("listener %s: SSH listeners take no options", c)
+		} else {
+			l, err = c.Listen(nil)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sessionCommand returns the program a session runs, e.g.
+// "git-upload-pack", to name its span.
+func sessionCommand(raw string) string {
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		return "shell"
+	}
+	if len(fields[0]) > 64 {
+		return fields[0][:64]
+	}
+	return fields[0]
+}
+
+// maxClientEnv is the most environment variables a session may set.
+const maxClientEnv = 16
+
 func (s *Server) handleSession(sess gossh.Session) {
+	fingerprint := keyFingerprint(sess.PublicKey())
+	if s.TrustedProxies[fingerprint] {
+		if forwarded := envValue(sess.Environ(), forwardedIdentityEnv); forwarded != "" {
+			fingerprint = forwarded
+		}
+	}
+	// SSH clients commonly pass the user's LANG.
+	requested := envValue(sess.Environ(), "LANG")
+	printer := s.Locales.For("", fingerprint, requested)
+	ctx, span := s.Tracer.Start(sess.Context(), "SSH "+sessionCommand(sess.RawCommand()), tracing.Server,
+		"client.address", sess.RemoteAddr().String(), "key", fingerprint)
+	defer span.End(nil)
+	fail := func(err error) {
+		span.End(err)
+		failSession(sess, printer.Error(err))
+	}
+
+	if until, blocked := s.Abuse.Blocked(fingerprint, time.Now()); blocked {
+		fail(errcode.Errorf(errcode.RateLimited, "too many requests, retry after %s", until.Format(time.RFC3339)))
+		return
+	}
+
+	// git clients set at most GIT_PROTOCOL.
+	if len(sess.Environ()) > maxClientEnv {
+		fail(errcode.New(errcode.InvalidRequest, "too many environment variables"))
+		return
+	}
+	if err := service.ValidProtocolParams(envValue(sess.Environ(), "GIT_PROTOCOL")); err != nil {
+		fail(errcode.Errorf(errcode.InvalidRequest, "invalid GIT_PROTOCOL: %w", err))
+		return
+	}
+
 	rawCmd := sess.RawCommand()
+	debugSSH.Printf("%s from %s: %q %q", fingerprint, sess.RemoteAddr(), rawCmd, sess.Environ())
+	if isAdminCommand(rawCmd) {
+		s.serveAdminCommand(ctx, sess, fingerprint, rawCmd)
+		return
+	}
+	if isInfoCommand(rawCmd) {
+		s.serveInfoCommand(sess, fingerprint, rawCmd)
+		return
+	}
 	req, err := service.ParseSSHCommand(rawCmd)
 	if err != nil {
-		fmt.Fprintf(sess.Stderr(), "invalid command: %v\n", err)
-		_ = sess.Exit(1)
+		fail(errcode.Errorf(errcode.InvalidRequest, "invalid command: %w", err))
 		return
 	}
 
-	repoFull, err := s.resolveRepoPath(req.RepoPath)
+	if to, ok := s.Rewrites.Rewrite(strings.Trim(strings.TrimSpace(req.RepoPath), "\"'")); ok {
+		req.RepoPath = to
+	}
+	repoFull, name, err := s.resolveRepoPath(req.RepoPath)
+	span.SetAttributes("repo", name)
 	if err != nil {
-		fmt.Fprintf(sess.Stderr(), "invalid repo path: %v\n", err)
-		_ = sess.Exit(1)
+		fail(errcode.Errorf(errcode.InvalidRequest, "invalid repo path: %w", err))
+		return
+	}
+	printer = s.Locales.For(name, fingerprint, requested)
+	deployKeyOnly, _ := sess.Context().Value(deployKeyOnlyKey{}).(bool)
+	if addr := s.Proxy.route(name); addr != "" {
+		if deployKeyOnly {
+			fail(errcode.New(errcode.AccessDenied, "deploy keys can only access repositories on this node"))
+			return
+		}
+		code, err := s.Proxy.relay(ctx, addr, sess, rawCmd, fingerprint)
+		if err != nil {
+			s.logger().Error("ssh proxy failed", "repo", name, "backend", addr, "remote_addr", sess.RemoteAddr().String(), "error", err)
+			fail(errcode.New(errcode.Unavailable, "repository backend unavailable"))
+			return
+		}
+		_ = sess.Exit(code)
 		return
 	}
 	if _, err := os.Stat(repoFull); err != nil {
-		fmt.Fprintf(sess.Stderr(), "repository not found: %v\n", err)
-		_ = sess.Exit(1)
+		if target, moved := s.Redirects.Lookup(name); moved {
+			if repoFull, name, err = s.resolveRepoPath(target); err != nil {
+				fail(errcode.Errorf(errcode.InvalidRequest, "invalid repo path: %w", err))
+				return
+			}
+			fmt.Fprintln(sess.Stderr(), printer.Text("warning: repository moved to {{.Message}}, please update your remote", target))
+		}
+	}
+	// Deploy keys are authorized by the repository they were provisioned
+	// into, below.
+	owner := s.keyOwner(fingerprint, deployKeyOnly)
+	if s.Authorizer != nil && !deployKeyOnly {
+		read := req.Service.IsRead()
+		if read && !s.Authorizer.CanRead(owner, name) || !read && !s.Authorizer.CanWrite(owner, name) {
+			s.Metrics.AuthFailure("denied")
+			fail(access.Denied(identityOrKey(owner, fingerprint), name, read))
+			return
+		}
+	}
+	if req.Service == service.ServiceReceivePack && owner != "" {
+		created, err := s.Personal.PreparePush(owner, name)
+		if err != nil {
+			if errcode.CodeOf(err) == errcode.Internal {
+				s.logger().Error("prepare push", "repo", name, "user", owner, "error", err)
+			}
+			fail(err)
+			return
+		}
+		if created {
+			s.logger().Info("created repository on push", "repo", name, "user", owner)
+		}
+	}
+	if _, err := os.Stat(repoFull); err != nil {
+		fail(errcode.Errorf(errcode.RepoNotFound, "repository not found: %s", name))
+		return
+	}
+	if deployKeyOnly {
+		readOnly, ok := s.Provisioned.DeployKey(fingerprint, name)
+		if !ok {
+			s.Metrics.AuthFailure("denied")
+			fail(errcode.Errorf(errcode.AccessDenied, "deploy key is not valid for %s", name))
+			return
+		}
+		if readOnly && !req.Service.IsRead() {
+			s.Metrics.AuthFailure("denied")
+			fail(errcode.Errorf(errcode.AccessDenied, "deploy key for %s is read-only", name))
+			return
+		}
+	}
+
+	priority := s.Shedder.Classify(req.Service == service.ServiceReceivePack, true, fingerprint)
+	if retryAfter, ok := s.Shedder.Allow(priority); !ok {
+		fail(&errcode.Error{Code: errcode.Overloaded, Message: fmt.Sprintf("server is overloaded, retry after %s", retryAfter), RetryAfter: retryAfter})
 		return
 	}
 
 	exec := service.ServiceExecutor{
-		UploadPackPath:  s.UploadPackPath,
-		ReceivePackPath: s.ReceivePackPath,
-		BaseEnv:         s.BaseEnv,
+		UploadPackPath:    s.UploadPackPath,
+		ReceivePackPath:   s.ReceivePackPath,
+		BaseEnv:           s.BaseEnv,
+		RefAdvertisement:  s.RefAdvertisement,
+		Messages:          s.Messages,
+		PushAnnotations:   s.PushAnnotations,
+		Capabilities:      s.Capabilities,
+		RefTransactions:   s.RefTransactions,
+		PushChecks:        s.PushChecks,
+		Locks:             s.Locks,
+		PathScopes:        s.PathScopes,
+		DryRunPushes:      s.DryRunPushes && s.Flags.Enabled(featureflag.DryRunPushes, name, fingerprint),
+		SparseHints:       s.SparseHints && s.Flags.Enabled(featureflag.SparseHints, name, fingerprint),
+		Review:            s.Review,
+		Freeze:            s.Freeze,
+		NegotiationLimits: s.NegotiationLimits,
+		Depth:             s.Depth,
+		Encryption:        s.Encryption,
+		Admission:         s.Admission,
+		Reaper:            s.Reaper,
+		UploadTimeout:     s.UploadTimeout,
+		ReceiveTimeout:    s.ReceiveTimeout,
+		MaxDuration:       s.MaxDuration,
+		Sessions:          s.Sessions,
+		OnFinish:          s.finish,
+		Logger:            s.Logger,
+		Tracer:            s.Tracer,
+		Locales:           s.Locales,
 	}
 	execReq := service.ServiceRequest{
 		Service:         req.Service,
 		RepoPath:        repoFull,
-		ProtocolVersion: gitProtocolEnv(sess.Environ()),
+		RepoName:        name,
+		Identity:        fingerprint,
+		User:            owner,
+		RemoteAddr:      sess.RemoteAddr().String(),
+		ProtocolVersion: envValue(sess.Environ(), "GIT_PROTOCOL"),
+		Locale:          printer.Locale,
+	}
+	if !s.Flags.Enabled(featureflag.ProtocolV2, name, fingerprint) {
+		execReq.ProtocolVersion = service.WithoutProtocolV2(execReq.ProtocolVersion)
+	}
+
+	var stdin io.Reader = sess
+	var negotiation *service.NegotiationCounter
+	if req.Service == service.ServiceUploadPack {
+		negotiation = service.NewNegotiationCounter(stdin)
+		stdin = negotiation
 	}
 
-	if err := exec.Serve(sess.Context(), execReq, sess, sess, sess.Stderr()); err != nil {
-		fmt.Fprintf(sess.Stderr(), "git service failed: %v\n", err)
+	done := s.Metrics.Begin(req.Service)
+	defer done()
+	if err := exec.Serve(ctx, execReq, stdin, sess, sess.Stderr()); err != nil {
+		span.End(err)
+		if errors.Is(err, faults.ErrDropped) {
+			// Close the channel without an exit status, as a lost
+			// connection would.
+			_ = sess.Close()
+			return
+		}
+		// git's output may have begun, so an ERR packet could be taken for
+		// part of it; limit errors were already sent as one.
+		fmt.Fprintf(sess.Stderr(), "git service failed: %s\n", errcode.Text(printer.Error(err)))
 		_ = sess.Exit(1)
 		return
 	}
 
+	op := repostats.OperationFetch
+	if req.Service == service.ServiceReceivePack {
+		op = repostats.OperationPush
+	}
+	s.Stats.Record(execReq.RepoName, op, fingerprint, time.Now())
+	s.recordKeyUse(sess, fingerprint, deployKeyOnly, execReq)
+	if negotiation != nil && negotiation.Wants > 0 {
+		s.Abuse.ObserveFetch(fingerprint, execReq.RepoName, negotiation.FullClone(), time.Now())
+	}
+
 	_ = sess.Exit(0)
 }
 
-func (s *Server) resolveRepoPath(raw string) (string, error) {
+// recordKeyUse records a use of the key with fingerprint for req.
+func (s *Server) recordKeyUse(sess gossh.Session, fingerprint string, deployKey bool, req service.ServiceRequest) {
+	if s.Credentials == nil {
+		return
+	}
+	op := "fetch"
+	switch req.Service {
+	case service.ServiceReceivePack:
+		op = "push"
+	case service.ServiceUploadArchive:
+		op = "archive"
+	}
+	use := credusage.Use{Kind: credusage.KindSSHKey, ID: fingerprint, Op: op, Repo: req.RepoName, Source: remoteHost(sess.RemoteAddr())}
+	if user, ok := s.UserKeys.Lookup(fingerprint); ok && !deployKey {
+		use.Owner = user
+	} else if name := s.identityName(fingerprint, deployKey); name != fingerprint {
+		use.Owner = name
+	}
+	s.Credentials.Record(use, time.Now())
+}
+
+// logger returns Logger or the default logger.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+// finish logs a finished git invocation and reports it to Metrics and
+// OnFinish.
+func (s *Server) finish(res service.Result) {
+	res.Log(s.logger())
+	s.Metrics.Observe(res)
+	if s.OnFinish != nil {
+		s.OnFinish(res)
+	}
+}
+
+// keyOwner returns the user a key belongs to: the user who registered it or
+// its comment in authorized_keys. Deploy keys belong to no one.
+func (s *Server) keyOwner(fingerprint string, deployKey bool) string {
+	if deployKey {
+		return ""
+	}
+	if user, ok := s.UserKeys.Lookup(fingerprint); ok {
+		return user
+	}
+	return s.keyNames[fingerprint]
+}
+
+// identityOrKey returns owner, or the key's fingerprint for keys no one
+// owns.
+func identityOrKey(owner, fingerprint string) string {
+	if owner == "" {
+		return "key " + fingerprint
+	}
+	return owner
+}
+
+// failSession sends err to the client as an ERR packet, which git reports
+// as a remote error with its code, and ends the session. It must only be
+// used before git started.
+func failSession(sess gossh.Session, err error) {
+	_ = service.WriteErr(sess, err)
+	_ = sess.Exit(1)
+}
+
+// resolveRepoPath returns the directory and the cleaned name of the
+// repository at raw, a path from the client's command.
+func (s *Server) resolveRepoPath(raw string) (string, string, error) {
 	cleaned := strings.TrimSpace(raw)
 	cleaned = strings.Trim(cleaned, "\"'")
-	cleaned = filepath.ToSlash(filepath.Clean(cleaned))
-	cleaned = strings.TrimPrefix(cleaned, "/")
-	if cleaned == "" || cleaned == "." {
-		return "", errors.New("empty path")
-	}
-	full := filepath.Join(s.RepoRoot, filepath.FromSlash(cleaned))
-	if err := ensureWithinRoot(s.RepoRoot, full); err != nil {
-		return "", err
+	resolver := service.RepoResolver{Root: s.RepoRoot, Mounts: s.RepoMounts}
+	return resolver.Resolve(cleaned)
+}
+
+func keyFingerprint(key gossh.PublicKey) string {
+	if key == nil {
+		return ""
 	}
-	return full, nil
+	return xssh.FingerprintSHA256(key)
 }
 
-func gitProtocolEnv(env []string) string {
+// envValue returns the value of key in env, the client's environment.
+func envValue(env []string, key string) string {
 	for _, e := range env {
-		if strings.HasPrefix(e, "GIT_PROTOCOL=") {
-			return strings.TrimPrefix(e, "GIT_PROTOCOL=")
+		if v, ok := strings.CutPrefix(e, key+"="); ok {
+			return v
 		}
 	}
 	return ""
 }
 
-func authorizeKey(authorized [][]byte) gossh.PublicKeyHandler {
+// hostSigner returns the host key, limited to the algorithms permitted by
+// the crypto policy.
+func (s *Server) hostSigner() (xssh.Signer, error) {
+	var signer xssh.Signer = s.HostKey
+	if s.HostKey == nil {
+		pem, err := os.ReadFile(s.HostKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("read host key: %w", err)
+		}
+		if signer, err = xssh.ParsePrivateKey(pem); err != nil {
+			return nil, fmt.Errorf("parse host key: %w", err)
+		}
+	}
+	return s.CryptoPolicy.SSHHostKey(signer)
+}
+
+// deployKeyOnlyKey marks connections authenticated with a deploy key that
+// is not in authorized_keys.
+type deployKeyOnlyKey struct{}
+
+func (s *Server) authorizeKey(authorized [][]byte) gossh.PublicKeyHandler {
 	return func(ctx gossh.Context, key gossh.PublicKey) bool {
+		if !s.CryptoPolicy.SSHClientKey(key) {
+			return false
+		}
+		source := remoteHost(ctx.RemoteAddr())
+		if _, blocked := s.Abuse.Blocked(source, time.Now()); blocked {
+			return false
+		}
 		marshaled := key.Marshal()
 		for _, allowed := range authorized {
 			if bytes.Equal(marshaled, allowed) {
+				ctx.SetValue(deployKeyOnlyKey{}, false)
 				return true
 			}
 		}
+		switch user, err := s.UserKeys.Authorize(keyFingerprint(key), time.Now()); {
+		case err == nil:
+			ctx.SetValue(deployKeyOnlyKey{}, false)
+			return true
+		case errors.Is(err, userkeys.ErrKeyExpired):
+			s.logger().Warn("ssh: rejected expired key", "key", keyFingerprint(key), "user", user, "remote_addr", source)
+		}
+		if s.Provisioned.IsDeployKey(keyFingerprint(key)) {
+			ctx.SetValue(deployKeyOnlyKey{}, true)
+			return true
+		}
+		// Clients offer several keys per connection, so thresholds should
+		// account for multiple failures per login attempt.
+		s.Abuse.ObserveAuthFailure(source, time.Now())
+		s.Metrics.AuthFailure("unknown_key")
 		return false
 	}
 }
 
-func loadAuthorizedKeys(path string) ([][]byte, error) {
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// loadAuthorizedKeys returns the keys in an authorized_keys file and their
+// comments, e.g. "alice@laptop", by fingerprint.
+func loadAuthorizedKeys(path string) ([][]byte, map[string]string, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	var keys [][]byte
+	names := make(map[string]string)
 	for len(data) > 0 {
-		pubKey, _, _, rest, err := xssh.ParseAuthorizedKey(data)
+		pubKey, comment, _, rest, err := xssh.ParseAuthorizedKey(data)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		keys = append(keys, pubKey.Marshal())
+		if comment != "" {
+			names[xssh.FingerprintSHA256(pubKey)] = comment
+		}
 		data = rest
 	}
 	if len(keys) == 0 {
-		return nil, errors.New("no authorized keys configured")
-	}
-	return keys, nil
-}
-
-func ensureWithinRoot(root, full string) error {
-	rootClean := filepath.Clean(root)
-	fullClean := filepath.Clean(full)
-	if rootClean == fullClean {
-		return nil
-	}
-	if !strings.HasPrefix(fullClean, rootClean+string(os.PathSeparator)) {
-		return errors.New("path traversal detected")
+		return nil, nil, errors.New("no authorized keys configured")
 	}
-	return nil
+	return keys, names, nil
 }
 
 func (s *Server) shutdownTimeout() time.Duration {
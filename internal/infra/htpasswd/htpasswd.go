@@ -0,0 +1,130 @@
+// Package htpasswd authenticates Smart HTTP clients against an htpasswd
+// file of bcrypt entries, "user:$2y$...", as `htpasswd -B` writes them.
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+var (
+	// ErrCredentialsRequired is returned for anonymous requests that need
+	// credentials.
+	ErrCredentialsRequired = errcode.New(errcode.Unauthenticated, "authentication required")
+	// ErrBadCredentials is returned for wrong passwords and, where
+	// credentials are required, unknown users.
+	ErrBadCredentials = errcode.New(errcode.Unauthenticated, "invalid username or password")
+)
+
+// File checks Basic auth credentials against the htpasswd file at Path,
+// which is read again when it changes. It is safe for concurrent use.
+type File struct {
+	Path string
+	// RequireForReads asks fetches for credentials as well; by default
+	// only pushes need them, and fetches of unknown users go on
+	// anonymously, e.g. with a fetch token as the password.
+	RequireForReads bool
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string][]byte
+	// verified remembers the last password checked for each user, as
+	// bcrypt is slow and git makes several requests per operation.
+	verified map[string][sha256.Size]byte
+}
+
+// Load reads the file unless it is unchanged since it was last read.
+func (f *File) Load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.load()
+}
+
+// Authenticate is an httpsmart.Authenticator: it returns the name of the
+// user whose credentials r carries.
+func (f *File) Authenticate(r *http.Request, repo string, svc service.Service) (string, error) {
+	required := f.RequireForReads || !svc.IsRead()
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		if required {
+			return "", ErrCredentialsRequired
+		}
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(password))
+	f.mu.Lock()
+	if err := f.load(); err != nil {
+		f.mu.Unlock()
+		return "", err
+	}
+	hash, known := f.users[user]
+	verified := known && f.verified[user] == sum
+	f.mu.Unlock()
+	switch {
+	case !known && required:
+		return "", ErrBadCredentials
+	case !known:
+		return "", nil
+	case verified:
+		return user, nil
+	}
+	// bcrypt takes long enough that holding the lock would make every
+	// request wait for clients with wrong passwords.
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", ErrBadCredentials
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Only remember the password if the entry didn't change meanwhile.
+	if bytes.Equal(f.users[user], hash) {
+		f.verified[user] = sum
+	}
+	return user, nil
+}
+
+// load reads the file if it changed; f.mu must be held.
+func (f *File) load() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	if f.users != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	users := make(map[string][]byte)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s:%d: want user:hash", f.Path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("%s:%d: only bcrypt entries (htpasswd -B) are supported", f.Path, n)
+		}
+		users[user] = []byte(hash)
+	}
+	f.users, f.modTime, f.size = users, info.ModTime(), info.Size()
+	f.verified = make(map[string][sha256.Size]byte)
+	return nil
+}
@@ -0,0 +1,328 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/jobs"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/provision"
+)
+
+// ErrRunning is returned when an import of the same source into the same
+// namespace is already running.
+var ErrRunning = errors.New("import already running")
+
+// importedFromKey records the source of an imported repository, so a
+// re-sync never overwrites a repository created some other way.
+const importedFromKey = "repocraft.importedFrom"
+
+// Job states.
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// Options control where and how a source is imported.
+type Options struct {
+	// Namespace the repositories are imported under, e.g. "acme"; the
+	// source's own paths are kept below it.
+	Namespace string
+	// Metadata copies descriptions and visibility; private repositories
+	// become private here as well.
+	Metadata bool
+}
+
+// Job is the progress of one import run.
+type Job struct {
+	ID        int    `json:"id"`
+	Source    string `json:"source"`
+	Namespace string `json:"namespace"`
+	State     string `json:"state"`
+	// Total is the number of repositories the source listed; Imported
+	// counts new clones and Updated re-synced repositories.
+	Total    int       `json:"total"`
+	Imported int       `json:"imported"`
+	Updated  int       `json:"updated"`
+	Failed   int       `json:"failed"`
+	Current  string    `json:"current,omitempty"`
+	Errors   []string  `json:"errors,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// maxJobErrors bounds the errors kept per job; Failed keeps counting.
+const maxJobErrors = 50
+
+// Importer runs import jobs into RepoRoot.
+type Importer struct {
+	RepoRoot string
+	// Interval, if set, re-syncs every source imported so far.
+	Interval time.Duration
+	// Index, if set, is refreshed after each job so imported private
+	// repositories are protected right away.
+	Index *provision.Index
+	// Events, if set, gets an event for each repository imported.
+	Events  *events.Log
+	GitPath string
+
+	jobs jobs.Registry[Job]
+
+	mu      sync.Mutex
+	running map[string]bool
+	// imports are the sources re-synced every Interval, by key.
+	imports map[string]imported
+}
+
+type imported struct {
+	source Source
+	opts   Options
+}
+
+// Start imports src in the background and returns the new job.
+func (im *Importer) Start(src Source, opts Options) (Job, error) {
+	ns, err := cleanNamespace(opts.Namespace)
+	if err != nil {
+		return Job{}, err
+	}
+	opts.Namespace = ns
+	key := src.Name() + " " + ns
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.running[key] {
+		return Job{}, ErrRunning
+	}
+	if im.running == nil {
+		im.running = make(map[string]bool)
+		im.imports = make(map[string]imported)
+	}
+	im.running[key] = true
+	im.imports[key] = imported{source: src, opts: opts}
+	job := im.jobs.Add(func(id int) *Job {
+		return &Job{ID: id, Source: src.Name(), Namespace: ns, State: StateRunning, Started: time.Now()}
+	})
+	snapshot := job.snapshot()
+
+	go func() {
+		im.run(context.Background(), job, src, opts)
+		im.mu.Lock()
+		delete(im.running, key)
+		im.mu.Unlock()
+		if err := im.Index.Refresh(context.Background()); err != nil {
+			log.Printf("import: refresh index: %v", err)
+		}
+	}()
+	return snapshot, nil
+}
+
+// Jobs returns the recent jobs, oldest first.
+func (im *Importer) Jobs() []Job {
+	return im.jobs.All((*Job).snapshot)
+}
+
+// Job returns the job with the given ID.
+func (im *Importer) Job(id int) (Job, bool) {
+	return im.jobs.Get(id, (*Job).snapshot)
+}
+
+// Run re-syncs the imported sources every Interval until ctx is cancelled.
+// It returns at once when Interval is zero.
+func (im *Importer) Run(ctx context.Context) {
+	if im.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(im.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		im.mu.Lock()
+		var due []imported
+		for _, imp := range im.imports {
+			due = append(due, imp)
+		}
+		im.mu.Unlock()
+		for _, imp := range due {
+			if _, err := im.Start(imp.source, imp.opts); err != nil && !errors.Is(err, ErrRunning) {
+				log.Printf("import: re-sync %s: %v", imp.source.Name(), err)
+			}
+		}
+	}
+}
+
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Errors = append([]string(nil), j.Errors...)
+	return c
+}
+
+func (im *Importer) run(ctx context.Context, job *Job, src Source, opts Options) {
+	remotes, err := src.List(ctx)
+	if err != nil {
+		log.Printf("import %d: %v", job.ID, err)
+		im.jobs.Finish(job, func(j *Job) {
+			j.State, j.Errors, j.Finished = StateFailed, []string{err.Error()}, time.Now()
+		})
+		return
+	}
+	im.jobs.Update(job, func(j *Job) { j.Total = len(remotes) })
+
+	for _, remote := range remotes {
+		rel := path.Join(opts.Namespace, remote.Path)
+		if !strings.HasSuffix(rel, ".git") {
+			rel += ".git"
+		}
+		im.jobs.Update(job, func(j *Job) { j.Current = rel })
+		created, err := im.sync(ctx, src, remote, rel, opts)
+		im.jobs.Update(job, func(j *Job) {
+			switch {
+			case err != nil:
+				j.Failed++
+				if len(j.Errors) < maxJobErrors {
+					j.Errors = append(j.Errors, fmt.Sprintf("%s: %v", rel, err))
+				}
+			case created:
+				j.Imported++
+			default:
+				j.Updated++
+			}
+		})
+		if err != nil {
+			log.Printf("import %d: %s: %v", job.ID, rel, err)
+		}
+	}
+
+	var done Job
+	im.jobs.Finish(job, func(j *Job) {
+		j.State, j.Current, j.Finished = StateDone, "", time.Now()
+		done = *j
+	})
+	log.Printf("import %d: %s done: %d imported, %d updated, %d failed", done.ID, done.Source, done.Imported, done.Updated, done.Failed)
+}
+
+// sync clones remote into rel, or fetches into it if it was imported
+// before, and reports whether it was created.
+func (im *Importer) sync(ctx context.Context, src Source, remote Remote, rel string, opts Options) (bool, error) {
+	if !filepath.IsLocal(rel) || hasHiddenPart(rel) {
+		return false, fmt.Errorf("invalid repository path %q", rel)
+	}
+	dir := filepath.Join(im.RepoRoot, filepath.FromSlash(rel))
+	origin := src.Name() + "/" + remote.Path
+	created := false
+
+	if _, err := os.Stat(dir); err == nil {
+		out, _ := exec.Command(im.git(), "config", "--file", filepath.Join(dir, "config"), "--get", importedFromKey).Output()
+		if strings.TrimSpace(string(out)) != origin {
+			return false, fmt.Errorf("repository exists and was not imported from %s", origin)
+		}
+		if err := im.gitRun(ctx, src, dir, "fetch", "--quiet", "--prune", "origin"); err != nil {
+			return false, err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+			return false, err
+		}
+		// Clone next to the destination under a hidden name, so servers and
+		// later runs never see a partial repository.
+		tmp := filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".import")
+		os.RemoveAll(tmp)
+		if err := im.gitRun(ctx, src, "", "clone", "--quiet", "--mirror", remote.CloneURL, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return false, err
+		}
+		if err := im.setConfig(tmp, importedFromKey, origin); err != nil {
+			os.RemoveAll(tmp)
+			return false, err
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			os.RemoveAll(tmp)
+			return false, err
+		}
+		created = true
+		im.Events.Record(events.Event{Type: events.RepoCreated, Repo: rel, Actor: "import"})
+	}
+
+	if opts.Metadata {
+		visibility := provision.Public
+		if remote.Private {
+			visibility = provision.Private
+		}
+		if err := im.setConfig(dir, provision.VisibilityKey, visibility); err != nil {
+			return created, err
+		}
+		if remote.Description != "" {
+			if err := os.WriteFile(filepath.Join(dir, "description"), []byte(remote.Description+"\n"), 0o644); err != nil {
+				return created, err
+			}
+		}
+	}
+	return created, nil
+}
+
+// gitRun runs git with the source's credentials passed through the
+// environment, where they don't show up in process listings or get saved.
+func (im *Importer) gitRun(ctx context.Context, src Source, dir string, args ...string) error {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, im.git(), args...)
+	// Clone URLs come from the source's API; only fetch over HTTP(S).
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=http:https")
+	if header := src.AuthHeader(); header != "" {
+		cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0="+header)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git %s: %v: %s", strings.Join(args[:min(len(args), 3)], " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (im *Importer) setConfig(dir, key, value string) error {
+	cmd := exec.Command(im.git(), "config", "--file", filepath.Join(dir, "config"), key, value)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git config %s: %v: %s", key, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (im *Importer) git() string {
+	if im.GitPath != "" {
+		return im.GitPath
+	}
+	return "git"
+}
+
+// cleanNamespace checks a destination namespace; it may be empty.
+func cleanNamespace(ns string) (string, error) {
+	ns = strings.Trim(ns, "/")
+	if ns == "" {
+		return "", nil
+	}
+	if !filepath.IsLocal(ns) || hasHiddenPart(ns) || path.Clean(ns) != ns {
+		return "", fmt.Errorf("invalid namespace %q", ns)
+	}
+	return ns, nil
+}
+
+func hasHiddenPart(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
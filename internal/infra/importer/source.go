@@ -0,0 +1,201 @@
+// Package importer mirrors the repositories of a GitHub organization or a
+// GitLab group into the repository root. Imports run as background jobs
+// whose progress can be polled; running an import again fetches only what
+// changed since the last run.
+package importer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Remote is a repository offered by a Source.
+type Remote struct {
+	// Path is the repository path within the organization or group, e.g.
+	// "app" or "backend/app" for GitLab subgroups.
+	Path        string
+	CloneURL    string
+	Description string
+	Private     bool
+}
+
+// Source lists the repositories to import.
+type Source interface {
+	// Name identifies the source in job status and in the imported
+	// repositories' config, e.g. "github:acme".
+	Name() string
+	List(ctx context.Context) ([]Remote, error)
+	// AuthHeader is sent to the clone URLs, so the token is never stored
+	// in a repository's config.
+	AuthHeader() string
+}
+
+// maxPages bounds pagination in case an API keeps returning full pages.
+const maxPages = 1000
+
+// GitHub lists the repositories of an organization.
+type GitHub struct {
+	Org   string
+	Token string
+	// BaseURL of the REST API; defaults to "https://api.github.com". Set it
+	// to "https://<host>/api/v3" for GitHub Enterprise Server.
+	BaseURL string
+	Client  *http.Client
+}
+
+type githubRepo struct {
+	Name        string `json:"name"`
+	CloneURL    string `json:"clone_url"`
+	Description string `json:"description"`
+	Private     bool   `json:"private"`
+}
+
+// Name implements Source.
+func (g GitHub) Name() string { return "github:" + g.Org }
+
+// AuthHeader implements Source.
+func (g GitHub) AuthHeader() string {
+	if g.Token == "" {
+		return ""
+	}
+	return basicAuth("x-access-token", g.Token)
+}
+
+// List implements Source.
+func (g GitHub) List(ctx context.Context) ([]Remote, error) {
+	base := strings.TrimSuffix(g.BaseURL, "/")
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	var remotes []Remote
+	for page := 1; page <= maxPages; page++ {
+		u := fmt.Sprintf("%s/orgs/%s/repos?type=all&per_page=100&page=%d", base, url.PathEscape(g.Org), page)
+		header := http.Header{"Accept": {"application/vnd.github+json"}}
+		if g.Token != "" {
+			header.Set("Authorization", "Bearer "+g.Token)
+		}
+		var repos []githubRepo
+		if err := getJSON(ctx, g.Client, u, header, &repos); err != nil {
+			return nil, fmt.Errorf("github: list %s: %w", g.Org, err)
+		}
+		for _, r := range repos {
+			remotes = append(remotes, Remote{Path: r.Name, CloneURL: r.CloneURL, Description: r.Description, Private: r.Private})
+		}
+		if len(repos) < 100 {
+			break
+		}
+	}
+	return remotes, nil
+}
+
+// GitLab lists the projects of a group and its subgroups.
+type GitLab struct {
+	// Group is the full path of the group, e.g. "acme/platform".
+	Group string
+	Token string
+	// BaseURL of the instance; defaults to "https://gitlab.com".
+	BaseURL string
+	Client  *http.Client
+}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	HTTPURLToRepo     string `json:"http_url_to_repo"`
+	Description       string `json:"description"`
+	Visibility        string `json:"visibility"`
+}
+
+// Name implements Source.
+func (g GitLab) Name() string { return "gitlab:" + g.Group }
+
+// AuthHeader implements Source.
+func (g GitLab) AuthHeader() string {
+	if g.Token == "" {
+		return ""
+	}
+	return basicAuth("oauth2", g.Token)
+}
+
+// List implements Source.
+func (g GitLab) List(ctx context.Context) ([]Remote, error) {
+	base := strings.TrimSuffix(g.BaseURL, "/")
+	if base == "" {
+		base = "https://gitlab.com"
+	}
+	group := strings.Trim(g.Group, "/")
+	var remotes []Remote
+	for page := 1; page <= maxPages; page++ {
+		u := fmt.Sprintf("%s/api/v4/groups/%s/projects?include_subgroups=true&archived=false&per_page=100&page=%d",
+			base, url.PathEscape(group), page)
+		header := http.Header{}
+		if g.Token != "" {
+			header.Set("PRIVATE-TOKEN", g.Token)
+		}
+		var projects []gitlabProject
+		if err := getJSON(ctx, g.Client, u, header, &projects); err != nil {
+			return nil, fmt.Errorf("gitlab: list %s: %w", group, err)
+		}
+		for _, p := range projects {
+			path := strings.TrimPrefix(p.PathWithNamespace, group+"/")
+			remotes = append(remotes, Remote{
+				Path:        path,
+				CloneURL:    p.HTTPURLToRepo,
+				Description: p.Description,
+				Private:     p.Visibility != "public",
+			})
+		}
+		if len(projects) < 100 {
+			break
+		}
+	}
+	return remotes, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, header http.Header, v any) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func basicAuth(user, password string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// ParseSource returns the source named by provider, "github" or "gitlab".
+// An empty baseURL selects the public service.
+func ParseSource(provider, owner, token, baseURL string) (Source, error) {
+	if owner == "" {
+		return nil, fmt.Errorf("missing organization or group")
+	}
+	switch strings.ToLower(provider) {
+	case "github":
+		return GitHub{Org: owner, Token: token, BaseURL: baseURL}, nil
+	case "gitlab":
+		return GitLab{Group: owner, Token: token, BaseURL: baseURL}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", provider)
+	}
+}
@@ -0,0 +1,218 @@
+// Package introspect reports what a running daemon is actually doing: the
+// effective configuration it started with, with secrets redacted, which
+// optional features are enabled, and the health of its components. Daemons
+// fill a Registry while they start and serve its Report on an admin
+// endpoint.
+package introspect
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redacted replaces secret values.
+const Redacted = "[redacted]"
+
+// checkTimeout bounds each health check.
+const checkTimeout = 5 * time.Second
+
+// secretWords mark setting names whose values are secret.
+var secretWords = []string{"TOKEN", "SECRET", "PASSWORD", "PASSPHRASE", "KEY", "CREDENTIAL", "CERTIFICATE", "PRIVATE"}
+
+// Health statuses.
+const (
+	StatusOK       = "ok"
+	StatusFailing  = "failing"
+	StatusDegraded = "degraded"
+)
+
+// Registry collects the configuration, features and health checks of a
+// daemon. A nil Registry records nothing.
+type Registry struct {
+	// Started is reported along with the uptime.
+	Started time.Time
+
+	mu       sync.Mutex
+	settings map[string]string
+	features map[string]bool
+	checks   map[string]func(context.Context) error
+}
+
+// Report is the state of a daemon at one point in time.
+type Report struct {
+	Started   time.Time `json:"started"`
+	Uptime    string    `json:"uptime"`
+	GoVersion string    `json:"go_version"`
+	// Status is StatusOK when every component is healthy and
+	// StatusDegraded otherwise.
+	Status   string            `json:"status"`
+	Settings map[string]string `json:"settings"`
+	Features map[string]bool   `json:"features"`
+	Health   map[string]Health `json:"health"`
+}
+
+// Health is the result of one component's health check.
+type Health struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// Set records the effective value of a setting, redacted if its name
+// suggests a secret. Passwords in URLs are redacted whatever the name.
+func (r *Registry) Set(name, value string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.settings == nil {
+		r.settings = make(map[string]string)
+	}
+	r.settings[name] = Redact(name, value)
+}
+
+// SetEnv records every environment variable starting with prefix, e.g.
+// "REPOCRAFT_", as a setting.
+func (r *Registry) SetEnv(prefix string) {
+	for _, kv := range os.Environ() {
+		if name, value, _ := strings.Cut(kv, "="); strings.HasPrefix(name, prefix) {
+			r.Set(name, value)
+		}
+	}
+}
+
+// Feature records whether an optional feature is enabled.
+func (r *Registry) Feature(name string, enabled bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.features == nil {
+		r.features = make(map[string]bool)
+	}
+	r.features[name] = enabled
+}
+
+// Check registers a health check for a component. fn returns nil while the
+// component is healthy.
+func (r *Registry) Check(name string, fn func(context.Context) error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checks == nil {
+		r.checks = make(map[string]func(context.Context) error)
+	}
+	r.checks[name] = fn
+}
+
+// Report runs the health checks concurrently and returns the daemon's state.
+func (r *Registry) Report(ctx context.Context) Report {
+	rep := Report{
+		GoVersion: runtime.Version(),
+		Status:    StatusOK,
+		Settings:  map[string]string{},
+		Features:  map[string]bool{},
+		Health:    map[string]Health{},
+	}
+	if r == nil {
+		return rep
+	}
+	r.mu.Lock()
+	rep.Started = r.Started
+	for k, v := range r.settings {
+		rep.Settings[k] = v
+	}
+	for k, v := range r.features {
+		rep.Features[k] = v
+	}
+	checks := make(map[string]func(context.Context) error, len(r.checks))
+	for k, v := range r.checks {
+		checks[k] = v
+	}
+	r.mu.Unlock()
+	if !rep.Started.IsZero() {
+		rep.Uptime = time.Since(rep.Started).Round(time.Second).String()
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn func(context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			start := time.Now()
+			err := fn(ctx)
+			h := Health{Status: StatusOK, Latency: time.Since(start).Round(time.Microsecond).String()}
+			if err != nil {
+				h.Status, h.Error = StatusFailing, err.Error()
+			}
+			mu.Lock()
+			rep.Health[name] = h
+			mu.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+	for _, h := range rep.Health {
+		if h.Status != StatusOK {
+			rep.Status = StatusDegraded
+		}
+	}
+	return rep
+}
+
+// Redact returns value, or Redacted if name suggests a secret. Passwords
+// and secret query parameters of URLs in value are redacted as well, also
+// inside comma-separated lists.
+func Redact(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	upper := strings.ToUpper(name)
+	for _, w := range secretWords {
+		if strings.Contains(upper, w) {
+			return Redacted
+		}
+	}
+	parts := strings.Split(value, ",")
+	for i, p := range parts {
+		parts[i] = redactURL(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+// redactURL hides the password and secret query parameters of a URL the
+// way url.URL.Redacted does.
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return s
+	}
+	_, changed := u.User.Password()
+	if q := u.Query(); len(q) > 0 {
+		for k := range q {
+			if Redact(k, "x") == Redacted {
+				q.Set(k, "xxxxx")
+				changed = true
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	if !changed {
+		return s
+	}
+	return u.Redacted()
+}
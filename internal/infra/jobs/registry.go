@@ -0,0 +1,92 @@
+// Package jobs keeps the background jobs of the importer, exporter and
+// purger for status queries.
+package jobs
+
+import "sync"
+
+// MaxFinished is the number of finished jobs kept for status queries.
+const MaxFinished = 100
+
+// Registry numbers jobs of type J and keeps them, and their updates, for
+// status queries: running jobs until they finish, and the last
+// MaxFinished finished ones. The zero value is ready to use.
+type Registry[J any] struct {
+	mu     sync.Mutex
+	jobs   []*entry[J]
+	nextID int
+}
+
+type entry[J any] struct {
+	id       int
+	job      *J
+	finished bool
+}
+
+// Add creates a job with the next ID and returns it. create runs under
+// the registry's lock, so the job is complete before it can be queried.
+func (r *Registry[J]) Add(create func(id int) *J) *J {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	job := create(r.nextID)
+	r.jobs = append(r.jobs, &entry[J]{id: r.nextID, job: job})
+	return job
+}
+
+// Update changes job under the registry's lock.
+func (r *Registry[J]) Update(job *J, fn func(*J)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(job)
+}
+
+// Finish changes job for the last time, under the registry's lock, and
+// drops the oldest finished jobs beyond MaxFinished.
+func (r *Registry[J]) Finish(job *J, fn func(*J)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(job)
+	finished := 0
+	for _, e := range r.jobs {
+		if e.job == job {
+			e.finished = true
+		}
+		if e.finished {
+			finished++
+		}
+	}
+	kept := r.jobs[:0]
+	for _, e := range r.jobs {
+		if e.finished && finished > MaxFinished {
+			finished--
+			continue
+		}
+		kept = append(kept, e)
+	}
+	clear(r.jobs[len(kept):])
+	r.jobs = kept
+}
+
+// All returns copies of the jobs, oldest first, made by snapshot.
+func (r *Registry[J]) All(snapshot func(*J) J) []J {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	jobs := make([]J, 0, len(r.jobs))
+	for _, e := range r.jobs {
+		jobs = append(jobs, snapshot(e.job))
+	}
+	return jobs
+}
+
+// Get returns a copy of the job with the given ID, made by snapshot.
+func (r *Registry[J]) Get(id int, snapshot func(*J) J) (J, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.jobs {
+		if e.id == id {
+			return snapshot(e.job), true
+		}
+	}
+	var zero J
+	return zero, false
+}
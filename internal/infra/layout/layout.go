@@ -0,0 +1,286 @@
+// Package layout checks that a repository root holds only what the servers
+// expect: bare repositories in namespace directories, with names every
+// transport can address, no symlinks leading out of the root and
+// permissions the server can work with. It repairs what is safe to repair
+// and reports the rest.
+package layout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Problem kinds.
+const (
+	// KindNonBare is a working tree clone, which the servers don't serve.
+	KindNonBare = "non-bare"
+	// KindBareConfig is a bare repository whose config says it isn't.
+	KindBareConfig = "bare-config"
+	// KindDanglingSymlink is a symlink whose target doesn't exist.
+	KindDanglingSymlink = "dangling-symlink"
+	// KindEscapingSymlink is a symlink leading out of the root, which the
+	// resolver's path checks can't see through.
+	KindEscapingSymlink = "escaping-symlink"
+	// KindInvalidName is a name clients can't address safely.
+	KindInvalidName = "invalid-name"
+	// KindNested is a repository inside another repository.
+	KindNested = "nested"
+	// KindAmbiguous is a repository with a twin differing only in ".git".
+	KindAmbiguous = "ambiguous"
+	// KindStaleTemp is what is left of an interrupted create, import or
+	// provisioning run.
+	KindStaleTemp = "stale-temp"
+	// KindPermissions is a file or directory the server can't use, or one
+	// anyone may write to.
+	KindPermissions = "permissions"
+)
+
+// tempSuffixes are the suffixes of the hidden directories repositories are
+// built in before being renamed into place.
+var tempSuffixes = []string{".create", ".import", ".provision"}
+
+// Problem is one finding of a check.
+type Problem struct {
+	// Path relative to the root.
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	// Fixed is set when the problem was repaired.
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Path, p.Kind, p.Detail)
+}
+
+// Checker checks the layout of RepoRoot.
+type Checker struct {
+	RepoRoot string
+	// Fix repairs what is safe to repair: it removes dangling symlinks and
+	// stale temporary directories, marks bare repositories bare in their
+	// config and fixes the permissions of files the running user owns.
+	Fix bool
+	// StaleAfter is the age after which temporary directories count as
+	// left over; defaults to 24 hours.
+	StaleAfter time.Duration
+	GitPath    string
+}
+
+// Check walks RepoRoot and returns the problems found, repaired or not.
+func (c *Checker) Check(ctx context.Context) ([]Problem, error) {
+	root, err := filepath.Abs(c.RepoRoot)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	var problems []Problem
+	report := func(p Problem) { problems = append(problems, p) }
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				rel, _ := filepath.Rel(root, path)
+				report(Problem{Path: filepath.ToSlash(rel), Kind: KindPermissions, Detail: err.Error()})
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		name := d.Name()
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			c.checkSymlink(root, path, rel, report)
+			return nil
+		}
+		if strings.HasPrefix(name, ".") {
+			if d.IsDir() {
+				c.checkTemp(path, rel, report)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if detail := invalidName(name); detail != "" {
+			report(Problem{Path: rel, Kind: KindInvalidName, Detail: detail})
+		}
+		c.checkPermissions(path, rel, d, report)
+		if _, err := os.Lstat(filepath.Join(path, ".git")); err == nil {
+			report(Problem{Path: rel, Kind: KindNonBare, Detail: "working tree clone; clone it with --bare instead"})
+			return filepath.SkipDir
+		}
+		if !service.IsRepository(path) {
+			return nil
+		}
+		if twin, ok := strings.CutSuffix(path, ".git"); ok && service.IsRepository(twin) {
+			report(Problem{Path: rel, Kind: KindAmbiguous, Detail: fmt.Sprintf("%s names a repository too", strings.TrimSuffix(rel, ".git"))})
+		}
+		c.checkRepo(ctx, path, rel, report)
+		return filepath.SkipDir
+	})
+	return problems, err
+}
+
+// checkRepo checks a bare repository and everything in it.
+func (c *Checker) checkRepo(ctx context.Context, dir, rel string, report func(Problem)) {
+	out, err := exec.CommandContext(ctx, c.git(), "config", "--file", filepath.Join(dir, "config"), "--type=bool", "--get", "core.bare").Output()
+	if err == nil && strings.TrimSpace(string(out)) == "false" {
+		p := Problem{Path: rel, Kind: KindBareConfig, Detail: "core.bare is false"}
+		if c.Fix {
+			err := exec.CommandContext(ctx, c.git(), "config", "--file", filepath.Join(dir, "config"), "core.bare", "true").Run()
+			p.Fixed = err == nil
+		}
+		report(p)
+	}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if path == dir {
+			return nil
+		}
+		sub := rel + filepath.ToSlash(strings.TrimPrefix(path, dir))
+		if err != nil {
+			report(Problem{Path: sub, Kind: KindPermissions, Detail: err.Error()})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		if d.IsDir() && filepath.Dir(path) == dir && service.IsRepository(path) {
+			report(Problem{Path: sub, Kind: KindNested, Detail: "repository inside " + rel})
+			return filepath.SkipDir
+		}
+		c.checkPermissions(path, sub, d, report)
+		return nil
+	})
+}
+
+// checkSymlink reports symlinks that dangle or lead out of root. Dangling
+// ones are removed when fixing; ones leading out of the root may be
+// deliberate, e.g. onto another disk, and are only reported.
+func (c *Checker) checkSymlink(root, path, rel string, report func(Problem)) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		dest, _ := os.Readlink(path)
+		p := Problem{Path: rel, Kind: KindDanglingSymlink, Detail: "points to missing " + dest}
+		if c.Fix {
+			p.Fixed = os.Remove(path) == nil
+		}
+		report(p)
+		return
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		realRoot = root
+	}
+	if target != realRoot && !strings.HasPrefix(target, realRoot+string(os.PathSeparator)) {
+		report(Problem{Path: rel, Kind: KindEscapingSymlink, Detail: "points outside the root to " + target})
+	}
+}
+
+// checkTemp reports hidden build directories older than StaleAfter and
+// removes them when fixing.
+func (c *Checker) checkTemp(path, rel string, report func(Problem)) {
+	temp := false
+	for _, suffix := range tempSuffixes {
+		temp = temp || strings.HasSuffix(path, suffix)
+	}
+	if !temp {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	staleAfter := c.StaleAfter
+	if staleAfter <= 0 {
+		staleAfter = 24 * time.Hour
+	}
+	age := time.Since(fi.ModTime())
+	if age < staleAfter {
+		return
+	}
+	p := Problem{Path: rel, Kind: KindStaleTemp, Detail: fmt.Sprintf("left over for %s", age.Round(time.Minute))}
+	if c.Fix {
+		p.Fixed = os.RemoveAll(path) == nil
+	}
+	report(p)
+}
+
+// checkPermissions reports directories the owner can't list, enter or
+// write, files the owner can't read, and anything writable by everyone.
+// Git's object files are read-only on purpose, so files need not be
+// writable.
+func (c *Checker) checkPermissions(path, rel string, d fs.DirEntry, report func(Problem)) {
+	fi, err := d.Info()
+	if err != nil {
+		return
+	}
+	mode := fi.Mode().Perm()
+	want := mode &^ 0o002
+	if d.IsDir() {
+		want |= 0o700
+	} else {
+		want |= 0o400
+	}
+	if want == mode {
+		return
+	}
+	p := Problem{Path: rel, Kind: KindPermissions, Detail: fmt.Sprintf("mode %04o, want %04o", mode, want)}
+	if c.Fix {
+		p.Fixed = os.Chmod(path, want) == nil
+	}
+	report(p)
+}
+
+// invalidName explains why clients can't safely address a directory name,
+// or returns "".
+func invalidName(name string) string {
+	switch {
+	case !utf8.ValidString(name):
+		return "name is not valid UTF-8"
+	case strings.HasPrefix(name, "-"):
+		return "name starts with a dash"
+	case strings.TrimSpace(name) != name:
+		return "name starts or ends with white space"
+	case strings.ContainsAny(name, "\\:*?\"<>|"):
+		return "name contains a character reserved on some platforms"
+	case strings.ContainsFunc(name, unicode.IsControl):
+		return "name contains a control character"
+	}
+	return ""
+}
+
+func (c *Checker) git() string {
+	if c.GitPath != "" {
+		return c.GitPath
+	}
+	return "git"
+}
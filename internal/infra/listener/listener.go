@@ -0,0 +1,177 @@
+// Package listener describes the addresses a server binds, so one server
+// can listen on IPv4 and IPv6, on several ports and on Unix sockets, with
+// options per listener such as TLS or trusting a proxy in front of it.
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Config is one listening address.
+type Config struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix". A "tcp" listener on a
+	// wildcard address accepts both IPv4 and IPv6; "tcp6" only IPv6, so it
+	// can be combined with a "tcp4" listener on the same port.
+	Network string
+	Addr    string
+	// TLS terminates TLS on this listener.
+	TLS bool
+	// Proxied marks every peer of this listener as a trusted proxy, so
+	// their forwarded client addresses are used.
+	Proxied bool
+}
+
+func (c Config) String() string {
+	s := c.Network + ":" + c.Addr
+	if c.TLS {
+		s += "+tls"
+	}
+	if c.Proxied {
+		s += "+proxied"
+	}
+	return s
+}
+
+// Listen binds the address. tlsConfig is required for TLS listeners.
+func (c Config) Listen(tlsConfig *tls.Config) (net.Listener, error) {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if c.TLS && tlsConfig == nil {
+		return nil, fmt.Errorf("listen %s: no TLS certificate configured", c)
+	}
+	if network == "unix" {
+		if err := removeStaleSocket(c.Addr); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen(network, c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.Proxied {
+		l = proxiedListener{l}
+	}
+	if c.TLS {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+// Parse reads a comma-separated list of listeners. Each entry is an
+// address with optional "+tls" and "+proxied" suffixes; the network follows
+// from the address:
+//
+//	0.0.0.0:8080              tcp4
+//	[::]:8080                 tcp6
+//	:8443+tls                 tcp, both families
+//	unix:/run/git.sock+proxied
+func Parse(s string) ([]Config, error) {
+	var configs []Config
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "+")
+		c := Config{Addr: parts[0]}
+		for _, opt := range parts[1:] {
+			switch opt {
+			case "tls":
+				c.TLS = true
+			case "proxied":
+				c.Proxied = true
+			default:
+				return nil, fmt.Errorf("listener %q: unknown option %q", entry, opt)
+			}
+		}
+		if path, ok := strings.CutPrefix(c.Addr, "unix:"); ok {
+			c.Network, c.Addr = "unix", path
+		} else {
+			network, err := tcpNetwork(c.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("listener %q: %w", entry, err)
+			}
+			c.Network = network
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// tcpNetwork picks tcp4 or tcp6 for literal addresses and tcp otherwise.
+func tcpNetwork(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "tcp", nil
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "tcp", nil // a host name
+	}
+	if ip.Is4() {
+		return "tcp4", nil
+	}
+	return "tcp6", nil
+}
+
+type proxiedKey struct{}
+
+// ConnContext marks connections accepted on proxied listeners; set it as
+// http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if _, ok := c.(proxiedConn); ok {
+		return context.WithValue(ctx, proxiedKey{}, true)
+	}
+	return ctx
+}
+
+// Proxied reports whether ctx belongs to a connection accepted on a
+// proxied listener.
+func Proxied(ctx context.Context) bool {
+	v, _ := ctx.Value(proxiedKey{}).(bool)
+	return v
+}
+
+type proxiedListener struct {
+	net.Listener
+}
+
+func (l proxiedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return proxiedConn{c}, nil
+}
+
+type proxiedConn struct {
+	net.Conn
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run;
+// other files at path, and sockets still being served, are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("listen unix:%s: address already in use", path)
+	}
+	return os.Remove(path)
+}
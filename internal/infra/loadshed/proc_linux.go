@@ -0,0 +1,113 @@
+//go:build linux
+
+package loadshed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// systemSampler reads /proc. I/O wait is measured between consecutive
+// calls, so the first sample reports it as zero.
+func systemSampler() func() (Pressure, error) {
+	var prevIOWait, prevTotal uint64
+	return func() (Pressure, error) {
+		var p Pressure
+		load, err := readLoad()
+		if err != nil {
+			return p, err
+		}
+		p.Load = load / float64(runtime.NumCPU())
+
+		// Kernels without PSI have no /proc/pressure; the metric stays zero.
+		if mem, err := readPSI("/proc/pressure/memory"); err == nil {
+			p.MemoryPressure = mem
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return p, err
+		}
+
+		iowait, total, err := readCPUTimes()
+		if err != nil {
+			return p, err
+		}
+		if prevTotal > 0 && total > prevTotal {
+			p.IOWait = 100 * float64(iowait-prevIOWait) / float64(total-prevTotal)
+		}
+		prevIOWait, prevTotal = iowait, total
+		return p, nil
+	}
+}
+
+func readLoad() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("empty /proc/loadavg")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse /proc/loadavg: %w", err)
+	}
+	return load, nil
+}
+
+// readPSI returns the "some avg10" value of a PSI file.
+func readPSI(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if v, ok := strings.CutPrefix(f, "avg10="); ok {
+				avg, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return 0, fmt.Errorf("parse %s: %w", path, err)
+				}
+				return avg, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("parse %s: no avg10", path)
+}
+
+// readCPUTimes returns the iowait and total jiffies of the aggregate cpu
+// line of /proc/stat.
+func readCPUTimes() (iowait, total uint64, err error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return 0, 0, errors.New("parse /proc/stat: no cpu line")
+	}
+	// user nice system idle iowait irq softirq steal; guest time is
+	// already included in user and nice.
+	for i, f := range fields[1:] {
+		if i >= 8 {
+			break
+		}
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("parse /proc/stat: %w", err)
+		}
+		total += v
+		if i == 4 {
+			iowait = v
+		}
+	}
+	return iowait, total, nil
+}
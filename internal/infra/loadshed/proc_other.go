@@ -0,0 +1,9 @@
+//go:build !linux
+
+package loadshed
+
+func systemSampler() func() (Pressure, error) {
+	return func() (Pressure, error) {
+		return Pressure{}, errUnsupported
+	}
+}
@@ -0,0 +1,183 @@
+// Package loadshed turns away low-priority git operations while the host is
+// under pressure, so that pushes keep going through.
+package loadshed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// errUnsupported is returned by the system sampler on platforms without
+// the /proc interfaces it reads.
+var errUnsupported = errors.New("system pressure is not available on this platform")
+
+// Priority orders operations by how long they may be held off.
+type Priority int
+
+const (
+	// PriorityLow covers anonymous clones and mirror syncs; shed first.
+	PriorityLow Priority = iota
+	// PriorityNormal covers authenticated fetches; shed under severe pressure.
+	PriorityNormal
+	// PriorityHigh covers pushes, which are never shed.
+	PriorityHigh
+)
+
+// Pressure is one sample of host load.
+type Pressure struct {
+	// Load is the 1-minute load average divided by the number of CPUs.
+	Load float64 `json:"load"`
+	// MemoryPressure is the share of time (percent) some task stalled on
+	// memory over the last 10 seconds, from Linux PSI. It stays zero on
+	// kernels without PSI.
+	MemoryPressure float64 `json:"memory_pressure"`
+	// IOWait is the share of CPU time (percent) spent waiting for I/O since
+	// the previous sample.
+	IOWait float64 `json:"io_wait"`
+}
+
+// Thresholds bound each Pressure metric. A zero field disables the check.
+type Thresholds struct {
+	Load           float64
+	MemoryPressure float64
+	IOWait         float64
+}
+
+// severeFactor scales Thresholds to the level at which authenticated
+// fetches are shed as well.
+const severeFactor = 1.5
+
+// Shedder samples host pressure every Interval and decides which operations
+// may start. Above Thresholds, low-priority operations are shed; above
+// severeFactor times Thresholds, normal ones too. A nil Shedder admits
+// everything.
+type Shedder struct {
+	Thresholds Thresholds
+	// Interval is the time between samples; defaults to five seconds.
+	Interval time.Duration
+	// RetryAfter is suggested to shed clients; defaults to 30 seconds.
+	RetryAfter time.Duration
+	// Mirrors lists identities (key fingerprints or remote hosts) of mirror
+	// sync clients, which are treated as low priority.
+	Mirrors map[string]bool
+	// Sample reads the current pressure; defaults to the host's /proc.
+	Sample func() (Pressure, error)
+
+	mu       sync.Mutex
+	pressure Pressure
+	level    Priority // operations below level are shed
+}
+
+// Classify returns the priority of an operation: pushes are high,
+// authenticated fetches normal, and anonymous fetches and fetches by
+// Mirrors low.
+func (s *Shedder) Classify(push, authenticated bool, identity string) Priority {
+	switch {
+	case push:
+		return PriorityHigh
+	case !authenticated:
+		return PriorityLow
+	case s != nil && s.Mirrors[identity]:
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+// Allow reports whether an operation of priority p may start. When it may
+// not, retryAfter is how long the client should wait before trying again.
+func (s *Shedder) Allow(p Priority) (retryAfter time.Duration, ok bool) {
+	if s == nil {
+		return 0, true
+	}
+	s.mu.Lock()
+	level := s.level
+	s.mu.Unlock()
+	if p >= level {
+		return 0, true
+	}
+	if s.RetryAfter > 0 {
+		return s.RetryAfter, false
+	}
+	return 30 * time.Second, false
+}
+
+// Pressure returns the most recent sample.
+func (s *Shedder) Pressure() Pressure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pressure
+}
+
+// Run samples pressure each Interval until ctx is cancelled.
+func (s *Shedder) Run(ctx context.Context) error {
+	sample := s.Sample
+	if sample == nil {
+		sample = systemSampler()
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	if err := s.update(sample); errors.Is(err, errUnsupported) {
+		return fmt.Errorf("load shedding: %w", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := s.update(sample); err != nil {
+				log.Printf("load shedding: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Shedder) update(sample func() (Pressure, error)) error {
+	p, err := sample()
+	if err != nil {
+		return err
+	}
+	level := PriorityLow
+	switch {
+	case s.exceeds(p, severeFactor):
+		level = PriorityHigh
+	case s.exceeds(p, 1):
+		level = PriorityNormal
+	}
+	s.mu.Lock()
+	prev := s.level
+	s.pressure = p
+	s.level = level
+	s.mu.Unlock()
+	if level != prev {
+		log.Printf("load shedding: %s (load %.2f, memory pressure %.1f%%, iowait %.1f%%)",
+			levelDescription(level), p.Load, p.MemoryPressure, p.IOWait)
+	}
+	return nil
+}
+
+func (s *Shedder) exceeds(p Pressure, factor float64) bool {
+	t := s.Thresholds
+	return (t.Load > 0 && p.Load >= t.Load*factor) ||
+		(t.MemoryPressure > 0 && p.MemoryPressure >= t.MemoryPressure*factor) ||
+		(t.IOWait > 0 && p.IOWait >= t.IOWait*factor)
+}
+
+func levelDescription(level Priority) string {
+	switch level {
+	case PriorityLow:
+		return "admitting all operations"
+	case PriorityNormal:
+		return "shedding anonymous clones and mirror syncs"
+	default:
+		return "shedding all fetches"
+	}
+}
@@ -0,0 +1,301 @@
+// Package locale translates what clients are told — errors, banners and
+// push rejections — into their language. The locale of a request comes
+// from, in this order: the setting for the client's identity, the language
+// the client asks for (git sends Accept-Language over HTTP; SSH clients
+// often pass LANG), the setting for the repository, and the default.
+//
+// Messages are looked up in a catalog by key: the error code for errors,
+// e.g. "repo_not_found", and the English text for everything else, as with
+// gettext. Catalogs for German and French are built in; a directory of
+// <locale>.json files adds locales or replaces entries:
+//
+//	{"repo_not_found": "Repository nicht gefunden{{with .Repo}}: {{.}}{{end}}",
+//	 "Maintenance tonight at 18:00 UTC": "Wartung heute um 18:00 UTC"}
+//
+// Messages are text/template templates over Data, so banners and
+// translations can name the repository.
+package locale
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repomatch"
+)
+
+//go:embed messages/*.json
+var builtin embed.FS
+
+// Data is what message templates can refer to.
+type Data struct {
+	Repo     string
+	Identity string
+	// Message is the detail of the message: the English text of an error,
+	// or the value a message describes, such as a new repository path.
+	Message string
+}
+
+// Localizer picks the locale of requests and translates messages into it.
+// A nil Localizer leaves messages in English.
+type Localizer struct {
+	// Default is the locale of requests nothing else decides; "" is English.
+	Default string `json:"default,omitempty"`
+	// Repos maps path.Match patterns such as "team-de/*" to the locale of
+	// matching repositories; the longest matching pattern wins.
+	Repos map[string]string `json:"repos,omitempty"`
+	// Identities maps SSH key fingerprints or client addresses to their
+	// locale.
+	Identities map[string]string `json:"identities,omitempty"`
+	// Catalog is a directory of <locale>.json files adding to the built-in
+	// messages.
+	Catalog string `json:"catalog,omitempty"`
+
+	catalogs map[string]map[string]*template.Template
+}
+
+// Load reads the locale settings from a JSON file and loads the catalogs.
+func Load(name string) (*Localizer, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read locales: %w", err)
+	}
+	l := &Localizer{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(l); err != nil {
+		return nil, fmt.Errorf("parse locales %s: %w", name, err)
+	}
+	if err := l.Init(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Init loads the built-in catalogs and those in Catalog, and checks the
+// settings refer to locales it has.
+func (l *Localizer) Init() error {
+	l.catalogs = make(map[string]map[string]*template.Template)
+	if err := l.loadCatalogs(builtin, "messages"); err != nil {
+		return err
+	}
+	if l.Catalog != "" {
+		if err := l.loadCatalogs(os.DirFS(l.Catalog), "."); err != nil {
+			return err
+		}
+	}
+	check := func(what, loc string) error {
+		if loc != "" && l.match(loc) == "" {
+			return fmt.Errorf("locales: %s: no catalog for %q", what, loc)
+		}
+		return nil
+	}
+	if err := check("default", l.Default); err != nil {
+		return err
+	}
+	for pattern, loc := range l.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("locales: invalid pattern %q", pattern)
+		}
+		if err := check(pattern, loc); err != nil {
+			return err
+		}
+	}
+	for identity, loc := range l.Identities {
+		if err := check(identity, loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Localizer) loadCatalogs(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return fmt.Errorf("read catalog: %w", err)
+		}
+		var entries map[string]string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("parse catalog %s: %w", file, err)
+		}
+		loc := normalize(strings.TrimSuffix(path.Base(file), ".json"))
+		catalog := l.catalogs[loc]
+		if catalog == nil {
+			catalog = make(map[string]*template.Template)
+			l.catalogs[loc] = catalog
+		}
+		for key, text := range entries {
+			tmpl, err := template.New(key).Option("missingkey=zero").Parse(text)
+			if err != nil {
+				return fmt.Errorf("catalog %s: %q: %w", filepath.ToSlash(file), key, err)
+			}
+			catalog[key] = tmpl
+		}
+	}
+	return nil
+}
+
+// Locale returns the locale for a request by identity for repo, where the
+// client asked for requested, an Accept-Language header or LANG value. It
+// returns "" for English.
+func (l *Localizer) Locale(repo, identity, requested string) string {
+	if l == nil {
+		return ""
+	}
+	if loc, ok := l.Identities[identity]; ok && identity != "" {
+		return l.match(loc)
+	}
+	for _, tag := range requestedTags(requested) {
+		if tag == "en" || strings.HasPrefix(tag, "en-") {
+			return ""
+		}
+		if loc := l.match(tag); loc != "" {
+			return loc
+		}
+	}
+	if loc, ok := repomatch.Best(l.Repos, repo); ok {
+		return l.match(loc)
+	}
+	return l.match(l.Default)
+}
+
+// match returns the catalog locale serving loc, e.g. "de" for "de-AT", or
+// "" if there is none.
+func (l *Localizer) match(loc string) string {
+	loc = normalize(loc)
+	if _, ok := l.catalogs[loc]; ok {
+		return loc
+	}
+	if base, _, ok := strings.Cut(loc, "-"); ok {
+		if _, ok := l.catalogs[base]; ok {
+			return base
+		}
+	}
+	return ""
+}
+
+// For returns the Printer for a request; see Locale.
+func (l *Localizer) For(repo, identity, requested string) Printer {
+	return l.Printer(l.Locale(repo, identity, requested), repo, identity)
+}
+
+// Printer returns the Printer for a request whose locale is already known.
+func (l *Localizer) Printer(loc, repo, identity string) Printer {
+	p := Printer{Locale: loc, data: Data{Repo: strings.Trim(repo, "/"), Identity: identity}}
+	if l != nil {
+		p.catalog = l.catalogs[loc]
+	}
+	return p
+}
+
+// Printer translates messages for one request. The zero Printer prints
+// English.
+type Printer struct {
+	// Locale is the locale messages are translated into; "" is English.
+	Locale  string
+	catalog map[string]*template.Template
+	data    Data
+}
+
+// Text returns the message with key, its English text, translated, with
+// detail as Data.Message. Untranslated keys containing "{{" are executed as
+// templates themselves.
+func (p Printer) Text(key, detail string) string {
+	if key == "" {
+		return ""
+	}
+	data := p.data
+	data.Message = detail
+	if tmpl, ok := p.catalog[key]; ok {
+		if s, err := execute(tmpl, data); err == nil {
+			return s
+		}
+		return key
+	}
+	if !strings.Contains(key, "{{") {
+		return key
+	}
+	tmpl, err := template.New("").Option("missingkey=zero").Parse(key)
+	if err != nil {
+		return key
+	}
+	if s, err := execute(tmpl, data); err == nil {
+		return s
+	}
+	return key
+}
+
+// Error returns err with its message translated by the catalog entry for
+// its code, which gets the English message as Data.Message. Errors the
+// catalog has no entry for are returned as they are.
+func (p Printer) Error(err error) error {
+	if err == nil || p.catalog == nil {
+		return err
+	}
+	e := errcode.As(err)
+	tmpl, ok := p.catalog[string(e.Code)]
+	if !ok {
+		return err
+	}
+	data := p.data
+	data.Message = err.Error()
+	msg, terr := execute(tmpl, data)
+	if terr != nil {
+		return err
+	}
+	return &errcode.Error{Code: e.Code, Message: msg, Status: e.Status, RetryAfter: e.RetryAfter, Err: err}
+}
+
+func execute(tmpl *template.Template, data Data) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying p.
+func NewContext(ctx context.Context, p Printer) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the Printer in ctx, or the zero Printer.
+func FromContext(ctx context.Context) Printer {
+	p, _ := ctx.Value(contextKey{}).(Printer)
+	return p
+}
+
+// requestedTags returns the language tags of an Accept-Language header in
+// order, or the locale of a LANG value such as "de_DE.UTF-8".
+func requestedTags(requested string) []string {
+	var tags []string
+	for _, part := range strings.Split(requested, ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), ".")
+		if tag = normalize(tag); tag != "" && tag != "*" && tag != "c" && tag != "posix" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// normalize turns "de_DE" and "de-de" into "de-de".
+func normalize(loc string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(loc), "_", "-"))
+}
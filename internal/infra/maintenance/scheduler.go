@@ -0,0 +1,213 @@
+// Package maintenance schedules heavy repository housekeeping such as
+// `git gc` into each repository's quietest hour, away from active pushes.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+)
+
+var debugMaintenance = diag.Register("maintenance", "Maintenance decisions per repository")
+
+// ErrBusy is returned when a repository has an active push or maintenance run.
+var ErrBusy = errors.New("repository is busy")
+
+// ErrEncrypted is returned for repositories encrypted at rest, whose
+// objects git can't see outside of a git service invocation.
+var ErrEncrypted = errors.New("repository is encrypted at rest")
+
+const lastRunKey = "repocraft.lastMaintenance"
+
+// Scheduler runs maintenance on every repository under RepoRoot once per
+// Every, during the hour of day with the least activity according to Stats.
+// Runs are skipped while a push to the repository is active. Repositories
+// under legal hold get git gc without pruning objects or expiring reflogs,
+// whatever Args say.
+type Scheduler struct {
+	RepoRoot string
+	// Stats supplies activity by hour; without it every repository is
+	// maintained at midnight UTC.
+	Stats *repostats.Store
+	Locks *repolock.Manager
+	// Every is the minimum time between runs; defaults to 24 hours.
+	Every time.Duration
+	// CheckInterval is how often repositories are considered; defaults to
+	// fifteen minutes.
+	CheckInterval time.Duration
+	// Args are passed to git; defaults to "gc --quiet".
+	Args    []string
+	GitPath string
+}
+
+// Run considers every repository each CheckInterval until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = 15 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := s.runDue(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				log.Printf("maintenance: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) runDue(ctx context.Context, now time.Time) error {
+	root := filepath.Clean(s.RepoRoot)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !service.IsRepository(path) {
+			return nil
+		}
+		if atrest.IsEncrypted(path) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if s.due(path, filepath.ToSlash(rel), now) {
+			switch err := s.run(ctx, path, false); {
+			case errors.Is(err, ErrBusy):
+				log.Printf("maintenance: %s busy, retrying later", rel)
+			case err != nil:
+				log.Printf("maintenance: %s: %v", rel, err)
+			}
+		}
+		return filepath.SkipDir
+	})
+}
+
+// due reports whether repoPath is inside its quiet hour and was not
+// maintained within the last Every.
+func (s *Scheduler) due(repoPath, repoName string, now time.Time) bool {
+	quiet := 0
+	if s.Stats != nil {
+		if st, ok := s.Stats.Get(repoName); ok {
+			quiet = st.QuietHour()
+		}
+	}
+	if now.UTC().Hour() != quiet {
+		debugMaintenance.Printf("%s: waiting for its quiet hour %02d:00 UTC", repoName, quiet)
+		return false
+	}
+	every := s.Every
+	if every <= 0 {
+		every = 24 * time.Hour
+	}
+	// Leave room for the run drifting within the one-hour window.
+	last := s.lastRun(repoPath)
+	if now.Sub(last) < every-time.Hour {
+		debugMaintenance.Printf("%s: maintained at %s", repoName, last.Format(time.RFC3339))
+		return false
+	}
+	debugMaintenance.Printf("%s: due", repoName)
+	return true
+}
+
+// Trigger starts maintenance of repoPath in the background now, regardless
+// of its window. Without force it fails with ErrBusy while a push is active.
+func (s *Scheduler) Trigger(repoPath string, force bool) error {
+	done, ok := s.Locks.TryMaintenance(repoPath, force)
+	if !ok {
+		return ErrBusy
+	}
+	go func() {
+		defer done()
+		if err := s.gc(context.Background(), repoPath); err != nil {
+			log.Printf("maintenance: %s: %v", repoPath, err)
+		}
+	}()
+	return nil
+}
+
+func (s *Scheduler) run(ctx context.Context, repoPath string, force bool) error {
+	if atrest.IsEncrypted(repoPath) {
+		return ErrEncrypted
+	}
+	done, ok := s.Locks.TryMaintenance(repoPath, force)
+	if !ok {
+		return ErrBusy
+	}
+	defer done()
+	return s.gc(ctx, repoPath)
+}
+
+func (s *Scheduler) gc(ctx context.Context, repoPath string) error {
+	bin := s.git()
+	args := s.Args
+	global := []string{"-C", repoPath}
+	held := !service.ReadLegalHold(repoPath).IsZero()
+	if len(args) == 0 || held {
+		args = []string{"gc", "--quiet"}
+	}
+	if held {
+		for _, kv := range service.LegalHoldGitConfig() {
+			global = append(global, "-c", kv[0]+"="+kv[1])
+		}
+	}
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, bin, append(global, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("maintenance: %s done in %s", repoPath, time.Since(start).Round(time.Millisecond))
+
+	set := exec.Command(bin, "config", "--file", filepath.Join(repoPath, "config"), lastRunKey, strconv.FormatInt(start.Unix(), 10))
+	if out, err := set.CombinedOutput(); err != nil {
+		return fmt.Errorf("git config %s: %v: %s", lastRunKey, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// lastRun returns when repoPath was last maintained, or the zero time.
+func (s *Scheduler) lastRun(repoPath string) time.Time {
+	out, err := exec.Command(s.git(), "config", "--file", filepath.Join(repoPath, "config"), "--get", lastRunKey).Output()
+	if err != nil {
+		return time.Time{}
+	}
+	unix, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
+
+func (s *Scheduler) git() string {
+	if s.GitPath != "" {
+		return s.GitPath
+	}
+	return "git"
+}
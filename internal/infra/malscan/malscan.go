@@ -0,0 +1,254 @@
+// Package malscan has the blobs pushes add scanned for malware by clamd or
+// an ICAP server while they are still in quarantine, refusing or flagging
+// pushes with findings.
+package malscan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repomatch"
+)
+
+// Actions on pushes with findings.
+const (
+	// Block refuses the push, as well as pushes that couldn't be scanned.
+	Block = "block"
+	// Flag lets the push through, recording the findings in the log and
+	// the event log; pushes that couldn't be scanned go through too.
+	Flag = "flag"
+	// Off doesn't scan.
+	Off = "off"
+)
+
+// maxFindings bounds the findings listed in the error.
+const maxFindings = 20
+
+// Policy is a service.PushCheck scanning the blobs pushes add, read from a
+// JSON file:
+//
+//	{"scanner": "clamd://127.0.0.1:3310", "min_size": 0,
+//	 "repos": {"*/*": "block", "sandbox/*": "flag", "mirrors/*": "off"}}
+//
+// Blobs already in the repository aren't scanned again.
+type Policy struct {
+	// Scanner is the address of the scanner, see ParseScanner.
+	Scanner string `json:"scanner"`
+	// MinSize is the size in bytes under which blobs aren't scanned.
+	MinSize int64 `json:"min_size,omitempty"`
+	// Repos maps path.Match patterns such as "team/*" to the action of
+	// matching repositories; the longest matching pattern wins.
+	// Repositories no pattern matches aren't scanned.
+	Repos map[string]string `json:"repos"`
+
+	// Events, if set, records flagged pushes.
+	Events *events.Log `json:"-"`
+
+	scanner Scanner
+}
+
+// Load reads a policy from a JSON file.
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read malware policy: %w", err)
+	}
+	p := &Policy{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("parse malware policy %s: %w", file, err)
+	}
+	if err := p.Init(); err != nil {
+		return nil, fmt.Errorf("malware policy %s: %w", file, err)
+	}
+	return p, nil
+}
+
+// Init checks the policy and sets up its scanner.
+func (p *Policy) Init() error {
+	for pattern, action := range p.Repos {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+		if action != Block && action != Flag && action != Off {
+			return fmt.Errorf("%s: invalid action %q, want block, flag or off", pattern, action)
+		}
+	}
+	if p.MinSize < 0 {
+		return fmt.Errorf("invalid min_size %d", p.MinSize)
+	}
+	var err error
+	p.scanner, err = ParseScanner(p.Scanner)
+	return err
+}
+
+// For returns the action for pushes to repo.
+func (p *Policy) For(repo string) string {
+	if p == nil {
+		return Off
+	}
+	if action, ok := repomatch.Best(p.Repos, repo); ok {
+		return action
+	}
+	return Off
+}
+
+// CheckPush scans the blobs of at least MinSize bytes the push adds and,
+// depending on the repository's action, declines it listing the findings
+// or lets it through and records them.
+func (p *Policy) CheckPush(ctx context.Context, req service.ServiceRequest, env []string, updates []service.PushCommand) error {
+	action := p.For(req.RepoName)
+	if action == Off {
+		return nil
+	}
+	findings, err := p.scan(ctx, req.RepoPath, env, updates)
+	if err != nil {
+		if action == Flag {
+			log.Printf("malscan: %s: push by %s not scanned: %v", req.RepoName, req.Identity, err)
+			return nil
+		}
+		log.Printf("malscan: %s: %v", req.RepoName, err)
+		return errcode.New(errcode.Unavailable, "the malware scanner is unavailable, try again later")
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+	if action == Flag {
+		log.Printf("malscan: %s: flagged push by %s: %s", req.RepoName, req.Identity, strings.Join(findings, "; "))
+		if p.Events != nil {
+			ev := events.Event{Type: events.MalwareFlagged, Time: time.Now(), Repo: req.RepoName, Actor: req.Identity, Findings: findings}
+			for _, u := range updates {
+				ev.Updates = append(ev.Updates, events.Update{Ref: u.Ref, Old: u.Old, New: u.New})
+			}
+			p.Events.Record(ev)
+		}
+		return nil
+	}
+	log.Printf("malscan: %s: refused push by %s: %s", req.RepoName, req.Identity, strings.Join(findings, "; "))
+	listed := findings
+	if len(listed) > maxFindings {
+		listed = append(listed[:maxFindings:maxFindings], fmt.Sprintf("and %d more", len(findings)-maxFindings))
+	}
+	return errcode.Errorf(errcode.AccessDenied, "the malware scanner refused this push:\n%s", strings.Join(listed, "\n"))
+}
+
+// scan returns the findings in the new blobs of updates, as "path (id12):
+// name".
+func (p *Policy) scan(ctx context.Context, repoPath string, env []string, updates []service.PushCommand) ([]string, error) {
+	blobs, err := newBlobs(ctx, repoPath, env, updates, p.MinSize)
+	if err != nil {
+		return nil, err
+	}
+	var findings []string
+	for _, b := range blobs {
+		found, err := p.scanBlob(ctx, repoPath, env, b)
+		if err != nil {
+			return nil, fmt.Errorf("scan %s: %w", b.path, err)
+		}
+		if found != "" {
+			findings = append(findings, fmt.Sprintf("%s (%.12s): %s", b.path, b.id, found))
+		}
+	}
+	return findings, nil
+}
+
+// scanBlob streams b from git to the scanner.
+func (p *Policy) scanBlob(ctx context.Context, repoPath string, env []string, b blob) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "blob", b.id)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	found, err := p.scanner.Scan(ctx, path.Base(b.path), out)
+	if err != nil {
+		cancel()
+		cmd.Wait()
+		return "", err
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("git cat-file: %w", err)
+	}
+	return found, nil
+}
+
+// blob is a blob a push adds, with the first path it was seen at.
+type blob struct {
+	id, path string
+}
+
+// newBlobs returns the blobs of at least minSize bytes reachable from the
+// updated refs that no ref has yet. env gives access to the pushed objects.
+func newBlobs(ctx context.Context, repoPath string, env []string, updates []service.PushCommand, minSize int64) ([]blob, error) {
+	args := []string{"-C", repoPath, "rev-list", "--objects"}
+	for _, u := range updates {
+		if !u.IsDelete() {
+			args = append(args, u.New)
+		}
+	}
+	if len(args) == 4 {
+		return nil, nil
+	}
+	args = append(args, "--not", "--all")
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-list: %w", err)
+	}
+	paths := make(map[string]string)
+	var ids bytes.Buffer
+	for _, line := range strings.Split(string(out), "\n") {
+		// Commits come without a path; trees and blobs with theirs, the
+		// root trees with an empty one.
+		id, name, ok := strings.Cut(line, " ")
+		if !ok || name == "" {
+			continue
+		}
+		if _, seen := paths[id]; !seen {
+			paths[id] = name
+			fmt.Fprintln(&ids, id)
+		}
+	}
+	if ids.Len() == 0 {
+		return nil, nil
+	}
+	cmd = exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = &ids
+	out, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file: %w", err)
+	}
+	var blobs []blob
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		if size, err := strconv.ParseInt(fields[2], 10, 64); err == nil && size >= minSize {
+			blobs = append(blobs, blob{id: fields[0], path: paths[fields[0]]})
+		}
+	}
+	return blobs, nil
+}
@@ -0,0 +1,203 @@
+package malscan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scanner scans content for malware.
+type Scanner interface {
+	// Scan reads r to its end and returns the name of what it found, or
+	// "" if r is clean.
+	Scan(ctx context.Context, name string, r io.Reader) (string, error)
+}
+
+const (
+	// scanTimeout bounds the scan of one blob.
+	scanTimeout = 5 * time.Minute
+	// chunkSize is the size of the chunks content is streamed in.
+	chunkSize = 64 << 10
+)
+
+// ParseScanner returns the scanner at addr: "clamd://host:3310" or
+// "clamd:///run/clamav/clamd.ctl" for clamd over TCP or a unix socket, or
+// "icap://host:1344/avscan" for an ICAP server's RESPMOD service.
+func ParseScanner(addr string) (Scanner, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scanner %q", addr)
+	}
+	switch {
+	case u.Scheme == "clamd" && u.Host != "":
+		return &Clamd{Network: "tcp", Addr: u.Host}, nil
+	case u.Scheme == "clamd" && u.Path != "":
+		return &Clamd{Network: "unix", Addr: u.Path}, nil
+	case u.Scheme == "icap" && u.Host != "":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1344")
+		}
+		return &ICAP{URL: u}, nil
+	}
+	return nil, fmt.Errorf("invalid scanner %q: want clamd://host:port, clamd:///socket or icap://host:port/service", addr)
+}
+
+// Clamd streams content to clamd with its INSTREAM command.
+type Clamd struct {
+	// Network and Addr are where clamd listens, e.g. "tcp" and
+	// "127.0.0.1:3310", or "unix" and "/run/clamav/clamd.ctl".
+	Network, Addr string
+}
+
+// Scan implements Scanner.
+func (c *Clamd) Scan(ctx context.Context, name string, r io.Reader) (string, error) {
+	conn, err := dial(ctx, c.Network, c.Addr)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	w := bufio.NewWriterSize(conn, chunkSize+4)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, chunkSize)
+	var size [4]byte
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				// clamd closes the connection once the stream is over
+				// its StreamMaxLength; its reply says so.
+				break
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	w.Flush()
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// ICAP sends content to an ICAP server (RFC 3507) as the body of an HTTP
+// response to modify. The server answering 204 No Content means it is
+// clean; anything it blocks or rewrites is a finding, named by the
+// X-Infection-Found, X-Virus-ID or X-Violations-Found header it returns.
+type ICAP struct {
+	// URL is the RESPMOD service, e.g. icap://127.0.0.1:1344/avscan.
+	URL *url.URL
+}
+
+// Scan implements Scanner.
+func (c *ICAP) Scan(ctx context.Context, name string, r io.Reader) (string, error) {
+	conn, err := dial(ctx, "tcp", c.URL.Host)
+	if err != nil {
+		return "", fmt.Errorf("icap: %w", err)
+	}
+	defer conn.Close()
+	reqHdr := fmt.Sprintf("GET /%s HTTP/1.1\r\nHost: repocraft\r\n\r\n", url.PathEscape(name))
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+	w := bufio.NewWriterSize(conn, chunkSize+16)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n%s%s",
+		c.URL.String(), c.URL.Host, len(reqHdr), len(reqHdr)+len(resHdr), reqHdr, resHdr)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("icap: %w", err)
+	}
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("icap: %w", err)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("icap: %w", err)
+	}
+	proto, rest, _ := strings.Cut(status, " ")
+	codeText, _, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeText)
+	if !strings.HasPrefix(proto, "ICAP/") || err != nil {
+		return "", fmt.Errorf("icap: invalid status line %q", status)
+	}
+	switch {
+	case code == 204:
+		return "", nil
+	case code == 200:
+		return icapFinding(header), nil
+	}
+	return "", fmt.Errorf("icap: %s", rest)
+}
+
+// icapFinding names what an ICAP server found from the headers servers
+// commonly report it in.
+func icapFinding(header textproto.MIMEHeader) string {
+	// X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;
+	for _, field := range strings.Split(header.Get("X-Infection-Found"), ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(field), "="); ok && k == "Threat" && v != "" {
+			return v
+		}
+	}
+	if v := header.Get("X-Virus-ID"); v != "" {
+		return v
+	}
+	if v := header.Get("X-Violations-Found"); v != "" {
+		// A count followed by lines describing each violation.
+		if lines := strings.Fields(v); len(lines) > 1 {
+			return strings.Join(lines[1:], " ")
+		}
+	}
+	return "content blocked by the ICAP server"
+}
+
+// dial connects to addr with a deadline of scanTimeout for the whole scan.
+func dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(scanTimeout))
+	return conn, nil
+}
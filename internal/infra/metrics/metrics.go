@@ -0,0 +1,219 @@
+// Package metrics counts git traffic and exposes it in the Prometheus text
+// format: requests by service, their duration, bytes in and out, active
+// sessions and authentication failures.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram: from ref advertisements to clones of large repositories.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Git counts the traffic of one git server. Its methods are safe for
+// concurrent use and do nothing on a nil *Git, so servers call them
+// unconditionally.
+type Git struct {
+	// Transport labels every series, e.g. "http" or "ssh".
+	Transport string
+
+	mu           sync.Mutex
+	requests     map[[2]string]uint64 // by service and status
+	durations    map[string]*histogram
+	bytesIn      map[string]uint64
+	bytesOut     map[string]uint64
+	active       map[string]int64
+	authFailures map[string]uint64 // by reason
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Begin counts a session of svc as active until the returned function is
+// called.
+func (g *Git) Begin(svc service.Service) func() {
+	if g == nil {
+		return func() {}
+	}
+	name := svc.Command()
+	g.mu.Lock()
+	g.init()
+	g.active[name]++
+	g.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.active[name]--
+			g.mu.Unlock()
+		})
+	}
+}
+
+// Observe counts a finished git invocation; it has the signature of the
+// servers' OnFinish.
+func (g *Git) Observe(res service.Result) {
+	if g == nil {
+		return
+	}
+	name := res.Request.Service.Command()
+	status := "ok"
+	if res.Err != nil || res.ExitCode != 0 {
+		status = "error"
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	g.requests[[2]string{name, status}]++
+	h := g.durations[name]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		g.durations[name] = h
+	}
+	seconds := res.Duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+	g.bytesIn[name] += uint64(max(res.BytesIn, 0))
+	g.bytesOut[name] += uint64(max(res.BytesOut, 0))
+}
+
+// AuthFailure counts a client refused for reason, e.g. "unauthenticated"
+// or "denied".
+func (g *Git) AuthFailure(reason string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	g.authFailures[reason]++
+}
+
+// init allocates the maps; g.mu must be held.
+func (g *Git) init() {
+	if g.requests != nil {
+		return
+	}
+	g.requests = make(map[[2]string]uint64)
+	g.durations = make(map[string]*histogram)
+	g.bytesIn = make(map[string]uint64)
+	g.bytesOut = make(map[string]uint64)
+	g.active = make(map[string]int64)
+	g.authFailures = make(map[string]uint64)
+}
+
+// metricFamily is the output of one metric across servers.
+type metricFamily struct {
+	name, kind, help string
+	lines            []string
+}
+
+// Handler serves the metrics of servers in the Prometheus text format.
+func Handler(servers ...*Git) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w, servers...)
+	})
+}
+
+// Write writes the metrics of servers in the Prometheus text format.
+func Write(w io.Writer, servers ...*Git) error {
+	families := []*metricFamily{
+		{name: "repocraft_git_requests_total", kind: "counter", help: "Git invocations finished, by service and status."},
+		{name: "repocraft_git_request_duration_seconds", kind: "histogram", help: "Duration of git invocations."},
+		{name: "repocraft_git_received_bytes_total", kind: "counter", help: "Bytes read from clients by git invocations."},
+		{name: "repocraft_git_sent_bytes_total", kind: "counter", help: "Bytes written to clients by git invocations."},
+		{name: "repocraft_git_active_sessions", kind: "gauge", help: "Git sessions in progress."},
+		{name: "repocraft_git_auth_failures_total", kind: "counter", help: "Clients refused for missing or wrong credentials or lacking access, by reason."},
+	}
+	for _, g := range servers {
+		if g != nil {
+			g.collect(families)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, line := range f.lines {
+			fmt.Fprintln(bw, line)
+		}
+	}
+	return bw.Flush()
+}
+
+// collect appends the series of g to families, in the order Write
+// declares them.
+func (g *Git) collect(families []*metricFamily) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	requests, durations, received, sent, active, auth := families[0], families[1], families[2], families[3], families[4], families[5]
+	transport := "transport=" + quote(g.Transport)
+
+	keys := make([][2]string, 0, len(g.requests))
+	for k := range g.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i][0]+" "+keys[i][1] < keys[j][0]+" "+keys[j][1] })
+	for _, k := range keys {
+		requests.lines = append(requests.lines, fmt.Sprintf("%s{%s,service=%s,status=%s} %d", requests.name, transport, quote(k[0]), quote(k[1]), g.requests[k]))
+	}
+	for _, svc := range sortedKeys(g.durations) {
+		h := g.durations[svc]
+		labels := transport + ",service=" + quote(svc)
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			durations.lines = append(durations.lines, fmt.Sprintf("%s_bucket{%s,le=%s} %d", durations.name, labels, quote(strconv.FormatFloat(bound, 'g', -1, 64)), cumulative))
+		}
+		durations.lines = append(durations.lines,
+			fmt.Sprintf("%s_bucket{%s,le=\"+Inf\"} %d", durations.name, labels, h.count),
+			fmt.Sprintf("%s_sum{%s} %s", durations.name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64)),
+			fmt.Sprintf("%s_count{%s} %d", durations.name, labels, h.count))
+	}
+	for _, svc := range sortedKeys(g.bytesIn) {
+		received.lines = append(received.lines, fmt.Sprintf("%s{%s,service=%s} %d", received.name, transport, quote(svc), g.bytesIn[svc]))
+	}
+	for _, svc := range sortedKeys(g.bytesOut) {
+		sent.lines = append(sent.lines, fmt.Sprintf("%s{%s,service=%s} %d", sent.name, transport, quote(svc), g.bytesOut[svc]))
+	}
+	for _, svc := range sortedKeys(g.active) {
+		active.lines = append(active.lines, fmt.Sprintf("%s{%s,service=%s} %d", active.name, transport, quote(svc), g.active[svc]))
+	}
+	for _, reason := range sortedKeys(g.authFailures) {
+		auth.lines = append(auth.lines, fmt.Sprintf("%s{%s,reason=%s} %d", auth.name, transport, quote(reason), g.authFailures[reason]))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quote formats a label value.
+func quote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
@@ -0,0 +1,205 @@
+package provision
+
+import (
+	"context"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	xssh "golang.org/x/crypto/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Index answers access questions from the provisioned settings of the
+// repositories under RepoRoot: which are private, themselves or through a
+// namespace, which deploy keys may use them and where they are canonically
+// served. It is rebuilt every Interval and after each reconcile, so
+// daemons that don't reconcile themselves pick up changes too.
+type Index struct {
+	RepoRoot string
+	// Interval between rescans; defaults to one minute.
+	Interval time.Duration
+	GitPath  string
+
+	mu         sync.RWMutex
+	private    map[string]bool    // repositories and namespaces
+	deployKeys map[string][]grant // by key fingerprint
+	canonical  map[string]string  // canonical base URLs by repository
+}
+
+type grant struct {
+	repo     string
+	title    string
+	readOnly bool
+}
+
+// DeployKeyGrant is a repository a deploy key is valid for.
+type DeployKeyGrant struct {
+	Repo     string
+	Title    string
+	ReadOnly bool
+}
+
+// Run rescans on start and then every Interval until ctx is cancelled.
+func (x *Index) Run(ctx context.Context) {
+	interval := x.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := x.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("provision index: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh rescans the repositories.
+func (x *Index) Refresh(ctx context.Context) error {
+	if x == nil {
+		return nil
+	}
+	git := x.GitPath
+	if git == "" {
+		git = "git"
+	}
+	private := make(map[string]bool)
+	deployKeys := make(map[string][]grant)
+	canonical := make(map[string]string)
+	err := walk(ctx, x.RepoRoot, func(dir, rel string) error {
+		st, _, err := readState(ctx, git, dir, rel)
+		if err != nil {
+			log.Printf("provision index: %v", err)
+			return nil
+		}
+		if st.Visibility == Private {
+			private[rel] = true
+		}
+		if st.CanonicalURL != "" {
+			canonical[rel] = st.CanonicalURL
+		}
+		for _, k := range st.DeployKeys {
+			pub, _, _, _, err := xssh.ParseAuthorizedKey([]byte(k.Key))
+			if err != nil {
+				log.Printf("provision index: %s: deploy key %q: %v", rel, k.Title, err)
+				continue
+			}
+			fp := xssh.FingerprintSHA256(pub)
+			deployKeys[fp] = append(deployKeys[fp], grant{repo: rel, title: k.Title, readOnly: k.ReadOnly})
+		}
+		return nil
+	}, func(dir, rel string) error {
+		if readNamespace(ctx, git, dir) == Private {
+			private[rel] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.private, x.deployKeys, x.canonical = private, deployKeys, canonical
+	x.mu.Unlock()
+	return nil
+}
+
+// Private reports whether the repository at the given path relative to
+// RepoRoot is private, or lies in a private namespace. Wikis are private
+// when their project is.
+func (x *Index) Private(repo string) bool {
+	if x == nil {
+		return false
+	}
+	repo = strings.Trim(repo, "/")
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if base, ok := service.WikiOf(repo); ok && (x.privateLocked(base+".git") || x.privateLocked(base)) {
+		return true
+	}
+	return x.privateLocked(repo)
+}
+
+func (x *Index) privateLocked(repo string) bool {
+	for p := repo; p != "." && p != ""; p = path.Dir(p) {
+		if x.private[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDeployKey reports whether the key with the given SHA256 fingerprint is
+// a deploy key of any repository.
+func (x *Index) IsDeployKey(fingerprint string) bool {
+	if x == nil {
+		return false
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.deployKeys[fingerprint]) > 0
+}
+
+// DeployKey reports whether the key with the given fingerprint is a deploy
+// key of repo, and whether it is limited to fetches. A project's deploy
+// keys are valid for its wiki too.
+func (x *Index) DeployKey(fingerprint, repo string) (readOnly, ok bool) {
+	if x == nil {
+		return false, false
+	}
+	repo = strings.Trim(repo, "/")
+	base, wiki := service.WikiOf(repo)
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, g := range x.deployKeys[fingerprint] {
+		if g.repo == repo || wiki && (g.repo == base+".git" || g.repo == base) {
+			return g.readOnly, true
+		}
+	}
+	return false, false
+}
+
+// DeployKeyGrants returns the repositories the key with the given
+// fingerprint is a deploy key of, sorted by path.
+func (x *Index) DeployKeyGrants(fingerprint string) []DeployKeyGrant {
+	if x == nil {
+		return nil
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var grants []DeployKeyGrant
+	for _, g := range x.deployKeys[fingerprint] {
+		grants = append(grants, DeployKeyGrant{Repo: g.repo, Title: g.title, ReadOnly: g.readOnly})
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Repo < grants[j].Repo })
+	return grants
+}
+
+// CanonicalURL returns the canonical base URL configured for repo, or for
+// the project of a wiki, or "" if it has none.
+func (x *Index) CanonicalURL(repo string) string {
+	if x == nil {
+		return ""
+	}
+	repo = strings.Trim(repo, "/")
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if base, ok := service.WikiOf(repo); ok {
+		if u := x.canonical[base+".git"]; u != "" {
+			return u
+		}
+		if u := x.canonical[base]; u != "" {
+			return u
+		}
+	}
+	return x.canonical[repo]
+}
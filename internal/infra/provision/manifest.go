@@ -0,0 +1,188 @@
+// Package provision converges the repositories under a root to a declarative
+// manifest: which repositories exist, their visibility, push protection,
+// deploy keys and mirror source. The provisioned settings live in each
+// repository's config, so the repositories stay the source of truth for the
+// servers and drift shows up in the next plan. Namespaces can be made
+// private as a whole; their settings live in a .repocraft file in the
+// namespace directory.
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	xssh "golang.org/x/crypto/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Visibility values.
+const (
+	Public  = "public"
+	Private = "private"
+)
+
+// Manifest is the desired state of the repositories it lists. Repositories
+// not listed are left alone unless Reconciler.Prune is set.
+type Manifest struct {
+	Namespaces []Namespace `json:"namespaces,omitempty"`
+	Repos      []Repo      `json:"repos"`
+}
+
+// Namespace is the desired state of a namespace such as "group/subgroup".
+// The repositories below it, at any depth, inherit its settings.
+type Namespace struct {
+	Path string `json:"path"`
+	// Visibility "private" makes every repository below the namespace
+	// private, whatever its own visibility.
+	Visibility string `json:"visibility,omitempty"`
+}
+
+// Repo is the desired state of one repository.
+type Repo struct {
+	// Path relative to the repository root, e.g. "team/app.git".
+	Path string `json:"path"`
+	// Visibility is "public" (the default) or "private"; private
+	// repositories are only served over HTTP with a fetch token.
+	Visibility    string      `json:"visibility,omitempty"`
+	Description   string      `json:"description,omitempty"`
+	DefaultBranch string      `json:"default_branch,omitempty"`
+	Protection    Protection  `json:"protection,omitempty"`
+	DeployKeys    []DeployKey `json:"deploy_keys,omitempty"`
+	// Mirror is the URL of a repository this one mirrors. Mirrors are
+	// cloned on creation and fetched on every reconcile.
+	Mirror string `json:"mirror,omitempty"`
+	// Archived repositories refuse pushes; mirrors are still fetched.
+	Archived bool `json:"archived,omitempty"`
+	// CanonicalURL is the base URL the repository must be cloned from over
+	// HTTP, e.g. "https://git.example.com", overriding the server's.
+	CanonicalURL string `json:"canonical_url,omitempty"`
+}
+
+// Protection maps to receive-pack's own checks, so it applies to every
+// push whichever transport it arrives on.
+type Protection struct {
+	DenyDeletes         bool `json:"deny_deletes,omitempty"`
+	DenyNonFastForwards bool `json:"deny_non_fast_forwards,omitempty"`
+}
+
+// DeployKey grants an SSH key access to a single repository.
+type DeployKey struct {
+	Title string `json:"title"`
+	// Key is an authorized_keys line, e.g. "ssh-ed25519 AAAA... ci@example".
+	Key      string `json:"key"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// Load reads a JSON manifest. YAML manifests can be converted first, e.g.
+// with `yq -o json`.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	var m Manifest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", path, err)
+	}
+	if err := m.normalize(); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// normalize cleans paths and keys and checks the manifest for mistakes.
+func (m *Manifest) normalize() error {
+	seen := make(map[string]bool)
+	for i := range m.Namespaces {
+		ns := &m.Namespaces[i]
+		path, err := cleanPath(ns.Path)
+		if err != nil {
+			return err
+		}
+		if seen[path] {
+			return fmt.Errorf("namespace %s is listed twice", path)
+		}
+		seen[path] = true
+		ns.Path = path
+		switch ns.Visibility {
+		case "":
+			ns.Visibility = Public
+		case Public, Private:
+		default:
+			return fmt.Errorf("%s: unknown visibility %q", path, ns.Visibility)
+		}
+	}
+	for i := range m.Repos {
+		r := &m.Repos[i]
+		path, err := cleanPath(r.Path)
+		if err != nil {
+			return err
+		}
+		if seen[path] {
+			return fmt.Errorf("repository %s is listed twice or as a namespace", path)
+		}
+		seen[path] = true
+		r.Path = path
+
+		switch r.Visibility {
+		case "":
+			r.Visibility = Public
+		case Public, Private:
+		default:
+			return fmt.Errorf("%s: unknown visibility %q", path, r.Visibility)
+		}
+		if strings.ContainsAny(r.DefaultBranch, " ~^:?*[\\") || strings.HasPrefix(r.DefaultBranch, "-") {
+			return fmt.Errorf("%s: invalid default branch %q", path, r.DefaultBranch)
+		}
+		if r.CanonicalURL != "" {
+			u, err := service.ParseCanonicalURL(r.CanonicalURL)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			r.CanonicalURL = u.String()
+		}
+		titles := make(map[string]bool)
+		for j := range r.DeployKeys {
+			k := &r.DeployKeys[j]
+			if k.Title == "" || strings.ContainsAny(k.Title, "\"\\\n") {
+				return fmt.Errorf("%s: invalid deploy key title %q", path, k.Title)
+			}
+			if titles[k.Title] {
+				return fmt.Errorf("%s: deploy key %q is listed twice", path, k.Title)
+			}
+			titles[k.Title] = true
+			pub, _, _, _, err := xssh.ParseAuthorizedKey([]byte(k.Key))
+			if err != nil {
+				return fmt.Errorf("%s: deploy key %q: %w", path, k.Title, err)
+			}
+			k.Key = strings.TrimSpace(string(xssh.MarshalAuthorizedKey(pub)))
+		}
+	}
+	return nil
+}
+
+var errInvalidPath = errors.New("invalid repository path")
+
+// cleanPath returns the slash-separated form of a repository path relative
+// to the root, refusing paths that escape it or name hidden directories.
+func cleanPath(raw string) (string, error) {
+	rel := filepath.ToSlash(filepath.Clean("/" + strings.TrimSpace(raw)))
+	rel = strings.TrimPrefix(rel, "/")
+	if rel == "" || rel == "." {
+		return "", fmt.Errorf("%w: %q", errInvalidPath, raw)
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("%w: %q", errInvalidPath, raw)
+		}
+	}
+	return rel, nil
+}
@@ -0,0 +1,430 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xssh "golang.org/x/crypto/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Change actions.
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Change is one difference between the manifest and the repositories.
+type Change struct {
+	Repo   string `json:"repo"`
+	Action string `json:"action"`
+	// Field, From and To describe updates, e.g. "visibility" from "public"
+	// to "private".
+	Field string `json:"field,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+func (c Change) String() string {
+	switch c.Action {
+	case ActionCreate:
+		return "+ " + c.Repo
+	case ActionDelete:
+		return "- " + c.Repo
+	}
+	return fmt.Sprintf("~ %s %s: %q -> %q", c.Repo, c.Field, c.From, c.To)
+}
+
+// Reconciler converges the repositories under RepoRoot to the manifest at
+// Manifest, on demand or every Interval.
+type Reconciler struct {
+	RepoRoot string
+	// Manifest is the path of the JSON manifest; it is read on every run.
+	Manifest string
+	// Prune deletes repositories created from an earlier manifest that
+	// are no longer listed. Without it they are reported but kept.
+	Prune bool
+	// Interval between scheduled runs; defaults to ten minutes.
+	Interval time.Duration
+	// Index, if set, is refreshed after every applied run.
+	Index *Index
+	// Events, if set, gets an event for each repository created or
+	// deleted.
+	Events  *events.Log
+	GitPath string
+
+	mu sync.Mutex
+}
+
+// Run applies the manifest on start and then every Interval until ctx is
+// cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changes, err := r.Apply(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("provision: %v", err)
+		}
+		for _, c := range changes {
+			log.Printf("provision: %s", c)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Plan returns the changes Apply would make, without making them.
+func (r *Reconciler) Plan(ctx context.Context) ([]Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes, _, err := r.plan(ctx)
+	return changes, err
+}
+
+// Apply converges the repositories to the manifest and returns the changes
+// made. Mirrors are fetched afterwards.
+func (r *Reconciler) Apply(ctx context.Context) ([]Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes, m, err := r.plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	desired := make(map[string]Repo, len(m.Repos))
+	for _, repo := range m.Repos {
+		desired[repo.Path] = repo
+	}
+
+	namespaces := make(map[string]Namespace, len(m.Namespaces))
+	for _, ns := range m.Namespaces {
+		namespaces[ns.Path+"/"] = ns
+	}
+
+	var applied []Change
+	for _, c := range changes {
+		var err error
+		if ns, ok := namespaces[c.Repo]; ok {
+			err = r.applyNamespace(ns)
+		} else {
+			err = r.apply(ctx, c, desired[c.Repo])
+		}
+		if err != nil {
+			_ = r.Index.Refresh(ctx)
+			return applied, fmt.Errorf("%s: %w", c, err)
+		}
+		applied = append(applied, c)
+	}
+	for _, repo := range m.Repos {
+		if repo.Mirror == "" {
+			continue
+		}
+		if err := r.fetchMirror(ctx, repo.Path); err != nil {
+			log.Printf("provision: fetch mirror %s: %v", repo.Path, err)
+		}
+	}
+	if err := r.Index.Refresh(ctx); err != nil {
+		log.Printf("provision: refresh index: %v", err)
+	}
+	return applied, nil
+}
+
+func (r *Reconciler) plan(ctx context.Context) ([]Change, *Manifest, error) {
+	m, err := Load(r.Manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	listed := make(map[string]bool, len(m.Repos))
+	var changes []Change
+	for _, want := range m.Namespaces {
+		dir := r.dir(want.Path)
+		if service.IsRepository(dir) {
+			return nil, nil, fmt.Errorf("namespace %s is a repository", want.Path)
+		}
+		if have := readNamespace(ctx, r.git(), dir); have != want.Visibility {
+			changes = append(changes, Change{Repo: want.Path + "/", Action: ActionUpdate, Field: "visibility", From: have, To: want.Visibility})
+		}
+	}
+	for _, want := range m.Repos {
+		listed[want.Path] = true
+		dir := r.dir(want.Path)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			changes = append(changes, Change{Repo: want.Path, Action: ActionCreate})
+			continue
+		}
+		if !service.IsRepository(dir) {
+			return nil, nil, fmt.Errorf("%s exists but is not a bare repository", want.Path)
+		}
+		have, managed, err := readState(ctx, r.git(), dir, want.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !managed {
+			changes = append(changes, Change{Repo: want.Path, Action: ActionUpdate, Field: "managed", From: "false", To: "true"})
+		}
+		changes = append(changes, diff(have, want)...)
+	}
+
+	err = walkRepos(ctx, r.RepoRoot, func(dir, rel string) error {
+		if listed[rel] {
+			return nil
+		}
+		_, managed, err := readState(ctx, r.git(), dir, rel)
+		if err != nil || !managed {
+			return err
+		}
+		if r.Prune {
+			changes = append(changes, Change{Repo: rel, Action: ActionDelete})
+		} else {
+			log.Printf("provision: %s is no longer in the manifest, keeping it as pruning is off", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return changes, m, nil
+}
+
+// diff lists the settings of have that differ from want.
+func diff(have, want Repo) []Change {
+	var changes []Change
+	add := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, Change{Repo: want.Path, Action: ActionUpdate, Field: field, From: from, To: to})
+		}
+	}
+	add("visibility", have.Visibility, want.Visibility)
+	add("description", have.Description, want.Description)
+	if want.DefaultBranch != "" {
+		add("default_branch", have.DefaultBranch, want.DefaultBranch)
+	}
+	add("protection.deny_deletes", strconv.FormatBool(have.Protection.DenyDeletes), strconv.FormatBool(want.Protection.DenyDeletes))
+	add("protection.deny_non_fast_forwards", strconv.FormatBool(have.Protection.DenyNonFastForwards), strconv.FormatBool(want.Protection.DenyNonFastForwards))
+	add("mirror", have.Mirror, want.Mirror)
+	add("archived", strconv.FormatBool(have.Archived), strconv.FormatBool(want.Archived))
+	add("canonical_url", have.CanonicalURL, want.CanonicalURL)
+
+	haveKeys := make(map[string]DeployKey)
+	for _, k := range have.DeployKeys {
+		haveKeys[k.Title] = k
+	}
+	for _, k := range want.DeployKeys {
+		add("deploy_keys."+k.Title, describeKey(haveKeys[k.Title]), describeKey(k))
+		delete(haveKeys, k.Title)
+	}
+	for _, k := range have.DeployKeys {
+		if _, stale := haveKeys[k.Title]; stale {
+			add("deploy_keys."+k.Title, describeKey(k), "")
+		}
+	}
+	return changes
+}
+
+// describeKey shows a deploy key by fingerprint and access in diffs.
+func describeKey(k DeployKey) string {
+	if k.Key == "" {
+		return ""
+	}
+	pub, _, _, _, err := xssh.ParseAuthorizedKey([]byte(k.Key))
+	if err != nil {
+		return "invalid key"
+	}
+	access := "read-write"
+	if k.ReadOnly {
+		access = "read-only"
+	}
+	return xssh.FingerprintSHA256(pub) + " " + access
+}
+
+func (r *Reconciler) apply(ctx context.Context, c Change, want Repo) error {
+	dir := r.dir(c.Repo)
+	switch c.Action {
+	case ActionCreate:
+		if err := r.create(ctx, dir, want); err != nil {
+			return err
+		}
+		r.Events.Record(events.Event{Type: events.RepoCreated, Repo: c.Repo, Actor: "provision"})
+		return nil
+	case ActionDelete:
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		r.Events.Record(events.Event{Type: events.RepoDeleted, Repo: c.Repo, Actor: "provision"})
+		return nil
+	}
+
+	switch field := c.Field; {
+	case field == "managed":
+		return r.setConfig(dir, managedKey, "true")
+	case field == "visibility":
+		return r.setConfig(dir, VisibilityKey, want.Visibility)
+	case field == "description":
+		desc := want.Description
+		if desc == "" {
+			desc = defaultDescription
+		}
+		return os.WriteFile(filepath.Join(dir, "description"), []byte(desc+"\n"), 0o644)
+	case field == "default_branch":
+		return r.gitRun(ctx, dir, "symbolic-ref", "HEAD", "refs/heads/"+want.DefaultBranch)
+	case field == "protection.deny_deletes":
+		return r.setConfig(dir, denyDeletesKey, strconv.FormatBool(want.Protection.DenyDeletes))
+	case field == "protection.deny_non_fast_forwards":
+		return r.setConfig(dir, denyNonFFKey, strconv.FormatBool(want.Protection.DenyNonFastForwards))
+	case field == "mirror":
+		return r.setMirror(dir, want.Mirror)
+	case field == "archived":
+		return r.setConfig(dir, service.ArchivedKey, strconv.FormatBool(want.Archived))
+	case field == "canonical_url":
+		if want.CanonicalURL == "" {
+			return r.unsetConfig(dir, service.CanonicalKey)
+		}
+		return r.setConfig(dir, service.CanonicalKey, want.CanonicalURL)
+	case strings.HasPrefix(field, "deploy_keys."):
+		title := strings.TrimPrefix(field, "deploy_keys.")
+		for _, k := range want.DeployKeys {
+			if k.Title == title {
+				return r.setDeployKey(dir, k)
+			}
+		}
+		return r.removeSection(dir, deployKeySection+"."+title)
+	}
+	return fmt.Errorf("unknown field %q", c.Field)
+}
+
+// applyNamespace writes the settings of ns, creating its directory if
+// needed.
+func (r *Reconciler) applyNamespace(ns Namespace) error {
+	dir := r.dir(ns.Path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return r.gitRun(context.Background(), "", "config", "--file", filepath.Join(dir, namespaceConfig), VisibilityKey, ns.Visibility)
+}
+
+// create initializes a repository, cloning it from its mirror source if it
+// has one, and applies all settings of want.
+func (r *Reconciler) create(ctx context.Context, dir string, want Repo) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	// Build in a hidden directory so a failed clone leaves nothing behind
+	// for the next plan to mistake for the repository.
+	tmp := filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".provision")
+	os.RemoveAll(tmp)
+	var err error
+	if want.Mirror != "" {
+		err = r.gitRun(ctx, "", "clone", "--quiet", "--mirror", want.Mirror, tmp)
+	} else {
+		err = r.gitRun(ctx, "", "init", "--quiet", "--bare", tmp)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	have, _, err := readState(ctx, r.git(), dir, want.Path)
+	if err != nil {
+		return err
+	}
+	if err := r.setConfig(dir, managedKey, "true"); err != nil {
+		return err
+	}
+	for _, c := range diff(have, want) {
+		if err := r.apply(ctx, c, want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reconciler) setMirror(dir, url string) error {
+	if url == "" {
+		return r.removeSection(dir, mirrorRemote)
+	}
+	for _, kv := range [][2]string{
+		{mirrorRemote + ".url", url},
+		{mirrorRemote + ".fetch", "+refs/*:refs/*"},
+		{mirrorRemote + ".mirror", "true"},
+	} {
+		if err := r.setConfig(dir, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reconciler) setDeployKey(dir string, k DeployKey) error {
+	section := deployKeySection + "." + k.Title
+	if err := r.setConfig(dir, section+".key", k.Key); err != nil {
+		return err
+	}
+	return r.setConfig(dir, section+".readOnly", strconv.FormatBool(k.ReadOnly))
+}
+
+// fetchMirror updates a mirror from its source, pruning refs deleted there.
+func (r *Reconciler) fetchMirror(ctx context.Context, rel string) error {
+	return r.gitRun(ctx, r.dir(rel), "fetch", "--quiet", "--prune", "origin")
+}
+
+func (r *Reconciler) setConfig(dir, key, value string) error {
+	return r.gitRun(context.Background(), "", "config", "--file", filepath.Join(dir, "config"), key, value)
+}
+
+func (r *Reconciler) unsetConfig(dir, key string) error {
+	return r.gitRun(context.Background(), "", "config", "--file", filepath.Join(dir, "config"), "--unset-all", key)
+}
+
+func (r *Reconciler) removeSection(dir, section string) error {
+	return r.gitRun(context.Background(), "", "config", "--file", filepath.Join(dir, "config"), "--remove-section", section)
+}
+
+func (r *Reconciler) gitRun(ctx context.Context, dir string, args ...string) error {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, r.git(), args...)
+	// Mirror sources must not prompt for credentials.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		name := args[0]
+		if dir != "" {
+			name = args[2]
+		}
+		return fmt.Errorf("git %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (r *Reconciler) dir(rel string) string {
+	return filepath.Join(r.RepoRoot, filepath.FromSlash(rel))
+}
+
+func (r *Reconciler) git() string {
+	if r.GitPath != "" {
+		return r.GitPath
+	}
+	return "git"
+}
@@ -0,0 +1,161 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Config keys holding the provisioned settings. Protection and mirrors use
+// git's own keys so git enforces and fetches them.
+const (
+	managedKey = "repocraft.managed"
+	// VisibilityKey holds Public or Private; other tools creating
+	// repositories, such as importers, set it too.
+	VisibilityKey    = "repocraft.visibility"
+	denyDeletesKey   = "receive.denyDeletes"
+	denyNonFFKey     = "receive.denyNonFastForwards"
+	deployKeySection = "deploykey"
+	mirrorRemote     = "remote.origin"
+)
+
+// namespaceConfig is the git config file holding a namespace's settings,
+// in the namespace directory. Its name is hidden from repository walks.
+const namespaceConfig = ".repocraft"
+
+// defaultDescription is what git init writes to the description file.
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository."
+
+// readState returns the provisioned settings of the repository at dir and
+// whether the repository is managed by a manifest.
+func readState(ctx context.Context, git, dir, rel string) (Repo, bool, error) {
+	st := Repo{Path: rel, Visibility: Public}
+	out, err := exec.CommandContext(ctx, git, "config", "--file", filepath.Join(dir, "config"), "--null", "--list").Output()
+	if err != nil {
+		return st, false, fmt.Errorf("read config of %s: %w", rel, err)
+	}
+	managed := false
+	keys := make(map[string]*DeployKey)
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		key, value, _ := strings.Cut(string(entry), "\n")
+		section, name := splitKey(key)
+		switch {
+		case key == managedKey:
+			managed = value == "true"
+		case key == VisibilityKey:
+			st.Visibility = value
+		case key == strings.ToLower(denyDeletesKey):
+			st.Protection.DenyDeletes = value == "true"
+		case key == strings.ToLower(denyNonFFKey):
+			st.Protection.DenyNonFastForwards = value == "true"
+		case key == mirrorRemote+".url":
+			st.Mirror = value
+		case key == service.ArchivedKey:
+			st.Archived = value == "true"
+		case key == strings.ToLower(service.CanonicalKey):
+			st.CanonicalURL = value
+		case strings.HasPrefix(section, deployKeySection+"."):
+			title := strings.TrimPrefix(section, deployKeySection+".")
+			k := keys[title]
+			if k == nil {
+				k = &DeployKey{Title: title}
+				keys[title] = k
+			}
+			switch name {
+			case "key":
+				k.Key = value
+			case "readonly":
+				k.ReadOnly = value == "true"
+			}
+		}
+	}
+	for _, k := range keys {
+		st.DeployKeys = append(st.DeployKeys, *k)
+	}
+	sort.Slice(st.DeployKeys, func(i, j int) bool { return st.DeployKeys[i].Title < st.DeployKeys[j].Title })
+
+	if desc, err := os.ReadFile(filepath.Join(dir, "description")); err == nil {
+		if d := strings.TrimSpace(string(desc)); d != defaultDescription {
+			st.Description = d
+		}
+	}
+	if head, err := os.ReadFile(filepath.Join(dir, "HEAD")); err == nil {
+		st.DefaultBranch = strings.TrimPrefix(strings.TrimSpace(string(head)), "ref: refs/heads/")
+	}
+	return st, managed, nil
+}
+
+// readNamespace returns the provisioned visibility of the namespace at dir.
+func readNamespace(ctx context.Context, git, dir string) string {
+	out, err := exec.CommandContext(ctx, git, "config", "--file", filepath.Join(dir, namespaceConfig), "--get", VisibilityKey).Output()
+	if v := strings.TrimSpace(string(out)); err == nil && v != "" {
+		return v
+	}
+	return Public
+}
+
+// splitKey splits a config key into its section (with subsection) and the
+// variable name: "deploykey.ci.key" becomes "deploykey.ci" and "key".
+func splitKey(key string) (string, string) {
+	i := strings.LastIndexByte(key, '.')
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+// walkRepos calls fn for every bare repository under root with its path
+// relative to root.
+func walkRepos(ctx context.Context, root string, fn func(dir, rel string) error) error {
+	return walk(ctx, root, fn, nil)
+}
+
+// walk calls repoFn for every bare repository under root and, if set,
+// nsFn for every namespace with settings, with their paths relative to
+// root.
+func walk(ctx context.Context, root string, repoFn, nsFn func(dir, rel string) error) error {
+	root = filepath.Clean(root)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if !service.IsRepository(path) {
+			if _, err := os.Stat(filepath.Join(path, namespaceConfig)); err == nil && nsFn != nil {
+				return nsFn(path, filepath.ToSlash(rel))
+			}
+			return nil
+		}
+		if err := repoFn(path, filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+// Describe returns the provisioned settings of the repository at rel under
+// repoRoot, as they would appear in a manifest.
+func Describe(ctx context.Context, repoRoot, rel string) (Repo, error) {
+	st, _, err := readState(ctx, "git", filepath.Join(repoRoot, filepath.FromSlash(rel)), rel)
+	return st, err
+}
@@ -0,0 +1,506 @@
+// Package purge removes files from the history of repositories, e.g. to
+// honor erasure requests for personal data or to get rid of leaked secrets.
+// History is rewritten with git-filter-repo; the rewritten refs replace the
+// old ones, and the objects they no longer reach are then dropped from the
+// repository and its replicas.
+package purge
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/bundles"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/jobs"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/replication"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+)
+
+// Job states.
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// stagingPrefix keeps the rewritten history reachable in the repository
+// until its refs are switched over.
+const stagingPrefix = "refs/repocraft/purge/"
+
+// auditFile in the repository directory records every purge of it, so the
+// record moves along with transfers.
+const auditFile = "repocraft/purges.jsonl"
+
+var objectID = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// Request selects what to remove from the history of a repository.
+type Request struct {
+	Repo string `json:"repo"`
+	// Paths are files or directories, relative to the repository root, to
+	// remove from every commit.
+	Paths []string `json:"paths,omitempty"`
+	// Blobs are the IDs of file contents to remove wherever they appear.
+	Blobs []string `json:"blobs,omitempty"`
+	// Reason is recorded with the purge, e.g. a ticket number.
+	Reason string `json:"reason"`
+	// DryRun rewrites a copy of the repository and reports the refs that
+	// would change, leaving the repository itself alone.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// RefChange is a ref moved to rewritten history. New is empty for refs
+// that are deleted because nothing of their history remains.
+type RefChange struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new,omitempty"`
+}
+
+// Job is the progress of one purge.
+type Job struct {
+	ID int `json:"id"`
+	Request
+	State string `json:"state"`
+	// Step is what the job is doing while it runs.
+	Step string `json:"step,omitempty"`
+	// RewrittenCommits counts the commits that got new IDs.
+	RewrittenCommits int         `json:"rewritten_commits"`
+	Refs             []RefChange `json:"refs,omitempty"`
+	// Replicas are the replicas brought in line with the rewritten refs.
+	Replicas []replication.ReplicaStatus `json:"replicas,omitempty"`
+	Error    string                      `json:"error,omitempty"`
+	Started  time.Time                   `json:"started"`
+	Finished time.Time                   `json:"finished,omitempty"`
+}
+
+// Purger runs purge jobs on the repositories under RepoRoot. While a job
+// runs, it holds the repository's maintenance lock; pushes still go
+// through, and the job fails rather than discard refs they moved.
+type Purger struct {
+	RepoRoot string
+	GitPath  string
+	// FilterRepoPath is the git-filter-repo executable; defaults to
+	// "git-filter-repo".
+	FilterRepoPath string
+	Locks          *repolock.Manager
+	// Replicator, if set, updates the replicas after a purge.
+	Replicator *replication.Replicator
+	// Repos, if set, is told about rewritten repositories.
+	Repos *repo.Cache
+
+	jobs jobs.Registry[Job]
+}
+
+// Start purges the repository named by req in the background and returns
+// the new job. Repositories under legal hold, encrypted at rest or
+// mirroring another repository are refused, as are repositories being
+// maintained or pushed to.
+func (p *Purger) Start(req Request) (Job, error) {
+	full, err := p.check(&req)
+	if err != nil {
+		return Job{}, err
+	}
+	done, ok := p.Locks.TryMaintenance(full, false)
+	if !ok {
+		return Job{}, errcode.New(errcode.Conflict, "repository is busy; retry once pushes and maintenance are finished")
+	}
+
+	job := p.jobs.Add(func(id int) *Job {
+		return &Job{ID: id, Request: req, State: StateRunning, Started: time.Now()}
+	})
+	snapshot := job.snapshot()
+
+	log.Printf("purge %d: %s: started (dry run %t), paths %q, blobs %q, reason %q", job.ID, req.Repo, req.DryRun, req.Paths, req.Blobs, req.Reason)
+	go func() {
+		defer done()
+		p.run(context.Background(), job, full)
+	}()
+	return snapshot, nil
+}
+
+// Jobs returns the recent jobs, oldest first.
+func (p *Purger) Jobs() []Job {
+	return p.jobs.All((*Job).snapshot)
+}
+
+// Job returns the job with the given ID.
+func (p *Purger) Job(id int) (Job, bool) {
+	return p.jobs.Get(id, (*Job).snapshot)
+}
+
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Paths = append([]string(nil), j.Paths...)
+	c.Blobs = append([]string(nil), j.Blobs...)
+	c.Refs = append([]RefChange(nil), j.Refs...)
+	c.Replicas = append([]replication.ReplicaStatus(nil), j.Replicas...)
+	return c
+}
+
+func (p *Purger) step(job *Job, step string) {
+	p.jobs.Update(job, func(j *Job) { j.Step = step })
+}
+
+// check validates req, normalizing its repository path, and returns the
+// repository's directory.
+func (p *Purger) check(req *Request) (string, error) {
+	rel := path.Clean(strings.Trim(req.Repo, "/"))
+	if !strings.HasSuffix(rel, ".git") {
+		rel += ".git"
+	}
+	full := filepath.Join(p.RepoRoot, filepath.FromSlash(rel))
+	if !filepath.IsLocal(rel) || hasHiddenPart(rel) || !service.IsRepository(full) {
+		return "", errcode.Errorf(errcode.RepoNotFound, "repository %q not found", req.Repo)
+	}
+	req.Repo = rel
+
+	if len(req.Paths) == 0 && len(req.Blobs) == 0 {
+		return "", errcode.New(errcode.InvalidRequest, "no paths or blobs to purge")
+	}
+	for i, raw := range req.Paths {
+		clean := path.Clean(strings.Trim(raw, "/"))
+		if raw == "" || !filepath.IsLocal(clean) || strings.ContainsAny(raw, "\r\n") {
+			return "", errcode.Errorf(errcode.InvalidRequest, "invalid path %q", raw)
+		}
+		req.Paths[i] = clean
+	}
+	for i, id := range req.Blobs {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if !objectID.MatchString(id) {
+			return "", errcode.Errorf(errcode.InvalidRequest, "invalid blob ID %q", req.Blobs[i])
+		}
+		req.Blobs[i] = id
+	}
+	if strings.TrimSpace(req.Reason) == "" || strings.ContainsAny(req.Reason, "\r\n") {
+		return "", errcode.New(errcode.InvalidRequest, "a single-line reason is required")
+	}
+
+	if hold := service.ReadLegalHold(full); !hold.IsZero() {
+		log.Printf("legal hold: refused purge of %s", rel)
+		return "", service.ErrLegalHold
+	}
+	if atrest.IsEncrypted(full) {
+		return "", errcode.New(errcode.Conflict, "repository is encrypted at rest")
+	}
+	if url := mirrorOf(full); url != "" {
+		return "", errcode.Errorf(errcode.Conflict, "repository mirrors %s, which would bring the purged history back; purge the source, or stop mirroring first", url)
+	}
+	return full, nil
+}
+
+func (p *Purger) run(ctx context.Context, job *Job, full string) {
+	err := p.purge(ctx, job, full)
+	var done Job
+	p.jobs.Finish(job, func(j *Job) {
+		j.State, j.Step, j.Finished = StateDone, "", time.Now()
+		if err != nil {
+			j.State, j.Error = StateFailed, err.Error()
+		}
+		done = j.snapshot()
+	})
+	if err != nil {
+		log.Printf("purge %d: %s failed: %v", done.ID, done.Repo, err)
+	} else {
+		log.Printf("purge %d: %s %s: %d commits rewritten, %d refs changed", done.ID, done.Repo, done.State, done.RewrittenCommits, len(done.Refs))
+	}
+	// Failed purges are recorded too; they may have switched refs.
+	if !done.DryRun {
+		if err := recordAudit(full, done); err != nil {
+			log.Printf("purge %d: %s: record audit: %v", done.ID, done.Repo, err)
+		}
+	}
+}
+
+// purge rewrites a mirror clone next to the repository, then switches the
+// repository's refs to the rewritten history and drops everything else.
+func (p *Purger) purge(ctx context.Context, job *Job, full string) error {
+	req := job.Request
+	// A hidden sibling is skipped by everything walking the root and is
+	// on the same file system, so the clone hardlinks the objects.
+	tmp := filepath.Join(filepath.Dir(full), "."+filepath.Base(full)+".purge")
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := p.dropStaging(ctx, full); err != nil {
+		return err
+	}
+	defer p.dropStaging(ctx, full)
+
+	p.step(job, "cloning")
+	if _, err := p.git(ctx, "", "clone", "--quiet", "--mirror", full, tmp); err != nil {
+		return err
+	}
+	before, err := p.refs(ctx, tmp)
+	if err != nil {
+		return err
+	}
+
+	p.step(job, "rewriting")
+	if err := p.filterRepo(ctx, tmp, req); err != nil {
+		return err
+	}
+	rewritten, err := countRewritten(filepath.Join(tmp, "filter-repo", "commit-map"))
+	if err != nil {
+		return err
+	}
+	after, err := p.refs(ctx, tmp)
+	if err != nil {
+		return err
+	}
+	changes := diffRefs(before, after)
+	p.jobs.Update(job, func(j *Job) { j.RewrittenCommits, j.Refs = rewritten, changes })
+	if req.DryRun {
+		return nil
+	}
+
+	// Without changes, e.g. on a replica that already got the rewritten
+	// refs, unreachable copies are still dropped.
+	if len(changes) > 0 {
+		p.step(job, "updating refs")
+		if _, err := p.git(ctx, full, "-c", "gc.auto=0", "fetch", "--quiet", "--no-tags", "--no-write-fetch-head", tmp, "+refs/*:"+stagingPrefix+"*"); err != nil {
+			return err
+		}
+		if err := p.switchRefs(ctx, full, changes); err != nil {
+			return err
+		}
+		for _, c := range changes {
+			log.Printf("purge %d: %s: %s %s -> %s", job.ID, req.Repo, c.Ref, c.Old, c.New)
+		}
+		if err := p.dropStaging(ctx, full); err != nil {
+			return err
+		}
+	}
+
+	p.step(job, "expiring reflogs")
+	if _, err := p.git(ctx, full, "reflog", "expire", "--expire=now", "--expire-unreachable=now", "--all"); err != nil {
+		return err
+	}
+	p.step(job, "repacking")
+	if _, err := p.git(ctx, full, "-c", "gc.pruneExpire=now", "gc", "--quiet", "--prune=now"); err != nil {
+		return err
+	}
+	if p.Repos != nil {
+		p.Repos.Evict(full)
+	}
+	// The clone bundle still holds the old history; it is regenerated on
+	// the next refresh.
+	if err := os.Remove(bundles.Path(full)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, id := range req.Blobs {
+		if _, err := p.git(ctx, full, "cat-file", "-e", id); err == nil {
+			return fmt.Errorf("blob %s is still in the repository", id)
+		}
+	}
+
+	if p.Replicator != nil {
+		p.step(job, "repairing replicas")
+		st, err := p.Replicator.Verify(ctx, full, req.Repo, true)
+		if err != nil {
+			return fmt.Errorf("replicas: %w", err)
+		}
+		p.jobs.Update(job, func(j *Job) { j.Replicas = st.Replicas })
+		for _, r := range st.Replicas {
+			if r.Error != "" {
+				return fmt.Errorf("replica %s: %s", r.URL, r.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// filterRepo rewrites the history of the bare repository dir, dropping
+// req's paths and blobs. Replace refs would keep the old commits reachable,
+// so none are written.
+func (p *Purger) filterRepo(ctx context.Context, dir string, req Request) error {
+	args := []string{"--force", "--quiet", "--replace-refs", "delete-no-add"}
+	if len(req.Paths) > 0 {
+		args = append(args, "--invert-paths")
+		for _, path := range req.Paths {
+			args = append(args, "--path", path)
+		}
+	}
+	if len(req.Blobs) > 0 {
+		file := filepath.Join(dir, "purge-blobs")
+		if err := os.WriteFile(file, []byte(strings.Join(req.Blobs, "\n")+"\n"), 0o600); err != nil {
+			return err
+		}
+		args = append(args, "--strip-blobs-with-ids", file)
+	}
+	bin := p.FilterRepoPath
+	if bin == "" {
+		bin = "git-filter-repo"
+	}
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git filter-repo: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// switchRefs moves the refs of the repository at dir to the rewritten
+// history fetched under stagingPrefix, in one transaction that fails if a
+// push moved any of them since the clone.
+func (p *Purger) switchRefs(ctx context.Context, dir string, changes []RefChange) error {
+	var stdin strings.Builder
+	for _, c := range changes {
+		if c.New == "" {
+			fmt.Fprintf(&stdin, "delete %s %s\n", c.Ref, c.Old)
+		} else {
+			fmt.Fprintf(&stdin, "update %s %s %s\n", c.Ref, c.New, c.Old)
+		}
+	}
+	cmd := exec.CommandContext(ctx, p.gitPath(), "-C", dir, "update-ref", "--stdin")
+	cmd.Stdin = strings.NewReader(stdin.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errcode.Errorf(errcode.Conflict, "refs changed during the purge, retry: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// dropStaging deletes the staging refs of dir.
+func (p *Purger) dropStaging(ctx context.Context, dir string) error {
+	out, err := p.git(ctx, dir, "for-each-ref", "--format=delete %(refname)", stagingPrefix)
+	if err != nil || out == "" {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, p.gitPath(), "-C", dir, "update-ref", "--stdin")
+	cmd.Stdin = strings.NewReader(out + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git update-ref: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// refs returns the refs of dir by name.
+func (p *Purger) refs(ctx context.Context, dir string) (map[string]string, error) {
+	out, err := p.git(ctx, dir, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if oid, name, ok := strings.Cut(line, " "); ok {
+			refs[name] = oid
+		}
+	}
+	return refs, nil
+}
+
+// diffRefs returns the refs that differ between before and after, by name.
+func diffRefs(before, after map[string]string) []RefChange {
+	var changes []RefChange
+	for name, old := range before {
+		if after[name] != old {
+			changes = append(changes, RefChange{Ref: name, Old: old, New: after[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Ref < changes[j].Ref })
+	return changes
+}
+
+// countRewritten counts the commits git-filter-repo gave new IDs, as
+// listed in its commit map.
+func countRewritten(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("read commit map: %w", err)
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		old, new, ok := strings.Cut(sc.Text(), " ")
+		if ok && objectID.MatchString(old) && strings.TrimSpace(new) != old {
+			n++
+		}
+	}
+	return n, sc.Err()
+}
+
+// recordAudit appends job to the purge record of the repository at dir.
+func recordAudit(dir string, job Job) error {
+	file := filepath.Join(dir, filepath.FromSlash(auditFile))
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	line, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mirrorOf returns the URL of the repository dir mirrors, if any.
+func mirrorOf(dir string) string {
+	out, err := exec.Command("git", "config", "--file", filepath.Join(dir, "config"), "--get-regexp", `^remote\..*\.mirror$`).Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		if value != "true" {
+			continue
+		}
+		remote := strings.TrimSuffix(strings.TrimPrefix(key, "remote."), ".mirror")
+		url, _ := exec.Command("git", "config", "--file", filepath.Join(dir, "config"), "remote."+remote+".url").Output()
+		if u := strings.TrimSpace(string(url)); u != "" {
+			return u
+		}
+		return remote
+	}
+	return ""
+}
+
+func (p *Purger) git(ctx context.Context, dir string, args ...string) (string, error) {
+	name := args[0]
+	for i := 0; i+1 < len(args) && args[i] == "-c"; i += 2 {
+		name = args[i+2]
+	}
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	out, err := exec.CommandContext(ctx, p.gitPath(), args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (p *Purger) gitPath() string {
+	if p.GitPath != "" {
+		return p.GitPath
+	}
+	return "git"
+}
+
+func hasHiddenPart(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
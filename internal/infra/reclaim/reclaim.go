@@ -0,0 +1,270 @@
+// Package reclaim removes what is left behind under a repository root once
+// nobody uses it: repositories created but never pushed to, and owner
+// namespaces without any repositories.
+package reclaim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repolock"
+)
+
+// Removal kinds.
+const (
+	// KindEmptyRepo is a repository without refs, never pushed to.
+	KindEmptyRepo = "empty-repo"
+	// KindEmptyNamespace is a namespace directory without repositories.
+	KindEmptyNamespace = "empty-namespace"
+)
+
+// namespaceGrace keeps namespaces changed this recently, which a
+// repository may be about to be created in.
+const namespaceGrace = time.Hour
+
+// Removal is something removed, or that would be in a dry run.
+type Removal struct {
+	Time time.Time `json:"time"`
+	// Path relative to the root.
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+func (r Removal) String() string {
+	return fmt.Sprintf("%s: %s: %s", r.Path, r.Kind, r.Detail)
+}
+
+// Collector finds and removes unused repositories and namespaces under
+// RepoRoot. Repositories under legal hold, encrypted at rest, archived or
+// with a wiki are kept, and so is anything being pushed to.
+type Collector struct {
+	RepoRoot string
+	// EmptyAfter removes repositories that have no refs this long after
+	// they were created; zero keeps them.
+	EmptyAfter time.Duration
+	// Namespaces removes namespace directories holding nothing but empty
+	// directories.
+	Namespaces bool
+	// DryRun only reports what would be removed.
+	DryRun bool
+	// Interval between runs of Run; defaults to 24 hours.
+	Interval time.Duration
+	Locks    *repolock.Manager
+	// OnRemove, if set, receives every removal as it happens.
+	OnRemove func(Removal)
+	GitPath  string
+}
+
+// Run collects on start and then every Interval until ctx is cancelled.
+func (c *Collector) Run(ctx context.Context) error {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Collect(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("reclaim: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect removes what is unused at now and returns the removals.
+func (c *Collector) Collect(ctx context.Context, now time.Time) ([]Removal, error) {
+	root, err := filepath.Abs(c.RepoRoot)
+	if err != nil {
+		return nil, err
+	}
+	var removals []Removal
+	remove := func(dir, rel, kind, detail string) {
+		r := Removal{Time: now.UTC(), Path: rel, Kind: kind, Detail: detail, DryRun: c.DryRun}
+		if !c.DryRun {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("reclaim: %s: %v", rel, err)
+				return
+			}
+		}
+		removals = append(removals, r)
+		if c.OnRemove != nil {
+			c.OnRemove(r)
+		}
+	}
+
+	// Walk depth first, so namespaces are judged after the repositories
+	// in them were removed.
+	var visit func(dir, rel string) (empty bool, err error)
+	visit = func(dir, rel string) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return false, err
+		}
+		empty := true
+		for _, e := range entries {
+			if !e.IsDir() || e.Type()&fs.ModeSymlink != 0 || strings.HasPrefix(e.Name(), ".") {
+				empty = false
+				continue
+			}
+			sub, subRel := filepath.Join(dir, e.Name()), path(rel, e.Name())
+			if service.IsRepository(sub) {
+				if c.EmptyAfter > 0 {
+					if c.reclaimable(ctx, sub, subRel, now, remove) {
+						continue
+					}
+				}
+				empty = false
+				continue
+			}
+			// Removing what is inside makes the namespace look fresh.
+			stale := !fresh(sub, now)
+			subEmpty, err := visit(sub, subRel)
+			if err != nil {
+				return false, err
+			}
+			if !subEmpty {
+				empty = false
+				continue
+			}
+			if c.Namespaces && stale {
+				remove(sub, subRel, KindEmptyNamespace, "holds no repositories")
+				continue
+			}
+			empty = false
+		}
+		return empty, nil
+	}
+	_, err = visit(root, "")
+	return removals, err
+}
+
+// reclaimable removes the repository at dir if it is abandoned, and
+// reports whether it did. A push may finish between the first look and
+// taking the maintenance lock, so it looks again while holding the lock.
+func (c *Collector) reclaimable(ctx context.Context, dir, rel string, now time.Time, remove func(dir, rel, kind, detail string)) bool {
+	if _, ok := c.abandoned(ctx, dir, rel, now); !ok {
+		return false
+	}
+	done, ok := c.Locks.TryMaintenance(dir, false)
+	if !ok {
+		return false
+	}
+	defer done()
+	detail, ok := c.abandoned(ctx, dir, rel, now)
+	if !ok {
+		return false
+	}
+	remove(dir, rel, KindEmptyRepo, detail)
+	return true
+}
+
+// abandoned reports whether the repository at dir was created more than
+// EmptyAfter ago and never received a ref, and describes it.
+func (c *Collector) abandoned(ctx context.Context, dir, rel string, now time.Time) (string, bool) {
+	if _, ok := service.WikiOf(rel); ok {
+		// Wikis go with their project.
+		return "", false
+	}
+	if service.IsRepository(filepath.Join(filepath.Dir(dir), filepath.Base(service.WikiPath(rel)))) {
+		return "", false
+	}
+	if atrest.IsEncrypted(dir) || service.Archived(dir) || !service.ReadLegalHold(dir).IsZero() {
+		return "", false
+	}
+	created, err := createdAt(dir)
+	if err != nil || now.Sub(created) < c.EmptyAfter {
+		return "", false
+	}
+	out, err := exec.CommandContext(ctx, c.git(), "-C", dir, "for-each-ref", "--count=1", "--format=%(refname)").Output()
+	if err != nil || len(strings.TrimSpace(string(out))) > 0 {
+		return "", false
+	}
+	return fmt.Sprintf("no refs since it was created %s ago", now.Sub(created).Round(time.Hour)), true
+}
+
+// createdAt estimates when the repository at dir was created from its
+// HEAD and refs directory, which git writes when initializing it and
+// rarely touches again while it has no refs. Its config is changed by
+// maintenance.
+func createdAt(dir string) (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{"HEAD", "refs"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// fresh reports whether the namespace at dir changed within
+// namespaceGrace.
+func fresh(dir string, now time.Time) bool {
+	fi, err := os.Stat(dir)
+	return err != nil || now.Sub(fi.ModTime()) < namespaceGrace
+}
+
+func path(rel, name string) string {
+	if rel == "" {
+		return name
+	}
+	return rel + "/" + name
+}
+
+func (c *Collector) git() string {
+	if c.GitPath != "" {
+		return c.GitPath
+	}
+	return "git"
+}
+
+// AppendTo returns an OnRemove function logging removals and appending
+// them to the file at path, one JSON object per line.
+func AppendTo(path string) func(Removal) {
+	var mu sync.Mutex
+	return func(r Removal) {
+		log.Printf("reclaim: removed %s", r)
+		line, err := json.Marshal(r)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Printf("reclaim: %v", err)
+			return
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Printf("reclaim: %v", err)
+			return
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			log.Printf("reclaim: %v", err)
+		}
+		f.Close()
+	}
+}
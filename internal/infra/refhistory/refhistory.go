@@ -0,0 +1,269 @@
+// Package refhistory keeps a rolling log of the ref updates pushed to each
+// repository: which ref moved from where to where, when and by whom.
+//
+// Unlike reflogs it lives outside the repositories, so it is neither
+// expired by gc nor lost on repack, and it is kept whether or not
+// core.logAllRefUpdates is set.
+package refhistory
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// ZeroOID is the object ID of a ref that doesn't exist.
+const ZeroOID = "0000000000000000000000000000000000000000"
+
+// Update is one recorded ref update. Old is the zero object ID when the
+// ref was created, New when it was deleted.
+type Update struct {
+	Time   time.Time `json:"time"`
+	Ref    string    `json:"ref"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+	Pusher string    `json:"pusher,omitempty"`
+}
+
+// IsDelete reports whether the update deleted the ref.
+func (u Update) IsDelete() bool {
+	return u.New == ZeroOID
+}
+
+// Query selects updates. Zero fields select everything.
+type Query struct {
+	Ref   string
+	Since time.Time
+	Until time.Time
+}
+
+func (q Query) matches(u Update) bool {
+	return (q.Ref == "" || u.Ref == q.Ref) &&
+		(q.Since.IsZero() || !u.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || u.Time.Before(q.Until))
+}
+
+// Store keeps the ref history of each repository in a file under Dir, one
+// JSON object per line. It is a service.ReferenceTransactions recording
+// the updates of every push that commits. It is safe for concurrent use.
+type Store struct {
+	Dir string
+	// Retention is how long updates are kept; defaults to 90 days.
+	Retention time.Duration
+
+	mu sync.Mutex
+}
+
+// Prepare accepts every update and records them once git commits them.
+func (s *Store) Prepare(ctx context.Context, req service.ServiceRequest, updates []service.PushCommand) (service.PreparedTransaction, error) {
+	return &transaction{store: s, repo: req.RepoName, pusher: req.Identity, updates: updates}, nil
+}
+
+type transaction struct {
+	store   *Store
+	repo    string
+	pusher  string
+	updates []service.PushCommand
+}
+
+func (t *transaction) Commit(ctx context.Context) error {
+	now := time.Now().UTC()
+	updates := make([]Update, 0, len(t.updates))
+	for _, u := range t.updates {
+		updates = append(updates, Update{Time: now, Ref: u.Ref, Old: u.Old, New: u.New, Pusher: t.pusher})
+	}
+	return t.store.Record(t.repo, updates...)
+}
+
+func (t *transaction) Abort(ctx context.Context) error { return nil }
+
+// Record appends updates to the history of repo, e.g. "owner/repo.git".
+func (s *Store) Record(repo string, updates ...Update) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, u := range updates {
+		line, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	path, err := s.path(repo)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	// A single write keeps the lines of one push together when other
+	// processes append to the same file.
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Updates returns the recorded updates of repo matching q, oldest first.
+func (s *Store) Updates(repo string, q Query) ([]Update, error) {
+	path, err := s.path(repo)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := readUpdates(path)
+	if err != nil {
+		return nil, err
+	}
+	var updates []Update
+	for _, u := range all {
+		if q.matches(u) {
+			updates = append(updates, u)
+		}
+	}
+	return updates, nil
+}
+
+// At returns what ref of repo pointed to at t, the zero object ID if it
+// didn't exist. ok is false if nothing about ref was recorded.
+func (s *Store) At(repo, ref string, t time.Time) (oid string, ok bool, err error) {
+	updates, err := s.Updates(repo, Query{Ref: ref})
+	if err != nil || len(updates) == 0 {
+		return "", false, err
+	}
+	for i := len(updates) - 1; i >= 0; i-- {
+		if !updates[i].Time.After(t) {
+			return updates[i].New, true, nil
+		}
+	}
+	// t is before the oldest recorded update, which tells where the ref
+	// pointed until then.
+	return updates[0].Old, true, nil
+}
+
+// Run trims histories on start and then daily until ctx is cancelled.
+func (s *Store) Run(ctx context.Context) error {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := s.Trim(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("ref history: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Trim drops updates older than the retention from every history, and
+// removes histories left empty.
+func (s *Store) Trim(ctx context.Context, now time.Time) error {
+	retention := s.Retention
+	if retention <= 0 {
+		retention = 90 * 24 * time.Hour
+	}
+	cutoff := now.Add(-retention)
+	err := filepath.WalkDir(s.Dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".jsonl") {
+			return nil
+		}
+		return s.trim(path, cutoff)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) trim(path string, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updates, err := readUpdates(path)
+	if err != nil {
+		return err
+	}
+	kept := updates[:0]
+	for _, u := range updates {
+		if !u.Time.Before(cutoff) {
+			kept = append(kept, u)
+		}
+	}
+	if len(kept) == len(updates) {
+		return nil
+	}
+	if len(kept) == 0 {
+		return os.Remove(path)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".trim-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	for _, u := range kept {
+		if err := enc.Encode(u); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// path returns the history file of repo.
+func (s *Store) path(repo string) (string, error) {
+	name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+repo)), "/")
+	if name == "" {
+		return "", errors.New("missing repository")
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(name)+".jsonl"), nil
+}
+
+func readUpdates(path string) ([]Update, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var updates []Update
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var u Update
+		if json.Unmarshal(sc.Bytes(), &u) != nil {
+			continue
+		}
+		updates = append(updates, u)
+	}
+	return updates, sc.Err()
+}
@@ -0,0 +1,266 @@
+// Package refpin pins the refs of repositories for multi-call reads: a pin
+// records every ref's value at one moment, and browsing requests naming it
+// resolve revisions against those values instead of the live refs, so a
+// pipeline reading commits, comparisons and archives sees one consistent
+// state while pushes land.
+//
+// Objects never change, so pinning refs is enough as long as the commits
+// they pointed to stay in the repository. Pins expire within a day, well
+// before gc prunes commits unreachable for gc.pruneExpire (two weeks by
+// default); a purge, which prunes right away, does remove them.
+package refpin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// maxPins caps the pins kept, so clients can't fill the disk with them.
+const maxPins = 10000
+
+var (
+	// ErrNotFound is returned for pins that don't exist or expired.
+	ErrNotFound = errcode.New(errcode.NotFound, "snapshot not found or expired")
+	// ErrTooMany is returned when too many pins are kept.
+	ErrTooMany = errcode.New(errcode.Overloaded, "too many snapshots, try again later")
+)
+
+// Ref is a pinned ref. Peeled is the object an annotated tag points to.
+type Ref struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	Peeled string `json:"peeled,omitempty"`
+}
+
+// Pin is the state of a repository's refs at one moment.
+type Pin struct {
+	ID      string    `json:"id"`
+	Repo    string    `json:"repo"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Head is the ref HEAD pointed to, if it was symbolic.
+	Head string `json:"head,omitempty"`
+	Refs []Ref  `json:"refs"`
+}
+
+// Resolve resolves rev like the live repository would: a full object
+// name, a full ref name or HEAD, or a short branch or tag name, in that
+// order. Object names are returned as they are.
+func (p *Pin) Resolve(rev string, isObjectName func(string) bool) (string, bool) {
+	if isObjectName(rev) {
+		return rev, true
+	}
+	if rev == "HEAD" {
+		if p.Head == "" {
+			return "", false
+		}
+		rev = p.Head
+	}
+	candidates := []string{rev}
+	if !strings.HasPrefix(rev, "refs/") {
+		candidates = []string{"refs/heads/" + rev, "refs/tags/" + rev}
+	}
+	for _, name := range candidates {
+		for _, ref := range p.Refs {
+			if ref.Name == name {
+				return ref.Target, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Store keeps pins as files in Dir, one per pin, so every server process
+// sharing the directory serves them. It is safe for concurrent use.
+type Store struct {
+	Dir string
+	// TTL is how long pins last unless asked otherwise; 1 hour when zero.
+	TTL time.Duration
+	// MaxTTL caps the lifetime clients may ask for; 24 hours when zero.
+	MaxTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*Pin
+}
+
+// Create pins refs of repo for ttl, or the store's TTL if zero.
+func (s *Store) Create(repo, head string, refs []Ref, ttl time.Duration, now time.Time) (*Pin, error) {
+	maxTTL := s.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = 24 * time.Hour
+	}
+	switch {
+	case ttl < 0 || ttl > maxTTL:
+		return nil, errcode.Errorf(errcode.InvalidRequest, "ttl must be at most %s", maxTTL)
+	case ttl == 0 && s.TTL > 0:
+		ttl = s.TTL
+	case ttl == 0:
+		ttl = time.Hour
+	}
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(entries) >= maxPins {
+		return nil, ErrTooMany
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if refs == nil {
+		refs = []Ref{}
+	}
+	p := &Pin{ID: hex.EncodeToString(id), Repo: repo, Created: now.UTC(), Expires: now.Add(ttl).UTC(), Head: head, Refs: refs}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	tmp := s.file(p.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, s.file(p.ID)); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	s.mu.Lock()
+	s.remember(p)
+	s.mu.Unlock()
+	return p, nil
+}
+
+// Get returns the pin with the given ID unless it expired.
+func (s *Store) Get(id string, now time.Time) (*Pin, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	p, ok := s.cache[id]
+	s.mu.Unlock()
+	if !ok {
+		data, err := os.ReadFile(s.file(id))
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		p = &Pin{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.remember(p)
+		s.mu.Unlock()
+	}
+	if !now.Before(p.Expires) {
+		return nil, ErrNotFound
+	}
+	if _, err := os.Stat(s.file(id)); os.IsNotExist(err) {
+		// Released through another process.
+		s.mu.Lock()
+		delete(s.cache, id)
+		s.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+// Release drops the pin with the given ID before it expires.
+func (s *Store) Release(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	delete(s.cache, id)
+	s.mu.Unlock()
+	err := os.Remove(s.file(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Run drops expired pins every few minutes until ctx is cancelled.
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := s.Prune(time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("snapshots: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune removes the files of expired pins.
+func (s *Store) Prune(now time.Time) error {
+	entries, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		_, err := s.Get(id, now)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrNotFound):
+			s.mu.Lock()
+			delete(s.cache, id)
+			s.mu.Unlock()
+			if err := os.Remove(s.file(id)); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		default:
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// remember caches p; s.mu must be held.
+func (s *Store) remember(p *Pin) {
+	if s.cache == nil {
+		s.cache = make(map[string]*Pin)
+	}
+	// Expired pins are dropped by Prune; a full cache starts over.
+	if len(s.cache) >= maxPins {
+		clear(s.cache)
+	}
+	s.cache[p.ID] = p
+}
+
+func (s *Store) file(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+func validID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil && strings.ToLower(id) == id
+}
@@ -0,0 +1,232 @@
+package replication
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Checksum returns a digest over the names and targets of refs. It ignores
+// order, peeled values and replication staging refs, so two nodes holding the
+// same refs produce the same checksum.
+func Checksum(refs map[string]string) string {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s %s\n", refs[name], name)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ReplicaStatus compares one replica against this node.
+type ReplicaStatus struct {
+	URL      string `json:"url"`
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Consistent is set when the replica holds exactly this node's refs.
+	Consistent bool `json:"consistent"`
+	// Repaired is set when Repair brought the replica back in line.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// Status is the result of verifying a repository across replicas.
+type Status struct {
+	Repo     string          `json:"repo"`
+	Checksum string          `json:"checksum"`
+	Refs     int             `json:"refs"`
+	Replicas []ReplicaStatus `json:"replicas"`
+}
+
+// Diverged reports whether any replica differs or could not be checked.
+func (s Status) Diverged() bool {
+	for _, rs := range s.Replicas {
+		if !rs.Consistent {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalRefs returns the refs of the repository at repoPath that take part in
+// replication.
+func (r *Replicator) LocalRefs(repoPath string) (map[string]string, error) {
+	var rp *repo.Repository
+	var err error
+	if r.Repos != nil {
+		rp, err = r.Repos.Open(repoPath)
+	} else {
+		rp, err = repo.Open(repoPath)
+		if err == nil {
+			defer rp.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	list, err := rp.Refs()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string, len(list))
+	for _, ref := range list {
+		if !strings.HasPrefix(ref.Name, stagingPrefix) {
+			refs[ref.Name] = ref.Target.String()
+		}
+	}
+	return refs, nil
+}
+
+// remoteRefs lists the refs of a replica that take part in replication.
+func (r *Replicator) remoteRefs(ctx context.Context, repoPath, url string) (map[string]string, error) {
+	out, err := r.git(ctx, repoPath, "ls-remote", "--refs", url)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		oid, name, ok := strings.Cut(line, "\t")
+		if ok && strings.HasPrefix(name, "refs/") && !strings.HasPrefix(name, stagingPrefix) {
+			refs[name] = oid
+		}
+	}
+	return refs, nil
+}
+
+// Verify compares the checksum of the repository with every replica.
+// With repair set, diverged replicas are updated to match this node.
+func (r *Replicator) Verify(ctx context.Context, repoPath, repoName string, repair bool) (Status, error) {
+	local, err := r.LocalRefs(repoPath)
+	if err != nil {
+		return Status{}, err
+	}
+	replicas, err := r.replicas(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+	st := Status{Repo: strings.Trim(repoName, "/"), Checksum: Checksum(local), Refs: len(local)}
+	for _, base := range replicas {
+		url := r.replicaURL(base, repoName)
+		rs := ReplicaStatus{URL: url}
+		remote, err := r.remoteRefs(ctx, repoPath, url)
+		if err != nil {
+			rs.Error = err.Error()
+			st.Replicas = append(st.Replicas, rs)
+			continue
+		}
+		rs.Checksum = Checksum(remote)
+		rs.Consistent = rs.Checksum == st.Checksum
+		if !rs.Consistent && repair {
+			if err := r.repair(ctx, repoPath, url, local, remote); err != nil {
+				rs.Error = err.Error()
+			} else {
+				rs.Checksum, rs.Consistent, rs.Repaired = st.Checksum, true, true
+			}
+		}
+		st.Replicas = append(st.Replicas, rs)
+	}
+	return st, nil
+}
+
+// repair pushes the refs that differ on a replica. Each update is leased on
+// the value just read from the replica so a concurrent replicated push wins.
+func (r *Replicator) repair(ctx context.Context, repoPath, url string, local, remote map[string]string) error {
+	args := []string{"push", "--quiet", "--atomic", "--no-verify"}
+	var refspecs []string
+	for name, oid := range local {
+		if remote[name] == oid {
+			continue
+		}
+		lease := remote[name]
+		if lease == "" {
+			lease = zeroOID
+		}
+		args = append(args, "--force-with-lease="+name+":"+lease)
+		refspecs = append(refspecs, "+"+oid+":"+name)
+	}
+	for name, oid := range remote {
+		if _, ok := local[name]; !ok {
+			args = append(args, "--force-with-lease="+name+":"+oid)
+			refspecs = append(refspecs, ":"+name)
+		}
+	}
+	if len(refspecs) == 0 {
+		return nil
+	}
+	args = append(append(args, url), refspecs...)
+	_, err := r.git(ctx, repoPath, args...)
+	return err
+}
+
+// Run periodically verifies every repository under RepoRoot and repairs
+// diverged replicas until ctx is cancelled.
+func (r *Replicator) Run(ctx context.Context) error {
+	interval := r.VerifyInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.verifyAll(ctx); err != nil {
+				log.Printf("replication verify: %v", err)
+			}
+		}
+	}
+}
+
+func (r *Replicator) verifyAll(ctx context.Context) error {
+	root := filepath.Clean(r.RepoRoot)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !service.IsRepository(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		st, err := r.Verify(ctx, path, filepath.ToSlash(rel), true)
+		if err != nil {
+			log.Printf("replication verify %s: %v", rel, err)
+			return filepath.SkipDir
+		}
+		for _, rs := range st.Replicas {
+			switch {
+			case rs.Repaired:
+				log.Printf("replication: repaired %s on %s", st.Repo, rs.URL)
+			case !rs.Consistent:
+				log.Printf("replication: %s diverged on %s: %s", st.Repo, rs.URL, rs.Error)
+			}
+		}
+		return filepath.SkipDir
+	})
+}
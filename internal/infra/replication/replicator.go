@@ -0,0 +1,283 @@
+// Package replication keeps replica nodes in step with the repositories of a
+// primary node.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/diag"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/discovery"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+var debugReplication = diag.Register("replication", "Git commands run against replicas")
+
+const zeroOID = "0000000000000000000000000000000000000000"
+
+// stagingPrefix holds objects pushed to a replica during prepare, keeping
+// them reachable until the transaction commits or aborts.
+const stagingPrefix = "refs/repocraft/txn/"
+
+// Replicator applies ref updates to replicas in two phases. On prepare, every
+// replica must still hold the old ref values and receives the new objects
+// under staging refs; the update is only allowed once Quorum nodes, counting
+// this one, hold the objects. On commit the refs are moved on the prepared
+// replicas. It implements service.ReferenceTransactions.
+type Replicator struct {
+	// Replicas are the base URLs of the replica nodes, e.g.
+	// "http://replica-1:8080"; the repository name is appended.
+	Replicas []string
+	// Discovery, if set, replaces Replicas with the non-primary nodes it
+	// returns. Wrap sources in a discovery.Cache to bound lookups.
+	Discovery discovery.Discoverer
+	// Quorum is the number of nodes, including this one, that must prepare
+	// an update. Defaults to a majority of all nodes.
+	Quorum int
+	// GitPath overrides the git binary used to talk to replicas.
+	GitPath string
+	// Timeout bounds each operation against a replica; defaults to one minute.
+	Timeout time.Duration
+
+	// RepoRoot is walked by Run to verify every repository.
+	RepoRoot string
+	// VerifyInterval is how often Run verifies replicas; defaults to ten minutes.
+	VerifyInterval time.Duration
+	// Repos optionally shares open repositories for checksumming.
+	Repos *repo.Cache
+}
+
+// Prepare stages updates on the replicas and fails unless a quorum prepared.
+func (r *Replicator) Prepare(ctx context.Context, req service.ServiceRequest, updates []service.PushCommand) (service.PreparedTransaction, error) {
+	id, err := newTxnID()
+	if err != nil {
+		return nil, err
+	}
+	tx := &transaction{r: r, repoPath: req.RepoPath, repoName: req.RepoName, id: id, updates: updates}
+
+	replicas, err := r.replicas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failures []error
+	)
+	for _, base := range replicas {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			err := tx.prepare(ctx, url)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, fmt.Errorf("%s: %w", url, err))
+				return
+			}
+			tx.prepared = append(tx.prepared, url)
+		}(r.replicaURL(base, req.RepoName))
+	}
+	wg.Wait()
+
+	if nodes, quorum := 1+len(tx.prepared), r.quorum(len(replicas)); nodes < quorum {
+		tx.Abort(context.WithoutCancel(ctx))
+		return nil, fmt.Errorf("replication quorum not reached: %d of %d nodes prepared: %w", nodes, quorum, errors.Join(failures...))
+	}
+	return tx, nil
+}
+
+// replicas returns the base URLs of the current replicas.
+func (r *Replicator) replicas(ctx context.Context) ([]string, error) {
+	if r.Discovery == nil {
+		return r.Replicas, nil
+	}
+	nodes, err := r.Discovery.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discover replicas: %w", err)
+	}
+	var urls []string
+	for _, n := range nodes {
+		if !n.Primary {
+			urls = append(urls, n.URL)
+		}
+	}
+	return urls, nil
+}
+
+func (r *Replicator) quorum(replicas int) int {
+	if r.Quorum > 0 {
+		return r.Quorum
+	}
+	return (replicas+1)/2 + 1
+}
+
+func (r *Replicator) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return time.Minute
+}
+
+func (r *Replicator) replicaURL(base, repoName string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(repoName, "/")
+}
+
+// git runs a git command against the local repository.
+func (r *Replicator) git(ctx context.Context, repoPath string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+	bin := r.GitPath
+	if bin == "" {
+		bin = "git"
+	}
+	if debugReplication.Enabled() {
+		shown := make([]string, len(args))
+		for i, arg := range args {
+			shown[i] = arg
+			if u, err := url.Parse(arg); err == nil && u.User != nil {
+				shown[i] = u.Redacted()
+			}
+		}
+		debugReplication.Printf("%s: git %s", repoPath, strings.Join(shown, " "))
+	}
+	cmd := exec.CommandContext(ctx, bin, append([]string{"-C", repoPath}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+type transaction struct {
+	r        *Replicator
+	repoPath string
+	repoName string
+	id       string
+	updates  []service.PushCommand
+	prepared []string
+}
+
+func (t *transaction) stagingRef(i int) string {
+	return fmt.Sprintf("%s%s/%d", stagingPrefix, t.id, i)
+}
+
+// prepare checks that url still holds the old values and stages new objects.
+func (t *transaction) prepare(ctx context.Context, url string) error {
+	args := []string{"ls-remote", url}
+	for _, u := range t.updates {
+		args = append(args, u.Ref)
+	}
+	out, err := t.r.git(ctx, t.repoPath, args...)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if oid, ref, ok := strings.Cut(line, "\t"); ok {
+			current[ref] = oid
+		}
+	}
+	var refspecs []string
+	for i, u := range t.updates {
+		have, ok := current[u.Ref]
+		if !ok {
+			have = zeroOID
+		}
+		if have != u.Old {
+			return fmt.Errorf("%s is at %s, expected %s", u.Ref, have, u.Old)
+		}
+		if !u.IsDelete() {
+			refspecs = append(refspecs, u.New+":"+t.stagingRef(i))
+		}
+	}
+	if len(refspecs) == 0 {
+		return nil
+	}
+	_, err = t.r.git(ctx, t.repoPath, append([]string{"push", "--quiet", "--atomic", "--no-verify", url}, refspecs...)...)
+	return err
+}
+
+// Commit moves the refs on every prepared replica. Replicas that fail are
+// left diverged and reported in the returned error.
+func (t *transaction) Commit(ctx context.Context) error {
+	return t.each(ctx, func(url string) error {
+		args := []string{"push", "--quiet", "--atomic", "--no-verify"}
+		for _, u := range t.updates {
+			args = append(args, "--force-with-lease="+u.Ref+":"+u.Old)
+		}
+		args = append(args, url)
+		for i, u := range t.updates {
+			if u.IsDelete() {
+				args = append(args, ":"+u.Ref)
+				continue
+			}
+			args = append(args, "+"+u.New+":"+u.Ref, ":"+t.stagingRef(i))
+		}
+		_, err := t.r.git(ctx, t.repoPath, args...)
+		return err
+	})
+}
+
+// Abort removes the staging refs from every prepared replica.
+func (t *transaction) Abort(ctx context.Context) error {
+	var refspecs []string
+	for i, u := range t.updates {
+		if !u.IsDelete() {
+			refspecs = append(refspecs, ":"+t.stagingRef(i))
+		}
+	}
+	if len(refspecs) == 0 {
+		return nil
+	}
+	return t.each(ctx, func(url string) error {
+		_, err := t.r.git(ctx, t.repoPath, append([]string{"push", "--quiet", "--no-verify", url}, refspecs...)...)
+		return err
+	})
+}
+
+func (t *transaction) each(ctx context.Context, fn func(url string) error) error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	for _, url := range t.prepared {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			if err := fn(url); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", url, err))
+				mu.Unlock()
+			}
+		}(url)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func newTxnID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
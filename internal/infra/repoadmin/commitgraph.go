@@ -0,0 +1,75 @@
+package repoadmin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+)
+
+// graphWrites tracks the commit-graphs being written, by repository, so
+// concurrent callers wait for one git process instead of fighting over its
+// lock file.
+var graphWrites struct {
+	mu      sync.Mutex
+	running map[string]*graphWrite
+}
+
+type graphWrite struct {
+	done chan struct{}
+	err  error
+}
+
+// EnsureCommitGraph writes a commit-graph for the repository at repoPath
+// unless it has one. Ancestry queries, by git and by repo.Repository.Compare,
+// then walk generation numbers instead of parsing every commit; maintenance
+// keeps the graph current afterwards. The graph is written even if ctx ends
+// first, for the next caller.
+func EnsureCommitGraph(ctx context.Context, repoPath string) error {
+	if hasCommitGraph(repoPath) || atrest.IsEncrypted(repoPath) {
+		return nil
+	}
+	key := filepath.Clean(repoPath)
+	graphWrites.mu.Lock()
+	w, ok := graphWrites.running[key]
+	if !ok {
+		if graphWrites.running == nil {
+			graphWrites.running = make(map[string]*graphWrite)
+		}
+		w = &graphWrite{done: make(chan struct{})}
+		graphWrites.running[key] = w
+		go func() {
+			out, err := exec.Command("git", "--git-dir="+key, "commit-graph", "write", "--reachable", "--no-progress").CombinedOutput()
+			if err != nil {
+				w.err = fmt.Errorf("git commit-graph write: %v: %s", err, strings.TrimSpace(string(out)))
+			}
+			graphWrites.mu.Lock()
+			delete(graphWrites.running, key)
+			graphWrites.mu.Unlock()
+			close(w.done)
+		}()
+	}
+	graphWrites.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func hasCommitGraph(repoPath string) bool {
+	info := filepath.Join(repoPath, "objects", "info")
+	for _, name := range []string{"commit-graph", filepath.Join("commit-graphs", "commit-graph-chain")} {
+		if _, err := os.Stat(filepath.Join(info, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package repoadmin
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// ExportRule sets an export attribute on the paths matching Pattern, for
+// archives served by git-upload-archive. Rules override the repository's
+// own .gitattributes: "-export-ignore" puts files it ignores back.
+type ExportRule struct {
+	// Pattern is a gitattributes pattern, such as "/internal" or "*.secret".
+	Pattern string `json:"pattern"`
+	// Attribute is "export-ignore" or "export-subst", or either prefixed by
+	// "-" to unset it.
+	Attribute string `json:"attribute"`
+}
+
+var exportAttributes = []string{"export-ignore", "-export-ignore", "export-subst", "-export-subst"}
+
+// Export rules are kept in a block of info/attributes, which takes
+// precedence over the .gitattributes of archived trees and leaves any
+// other lines of the file alone.
+const (
+	exportRulesFile  = "info/attributes"
+	exportRulesBegin = "# BEGIN repocraft export rules; managed through the admin API"
+	exportRulesEnd   = "# END repocraft export rules"
+)
+
+// ExportRules returns the export rules of the repository at repo (relative
+// to RepoRoot).
+func (m *Manager) ExportRules(repo string) ([]ExportRule, error) {
+	_, full, err := m.resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+	if !service.IsRepository(full) {
+		return nil, ErrRepoNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(full, filepath.FromSlash(exportRulesFile)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, block, _ := splitExportRules(data)
+	rules := []ExportRule{}
+	sc := bufio.NewScanner(bytes.NewReader(block))
+	for sc.Scan() {
+		if pattern, attr, ok := strings.Cut(sc.Text(), " "); ok {
+			rules = append(rules, ExportRule{Pattern: pattern, Attribute: attr})
+		}
+	}
+	return rules, nil
+}
+
+// SetExportRules replaces the export rules of the repository at repo.
+func (m *Manager) SetExportRules(repo string, rules []ExportRule) ([]ExportRule, error) {
+	var block bytes.Buffer
+	for _, r := range rules {
+		if r.Pattern == "" || strings.ContainsAny(r.Pattern, " \t\r\n\"") || strings.HasPrefix(r.Pattern, "#") || strings.HasPrefix(r.Pattern, "!") {
+			return nil, errcode.Errorf(errcode.InvalidRequest, "invalid pattern %q", r.Pattern)
+		}
+		if !contains(exportAttributes, r.Attribute) {
+			return nil, errcode.Errorf(errcode.InvalidRequest, "invalid attribute %q; known are %s", r.Attribute, strings.Join(exportAttributes, ", "))
+		}
+		block.WriteString(r.Pattern + " " + r.Attribute + "\n")
+	}
+	_, full, err := m.resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !service.IsRepository(full) {
+		return nil, ErrRepoNotFound
+	}
+	file := filepath.Join(full, filepath.FromSlash(exportRulesFile))
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	before, _, after := splitExportRules(data)
+	var out bytes.Buffer
+	out.Write(before)
+	if block.Len() > 0 {
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+			out.WriteByte('\n')
+		}
+		out.WriteString(exportRulesBegin + "\n")
+		out.Write(block.Bytes())
+		out.WriteString(exportRulesEnd + "\n")
+	}
+	out.Write(after)
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return nil, err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if rules == nil {
+		rules = []ExportRule{}
+	}
+	return rules, nil
+}
+
+// splitExportRules splits an attributes file into what precedes the block
+// of export rules, the rules and what follows.
+func splitExportRules(data []byte) (before, block, after []byte) {
+	begin := bytes.Index(data, []byte(exportRulesBegin+"\n"))
+	if begin < 0 {
+		return data, nil, nil
+	}
+	rest := data[begin+len(exportRulesBegin)+1:]
+	end := bytes.Index(rest, []byte(exportRulesEnd+"\n"))
+	if end < 0 {
+		return data[:begin], rest, nil
+	}
+	return data[:begin], rest[:end], rest[end+len(exportRulesEnd)+1:]
+}
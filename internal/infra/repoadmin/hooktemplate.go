@@ -0,0 +1,173 @@
+package repoadmin
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// HookTemplate links the executable scripts of a shared hooks directory
+// into the hooks directory of every repository under RepoRoot, so teams can
+// keep using existing shell hooks. Links point back into Dir, so edits to a
+// script apply everywhere at once; Sync is only needed when scripts are
+// added or removed, and for repositories created since the last run. A
+// repository's own hook of the same name is never replaced.
+type HookTemplate struct {
+	// Dir is the template hooks directory; it should be absolute.
+	Dir      string
+	RepoRoot string
+	// Interval is the time between syncs in Run; defaults to ten minutes.
+	Interval time.Duration
+}
+
+// HookSyncReport summarizes a Sync.
+type HookSyncReport struct {
+	Repos   int `json:"repos"`
+	Linked  int `json:"linked"`
+	Removed int `json:"removed"`
+	// Skipped counts template scripts shadowed by a repository's own hook.
+	Skipped int `json:"skipped"`
+}
+
+// Run syncs all repositories on start and then every Interval until ctx is
+// cancelled.
+func (t *HookTemplate) Run(ctx context.Context) {
+	interval := t.Interval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := t.Sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("hook template: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync applies the template to every repository under RepoRoot.
+func (t *HookTemplate) Sync(ctx context.Context) (HookSyncReport, error) {
+	var report HookSyncReport
+	scripts, err := t.scripts()
+	if err != nil {
+		return report, err
+	}
+	root := filepath.Clean(t.RepoRoot)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !service.IsRepository(path) {
+			return nil
+		}
+		r, err := t.apply(path, scripts)
+		if err != nil {
+			log.Printf("hook template: %s: %v", path, err)
+		}
+		report.Repos++
+		report.Linked += r.Linked
+		report.Removed += r.Removed
+		report.Skipped += r.Skipped
+		return filepath.SkipDir
+	})
+	return report, err
+}
+
+// Apply applies the template to the repository at repoPath.
+func (t *HookTemplate) Apply(repoPath string) (HookSyncReport, error) {
+	scripts, err := t.scripts()
+	if err != nil {
+		return HookSyncReport{}, err
+	}
+	r, err := t.apply(repoPath, scripts)
+	r.Repos = 1
+	return r, err
+}
+
+// scripts returns the names of the executable files in Dir.
+func (t *HookTemplate) scripts() (map[string]bool, error) {
+	entries, err := os.ReadDir(t.Dir)
+	if err != nil {
+		return nil, err
+	}
+	scripts := make(map[string]bool)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() && info.Mode().Perm()&0o111 != 0 {
+			scripts[entry.Name()] = true
+		}
+	}
+	return scripts, nil
+}
+
+func (t *HookTemplate) apply(repoPath string, scripts map[string]bool) (HookSyncReport, error) {
+	var r HookSyncReport
+	hooks := filepath.Join(repoPath, "hooks")
+	if err := os.MkdirAll(hooks, 0o755); err != nil {
+		return r, err
+	}
+
+	// Links to scripts that left the template are removed.
+	entries, err := os.ReadDir(hooks)
+	if err != nil {
+		return r, err
+	}
+	for _, entry := range entries {
+		if name, ok := t.linkedScript(filepath.Join(hooks, entry.Name())); ok && !scripts[name] {
+			if err := os.Remove(filepath.Join(hooks, entry.Name())); err != nil {
+				return r, err
+			}
+			r.Removed++
+		}
+	}
+
+	for name := range scripts {
+		dst := filepath.Join(hooks, name)
+		if linked, ok := t.linkedScript(dst); ok && linked == name {
+			continue
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			r.Skipped++
+			continue
+		} else if !os.IsNotExist(err) {
+			return r, err
+		}
+		if err := os.Symlink(filepath.Join(t.Dir, name), dst); err != nil {
+			return r, err
+		}
+		r.Linked++
+	}
+	return r, nil
+}
+
+// linkedScript reports whether path is a link into Dir, and to which script.
+func (t *HookTemplate) linkedScript(path string) (string, bool) {
+	target, err := os.Readlink(path)
+	if err != nil || filepath.Dir(target) != filepath.Clean(t.Dir) {
+		return "", false
+	}
+	return filepath.Base(target), true
+}
@@ -0,0 +1,131 @@
+package repoadmin
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// LegalHold returns the legal hold of the repository at repo (relative to
+// RepoRoot).
+func (m *Manager) LegalHold(repo string) (service.LegalHold, error) {
+	_, full, err := m.resolve(repo)
+	if err != nil {
+		return service.LegalHold{}, err
+	}
+	if !service.IsRepository(full) {
+		return service.LegalHold{}, ErrRepoNotFound
+	}
+	return service.ReadLegalHold(full), nil
+}
+
+// PlaceLegalHold holds refs of the repository at repo, in addition to those
+// already held, or the whole repository if refs is empty. A non-empty
+// reason replaces the previous one.
+func (m *Manager) PlaceLegalHold(repo string, refs []string, reason string) (service.LegalHold, error) {
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref, "refs/") || exec.Command("git", "check-ref-format", ref).Run() != nil {
+			return service.LegalHold{}, errcode.Errorf(errcode.InvalidRequest, "invalid ref %q", ref)
+		}
+	}
+	if strings.ContainsAny(reason, "\r\n") {
+		return service.LegalHold{}, errcode.New(errcode.InvalidRequest, "reason spans lines")
+	}
+	return m.updateLegalHold(repo, func(h *service.LegalHold) {
+		if len(refs) == 0 {
+			h.All = true
+		}
+		for _, ref := range refs {
+			h.Refs = appendNew(h.Refs, ref)
+		}
+		if reason != "" {
+			h.Reason = reason
+		}
+	})
+}
+
+// ReleaseLegalHold releases refs of the repository at repo, or everything
+// it holds if refs is empty.
+func (m *Manager) ReleaseLegalHold(repo string, refs []string) (service.LegalHold, error) {
+	return m.updateLegalHold(repo, func(h *service.LegalHold) {
+		if len(refs) == 0 {
+			*h = service.LegalHold{}
+			return
+		}
+		var kept []string
+		for _, ref := range h.Refs {
+			if !contains(refs, ref) {
+				kept = append(kept, ref)
+			}
+		}
+		h.Refs = kept
+		if h.IsZero() {
+			h.Reason = ""
+		}
+	})
+}
+
+func (m *Manager) updateLegalHold(repo string, update func(*service.LegalHold)) (service.LegalHold, error) {
+	_, full, err := m.resolve(repo)
+	if err != nil {
+		return service.LegalHold{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !service.IsRepository(full) {
+		return service.LegalHold{}, ErrRepoNotFound
+	}
+	h := service.ReadLegalHold(full)
+	update(&h)
+	config := filepath.Join(full, "config")
+	for _, key := range []string{service.LegalHoldKey, service.LegalHoldRefKey, service.LegalHoldReasonKey} {
+		// Exit status 5 means the key wasn't set.
+		if out, err := exec.Command("git", "config", "--file", config, "--unset-all", key).CombinedOutput(); err != nil && exitStatus(err) != 5 {
+			return service.LegalHold{}, fmt.Errorf("git config %s: %v: %s", key, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if h.All {
+		if err := setConfig(full, service.LegalHoldKey, strconv.FormatBool(true)); err != nil {
+			return service.LegalHold{}, err
+		}
+	}
+	for _, ref := range h.Refs {
+		if out, err := exec.Command("git", "config", "--file", config, "--add", service.LegalHoldRefKey, ref).CombinedOutput(); err != nil {
+			return service.LegalHold{}, fmt.Errorf("git config %s: %v: %s", service.LegalHoldRefKey, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if h.Reason != "" {
+		if err := setConfig(full, service.LegalHoldReasonKey, h.Reason); err != nil {
+			return service.LegalHold{}, err
+		}
+	}
+	return h, nil
+}
+
+func exitStatus(err error) int {
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode()
+	}
+	return -1
+}
+
+func appendNew(list []string, s string) []string {
+	if contains(list, s) {
+		return list
+	}
+	return append(list, s)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+// Package repoadmin implements administrative operations on the repository
+// layout under a repository root, such as moving repositories between owners.
+package repoadmin
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/events"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+)
+
+var (
+	// ErrRepoNotFound is returned when the source repository does not exist.
+	ErrRepoNotFound = errcode.New(errcode.RepoNotFound, "repository not found")
+	// ErrRepoExists is returned when the destination is already taken.
+	ErrRepoExists = errcode.New(errcode.RepoExists, "repository already exists")
+	// ErrInvalidPath is returned for paths escaping the root or otherwise unusable.
+	ErrInvalidPath = errcode.New(errcode.InvalidRequest, "invalid repository path")
+)
+
+// Manager performs layout changes under RepoRoot. Optional collaborators are
+// kept consistent with the move: redirects, statistics and open handles.
+type Manager struct {
+	RepoRoot  string
+	Redirects *RedirectStore
+	Stats     *repostats.Store
+	Repos     *repo.Cache
+	// Events, if set, gets an event for each repository created, moved or
+	// archived.
+	Events *events.Log
+
+	// mu serializes layout changes so concurrent transfers can't race on
+	// the same destination.
+	mu sync.Mutex
+}
+
+// Transfer moves the repository at from to to (both relative to RepoRoot),
+// records a redirect from the old path and stores the previous location in
+// the repository config as repocraft.previousPath.
+func (m *Manager) Transfer(from, to string) error {
+	fromRel, fromFull, err := m.resolve(from)
+	if err != nil {
+		return err
+	}
+	toRel, toFull, err := m.resolve(to)
+	if err != nil {
+		return err
+	}
+	if fromRel == toRel {
+		return fmt.Errorf("%w: source and destination are the same", ErrInvalidPath)
+	}
+	if strings.HasPrefix(toRel+"/", fromRel+"/") {
+		return fmt.Errorf("%w: destination is inside the source", ErrInvalidPath)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !service.IsRepository(fromFull) {
+		return ErrRepoNotFound
+	}
+	if err := m.checkPlacement(toRel, fromFull); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(toFull), 0o755); err != nil {
+		return fmt.Errorf("create destination namespace: %w", err)
+	}
+	// rename(2) is atomic within one filesystem: clients see either the old
+	// or the new location, never a partial copy.
+	if err := os.Rename(fromFull, toFull); err != nil {
+		return fmt.Errorf("move repository: %w", err)
+	}
+
+	if err := setConfig(toFull, "repocraft.previousPath", fromRel); err != nil {
+		return err
+	}
+	if m.Redirects != nil {
+		if err := m.Redirects.Add(fromRel, toRel); err != nil {
+			return err
+		}
+	}
+	if m.Repos != nil {
+		m.Repos.Evict(fromFull)
+	}
+	m.Stats.Rename(fromRel, toRel)
+	m.Events.Record(events.Event{Type: events.RepoTransferred, Repo: toRel, From: fromRel})
+	return m.moveWiki(fromRel, toRel)
+}
+
+// moveWiki moves the wiki of a transferred project along with it.
+func (m *Manager) moveWiki(fromRel, toRel string) error {
+	fromRel, toRel = service.WikiPath(fromRel), service.WikiPath(toRel)
+	root := filepath.Clean(m.RepoRoot)
+	fromFull, toFull := filepath.Join(root, filepath.FromSlash(fromRel)), filepath.Join(root, filepath.FromSlash(toRel))
+	if !service.IsRepository(fromFull) {
+		return nil
+	}
+	if err := m.checkPlacement(toRel, fromFull); err != nil {
+		return fmt.Errorf("move wiki: %w", err)
+	}
+	if err := os.Rename(fromFull, toFull); err != nil {
+		return fmt.Errorf("move wiki: %w", err)
+	}
+	if m.Redirects != nil {
+		if err := m.Redirects.Add(fromRel, toRel); err != nil {
+			return err
+		}
+	}
+	if m.Repos != nil {
+		m.Repos.Evict(fromFull)
+	}
+	m.Stats.Rename(fromRel, toRel)
+	m.Events.Record(events.Event{Type: events.RepoTransferred, Repo: toRel, From: fromRel})
+	return nil
+}
+
+// Create initializes an empty bare repository at repo (relative to
+// RepoRoot), creating the namespaces above it as needed. Wiki paths are
+// refused; see CreateWiki.
+func (m *Manager) Create(repo string) error {
+	rel, full, err := m.resolve(repo)
+	if err != nil {
+		return err
+	}
+	if _, ok := service.WikiOf(rel); ok {
+		return fmt.Errorf("%w: paths ending in %s are reserved for wikis", ErrInvalidPath, service.WikiSuffix)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.create(rel, full)
+}
+
+// CreateWiki initializes the wiki of the existing repository at repo. The
+// wiki's access follows its project's.
+func (m *Manager) CreateWiki(repo string) error {
+	rel, full, err := m.resolve(repo)
+	if err != nil {
+		return err
+	}
+	if _, ok := service.WikiOf(rel); ok {
+		return fmt.Errorf("%w: %s is a wiki", ErrInvalidPath, rel)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !service.IsRepository(full) {
+		return ErrRepoNotFound
+	}
+	wiki := service.WikiPath(rel)
+	return m.create(wiki, filepath.Join(filepath.Clean(m.RepoRoot), filepath.FromSlash(wiki)))
+}
+
+func (m *Manager) create(rel, full string) error {
+	if err := m.checkPlacement(rel, ""); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		return fmt.Errorf("create namespace: %w", err)
+	}
+	// Initialize under a hidden name so no one sees a partial repository.
+	tmp := filepath.Join(filepath.Dir(full), "."+filepath.Base(full)+".create")
+	os.RemoveAll(tmp)
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", tmp).CombinedOutput(); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("git init: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, full); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("create repository: %w", err)
+	}
+	m.Events.Record(events.Event{Type: events.RepoCreated, Repo: rel})
+	return nil
+}
+
+// checkPlacement checks that a repository may be placed at rel without
+// making a path ambiguous: nothing may exist at rel yet, no namespace above
+// it may be a repository, and rel and rel+".git" (or rel without ".git")
+// must not both name repositories. moving is the repository being moved
+// to rel, if any, which doesn't count.
+func (m *Manager) checkPlacement(rel, moving string) error {
+	root := filepath.Clean(m.RepoRoot)
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	if _, err := os.Lstat(full); err == nil {
+		if service.IsRepository(full) {
+			return ErrRepoExists
+		}
+		return fmt.Errorf("%w: %s is a namespace", ErrRepoExists, rel)
+	}
+	for dir := filepath.Dir(full); dir != root && len(dir) > len(root); dir = filepath.Dir(dir) {
+		if service.IsRepository(dir) {
+			return fmt.Errorf("%w: %s is inside a repository", ErrInvalidPath, rel)
+		}
+	}
+	twin := full + ".git"
+	if base, ok := strings.CutSuffix(full, ".git"); ok {
+		twin = base
+	}
+	if twin != moving && service.IsRepository(twin) {
+		return fmt.Errorf("%w: %s would be ambiguous with an existing repository", ErrRepoExists, rel)
+	}
+	return nil
+}
+
+// SetArchived marks the repository at repo (relative to RepoRoot) archived,
+// so it refuses pushes, or makes it writable again.
+func (m *Manager) SetArchived(repo string, archived bool) error {
+	rel, full, err := m.resolve(repo)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !service.IsRepository(full) {
+		return ErrRepoNotFound
+	}
+	if err := setConfig(full, service.ArchivedKey, strconv.FormatBool(archived)); err != nil {
+		return err
+	}
+	event := events.Event{Type: events.RepoArchived, Repo: rel}
+	if !archived {
+		event.Type = events.RepoUnarchived
+	}
+	m.Events.Record(event)
+	return nil
+}
+
+// resolve validates a repository path relative to the root and returns its
+// cleaned relative form and absolute location.
+func (m *Manager) resolve(raw string) (string, string, error) {
+	rel := filepath.ToSlash(filepath.Clean("/" + strings.TrimSpace(raw)))
+	rel = strings.TrimPrefix(rel, "/")
+	if rel == "" || rel == "." {
+		return "", "", ErrInvalidPath
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", "", fmt.Errorf("%w: %q", ErrInvalidPath, raw)
+		}
+	}
+	root := filepath.Clean(m.RepoRoot)
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	if !strings.HasPrefix(full, root+string(os.PathSeparator)) {
+		return "", "", ErrInvalidPath
+	}
+	return rel, full, nil
+}
+
+// setConfig writes key=value to the repository's own config file.
+func setConfig(repoDir, key, value string) error {
+	cmd := exec.Command("git", "config", "--file", filepath.Join(repoDir, "config"), key, value)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git config %s: %v: %s", key, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
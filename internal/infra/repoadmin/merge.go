@@ -0,0 +1,152 @@
+package repoadmin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// mergeCommitter commits the merges the server makes.
+const mergeCommitter = "Repocraft <repocraft@localhost>"
+
+var (
+	// ErrMergeConflict is returned when the branches can't be merged
+	// without resolving conflicts.
+	ErrMergeConflict = errcode.New(errcode.Conflict, "merge conflict")
+	// ErrNotFastForward is returned for fast-forward-only merges of
+	// diverged branches.
+	ErrNotFastForward = errcode.New(errcode.Conflict, "not a fast-forward")
+	// ErrRevisionNotFound is returned for branches or commits that don't
+	// exist.
+	ErrRevisionNotFound = errcode.New(errcode.NotFound, "revision not found")
+)
+
+// MergeRequest asks to merge From into the branch Into.
+type MergeRequest struct {
+	// Into is the branch to update, e.g. "main" or "refs/heads/main".
+	Into string `json:"into"`
+	// From is the branch or commit to merge.
+	From string `json:"from"`
+	// Message of the merge commit; defaults to "Merge <from> into <into>".
+	Message string `json:"message,omitempty"`
+	// Author of the merge commit, as "Name <email>"; defaults to the
+	// server.
+	Author string `json:"author,omitempty"`
+	// FastForwardOnly refuses merges that need a merge commit.
+	FastForwardOnly bool `json:"fast_forward_only,omitempty"`
+}
+
+// MergeResult is the outcome of a merge. Old equals New when From was
+// already merged.
+type MergeResult struct {
+	Ref         string `json:"ref"`
+	Old         string `json:"old"`
+	New         string `json:"new"`
+	FastForward bool   `json:"fast_forward"`
+}
+
+// Merge merges req.From into req.Into in the repository at repo (relative
+// to RepoRoot), fast-forwarding when it can. The branch is only updated if
+// it didn't move meanwhile. Like all changes the server makes itself, it
+// doesn't run the repository's receive hooks, but branches under legal
+// hold are refused.
+func (m *Manager) Merge(ctx context.Context, repo string, req MergeRequest) (MergeResult, error) {
+	_, full, err := m.resolve(repo)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	if !service.IsRepository(full) {
+		return MergeResult{}, ErrRepoNotFound
+	}
+	if service.Archived(full) {
+		return MergeResult{}, errcode.New(errcode.RepoArchived, "repository is archived")
+	}
+	ref := req.Into
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/heads/" + ref
+	}
+	if req.Into == "" || req.From == "" || strings.HasPrefix(req.From, "-") || exec.Command("git", "check-ref-format", ref).Run() != nil {
+		return MergeResult{}, errcode.New(errcode.InvalidRequest, "invalid branch")
+	}
+	if service.ReadLegalHold(full).Covers(ref) {
+		log.Printf("legal hold: refused merge of %s into %s in %s", req.From, ref, repo)
+		return MergeResult{}, service.ErrLegalHold
+	}
+	git := func(env []string, args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir=" + full}, args...)...)
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	old, err := git(nil, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return MergeResult{}, fmt.Errorf("%w: %s", ErrRevisionNotFound, req.Into)
+	}
+	from, err := git(nil, "rev-parse", "--verify", "--quiet", "--end-of-options", req.From+"^{commit}")
+	if err != nil {
+		return MergeResult{}, fmt.Errorf("%w: %s", ErrRevisionNotFound, req.From)
+	}
+	if err := EnsureCommitGraph(ctx, full); err != nil {
+		log.Printf("merge %s: %v", repo, err)
+	}
+	res := MergeResult{Ref: ref, Old: old, New: old}
+	if _, err := git(nil, "merge-base", "--is-ancestor", from, old); err == nil {
+		return res, nil
+	}
+	if _, err := git(nil, "merge-base", "--is-ancestor", old, from); err == nil {
+		res.New, res.FastForward = from, true
+	} else {
+		if req.FastForwardOnly {
+			return MergeResult{}, ErrNotFastForward
+		}
+		out, err := git(nil, "merge-tree", "--write-tree", "--name-only", "--no-messages", old, from)
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == 1 {
+			files := strings.Split(out, "\n")[1:]
+			return MergeResult{}, fmt.Errorf("%w in %s", ErrMergeConflict, strings.Join(files, ", "))
+		}
+		if err != nil {
+			return MergeResult{}, fmt.Errorf("git merge-tree: %w", err)
+		}
+		tree, _, _ := strings.Cut(out, "\n")
+		msg := req.Message
+		if msg == "" {
+			msg = fmt.Sprintf("Merge %s into %s", req.From, strings.TrimPrefix(ref, "refs/heads/"))
+		}
+		author := req.Author
+		if author == "" {
+			author = mergeCommitter
+		}
+		env, err := identityEnv("AUTHOR", author)
+		if err != nil {
+			return MergeResult{}, err
+		}
+		committer, _ := identityEnv("COMMITTER", mergeCommitter)
+		if res.New, err = git(append(env, committer...), "commit-tree", tree, "-p", old, "-p", from, "-m", msg); err != nil {
+			return MergeResult{}, fmt.Errorf("git commit-tree: %w", err)
+		}
+	}
+	if _, err := git(nil, "update-ref", "-m", "merge "+req.From, ref, res.New, old); err != nil {
+		return MergeResult{}, errcode.Errorf(errcode.Conflict, "%s moved during the merge", req.Into)
+	}
+	return res, nil
+}
+
+// identityEnv returns the git environment setting the name and email of
+// role, "AUTHOR" or "COMMITTER", from "Name <email>".
+func identityEnv(role, ident string) ([]string, error) {
+	name, email, ok := strings.Cut(ident, "<")
+	email, found := strings.CutSuffix(strings.TrimSpace(email), ">")
+	name = strings.TrimSpace(name)
+	if !ok || !found || name == "" || strings.ContainsAny(ident, "\n\x00") {
+		return nil, errcode.Errorf(errcode.InvalidRequest, "invalid identity %q, want \"Name <email>\"", ident)
+	}
+	return []string{"GIT_" + role + "_NAME=" + name, "GIT_" + role + "_EMAIL=" + email}, nil
+}
@@ -0,0 +1,105 @@
+package repoadmin
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// PersonalNamespaces lets users create repositories by pushing to them, but
+// only in their own namespace: a push by alice to alice/tool.git creates it,
+// while a push to bob/tool.git still fails as the repository doesn't exist.
+// Pushes by users into their namespace are held to its quotas.
+type PersonalNamespaces struct {
+	Manager *Manager
+	// MaxRepos caps the repositories in a namespace; zero means no limit.
+	MaxRepos int
+	// MaxSize caps the disk usage of a namespace in bytes; zero means no
+	// limit. A push may take a namespace past it, but no push into the
+	// namespace is accepted from then on.
+	MaxSize int64
+
+	// mu serializes the quota check and creation so concurrent pushes
+	// can't both take the last slot.
+	mu sync.Mutex
+}
+
+// PreparePush is called before user pushes to repo, a path relative to the
+// root. It creates repo if it is missing and belongs to user's namespace,
+// and refuses pushes into the namespace once it is over quota with
+// errcode.QuotaExceeded. It reports whether it created repo. Pushes by
+// anyone else, or by anonymous users, are left alone.
+func (p *PersonalNamespaces) PreparePush(user, repo string) (bool, error) {
+	if p == nil || user == "" {
+		return false, nil
+	}
+	rel, full, err := p.Manager.resolve(repo)
+	if err != nil {
+		return false, nil
+	}
+	owner, name, ok := strings.Cut(rel, "/")
+	if !ok || owner != user {
+		return false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ns := filepath.Join(filepath.Clean(p.Manager.RepoRoot), owner)
+	exists := service.IsRepository(full)
+	if p.MaxSize > 0 {
+		if size := dirSize(ns); size >= p.MaxSize {
+			return false, errcode.Errorf(errcode.QuotaExceeded, "namespace %s uses %d of its %d bytes", owner, size, p.MaxSize)
+		}
+	}
+	if exists {
+		return false, nil
+	}
+	if strings.Contains(name, "/") || !strings.HasSuffix(name, ".git") {
+		return false, fmt.Errorf("%w: repositories are created by push only at %s/<name>.git", ErrInvalidPath, owner)
+	}
+	if p.MaxRepos > 0 {
+		if n := countRepos(ns); n >= p.MaxRepos {
+			return false, errcode.Errorf(errcode.QuotaExceeded, "namespace %s has %d of its %d repositories", owner, n, p.MaxRepos)
+		}
+	}
+	if err := p.Manager.Create(rel); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// countRepos returns the number of repositories under dir, wikis included.
+func countRepos(dir string) int {
+	n := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == dir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if service.IsRepository(path) {
+			n++
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return n
+}
+
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,161 @@
+package repoadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const maxRedirectHops = 10
+
+// RedirectStore remembers where moved repositories went, so clients using an
+// old path are sent to the new one. Paths are relative to the repository root.
+// The file is read again when another process changes it, so gitsshd
+// follows the moves made through githttpd. The zero value keeps redirects
+// in memory only.
+type RedirectStore struct {
+	// Path is the JSON file redirects are persisted to.
+	Path string
+
+	mu        sync.RWMutex
+	redirects map[string]string
+	// modTime and size identify the file as last read or written.
+	modTime time.Time
+	size    int64
+}
+
+// Lookup follows redirects from repo and returns the final target.
+func (s *RedirectStore) Lookup(repo string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	target, ok := s.redirects[repo]
+	if !ok {
+		return "", false
+	}
+	for i := 0; i < maxRedirectHops; i++ {
+		next, ok := s.redirects[target]
+		if !ok {
+			break
+		}
+		target = next
+	}
+	return target, true
+}
+
+// All returns a copy of every redirect.
+func (s *RedirectStore) All() map[string]string {
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]string, len(s.redirects))
+	for from, to := range s.redirects {
+		out[from] = to
+	}
+	return out
+}
+
+// Add records that from now lives at to and persists the change. A redirect
+// away from to is dropped, since to is a real repository again.
+func (s *RedirectStore) Add(from, to string) error {
+	s.refresh()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.redirects == nil {
+		s.redirects = make(map[string]string)
+	}
+	s.redirects[from] = to
+	delete(s.redirects, to)
+	return s.saveLocked()
+}
+
+// Remove drops the redirect for from, e.g. when a new repository takes its place.
+func (s *RedirectStore) Remove(from string) error {
+	s.refresh()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.redirects[from]; !ok {
+		return nil
+	}
+	delete(s.redirects, from)
+	return s.saveLocked()
+}
+
+// Load reads persisted redirects. A missing file is not an error.
+func (s *RedirectStore) Load() error {
+	if s.Path == "" {
+		return nil
+	}
+	f, err := os.Open(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("load redirects: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("load redirects: %w", err)
+	}
+	redirects := make(map[string]string)
+	if err := json.NewDecoder(f).Decode(&redirects); err != nil {
+		return fmt.Errorf("load redirects: %w", err)
+	}
+	s.mu.Lock()
+	s.redirects, s.modTime, s.size = redirects, info.ModTime(), info.Size()
+	s.mu.Unlock()
+	return nil
+}
+
+// refresh reloads the file if it changed since it was last read or
+// written. The redirects known are kept if it can't be read.
+func (s *RedirectStore) refresh() {
+	if s.Path == "" {
+		return
+	}
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+	s.mu.RUnlock()
+	if changed {
+		if err := s.Load(); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+}
+
+func (s *RedirectStore) saveLocked() error {
+	if s.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.redirects, "", "  ")
+	if err != nil {
+		return fmt.Errorf("save redirects: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+		return fmt.Errorf("save redirects: %w", err)
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("save redirects: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("save redirects: %w", err)
+	}
+	if info, err := os.Stat(s.Path); err == nil {
+		s.modTime, s.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
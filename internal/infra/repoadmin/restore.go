@@ -0,0 +1,68 @@
+package repoadmin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// RestoreResult is the outcome of a restore. Old is empty when the ref
+// didn't exist, and equals New when it already pointed to the commit.
+type RestoreResult struct {
+	Ref string `json:"ref"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+}
+
+// RestoreRef points ref of the repository at repo (relative to RepoRoot)
+// back to the commit to, recreating the ref if it was deleted. ref is
+// only updated if it didn't move meanwhile. Like merges, restores don't
+// run the repository's receive hooks, but refs under legal hold are
+// refused. The commit must still be in the repository; gc prunes commits
+// unreachable for longer than gc.pruneExpire.
+func (m *Manager) RestoreRef(ctx context.Context, repo, ref, to string) (RestoreResult, error) {
+	_, full, err := m.resolve(repo)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	if !service.IsRepository(full) {
+		return RestoreResult{}, ErrRepoNotFound
+	}
+	if service.Archived(full) {
+		return RestoreResult{}, errcode.New(errcode.RepoArchived, "repository is archived")
+	}
+	if !strings.HasPrefix(ref, "refs/") || exec.Command("git", "check-ref-format", ref).Run() != nil {
+		return RestoreResult{}, errcode.New(errcode.InvalidRequest, "invalid ref")
+	}
+	if len(to) != 40 || strings.Trim(to, "0123456789abcdef") != "" {
+		return RestoreResult{}, errcode.New(errcode.InvalidRequest, "invalid commit, want a full object ID")
+	}
+	if service.ReadLegalHold(full).Covers(ref) {
+		log.Printf("legal hold: refused restore of %s to %s in %s", ref, to, repo)
+		return RestoreResult{}, service.ErrLegalHold
+	}
+	git := func(args ...string) (string, error) {
+		out, err := exec.CommandContext(ctx, "git", append([]string{"--git-dir=" + full}, args...)...).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	if _, err := git("cat-file", "-e", to+"^{commit}"); err != nil {
+		return RestoreResult{}, fmt.Errorf("%w: %s is no longer in the repository", ErrRevisionNotFound, to)
+	}
+	res := RestoreResult{Ref: ref, New: to}
+	expect := strings.Repeat("0", 40)
+	if res.Old, err = git("rev-parse", "--verify", "--quiet", ref); err == nil {
+		expect = res.Old
+	}
+	if res.Old == to {
+		return res, nil
+	}
+	if _, err := git("update-ref", "-m", "restore", ref, to, expect); err != nil {
+		return RestoreResult{}, errcode.Errorf(errcode.Conflict, "%s moved during the restore", ref)
+	}
+	return res, nil
+}
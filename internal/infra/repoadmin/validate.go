@@ -0,0 +1,82 @@
+package repoadmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// PackReport is the outcome of ValidatePack.
+type PackReport struct {
+	Valid    bool   `json:"valid"`
+	Objects  uint32 `json:"objects,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Error is git's explanation of why the pack was rejected.
+	Error string `json:"error,omitempty"`
+}
+
+// ValidatePack checks a pack as receive-pack would before accepting a push:
+// every object must be well formed, and objects the pack refers to must be
+// in it or in the repository at repoDir (thin packs are completed). The
+// pack is indexed into a temporary object directory and never becomes part
+// of the repository. A rejected pack is reported in PackReport, not as an
+// error.
+func ValidatePack(ctx context.Context, repoDir string, pack io.Reader) (PackReport, error) {
+	tmp, err := os.MkdirTemp("", "repocraft-validate-")
+	if err != nil {
+		return PackReport{}, fmt.Errorf("validate pack: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(filepath.Join(tmp, "pack"), 0o700); err != nil {
+		return PackReport{}, fmt.Errorf("validate pack: %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "index-pack", "--stdin", "--strict", "--fix-thin")
+	cmd.Dir = repoDir
+	cmd.Stdin = pack
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"GIT_DIR="+repoDir,
+		"GIT_OBJECT_DIRECTORY="+tmp,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES="+filepath.Join(repoDir, "objects"),
+	)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || ctx.Err() != nil {
+			return PackReport{}, fmt.Errorf("validate pack: %w", err)
+		}
+		return PackReport{Error: strings.TrimSpace(stderr.String())}, nil
+	}
+
+	// index-pack prints "pack\t<checksum>".
+	_, checksum, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\t")
+	objects, err := idxObjectCount(filepath.Join(tmp, "pack", "pack-"+checksum+".idx"))
+	if err != nil {
+		return PackReport{}, fmt.Errorf("validate pack: %w", err)
+	}
+	return PackReport{Valid: true, Objects: objects, Checksum: checksum}, nil
+}
+
+// idxObjectCount reads the object count from the last fan-out entry of a
+// version 2 pack index.
+func idxObjectCount(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var entry [4]byte
+	if _, err := f.ReadAt(entry[:], 8+255*4); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(entry[:]), nil
+}
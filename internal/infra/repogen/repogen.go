@@ -0,0 +1,377 @@
+// Package repogen generates synthetic bare repositories of a configurable
+// shape for tests and benchmarks. Generation is deterministic: the same
+// Shape always yields the same objects, down to their IDs, so performance
+// work can be reproduced on another machine.
+package repogen
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// epoch is the commit time of the first commit; later commits are a minute
+// apart. A fixed clock keeps the commit IDs the same across runs.
+const epoch = 1700000000
+
+// Shape describes a generated repository.
+type Shape struct {
+	// Commits is the length of the default branch's history, at least 1.
+	Commits int
+	// Branches is the number of branches besides the default one. Each
+	// forks off the default branch at a random commit and adds
+	// BranchCommits commits of its own.
+	Branches      int
+	BranchCommits int
+	// Files is the number of files of the first commit, at least 1. Later
+	// commits change one to three files and now and then add one.
+	Files int
+	// Blob sizes lie between MinBlobSize and MaxBlobSize bytes, each power
+	// of two in between equally likely, so most blobs are small and a few
+	// are large as in real repositories.
+	MinBlobSize int
+	MaxBlobSize int
+	// BinaryRatio is the fraction of files with binary content: random
+	// bytes that neither compress nor delta. The others are text whose
+	// changes touch a few lines, so they delta against earlier versions.
+	BinaryRatio float64
+	// Seed seeds the generator; different seeds give different
+	// repositories of the same shape.
+	Seed int64
+}
+
+func (s Shape) validate() error {
+	switch {
+	case s.Commits < 1:
+		return errors.New("at least one commit is needed")
+	case s.Files < 1:
+		return errors.New("at least one file is needed")
+	case s.Branches < 0 || s.BranchCommits < 0:
+		return errors.New("branches and branch commits can't be negative")
+	case s.MinBlobSize < 0 || s.MaxBlobSize < s.MinBlobSize:
+		return errors.New("blob sizes must satisfy 0 <= min <= max")
+	case s.BinaryRatio < 0 || s.BinaryRatio > 1:
+		return errors.New("binary ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Summary counts what was generated.
+type Summary struct {
+	Commits     int   `json:"commits"`
+	Branches    int   `json:"branches"`
+	Blobs       int   `json:"blobs"`
+	BinaryBlobs int   `json:"binary_blobs"`
+	BlobBytes   int64 `json:"blob_bytes"`
+}
+
+// Generator writes repositories of a Shape with git fast-import.
+type Generator struct {
+	Shape
+	// Branch names the default branch; defaults to "main". The other
+	// branches are named "branch-1", "branch-2" and so on.
+	Branch  string
+	GitPath string
+}
+
+// Generate creates the repository as a new bare repository at dir, which
+// must not exist. A failed generation removes dir again.
+func (g *Generator) Generate(ctx context.Context, dir string) (Summary, error) {
+	if err := g.Shape.validate(); err != nil {
+		return Summary{}, err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return Summary{}, fmt.Errorf("%s already exists", dir)
+	}
+	sum, err := g.generate(ctx, dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+	}
+	return sum, err
+}
+
+func (g *Generator) generate(ctx context.Context, dir string) (Summary, error) {
+	if out, err := exec.CommandContext(ctx, g.gitPath(), "init", "--quiet", "--bare", "--initial-branch="+g.branch(), dir).CombinedOutput(); err != nil {
+		return Summary{}, fmt.Errorf("git init: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	cmd := exec.CommandContext(ctx, g.gitPath(), "-C", dir, "fast-import", "--quiet")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return Summary{}, err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return Summary{}, err
+	}
+	w := &writer{
+		shape:  g.Shape,
+		branch: g.branch(),
+		rng:    rand.New(rand.NewSource(g.Seed)),
+		bw:     bufio.NewWriterSize(stdin, 1<<20),
+	}
+	werr := w.write(ctx)
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return Summary{}, fmt.Errorf("git fast-import: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if werr != nil {
+		return Summary{}, werr
+	}
+	return w.sum, nil
+}
+
+func (g *Generator) branch() string {
+	if g.Branch != "" {
+		return g.Branch
+	}
+	return "main"
+}
+
+func (g *Generator) gitPath() string {
+	if g.GitPath != "" {
+		return g.GitPath
+	}
+	return "git"
+}
+
+// file is a file of the tree being built. Text files keep their lines so
+// changes can edit them.
+type file struct {
+	path   string
+	binary bool
+	lines  []string
+}
+
+// change is a file's new content in a commit.
+type change struct {
+	path    string
+	content []byte
+}
+
+// writer streams the history in fast-import format. Every random choice is
+// drawn from rng in a fixed order, which makes the output deterministic.
+type writer struct {
+	shape  Shape
+	branch string
+	rng    *rand.Rand
+	bw     *bufio.Writer
+	mark   int
+	added  int
+	sum    Summary
+}
+
+func (w *writer) write(ctx context.Context) error {
+	forks := make(map[int][]int)
+	for b := 1; b <= w.shape.Branches; b++ {
+		at := 1 + w.rng.Intn(w.shape.Commits)
+		forks[at] = append(forks[at], b)
+	}
+
+	var files []*file
+	parent := 0
+	for c := 1; c <= w.shape.Commits; c++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var changes []change
+		msg := "Initial commit"
+		if c == 1 {
+			for i := 0; i < w.shape.Files; i++ {
+				f, ch := w.add()
+				files = append(files, f)
+				changes = append(changes, ch)
+			}
+		} else {
+			files, changes = w.evolve(files)
+			msg = "Update " + changes[0].path
+		}
+		parent = w.commit(w.branch, parent, msg, changes)
+
+		for _, b := range forks[c] {
+			w.fork(fmt.Sprintf("branch-%d", b), parent, files)
+		}
+	}
+	return w.bw.Flush()
+}
+
+// fork writes a branch off the commit at mark, whose tree holds files.
+func (w *writer) fork(name string, mark int, files []*file) {
+	w.sum.Branches++
+	if w.shape.BranchCommits == 0 {
+		fmt.Fprintf(w.bw, "reset refs/heads/%s\nfrom :%d\n\n", name, mark)
+		return
+	}
+	own := make([]*file, len(files))
+	for i, f := range files {
+		cp := *f
+		cp.lines = append([]string(nil), f.lines...)
+		own[i] = &cp
+	}
+	for i := 0; i < w.shape.BranchCommits; i++ {
+		var changes []change
+		own, changes = w.evolve(own)
+		mark = w.commit(name, mark, fmt.Sprintf("Update %s on %s", changes[0].path, name), changes)
+	}
+}
+
+// evolve changes one to three files and, one time in ten, adds one.
+func (w *writer) evolve(files []*file) ([]*file, []change) {
+	n := 1 + w.rng.Intn(3)
+	if n > len(files) {
+		n = len(files)
+	}
+	var picked []int
+	for len(picked) < n {
+		if i := w.rng.Intn(len(files)); !contains(picked, i) {
+			picked = append(picked, i)
+		}
+	}
+	var changes []change
+	for _, i := range picked {
+		changes = append(changes, w.edit(files[i]))
+	}
+	if w.rng.Intn(10) == 0 {
+		f, ch := w.add()
+		files = append(files, f)
+		changes = append(changes, ch)
+	}
+	return files, changes
+}
+
+// add makes a new file.
+func (w *writer) add() (*file, change) {
+	i := w.added
+	w.added++
+	f := &file{binary: w.rng.Float64() < w.shape.BinaryRatio}
+	if f.binary {
+		f.path = fmt.Sprintf("assets/%02d/blob-%d.bin", i%32, i)
+		return f, change{f.path, w.binaryContent()}
+	}
+	f.path = fmt.Sprintf("src/%02d/file-%d.txt", i%32, i)
+	size := w.size()
+	for n := 0; n < size; {
+		l := w.line()
+		f.lines = append(f.lines, l)
+		n += len(l) + 1
+	}
+	return f, change{f.path, text(f.lines)}
+}
+
+// edit changes a file: binary files are rewritten, while a tenth of the
+// lines of text files are replaced, inserted or deleted.
+func (w *writer) edit(f *file) change {
+	if f.binary {
+		return change{f.path, w.binaryContent()}
+	}
+	for n := 1 + len(f.lines)/10; n > 0; n-- {
+		if len(f.lines) == 0 {
+			f.lines = append(f.lines, w.line())
+			continue
+		}
+		at := w.rng.Intn(len(f.lines))
+		switch w.rng.Intn(3) {
+		case 0:
+			f.lines[at] = w.line()
+		case 1:
+			f.lines = append(f.lines[:at], append([]string{w.line()}, f.lines[at:]...)...)
+		default:
+			f.lines = append(f.lines[:at], f.lines[at+1:]...)
+		}
+	}
+	return change{f.path, text(f.lines)}
+}
+
+// commit writes a commit of changes on top of parent, or a root commit if
+// parent is zero, and returns its mark.
+func (w *writer) commit(branch string, parent int, msg string, changes []change) int {
+	w.mark++
+	w.sum.Commits++
+	msg += "\n"
+	fmt.Fprintf(w.bw, "commit refs/heads/%s\nmark :%d\n", branch, w.mark)
+	fmt.Fprintf(w.bw, "committer repogen <repogen@example.com> %d +0000\n", epoch+60*w.mark)
+	fmt.Fprintf(w.bw, "data %d\n%s", len(msg), msg)
+	if parent > 0 {
+		fmt.Fprintf(w.bw, "from :%d\n", parent)
+	}
+	for _, ch := range changes {
+		fmt.Fprintf(w.bw, "M 100644 inline %s\ndata %d\n", ch.path, len(ch.content))
+		w.bw.Write(ch.content)
+		w.bw.WriteString("\n")
+		w.sum.Blobs++
+		w.sum.BlobBytes += int64(len(ch.content))
+		if strings.HasSuffix(ch.path, ".bin") {
+			w.sum.BinaryBlobs++
+		}
+	}
+	w.bw.WriteString("\n")
+	return w.mark
+}
+
+// size picks a blob size. It is drawn with integers only, as floating
+// point functions may round differently across architectures.
+func (w *writer) size() int {
+	lo, hi := w.shape.MinBlobSize, w.shape.MaxBlobSize
+	if lo == hi {
+		return lo
+	}
+	// Pick a power of two, then a size within it.
+	lb, hb := bits.Len(uint(lo)), bits.Len(uint(hi))
+	b := lb + w.rng.Intn(hb-lb+1)
+	from, to := 0, 1
+	if b > 0 {
+		from, to = 1<<(b-1), 1<<b
+	}
+	from, to = max(from, lo), min(to-1, hi)
+	return from + w.rng.Intn(to-from+1)
+}
+
+// binaryContent makes random bytes. The leading NUL makes git treat them
+// as binary even when short.
+func (w *writer) binaryContent() []byte {
+	content := make([]byte, w.size())
+	w.rng.Read(content)
+	if len(content) > 0 {
+		content[0] = 0
+	}
+	return content
+}
+
+var words = strings.Fields(`the a of to in is for on with as repository commit tree blob
+	pack index ref branch tag merge fetch push clone object delta graph remote
+	server client config hook update return if else range func var const type
+	struct error nil true false string int byte map slice channel select`)
+
+// line makes a line of three to twelve words.
+func (w *writer) line() string {
+	n := 3 + w.rng.Intn(10)
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = words[w.rng.Intn(len(words))]
+	}
+	return strings.Join(parts, " ")
+}
+
+func text(lines []string) []byte {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+func contains(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
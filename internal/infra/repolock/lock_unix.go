@@ -0,0 +1,46 @@
+//go:build unix
+
+package repolock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFile takes an flock on the file at path, creating it: exclusive or
+// shared, and waiting for it only if wait is set. It fails with errLocked
+// when it would have to wait.
+func lockFile(path string, exclusive, wait bool) (unlock func(), err error) {
+	// Only the lock directory is created, never the repository.
+	if err := os.Mkdir(filepath.Dir(path), 0o755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
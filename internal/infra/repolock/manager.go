@@ -0,0 +1,160 @@
+// Package repolock tracks work in progress on repositories so heavy
+// maintenance stays out of the way of pushes.
+package repolock
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+// Lock files in the repository's repocraft directory. Pushes hold a shared
+// lock on pushLock, and maintenance an exclusive one on maintenanceLock,
+// so that daemons serving the same repositories, such as githttpd and
+// gitsshd, see each other's work.
+const (
+	pushLock        = "repocraft/push.lock"
+	maintenanceLock = "repocraft/maintenance.lock"
+)
+
+var errLocked = errors.New("locked")
+
+// Manager tracks active pushes and maintenance runs per repository, keyed by
+// the repository's directory. Pushes never wait; maintenance is only started
+// while no push is active, in this process or another one. The zero value
+// is ready to use and a nil Manager tracks nothing.
+type Manager struct {
+	mu    sync.Mutex
+	repos map[string]*state
+}
+
+type state struct {
+	pushes      int
+	maintenance bool
+}
+
+// BeginPush marks a push to repoPath as active until done is called.
+func (m *Manager) BeginPush(repoPath string) (done func()) {
+	if m == nil {
+		return func() {}
+	}
+	key := filepath.Clean(repoPath)
+	m.mu.Lock()
+	m.stateLocked(key).pushes++
+	m.mu.Unlock()
+	// Maintenance only holds the lock exclusively for an instant; a push to
+	// a repository the lock file can't be created in is only tracked here.
+	unlock, err := lockFile(lockPath(key, pushLock), false, true)
+	if err != nil {
+		unlock = func() {}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unlock()
+			m.mu.Lock()
+			st := m.repos[key]
+			st.pushes--
+			m.releaseLocked(key, st)
+			m.mu.Unlock()
+		})
+	}
+}
+
+// TryMaintenance claims repoPath for maintenance. It fails while another
+// maintenance run is active and, unless force is set, while a push is active.
+func (m *Manager) TryMaintenance(repoPath string, force bool) (done func(), ok bool) {
+	if m == nil {
+		return func() {}, true
+	}
+	key := filepath.Clean(repoPath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.stateLocked(key)
+	if st.maintenance || (st.pushes > 0 && !force) {
+		m.releaseLocked(key, st)
+		return nil, false
+	}
+	unlock, ok := tryLocks(key, force)
+	if !ok {
+		m.releaseLocked(key, st)
+		return nil, false
+	}
+	st.maintenance = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unlock()
+			m.mu.Lock()
+			st := m.repos[key]
+			st.maintenance = false
+			m.releaseLocked(key, st)
+			m.mu.Unlock()
+		})
+	}, true
+}
+
+// tryLocks takes the maintenance lock of the repository at key and, unless
+// force is set, makes sure no other process is pushing to it. Repositories
+// the lock files can't be created in are only tracked in this process.
+func tryLocks(key string, force bool) (unlock func(), ok bool) {
+	unlock, err := lockFile(lockPath(key, maintenanceLock), true, false)
+	if errors.Is(err, errLocked) {
+		return nil, false
+	}
+	if err != nil {
+		unlock = func() {}
+	}
+	if force {
+		return unlock, true
+	}
+	// Pushes that start from now on run alongside maintenance, as they do
+	// within a process.
+	pushes, err := lockFile(lockPath(key, pushLock), true, false)
+	if errors.Is(err, errLocked) {
+		unlock()
+		return nil, false
+	}
+	if err == nil {
+		pushes()
+	}
+	return unlock, true
+}
+
+func lockPath(repoPath, name string) string {
+	return filepath.Join(repoPath, filepath.FromSlash(name))
+}
+
+// ActivePushes returns the number of pushes to repoPath in progress in
+// this process.
+func (m *Manager) ActivePushes(repoPath string) int {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st, ok := m.repos[filepath.Clean(repoPath)]; ok {
+		return st.pushes
+	}
+	return 0
+}
+
+func (m *Manager) stateLocked(key string) *state {
+	if m.repos == nil {
+		m.repos = make(map[string]*state)
+	}
+	st, ok := m.repos[key]
+	if !ok {
+		st = &state{}
+		m.repos[key] = st
+	}
+	return st
+}
+
+func (m *Manager) releaseLocked(key string, st *state) {
+	if st.pushes == 0 && !st.maintenance {
+		delete(m.repos, key)
+	}
+}
@@ -0,0 +1,45 @@
+// Package repomatch picks the most specific of the path.Match patterns
+// configuration files key repository settings by.
+package repomatch
+
+import (
+	"path"
+	"strings"
+)
+
+// Best returns the value of the pattern of m that matches repo most
+// specifically, and whether any pattern matches. The longest pattern wins;
+// of patterns as long, the one with fewer wildcards, and then the one
+// sorting first, so that the same pattern always wins.
+func Best[V any](m map[string]V, repo string) (V, bool) {
+	repo = strings.Trim(repo, "/")
+	var (
+		best  string
+		value V
+		found bool
+	)
+	for pattern, v := range m {
+		if ok, _ := path.Match(pattern, repo); !ok {
+			continue
+		}
+		if !found || moreSpecific(pattern, best) {
+			best, value, found = pattern, v, true
+		}
+	}
+	return value, found
+}
+
+// moreSpecific reports whether pattern a wins over pattern b.
+func moreSpecific(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	if wa, wb := wildcards(a), wildcards(b); wa != wb {
+		return wa < wb
+	}
+	return a < b
+}
+
+func wildcards(pattern string) int {
+	return strings.Count(pattern, "*") + strings.Count(pattern, "?") + strings.Count(pattern, "[")
+}
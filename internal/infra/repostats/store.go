@@ -0,0 +1,352 @@
+// Package repostats records per-repository read/write activity.
+package repostats
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the per-repository set of distinct clients.
+// Beyond it UniqueClients saturates instead of growing without limit.
+const maxTrackedClients = 4096
+
+// Operation is the kind of activity being recorded.
+type Operation string
+
+const (
+	OperationFetch Operation = "fetch"
+	OperationPush  Operation = "push"
+)
+
+// RepoStats holds the counters for one repository.
+type RepoStats struct {
+	Repo          string    `json:"repo"`
+	FetchCount    int64     `json:"fetch_count"`
+	PushCount     int64     `json:"push_count"`
+	UniqueClients int       `json:"unique_clients"`
+	LastFetch     time.Time `json:"last_fetch,omitempty"`
+	LastPush      time.Time `json:"last_push,omitempty"`
+	// HourlyActivity counts fetches and pushes by hour of day (UTC).
+	HourlyActivity [24]int64 `json:"hourly_activity"`
+}
+
+// LastActivity returns the most recent fetch or push time.
+func (s RepoStats) LastActivity() time.Time {
+	if s.LastPush.After(s.LastFetch) {
+		return s.LastPush
+	}
+	return s.LastFetch
+}
+
+// QuietHour returns the hour of day (UTC) with the least recorded activity,
+// the earliest one on ties.
+func (s RepoStats) QuietHour() int {
+	quiet := 0
+	for h, n := range s.HourlyActivity {
+		if n < s.HourlyActivity[quiet] {
+			quiet = h
+		}
+	}
+	return quiet
+}
+
+type repoEntry struct {
+	RepoStats
+	Clients map[string]struct{} `json:"clients"`
+}
+
+// Store accumulates statistics in memory and persists them to Path.
+// The zero value keeps statistics in memory only.
+type Store struct {
+	// Path is the JSON file statistics are loaded from and flushed to.
+	Path string
+	// Peers are the files other daemons serving the same repositories
+	// flush their statistics to, such as gitsshd's for githttpd. Get, All
+	// and Top add them in, reading them again when they change.
+	Peers []string
+	// FlushInterval controls how often Run persists; defaults to one minute.
+	FlushInterval time.Duration
+
+	mu    sync.Mutex
+	repos map[string]*repoEntry
+	dirty bool
+	peers map[string]*peerFile
+}
+
+// peerFile is a file of Peers as last read.
+type peerFile struct {
+	modTime time.Time
+	size    int64
+	entries []*repoEntry
+}
+
+// Record counts one operation on repo by client (e.g. a key fingerprint or
+// remote IP). Client identifiers are hashed before being stored.
+func (s *Store) Record(repo string, op Operation, client string, at time.Time) {
+	if s == nil || repo == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repos == nil {
+		s.repos = make(map[string]*repoEntry)
+	}
+	e, ok := s.repos[repo]
+	if !ok {
+		e = &repoEntry{RepoStats: RepoStats{Repo: repo}, Clients: make(map[string]struct{})}
+		s.repos[repo] = e
+	}
+
+	switch op {
+	case OperationFetch:
+		e.FetchCount++
+		e.LastFetch = at.UTC()
+	case OperationPush:
+		e.PushCount++
+		e.LastPush = at.UTC()
+	}
+	e.HourlyActivity[at.UTC().Hour()]++
+	if client != "" && len(e.Clients) < maxTrackedClients {
+		sum := sha256.Sum256([]byte(client))
+		e.Clients[hex.EncodeToString(sum[:8])] = struct{}{}
+		e.UniqueClients = len(e.Clients)
+	}
+	s.dirty = true
+}
+
+// Get returns the statistics for repo.
+func (s *Store) Get(repo string) (RepoStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Peers) == 0 {
+		e, ok := s.repos[repo]
+		if !ok {
+			return RepoStats{}, false
+		}
+		return e.RepoStats, true
+	}
+	st, ok := s.mergedLocked()[repo]
+	return st, ok
+}
+
+// All returns the statistics of every known repository, least recently
+// active first, which puts archiving candidates at the top.
+func (s *Store) All() []RepoStats {
+	s.mu.Lock()
+	out := make([]RepoStats, 0, len(s.repos))
+	if len(s.Peers) == 0 {
+		for _, e := range s.repos {
+			out = append(out, e.RepoStats)
+		}
+	} else {
+		for _, st := range s.mergedLocked() {
+			out = append(out, st)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].LastActivity().Before(out[j].LastActivity())
+	})
+	return out
+}
+
+// Top returns the statistics of the n busiest repositories by fetches and
+// pushes combined, busiest first.
+func (s *Store) Top(n int) []RepoStats {
+	out := s.All()
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].FetchCount+out[i].PushCount > out[j].FetchCount+out[j].PushCount
+	})
+	if n >= 0 && n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+// mergedLocked returns the statistics of every repository, adding up
+// those of Path and Peers. s.mu must be held.
+func (s *Store) mergedLocked() map[string]RepoStats {
+	out := make(map[string]RepoStats, len(s.repos))
+	clients := make(map[string]map[string]struct{})
+	add := func(e *repoEntry) {
+		st, ok := out[e.Repo]
+		if !ok {
+			st = RepoStats{Repo: e.Repo}
+			clients[e.Repo] = make(map[string]struct{})
+		}
+		st.FetchCount += e.FetchCount
+		st.PushCount += e.PushCount
+		if e.LastFetch.After(st.LastFetch) {
+			st.LastFetch = e.LastFetch
+		}
+		if e.LastPush.After(st.LastPush) {
+			st.LastPush = e.LastPush
+		}
+		for h, n := range e.HourlyActivity {
+			st.HourlyActivity[h] += n
+		}
+		seen := clients[e.Repo]
+		for c := range e.Clients {
+			if len(seen) >= maxTrackedClients {
+				break
+			}
+			seen[c] = struct{}{}
+		}
+		st.UniqueClients = len(seen)
+		out[e.Repo] = st
+	}
+	for _, e := range s.repos {
+		add(e)
+	}
+	for _, path := range s.Peers {
+		for _, e := range s.peerLocked(path) {
+			add(e)
+		}
+	}
+	return out
+}
+
+// peerLocked returns the entries of the peer file at path, reading it
+// again if it changed. A missing or unreadable file has none. s.mu must
+// be held.
+func (s *Store) peerLocked(path string) []*repoEntry {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	p := s.peers[path]
+	if p != nil && p.modTime.Equal(info.ModTime()) && p.size == info.Size() {
+		return p.entries
+	}
+	entries, err := readEntries(path)
+	if err != nil {
+		log.Printf("repo stats: %v", err)
+		if p != nil {
+			return p.entries
+		}
+		return nil
+	}
+	if s.peers == nil {
+		s.peers = make(map[string]*peerFile)
+	}
+	s.peers[path] = &peerFile{modTime: info.ModTime(), size: info.Size(), entries: entries}
+	return entries
+}
+
+// Rename moves the statistics of oldRepo to newRepo.
+func (s *Store) Rename(oldRepo, newRepo string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.repos[oldRepo]
+	if !ok {
+		return
+	}
+	delete(s.repos, oldRepo)
+	e.Repo = newRepo
+	s.repos[newRepo] = e
+	s.dirty = true
+}
+
+// Load reads previously persisted statistics. A missing file is not an error.
+func (s *Store) Load() error {
+	if s.Path == "" {
+		return nil
+	}
+	entries, err := readEntries(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos = make(map[string]*repoEntry, len(entries))
+	for _, e := range entries {
+		if e.Clients == nil {
+			e.Clients = make(map[string]struct{})
+		}
+		s.repos[e.Repo] = e
+	}
+	return nil
+}
+
+// readEntries reads a file of statistics Flush wrote.
+func readEntries(path string) ([]*repoEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load repo stats: %w", err)
+	}
+	var entries []*repoEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("load repo stats %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// Flush writes the statistics to Path if anything changed since the last flush.
+func (s *Store) Flush() error {
+	if s.Path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	entries := make([]*repoEntry, 0, len(s.repos))
+	for _, e := range s.repos {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("flush repo stats: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+		return fmt.Errorf("flush repo stats: %w", err)
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("flush repo stats: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("flush repo stats: %w", err)
+	}
+	return nil
+}
+
+// Run flushes periodically until ctx is cancelled, then flushes once more.
+func (s *Store) Run(ctx context.Context) error {
+	interval := s.FlushInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return s.Flush()
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("repo stats: %v", err)
+			}
+		}
+	}
+}
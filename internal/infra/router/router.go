@@ -0,0 +1,379 @@
+// Package router fronts several storage nodes holding the same repositories.
+// Pushes go to the primary; fetches are spread over healthy nodes whose refs
+// match the primary's.
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/discovery"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/pktline"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/replication"
+)
+
+// Node is one storage node serving Git Smart HTTP and the JSON API.
+type Node = discovery.Node
+
+// Router is an http.Handler that proxies to storage nodes. Exactly one node
+// must be the primary.
+type Router struct {
+	// Nodes is the static node list, used when Discovery is nil.
+	Nodes []Node
+	// Discovery, if set, is queried on every health check interval and the
+	// routing table is replaced with its answer.
+	Discovery discovery.Discoverer
+	// HealthPath is requested on every node to check it; any response below
+	// 500 counts as healthy. Defaults to "/".
+	HealthPath string
+	// HealthInterval is the time between health checks; defaults to five seconds.
+	HealthInterval time.Duration
+	// FreshnessTTL is how long a replica's agreement with the primary on a
+	// repository's refs is trusted; defaults to two seconds.
+	FreshnessTTL time.Duration
+	// Client is used for health and freshness checks; defaults to a client
+	// with a five second timeout.
+	Client *http.Client
+
+	once sync.Once
+	next atomic.Uint64
+
+	mu      sync.Mutex
+	nodes   []*node
+	primary *node
+	fresh   map[string]freshness // repo -> nodes agreeing with the primary
+}
+
+type node struct {
+	Node
+	url     *url.URL
+	proxy   *httputil.ReverseProxy
+	healthy atomic.Bool
+}
+
+type freshness struct {
+	at    time.Time
+	nodes []*node
+}
+
+// Validate checks the static node configuration.
+func (rt *Router) Validate() error {
+	if rt.Discovery != nil {
+		return nil
+	}
+	return validateNodes(rt.Nodes)
+}
+
+func validateNodes(nodes []Node) error {
+	primaries := 0
+	for _, n := range nodes {
+		if _, err := url.Parse(n.URL); err != nil {
+			return fmt.Errorf("node %q: %w", n.URL, err)
+		}
+		if n.Primary {
+			primaries++
+		}
+	}
+	if primaries != 1 {
+		return fmt.Errorf("exactly one primary node required, got %d", primaries)
+	}
+	return nil
+}
+
+func (rt *Router) init() {
+	rt.once.Do(func() {
+		if rt.Discovery == nil {
+			rt.setNodes(rt.Nodes)
+		}
+	})
+}
+
+// setNodes replaces the routing table. Nodes that stay keep their health.
+func (rt *Router) setNodes(nodes []Node) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	existing := make(map[Node]*node, len(rt.nodes))
+	for _, nd := range rt.nodes {
+		existing[nd.Node] = nd
+	}
+	if len(nodes) == len(rt.nodes) {
+		same := true
+		for _, n := range nodes {
+			if existing[n] == nil {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+	}
+	log.Printf("router: routing to %d storage nodes", len(nodes))
+	rt.nodes, rt.primary = nil, nil
+	for _, n := range nodes {
+		nd, ok := existing[n]
+		if !ok {
+			var err error
+			if nd, err = newNode(n); err != nil {
+				log.Printf("router: %v", err)
+				continue
+			}
+		}
+		rt.nodes = append(rt.nodes, nd)
+		if n.Primary && rt.primary == nil {
+			rt.primary = nd
+		}
+	}
+	rt.fresh = nil
+}
+
+func newNode(n Node) (*node, error) {
+	u, err := url.Parse(strings.TrimRight(n.URL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("node %q: %w", n.URL, err)
+	}
+	nd := &node{Node: n, url: u}
+	nd.proxy = httputil.NewSingleHostReverseProxy(u)
+	// Stream pack data as it arrives.
+	nd.proxy.FlushInterval = -1
+	nd.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("router: %s %s via %s: %v", r.Method, r.URL.Path, u, err)
+		nd.healthy.Store(false)
+		http.Error(w, "storage node unavailable", http.StatusBadGateway)
+	}
+	// Nodes start healthy until the first check says otherwise.
+	nd.healthy.Store(true)
+	return nd, nil
+}
+
+func (rt *Router) snapshot() ([]*node, *node) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.nodes, rt.primary
+}
+
+// ServeHTTP routes pushes and API calls to the primary and fetches to an
+// up-to-date node.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.init()
+	nodes, primary := rt.snapshot()
+	if primary == nil {
+		http.Error(w, "no primary node configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	repo, read := classify(r)
+	if !read {
+		if !primary.healthy.Load() {
+			http.Error(w, "primary storage node unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		primary.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	nd := rt.pickReader(r.Context(), repo, nodes, primary)
+	if nd == nil {
+		http.Error(w, "no storage node available", http.StatusServiceUnavailable)
+		return
+	}
+	nd.proxy.ServeHTTP(w, r)
+}
+
+// classify returns the repository of a fetch request and whether the request
+// only reads. Pushes and everything outside Git Smart HTTP count as writes.
+func classify(r *http.Request) (string, bool) {
+	path := r.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/info/refs"):
+		if r.URL.Query().Get("service") != "git-upload-pack" {
+			return "", false
+		}
+		return strings.TrimSuffix(path, "/info/refs"), true
+	case strings.HasSuffix(path, "/git-upload-pack"):
+		return strings.TrimSuffix(path, "/git-upload-pack"), true
+	case strings.HasSuffix(path, "/git-upload-archive"):
+		return strings.TrimSuffix(path, "/git-upload-archive"), true
+	default:
+		return "", false
+	}
+}
+
+// pickReader returns a healthy node that agrees with the primary on repo's
+// refs, rotating between candidates. Without a healthy primary any healthy
+// node serves reads.
+func (rt *Router) pickReader(ctx context.Context, repo string, nodes []*node, primary *node) *node {
+	var candidates []*node
+	if primary.healthy.Load() {
+		for _, nd := range rt.freshNodes(ctx, repo, nodes, primary) {
+			if nd.healthy.Load() {
+				candidates = append(candidates, nd)
+			}
+		}
+	} else {
+		for _, nd := range nodes {
+			if nd.healthy.Load() {
+				candidates = append(candidates, nd)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rt.next.Add(1)%uint64(len(candidates))]
+}
+
+// freshNodes returns the primary and the replicas whose advertised refs for
+// repo match the primary's, caching the answer for FreshnessTTL.
+func (rt *Router) freshNodes(ctx context.Context, repo string, all []*node, primary *node) []*node {
+	ttl := rt.FreshnessTTL
+	if ttl <= 0 {
+		ttl = 2 * time.Second
+	}
+	now := time.Now()
+	rt.mu.Lock()
+	f, ok := rt.fresh[repo]
+	rt.mu.Unlock()
+	if ok && now.Sub(f.at) < ttl {
+		return f.nodes
+	}
+
+	nodes := []*node{primary}
+	want, err := rt.checksum(ctx, primary, repo)
+	if err == nil {
+		for _, nd := range all {
+			if nd == primary || !nd.healthy.Load() {
+				continue
+			}
+			if got, err := rt.checksum(ctx, nd, repo); err == nil && got == want {
+				nodes = append(nodes, nd)
+			}
+		}
+	}
+
+	rt.mu.Lock()
+	if rt.fresh == nil {
+		rt.fresh = make(map[string]freshness)
+	}
+	rt.fresh[repo] = freshness{at: now, nodes: nodes}
+	rt.mu.Unlock()
+	return nodes
+}
+
+// checksum computes the replication checksum of the refs nd advertises for repo.
+func (rt *Router) checksum(ctx context.Context, nd *node, repo string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nd.url.String()+repo+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := rt.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("info/refs: %s", resp.Status)
+	}
+
+	refs := make(map[string]string)
+	pr := pktline.NewReader(resp.Body)
+	for {
+		pkt, err := pr.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if pkt.Type != pktline.Data {
+			continue
+		}
+		line, _, _ := strings.Cut(strings.TrimSuffix(string(pkt.Payload), "\n"), "\x00")
+		oid, name, ok := strings.Cut(line, " ")
+		if ok && strings.HasPrefix(name, "refs/") && !strings.HasSuffix(name, "^{}") {
+			refs[name] = oid
+		}
+	}
+	return replication.Checksum(refs), nil
+}
+
+// Run refreshes the nodes from Discovery and checks their health every
+// HealthInterval until ctx is cancelled.
+func (rt *Router) Run(ctx context.Context) error {
+	rt.init()
+	interval := rt.HealthInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rt.discover(ctx)
+		rt.checkHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rt *Router) discover(ctx context.Context) {
+	if rt.Discovery == nil {
+		return
+	}
+	nodes, err := rt.Discovery.Discover(ctx)
+	if err == nil {
+		err = validateNodes(nodes)
+	}
+	if err != nil {
+		log.Printf("router: discovery: %v", err)
+		return
+	}
+	rt.setNodes(nodes)
+}
+
+func (rt *Router) checkHealth(ctx context.Context) {
+	path := rt.HealthPath
+	if path == "" {
+		path = "/"
+	}
+	nodes, _ := rt.snapshot()
+	var wg sync.WaitGroup
+	for _, nd := range nodes {
+		wg.Add(1)
+		go func(nd *node) {
+			defer wg.Done()
+			healthy := false
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, nd.url.String()+path, nil)
+			if err == nil {
+				if resp, err := rt.client().Do(req); err == nil {
+					resp.Body.Close()
+					healthy = resp.StatusCode < 500
+				}
+			}
+			if was := nd.healthy.Swap(healthy); was != healthy && ctx.Err() == nil {
+				log.Printf("router: node %s healthy=%t", nd.url, healthy)
+			}
+		}(nd)
+	}
+	wg.Wait()
+}
+
+func (rt *Router) client() *http.Client {
+	if rt.Client != nil {
+		return rt.Client
+	}
+	return defaultClient
+}
+
+var defaultClient = &http.Client{Timeout: 5 * time.Second}
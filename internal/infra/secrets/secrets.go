@@ -0,0 +1,98 @@
+// Package secrets loads keys and tokens, such as SSH host keys, TLS keys
+// and token-signing keys, from pluggable providers instead of flat files,
+// and notifies their users when a secret is rotated.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by providers for secrets they don't hold.
+var ErrNotFound = errors.New("secret not found")
+
+// Provider returns the current value of a named secret, e.g.
+// "ssh-host-key" or "fetch-token-key".
+type Provider interface {
+	Secret(ctx context.Context, name string) ([]byte, error)
+}
+
+// Env reads secrets from environment variables: "fetch-token-key" is read
+// from Prefix + "FETCH_TOKEN_KEY".
+type Env struct {
+	Prefix string
+}
+
+// Secret implements Provider.
+func (e Env) Secret(_ context.Context, name string) ([]byte, error) {
+	key := e.Prefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_", "/", "_").Replace(name))
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil, ErrNotFound
+	}
+	return []byte(v), nil
+}
+
+// Files reads each secret from the file of the same name in Dir, as
+// mounted by Kubernetes secrets or systemd credentials.
+type Files struct {
+	Dir string
+}
+
+// Secret implements Provider.
+func (f Files) Secret(_ context.Context, name string) ([]byte, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid secret name %q", name)
+	}
+	b, err := os.ReadFile(filepath.Join(f.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+// Parse returns the provider described by spec:
+//
+//	env:PREFIX_           environment variables with the given prefix
+//	file:/run/secrets     one file per secret
+//	vault:https://vault   HashiCorp Vault KV v2, token from VAULT_TOKEN
+//	aws:us-east-1         AWS Secrets Manager, credentials from AWS_* variables
+func Parse(spec string) (Provider, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	switch kind {
+	case "env":
+		return Env{Prefix: arg}, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file secrets need a directory")
+		}
+		return Files{Dir: arg}, nil
+	case "vault":
+		if arg == "" {
+			arg = os.Getenv("VAULT_ADDR")
+		}
+		if arg == "" {
+			return nil, errors.New("vault secrets need an address")
+		}
+		return Vault{Address: arg, Token: os.Getenv("VAULT_TOKEN")}, nil
+	case "aws":
+		if arg == "" {
+			arg = os.Getenv("AWS_REGION")
+		}
+		if arg == "" {
+			return nil, errors.New("aws secrets need a region")
+		}
+		return AWSSecretsManager{
+			Region:          arg,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret provider %q", kind)
+	}
+}
@@ -0,0 +1,37 @@
+package secrets
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+)
+
+// Certificate is a TLS certificate that can be replaced while a server
+// uses it; set tls.Config.GetCertificate to its GetCertificate method.
+type Certificate struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Set replaces the certificate with a PEM bundle holding the certificate
+// chain and its private key.
+func (c *Certificate) Set(pem []byte) error {
+	cert, err := tls.X509KeyPair(pem, pem)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return c.cert, nil
+}
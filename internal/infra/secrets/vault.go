@@ -0,0 +1,69 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault reads secrets from a HashiCorp Vault KV version 2 engine. A name
+// such as "repocraft/ssh-host-key#pem" selects the field "pem" of the
+// secret at that path; without a field, "value" is read.
+type Vault struct {
+	Address string
+	Token   string
+	// Mount is the path of the KV engine; defaults to "secret".
+	Mount  string
+	Client *http.Client
+}
+
+// Secret implements Provider.
+func (v Vault) Secret(ctx context.Context, name string) ([]byte, error) {
+	path, field, found := strings.Cut(name, "#")
+	if !found {
+		field = "value"
+	}
+	mount := v.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	u := strings.TrimRight(v.Address, "/") + "/v1/" + strings.Trim(mount, "/") + "/data/" + strings.Trim(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if v.Token != "" {
+		req.Header.Set("X-Vault-Token", v.Token)
+	}
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault: %s", resp.Status)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	value, ok := body.Data.Data[field].(string)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return []byte(value), nil
+}
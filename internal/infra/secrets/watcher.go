@@ -0,0 +1,88 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Watcher polls a Provider for the secrets registered with Watch and calls
+// their rotation hooks when a value changes.
+type Watcher struct {
+	Provider Provider
+	// Interval is the time between polls in Run; defaults to five minutes.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	watches []*watch
+}
+
+type watch struct {
+	name     string
+	value    []byte
+	onChange func([]byte) error
+}
+
+// Watch loads the secret name and passes it to onChange, then registers
+// onChange to be called again with each new value. An error from the
+// initial load or from onChange is returned and nothing is registered; it
+// is ErrNotFound for secrets the provider doesn't hold.
+func (w *Watcher) Watch(ctx context.Context, name string, onChange func([]byte) error) error {
+	value, err := w.Provider.Secret(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := onChange(value); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.watches = append(w.watches, &watch{name: name, value: value, onChange: onChange})
+	w.mu.Unlock()
+	return nil
+}
+
+// Run polls the watched secrets every Interval until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Refresh(ctx)
+		}
+	}
+}
+
+// Refresh reloads every watched secret once. A value rejected by its hook
+// is logged and offered again on the next refresh; the previous value
+// stays in use.
+func (w *Watcher) Refresh(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, wt := range w.watches {
+		value, err := w.Provider.Secret(ctx, wt.name)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("secrets: reload %s: %v", wt.name, err)
+			}
+			continue
+		}
+		if bytes.Equal(value, wt.value) {
+			continue
+		}
+		if err := wt.onChange(value); err != nil {
+			log.Printf("secrets: rotate %s: %v", wt.name, err)
+			continue
+		}
+		wt.value = value
+		log.Printf("secrets: rotated %s", wt.name)
+	}
+}
@@ -0,0 +1,20 @@
+// Package shard assigns repositories to the nodes of a sharded fleet.
+package shard
+
+import "crypto/sha256"
+
+// Owner returns the index in nodes of the node owning repo, or -1 if nodes
+// is empty. Ownership is decided by rendezvous hashing, so adding or
+// removing a node only moves the repositories it gains or held. Routers
+// that should agree must use the same node names.
+func Owner(nodes []string, repo string) int {
+	owner := -1
+	var best [sha256.Size]byte
+	for i, n := range nodes {
+		score := sha256.Sum256([]byte(n + "\x00" + repo))
+		if owner < 0 || string(score[:]) > string(best[:]) {
+			owner, best = i, score
+		}
+	}
+	return owner
+}
@@ -0,0 +1,248 @@
+// Package signedurl issues and verifies HMAC-signed, expiring tokens that
+// grant read access to a single repository, user tokens that let a user
+// manage their own account through the API, and sudo tokens that let
+// automation do some of that on a user's behalf.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMalformed is returned for tokens that cannot be parsed.
+	ErrMalformed = errors.New("malformed token")
+	// ErrExpired is returned for well-formed tokens past their expiry.
+	ErrExpired = errors.New("token expired")
+	// ErrInvalidSignature is returned when the token was not issued for the repository.
+	ErrInvalidSignature = errors.New("invalid token signature")
+)
+
+// Signer issues and verifies tokens of the form "<unix-expiry>.<signature>".
+// The signature binds the token to one repository path.
+type Signer struct {
+	// Key signs tokens; change it with Rotate once the Signer is in use.
+	Key []byte
+	// MaxTTL caps the lifetime of issued tokens; defaults to 24 hours.
+	MaxTTL time.Duration
+
+	mu       sync.RWMutex
+	previous []byte
+}
+
+// Rotate makes key the signing key. Tokens signed with the previous key
+// stay valid until they expire, so callers should not rotate again within
+// MaxTTL.
+func (s *Signer) Rotate(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !hmac.Equal(key, s.Key) {
+		s.previous, s.Key = s.Key, key
+	}
+}
+
+// Sign returns a token granting read access to repo until expires.
+func (s *Signer) Sign(repo string, expires time.Time) (string, error) {
+	s.mu.RLock()
+	key := s.Key
+	s.mu.RUnlock()
+	if len(key) == 0 {
+		return "", errors.New("missing signing key")
+	}
+	if max := s.maxTTL(); time.Until(expires) > max {
+		return "", fmt.Errorf("token lifetime exceeds %s", max)
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + signature(key, repo, exp), nil
+}
+
+// Verify checks that token is valid for repo at now.
+func (s *Signer) Verify(token, repo string, now time.Time) error {
+	s.mu.RLock()
+	key, previous := s.Key, s.previous
+	s.mu.RUnlock()
+	if len(key) == 0 {
+		return errors.New("missing signing key")
+	}
+	exp, sig, found := strings.Cut(token, ".")
+	if !found {
+		return ErrMalformed
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(key, repo, exp))) &&
+		(len(previous) == 0 || !hmac.Equal([]byte(sig), []byte(signature(previous, repo, exp)))) {
+		return ErrInvalidSignature
+	}
+	if !now.Before(time.Unix(unix, 0)) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// userTokenPrefix starts user tokens, telling them apart from fetch tokens.
+const userTokenPrefix = "u1."
+
+// SignUser returns a token identifying user until expires, of the form
+// "u1.<user>.<unix-expiry>.<signature>" with the user name base64-encoded.
+func (s *Signer) SignUser(user string, expires time.Time) (string, error) {
+	s.mu.RLock()
+	key := s.Key
+	s.mu.RUnlock()
+	if len(key) == 0 {
+		return "", errors.New("missing signing key")
+	}
+	if max := s.maxTTL(); time.Until(expires) > max {
+		return "", fmt.Errorf("token lifetime exceeds %s", max)
+	}
+	name := base64.RawURLEncoding.EncodeToString([]byte(user))
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return userTokenPrefix + name + "." + exp + "." + userSignature(key, user, exp), nil
+}
+
+// VerifyUser checks that token is a valid user token at now and returns
+// the user it identifies.
+func (s *Signer) VerifyUser(token string, now time.Time) (string, error) {
+	s.mu.RLock()
+	key, previous := s.Key, s.previous
+	s.mu.RUnlock()
+	if len(key) == 0 {
+		return "", errors.New("missing signing key")
+	}
+	rest, ok := strings.CutPrefix(token, userTokenPrefix)
+	if !ok {
+		return "", ErrMalformed
+	}
+	parts := strings.Split(rest, ".")
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(name) == 0 {
+		return "", ErrMalformed
+	}
+	user, exp, sig := string(name), parts[1], parts[2]
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	if !hmac.Equal([]byte(sig), []byte(userSignature(key, user, exp))) &&
+		(len(previous) == 0 || !hmac.Equal([]byte(sig), []byte(userSignature(previous, user, exp)))) {
+		return "", ErrInvalidSignature
+	}
+	if !now.Before(time.Unix(unix, 0)) {
+		return "", ErrExpired
+	}
+	return user, nil
+}
+
+func userSignature(key []byte, user, exp string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "user\n%s\n%s", user, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sudoTokenPrefix starts sudo tokens.
+const sudoTokenPrefix = "s1."
+
+// Sudo is what a sudo token grants: acting as User, within Scopes, to
+// Actor, the automation or support engineer holding the token.
+type Sudo struct {
+	User   string
+	Actor  string
+	Scopes []string
+}
+
+// SignSudo returns a token granting sudo until expires, of the form
+// "s1.<user>.<actor>.<scopes>.<unix-expiry>.<signature>" with the user,
+// the actor and the comma-separated scopes base64-encoded.
+func (s *Signer) SignSudo(sudo Sudo, expires time.Time) (string, error) {
+	s.mu.RLock()
+	key := s.Key
+	s.mu.RUnlock()
+	if len(key) == 0 {
+		return "", errors.New("missing signing key")
+	}
+	if max := s.maxTTL(); time.Until(expires) > max {
+		return "", fmt.Errorf("token lifetime exceeds %s", max)
+	}
+	scopes := strings.Join(sudo.Scopes, ",")
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	enc := base64.RawURLEncoding.EncodeToString
+	return sudoTokenPrefix + enc([]byte(sudo.User)) + "." + enc([]byte(sudo.Actor)) + "." + enc([]byte(scopes)) + "." +
+		exp + "." + sudoSignature(key, sudo.User, sudo.Actor, scopes, exp), nil
+}
+
+// IsSudo reports whether token has the form of a sudo token.
+func IsSudo(token string) bool {
+	return strings.HasPrefix(token, sudoTokenPrefix)
+}
+
+// VerifySudo checks that token is a valid sudo token at now and returns
+// what it grants.
+func (s *Signer) VerifySudo(token string, now time.Time) (Sudo, error) {
+	s.mu.RLock()
+	key, previous := s.Key, s.previous
+	s.mu.RUnlock()
+	if len(key) == 0 {
+		return Sudo{}, errors.New("missing signing key")
+	}
+	rest, ok := strings.CutPrefix(token, sudoTokenPrefix)
+	if !ok {
+		return Sudo{}, ErrMalformed
+	}
+	parts := strings.Split(rest, ".")
+	if len(parts) != 5 {
+		return Sudo{}, ErrMalformed
+	}
+	var fields [3]string
+	for i := range fields {
+		raw, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil || len(raw) == 0 {
+			return Sudo{}, ErrMalformed
+		}
+		fields[i] = string(raw)
+	}
+	user, actor, scopes := fields[0], fields[1], fields[2]
+	exp, sig := parts[3], parts[4]
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return Sudo{}, ErrMalformed
+	}
+	if !hmac.Equal([]byte(sig), []byte(sudoSignature(key, user, actor, scopes, exp))) &&
+		(len(previous) == 0 || !hmac.Equal([]byte(sig), []byte(sudoSignature(previous, user, actor, scopes, exp)))) {
+		return Sudo{}, ErrInvalidSignature
+	}
+	if !now.Before(time.Unix(unix, 0)) {
+		return Sudo{}, ErrExpired
+	}
+	return Sudo{User: user, Actor: actor, Scopes: strings.Split(scopes, ",")}, nil
+}
+
+func sudoSignature(key []byte, user, actor, scopes, exp string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "sudo\n%s\n%s\n%s\n%s", user, actor, scopes, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signature(key []byte, repo, exp string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "fetch\n%s\n%s", strings.Trim(repo, "/"), exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Signer) maxTTL() time.Duration {
+	if s.MaxTTL > 0 {
+		return s.MaxTTL
+	}
+	return 24 * time.Hour
+}
@@ -0,0 +1,419 @@
+// Package snapshot writes source archives of commits, optionally with the
+// submodules they pin, for consumers that need a complete source tree.
+//
+// Submodules are included when their repository is served here too: their
+// URL in .gitmodules is relative, like "../lib.git", or under one of the
+// server's base URLs. Archives honor export-ignore and export-subst like
+// git archive, including a repository's export rules.
+package snapshot
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// Formats are the archive formats Write produces.
+var Formats = []string{"tar", "tar.gz", "zip"}
+
+// ContentType returns the media type of format.
+func ContentType(format string) string {
+	switch format {
+	case "tar.gz":
+		return "application/gzip"
+	case "zip":
+		return "application/zip"
+	}
+	return "application/x-tar"
+}
+
+// maxDepth bounds how deep submodules nest, which also ends cycles.
+const maxDepth = 8
+
+// Submodule is a submodule pinned by a commit.
+type Submodule struct {
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	Commit string `json:"commit"`
+	// Repo is the repository the submodule is served from here, if any.
+	Repo string `json:"repo,omitempty"`
+}
+
+// Submodules lists the submodules pinned by commit of the repository name
+// at dir, resolving their repositories against bases.
+func Submodules(ctx context.Context, git, dir, name, commit string, bases []*url.URL) ([]Submodule, error) {
+	out, err := exec.CommandContext(ctx, git, "--git-dir="+dir, "ls-tree", "-r", "-z", commit).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-tree %s: %w", commit, err)
+	}
+	var subs []Submodule
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		meta, p, ok := strings.Cut(string(entry), "\t")
+		if fields := strings.Fields(meta); ok && len(fields) == 3 && fields[1] == "commit" {
+			subs = append(subs, Submodule{Path: p, Commit: fields[2]})
+		}
+	}
+	if len(subs) == 0 {
+		return nil, nil
+	}
+	// .gitmodules maps submodule names to paths and URLs.
+	out, err = exec.CommandContext(ctx, git, "--git-dir="+dir, "config", "--blob", commit+":.gitmodules", "--null", "--get-regexp", `^submodule\..*\.(path|url)$`).Output()
+	if err != nil {
+		return subs, nil
+	}
+	paths, urls := make(map[string]string), make(map[string]string)
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		key, value, _ := strings.Cut(string(entry), "\n")
+		rest, _ := strings.CutPrefix(key, "submodule.")
+		i := strings.LastIndexByte(rest, '.')
+		if i < 0 {
+			continue
+		}
+		switch rest[i+1:] {
+		case "path":
+			paths[value] = rest[:i]
+		case "url":
+			urls[rest[:i]] = value
+		}
+	}
+	for i := range subs {
+		subs[i].URL = urls[paths[subs[i].Path]]
+		subs[i].Repo, _ = ResolveURL(name, subs[i].URL, bases)
+	}
+	return subs, nil
+}
+
+// ResolveURL returns the repository a submodule URL of the repository name
+// points to on this server: relative URLs are resolved against name, as
+// git resolves them against the superproject's URL, and absolute ones
+// must be under one of bases, by host and path, whatever their scheme.
+func ResolveURL(name, raw string, bases []*url.URL) (string, bool) {
+	var repo string
+	switch {
+	case raw == "":
+		return "", false
+	case strings.HasPrefix(raw, "./") || strings.HasPrefix(raw, "../"):
+		repo = path.Join(name, raw)
+	default:
+		host, p, ok := splitURL(raw)
+		if !ok {
+			return "", false
+		}
+		for _, base := range bases {
+			prefix := strings.Trim(base.Path, "/")
+			if !strings.EqualFold(host, base.Hostname()) {
+				continue
+			}
+			if rest, ok := strings.CutPrefix(strings.Trim(p, "/"), prefix); ok && (prefix == "" || strings.HasPrefix(rest, "/")) {
+				repo = rest
+				break
+			}
+		}
+	}
+	repo = strings.Trim(repo, "/")
+	if repo == "" || repo == "." || strings.HasPrefix(repo, "..") {
+		return "", false
+	}
+	return repo, true
+}
+
+// splitURL returns the host and path of a git URL, including scp-like
+// ones such as "git@host:owner/repo.git".
+func splitURL(raw string) (host, p string, ok bool) {
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return "", "", false
+		}
+		return u.Hostname(), u.Path, true
+	}
+	userHost, p, ok := strings.Cut(raw, ":")
+	if !ok || strings.Contains(userHost, "/") {
+		return "", "", false
+	}
+	if _, h, ok := strings.Cut(userHost, "@"); ok {
+		userHost = h
+	}
+	return userHost, p, true
+}
+
+// Archiver writes archives of the repositories of a server.
+type Archiver struct {
+	// Bases are the URLs the server is reached at, such as its canonical
+	// URL; absolute submodule URLs under them are served here.
+	Bases   []*url.URL
+	GitPath string
+}
+
+// Request selects what to archive.
+type Request struct {
+	// Repo is the name of the repository, Dir its directory.
+	Repo string
+	Dir  string
+	// Rev is the commit to archive; defaults to HEAD.
+	Rev string
+	// Format is one of Formats; defaults to tar.
+	Format string
+	// Prefix is prepended to every path, e.g. "project-1.2/".
+	Prefix string
+	// Submodules includes the submodules served here, recursively.
+	Submodules bool
+	// Resolve returns the directory of the repository name, or an error if
+	// it isn't served to the requester.
+	Resolve func(name string) (string, error)
+}
+
+// Plan is an archive checked and ready to be written.
+type Plan struct {
+	a      *Archiver
+	format string
+	parts  []part
+}
+
+// part is the tree of one commit in the archive.
+type part struct {
+	dir, commit, prefix string
+	// under is the part whose archive must hold prefix for this one to be
+	// included, so submodules left out by export-ignore stay out.
+	under int
+}
+
+// Plan resolves req and every submodule to include, so that nothing can
+// fail for lack of a repository or commit once the archive is written.
+func (a *Archiver) Plan(ctx context.Context, req Request) (*Plan, error) {
+	format := req.Format
+	if format == "" {
+		format = "tar"
+	}
+	if format != "tar" && format != "tar.gz" && format != "zip" {
+		return nil, errcode.Errorf(errcode.InvalidRequest, "unknown format %q; known are %s", format, strings.Join(Formats, ", "))
+	}
+	rev := req.Rev
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if strings.HasPrefix(rev, "-") {
+		return nil, errcode.New(errcode.InvalidRequest, "invalid revision")
+	}
+	if path.IsAbs(req.Prefix) || contains(strings.Split(req.Prefix, "/"), "..") {
+		return nil, errcode.New(errcode.InvalidRequest, "invalid prefix")
+	}
+	commit, err := a.commit(ctx, req.Dir, rev)
+	if err != nil {
+		return nil, errcode.Errorf(errcode.NotFound, "revision %q not found", rev)
+	}
+	p := &Plan{a: a, format: format, parts: []part{{dir: req.Dir, commit: commit, prefix: req.Prefix, under: -1}}}
+	if req.Submodules {
+		if err := a.planSubmodules(ctx, p, req, req.Repo, 0, 1); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (a *Archiver) planSubmodules(ctx context.Context, p *Plan, req Request, name string, parent, depth int) error {
+	super := p.parts[parent]
+	subs, err := Submodules(ctx, a.git(), super.dir, name, super.commit, a.Bases)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if !a.exported(ctx, super.dir, super.commit, sub.Path) {
+			continue
+		}
+		if depth > maxDepth {
+			return errcode.Errorf(errcode.LimitExceeded, "submodules nest deeper than %d", maxDepth)
+		}
+		if sub.Repo == "" {
+			return errcode.Errorf(errcode.NotFound, "submodule %s of %s: %q is not served here", sub.Path, name, sub.URL)
+		}
+		dir, err := req.Resolve(sub.Repo)
+		if err != nil {
+			return errcode.Errorf(errcode.NotFound, "submodule %s of %s: repository %s not found", sub.Path, name, sub.Repo)
+		}
+		if _, err := a.commit(ctx, dir, sub.Commit); err != nil {
+			return errcode.Errorf(errcode.NotFound, "submodule %s of %s: commit %s not in %s", sub.Path, name, sub.Commit, sub.Repo)
+		}
+		p.parts = append(p.parts, part{dir: dir, commit: sub.Commit, prefix: super.prefix + sub.Path + "/", under: parent})
+		if err := a.planSubmodules(ctx, p, req, sub.Repo, len(p.parts)-1, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exported reports whether the archive of commit holds p, which
+// export-ignore may leave out.
+func (a *Archiver) exported(ctx context.Context, dir, commit, p string) bool {
+	return exec.CommandContext(ctx, a.git(), "--git-dir="+dir, "archive", "--format=tar", commit, "--", p).Run() == nil
+}
+
+func (a *Archiver) commit(ctx context.Context, dir, rev string) (string, error) {
+	out, err := exec.CommandContext(ctx, a.git(), "--git-dir="+dir, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}").Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (a *Archiver) git() string {
+	if a.GitPath != "" {
+		return a.GitPath
+	}
+	return "git"
+}
+
+// Write writes the archive to w.
+func (p *Plan) Write(ctx context.Context, w io.Writer) error {
+	var sink entrySink
+	switch p.format {
+	case "zip":
+		zw := zip.NewWriter(w)
+		sink = &zipSink{w: zw}
+	case "tar.gz":
+		gw := gzip.NewWriter(w)
+		sink = &tarSink{w: tar.NewWriter(gw), gz: gw}
+	default:
+		sink = &tarSink{w: tar.NewWriter(w)}
+	}
+	dirs := make([]map[string]bool, len(p.parts))
+	for i, pt := range p.parts {
+		if pt.under >= 0 && !dirs[pt.under][pt.prefix] {
+			// The submodule's parent was left out itself.
+			dirs[i] = map[string]bool{}
+			continue
+		}
+		seen, err := p.copy(ctx, sink, pt)
+		if err != nil {
+			return err
+		}
+		dirs[i] = seen
+	}
+	return sink.Close()
+}
+
+// copy adds the entries of git archive's tar of pt to sink and returns the
+// directories among them.
+func (p *Plan) copy(ctx context.Context, sink entrySink, pt part) (map[string]bool, error) {
+	args := []string{"--git-dir=" + pt.dir, "archive", "--format=tar"}
+	if pt.prefix != "" {
+		args = append(args, "--prefix="+pt.prefix)
+	}
+	cmd := exec.CommandContext(ctx, p.a.git(), append(args, pt.commit)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	tr := tar.NewReader(out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			// The commit ID git records; there is more than one commit.
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			if pt.under >= 0 && hdr.Name == pt.prefix {
+				// The superproject's archive holds it already.
+				continue
+			}
+			seen[hdr.Name] = true
+		}
+		if err := sink.Add(hdr, tr); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, err
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("git archive %s: %v: %s", pt.commit, err, strings.TrimSpace(stderr.String()))
+	}
+	return seen, nil
+}
+
+type entrySink interface {
+	Add(hdr *tar.Header, body io.Reader) error
+	Close() error
+}
+
+type tarSink struct {
+	w  *tar.Writer
+	gz *gzip.Writer
+}
+
+func (s *tarSink) Add(hdr *tar.Header, body io.Reader) error {
+	if err := s.w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(s.w, body)
+	return err
+}
+
+func (s *tarSink) Close() error {
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+	if s.gz != nil {
+		return s.gz.Close()
+	}
+	return nil
+}
+
+type zipSink struct {
+	w *zip.Writer
+}
+
+func (s *zipSink) Add(hdr *tar.Header, body io.Reader) error {
+	fh, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return err
+	}
+	fh.Name = hdr.Name
+	fh.Modified = hdr.ModTime
+	if hdr.Typeflag != tar.TypeDir {
+		fh.Method = zip.Deflate
+	}
+	f, err := s.w.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		// Like git archive, zips hold a symlink's target as its content.
+		_, err = io.WriteString(f, hdr.Linkname)
+		return err
+	}
+	_, err = io.Copy(f, body)
+	return err
+}
+
+func (s *zipSink) Close() error { return s.w.Close() }
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+// Package sparse keeps the sparse profiles of repositories: named sets of
+// directories that monorepo users can clone with a partial clone filter
+// and a cone-mode sparse checkout, instead of the whole tree.
+//
+// Profiles are sections of the repository's git config:
+//
+//	[sparseProfile "frontend"]
+//		description = Web app and the libraries it uses
+//		path = web
+//		path = libs/ui
+//		filter = blob:none
+package sparse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// section is the git config section of sparse profiles.
+const section = "sparseprofile"
+
+// DefaultFilter is the partial clone filter of profiles that don't set
+// one: commits and trees are fetched, blobs only when checked out.
+const DefaultFilter = "blob:none"
+
+// filterPattern matches the filters profiles may recommend.
+var filterPattern = regexp.MustCompile(`^(blob:none|blob:limit=[0-9]+[kmg]?|tree:[0-9]+)$`)
+
+// Profile is a sparse profile of a repository.
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Paths are the directories checked out, relative to the root, in
+	// addition to the files at the root that cone mode always includes.
+	Paths []string `json:"paths"`
+	// Filter is the partial clone filter; DefaultFilter when empty.
+	Filter string `json:"filter,omitempty"`
+}
+
+// Check reports what is wrong with p.
+func (p Profile) Check() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, "\"\\\n\x00 ") {
+		return errcode.New(errcode.InvalidRequest, "missing or invalid profile name")
+	}
+	if strings.ContainsAny(p.Description, "\n\x00") {
+		return errcode.New(errcode.InvalidRequest, "description spans lines")
+	}
+	if len(p.Paths) == 0 {
+		return errcode.New(errcode.InvalidRequest, "a profile needs at least one path")
+	}
+	for _, dir := range p.Paths {
+		if !ValidPath(dir) {
+			return errcode.Errorf(errcode.InvalidRequest, "invalid path %q, want a directory relative to the root", dir)
+		}
+	}
+	if p.Filter != "" && !ValidFilter(p.Filter) {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid filter %q; use blob:none, blob:limit=<n> or tree:<depth>", p.Filter)
+	}
+	return nil
+}
+
+// ValidPath reports whether dir is a directory path profiles may list.
+func ValidPath(dir string) bool {
+	return dir != "" && !strings.ContainsAny(dir, "\n\x00*?[\\") && path.Clean(dir) == dir && dir != "." && !path.IsAbs(dir) && !strings.HasPrefix(dir, "../") && dir != ".."
+}
+
+// ValidFilter reports whether filter is a partial clone filter profiles
+// may recommend.
+func ValidFilter(filter string) bool {
+	return filterPattern.MatchString(filter)
+}
+
+// FilterOrDefault returns the partial clone filter of p.
+func (p Profile) FilterOrDefault() string {
+	if p.Filter == "" {
+		return DefaultFilter
+	}
+	return p.Filter
+}
+
+// Commands returns the commands that clone the repository at cloneURL into
+// dir with p.
+func (p Profile) Commands(cloneURL, dir string) []string {
+	return []string{
+		fmt.Sprintf("git clone --filter=%s --sparse %s %s", p.FilterOrDefault(), cloneURL, dir),
+		fmt.Sprintf("git -C %s sparse-checkout set --cone %s", dir, strings.Join(p.Paths, " ")),
+	}
+}
+
+// Read returns the sparse profiles of the repository at dir, by name.
+func Read(ctx context.Context, dir string) ([]Profile, error) {
+	out, err := exec.CommandContext(ctx, "git", "config", "--file", filepath.Join(dir, "config"), "--null", "--get-regexp", `^`+section+`\.`).Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		// No profiles.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read sparse profiles: %w", err)
+	}
+	profiles := make(map[string]*Profile)
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		key, value, _ := strings.Cut(string(entry), "\n")
+		rest, _ := strings.CutPrefix(key, section+".")
+		i := strings.LastIndexByte(rest, '.')
+		if i < 0 {
+			continue
+		}
+		name, variable := rest[:i], rest[i+1:]
+		p := profiles[name]
+		if p == nil {
+			p = &Profile{Name: name}
+			profiles[name] = p
+		}
+		switch variable {
+		case "description":
+			p.Description = value
+		case "path":
+			p.Paths = append(p.Paths, value)
+		case "filter":
+			p.Filter = value
+		}
+	}
+	list := make([]Profile, 0, len(profiles))
+	for _, p := range profiles {
+		if len(p.Paths) > 0 {
+			list = append(list, *p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Save adds p to the repository at dir, replacing the profile of the same
+// name. It also lets the repository serve filtered fetches, which git
+// refuses by default, and the objects partial clones fetch later, as long
+// as they are reachable.
+func Save(ctx context.Context, dir string, p Profile) error {
+	if err := p.Check(); err != nil {
+		return err
+	}
+	for _, key := range []string{"uploadpack.allowFilter", "uploadpack.allowReachableSHA1InWant"} {
+		if err := gitConfig(ctx, dir, key, "true"); err != nil {
+			return err
+		}
+	}
+	if err := Remove(ctx, dir, p.Name); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	name := section + "." + p.Name + "."
+	var set [][2]string
+	if p.Description != "" {
+		set = append(set, [2]string{name + "description", p.Description})
+	}
+	for _, dir := range p.Paths {
+		set = append(set, [2]string{name + "path", dir})
+	}
+	if p.Filter != "" {
+		set = append(set, [2]string{name + "filter", p.Filter})
+	}
+	for _, kv := range set {
+		if err := gitConfig(ctx, dir, "--add", kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrNotFound is returned for profiles that don't exist.
+var ErrNotFound = errcode.New(errcode.NotFound, "sparse profile not found")
+
+// Remove removes the named profile from the repository at dir.
+func Remove(ctx context.Context, dir, name string) error {
+	err := gitConfig(ctx, dir, "--remove-section", section+"."+name)
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 128 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func gitConfig(ctx context.Context, dir string, args ...string) error {
+	return exec.CommandContext(ctx, "git", append([]string{"config", "--file", filepath.Join(dir, "config")}, args...)...).Run()
+}
@@ -0,0 +1,241 @@
+// Package telemetry sends anonymous usage statistics to an endpoint the
+// operator opts in to, to help the maintainers decide which protocol
+// features matter: the version of the server, roughly how many
+// repositories it hosts, and which protocol versions clients speak.
+// Reports hold counts only; nothing names a repository, user, host or
+// address, and no ID ties one report to the next.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+const (
+	// DefaultInterval is how often reports are sent when the Reporter
+	// doesn't say.
+	DefaultInterval = 24 * time.Hour
+	// firstReport is how long after startup the first report is sent, so
+	// restarts don't each send one.
+	firstReport = time.Hour
+)
+
+// Report is what is sent, as JSON.
+type Report struct {
+	// Daemon is "githttpd" or "gitsshd".
+	Daemon string `json:"daemon"`
+	// Version is the version of the server module, "(devel)" for builds
+	// from a checkout.
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	// Repos is the number of repositories in a power of ten bucket, e.g.
+	// "100-999".
+	Repos string `json:"repos"`
+	// Protocols counts the git operations since the last report by
+	// service and protocol version, e.g. {"git-upload-pack": {"v2": 120}}.
+	Protocols map[string]map[string]int64 `json:"protocols"`
+	// Hours is how many hours the counts cover.
+	Hours int `json:"hours"`
+}
+
+// Reporter counts the protocol versions of git operations and sends a
+// Report to Endpoint every Interval.
+type Reporter struct {
+	// Endpoint is the URL reports are posted to.
+	Endpoint string
+	// Daemon names the daemon in reports.
+	Daemon string
+	// RepoRoot is where repositories are counted.
+	RepoRoot string
+	// Interval is how often reports are sent; DefaultInterval if zero.
+	Interval time.Duration
+	// Client sends the reports; a client with a 30 second timeout if nil.
+	Client *http.Client
+	// Logger receives each report sent, its content at debug level;
+	// slog.Default() if nil.
+	Logger *slog.Logger
+
+	mu        sync.Mutex
+	protocols map[string]map[string]int64
+	since     time.Time
+}
+
+// Observe counts the protocol version of res. It has the signature of
+// service.ServiceExecutor's OnFinish. Operations are counted once: over
+// HTTP by their advertisement, the only request of each fetch or push
+// that all protocol versions make.
+func (r *Reporter) Observe(res service.Result) {
+	req := res.Request
+	if req.Service == service.ServiceAdminCommand || req.StatelessRPC && !req.AdvertiseRefs {
+		return
+	}
+	version := "v0"
+	switch {
+	case req.IsProtocolV2():
+		version = "v2"
+	case strings.Contains(":"+req.ProtocolVersion+":", ":version=1:"):
+		version = "v1"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.protocols == nil {
+		r.protocols = make(map[string]map[string]int64)
+	}
+	name := req.Service.Command()
+	if r.protocols[name] == nil {
+		r.protocols[name] = make(map[string]int64)
+	}
+	r.protocols[name][version]++
+}
+
+// Run sends a report an hour after it is called and then every Interval
+// until ctx is done.
+func (r *Reporter) Run(ctx context.Context) {
+	r.mu.Lock()
+	r.since = time.Now()
+	r.mu.Unlock()
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	timer := time.NewTimer(min(firstReport, interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		report := r.Report()
+		if err := r.send(ctx, report); err != nil {
+			r.logger().Warn("send telemetry report", "endpoint", r.Endpoint, "error", err)
+		} else {
+			r.logger().Info("sent telemetry report", "endpoint", r.Endpoint)
+			if data, err := json.Marshal(report); err == nil {
+				r.logger().Debug("telemetry report", "report", string(data))
+			}
+			r.reset()
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (r *Reporter) logger() *slog.Logger {
+	if r.Logger == nil {
+		return slog.Default()
+	}
+	return r.Logger
+}
+
+// Report returns the report that would be sent now.
+func (r *Reporter) Report() Report {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	report := Report{
+		Daemon:    r.Daemon,
+		Version:   version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Repos:     bucket(countRepos(r.RepoRoot)),
+		Protocols: make(map[string]map[string]int64),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, versions := range r.protocols {
+		report.Protocols[name] = make(map[string]int64, len(versions))
+		for v, n := range versions {
+			report.Protocols[name][v] = n
+		}
+	}
+	if !r.since.IsZero() {
+		report.Hours = int(time.Since(r.since).Round(time.Hour) / time.Hour)
+	}
+	return report
+}
+
+// reset starts counting anew after a report was sent. Operations that
+// finished in between are lost, which counts don't need to be exact for.
+func (r *Reporter) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.protocols = nil
+	r.since = time.Now()
+}
+
+// send posts report to Endpoint.
+func (r *Reporter) send(ctx context.Context, report Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// countRepos returns the number of bare repositories under root.
+func countRepos(root string) int {
+	root = filepath.Clean(root)
+	n := 0
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if service.IsRepository(path) {
+			n++
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return n
+}
+
+// bucket rounds n down to a power of ten range.
+func bucket(n int) string {
+	if n == 0 {
+		return "0"
+	}
+	low := 1
+	for low*10 <= n {
+		low *= 10
+	}
+	return fmt.Sprintf("%d-%d", low, low*10-1)
+}
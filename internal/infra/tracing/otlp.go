@@ -0,0 +1,234 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// queueSize bounds the spans waiting to be sent; more are dropped.
+	queueSize = 4096
+	// batchSize is the most spans sent in one request.
+	batchSize = 512
+	// flushInterval is how long spans wait for a batch to fill up.
+	flushInterval = 5 * time.Second
+)
+
+// Exporter sends spans in batches to an OTLP/HTTP endpoint in its JSON
+// encoding, such as http://collector:4318/v1/traces of an OpenTelemetry
+// collector. Spans are queued without blocking and dropped when the
+// collector doesn't keep up.
+type Exporter struct {
+	// URL is the traces endpoint.
+	URL string
+	// ServiceName is the service.name resource attribute, e.g. "githttpd".
+	ServiceName string
+	// Client sends the batches; a client with a 10 second timeout if nil.
+	Client *http.Client
+	// Logger receives the batches that couldn't be sent; slog.Default()
+	// if nil.
+	Logger *slog.Logger
+
+	once  sync.Once
+	queue chan *Span
+}
+
+func (e *Exporter) init() {
+	e.once.Do(func() {
+		e.queue = make(chan *Span, queueSize)
+	})
+}
+
+func (e *Exporter) export(s *Span) {
+	if e == nil {
+		return
+	}
+	e.init()
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+// Run sends the queued spans until ctx is done, then what is left.
+func (e *Exporter) Run(ctx context.Context) {
+	e.init()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(ctx, batch); err != nil {
+			e.logger().Warn("dropped spans", "spans", len(batch), "url", e.URL, "error", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), flushInterval)
+			defer cancel()
+			for {
+				select {
+				case s := <-e.queue:
+					if batch = append(batch, s); len(batch) >= batchSize {
+						flush(ctx)
+					}
+				default:
+					flush(ctx)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *Exporter) logger() *slog.Logger {
+	if e.Logger == nil {
+		return slog.Default()
+	}
+	return e.Logger
+}
+
+// send posts spans to URL.
+func (e *Exporter) send(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding of a trace export request.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              Kind            `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 1 ok, 2 error
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+func (e *Exporter) encode(spans []*Span) otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "repocraft"}}
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.traceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: a.key, Value: value(a.value)})
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, span)
+	}
+	resource := otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: value(e.ServiceName)}}}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{Resource: resource, ScopeSpans: []otlpScopeSpans{scope}}}}
+}
+
+// value encodes an attribute value; durations are in seconds.
+func value(v any) otlpValue {
+	integer := func(n int64) otlpValue {
+		s := strconv.FormatInt(n, 10)
+		return otlpValue{IntValue: &s}
+	}
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		return integer(int64(v))
+	case int64:
+		return integer(v)
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case time.Duration:
+		seconds := v.Seconds()
+		return otlpValue{DoubleValue: &seconds}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{StringValue: &s}
+}
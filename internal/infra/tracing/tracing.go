@@ -0,0 +1,216 @@
+// Package tracing records spans of git operations and sends them to an
+// OpenTelemetry collector over OTLP/HTTP, so slow clones can be lined up
+// with backend load in an existing tracing stack. Traces are continued from
+// the W3C traceparent header of incoming requests.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is the role of a span, as in OTLP.
+type Kind int
+
+// Span kinds.
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+// TraceParentHeader carries the trace context between services.
+const TraceParentHeader = "Traceparent"
+
+// spanContext identifies a span across services.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// traceParent formats c as a traceparent header value.
+func (c spanContext) traceParent() string {
+	flags := "00"
+	if c.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.traceID[:]) + "-" + hex.EncodeToString(c.spanID[:]) + "-" + flags
+}
+
+// parseTraceParent parses a traceparent header value. Later versions
+// are read as version 00, as the specification asks.
+func parseTraceParent(v string) (spanContext, bool) {
+	var c spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return c, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return c, false
+	}
+	if _, err := hex.Decode(c.traceID[:], []byte(parts[1])); err != nil || c.traceID == [16]byte{} {
+		return c, false
+	}
+	if _, err := hex.Decode(c.spanID[:], []byte(parts[2])); err != nil || c.spanID == [8]byte{} {
+		return c, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return c, false
+	}
+	c.sampled = flags[0]&1 == 1
+	return c, true
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Extract returns ctx carrying the trace context of header, if any, for
+// spans started from it to continue.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	if c, ok := parseTraceParent(header.Get(TraceParentHeader)); ok {
+		return context.WithValue(ctx, remoteKey{}, c)
+	}
+	return ctx
+}
+
+// FromContext returns the span started in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Tracer starts spans and hands sampled ones to an exporter. Its methods
+// do nothing on a nil *Tracer, and return nil spans whose methods do
+// nothing either, so servers call them unconditionally.
+type Tracer struct {
+	// Exporter receives finished spans.
+	Exporter *Exporter
+	// SampleRatio is the share of traces started here that are recorded,
+	// from 0 to 1. Traces continued from a caller follow its decision.
+	SampleRatio float64
+}
+
+// Start starts a span named name as a child of the span in ctx or of the
+// trace context Extract put there, or else as the root of a new trace. kv
+// are attribute key and value pairs. The returned context carries the
+// span.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, kv ...any) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := FromContext(ctx); parent != nil {
+		s.ctx.traceID, s.parentID, s.ctx.sampled = parent.ctx.traceID, parent.ctx.spanID, parent.ctx.sampled
+	} else if remote, ok := ctx.Value(remoteKey{}).(spanContext); ok {
+		s.ctx.traceID, s.parentID, s.ctx.sampled = remote.traceID, remote.spanID, remote.sampled
+	} else {
+		rand.Read(s.ctx.traceID[:])
+		s.ctx.sampled = t.sample(s.ctx.traceID)
+	}
+	rand.Read(s.ctx.spanID[:])
+	s.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample decides on a new trace from its ID, as OpenTelemetry's
+// TraceIDRatioBased sampler does.
+func (t *Tracer) sample(traceID [16]byte) bool {
+	switch {
+	case t.SampleRatio >= 1:
+		return true
+	case t.SampleRatio <= 0:
+		return false
+	}
+	var x uint64
+	for _, b := range traceID[8:] {
+		x = x<<8 | uint64(b)
+	}
+	return x>>1 < uint64(t.SampleRatio*(1<<63))
+}
+
+// Span is an operation in a trace.
+type Span struct {
+	tracer   *Tracer
+	ctx      spanContext
+	parentID [8]byte
+	name     string
+	kind     Kind
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []attribute
+	err   error
+	ended bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// SetAttributes records key and value pairs on the span. Values are
+// strings, bools, integers, floats or durations; anything else is
+// formatted with fmt.
+func (s *Span) SetAttributes(kv ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		replaced := false
+		for j := range s.attrs {
+			if s.attrs[j].key == key {
+				s.attrs[j].value, replaced = kv[i+1], true
+			}
+		}
+		if !replaced {
+			s.attrs = append(s.attrs, attribute{key, kv[i+1]})
+		}
+	}
+}
+
+// End finishes the span, as failed if err is not nil, and exports it if
+// the trace is sampled. Only the first call counts.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end, s.err = true, time.Now(), err
+	s.mu.Unlock()
+	if s.ctx.sampled {
+		s.tracer.Exporter.export(s)
+	}
+}
+
+// Inject sets the traceparent header continuing the trace from s.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set(TraceParentHeader, s.ctx.traceParent())
+}
+
+// TraceID returns the trace's ID in hex, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.ctx.traceID[:])
+}
@@ -0,0 +1,483 @@
+// Package userkeys keeps the SSH public keys users registered themselves
+// through the API, so adding a key doesn't take an admin editing
+// authorized_keys. Keys are kept per user in a JSON file that the HTTP
+// daemon writes and the SSH daemon re-reads whenever it changes:
+//
+//	{"users": {"alice": [{"key": "ssh-ed25519 AAAA...", "fingerprint": "SHA256:...",
+//	  "title": "laptop", "added": "2024-05-01T12:00:00Z"}]}}
+//
+// A key belongs to one user only; registering it again for the same user
+// returns the key already registered. Keys may expire; expired keys are
+// kept, so they show up in stale key reports, but no longer admitted.
+// When keys were last used is kept apart, see UsagePath.
+package userkeys
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	xssh "golang.org/x/crypto/ssh"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+const (
+	// MaxKeysPerUser caps the keys one user can register.
+	MaxKeysPerUser = 50
+	maxUserLen     = 64
+	maxTitleLen    = 100
+)
+
+var (
+	// ErrInvalidKey is returned for keys that aren't a single public key in
+	// authorized_keys form.
+	ErrInvalidKey = errcode.New(errcode.InvalidRequest, "invalid public key")
+	// ErrKeyInUse is returned for keys another user registered.
+	ErrKeyInUse = errcode.New(errcode.Conflict, "key is registered to another user")
+	// ErrKeyNotFound is returned when removing a key the user doesn't have.
+	ErrKeyNotFound = errcode.New(errcode.NotFound, "key not found")
+	// ErrKeyExpired is returned when authorizing a key past its expiry.
+	ErrKeyExpired = errcode.New(errcode.Unauthenticated, "key expired")
+)
+
+// Key is a registered public key.
+type Key struct {
+	// Key is the public key in authorized_keys form, without options or
+	// comment.
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Title       string    `json:"title,omitempty"`
+	Added       time.Time `json:"added"`
+	// Expires, if set, is when the key stops being admitted.
+	Expires *time.Time `json:"expires,omitempty"`
+	// LastUsed is when the key last authenticated, if it has since usage
+	// was recorded. It isn't stored with the key.
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// Expired reports whether the key has expired at now.
+func (k Key) Expired(now time.Time) bool {
+	return k.Expires != nil && !now.Before(*k.Expires)
+}
+
+type file struct {
+	Users map[string][]Key `json:"users"`
+}
+
+// Store holds the registered keys. A nil Store has no keys.
+type Store struct {
+	// Path of the JSON key file.
+	Path string
+	// Interval between checks of the file for changes made by another
+	// process; defaults to five seconds.
+	Interval time.Duration
+	// UsagePath is the JSON file recording when keys were last used,
+	// written by the daemon authorizing keys; defaults to Path with
+	// "-usage" before the extension, e.g. "user_keys-usage.json".
+	UsagePath string
+	// Allow, if set, rejects keys of types the server doesn't admit, e.g.
+	// cryptopolicy.Policy.SSHClientKey.
+	Allow func(xssh.PublicKey) bool
+	// MaxLifetime, if set, is the longest time a key may be registered for.
+	// Keys added without an expiry get one MaxLifetime away.
+	MaxLifetime time.Duration
+
+	mu      sync.RWMutex
+	users   map[string][]Key
+	owners  map[string]owner // by fingerprint
+	modTime time.Time
+	err     error
+
+	usage usage
+}
+
+type owner struct {
+	user    string
+	expires *time.Time
+}
+
+// Load reads the key file. A missing file is not an error; on any other
+// error the previous keys stay in effect.
+func (s *Store) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = s.loadLocked()
+	if s.err == nil {
+		s.err = s.usage.load(s.usagePath())
+	}
+	return s.err
+}
+
+func (s *Store) loadLocked() error {
+	fi, err := os.Stat(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.setLocked(nil, time.Time{})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read user keys: %w", err)
+	}
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return fmt.Errorf("read user keys: %w", err)
+	}
+	var f file
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return fmt.Errorf("parse user keys %s: %w", s.Path, err)
+	}
+	s.setLocked(f.Users, fi.ModTime())
+	return nil
+}
+
+func (s *Store) setLocked(users map[string][]Key, modTime time.Time) {
+	if users == nil {
+		users = make(map[string][]Key)
+	}
+	owners := make(map[string]owner)
+	for user, keys := range users {
+		for _, k := range keys {
+			owners[k.Fingerprint] = owner{user: user, expires: k.Expires}
+		}
+	}
+	s.users, s.owners, s.modTime = users, owners, modTime
+}
+
+// refreshLocked re-reads the files if another process changed them.
+func (s *Store) refreshLocked() error {
+	if err := s.usage.refresh(s.usagePath()); err != nil {
+		return err
+	}
+	fi, err := os.Stat(s.Path)
+	if err == nil && fi.ModTime().Equal(s.modTime) && s.users != nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrNotExist) && s.modTime.IsZero() && s.users != nil {
+		return nil
+	}
+	return s.loadLocked()
+}
+
+// Run re-reads the files every Interval when they changed and saves the
+// usage recorded by Authorize, until ctx is cancelled.
+func (s *Store) Run(ctx context.Context) {
+	if s == nil || s.Path == "" {
+		return
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		before := s.modTime
+		err := s.refreshLocked()
+		s.err = err
+		changed := !s.modTime.Equal(before)
+		if err == nil {
+			err = s.usage.flush(s.usagePath(), s.owners)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("%v; keeping the previous keys", err)
+		} else if changed {
+			log.Printf("user keys: reloaded %s", s.Path)
+		}
+	}
+}
+
+// Err returns the error of the last load, if it failed.
+func (s *Store) Err() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// Lookup returns the user who registered the key with fingerprint, unless
+// the key has expired.
+func (s *Store) Lookup(fingerprint string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.owners[fingerprint]
+	if !ok || (Key{Expires: o.expires}).Expired(time.Now()) {
+		return "", false
+	}
+	return o.user, true
+}
+
+// Authorize returns the user who registered the key with fingerprint and
+// records that the key was used at now. It returns ErrKeyExpired for
+// expired keys and ErrKeyNotFound for keys nobody registered.
+func (s *Store) Authorize(fingerprint string, now time.Time) (string, error) {
+	if s == nil {
+		return "", ErrKeyNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.owners[fingerprint]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	if (Key{Expires: o.expires}).Expired(now) {
+		return o.user, ErrKeyExpired
+	}
+	s.usage.touch(fingerprint, now)
+	return o.user, nil
+}
+
+// List returns the keys of user, oldest first.
+func (s *Store) List(user string) ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refreshLocked(); err != nil {
+		return nil, err
+	}
+	keys := s.withUsageLocked(s.users[user])
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Added.Before(keys[j].Added) })
+	return keys, nil
+}
+
+// withUsageLocked returns a copy of keys with LastUsed set.
+func (s *Store) withUsageLocked(keys []Key) []Key {
+	out := make([]Key, len(keys))
+	for i, k := range keys {
+		if t, ok := s.usage.lastUsed[k.Fingerprint]; ok {
+			t := t
+			k.LastUsed = &t
+		}
+		out[i] = k
+	}
+	return out
+}
+
+// Reasons a key is stale.
+const (
+	// StaleExpired is a key past its expiry.
+	StaleExpired = "expired"
+	// StaleExpiring is a key expiring soon.
+	StaleExpiring = "expiring"
+	// StaleUnused is a key that wasn't used for a long time, or never since
+	// it was added a long time ago.
+	StaleUnused = "unused"
+)
+
+// StaleKey is a key flagged by a stale key report.
+type StaleKey struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+	Key
+}
+
+// Stale returns the keys that expired, expire within expiringWithin, or
+// weren't used for unusedFor at now, by user and then oldest first. A zero
+// duration skips its check.
+func (s *Store) Stale(now time.Time, unusedFor, expiringWithin time.Duration) ([]StaleKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refreshLocked(); err != nil {
+		return nil, err
+	}
+	var stale []StaleKey
+	for user, keys := range s.users {
+		for _, k := range s.withUsageLocked(keys) {
+			reason := ""
+			switch {
+			case k.Expired(now):
+				reason = StaleExpired
+			case expiringWithin > 0 && k.Expired(now.Add(expiringWithin)):
+				reason = StaleExpiring
+			case unusedFor > 0:
+				last := k.Added
+				if k.LastUsed != nil {
+					last = *k.LastUsed
+				}
+				if now.Sub(last) >= unusedFor {
+					reason = StaleUnused
+				}
+			}
+			if reason != "" {
+				stale = append(stale, StaleKey{User: user, Reason: reason, Key: k})
+			}
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].User != stale[j].User {
+			return stale[i].User < stale[j].User
+		}
+		return stale[i].Added.Before(stale[j].Added)
+	})
+	return stale, nil
+}
+
+// Add registers a public key in authorized_keys form for user until
+// expires, or without expiry if expires is zero. The title defaults to the
+// key's comment. It reports whether the key is new; a key the user already
+// has is returned as it is.
+func (s *Store) Add(user, authorizedKey, title string, expires time.Time) (Key, bool, error) {
+	if err := CheckUser(user); err != nil {
+		return Key{}, false, err
+	}
+	pub, comment, options, rest, err := xssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil || len(options) > 0 || len(bytes.TrimSpace(rest)) > 0 {
+		return Key{}, false, ErrInvalidKey
+	}
+	if _, ok := pub.(*xssh.Certificate); ok {
+		return Key{}, false, errcode.New(errcode.InvalidRequest, "certificates can't be registered")
+	}
+	if s.Allow != nil && !s.Allow(pub) {
+		return Key{}, false, errcode.Errorf(errcode.InvalidRequest, "%s keys are not permitted", pub.Type())
+	}
+	if title == "" {
+		title = comment
+	}
+	title = strings.TrimSpace(title)
+	if len(title) > maxTitleLen || strings.IndexFunc(title, unicode.IsControl) >= 0 {
+		return Key{}, false, errcode.New(errcode.InvalidRequest, "invalid title")
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if expires.IsZero() && s.MaxLifetime > 0 {
+		expires = now.Add(s.MaxLifetime)
+	}
+	if !expires.IsZero() && !expires.After(now) {
+		return Key{}, false, errcode.New(errcode.InvalidRequest, "expiry is in the past")
+	}
+	if s.MaxLifetime > 0 && expires.After(now.Add(s.MaxLifetime)) {
+		return Key{}, false, errcode.Errorf(errcode.InvalidRequest, "keys may be registered for at most %s", s.MaxLifetime)
+	}
+	key := Key{
+		Key:         strings.TrimSpace(string(xssh.MarshalAuthorizedKey(pub))),
+		Fingerprint: xssh.FingerprintSHA256(pub),
+		Title:       title,
+		Added:       now,
+	}
+	if !expires.IsZero() {
+		exp := expires.UTC().Truncate(time.Second)
+		key.Expires = &exp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refreshLocked(); err != nil {
+		return Key{}, false, err
+	}
+	if o, ok := s.owners[key.Fingerprint]; ok {
+		if o.user != user {
+			return Key{}, false, ErrKeyInUse
+		}
+		for _, k := range s.withUsageLocked(s.users[user]) {
+			if k.Fingerprint == key.Fingerprint {
+				return k, false, nil
+			}
+		}
+	}
+	if len(s.users[user]) >= MaxKeysPerUser {
+		return Key{}, false, errcode.Errorf(errcode.LimitExceeded, "at most %d keys per user", MaxKeysPerUser)
+	}
+	users := s.copyLocked()
+	users[user] = append(users[user], key)
+	if err := s.saveLocked(users); err != nil {
+		return Key{}, false, err
+	}
+	return key, true, nil
+}
+
+// Remove drops the key with fingerprint from user's keys.
+func (s *Store) Remove(user, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refreshLocked(); err != nil {
+		return err
+	}
+	if o, ok := s.owners[fingerprint]; !ok || o.user != user {
+		return ErrKeyNotFound
+	}
+	users := s.copyLocked()
+	var keys []Key
+	for _, k := range users[user] {
+		if k.Fingerprint != fingerprint {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		delete(users, user)
+	} else {
+		users[user] = keys
+	}
+	return s.saveLocked(users)
+}
+
+func (s *Store) usagePath() string {
+	if s.UsagePath != "" {
+		return s.UsagePath
+	}
+	ext := filepath.Ext(s.Path)
+	return strings.TrimSuffix(s.Path, ext) + "-usage" + ext
+}
+
+func (s *Store) copyLocked() map[string][]Key {
+	users := make(map[string][]Key, len(s.users)+1)
+	for user, keys := range s.users {
+		users[user] = append([]Key(nil), keys...)
+	}
+	return users
+}
+
+// saveLocked writes users to the file and makes them current.
+func (s *Store) saveLocked(users map[string][]Key) error {
+	data, err := json.MarshalIndent(file{Users: users}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("save user keys: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+		return fmt.Errorf("save user keys: %w", err)
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("save user keys: %w", err)
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return fmt.Errorf("save user keys: %w", err)
+	}
+	var modTime time.Time
+	if fi, err := os.Stat(s.Path); err == nil {
+		modTime = fi.ModTime()
+	}
+	s.setLocked(users, modTime)
+	return nil
+}
+
+// CheckUser reports whether user is a valid user name: printable, without
+// spaces or slashes, and at most 64 bytes long.
+func CheckUser(user string) error {
+	if user == "" || len(user) > maxUserLen || strings.IndexFunc(user, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || r == '/'
+	}) >= 0 {
+		return errcode.New(errcode.InvalidRequest, "invalid user name")
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package userkeys
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// usage tracks when keys were last used. The SSH daemon records uses in
+// memory and saves them every Interval, merging them with what other
+// daemons saved, so a fleet of SSH daemons can share one file.
+type usage struct {
+	lastUsed map[string]time.Time // by fingerprint
+	dirty    bool
+	modTime  time.Time
+}
+
+type usageFile struct {
+	LastUsed map[string]time.Time `json:"last_used"`
+}
+
+// load merges the usage file into the recorded uses. A missing file is not
+// an error.
+func (u *usage) load(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if u.lastUsed == nil {
+			u.lastUsed = make(map[string]time.Time)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read key usage: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read key usage: %w", err)
+	}
+	var f usageFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return fmt.Errorf("parse key usage %s: %w", path, err)
+	}
+	if u.lastUsed == nil {
+		u.lastUsed = make(map[string]time.Time, len(f.LastUsed))
+	}
+	for fingerprint, t := range f.LastUsed {
+		if t.After(u.lastUsed[fingerprint]) {
+			u.lastUsed[fingerprint] = t
+		}
+	}
+	u.modTime = fi.ModTime()
+	return nil
+}
+
+// refresh loads the usage file if it changed since it was last read.
+func (u *usage) refresh(path string) error {
+	fi, err := os.Stat(path)
+	if err == nil && fi.ModTime().Equal(u.modTime) && u.lastUsed != nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrNotExist) && u.lastUsed != nil {
+		return nil
+	}
+	return u.load(path)
+}
+
+func (u *usage) touch(fingerprint string, now time.Time) {
+	if u.lastUsed == nil {
+		u.lastUsed = make(map[string]time.Time)
+	}
+	now = now.UTC().Truncate(time.Second)
+	if now.After(u.lastUsed[fingerprint]) {
+		u.lastUsed[fingerprint] = now
+		u.dirty = true
+	}
+}
+
+// flush saves the recorded uses of the keys in owners, if there are new
+// ones, after merging in those other daemons saved.
+func (u *usage) flush(path string, owners map[string]owner) error {
+	if !u.dirty {
+		return nil
+	}
+	if err := u.load(path); err != nil {
+		return err
+	}
+	for fingerprint := range u.lastUsed {
+		if _, ok := owners[fingerprint]; !ok {
+			delete(u.lastUsed, fingerprint)
+		}
+	}
+	data, err := json.MarshalIndent(usageFile{LastUsed: u.lastUsed}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("save key usage: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("save key usage: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("save key usage: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("save key usage: %w", err)
+	}
+	if fi, err := os.Stat(path); err == nil {
+		u.modTime = fi.ModTime()
+	}
+	u.dirty = false
+	return nil
+}
@@ -0,0 +1,194 @@
+// Package warmup prepares busy repositories before a daemon starts serving,
+// so the first requests after a deploy don't pay for cold caches.
+package warmup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/atrest"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/repo"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/repostats"
+)
+
+// Warmer warms up repositories: it advertises their refs once, reads their
+// pack indexes, bitmaps and commit-graph into the page cache and, with a
+// Cache, leaves them open with their packs mapped.
+type Warmer struct {
+	Resolver service.RepoResolver
+	// Repos names the repositories to warm up, e.g. "group/project.git".
+	Repos []string
+	// Top adds the Top busiest repositories recorded in Stats.
+	Top   int
+	Stats *repostats.Store
+	// Cache, if set, keeps the warmed repositories open.
+	Cache   *repo.Cache
+	GitPath string
+	// Concurrency bounds the repositories warmed at once; defaults to 4.
+	Concurrency int
+}
+
+// Run warms up the configured repositories until all are done or ctx ends
+// and returns how many were warmed. Failures are logged and skipped;
+// repositories encrypted at rest are left alone.
+func (w *Warmer) Run(ctx context.Context) int {
+	names := w.names()
+	limit := w.Concurrency
+	if limit <= 0 {
+		limit = 4
+	}
+
+	var (
+		mu     sync.Mutex
+		warmed int
+		wg     sync.WaitGroup
+	)
+	sem := make(chan struct{}, limit)
+	for _, name := range names {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return warmed
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			ok, err := w.warm(ctx, name)
+			if err != nil {
+				log.Printf("warmup: %s: %v", name, err)
+			}
+			if !ok {
+				return
+			}
+			mu.Lock()
+			warmed++
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	return warmed
+}
+
+// names returns the configured repositories followed by the busiest ones,
+// without duplicates.
+func (w *Warmer) names() []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		name = strings.Trim(name, "/")
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range w.Repos {
+		add(name)
+	}
+	if w.Top > 0 && w.Stats != nil {
+		for _, s := range w.Stats.Top(w.Top) {
+			add(s.Repo)
+		}
+	}
+	return names
+}
+
+// warm warms up the repository at name and reports whether it did.
+func (w *Warmer) warm(ctx context.Context, name string) (bool, error) {
+	full, _, err := w.Resolver.Resolve(name)
+	if err != nil {
+		return false, err
+	}
+	if !service.IsRepository(full) {
+		return false, errors.New("repository not found")
+	}
+	if atrest.IsEncrypted(full) {
+		return false, nil
+	}
+
+	cmd := exec.CommandContext(ctx, w.gitPath(), "upload-pack", "--stateless-rpc", "--advertise-refs", full)
+	cmd.Stdout = io.Discard
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return false, fmt.Errorf("git upload-pack: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := readIndexes(ctx, full); err != nil {
+		return false, err
+	}
+
+	if w.Cache == nil {
+		return true, nil
+	}
+	rp, err := w.Cache.Open(full)
+	if err != nil {
+		return false, err
+	}
+	if _, err := rp.Refs(); err != nil {
+		return false, err
+	}
+	rp.HasCommitGraph()
+	// Reading HEAD's commit maps the packs; an empty repository has none.
+	if head, err := rp.ResolveRevision("HEAD"); err == nil {
+		if _, err := rp.Commit(head); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// readIndexes reads the files git consults on every fetch into the page
+// cache. Packs themselves are left to the fetches, being large.
+func readIndexes(ctx context.Context, dir string) error {
+	objects := filepath.Join(dir, "objects")
+	var files []string
+	for _, pattern := range []string{
+		filepath.Join(objects, "pack", "*.idx"),
+		filepath.Join(objects, "pack", "*.bitmap"),
+		filepath.Join(objects, "pack", "*.rev"),
+		filepath.Join(objects, "pack", "multi-pack-index"),
+		filepath.Join(objects, "info", "commit-graph"),
+		filepath.Join(objects, "info", "commit-graphs", "*.graph"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			// Maintenance may have replaced it meanwhile.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		_, err = io.Copy(io.Discard, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func (w *Warmer) gitPath() string {
+	if w.GitPath != "" {
+		return w.GitPath
+	}
+	return "git"
+}
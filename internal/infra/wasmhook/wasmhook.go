@@ -0,0 +1,388 @@
+// Package wasmhook runs the policy plugins of repositories: pre-receive and
+// update hooks compiled to WebAssembly, so tenants can have their own push
+// rules without the operator installing native code they would have to
+// trust.
+//
+// Plugins are WASI command modules, run the way git runs hooks. A
+// pre-receive plugin reads "<old> <new> <ref>" lines on its standard input;
+// an update plugin runs once per ref with the ref name, the old and the new
+// object ID as arguments. Exiting with a status other than zero declines
+// the push, with what the plugin printed shown to the client. The objects
+// of the repository, including those of the push, are mounted read-only at
+// /objects, and GIT_OBJECT_DIRECTORY, GIT_ALTERNATE_OBJECT_DIRECTORIES and
+// GIT_QUARANTINE_PATH point into it; plugins see nothing else of the host.
+// REPOCRAFT_REPO and REPOCRAFT_PUSHER name the repository and who pushes.
+//
+// Plugins are kept in the repository as policies/<hook>/<name>.wasm and
+// run in the order of their names.
+package wasmhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Hooks plugins run as.
+const (
+	PreReceive = "pre-receive"
+	Update     = "update"
+)
+
+const (
+	// dirName is the directory of the plugins in the repository.
+	dirName = "policies"
+	// objectsMount is where the repository's objects are mounted.
+	objectsMount = "/objects"
+	// MaxModuleSize bounds the size of plugins.
+	MaxModuleSize = 16 << 20
+	// DefaultMemoryLimit is the memory a plugin may use when the Runner
+	// doesn't set one.
+	DefaultMemoryLimit = 64 << 20
+	// DefaultTimeout is how long a plugin may run when the Runner doesn't
+	// set a limit.
+	DefaultTimeout = 5 * time.Second
+	// maxOutput bounds what a plugin prints that is kept.
+	maxOutput = 16 << 10
+	// pageSize is the size of a WebAssembly memory page.
+	pageSize = 64 << 10
+)
+
+// namePattern matches plugin names.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ErrNotFound is returned for plugins that don't exist.
+var ErrNotFound = errcode.New(errcode.NotFound, "policy plugin not found")
+
+// Plugin describes a policy plugin of a repository.
+type Plugin struct {
+	Name string `json:"name"`
+	// Hook is PreReceive or Update.
+	Hook     string    `json:"hook"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Modified time.Time `json:"modified"`
+}
+
+// Runner is a service.PushCheck running the policy plugins of the
+// repository pushed to, each in its own sandbox.
+type Runner struct {
+	// MemoryLimit is the memory in bytes a plugin may use, rounded down
+	// to whole pages; DefaultMemoryLimit if zero.
+	MemoryLimit int64
+	// Timeout is how long a plugin may run before it is stopped and the
+	// push declined; DefaultTimeout if zero.
+	Timeout time.Duration
+	// Logger receives plugins that fail to run; slog.Default() if nil.
+	Logger *slog.Logger
+
+	once  sync.Once
+	cache wazero.CompilationCache
+}
+
+func (r *Runner) logger() *slog.Logger {
+	if r.Logger == nil {
+		return slog.Default()
+	}
+	return r.Logger
+}
+
+// runtime returns a new runtime for one run of a plugin, sharing the
+// compiled code of earlier runs.
+func (r *Runner) runtime(ctx context.Context) (wazero.Runtime, error) {
+	r.once.Do(func() {
+		r.cache = wazero.NewCompilationCache()
+	})
+	limit := r.MemoryLimit
+	if limit <= 0 {
+		limit = DefaultMemoryLimit
+	}
+	config := wazero.NewRuntimeConfig().
+		WithCompilationCache(r.cache).
+		WithMemoryLimitPages(uint32(limit / pageSize)).
+		WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(ctx, config)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	return rt, nil
+}
+
+// compile compiles module in rt and checks it is a WASI command that
+// imports nothing but WASI.
+func compile(ctx context.Context, rt wazero.Runtime, module []byte) (wazero.CompiledModule, error) {
+	compiled, err := rt.CompileModule(ctx, module)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := compiled.ExportedFunctions()["_start"]; !ok {
+		return nil, errors.New("not a WASI command: _start isn't exported")
+	}
+	for _, f := range compiled.ImportedFunctions() {
+		if mod, name, _ := f.Import(); mod != wasi_snapshot_preview1.ModuleName {
+			return nil, fmt.Errorf("imports %s.%s; only %s is available", mod, name, wasi_snapshot_preview1.ModuleName)
+		}
+	}
+	return compiled, nil
+}
+
+// run runs a plugin and returns its exit status and what it printed.
+func (r *Runner) run(ctx context.Context, file string, args []string, stdin []byte, env []string, objects string) (uint32, string, error) {
+	module, err := os.ReadFile(file)
+	if err != nil {
+		return 0, "", err
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rt, err := r.runtime(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rt.Close(context.Background())
+	compiled, err := compile(ctx, rt, module)
+	if err != nil {
+		return 0, "", err
+	}
+	out := &limitedBuffer{max: maxOutput}
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(args...).
+		WithStdin(bytes.NewReader(stdin)).
+		WithStdout(out).
+		WithStderr(out).
+		WithFSConfig(wazero.NewFSConfig().WithReadOnlyDirMount(objects, objectsMount)).
+		WithSysWalltime().
+		WithSysNanotime()
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		config = config.WithEnv(k, v)
+	}
+	_, err = rt.InstantiateModule(ctx, compiled, config)
+	var exit *sys.ExitError
+	switch {
+	case err == nil:
+		return 0, out.String(), nil
+	case errors.As(err, &exit) && exit.ExitCode() == sys.ExitCodeDeadlineExceeded:
+		return 0, out.String(), fmt.Errorf("ran longer than %v", timeout)
+	case errors.As(err, &exit) && exit.ExitCode() != sys.ExitCodeContextCanceled:
+		return exit.ExitCode(), out.String(), nil
+	}
+	return 0, out.String(), err
+}
+
+// CheckPush runs the pre-receive plugins of the repository on the push,
+// then its update plugins on each ref, and declines the push at the first
+// plugin that exits with an error or fails.
+func (r *Runner) CheckPush(ctx context.Context, req service.ServiceRequest, env []string, updates []service.PushCommand) error {
+	plugins, err := List(req.RepoPath)
+	if err != nil {
+		r.logger().Error("read policy plugins", "repo", req.RepoName, "error", err)
+		return errcode.New(errcode.Unavailable, "the policy plugins of this repository can't be read, try again later")
+	}
+	if len(plugins) == 0 {
+		return nil
+	}
+	objects := filepath.Join(req.RepoPath, "objects")
+	vars := []string{"REPOCRAFT_REPO=" + req.RepoName, "REPOCRAFT_PUSHER=" + req.Identity}
+	for _, kv := range env {
+		if k, v, _ := strings.Cut(kv, "="); v != "" {
+			vars = append(vars, k+"="+guestPaths(objects, v))
+		}
+	}
+	var stdin bytes.Buffer
+	for _, u := range updates {
+		fmt.Fprintf(&stdin, "%s %s %s\n", u.Old, u.New, u.Ref)
+	}
+	for _, hook := range []string{PreReceive, Update} {
+		for _, p := range plugins {
+			if p.Hook != hook {
+				continue
+			}
+			file := filepath.Join(req.RepoPath, dirName, p.Hook, p.Name+".wasm")
+			if hook == PreReceive {
+				if err := r.check(ctx, req, p, file, []string{p.Name}, stdin.Bytes(), vars, objects); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, u := range updates {
+				if err := r.check(ctx, req, p, file, []string{p.Name, u.Ref, u.Old, u.New}, nil, vars, objects); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// check runs a plugin and returns the error declining the push, if any.
+func (r *Runner) check(ctx context.Context, req service.ServiceRequest, p Plugin, file string, args []string, stdin []byte, env []string, objects string) error {
+	status, output, err := r.run(ctx, file, args, stdin, env, objects)
+	output = strings.TrimSpace(output)
+	switch {
+	case err != nil:
+		r.logger().Error("policy plugin failed", "repo", req.RepoName, "hook", p.Hook, "plugin", p.Name, "error", err)
+		return errcode.Errorf(errcode.AccessDenied, "policy %s failed: %v", p.Name, err)
+	case status == 0:
+		return nil
+	case output == "":
+		return errcode.Errorf(errcode.AccessDenied, "policy %s declined this push", p.Name)
+	}
+	return errcode.Errorf(errcode.AccessDenied, "policy %s declined this push:\n%s", p.Name, output)
+}
+
+// guestPaths rewrites a list of paths in the host's objects directory to
+// where plugins see them; paths outside of it are left out.
+func guestPaths(objects, list string) string {
+	var paths []string
+	for _, p := range filepath.SplitList(list) {
+		rel, err := filepath.Rel(objects, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		paths = append(paths, path.Join(objectsMount, filepath.ToSlash(rel)))
+	}
+	return strings.Join(paths, ":")
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// List returns the policy plugins of the repository in dir, pre-receive
+// plugins first, each hook's in the order they run.
+func List(dir string) ([]Plugin, error) {
+	var plugins []Plugin
+	for _, hook := range []string{PreReceive, Update} {
+		entries, err := os.ReadDir(filepath.Join(dir, dirName, hook))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			name, ok := strings.CutSuffix(e.Name(), ".wasm")
+			if !ok || !e.Type().IsRegular() || !namePattern.MatchString(name) {
+				continue
+			}
+			file := filepath.Join(dir, dirName, hook, e.Name())
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(data)
+			plugins = append(plugins, Plugin{Name: name, Hook: hook, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), Modified: info.ModTime().UTC()})
+		}
+	}
+	// "pre-receive" sorts before "update".
+	sort.Slice(plugins, func(i, j int) bool {
+		if plugins[i].Hook != plugins[j].Hook {
+			return plugins[i].Hook < plugins[j].Hook
+		}
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins, nil
+}
+
+// checkName reports what is wrong with a plugin's hook and name.
+func checkName(hook, name string) error {
+	if hook != PreReceive && hook != Update {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid hook %q, want pre-receive or update", hook)
+	}
+	if !namePattern.MatchString(name) {
+		return errcode.New(errcode.InvalidRequest, "missing or invalid plugin name; use letters, digits, dots, dashes and underscores")
+	}
+	return nil
+}
+
+// Save adds module to the repository in dir as the plugin name of hook, or
+// replaces the plugin of that name. Modules that aren't WASI commands, or
+// that don't fit in the memory limit, are refused.
+func (r *Runner) Save(ctx context.Context, dir, hook, name string, module []byte) error {
+	if err := checkName(hook, name); err != nil {
+		return err
+	}
+	if len(module) > MaxModuleSize {
+		return errcode.Errorf(errcode.TooLarge, "plugins are limited to %d MiB", MaxModuleSize>>20)
+	}
+	rt, err := r.runtime(ctx)
+	if err != nil {
+		return err
+	}
+	defer rt.Close(context.Background())
+	if _, err := compile(ctx, rt, module); err != nil {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid plugin: %v", err)
+	}
+	hookDir := filepath.Join(dir, dirName, hook)
+	if err := os.MkdirAll(hookDir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(hookDir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(module); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(hookDir, name+".wasm"))
+}
+
+// Remove removes the plugin name of hook from the repository in dir.
+func Remove(dir, hook, name string) error {
+	if err := checkName(hook, name); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(dir, dirName, hook, name+".wasm"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/git/service"
+)
+
+// Headers of deliveries.
+const (
+	EventHeader     = "Repocraft-Event"
+	DeliveryHeader  = "Repocraft-Delivery"
+	SignatureHeader = "Repocraft-Signature" // "sha256=" and the hex HMAC-SHA256 of the body
+)
+
+// Update is a ref update in a Payload. Old is the zero object ID when the
+// ref was created, New when it was deleted.
+type Update struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Payload is the body of a delivery.
+type Payload struct {
+	Event   string    `json:"event"`
+	Repo    string    `json:"repo"`
+	Pusher  string    `json:"pusher,omitempty"`
+	Time    time.Time `json:"time"`
+	Updates []Update  `json:"updates"`
+}
+
+type delivery struct {
+	hook    Hook
+	id      string
+	payload []byte
+	event   string
+}
+
+// Dispatcher sends the pushes of repositories to their webhooks. It is a
+// service.ReferenceTransactions: once git commits the updates of a push,
+// each webhook gets one delivery per event it subscribes to, holding the
+// updates that pass its filters. Deliveries are sent in the background by
+// Run and retried on failure.
+type Dispatcher struct {
+	// Egress restricts where deliveries go; the zero Egress applies when
+	// nil.
+	Egress *Egress
+	// Client sends the deliveries; defaults to one of Egress with a 10
+	// second timeout.
+	Client *http.Client
+	// Attempts per delivery; defaults to 3.
+	Attempts int
+	// Workers sending deliveries, so that a slow endpoint doesn't hold up
+	// the others; defaults to 4.
+	Workers int
+	// QueueSize bounds the deliveries waiting to be sent; more are
+	// dropped. Defaults to 1000.
+	QueueSize int
+
+	once  sync.Once
+	queue chan delivery
+}
+
+func (d *Dispatcher) init() {
+	d.once.Do(func() {
+		size := d.QueueSize
+		if size <= 0 {
+			size = 1000
+		}
+		d.queue = make(chan delivery, size)
+		if d.Egress == nil {
+			d.Egress = &Egress{}
+		}
+		if d.Client == nil {
+			d.Client = d.Egress.Client(10 * time.Second)
+		}
+	})
+}
+
+// Prepare accepts every update and queues the deliveries once git commits
+// them.
+func (d *Dispatcher) Prepare(ctx context.Context, req service.ServiceRequest, updates []service.PushCommand) (service.PreparedTransaction, error) {
+	return &transaction{d: d, req: req, updates: updates}, nil
+}
+
+type transaction struct {
+	d       *Dispatcher
+	req     service.ServiceRequest
+	updates []service.PushCommand
+}
+
+func (t *transaction) Commit(ctx context.Context) error {
+	hooks, err := Read(ctx, t.req.RepoPath)
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	head := defaultBranch(t.req.RepoPath)
+	now := time.Now().UTC()
+	for _, h := range hooks {
+		byEvent := make(map[string][]Update)
+		for _, u := range t.updates {
+			event, ok := EventOf(u.Ref)
+			if ok && h.Subscribes(event) && h.Matches(u.Ref, head) {
+				byEvent[event] = append(byEvent[event], Update{Ref: u.Ref, Old: u.Old, New: u.New})
+			}
+		}
+		for _, event := range Events {
+			if updates := byEvent[event]; len(updates) > 0 {
+				t.d.enqueue(h, Payload{Event: event, Repo: t.req.RepoName, Pusher: t.req.Identity, Time: now, Updates: updates})
+			}
+		}
+	}
+	return nil
+}
+
+func (t *transaction) Abort(ctx context.Context) error { return nil }
+
+func (d *Dispatcher) enqueue(h Hook, p Payload) {
+	d.init()
+	body, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	dl := delivery{hook: h, id: hex.EncodeToString(id), payload: body, event: p.Event}
+	select {
+	case d.queue <- dl:
+	default:
+		log.Printf("webhook %s of %s: queue full, dropped %s delivery %s", h.Name, p.Repo, p.Event, dl.id)
+	}
+}
+
+// Run sends queued deliveries until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.init()
+	workers := d.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case dl := <-d.queue:
+					d.deliver(ctx, dl)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver sends dl, retrying with growing pauses until it is accepted with
+// a 2xx status or the attempts run out.
+func (d *Dispatcher) deliver(ctx context.Context, dl delivery) {
+	attempts := d.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	pause := time.Second
+	for attempt := 1; ; attempt++ {
+		err := d.send(ctx, dl)
+		if err == nil {
+			return
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			log.Printf("webhook %s: %s delivery %s failed after %d attempts: %v", dl.hook.Name, dl.event, dl.id, attempt, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pause):
+		}
+		pause *= 4
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, dl delivery) error {
+	d.init()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.hook.URL, bytes.NewReader(dl.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "repocraft-webhook")
+	req.Header.Set(EventHeader, dl.event)
+	req.Header.Set(DeliveryHeader, dl.id)
+	if dl.hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(dl.hook.Secret))
+		mac.Write(dl.payload)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	if err := d.Egress.CheckURL(ctx, req.URL); err != nil {
+		return err
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", dl.hook.URL, resp.Status)
+	}
+	return nil
+}
+
+// defaultBranch returns the ref HEAD of the repository at dir points to.
+func defaultBranch(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	ref, _ := strings.CutPrefix(strings.TrimSpace(string(data)), "ref: ")
+	return ref
+}
@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// internalPrefixes are the addresses webhooks may not reach by default:
+// loopback, private, link-local (including cloud metadata services),
+// carrier-grade NAT, unspecified and multicast addresses.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// ErrDestinationDenied is returned for deliveries to addresses the egress
+// policy blocks.
+var ErrDestinationDenied = errors.New("destination denied by the webhook egress policy")
+
+// Egress decides where webhook deliveries may go and how. The zero Egress
+// connects directly, verifies TLS certificates against the system roots
+// and blocks internal addresses, so that webhooks can't be aimed at the
+// server's own network.
+type Egress struct {
+	// Proxy, if set, is the HTTP proxy every delivery goes through.
+	// Destinations are then checked before the request is sent, with the
+	// addresses their names resolve to here.
+	Proxy *url.URL
+	// Allow are address ranges reachable even though they are blocked,
+	// e.g. the network of an internal CI server.
+	Allow []netip.Prefix
+	// Block are address ranges blocked in addition to the internal ones.
+	Block []netip.Prefix
+	// AllowInternal lifts the block of internal addresses.
+	AllowInternal bool
+	// HTTPSOnly refuses webhook URLs that aren't https.
+	HTTPSOnly bool
+	// RootCAs, if set, replaces the system roots deliveries are verified
+	// against. Certificates are always verified.
+	RootCAs *x509.CertPool
+	// TLS, if set, adjusts the TLS configuration further, e.g. to a crypto
+	// policy.
+	TLS func(*tls.Config)
+}
+
+// ParseCIDRs parses comma-separated address ranges such as
+// "10.1.0.0/16,fd00::/8".
+func ParseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// LoadRootCAs reads PEM certificates from file into a pool.
+func LoadRootCAs(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates", file)
+	}
+	return pool, nil
+}
+
+// Permits reports whether deliveries may reach addr.
+func (e *Egress) Permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range e.Allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	for _, p := range e.Block {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if !e.AllowInternal {
+		for _, p := range internalPrefixes {
+			if p.Contains(addr) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CheckURL reports what keeps deliveries to the webhook URL u from being
+// sent.
+func (e *Egress) CheckURL(ctx context.Context, u *url.URL) error {
+	if e.HTTPSOnly && u.Scheme != "https" {
+		return fmt.Errorf("%s: the webhook egress policy requires https", u.Redacted())
+	}
+	if e.Proxy == nil {
+		// Addresses are checked as they are dialed, which also covers
+		// names resolving differently later.
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !e.Permits(addr) {
+			return fmt.Errorf("%s (%s): %w", u.Hostname(), addr.Unmap(), ErrDestinationDenied)
+		}
+	}
+	return nil
+}
+
+// Client returns an HTTP client sending deliveries under the policy. It
+// doesn't follow redirects, which could lead anywhere.
+func (e *Egress) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if e.Proxy == nil {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !e.Permits(ap.Addr()) {
+				return fmt.Errorf("%s: %w", ap.Addr(), ErrDestinationDenied)
+			}
+			return nil
+		}
+	}
+	tlsConfig := &tls.Config{RootCAs: e.RootCAs, MinVersion: tls.VersionTLS12}
+	if e.TLS != nil {
+		e.TLS(tlsConfig)
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if e.Proxy != nil {
+		transport.Proxy = http.ProxyURL(e.Proxy)
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
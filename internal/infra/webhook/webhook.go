@@ -0,0 +1,223 @@
+// Package webhook notifies HTTP endpoints of the pushes to a repository.
+//
+// A repository has any number of webhooks, each a section of its git
+// config with its own URL, secret, events and filters:
+//
+//	[webhook "ci"]
+//		url = https://ci.example.com/hooks/repocraft
+//		secret = s3cret
+//		event = push
+//		event = tag
+//		ref = refs/heads/release/*
+//		defaultBranch = true
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/repocraft-project/repocraft-server-go/internal/infra/errcode"
+)
+
+// Events a webhook subscribes to.
+const (
+	// EventPush is sent for branch updates, creations and deletions.
+	EventPush = "push"
+	// EventTag is sent for tags created, moved or deleted.
+	EventTag = "tag"
+)
+
+// Events are the known events.
+var Events = []string{EventPush, EventTag}
+
+// section is the git config section of webhooks.
+const section = "webhook"
+
+// Hook is a webhook of a repository.
+type Hook struct {
+	// Name tells the webhooks of a repository apart, e.g. "ci".
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret keys the signature of deliveries; they are unsigned without.
+	Secret string `json:"secret,omitempty"`
+	// Events subscribed to; every event when empty.
+	Events []string `json:"events,omitempty"`
+	// Refs are patterns such as "refs/heads/release/*" of the refs whose
+	// updates are sent, with * also matching slashes; every ref when empty.
+	Refs []string `json:"refs,omitempty"`
+	// DefaultBranch only sends updates of the branch HEAD points to.
+	DefaultBranch bool `json:"default_branch,omitempty"`
+}
+
+// Check reports what is wrong with h.
+func (h Hook) Check() error {
+	if h.Name == "" || strings.ContainsAny(h.Name, "\"\\\n\x00") {
+		return errcode.New(errcode.InvalidRequest, "missing or invalid webhook name")
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid webhook url %q", h.URL)
+	}
+	for _, e := range h.Events {
+		if e != EventPush && e != EventTag {
+			return errcode.Errorf(errcode.InvalidRequest, "unknown event %q; known are %s", e, strings.Join(Events, ", "))
+		}
+	}
+	for _, ref := range h.Refs {
+		if _, err := path.Match(unslash(ref), ""); err != nil || !strings.HasPrefix(ref, "refs/") {
+			return errcode.Errorf(errcode.InvalidRequest, "invalid ref pattern %q", ref)
+		}
+	}
+	return nil
+}
+
+// Subscribes reports whether h is sent event.
+func (h Hook) Subscribes(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether updates of ref are sent to h, in a repository
+// whose HEAD points to head.
+func (h Hook) Matches(ref, head string) bool {
+	if h.DefaultBranch && ref != head {
+		return false
+	}
+	if len(h.Refs) == 0 {
+		return true
+	}
+	for _, pattern := range h.Refs {
+		if ok, _ := path.Match(unslash(pattern), unslash(ref)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// unslash lets * in path.Match patterns match slashes, as it does in
+// freeze windows.
+func unslash(s string) string {
+	return strings.ReplaceAll(s, "/", "\x00")
+}
+
+// EventOf returns the event an update of ref belongs to, if any.
+func EventOf(ref string) (string, bool) {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return EventPush, true
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return EventTag, true
+	}
+	return "", false
+}
+
+// Read returns the webhooks of the repository at dir, by name.
+func Read(ctx context.Context, dir string) ([]Hook, error) {
+	out, err := exec.CommandContext(ctx, "git", "config", "--file", filepath.Join(dir, "config"), "--null", "--get-regexp", `^`+section+`\.`).Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		// No webhooks.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read webhooks: %w", err)
+	}
+	hooks := make(map[string]*Hook)
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		key, value, _ := strings.Cut(string(entry), "\n")
+		rest, _ := strings.CutPrefix(key, section+".")
+		i := strings.LastIndexByte(rest, '.')
+		if i < 0 {
+			continue
+		}
+		name, variable := rest[:i], rest[i+1:]
+		h := hooks[name]
+		if h == nil {
+			h = &Hook{Name: name}
+			hooks[name] = h
+		}
+		switch variable {
+		case "url":
+			h.URL = value
+		case "secret":
+			h.Secret = value
+		case "event":
+			h.Events = append(h.Events, value)
+		case "ref":
+			h.Refs = append(h.Refs, value)
+		case "defaultbranch":
+			h.DefaultBranch = value == "true"
+		}
+	}
+	list := make([]Hook, 0, len(hooks))
+	for _, h := range hooks {
+		if h.URL != "" {
+			list = append(list, *h)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Save adds h to the repository at dir, replacing the webhook of the same
+// name.
+func Save(ctx context.Context, dir string, h Hook) error {
+	if err := h.Check(); err != nil {
+		return err
+	}
+	if err := Remove(ctx, dir, h.Name); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	name := section + "." + h.Name + "."
+	set := [][2]string{{name + "url", h.URL}}
+	if h.Secret != "" {
+		set = append(set, [2]string{name + "secret", h.Secret})
+	}
+	for _, e := range h.Events {
+		set = append(set, [2]string{name + "event", e})
+	}
+	for _, ref := range h.Refs {
+		set = append(set, [2]string{name + "ref", ref})
+	}
+	if h.DefaultBranch {
+		set = append(set, [2]string{name + "defaultBranch", "true"})
+	}
+	for _, kv := range set {
+		if err := gitConfig(ctx, dir, "--add", kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrNotFound is returned for webhooks that don't exist.
+var ErrNotFound = errcode.New(errcode.NotFound, "webhook not found")
+
+// Remove removes the named webhook from the repository at dir.
+func Remove(ctx context.Context, dir, name string) error {
+	err := gitConfig(ctx, dir, "--remove-section", section+"."+name)
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 128 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func gitConfig(ctx context.Context, dir string, args ...string) error {
+	return exec.CommandContext(ctx, "git", append([]string{"config", "--file", filepath.Join(dir, "config")}, args...)...).Run()
+}